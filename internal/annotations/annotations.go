@@ -14,16 +14,176 @@ License.
 
 package annotations
 
+import (
+	"strings"
+)
+
 // This file contains constants for frequently used annotations.
 
 // BundleFile is the annotation that contains the name of the bundle file.
 const BundleFile = prefix + "/bundle-file"
 
+// BundleDir is the annotation that contains the name of a directory containing multiple bundle
+// files. It is used together with the BundleVersion annotation.
+const BundleDir = prefix + "/bundle-dir"
+
+// BundleVersion is the annotation that contains the version of the bundle that should be selected
+// from the bundles available in the directory specified by the BundleDir annotation.
+const BundleVersion = prefix + "/bundle-version"
+
+// BundleDigest contains the expected SHA-256 digest of the bundle, for example 'sha256:3a4c...'.
+// The extractor uses it to check that the bundle wasn't corrupted before extracting it.
+const BundleDigest = prefix + "/bundle-digest"
+
+// BundleURL contains the URL where the extractors can download the bundle directly, for example
+// 's3://bundles/4.12.3.tar' for a bundle stored in an S3 compatible object store. When this is
+// specified the bundle server isn't used.
+const BundleURL = prefix + "/bundle-url"
+
+// BundleURLSecret contains the name of the secret, in the namespace of the controller, that
+// contains the credentials used to download the bundle from the URL specified in the BundleURL
+// annotation. The keys of the secret are 'access-key-id', 'secret-access-key' and optionally
+// 'session-token', 'endpoint' and 'region'.
+const BundleURLSecret = prefix + "/bundle-url-secret"
+
+// Streaming indicates if the bundle extractors should extract the bundle while it is downloaded,
+// without saving it to a file, so that they need half the disk space. The value should be 'true'
+// or 'false'. Note that nodes that replicate the bundle always save it to a file.
+const Streaming = prefix + "/streaming"
+
+// Paused indicates if the controller should stop starting new jobs to extract the bundle or load
+// the images, and stop from requesting the upgrade. The value should be 'true' or 'false'. The jobs
+// that are already running finish, and the upgrade continues from where it was when the value is
+// changed to 'false' or the annotation is removed.
+const Paused = prefix + "/paused"
+
+// Force indicates if the upgrade should be requested to the cluster version operator as a forced
+// upgrade, skipping the verification of the signature of the release image and the preconditions.
+// The value should be 'true' or 'false'.
+const Force = prefix + "/force"
+
+// AllowUnsupportedUpdate indicates if the upgrade should be requested even if the update graph
+// contained in the bundle doesn't have an edge from the current version to the version of the
+// bundle. The value should be 'true' or 'false'.
+const AllowUnsupportedUpdate = prefix + "/allow-unsupported-update"
+
 // FundleMetadata contains the metadata of the bundle, except the list of images.
 const BundleMetadata = prefix + "/bundle-metadata"
 
 // Progress contains information about the progress of the upgrade.
 const Progress = prefix + "/progress"
 
+// ProgressDetails contains the same information than the Progress annotation, but in JSON format
+// so that it can be used by other tools: the current phase, the number of bytes processed, the
+// total number of bytes and the percentage.
+const ProgressDetails = prefix + "/progress-details"
+
+// Error contains the description of the problem that prevents the programs running in the node
+// from completing their task, for example lack of disk space to extract the bundle. It is removed
+// when the task completes successfully.
+const Error = prefix + "/error"
+
+// LogLevel contains the log level that the programs running in the node should use. The value can
+// be a non negative integer or one of the names 'info', 'debug' or 'trace'.
+const LogLevel = prefix + "/log-level"
+
+// ImageStore contains the details of the image storage where the bundle loader added the images:
+// the graph root, the number of images and blobs added and the number of bytes consumed. This is
+// intended for debugging.
+const ImageStore = prefix + "/image-store"
+
+// PullOrder contains the strategy that the bundle loader uses to decide the order of image pulls.
+// The value can be 'default', 'size' or 'priority'.
+const PullOrder = prefix + "/pull-order"
+
+// PullPriority contains a comma separated list of image names, for example 'etcd,hyperkube', that
+// the bundle loader pulls first when the pull order is 'priority'.
+const PullPriority = prefix + "/pull-priority"
+
+// PullConcurrency contains the maximum number of images that the bundle loader pulls in parallel,
+// for example '4'.
+const PullConcurrency = prefix + "/pull-concurrency"
+
+// PullTimeout contains the maximum time that a single attempt of the bundle loader to pull an image
+// can take, for example '5m'.
+const PullTimeout = prefix + "/pull-timeout"
+
+// PullAttempts contains the number of times that the bundle loader tries to pull an image before
+// marking the node as failed, for example '5'.
+const PullAttempts = prefix + "/pull-attempts"
+
+// LoadTimeout contains the maximum time that the bundle loader can take to pull all the images,
+// for example '1h'.
+const LoadTimeout = prefix + "/load-timeout"
+
+// LoadMode contains the mode that the bundle loader uses to load the images into CRI-O. The value
+// can be 'pull', to pull the images from a temporary registry, or 'copy', to copy them directly
+// from the bundle directory into the container storage.
+const LoadMode = prefix + "/load-mode"
+
+// KeepBundle indicates if the bundle loaders should keep the extracted bundle after loading the
+// images, so that they can be loaded again without transferring the bundle. The value should be
+// 'true' or 'false'. The bundle is removed anyhow by the bundle cleaner.
+const KeepBundle = prefix + "/keep-bundle"
+
+// RoleFilter indicates if the bundle loaders should load only the images needed by the roles of
+// the node, for example skipping the images that are only used in control plane nodes when the
+// node is a worker. The value should be 'true' or 'false'.
+const RoleFilter = prefix + "/role-filter"
+
+// LoaderMetricsFile contains the file where the bundle loaders write the image pull metrics in the
+// Prometheus text format, for example '/var/node_exporter/textfile/upgrade_tool_loader.prom'.
+const LoaderMetricsFile = prefix + "/loader-metrics-file"
+
+// RegistryCertSecret contains the name of the secret, in the namespace of the controller, that
+// contains the TLS certificate and key used by the registries that the bundle loaders start to
+// serve the images to CRI-O. The secret should be of type 'kubernetes.io/tls', with the 'tls.crt'
+// and 'tls.key' keys. When not specified the loaders generate a self signed certificate.
+const RegistryCertSecret = prefix + "/registry-cert-secret"
+
+// RegistryMetricsAddress contains the address where the registries that the bundle loaders start
+// serve their Prometheus metrics, for example ':9101'. Note that the loaders use the network of
+// the host, so this needs to be a port that is free in all the nodes.
+const RegistryMetricsAddress = prefix + "/registry-metrics-address"
+
+// History contains the history of the upgrades of a node, as a JSON array with the version,
+// release and time of each upgrade. The bundle cleaner adds an entry when it finishes, and it is
+// the only annotation of the tool that the cleaner doesn't remove.
+const History = prefix + "/history"
+
+// ExtractorRetries contains the number of times that the controller has created again the bundle
+// extractor job of a node because it failed, for example '2'.
+const ExtractorRetries = prefix + "/extractor-retries"
+
+// LoaderRetries contains the number of times that the controller has created again the bundle
+// loader job of a node because it failed, for example '2'.
+const LoaderRetries = prefix + "/loader-retries"
+
+// AgentCommand contains the command line, as a JSON array, that the bundle agent running in the
+// node should execute, for example '["bundle-extractor","--node=node0",...]'. It is written by the
+// controller when it runs in daemon set mode, and only the bundle extractor and the bundle loader
+// are allowed.
+const AgentCommand = prefix + "/agent-command"
+
+// AgentCompleted contains the SHA-256 digest of the value of the AgentCommand annotation when the
+// bundle agent completed it successfully, so that it isn't executed again.
+const AgentCompleted = prefix + "/agent-completed"
+
+// PoolPaused indicates that the controller paused the machine config pool because nodes joined
+// the cluster while the upgrade was in progress, and that it should resume it when those nodes
+// have the bundle. The value should be 'true'. Pools that don't have it are never resumed by the
+// controller.
+const PoolPaused = prefix + "/pool-paused"
+
+// Generation contains the generation of the object that was used to generate the object that has
+// this annotation, for example the generation of the ManagedClusterUpgrade that was used to
+// generate a ManifestWork, so that it is updated only when the generation changes.
+const Generation = prefix + "/generation"
+
+// Owned checks if the given annotation is one of the annotations of the tool.
+func Owned(name string) bool {
+	return strings.HasPrefix(name, prefix+"/")
+}
+
 // prefix is the prefix for all the annotations.
 const prefix = "upgrade-tool"
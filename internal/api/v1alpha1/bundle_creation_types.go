@@ -0,0 +1,122 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BundleCreation requests the creation of an upgrade bundle inside the cluster.
+type BundleCreation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BundleCreationSpec   `json:"spec,omitempty"`
+	Status BundleCreationStatus `json:"status,omitempty"`
+}
+
+// BundleCreationSpec describes the bundle that should be created.
+type BundleCreationSpec struct {
+	// Version is the OpenShift version of the bundle, for example '4.13.4'.
+	Version string `json:"version"`
+
+	// Arch is the architecture of the bundle, for example 'x86_64'.
+	Arch string `json:"arch"`
+
+	// PullSecret is a reference to a secret of type 'kubernetes.io/dockerconfigjson' that
+	// contains the credentials needed to pull the images.
+	PullSecret corev1.LocalObjectReference `json:"pullSecret"`
+
+	// Storage describes where the resulting bundle will be stored.
+	Storage BundleCreationStorage `json:"storage"`
+
+	// Image is the image that contains the upgrade tool. This is optional and the default is
+	// the image used by the controller.
+	Image string `json:"image,omitempty"`
+}
+
+// BundleCreationStorage describes where the bundle will be stored. Exactly one of the persistent
+// volume claim and the object store must be specified.
+type BundleCreationStorage struct {
+	// PersistentVolumeClaim is a reference to the persistent volume claim where the bundle
+	// will be written.
+	PersistentVolumeClaim *corev1.PersistentVolumeClaimVolumeSource `json:"persistentVolumeClaim,omitempty"`
+
+	// ObjectStore describes the S3 compatible object store where the bundle will be uploaded.
+	ObjectStore *BundleCreationObjectStore `json:"objectStore,omitempty"`
+
+	// Path is the directory inside the volume where the bundle will be written. This is
+	// optional and the default is the root of the volume. It isn't used for the object store,
+	// as its URL already contains the directory.
+	Path string `json:"path,omitempty"`
+}
+
+// BundleCreationObjectStore describes the S3 compatible object store where the bundle will be
+// uploaded.
+type BundleCreationObjectStore struct {
+	// URL is the URL of the directory where the bundle will be uploaded, for example
+	// 's3://bundles/4.13'.
+	URL string `json:"url"`
+
+	// Secret is a reference to the secret that contains the credentials needed to upload the
+	// bundle. The keys of the secret are 'access-key-id', 'secret-access-key' and optionally
+	// 'session-token', 'endpoint' and 'region'.
+	Secret *corev1.LocalObjectReference `json:"secret,omitempty"`
+}
+
+// BundleCreationPhase indicates the phase of a bundle creation.
+type BundleCreationPhase string
+
+const (
+	BundleCreationPending   BundleCreationPhase = "Pending"
+	BundleCreationRunning   BundleCreationPhase = "Running"
+	BundleCreationSucceeded BundleCreationPhase = "Succeeded"
+	BundleCreationFailed    BundleCreationPhase = "Failed"
+)
+
+// BundleCreationStatus describes the progress of the bundle creation.
+type BundleCreationStatus struct {
+	// Phase is the current phase of the bundle creation.
+	Phase BundleCreationPhase `json:"phase,omitempty"`
+
+	// Message is a human readable description of the current state.
+	Message string `json:"message,omitempty"`
+
+	// Job is the name of the job that runs the bundle creator.
+	Job string `json:"job,omitempty"`
+
+	// BundleFile is the location of the bundle file inside the storage, once it has been
+	// created. For the object store this is the URL of the bundle object.
+	BundleFile string `json:"bundleFile,omitempty"`
+
+	// StartTime is the time when the job started.
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is the time when the job finished.
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// BundleCreationList is a list of bundle creations.
+type BundleCreationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []BundleCreation `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BundleCreation{}, &BundleCreationList{})
+}
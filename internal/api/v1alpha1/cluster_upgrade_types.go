@@ -0,0 +1,385 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// ClusterUpgrade requests the upgrade of the cluster to a version using a bundle. The controller
+// distributes the bundle to the nodes, loads the images and then requests the upgrade to the
+// cluster version operator.
+type ClusterUpgrade struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterUpgradeSpec   `json:"spec,omitempty"`
+	Status ClusterUpgradeStatus `json:"status,omitempty"`
+}
+
+// ClusterUpgradeSpec describes the desired upgrade.
+type ClusterUpgradeSpec struct {
+	// Version is the OpenShift version that the cluster will be upgraded to, for example
+	// '4.13.4'.
+	Version string `json:"version"`
+
+	// Arch is the architecture of the bundle, for example 'x86_64'. This is optional, but when
+	// it is specified the upgrade will be rejected if the nodes of the cluster have a different
+	// architecture that isn't covered by one of the architecture specific bundles.
+	Arch string `json:"arch,omitempty"`
+
+	// Bundle describes where the bundle containing the version can be found. When the cluster
+	// has nodes with different architectures and the bundle is a directory, each node will use
+	// the bundle of the directory that has its architecture.
+	Bundle ClusterUpgradeBundle `json:"bundle"`
+
+	// ArchBundles contains the bundles for the nodes whose architecture is different to the
+	// architecture of the main bundle, for clusters that have nodes with different
+	// architectures. Note that all the bundles need to be created from the same multi
+	// architecture release.
+	ArchBundles []ClusterUpgradeArchBundle `json:"archBundles,omitempty"`
+
+	// Rollout describes how the bundle is distributed to the nodes.
+	Rollout ClusterUpgradeRollout `json:"rollout,omitempty"`
+
+	// Paused indicates that the controller should not start new jobs to extract the bundle or
+	// load the images, and that it should not request the upgrade. The jobs that are already
+	// running will finish, and when this is set to false again the upgrade will continue from
+	// where it was. Note that this has no effect once the upgrade has been requested to the
+	// cluster version operator.
+	Paused bool `json:"paused,omitempty"`
+
+	// Schedule describes the maintenance windows when the upgrade can progress. Outside of
+	// them the upgrade behaves as if it were paused: no new jobs are started and the upgrade
+	// isn't requested to the cluster version operator. This is optional and the default is to
+	// progress at any time.
+	Schedule *ClusterUpgradeSchedule `json:"schedule,omitempty"`
+
+	// SkipPreflightChecks indicates that the controller should start the upgrade even if the
+	// checks of the health of the cluster that it runs before starting fail. This is intended
+	// for emergencies only, when the upgrade itself is the fix for the problem detected by the
+	// checks.
+	SkipPreflightChecks bool `json:"skipPreflightChecks,omitempty"`
+
+	// Force indicates that the upgrade should be requested to the cluster version operator as
+	// a forced upgrade, so that it skips the verification of the signature of the release image
+	// and the preconditions. This is intended for disconnected clusters that don't have the
+	// signature of the release, and the default is false. It has no effect in hosted mode.
+	Force bool `json:"force,omitempty"`
+
+	// AllowUnsupportedUpdate indicates that the upgrade should be requested even if the update
+	// graph contained in the bundle says that there is no supported update from the current
+	// version of the cluster to the version of the bundle. By default the controller refuses to
+	// request such an upgrade and marks the upgrade as degraded.
+	AllowUnsupportedUpdate bool `json:"allowUnsupportedUpdate,omitempty"`
+
+	// PullOrder is the strategy that the nodes use to decide the order of the image pulls when
+	// they load the images of the bundle. The supported values are 'default', 'size' and
+	// 'priority'. This is optional and the default is to pull the images in the order they
+	// appear in the bundle.
+	PullOrder string `json:"pullOrder,omitempty"`
+}
+
+// ClusterUpgradeSchedule describes the maintenance windows of an upgrade.
+type ClusterUpgradeSchedule struct {
+	// TimeZone is the name of the time zone used to evaluate the cron expressions of the
+	// windows, for example 'Europe/Madrid'. This is optional and the default is UTC.
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// Windows is the list of maintenance windows. The upgrade can progress when any of them
+	// is open.
+	Windows []ClusterUpgradeWindow `json:"windows,omitempty"`
+}
+
+// ClusterUpgradeWindow describes a maintenance window. It is either a recurring window described
+// by a cron expression and a duration, or a single window described by a start and end time.
+type ClusterUpgradeWindow struct {
+	// Cron is a cron expression with five fields that describes when the window opens, for
+	// example '0 22 * * 6' for every Saturday at 22:00.
+	Cron string `json:"cron,omitempty"`
+
+	// Duration is how long the window stays open after the cron expression matches, for
+	// example '6h'.
+	Duration *metav1.Duration `json:"duration,omitempty"`
+
+	// Start is the time when a single window opens.
+	Start *metav1.Time `json:"start,omitempty"`
+
+	// End is the time when a single window closes.
+	End *metav1.Time `json:"end,omitempty"`
+}
+
+// ClusterUpgradeBundle describes where the bundle can be found. Exactly one of the file, the
+// directory or the URL should be specified.
+type ClusterUpgradeBundle struct {
+	// File is the path of the bundle file in the nodes that have it initially.
+	File string `json:"file,omitempty"`
+
+	// Dir is the path of a directory, in the nodes that have it initially, that contains
+	// multiple bundle files. The bundle for the requested version will be selected.
+	Dir string `json:"dir,omitempty"`
+
+	// URL is the URL where the nodes can download the bundle directly, for example
+	// 's3://bundles/4.13.4.tar' for a bundle stored in an S3 compatible object store. When
+	// this is specified the bundle server isn't used.
+	URL string `json:"url,omitempty"`
+
+	// URLSecret is a reference to the secret that contains the credentials needed to download
+	// the bundle from the URL. The keys of the secret are 'access-key-id', 'secret-access-key'
+	// and optionally 'session-token', 'endpoint' and 'region'.
+	URLSecret *corev1.LocalObjectReference `json:"urlSecret,omitempty"`
+
+	// Digest is the expected SHA-256 digest of the bundle, for example 'sha256:3a4c...'.
+	Digest string `json:"digest,omitempty"`
+}
+
+// ClusterUpgradeArchBundle describes the bundle for the nodes of an architecture. These bundles are
+// always downloaded from an URL, using the credentials of the main bundle.
+type ClusterUpgradeArchBundle struct {
+	// Arch is the architecture of the nodes that will use this bundle, for example 'aarch64'.
+	Arch string `json:"arch"`
+
+	// URL is the URL where the nodes can download the bundle directly, for example
+	// 's3://bundles/4.13.4-aarch64.tar'.
+	URL string `json:"url"`
+
+	// Digest is the expected SHA-256 digest of the bundle, for example 'sha256:3a4c...'.
+	Digest string `json:"digest,omitempty"`
+}
+
+// ClusterUpgradeRollout describes how the bundle is distributed to the nodes.
+type ClusterUpgradeRollout struct {
+	// Replicas is the number of nodes that will receive the bundle before the rest, and that
+	// will then serve it to the rest of the nodes. This is optional and the default is the
+	// value configured in the controller.
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Streaming indicates if the nodes should extract the bundle while it is downloaded,
+	// without saving it to a file, so that they need half the disk space.
+	Streaming bool `json:"streaming,omitempty"`
+
+	// Batches splits the nodes in groups that load the images of the bundle one after the
+	// other. Each item is a number of nodes or a percentage of the total number of nodes,
+	// rounded up. For example '1' and '10%' will load the images first in one canary node,
+	// then in ten percent of the nodes and finally in the rest of the nodes, as the nodes that
+	// aren't part of any batch form a last batch. The images are loaded in a batch only when
+	// all the nodes of the previous batches have them loaded, are ready and don't report
+	// errors. This is optional and the default is to load the images in all the nodes at the
+	// same time.
+	Batches []intstr.IntOrString `json:"batches,omitempty"`
+
+	// MaxRetries is the number of times that the controller will create again the job that
+	// extracts the bundle or loads the images in a node when it fails. The delay between
+	// retries grows exponentially. This is optional and the default is the value configured in
+	// the controller.
+	MaxRetries *int32 `json:"maxRetries,omitempty"`
+
+	// FailureBudget is the number or percentage of nodes, rounded down, that can fail without
+	// marking the upgrade as degraded, for example '5%'. This is optional and the default is
+	// the value configured in the controller.
+	FailureBudget *intstr.IntOrString `json:"failureBudget,omitempty"`
+
+	// MaxConcurrency is the number or percentage of nodes, rounded up, that can extract the
+	// bundle or load the images at the same time, for example '10%', so that downloading the
+	// bundle doesn't saturate the network or the disks of the cluster. This is optional and
+	// the default is the value configured in the controller. Zero means no limit.
+	MaxConcurrency *intstr.IntOrString `json:"maxConcurrency,omitempty"`
+
+	// NodeSelector selects the nodes that are part of the upgrade. The bundle isn't distributed
+	// to the nodes that aren't selected, and the upgrade doesn't wait for them. This is optional
+	// and the default is to select all the nodes.
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+
+	// ExcludedNodes contains the names of nodes that are temporarily excluded from the
+	// distribution of the bundle, for example because they are under maintenance. The bundle
+	// isn't distributed to these nodes while they are in this list, and the upgrade isn't
+	// requested till they are removed from the list and have the bundle. Unlike the rest of the
+	// spec this can be changed while the upgrade is in progress.
+	ExcludedNodes []string `json:"excludedNodes,omitempty"`
+
+	// Tolerations are added to the pods that extract the bundle and load the images, so that
+	// they can run in nodes that have taints. The taints of the control plane nodes are always
+	// tolerated.
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+}
+
+// ClusterUpgradePhase indicates the phase of a cluster upgrade.
+type ClusterUpgradePhase string
+
+const (
+	ClusterUpgradePending    ClusterUpgradePhase = "Pending"
+	ClusterUpgradeExtracting ClusterUpgradePhase = "Extracting"
+	ClusterUpgradeLoading    ClusterUpgradePhase = "Loading"
+	ClusterUpgradeUpgrading  ClusterUpgradePhase = "Upgrading"
+	ClusterUpgradeCompleted  ClusterUpgradePhase = "Completed"
+)
+
+// Types of the conditions of a cluster upgrade.
+const (
+	// ClusterUpgradeBundleDistributed indicates if all the nodes have the bundle extracted.
+	ClusterUpgradeBundleDistributed = "BundleDistributed"
+
+	// ClusterUpgradeImagesLoaded indicates if all the nodes have the images of the bundle
+	// loaded.
+	ClusterUpgradeImagesLoaded = "ImagesLoaded"
+
+	// ClusterUpgradeUpgradeTriggered indicates if the upgrade has been requested to the cluster
+	// version operator.
+	ClusterUpgradeUpgradeTriggered = "UpgradeTriggered"
+
+	// ClusterUpgradeUpgradeCompleted indicates if the cluster version operator has completed
+	// the upgrade.
+	ClusterUpgradeUpgradeCompleted = "UpgradeCompleted"
+
+	// ClusterUpgradeDegraded indicates if there are problems that prevent the upgrade from
+	// progressing, like nodes that failed to extract or load the bundle.
+	ClusterUpgradeDegraded = "Degraded"
+
+	// ClusterUpgradePaused indicates if the upgrade has been paused.
+	ClusterUpgradePaused = "Paused"
+
+	// ClusterUpgradePreflightChecksPassed indicates if the checks of the health of the cluster
+	// that run before starting the upgrade passed.
+	ClusterUpgradePreflightChecksPassed = "PreflightChecksPassed"
+)
+
+// Reasons of the conditions of a cluster upgrade.
+const (
+	ClusterUpgradeAsExpectedReason        = "AsExpected"
+	ClusterUpgradeCompletedReason         = "Completed"
+	ClusterUpgradeDistributedReason       = "Distributed"
+	ClusterUpgradeDistributingReason      = "Distributing"
+	ClusterUpgradeInProgressReason        = "InProgress"
+	ClusterUpgradeLoadedReason            = "Loaded"
+	ClusterUpgradeLoadingReason           = "Loading"
+	ClusterUpgradeNodeErrorsReason        = "NodeErrors"
+	ClusterUpgradeNotStartedReason        = "NotStarted"
+	ClusterUpgradeOutsideWindowReason     = "OutsideWindow"
+	ClusterUpgradePassedReason            = "Passed"
+	ClusterUpgradePausedReason            = "Paused"
+	ClusterUpgradePreflightFailedReason   = "PreflightFailed"
+	ClusterUpgradeSkippedReason           = "Skipped"
+	ClusterUpgradeTriggeredReason         = "Triggered"
+	ClusterUpgradeUnsupportedUpdateReason = "UnsupportedUpdate"
+	ClusterUpgradeUpgradeFailingReason    = "UpgradeFailing"
+	ClusterUpgradeWaitingReason           = "Waiting"
+	ClusterUpgradeWithinBudgetReason      = "WithinBudget"
+)
+
+// ClusterUpgradeStatus describes the progress of the cluster upgrade.
+type ClusterUpgradeStatus struct {
+	// ObservedGeneration is the generation of the spec that was used to calculate this status.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Phase is the current phase of the upgrade.
+	Phase ClusterUpgradePhase `json:"phase,omitempty"`
+
+	// Message is a human readable description of the current state.
+	Message string `json:"message,omitempty"`
+
+	// Nodes is the total number of nodes of the cluster.
+	Nodes int `json:"nodes,omitempty"`
+
+	// ExtractedNodes is the number of nodes that have the bundle extracted.
+	ExtractedNodes int `json:"extractedNodes,omitempty"`
+
+	// LoadedNodes is the number of nodes that have the images of the bundle loaded.
+	LoadedNodes int `json:"loadedNodes,omitempty"`
+
+	// Batch is the number, starting with one, of the batch of nodes that is loading the images
+	// of the bundle. It is zero when the rollout isn't split in batches.
+	Batch int `json:"batch,omitempty"`
+
+	// Conditions contains the details of the current state of the upgrade.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// History records how the upgrade progressed, so that it can be audited once it has
+	// completed.
+	History *ClusterUpgradeHistory `json:"history,omitempty"`
+}
+
+// ClusterUpgradeHistory records what was installed by an upgrade, when each of its phases started
+// and ended, and the nodes that had problems.
+type ClusterUpgradeHistory struct {
+	// BundleDigest is the digest of the bundle specified in the spec of the upgrade.
+	BundleDigest string `json:"bundleDigest,omitempty"`
+
+	// Release is the release image contained in the bundle.
+	Release string `json:"release,omitempty"`
+
+	// StartTime is the time when the controller started to process the upgrade.
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is the time when the cluster version operator completed the upgrade.
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Phases contains the phases that the upgrade went through, in order. The same phase may
+	// appear more than once, for example when nodes join the cluster during the upgrade.
+	Phases []ClusterUpgradePhaseRecord `json:"phases,omitempty"`
+
+	// Nodes contains the nodes where extracting the bundle or loading the images failed, sorted
+	// by name.
+	Nodes []ClusterUpgradeNodeRecord `json:"nodes,omitempty"`
+}
+
+// ClusterUpgradePhaseRecord records when the upgrade entered and left a phase.
+type ClusterUpgradePhaseRecord struct {
+	// Phase is the name of the phase.
+	Phase ClusterUpgradePhase `json:"phase"`
+
+	// StartTime is the time when the upgrade entered the phase.
+	StartTime metav1.Time `json:"startTime"`
+
+	// EndTime is the time when the upgrade left the phase. It is empty for the current phase.
+	EndTime *metav1.Time `json:"endTime,omitempty"`
+
+	// Duration is the time that the upgrade spent in the phase. It is empty for the current
+	// phase.
+	Duration *metav1.Duration `json:"duration,omitempty"`
+}
+
+// ClusterUpgradeNodeRecord records the problems that happened in a node during the upgrade.
+type ClusterUpgradeNodeRecord struct {
+	// Name is the name of the node.
+	Name string `json:"name"`
+
+	// ExtractorRetries is the number of times that the job that extracts the bundle was created
+	// again because it failed.
+	ExtractorRetries int32 `json:"extractorRetries,omitempty"`
+
+	// LoaderRetries is the number of times that the job that loads the images was created again
+	// because it failed.
+	LoaderRetries int32 `json:"loaderRetries,omitempty"`
+
+	// Failed indicates that a job failed and there were no retries left.
+	Failed bool `json:"failed,omitempty"`
+
+	// Error is the last error reported by the node.
+	Error string `json:"error,omitempty"`
+}
+
+// ClusterUpgradeList is a list of cluster upgrades.
+type ClusterUpgradeList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ClusterUpgrade `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterUpgrade{}, &ClusterUpgradeList{})
+}
@@ -0,0 +1,442 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// This file contains the deep copy methods needed to implement the runtime.Object interface.
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *BundleCreation) DeepCopyInto(out *BundleCreation) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy creates a deep copy of the object.
+func (in *BundleCreation) DeepCopy() *BundleCreation {
+	if in == nil {
+		return nil
+	}
+	out := &BundleCreation{}
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is the implementation of the runtime.Object interface.
+func (in *BundleCreation) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *BundleCreationSpec) DeepCopyInto(out *BundleCreationSpec) {
+	*out = *in
+	out.PullSecret = in.PullSecret
+	in.Storage.DeepCopyInto(&out.Storage)
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *BundleCreationStorage) DeepCopyInto(out *BundleCreationStorage) {
+	*out = *in
+	if in.PersistentVolumeClaim != nil {
+		out.PersistentVolumeClaim = in.PersistentVolumeClaim.DeepCopy()
+	}
+	if in.ObjectStore != nil {
+		out.ObjectStore = &BundleCreationObjectStore{}
+		in.ObjectStore.DeepCopyInto(out.ObjectStore)
+	}
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *BundleCreationObjectStore) DeepCopyInto(out *BundleCreationObjectStore) {
+	*out = *in
+	if in.Secret != nil {
+		out.Secret = &corev1.LocalObjectReference{}
+		*out.Secret = *in.Secret
+	}
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *BundleCreationStatus) DeepCopyInto(out *BundleCreationStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		out.StartTime = in.StartTime.DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		out.CompletionTime = in.CompletionTime.DeepCopy()
+	}
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *BundleCreationList) DeepCopyInto(out *BundleCreationList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]BundleCreation, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy creates a deep copy of the object.
+func (in *BundleCreationList) DeepCopy() *BundleCreationList {
+	if in == nil {
+		return nil
+	}
+	out := &BundleCreationList{}
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is the implementation of the runtime.Object interface.
+func (in *BundleCreationList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *NodeUpgradeStatus) DeepCopyInto(out *NodeUpgradeStatus) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy creates a deep copy of the object.
+func (in *NodeUpgradeStatus) DeepCopy() *NodeUpgradeStatus {
+	if in == nil {
+		return nil
+	}
+	out := &NodeUpgradeStatus{}
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is the implementation of the runtime.Object interface.
+func (in *NodeUpgradeStatus) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *NodeUpgradeStatusStatus) DeepCopyInto(out *NodeUpgradeStatusStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		out.StartTime = in.StartTime.DeepCopy()
+	}
+	if in.UpdateTime != nil {
+		out.UpdateTime = in.UpdateTime.DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		out.CompletionTime = in.CompletionTime.DeepCopy()
+	}
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *NodeUpgradeStatusList) DeepCopyInto(out *NodeUpgradeStatusList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]NodeUpgradeStatus, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy creates a deep copy of the object.
+func (in *NodeUpgradeStatusList) DeepCopy() *NodeUpgradeStatusList {
+	if in == nil {
+		return nil
+	}
+	out := &NodeUpgradeStatusList{}
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is the implementation of the runtime.Object interface.
+func (in *NodeUpgradeStatusList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ClusterUpgrade) DeepCopyInto(out *ClusterUpgrade) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy creates a deep copy of the object.
+func (in *ClusterUpgrade) DeepCopy() *ClusterUpgrade {
+	if in == nil {
+		return nil
+	}
+	out := &ClusterUpgrade{}
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is the implementation of the runtime.Object interface.
+func (in *ClusterUpgrade) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ClusterUpgradeSpec) DeepCopyInto(out *ClusterUpgradeSpec) {
+	*out = *in
+	if in.ArchBundles != nil {
+		out.ArchBundles = make([]ClusterUpgradeArchBundle, len(in.ArchBundles))
+		copy(out.ArchBundles, in.ArchBundles)
+	}
+	in.Bundle.DeepCopyInto(&out.Bundle)
+	in.Rollout.DeepCopyInto(&out.Rollout)
+	if in.Schedule != nil {
+		out.Schedule = &ClusterUpgradeSchedule{}
+		in.Schedule.DeepCopyInto(out.Schedule)
+	}
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ClusterUpgradeSchedule) DeepCopyInto(out *ClusterUpgradeSchedule) {
+	*out = *in
+	if in.Windows != nil {
+		out.Windows = make([]ClusterUpgradeWindow, len(in.Windows))
+		for i := range in.Windows {
+			in.Windows[i].DeepCopyInto(&out.Windows[i])
+		}
+	}
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ClusterUpgradeWindow) DeepCopyInto(out *ClusterUpgradeWindow) {
+	*out = *in
+	if in.Duration != nil {
+		duration := *in.Duration
+		out.Duration = &duration
+	}
+	if in.Start != nil {
+		out.Start = in.Start.DeepCopy()
+	}
+	if in.End != nil {
+		out.End = in.End.DeepCopy()
+	}
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ClusterUpgradeBundle) DeepCopyInto(out *ClusterUpgradeBundle) {
+	*out = *in
+	if in.URLSecret != nil {
+		out.URLSecret = &corev1.LocalObjectReference{
+			Name: in.URLSecret.Name,
+		}
+	}
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ClusterUpgradeRollout) DeepCopyInto(out *ClusterUpgradeRollout) {
+	*out = *in
+	if in.Replicas != nil {
+		replicas := *in.Replicas
+		out.Replicas = &replicas
+	}
+	if in.Batches != nil {
+		out.Batches = make([]intstr.IntOrString, len(in.Batches))
+		copy(out.Batches, in.Batches)
+	}
+	if in.MaxRetries != nil {
+		retries := *in.MaxRetries
+		out.MaxRetries = &retries
+	}
+	if in.FailureBudget != nil {
+		budget := *in.FailureBudget
+		out.FailureBudget = &budget
+	}
+	if in.MaxConcurrency != nil {
+		concurrency := *in.MaxConcurrency
+		out.MaxConcurrency = &concurrency
+	}
+	if in.NodeSelector != nil {
+		out.NodeSelector = in.NodeSelector.DeepCopy()
+	}
+	if in.ExcludedNodes != nil {
+		out.ExcludedNodes = make([]string, len(in.ExcludedNodes))
+		copy(out.ExcludedNodes, in.ExcludedNodes)
+	}
+	if in.Tolerations != nil {
+		out.Tolerations = make([]corev1.Toleration, len(in.Tolerations))
+		for i := range in.Tolerations {
+			in.Tolerations[i].DeepCopyInto(&out.Tolerations[i])
+		}
+	}
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ClusterUpgradeStatus) DeepCopyInto(out *ClusterUpgradeStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(in.Conditions))
+		for i := range in.Conditions {
+			in.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+	if in.History != nil {
+		out.History = &ClusterUpgradeHistory{}
+		in.History.DeepCopyInto(out.History)
+	}
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ClusterUpgradeHistory) DeepCopyInto(out *ClusterUpgradeHistory) {
+	*out = *in
+	if in.StartTime != nil {
+		out.StartTime = in.StartTime.DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		out.CompletionTime = in.CompletionTime.DeepCopy()
+	}
+	if in.Phases != nil {
+		out.Phases = make([]ClusterUpgradePhaseRecord, len(in.Phases))
+		for i := range in.Phases {
+			in.Phases[i].DeepCopyInto(&out.Phases[i])
+		}
+	}
+	if in.Nodes != nil {
+		out.Nodes = make([]ClusterUpgradeNodeRecord, len(in.Nodes))
+		copy(out.Nodes, in.Nodes)
+	}
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ClusterUpgradePhaseRecord) DeepCopyInto(out *ClusterUpgradePhaseRecord) {
+	*out = *in
+	in.StartTime.DeepCopyInto(&out.StartTime)
+	if in.EndTime != nil {
+		out.EndTime = in.EndTime.DeepCopy()
+	}
+	if in.Duration != nil {
+		duration := *in.Duration
+		out.Duration = &duration
+	}
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ClusterUpgradeList) DeepCopyInto(out *ClusterUpgradeList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]ClusterUpgrade, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy creates a deep copy of the object.
+func (in *ClusterUpgradeList) DeepCopy() *ClusterUpgradeList {
+	if in == nil {
+		return nil
+	}
+	out := &ClusterUpgradeList{}
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is the implementation of the runtime.Object interface.
+func (in *ClusterUpgradeList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ManagedClusterUpgrade) DeepCopyInto(out *ManagedClusterUpgrade) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy creates a deep copy of the object.
+func (in *ManagedClusterUpgrade) DeepCopy() *ManagedClusterUpgrade {
+	if in == nil {
+		return nil
+	}
+	out := &ManagedClusterUpgrade{}
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is the implementation of the runtime.Object interface.
+func (in *ManagedClusterUpgrade) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ManagedClusterUpgradeSpec) DeepCopyInto(out *ManagedClusterUpgradeSpec) {
+	*out = *in
+	in.ClusterSelector.DeepCopyInto(&out.ClusterSelector)
+	in.Upgrade.DeepCopyInto(&out.Upgrade)
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ManagedClusterUpgradeStatus) DeepCopyInto(out *ManagedClusterUpgradeStatus) {
+	*out = *in
+	if in.ClusterStatuses != nil {
+		out.ClusterStatuses = make(
+			[]ManagedClusterUpgradeClusterStatus,
+			len(in.ClusterStatuses),
+		)
+		copy(out.ClusterStatuses, in.ClusterStatuses)
+	}
+}
+
+// DeepCopyInto copies the receiver into the given object.
+func (in *ManagedClusterUpgradeList) DeepCopyInto(out *ManagedClusterUpgradeList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]ManagedClusterUpgrade, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy creates a deep copy of the object.
+func (in *ManagedClusterUpgradeList) DeepCopy() *ManagedClusterUpgradeList {
+	if in == nil {
+		return nil
+	}
+	out := &ManagedClusterUpgradeList{}
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is the implementation of the runtime.Object interface.
+func (in *ManagedClusterUpgradeList) DeepCopyObject() runtime.Object {
+	return in.DeepCopy()
+}
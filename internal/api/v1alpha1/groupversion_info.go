@@ -0,0 +1,35 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+// Package v1alpha1 contains the custom resources used by the upgrade tool.
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+// GroupVersion is the group and version used to register the types of this package.
+var GroupVersion = schema.GroupVersion{
+	Group:   "upgrade-tool.io",
+	Version: "v1alpha1",
+}
+
+// SchemeBuilder is used to add the types of this package to a scheme.
+var SchemeBuilder = &scheme.Builder{
+	GroupVersion: GroupVersion,
+}
+
+// AddToScheme adds the types of this package to the given scheme.
+var AddToScheme = SchemeBuilder.AddToScheme
@@ -0,0 +1,116 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ManagedClusterUpgrade requests, from an Advanced Cluster Management hub, the upgrade of a set of
+// managed clusters. The hub controller creates in each selected cluster, using a ManifestWork, a
+// ClusterUpgrade object, and aggregates the status that those objects report back to the hub.
+type ManagedClusterUpgrade struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ManagedClusterUpgradeSpec   `json:"spec,omitempty"`
+	Status ManagedClusterUpgradeStatus `json:"status,omitempty"`
+}
+
+// ManagedClusterUpgradeSpec describes the desired upgrade of the managed clusters.
+type ManagedClusterUpgradeSpec struct {
+	// ClusterSelector selects the ManagedCluster objects of the clusters that will be upgraded.
+	// Note that, as usual for label selectors, an empty selector selects all the clusters.
+	ClusterSelector metav1.LabelSelector `json:"clusterSelector"`
+
+	// Namespace is the namespace of the managed clusters where the controller of the upgrade
+	// tool runs, and where the ClusterUpgrade objects will be created. This is optional and the
+	// default is 'upgrade-tool'.
+	Namespace string `json:"namespace,omitempty"`
+
+	// Upgrade describes the upgrade that will be requested to the managed clusters. Note that
+	// the secrets that it references, like the one containing the credentials for the bundle
+	// URL, need to exist already in the managed clusters.
+	Upgrade ClusterUpgradeSpec `json:"upgrade"`
+}
+
+// ManagedClusterUpgradePhase indicates the phase of the upgrade of a set of managed clusters.
+type ManagedClusterUpgradePhase string
+
+const (
+	ManagedClusterUpgradePending     ManagedClusterUpgradePhase = "Pending"
+	ManagedClusterUpgradeProgressing ManagedClusterUpgradePhase = "Progressing"
+	ManagedClusterUpgradeCompleted   ManagedClusterUpgradePhase = "Completed"
+)
+
+// ManagedClusterUpgradeStatus describes the progress of the upgrade of the managed clusters.
+type ManagedClusterUpgradeStatus struct {
+	// ObservedGeneration is the generation of the spec that was used to calculate this status.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Phase is the current phase of the upgrade. It is completed when all the selected clusters
+	// have completed the upgrade.
+	Phase ManagedClusterUpgradePhase `json:"phase,omitempty"`
+
+	// Message is a human readable description of the current state.
+	Message string `json:"message,omitempty"`
+
+	// Clusters is the number of selected clusters.
+	Clusters int `json:"clusters,omitempty"`
+
+	// CompletedClusters is the number of clusters that have completed the upgrade.
+	CompletedClusters int `json:"completedClusters,omitempty"`
+
+	// DegradedClusters is the number of clusters whose upgrade reports that it is degraded.
+	DegradedClusters int `json:"degradedClusters,omitempty"`
+
+	// ClusterStatuses contains the status reported by each of the selected clusters.
+	ClusterStatuses []ManagedClusterUpgradeClusterStatus `json:"clusterStatuses,omitempty"`
+}
+
+// ManagedClusterUpgradeClusterStatus is the status of the upgrade reported by a managed cluster.
+type ManagedClusterUpgradeClusterStatus struct {
+	// Cluster is the name of the managed cluster.
+	Cluster string `json:"cluster"`
+
+	// Phase is the phase of the ClusterUpgrade object of the cluster. It is empty till the
+	// cluster reports it.
+	Phase ClusterUpgradePhase `json:"phase,omitempty"`
+
+	// Message is the message of the ClusterUpgrade object of the cluster.
+	Message string `json:"message,omitempty"`
+
+	// Degraded indicates if the ClusterUpgrade object of the cluster reports that it is
+	// degraded.
+	Degraded bool `json:"degraded,omitempty"`
+
+	// Nodes, ExtractedNodes and LoadedNodes are the number of nodes of the cluster, the number
+	// that have the bundle extracted and the number that have the images loaded.
+	Nodes          int `json:"nodes,omitempty"`
+	ExtractedNodes int `json:"extractedNodes,omitempty"`
+	LoadedNodes    int `json:"loadedNodes,omitempty"`
+}
+
+// ManagedClusterUpgradeList is a list of managed cluster upgrades.
+type ManagedClusterUpgradeList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ManagedClusterUpgrade `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ManagedClusterUpgrade{}, &ManagedClusterUpgradeList{})
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NodeUpgradeStatus describes the state of the upgrade in one node. There is one of these objects
+// for each node, with the same name than the node, and they are updated by the programs that run in
+// the node: the bundle extractor, the bundle loader and the bundle cleaner.
+type NodeUpgradeStatus struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NodeUpgradeStatusSpec   `json:"spec,omitempty"`
+	Status NodeUpgradeStatusStatus `json:"status,omitempty"`
+}
+
+// NodeUpgradeStatusSpec identifies the node.
+type NodeUpgradeStatusSpec struct {
+	// Node is the name of the node.
+	Node string `json:"node"`
+}
+
+// NodeUpgradePhase indicates the phase of the upgrade in a node.
+type NodeUpgradePhase string
+
+const (
+	NodeUpgradeExtracting NodeUpgradePhase = "Extracting"
+	NodeUpgradeExtracted  NodeUpgradePhase = "Extracted"
+	NodeUpgradeLoading    NodeUpgradePhase = "Loading"
+	NodeUpgradeLoaded     NodeUpgradePhase = "Loaded"
+	NodeUpgradeCleaning   NodeUpgradePhase = "Cleaning"
+	NodeUpgradeCleaned    NodeUpgradePhase = "Cleaned"
+	NodeUpgradeFailed     NodeUpgradePhase = "Failed"
+)
+
+// NodeUpgradeStatusStatus describes the progress of the upgrade in the node.
+type NodeUpgradeStatusStatus struct {
+	// Phase is the current phase of the upgrade in the node.
+	Phase NodeUpgradePhase `json:"phase,omitempty"`
+
+	// Progress is a human readable description of the progress of the current phase.
+	Progress string `json:"progress,omitempty"`
+
+	// Percent is the percentage of the current phase that has been completed, when known.
+	Percent int `json:"percent,omitempty"`
+
+	// Error is the description of the error that caused the upgrade to fail in the node.
+	Error string `json:"error,omitempty"`
+
+	// FailedPhase is the phase that was running when the error happened.
+	FailedPhase NodeUpgradePhase `json:"failedPhase,omitempty"`
+
+	// StartTime is the time when the current phase started.
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// UpdateTime is the time when the status was last updated.
+	UpdateTime *metav1.Time `json:"updateTime,omitempty"`
+
+	// CompletionTime is the time when the current phase finished, either successfully or with
+	// an error.
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// NodeUpgradeStatusList is a list of node upgrade statuses.
+type NodeUpgradeStatusList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []NodeUpgradeStatus `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NodeUpgradeStatus{}, &NodeUpgradeStatusList{})
+}
@@ -0,0 +1,337 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/jhernand/upgrade-tool/internal/annotations"
+)
+
+// BundleAgentBuilder contains the data and logic needed to create a bundle agent. Don't create
+// instances of this type directly, use the NewBundleAgent function instead.
+type BundleAgentBuilder struct {
+	logger     logr.Logger
+	client     clnt.Client
+	node       string
+	executable string
+	interval   time.Duration
+	retries    int
+}
+
+// BundleAgent runs in every node as part of a daemon set, and runs the bundle extractor or the
+// bundle loader when the controller requests it writing the command line to the agent command
+// annotation of the node. This is used instead of creating one job per node, so that large
+// clusters don't need to create and delete thousands of objects for each upgrade. Don't create
+// instances of this type directly, use the NewBundleAgent function instead.
+type BundleAgent struct {
+	logger     logr.Logger
+	client     clnt.Client
+	node       string
+	executable string
+	interval   time.Duration
+	retries    int
+
+	// failedDigest is the digest of the last command that failed, failures is the number of
+	// consecutive failures and retryTime is the time when it can be executed again.
+	failedDigest string
+	failures     int
+	retryTime    time.Time
+}
+
+// NewBundleAgent creates a builder that can then be used to configure and create bundle agents.
+func NewBundleAgent() *BundleAgentBuilder {
+	return &BundleAgentBuilder{
+		interval: 10 * time.Second,
+		retries:  controllerDefaultJobRetries,
+	}
+}
+
+// SetLogger sets the logger that the agent will use to write messages to the log. This is
+// mandatory.
+func (b *BundleAgentBuilder) SetLogger(value logr.Logger) *BundleAgentBuilder {
+	b.logger = value
+	return b
+}
+
+// SetClient sets the Kubernetes API client that the agent will use to read and update the node.
+// This is mandatory.
+func (b *BundleAgentBuilder) SetClient(value clnt.Client) *BundleAgentBuilder {
+	b.client = value
+	return b
+}
+
+// SetNode sets the name of the node where the agent is running. This is mandatory.
+func (b *BundleAgentBuilder) SetNode(value string) *BundleAgentBuilder {
+	b.node = value
+	return b
+}
+
+// SetExecutable sets the path of the executable that will be used to run the commands requested
+// by the controller. This is optional and the default is the executable of the current process.
+func (b *BundleAgentBuilder) SetExecutable(value string) *BundleAgentBuilder {
+	b.executable = value
+	return b
+}
+
+// SetInterval sets the interval between checks of the node annotations. This is optional and the
+// default is 10 seconds.
+func (b *BundleAgentBuilder) SetInterval(value time.Duration) *BundleAgentBuilder {
+	b.interval = value
+	return b
+}
+
+// SetRetries sets the number of times that a command that fails will be executed again. The delay
+// between retries grows exponentially. This is optional and the default is three.
+func (b *BundleAgentBuilder) SetRetries(value int) *BundleAgentBuilder {
+	b.retries = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new bundle agent.
+func (b *BundleAgentBuilder) Build() (result *BundleAgent, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+	if b.client == nil {
+		err = errors.New("client is mandatory")
+		return
+	}
+	if b.node == "" {
+		err = errors.New("node name is mandatory")
+		return
+	}
+	if b.interval <= 0 {
+		err = fmt.Errorf(
+			"interval %s isn't valid, it must be greater than zero",
+			b.interval,
+		)
+		return
+	}
+	if b.retries < 0 {
+		err = fmt.Errorf(
+			"number of retries %d isn't valid, it must be greater than or equal to zero",
+			b.retries,
+		)
+		return
+	}
+
+	// Use the executable of the current process if no other has been specified:
+	executable := b.executable
+	if executable == "" {
+		executable, err = os.Executable()
+		if err != nil {
+			return
+		}
+	}
+
+	// Create and populate the object:
+	result = &BundleAgent{
+		logger:     b.logger,
+		client:     b.client,
+		node:       b.node,
+		executable: executable,
+		interval:   b.interval,
+		retries:    b.retries,
+	}
+	return
+}
+
+// Run checks the node annotations periodically and runs the requested commands. It only returns
+// when the context is cancelled.
+func (a *BundleAgent) Run(ctx context.Context) error {
+	a.logger.Info(
+		"Waiting for commands",
+		"node", a.node,
+		"interval", a.interval,
+	)
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		err := a.check(ctx)
+		if err != nil && ctx.Err() == nil {
+			a.logger.Error(
+				err,
+				"Failed to check node",
+				"node", a.node,
+			)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// check fetches the node and runs the requested command if it hasn't completed yet.
+func (a *BundleAgent) check(ctx context.Context) error {
+	// Fetch the node:
+	node := &corev1.Node{}
+	key := clnt.ObjectKey{
+		Name: a.node,
+	}
+	err := a.client.Get(ctx, key, node)
+	if err != nil {
+		return err
+	}
+
+	// Do nothing if there is no command, or if it has already been completed:
+	value := node.Annotations[annotations.AgentCommand]
+	if value == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(value))
+	digest := hex.EncodeToString(sum[:])
+	if node.Annotations[annotations.AgentCompleted] == digest {
+		return nil
+	}
+
+	// Check if the command failed before, and if it can be retried:
+	if digest == a.failedDigest {
+		if a.failures > a.retries {
+			return nil
+		}
+		if time.Now().Before(a.retryTime) {
+			return nil
+		}
+	} else {
+		a.failedDigest = ""
+		a.failures = 0
+	}
+
+	// Check that the command is one of the programs that the agent is allowed to run, as we
+	// don't want to run arbitrary programs in the node:
+	var args []string
+	err = json.Unmarshal([]byte(value), &args)
+	if err != nil {
+		return fmt.Errorf("failed to parse agent command '%s': %w", value, err)
+	}
+	if len(args) == 0 || !bundleAgentPrograms[args[0]] {
+		return fmt.Errorf("agent command '%s' isn't allowed", value)
+	}
+
+	// Run the command:
+	err = a.run(ctx, args)
+	if err != nil {
+		a.failedDigest = digest
+		a.failures++
+		delay := controllerRetryBaseDelay
+		for i := 1; i < a.failures && delay < controllerRetryMaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > controllerRetryMaxDelay {
+			delay = controllerRetryMaxDelay
+		}
+		a.retryTime = time.Now().Add(delay)
+		if a.failures > a.retries {
+			a.logger.Error(
+				err,
+				"Command failed and there are no retries left",
+				"program", args[0],
+				"failures", a.failures,
+			)
+			return nil
+		}
+		a.logger.Error(
+			err,
+			"Command failed, will retry it later",
+			"program", args[0],
+			"failures", a.failures,
+			"delay", delay,
+		)
+		return nil
+	}
+
+	// Remember that the command has completed, so that it isn't executed again:
+	update := node.DeepCopy()
+	if update.Annotations == nil {
+		update.Annotations = map[string]string{}
+	}
+	update.Annotations[annotations.AgentCompleted] = digest
+	err = a.client.Patch(ctx, update, clnt.MergeFrom(node))
+	if err != nil {
+		return err
+	}
+	a.failedDigest = ""
+	a.failures = 0
+	return nil
+}
+
+func (a *BundleAgent) run(ctx context.Context, args []string) error {
+	a.logger.Info(
+		"Running command",
+		"program", args[0],
+		"args", args[1:],
+	)
+	cmd := exec.CommandContext(ctx, a.executable, append([]string{"start"}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	err := cmd.Run()
+	if err != nil {
+		return err
+	}
+	a.logger.Info(
+		"Command completed",
+		"program", args[0],
+		"duration", time.Since(start),
+	)
+	return nil
+}
+
+// bundleAgentPrograms contains the programs that the agent is allowed to run.
+var bundleAgentPrograms = map[string]bool{
+	bundleExtractor: true,
+	bundleLoader:    true,
+}
+
+// bundleAgentPermissions are the permissions that the agent needs to read and update the
+// annotations of the node. As the agent runs the extractor and the loader with its own service
+// account it also needs the permissions of those programs.
+var bundleAgentPermissions = rbacPermissions{
+	cluster: append(
+		[]rbacv1.PolicyRule{
+			{
+				APIGroups: []string{""},
+				Resources: []string{"nodes"},
+				Verbs:     []string{"get", "patch"},
+			},
+			{
+				APIGroups: []string{""},
+				Resources: []string{"nodes/status"},
+				Verbs:     []string{"patch"},
+			},
+		},
+		nodeEventRules...,
+	),
+	namespace:  nodeStatusRules,
+	privileged: true,
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Bundle agent", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		ctx = context.Background()
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	// makeClient creates a fake client containing a node with the given agent command.
+	makeClient := func(command string) clnt.Client {
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "node0",
+				Annotations: map[string]string{
+					annotations.AgentCommand: command,
+				},
+			},
+		}
+		return fake.NewClientBuilder().
+			WithScheme(snapshotScheme()).
+			WithObjects(node).
+			Build()
+	}
+
+	// makeAgent creates an agent that uses the given executable to run the commands.
+	makeAgent := func(client clnt.Client, executable string) *BundleAgent {
+		agent, err := NewBundleAgent().
+			SetLogger(logger).
+			SetClient(client).
+			SetNode("node0").
+			SetExecutable(executable).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		return agent
+	}
+
+	// fetchAnnotations returns the annotations of the node.
+	fetchAnnotations := func(client clnt.Client) map[string]string {
+		node := &corev1.Node{}
+		err := client.Get(ctx, clnt.ObjectKey{Name: "node0"}, node)
+		Expect(err).ToNot(HaveOccurred())
+		return node.Annotations
+	}
+
+	It("Can't be created without a node", func() {
+		_, err := NewBundleAgent().
+			SetLogger(logger).
+			SetClient(makeClient("")).
+			Build()
+		Expect(err).To(MatchError("node name is mandatory"))
+	})
+
+	It("Records the completion of a successful command", func() {
+		client := makeClient(`["bundle-extractor","--node=node0"]`)
+		agent := makeAgent(client, "true")
+		err := agent.check(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fetchAnnotations(client)).To(HaveKey(annotations.AgentCompleted))
+	})
+
+	It("Doesn't run again a completed command", func() {
+		client := makeClient(`["bundle-extractor","--node=node0"]`)
+		err := makeAgent(client, "true").check(ctx)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Use an executable that fails, so that running the command again would be
+		// noticed as a failure:
+		agent := makeAgent(client, "false")
+		err = agent.check(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(agent.failures).To(BeZero())
+	})
+
+	It("Waits before retrying a failed command", func() {
+		client := makeClient(`["bundle-loader","--node=node0"]`)
+		agent := makeAgent(client, "false")
+		err := agent.check(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(agent.failures).To(Equal(1))
+		Expect(agent.retryTime).To(BeTemporally(">", time.Now()))
+		Expect(fetchAnnotations(client)).ToNot(HaveKey(annotations.AgentCompleted))
+
+		// The second check should not run the command again because the delay hasn't
+		// passed yet:
+		err = agent.check(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(agent.failures).To(Equal(1))
+	})
+
+	It("Rejects programs that aren't allowed", func() {
+		client := makeClient(`["bundle-cleaner","--force=true"]`)
+		agent := makeAgent(client, "true")
+		err := agent.check(ctx)
+		Expect(err).To(MatchError(ContainSubstring("isn't allowed")))
+		Expect(fetchAnnotations(client)).ToNot(HaveKey(annotations.AgentCompleted))
+	})
+})
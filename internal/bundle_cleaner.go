@@ -16,16 +16,28 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
+	dreference "github.com/distribution/distribution/v3/reference"
+	"github.com/dustin/go-humanize"
 	"github.com/go-logr/logr"
+	configv1 "github.com/openshift/api/config/v1"
+	"golang.org/x/exp/slices"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	criv1 "k8s.io/cri-api/pkg/apis/runtime/v1"
 	clnt "sigs.k8s.io/controller-runtime/pkg/client"
 
+	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
 	"github.com/jhernand/upgrade-tool/internal/labels"
 )
 
@@ -35,8 +47,14 @@ type BundleCleanerBuilder struct {
 	logger    logr.Logger
 	client    clnt.Client
 	node      string
+	namespace string
 	rootDir   string
 	bundleDir string
+	force     bool
+	removeOld bool
+	keepPin   bool
+	dryRun    bool
+	tempAge   time.Duration
 }
 
 // BundleCleaner removes the temporary files and directories used by the upgrade process. Don't
@@ -47,12 +65,21 @@ type BundleCleaner struct {
 	node      string
 	rootDir   string
 	bundleDir string
+	force     bool
+	removeOld bool
+	keepPin   bool
+	dryRun    bool
+	tempAge   time.Duration
 	crioTool  *CRIOTool
+	status    *nodeStatusWriter
+	events    *nodeEventWriter
 }
 
 // NewBundleCleaner creates a builder that can then be used to configure and create bundle cleaners.
 func NewBundleCleaner() *BundleCleanerBuilder {
-	return &BundleCleanerBuilder{}
+	return &BundleCleanerBuilder{
+		tempAge: bundleCleanerDefaultTempAge,
+	}
 }
 
 // SetLogger sets the logger that the cleaner will use to write log messages. This is mandatory.
@@ -77,6 +104,14 @@ func (b *BundleCleanerBuilder) SetNode(value string) *BundleCleanerBuilder {
 	return b
 }
 
+// SetNamespace sets the namespace where the cleaner will write the NodeUpgradeStatus object of the
+// node. This is optional, and when not specified the status is only reported using the labels of
+// the node.
+func (b *BundleCleanerBuilder) SetNamespace(value string) *BundleCleanerBuilder {
+	b.namespace = value
+	return b
+}
+
 // SetRootDir sets the root directory. This is optional, and when specified all the other
 // directories are relative to it. This is intended for running the cleaner in a privileged pod with
 // the node root filesystem mounted in a regular directory.
@@ -92,6 +127,48 @@ func (b *BundleCleanerBuilder) SetBundleDir(value string) *BundleCleanerBuilder
 	return b
 }
 
+// SetForce sets a flag that indicates if the cleaner should clean even if it can't confirm that the
+// upgrade has completed. Without this the cleaner checks the cluster version and the machine
+// configuration state of the node, and refuses to remove the pinning configuration while the
+// upgrade is still in progress. This is optional and the default is false.
+func (b *BundleCleanerBuilder) SetForce(value bool) *BundleCleanerBuilder {
+	b.force = value
+	return b
+}
+
+// SetRemoveOldImages sets a flag that indicates if the cleaner should remove from the CRI-O storage
+// the images of previous releases. Those are the images that are in the same repositories than the
+// images of the current release, but that aren't part of it and aren't used by any container.
+// This is optional and the default is to not remove any image.
+func (b *BundleCleanerBuilder) SetRemoveOldImages(value bool) *BundleCleanerBuilder {
+	b.removeOld = value
+	return b
+}
+
+// SetKeepPinning sets a flag that indicates if the cleaner should keep the CRI-O configuration that
+// pins the images of the release, so that CRI-O will not garbage collect them. This is optional
+// and the default is to remove it.
+func (b *BundleCleanerBuilder) SetKeepPinning(value bool) *BundleCleanerBuilder {
+	b.keepPin = value
+	return b
+}
+
+// SetDryRun sets a flag that indicates if the cleaner should only report what directories, CRI-O
+// configuration files and images it would remove, without changing anything. This is optional and
+// the default is false.
+func (b *BundleCleanerBuilder) SetDryRun(value bool) *BundleCleanerBuilder {
+	b.dryRun = value
+	return b
+}
+
+// SetTempAge sets the minimum age of the temporary directories left behind by runs of the registry
+// and skopeo that didn't finish correctly. Directories younger than this are assumed to be in use
+// and aren't removed. This is optional and the default is one hour.
+func (b *BundleCleanerBuilder) SetTempAge(value time.Duration) *BundleCleanerBuilder {
+	b.tempAge = value
+	return b
+}
+
 // Build uses the data stored in the builder to create and configure a new bundle cleaner.
 func (b *BundleCleanerBuilder) Build() (result *BundleCleaner, err error) {
 	// Check parameters:
@@ -111,6 +188,13 @@ func (b *BundleCleanerBuilder) Build() (result *BundleCleaner, err error) {
 		err = errors.New("bundle directory is mandatory")
 		return
 	}
+	if b.tempAge < 0 {
+		err = fmt.Errorf(
+			"temporary directory age %s isn't valid, it must be greater than or equal to zero",
+			b.tempAge,
+		)
+		return
+	}
 
 	// Create the CRI-O tool:
 	crioTool, err := NewCRIOTool().
@@ -129,26 +213,84 @@ func (b *BundleCleanerBuilder) Build() (result *BundleCleaner, err error) {
 		node:      b.node,
 		rootDir:   b.rootDir,
 		bundleDir: b.bundleDir,
+		force:     b.force,
+		removeOld: b.removeOld,
+		keepPin:   b.keepPin,
+		dryRun:    b.dryRun,
+		tempAge:   b.tempAge,
 		crioTool:  crioTool,
 	}
+
+	// In dry run mode the status and the events aren't written, as nothing changes:
+	if !b.dryRun {
+		result.status = newNodeStatusWriter(b.logger, b.client, b.namespace, b.node)
+		result.events = newNodeEventWriter(b.logger, b.client, b.node, nodeEventCleanerComponent)
+	}
 	return
 }
 
 func (l *BundleCleaner) Run(ctx context.Context) error {
+	// Check that the upgrade has completed, as removing the pinning configuration while it is
+	// in progress could result in the removal of images that are still needed:
+	l.status.start(ctx, v1alpha1.NodeUpgradeCleaning)
+	l.events.normal(ctx, nodeEventCleaning, "Started cleaning bundle")
+	err := l.checkUpgrade(ctx)
+	if err != nil && l.dryRun {
+		l.logger.Info(
+			"Cleaning would be refused, but will continue because this is a dry run",
+			"reason", err.Error(),
+		)
+		err = nil
+	}
+	if err != nil {
+		l.status.fail(ctx, err.Error())
+		l.events.warning(ctx, nodeEventCleaningFailed, err.Error())
+		return err
+	}
+
 	// Clean the bundle directory:
-	err := l.cleanBundleDir(ctx)
+	err = l.cleanBundleDir(ctx)
 	if err != nil {
+		l.status.fail(ctx, err.Error())
+		l.events.warning(ctx, nodeEventCleaningFailed, err.Error())
 		return err
 	}
 	l.logger.Info("Cleaned bundle directory")
 
+	// Remove the temporary directories left behind by runs that didn't finish correctly:
+	err = l.cleanTempDirs(ctx)
+	if err != nil {
+		l.status.fail(ctx, err.Error())
+		l.events.warning(ctx, nodeEventCleaningFailed, err.Error())
+		return err
+	}
+
+	// Remove the images of previous releases. This needs to be done before cleaning the CRI-O
+	// configuration because the pinned images are the images of the current release.
+	if l.removeOld {
+		err = l.removeOldImages(ctx)
+		if err != nil {
+			l.status.fail(ctx, err.Error())
+			l.events.warning(ctx, nodeEventCleaningFailed, err.Error())
+			return err
+		}
+	}
+
 	// Clean the CRI-O configuration:
 	err = l.cleanCRIO(ctx)
 	if err != nil {
+		l.status.fail(ctx, err.Error())
+		l.events.warning(ctx, nodeEventCleaningFailed, err.Error())
 		return err
 	}
 	l.logger.Info("Cleaned CRI-O")
 
+	// In dry run mode the node isn't changed:
+	if l.dryRun {
+		l.logger.Info("Finished dry run, nothing has been changed")
+		return nil
+	}
+
 	// Write the node annotations that indicate the result:
 	err = l.writeResult(ctx)
 	if err != nil {
@@ -158,24 +300,213 @@ func (l *BundleCleaner) Run(ctx context.Context) error {
 	return nil
 }
 
+// checkUpgrade checks that the upgrade has completed, both in the cluster and in the node. If it
+// hasn't it returns an error, unless the force flag is set.
+func (c *BundleCleaner) checkUpgrade(ctx context.Context) error {
+	problems, err := c.upgradeProblems(ctx)
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		c.logger.Info("Verified that the upgrade has completed")
+		return nil
+	}
+	if c.force {
+		c.logger.Info(
+			"Upgrade hasn't completed, but will clean anyhow because force is enabled",
+			"problems", problems,
+		)
+		return nil
+	}
+	return fmt.Errorf(
+		"upgrade hasn't completed: %s; use the force option to clean anyhow",
+		strings.Join(problems, ", "),
+	)
+}
+
+// upgradeProblems returns the descriptions of the reasons why the upgrade can't be considered
+// completed. An empty result means that it has completed.
+func (c *BundleCleaner) upgradeProblems(ctx context.Context) (result []string, err error) {
+	// Get the node and the metadata of the bundle that was loaded into it:
+	node := &corev1.Node{}
+	err = c.client.Get(ctx, clnt.ObjectKey{Name: c.node}, node)
+	if err != nil {
+		return
+	}
+	var metadata *Metadata
+	value := node.Annotations[annotations.BundleMetadata]
+	if value != "" {
+		err = json.Unmarshal([]byte(value), &metadata)
+		if err != nil {
+			err = fmt.Errorf("failed to parse bundle metadata of node '%s': %w", c.node, err)
+			return
+		}
+	}
+	if metadata == nil {
+		result = append(result, "node doesn't have the bundle metadata")
+	}
+
+	// Check that the cluster version has completed the update to the release of the bundle:
+	version := &configv1.ClusterVersion{}
+	err = c.client.Get(ctx, clnt.ObjectKey{Name: "version"}, version)
+	if apierrors.IsNotFound(err) {
+		err = nil
+		result = append(result, "cluster version doesn't exist")
+	}
+	if err != nil {
+		return
+	}
+	if version.Name != "" {
+		result = append(result, c.versionProblems(version, metadata)...)
+	}
+
+	// Check that the machine configuration of the node has been applied. These annotations
+	// don't exist in clusters without the machine config operator, and then there is nothing
+	// to check.
+	state := node.Annotations[bundleCleanerMachineConfigState]
+	if state != "" && state != bundleCleanerMachineConfigDone {
+		result = append(result, fmt.Sprintf("machine configuration state is '%s'", state))
+	}
+	current := node.Annotations[bundleCleanerMachineConfigCurrent]
+	desired := node.Annotations[bundleCleanerMachineConfigDesired]
+	if current != desired {
+		result = append(result, fmt.Sprintf(
+			"machine configuration '%s' hasn't been applied yet, current is '%s'",
+			desired, current,
+		))
+	}
+	return
+}
+
+func (c *BundleCleaner) versionProblems(version *configv1.ClusterVersion,
+	metadata *Metadata) (result []string) {
+	desired := version.Status.Desired
+	if metadata != nil && desired.Image != metadata.Release && desired.Version != metadata.Version {
+		result = append(result, fmt.Sprintf(
+			"cluster desired release is '%s' instead of '%s'",
+			desired.Image, metadata.Release,
+		))
+	}
+	if len(version.Status.History) == 0 {
+		result = append(result, "cluster version doesn't have update history")
+	} else {
+		last := version.Status.History[0]
+		if last.State != configv1.CompletedUpdate {
+			result = append(result, fmt.Sprintf(
+				"update to version '%s' is in state '%s'",
+				last.Version, last.State,
+			))
+		}
+	}
+	for _, condition := range version.Status.Conditions {
+		if condition.Type == configv1.OperatorProgressing &&
+			condition.Status == configv1.ConditionTrue {
+			result = append(result, "cluster version is progressing")
+		}
+	}
+	return
+}
+
 func (c *BundleCleaner) cleanBundleDir(ctx context.Context) error {
+	// Remove the bundle directory, the temporary directory used while extracting it, and the
+	// replica of the bundle file that the extractor creates when replication is enabled, with
+	// the partial download files used to create it:
 	dir := c.absolutePath(c.bundleDir)
-	err := os.RemoveAll(dir)
+	replica := fmt.Sprintf("%s.tar", dir)
+	paths := []string{
+		dir,
+		dir + ".tmp",
+		replica,
+		replica + ".tmp",
+		replica + ".part",
+		replica + ".part.json",
+	}
+	for _, path := range paths {
+		err := c.removePath(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanTempDirs removes the temporary directories created by the registry and by skopeo when they
+// are older than the configured age. Those directories are usually removed when the process that
+// created them finishes, but they are left behind when it crashes or is killed.
+func (c *BundleCleaner) cleanTempDirs(ctx context.Context) error {
+	limit := time.Now().Add(-c.tempAge)
+	for _, tempDir := range bundleCleanerTempDirs {
+		tempDir = c.absolutePath(tempDir)
+		entries, err := os.ReadDir(tempDir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(limit) {
+				continue
+			}
+			path := filepath.Join(tempDir, entry.Name())
+			if !c.isStaleTempDir(path) {
+				continue
+			}
+			err = c.removePath(path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isStaleTempDir checks if the given directory is one of the temporary directories that the tool
+// creates, using the suffixes of the names used by the registry and by skopeo.
+func (c *BundleCleaner) isStaleTempDir(path string) bool {
+	name := filepath.Base(path)
+	for _, suffix := range bundleCleanerTempSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// removePath removes the given file or directory, if it exists. In dry run mode it only writes to
+// the log what would be removed.
+func (c *BundleCleaner) removePath(path string) error {
+	_, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	c.logger.Info(
-		"Removed bundle directory",
-		"dir", dir,
-	)
-	tmp := fmt.Sprintf("%s.tmp", dir)
-	err = os.RemoveAll(tmp)
+	if c.dryRun {
+		c.logger.Info(
+			"Would remove path",
+			"path", path,
+		)
+		return nil
+	}
+	err = os.RemoveAll(path)
 	if err != nil {
 		return err
 	}
 	c.logger.Info(
-		"Removed bundle directory",
-		"dir", dir,
+		"Removed path",
+		"path", path,
 	)
 	return nil
 }
@@ -189,20 +520,156 @@ func (c *BundleCleaner) absolutePath(relPath string) string {
 }
 
 func (c *BundleCleaner) cleanCRIO(ctx context.Context) error {
+	// In dry run mode only report the configuration files that exist:
+	if c.dryRun {
+		files, err := c.crioTool.ConfFiles()
+		if err != nil {
+			return err
+		}
+		pin := c.crioTool.absolutePath(crioPinConf)
+		for _, file := range files {
+			if c.keepPin && file == pin {
+				continue
+			}
+			c.logger.Info(
+				"Would remove CRI-O configuration file",
+				"file", file,
+			)
+		}
+		c.logger.Info("Would reload CRI-O")
+		return nil
+	}
+
 	// Remove the configuration files:
 	err := c.crioTool.RemoveMirrorConf()
 	if err != nil {
 		return err
 	}
-	err = c.crioTool.RemovePinConf()
-	if err != nil {
-		return err
+	if c.keepPin {
+		c.logger.Info("Keeping pinning configuration")
+	} else {
+		err = c.crioTool.RemovePinConf()
+		if err != nil {
+			return err
+		}
 	}
 
 	// Reload the service:
 	return c.crioTool.ReloadService(ctx)
 }
 
+// removeOldImages removes the images of previous releases. Failures to remove individual images
+// are written to the log, but don't stop the process.
+func (c *BundleCleaner) removeOldImages(ctx context.Context) error {
+	current, err := c.crioTool.PinnedImages()
+	if err != nil {
+		return err
+	}
+	if len(current) == 0 {
+		c.logger.Info(
+			"There are no pinned images, will not remove old images because the images " +
+				"of the current release are unknown",
+		)
+		return nil
+	}
+	images, err := c.crioTool.ListImages(ctx)
+	if err != nil {
+		return err
+	}
+	used, err := c.crioTool.UsedImages(ctx)
+	if err != nil {
+		return err
+	}
+	old, err := c.selectOldImages(images, current, used)
+	if err != nil {
+		return err
+	}
+	if c.dryRun {
+		var size uint64
+		for _, image := range old {
+			c.logger.Info(
+				"Would remove old image",
+				"id", image.Id,
+				"digests", image.RepoDigests,
+				"size", humanize.IBytes(image.Size_),
+			)
+			size += image.Size_
+		}
+		c.logger.Info(
+			"Would remove old images",
+			"count", len(old),
+			"reclaimed", humanize.IBytes(size),
+		)
+		return nil
+	}
+	var (
+		removed   int
+		reclaimed uint64
+	)
+	for _, image := range old {
+		err = c.crioTool.RemoveImage(ctx, image.Id)
+		if err != nil {
+			c.logger.Error(
+				err,
+				"Failed to remove old image",
+				"id", image.Id,
+				"digests", image.RepoDigests,
+			)
+			continue
+		}
+		removed++
+		reclaimed += image.Size_
+	}
+	c.logger.Info(
+		"Removed old images",
+		"candidates", len(old),
+		"removed", removed,
+		"reclaimed", humanize.IBytes(reclaimed),
+	)
+	return nil
+}
+
+// selectOldImages selects the images that belong only to previous releases. Those are the images
+// that are in the repositories of the current images, that aren't current, and that aren't used by
+// any container. Images that have tags are also kept, as the images of releases are always
+// referenced by digest.
+func (c *BundleCleaner) selectOldImages(images []*criv1.Image, current []string,
+	used map[string]bool) (result []*criv1.Image, err error) {
+	repos := map[string]bool{}
+	for _, ref := range current {
+		var named dreference.Named
+		named, err = dreference.ParseNormalizedNamed(ref)
+		if err != nil {
+			return
+		}
+		repos[named.Name()] = true
+	}
+	for _, image := range images {
+		if used[image.Id] || len(image.RepoTags) > 0 {
+			continue
+		}
+		inRepos := false
+		keep := false
+		for _, repoDigest := range image.RepoDigests {
+			if slices.Contains(current, repoDigest) || used[repoDigest] {
+				keep = true
+				break
+			}
+			named, err := dreference.ParseNormalizedNamed(repoDigest)
+			if err != nil {
+				continue
+			}
+			if repos[named.Name()] {
+				inRepos = true
+			}
+		}
+		if inRepos && !keep {
+			result = append(result, image)
+		}
+	}
+	return
+}
+
 func (c *BundleCleaner) writeResult(ctx context.Context) error {
 	// Fetch the node:
 	nodeObject := &corev1.Node{}
@@ -214,13 +681,36 @@ func (c *BundleCleaner) writeResult(ctx context.Context) error {
 		return err
 	}
 
-	// Apply the patch:
-	loadedText := strconv.FormatBool(true)
+	// Add the entry for this upgrade to the history:
+	history, err := c.updateHistory(nodeObject)
+	if err != nil {
+		return err
+	}
+
+	// Remove all the labels and annotations of the tool, so that the next upgrade starts from a
+	// clean state, except the history and the label that indicates that the node has been
+	// cleaned:
 	nodeUpdate := nodeObject.DeepCopy()
+	for name := range nodeUpdate.Labels {
+		if labels.Owned(name) {
+			delete(nodeUpdate.Labels, name)
+		}
+	}
+	for name := range nodeUpdate.Annotations {
+		if annotations.Owned(name) {
+			delete(nodeUpdate.Annotations, name)
+		}
+	}
 	if nodeUpdate.Labels == nil {
 		nodeUpdate.Labels = map[string]string{}
 	}
-	nodeUpdate.Labels[labels.BundleCleaned] = loadedText
+	nodeUpdate.Labels[labels.BundleCleaned] = strconv.FormatBool(true)
+	if nodeUpdate.Annotations == nil {
+		nodeUpdate.Annotations = map[string]string{}
+	}
+	nodeUpdate.Annotations[annotations.History] = history
+
+	// Apply the patch:
 	nodePatch := clnt.MergeFrom(nodeObject)
 	err = c.client.Patch(ctx, nodeUpdate, nodePatch)
 	if err != nil {
@@ -230,5 +720,111 @@ func (c *BundleCleaner) writeResult(ctx context.Context) error {
 		"Wrote success",
 		"node", c.node,
 	)
+	c.status.succeed(ctx, v1alpha1.NodeUpgradeCleaned)
+	c.events.normal(ctx, nodeEventCleaned, "Finished cleaning bundle")
 	return nil
 }
+
+// updateHistory returns the text of the history annotation of the node with a new entry that
+// describes the upgrade that has been cleaned. Only the most recent entries are kept.
+func (c *BundleCleaner) updateHistory(node *corev1.Node) (result string, err error) {
+	var history []bundleCleanerHistoryEntry
+	value := node.Annotations[annotations.History]
+	if value != "" {
+		err = json.Unmarshal([]byte(value), &history)
+		if err != nil {
+			c.logger.Error(
+				err,
+				"Failed to parse history, will start a new one",
+				"node", c.node,
+			)
+			history = nil
+			err = nil
+		}
+	}
+	entry := bundleCleanerHistoryEntry{
+		Cleaned: time.Now().UTC(),
+	}
+	value = node.Annotations[annotations.BundleMetadata]
+	if value != "" {
+		var metadata *Metadata
+		err = json.Unmarshal([]byte(value), &metadata)
+		if err != nil {
+			return
+		}
+		entry.Version = metadata.Version
+		entry.Arch = metadata.Arch
+		entry.Release = metadata.Release
+	}
+	history = append(history, entry)
+	if len(history) > bundleCleanerHistoryLimit {
+		history = history[len(history)-bundleCleanerHistoryLimit:]
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		return
+	}
+	result = string(data)
+	return
+}
+
+// bundleCleanerHistoryEntry is an entry of the history annotation of the node.
+type bundleCleanerHistoryEntry struct {
+	Version string    `json:"version,omitempty"`
+	Arch    string    `json:"arch,omitempty"`
+	Release string    `json:"release,omitempty"`
+	Cleaned time.Time `json:"cleaned"`
+}
+
+// bundleCleanerHistoryLimit is the maximum number of entries kept in the history annotation.
+const bundleCleanerHistoryLimit = 10
+
+// Annotations that the machine config daemon adds to the node to describe the state of its
+// configuration.
+const (
+	bundleCleanerMachineConfigCurrent = "machineconfiguration.openshift.io/currentConfig"
+	bundleCleanerMachineConfigDesired = "machineconfiguration.openshift.io/desiredConfig"
+	bundleCleanerMachineConfigState   = "machineconfiguration.openshift.io/state"
+	bundleCleanerMachineConfigDone    = "Done"
+)
+
+// bundleCleanerDefaultTempAge is the default minimum age of the temporary directories that the
+// cleaner removes.
+const bundleCleanerDefaultTempAge = time.Hour
+
+// bundleCleanerTempDirs are the directories, relative to the root directory, where the cleaner
+// looks for temporary directories left behind by runs that didn't finish correctly.
+var bundleCleanerTempDirs = []string{
+	"/tmp",
+	"/var/tmp",
+}
+
+// bundleCleanerTempSuffixes are the suffixes of the names of the temporary directories created by
+// the registry and by the skopeo based image downloads.
+var bundleCleanerTempSuffixes = []string{
+	".registry",
+	".skopeo",
+}
+
+// bundleCleanerPermissions are the permissions that the cleaner needs to read and update the
+// annotations and labels of the node, to check the version of the cluster, and to report the
+// progress.
+var bundleCleanerPermissions = rbacPermissions{
+	cluster: append(
+		[]rbacv1.PolicyRule{
+			{
+				APIGroups: []string{""},
+				Resources: []string{"nodes"},
+				Verbs:     []string{"get", "patch"},
+			},
+			{
+				APIGroups: []string{configv1.GroupName},
+				Resources: []string{"clusterversions"},
+				Verbs:     []string{"get"},
+			},
+		},
+		nodeEventRules...,
+	),
+	namespace:  nodeStatusRules,
+	privileged: true,
+}
@@ -0,0 +1,515 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	core "k8s.io/client-go/kubernetes/scheme"
+	criv1 "k8s.io/cri-api/pkg/apis/runtime/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/labels"
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Bundle cleaner", func() {
+	var (
+		ctx     context.Context
+		node    *corev1.Node
+		version *configv1.ClusterVersion
+		cleaner *BundleCleaner
+	)
+
+	BeforeEach(func() {
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a node and a cluster version that have completed the upgrade:
+		node = &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "my-node",
+				Annotations: map[string]string{
+					annotations.BundleMetadata: `{
+						"version": "4.14.1",
+						"release": "quay.io/openshift/release@sha256:123"
+					}`,
+					bundleCleanerMachineConfigCurrent: "rendered-worker-2",
+					bundleCleanerMachineConfigDesired: "rendered-worker-2",
+					bundleCleanerMachineConfigState:   bundleCleanerMachineConfigDone,
+				},
+			},
+		}
+		version = &configv1.ClusterVersion{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "version",
+			},
+			Status: configv1.ClusterVersionStatus{
+				Desired: configv1.Release{
+					Version: "4.14.1",
+					Image:   "quay.io/openshift/release@sha256:123",
+				},
+				History: []configv1.UpdateHistory{{
+					State:   configv1.CompletedUpdate,
+					Version: "4.14.1",
+					Image:   "quay.io/openshift/release@sha256:123",
+				}},
+				Conditions: []configv1.ClusterOperatorStatusCondition{{
+					Type:   configv1.OperatorProgressing,
+					Status: configv1.ConditionFalse,
+				}},
+			},
+		}
+	})
+
+	// createCleaner creates the cleaner with an API client that contains the node and the
+	// cluster version.
+	createCleaner := func() {
+		logger, err := logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		scheme := runtime.NewScheme()
+		core.AddToScheme(scheme)
+		configv1.AddToScheme(scheme)
+		objects := []runtime.Object{node}
+		if version != nil {
+			objects = append(objects, version)
+		}
+		client := fake.NewClientBuilder().
+			WithScheme(scheme).
+			WithRuntimeObjects(objects...).
+			Build()
+		cleaner = &BundleCleaner{
+			logger:  logger,
+			client:  client,
+			node:    "my-node",
+			tempAge: bundleCleanerDefaultTempAge,
+		}
+	}
+
+	It("Accepts completed upgrade", func() {
+		createCleaner()
+		err := cleaner.checkUpgrade(ctx)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Rejects upgrade that is still progressing", func() {
+		version.Status.History[0].State = configv1.PartialUpdate
+		version.Status.Conditions[0].Status = configv1.ConditionTrue
+		createCleaner()
+		err := cleaner.checkUpgrade(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("state 'Partial'"))
+		Expect(err.Error()).To(ContainSubstring("is progressing"))
+		Expect(err.Error()).To(ContainSubstring("force"))
+	})
+
+	It("Rejects cluster that is upgrading to a different release", func() {
+		version.Status.Desired.Version = "4.14.2"
+		version.Status.Desired.Image = "quay.io/openshift/release@sha256:456"
+		createCleaner()
+		err := cleaner.checkUpgrade(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("sha256:456"))
+	})
+
+	It("Rejects node whose machine configuration hasn't been applied", func() {
+		node.Annotations[bundleCleanerMachineConfigDesired] = "rendered-worker-3"
+		node.Annotations[bundleCleanerMachineConfigState] = "Working"
+		createCleaner()
+		err := cleaner.checkUpgrade(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("rendered-worker-3"))
+		Expect(err.Error()).To(ContainSubstring("'Working'"))
+	})
+
+	It("Accepts node without machine config annotations", func() {
+		delete(node.Annotations, bundleCleanerMachineConfigCurrent)
+		delete(node.Annotations, bundleCleanerMachineConfigDesired)
+		delete(node.Annotations, bundleCleanerMachineConfigState)
+		createCleaner()
+		err := cleaner.checkUpgrade(ctx)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Rejects node without bundle metadata", func() {
+		delete(node.Annotations, annotations.BundleMetadata)
+		createCleaner()
+		err := cleaner.checkUpgrade(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("metadata"))
+	})
+
+	It("Rejects cluster without cluster version", func() {
+		version = nil
+		createCleaner()
+		err := cleaner.checkUpgrade(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("cluster version doesn't exist"))
+	})
+
+	It("Accepts upgrade in progress when forced", func() {
+		version.Status.History[0].State = configv1.PartialUpdate
+		createCleaner()
+		cleaner.force = true
+		err := cleaner.checkUpgrade(ctx)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("Result", func() {
+		It("Removes the labels and annotations of the tool", func() {
+			node.Labels = map[string]string{
+				labels.BundleExtracted:   "true",
+				labels.BundleLoaded:      "true",
+				"kubernetes.io/hostname": "my-node",
+			}
+			node.Annotations[annotations.Progress] = "Pulled 10 of 10 images"
+			node.Annotations[annotations.Error] = "Something failed"
+			node.Annotations[annotations.ImageStore] = "{}"
+			createCleaner()
+			err := cleaner.writeResult(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			result := &corev1.Node{}
+			err = cleaner.client.Get(ctx, clnt.ObjectKey{Name: "my-node"}, result)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Labels).To(Equal(map[string]string{
+				labels.BundleCleaned:     "true",
+				"kubernetes.io/hostname": "my-node",
+			}))
+			Expect(result.Annotations).To(HaveKey(annotations.History))
+			Expect(result.Annotations).To(HaveKey(bundleCleanerMachineConfigState))
+			for name := range result.Annotations {
+				if name != annotations.History {
+					Expect(annotations.Owned(name)).To(BeFalse(), name)
+				}
+			}
+		})
+
+		It("Adds an entry to the history", func() {
+			node.Annotations[annotations.History] = `[{
+				"version": "4.14.0",
+				"cleaned": "2023-10-01T00:00:00Z"
+			}]`
+			createCleaner()
+			err := cleaner.writeResult(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			result := &corev1.Node{}
+			err = cleaner.client.Get(ctx, clnt.ObjectKey{Name: "my-node"}, result)
+			Expect(err).ToNot(HaveOccurred())
+			var history []bundleCleanerHistoryEntry
+			err = json.Unmarshal([]byte(result.Annotations[annotations.History]), &history)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(history).To(HaveLen(2))
+			Expect(history[0].Version).To(Equal("4.14.0"))
+			Expect(history[1].Version).To(Equal("4.14.1"))
+			Expect(history[1].Release).To(Equal("quay.io/openshift/release@sha256:123"))
+			Expect(history[1].Cleaned).ToNot(BeZero())
+		})
+
+		It("Keeps only the most recent history entries", func() {
+			entries := make([]bundleCleanerHistoryEntry, bundleCleanerHistoryLimit)
+			data, err := json.Marshal(entries)
+			Expect(err).ToNot(HaveOccurred())
+			node.Annotations[annotations.History] = string(data)
+			createCleaner()
+			text, err := cleaner.updateHistory(node)
+			Expect(err).ToNot(HaveOccurred())
+			var history []bundleCleanerHistoryEntry
+			err = json.Unmarshal([]byte(text), &history)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(history).To(HaveLen(bundleCleanerHistoryLimit))
+			Expect(history[len(history)-1].Version).To(Equal("4.14.1"))
+		})
+	})
+
+	Describe("Old images", func() {
+		var (
+			images         *bundleCleanerFakeImageClient
+			runtimeService *fakeRuntimeClient
+			pin            string
+		)
+
+		// digest returns a digest made repeating the given character.
+		digest := func(c string) string {
+			return "sha256:" + strings.Repeat(c, 64)
+		}
+
+		BeforeEach(func() {
+			createCleaner()
+
+			// Create a temporary directory for the pinning configuration:
+			tmp, err := os.MkdirTemp("", "*.test")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, tmp)
+			pin = filepath.Join(tmp, crioPinConf)
+			err = os.MkdirAll(filepath.Dir(pin), 0755)
+			Expect(err).ToNot(HaveOccurred())
+
+			// Create the CRI-O tool with fake services. The current release has the
+			// images 'a' and 'b', the previous one had 'a', 'c' and 'd', and 'd' is still
+			// used by a container. There is also an image from another repository.
+			images = &bundleCleanerFakeImageClient{
+				images: []*criv1.Image{
+					{
+						Id:          "a",
+						RepoDigests: []string{"quay.io/openshift/release@" + digest("a")},
+					},
+					{
+						Id:          "b",
+						RepoDigests: []string{"quay.io/openshift/release@" + digest("b")},
+					},
+					{
+						Id:          "c",
+						RepoDigests: []string{"quay.io/openshift/release@" + digest("c")},
+						Size_:       1000,
+					},
+					{
+						Id:          "d",
+						RepoDigests: []string{"quay.io/openshift/release@" + digest("d")},
+					},
+					{
+						Id:          "e",
+						RepoDigests: []string{"quay.io/my/app@" + digest("e")},
+					},
+					{
+						Id:          "f",
+						RepoTags:    []string{"quay.io/openshift/release:latest"},
+						RepoDigests: []string{"quay.io/openshift/release@" + digest("f")},
+					},
+				},
+			}
+			runtimeService = &fakeRuntimeClient{
+				containers: []*criv1.Container{{
+					ImageRef: "d",
+				}},
+			}
+			cleaner.crioTool = &CRIOTool{
+				logger:        cleaner.logger,
+				rootDir:       tmp,
+				imageClient:   images,
+				runtimeClient: runtimeService,
+			}
+			err = cleaner.crioTool.CreatePinConf([]string{
+				"quay.io/openshift/release@" + digest("a"),
+				"quay.io/openshift/release@" + digest("b"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Removes only the images of previous releases", func() {
+			err := cleaner.removeOldImages(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(images.removed).To(ConsistOf("c"))
+		})
+
+		It("Doesn't remove anything if there are no pinned images", func() {
+			err := os.Remove(pin)
+			Expect(err).ToNot(HaveOccurred())
+			err = cleaner.removeOldImages(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(images.removed).To(BeEmpty())
+		})
+	})
+
+	Describe("Temporary directories", func() {
+		var tmp string
+
+		BeforeEach(func() {
+			createCleaner()
+			var err error
+			tmp, err = os.MkdirTemp("", "*.test")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, tmp)
+			cleaner.rootDir = tmp
+		})
+
+		// makeDir creates a temporary directory with the given name, files and age.
+		makeDir := func(name string, files []string, age time.Duration) string {
+			dir := filepath.Join(tmp, "tmp", name)
+			err := os.MkdirAll(dir, 0700)
+			Expect(err).ToNot(HaveOccurred())
+			for _, file := range files {
+				err = os.WriteFile(filepath.Join(dir, file), []byte("data"), 0400)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			modTime := time.Now().Add(-age)
+			err = os.Chtimes(dir, modTime, modTime)
+			Expect(err).ToNot(HaveOccurred())
+			return dir
+		}
+
+		It("Removes old registry and skopeo directories", func() {
+			registry := makeDir("123.registry", []string{"tls.crt", "tls.key"}, 2*time.Hour)
+			skopeo := makeDir("456.skopeo", []string{"tls.crt"}, 2*time.Hour)
+			err := cleaner.cleanTempDirs(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(registry).ToNot(BeADirectory())
+			Expect(skopeo).ToNot(BeADirectory())
+		})
+
+		It("Keeps old directories that contain only TLS files", func() {
+			dir := makeDir("789", []string{"tls.crt", "tls.key"}, 2*time.Hour)
+			err := cleaner.cleanTempDirs(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dir).To(BeADirectory())
+		})
+
+		It("Keeps recent directories", func() {
+			dir := makeDir("123.registry", []string{"tls.crt", "tls.key"}, time.Minute)
+			err := cleaner.cleanTempDirs(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dir).To(BeADirectory())
+		})
+
+		It("Keeps directories that aren't created by the tool", func() {
+			other := makeDir("other", []string{"tls.crt", "data.txt"}, 2*time.Hour)
+			empty := makeDir("empty", nil, 2*time.Hour)
+			err := cleaner.cleanTempDirs(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(other).To(BeADirectory())
+			Expect(empty).To(BeADirectory())
+		})
+
+		It("Doesn't remove anything in dry run mode", func() {
+			dir := makeDir("123.registry", []string{"tls.crt", "tls.key"}, 2*time.Hour)
+			cleaner.dryRun = true
+			err := cleaner.cleanTempDirs(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dir).To(BeADirectory())
+		})
+	})
+
+	Describe("Dry run", func() {
+		var (
+			tmp    string
+			bundle string
+			pin    string
+			images *bundleCleanerFakeImageClient
+		)
+
+		BeforeEach(func() {
+			createCleaner()
+
+			// Create a root directory with the bundle, the replica and the pinning
+			// configuration:
+			var err error
+			tmp, err = os.MkdirTemp("", "*.test")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, tmp)
+			bundle = filepath.Join(tmp, "var", "lib", "upgrade")
+			err = os.MkdirAll(bundle, 0755)
+			Expect(err).ToNot(HaveOccurred())
+			err = os.WriteFile(bundle+".tar", []byte("replica"), 0644)
+			Expect(err).ToNot(HaveOccurred())
+			pin = filepath.Join(tmp, crioPinConf)
+			err = os.MkdirAll(filepath.Dir(pin), 0755)
+			Expect(err).ToNot(HaveOccurred())
+			cleaner.rootDir = tmp
+			cleaner.bundleDir = "/var/lib/upgrade"
+
+			// Create the CRI-O tool with an old image:
+			images = &bundleCleanerFakeImageClient{
+				images: []*criv1.Image{{
+					Id: "old",
+					RepoDigests: []string{
+						"quay.io/openshift/release@sha256:" + strings.Repeat("b", 64),
+					},
+				}},
+			}
+			cleaner.crioTool = &CRIOTool{
+				logger:        cleaner.logger,
+				rootDir:       tmp,
+				imageClient:   images,
+				runtimeClient: &fakeRuntimeClient{},
+			}
+			err = cleaner.crioTool.CreatePinConf([]string{
+				"quay.io/openshift/release@sha256:" + strings.Repeat("a", 64),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Removes the bundle directory and the replica", func() {
+			err := cleaner.cleanBundleDir(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bundle).ToNot(BeAnExistingFile())
+			Expect(bundle + ".tar").ToNot(BeAnExistingFile())
+		})
+
+		It("Doesn't change anything", func() {
+			cleaner.dryRun = true
+			cleaner.removeOld = true
+			err := cleaner.Run(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bundle).To(BeADirectory())
+			Expect(bundle + ".tar").To(BeARegularFile())
+			Expect(pin).To(BeARegularFile())
+			Expect(images.removed).To(BeEmpty())
+			result := &corev1.Node{}
+			err = cleaner.client.Get(ctx, clnt.ObjectKey{Name: "my-node"}, result)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Labels).ToNot(HaveKey(labels.BundleCleaned))
+		})
+
+		It("Doesn't fail if the upgrade hasn't completed", func() {
+			version.Status.History[0].State = configv1.PartialUpdate
+			err := cleaner.client.Update(ctx, version)
+			Expect(err).ToNot(HaveOccurred())
+			cleaner.dryRun = true
+			err = cleaner.Run(ctx)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+})
+
+// bundleCleanerFakeImageClient is an implementation of the CRI image service that only supports
+// listing and removing images.
+type bundleCleanerFakeImageClient struct {
+	criv1.ImageServiceClient
+	images  []*criv1.Image
+	removed []string
+}
+
+func (c *bundleCleanerFakeImageClient) ListImages(ctx context.Context,
+	in *criv1.ListImagesRequest, opts ...grpc.CallOption) (out *criv1.ListImagesResponse,
+	err error) {
+	out = &criv1.ListImagesResponse{
+		Images: c.images,
+	}
+	return
+}
+
+func (c *bundleCleanerFakeImageClient) RemoveImage(ctx context.Context,
+	in *criv1.RemoveImageRequest, opts ...grpc.CallOption) (out *criv1.RemoveImageResponse,
+	err error) {
+	c.removed = append(c.removed, in.Image.Image)
+	out = &criv1.RemoveImageResponse{}
+	return
+}
@@ -0,0 +1,349 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+	"github.com/jhernand/upgrade-tool/internal/labels"
+)
+
+// bundleCreationReconciler reconciles BundleCreation objects, running the bundle creator inside a
+// job and reporting the progress in the status.
+type bundleCreationReconciler struct {
+	logger logr.Logger
+	client clnt.Client
+}
+
+func (r *bundleCreationReconciler) Reconcile(ctx context.Context,
+	request ctrl.Request) (result ctrl.Result, err error) {
+	// Fetch the object:
+	object := &v1alpha1.BundleCreation{}
+	err = r.client.Get(ctx, request.NamespacedName, object)
+	if apierrors.IsNotFound(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	// Nothing to do if it already finished:
+	switch object.Status.Phase {
+	case v1alpha1.BundleCreationSucceeded, v1alpha1.BundleCreationFailed:
+		r.logger.V(2).Info(
+			"Bundle creation already finished",
+			"namespace", object.Namespace,
+			"name", object.Name,
+			"phase", object.Status.Phase,
+		)
+		return
+	}
+
+	// Check the storage. Errors here will not be fixed retrying, so we report them in the
+	// status instead of returning them:
+	update := object.DeepCopy()
+	message := r.checkStorage(object)
+	if message != "" {
+		update.Status.Phase = v1alpha1.BundleCreationFailed
+		update.Status.Message = message
+		err = r.writeStatus(ctx, object, update)
+		return
+	}
+
+	// Make sure that the job exists:
+	job, err := r.ensureJob(ctx, object)
+	if err != nil {
+		return
+	}
+
+	// Update the status according to the state of the job:
+	r.updateStatus(update, job)
+	err = r.writeStatus(ctx, object, update)
+	return
+}
+
+// checkStorage checks that the spec describes exactly one kind of storage. Returns a message
+// describing the problem, or an empty string if there is no problem.
+func (r *bundleCreationReconciler) checkStorage(object *v1alpha1.BundleCreation) string {
+	storage := object.Spec.Storage
+	switch {
+	case storage.PersistentVolumeClaim == nil && storage.ObjectStore == nil:
+		return "Storage must specify a persistent volume claim or an object store"
+	case storage.PersistentVolumeClaim != nil && storage.ObjectStore != nil:
+		return "Storage must specify only one of persistent volume claim and object store"
+	case storage.PersistentVolumeClaim != nil && storage.PersistentVolumeClaim.ClaimName == "":
+		return "Persistent volume claim must specify the claim name"
+	case storage.ObjectStore != nil && !strings.HasPrefix(storage.ObjectStore.URL, "s3://"):
+		return fmt.Sprintf(
+			"Object store URL '%s' isn't valid, it should have the form 's3://bucket/dir'",
+			storage.ObjectStore.URL,
+		)
+	}
+	return ""
+}
+
+// writeStatus saves the status of the given updated object if it is different to the status of
+// the original object.
+func (r *bundleCreationReconciler) writeStatus(ctx context.Context, object,
+	update *v1alpha1.BundleCreation) error {
+	if equality.Semantic.DeepEqual(update.Status, object.Status) {
+		return nil
+	}
+	err := r.client.Status().Update(ctx, update)
+	if err != nil {
+		return err
+	}
+	r.logger.Info(
+		"Updated bundle creation status",
+		"namespace", update.Namespace,
+		"name", update.Name,
+		"phase", update.Status.Phase,
+		"message", update.Status.Message,
+	)
+	return nil
+}
+
+func (r *bundleCreationReconciler) ensureJob(ctx context.Context,
+	object *v1alpha1.BundleCreation) (result *batchv1.Job, err error) {
+	// Check if the job already exists:
+	name := fmt.Sprintf("%s-%s", bundleCreation, object.Name)
+	job := &batchv1.Job{}
+	key := clnt.ObjectKey{
+		Namespace: object.Namespace,
+		Name:      name,
+	}
+	err = r.client.Get(ctx, key, job)
+	if err == nil {
+		result = job
+		return
+	}
+	if !apierrors.IsNotFound(err) {
+		return
+	}
+
+	// Prepare the volumes and the command line, which depend on the kind of storage. When the
+	// bundle is uploaded to the object store it is written first to a temporary volume.
+	storage := object.Spec.Storage
+	image := object.Spec.Image
+	if image == "" {
+		image = controllerImage
+	}
+	outputSource := corev1.VolumeSource{
+		PersistentVolumeClaim: storage.PersistentVolumeClaim,
+	}
+	outputDir := path.Join(bundleCreationOutputPath, storage.Path)
+	volumes := []corev1.Volume{}
+	mounts := []corev1.VolumeMount{}
+	var uploadArgs []string
+	if storage.ObjectStore != nil {
+		outputSource = corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		}
+		outputDir = bundleCreationOutputPath
+		uploadArgs = append(
+			uploadArgs,
+			fmt.Sprintf("--upload-url=%s", storage.ObjectStore.URL),
+		)
+		if storage.ObjectStore.Secret != nil {
+			volumes = append(volumes, corev1.Volume{
+				Name: bundleCreationCredentialsVolume,
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: storage.ObjectStore.Secret.Name,
+					},
+				},
+			})
+			mounts = append(mounts, corev1.VolumeMount{
+				Name:      bundleCreationCredentialsVolume,
+				MountPath: bundleCreationCredentialsPath,
+				ReadOnly:  true,
+			})
+			uploadArgs = append(
+				uploadArgs,
+				fmt.Sprintf("--s3-credentials-dir=%s", bundleCreationCredentialsPath),
+			)
+		}
+	}
+
+	// Create the job:
+	job = &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: object.Namespace,
+			Name:      name,
+			Labels: map[string]string{
+				labels.Job: bundleCreation,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: pointer.Int32(bundleCreationBackoffLimit),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Volumes: append([]corev1.Volume{
+						{
+							Name:         bundleCreationOutputVolume,
+							VolumeSource: outputSource,
+						},
+						{
+							Name: bundleCreationPullSecretVolume,
+							VolumeSource: corev1.VolumeSource{
+								Secret: &corev1.SecretVolumeSource{
+									SecretName: object.Spec.PullSecret.Name,
+								},
+							},
+						},
+					}, volumes...),
+					Containers: []corev1.Container{{
+						Name:            bundleCreation,
+						Image:           image,
+						ImagePullPolicy: controllerImagePullPolicy,
+						VolumeMounts: append([]corev1.VolumeMount{
+							{
+								Name:      bundleCreationOutputVolume,
+								MountPath: bundleCreationOutputPath,
+							},
+							{
+								Name:      bundleCreationPullSecretVolume,
+								MountPath: bundleCreationPullSecretPath,
+								ReadOnly:  true,
+							},
+						}, mounts...),
+						Env: []corev1.EnvVar{{
+							// Put the cache inside the volume, as it will contain
+							// all the images before they are added to the bundle.
+							Name:  "XDG_CACHE_HOME",
+							Value: path.Join(bundleCreationOutputPath, ".cache"),
+						}},
+						Command: append([]string{
+							"/usr/bin/upgrade-tool",
+							"create",
+							"bundle",
+							"--log-file=stdout",
+							"--log-level=1",
+							"--mute=true",
+							fmt.Sprintf("--version=%s", object.Spec.Version),
+							fmt.Sprintf("--arch=%s", object.Spec.Arch),
+							fmt.Sprintf(
+								"--pull-secret=%s",
+								path.Join(
+									bundleCreationPullSecretPath,
+									corev1.DockerConfigJsonKey,
+								),
+							),
+							fmt.Sprintf("--output=%s", outputDir),
+						}, uploadArgs...),
+					}},
+					RestartPolicy: corev1.RestartPolicyNever,
+				},
+			},
+		},
+	}
+	err = controllerutil.SetControllerReference(object, job, r.client.Scheme())
+	if err != nil {
+		return
+	}
+	err = r.client.Create(ctx, job)
+	if err != nil {
+		r.logger.Error(
+			err,
+			"Failed to create bundle creation job",
+			"namespace", job.Namespace,
+			"job", job.Name,
+		)
+		return
+	}
+	r.logger.Info(
+		"Created bundle creation job",
+		"namespace", job.Namespace,
+		"job", job.Name,
+	)
+	result = job
+	return
+}
+
+func (r *bundleCreationReconciler) updateStatus(object *v1alpha1.BundleCreation,
+	job *batchv1.Job) {
+	status := &object.Status
+	status.Job = job.Name
+	status.StartTime = job.Status.StartTime
+	status.CompletionTime = job.Status.CompletionTime
+	switch {
+	case r.jobCondition(job, batchv1.JobComplete):
+		status.Phase = v1alpha1.BundleCreationSucceeded
+		status.Message = "Bundle created"
+		name := fmt.Sprintf("upgrade-%s-%s.tar", object.Spec.Version, object.Spec.Arch)
+		if object.Spec.Storage.ObjectStore != nil {
+			status.BundleFile = strings.TrimSuffix(
+				object.Spec.Storage.ObjectStore.URL, "/",
+			) + "/" + name
+		} else {
+			status.BundleFile = path.Join(object.Spec.Storage.Path, name)
+		}
+	case r.jobCondition(job, batchv1.JobFailed):
+		status.Phase = v1alpha1.BundleCreationFailed
+		status.Message = fmt.Sprintf(
+			"Job '%s' failed, check the logs of its pods for details",
+			job.Name,
+		)
+	case job.Status.Active > 0:
+		status.Phase = v1alpha1.BundleCreationRunning
+		status.Message = "Creating bundle"
+		if job.Status.Failed > 0 {
+			status.Message = fmt.Sprintf(
+				"Creating bundle after %d failed attempts",
+				job.Status.Failed,
+			)
+		}
+	default:
+		status.Phase = v1alpha1.BundleCreationPending
+		status.Message = "Waiting for job to start"
+	}
+}
+
+func (r *bundleCreationReconciler) jobCondition(job *batchv1.Job,
+	kind batchv1.JobConditionType) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == kind && condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	bundleCreation                  = "bundle-creation"
+	bundleCreationBackoffLimit      = 3
+	bundleCreationOutputVolume      = "output"
+	bundleCreationOutputPath        = "/output"
+	bundleCreationPullSecretVolume  = "pull-secret"
+	bundleCreationPullSecretPath    = "/var/run/secrets/pull-secret"
+	bundleCreationCredentialsVolume = "credentials"
+	bundleCreationCredentialsPath   = "/var/run/secrets/credentials"
+)
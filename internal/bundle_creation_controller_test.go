@@ -0,0 +1,363 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+	"github.com/jhernand/upgrade-tool/internal/labels"
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Bundle creation controller", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	// makeCreation creates a bundle creation that writes the bundle to a persistent volume
+	// claim.
+	makeCreation := func() *v1alpha1.BundleCreation {
+		return &v1alpha1.BundleCreation{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "upgrade-tool",
+				Name:      "my-bundle",
+				UID:       "1234",
+			},
+			Spec: v1alpha1.BundleCreationSpec{
+				Version: "4.13.4",
+				Arch:    "x86_64",
+				PullSecret: corev1.LocalObjectReference{
+					Name: "my-pull-secret",
+				},
+				Storage: v1alpha1.BundleCreationStorage{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: "my-claim",
+					},
+					Path: "bundles",
+				},
+			},
+		}
+	}
+
+	// makeClient creates a fake client containing the given bundle creation and objects.
+	makeClient := func(creation *v1alpha1.BundleCreation, objects ...clnt.Object) clnt.Client {
+		return fake.NewClientBuilder().
+			WithScheme(snapshotScheme()).
+			WithObjects(creation).
+			WithObjects(objects...).
+			WithStatusSubresource(creation).
+			Build()
+	}
+
+	// makeJob creates the job for the bundle creation with the given status.
+	makeJob := func(status batchv1.JobStatus) *batchv1.Job {
+		return &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "upgrade-tool",
+				Name:      "bundle-creation-my-bundle",
+			},
+			Status: status,
+		}
+	}
+
+	// reconcile runs one reconciliation cycle and returns the resulting bundle creation.
+	reconcile := func(client clnt.Client) (*v1alpha1.BundleCreation, error) {
+		reconciler := &bundleCreationReconciler{
+			logger: logger,
+			client: client,
+		}
+		key := clnt.ObjectKey{
+			Namespace: "upgrade-tool",
+			Name:      "my-bundle",
+		}
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{
+			NamespacedName: key,
+		})
+		if err != nil {
+			return nil, err
+		}
+		result := &v1alpha1.BundleCreation{}
+		err = client.Get(ctx, key, result)
+		Expect(err).ToNot(HaveOccurred())
+		return result, nil
+	}
+
+	// listJobs returns the jobs that have been created.
+	listJobs := func(client clnt.Client) []batchv1.Job {
+		jobs := &batchv1.JobList{}
+		err := client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+		Expect(err).ToNot(HaveOccurred())
+		return jobs.Items
+	}
+
+	It("Creates the job that runs the bundle creator", func() {
+		client := makeClient(makeCreation())
+		creation, err := reconcile(client)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Check the job:
+		jobs := listJobs(client)
+		Expect(jobs).To(HaveLen(1))
+		job := jobs[0]
+		Expect(job.Name).To(Equal("bundle-creation-my-bundle"))
+		Expect(job.Labels).To(HaveKeyWithValue(labels.Job, bundleCreation))
+		Expect(job.OwnerReferences).To(HaveLen(1))
+		Expect(job.OwnerReferences[0].Name).To(Equal("my-bundle"))
+		Expect(job.OwnerReferences[0].Controller).To(HaveValue(BeTrue()))
+		spec := job.Spec.Template.Spec
+		Expect(spec.Volumes).To(HaveLen(2))
+		Expect(spec.Volumes[0].PersistentVolumeClaim).ToNot(BeNil())
+		Expect(spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("my-claim"))
+		Expect(spec.Volumes[1].Secret).ToNot(BeNil())
+		Expect(spec.Volumes[1].Secret.SecretName).To(Equal("my-pull-secret"))
+		Expect(spec.Containers).To(HaveLen(1))
+		container := spec.Containers[0]
+		Expect(container.Image).To(Equal(controllerImage))
+		Expect(container.Command).To(ContainElements(
+			"--version=4.13.4",
+			"--arch=x86_64",
+			"--pull-secret=/var/run/secrets/pull-secret/.dockerconfigjson",
+			"--output=/output/bundles",
+		))
+
+		// Check the status:
+		Expect(creation.Status.Phase).To(Equal(v1alpha1.BundleCreationPending))
+		Expect(creation.Status.Job).To(Equal("bundle-creation-my-bundle"))
+		Expect(creation.Status.Message).To(Equal("Waiting for job to start"))
+	})
+
+	It("Uses the image given in the spec", func() {
+		object := makeCreation()
+		object.Spec.Image = "quay.io/my/upgrade-tool:latest"
+		client := makeClient(object)
+		_, err := reconcile(client)
+		Expect(err).ToNot(HaveOccurred())
+		jobs := listJobs(client)
+		Expect(jobs).To(HaveLen(1))
+		Expect(jobs[0].Spec.Template.Spec.Containers[0].Image).To(Equal(
+			"quay.io/my/upgrade-tool:latest",
+		))
+	})
+
+	It("Reports failure if the storage isn't specified", func() {
+		object := makeCreation()
+		object.Spec.Storage.PersistentVolumeClaim = nil
+		client := makeClient(object)
+		creation, err := reconcile(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creation.Status.Phase).To(Equal(v1alpha1.BundleCreationFailed))
+		Expect(creation.Status.Message).To(Equal(
+			"Storage must specify a persistent volume claim or an object store",
+		))
+		Expect(listJobs(client)).To(BeEmpty())
+	})
+
+	It("Reports failure if both kinds of storage are specified", func() {
+		object := makeCreation()
+		object.Spec.Storage.ObjectStore = &v1alpha1.BundleCreationObjectStore{
+			URL: "s3://bundles/4.13",
+		}
+		client := makeClient(object)
+		creation, err := reconcile(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creation.Status.Phase).To(Equal(v1alpha1.BundleCreationFailed))
+		Expect(creation.Status.Message).To(Equal(
+			"Storage must specify only one of persistent volume claim and object store",
+		))
+		Expect(listJobs(client)).To(BeEmpty())
+	})
+
+	It("Reports failure if the object store URL isn't valid", func() {
+		object := makeCreation()
+		object.Spec.Storage.PersistentVolumeClaim = nil
+		object.Spec.Storage.ObjectStore = &v1alpha1.BundleCreationObjectStore{
+			URL: "https://bundles.example.com",
+		}
+		client := makeClient(object)
+		creation, err := reconcile(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creation.Status.Phase).To(Equal(v1alpha1.BundleCreationFailed))
+		Expect(creation.Status.Message).To(ContainSubstring("https://bundles.example.com"))
+		Expect(listJobs(client)).To(BeEmpty())
+	})
+
+	It("Uploads the bundle to the object store", func() {
+		object := makeCreation()
+		object.Spec.Storage.PersistentVolumeClaim = nil
+		object.Spec.Storage.ObjectStore = &v1alpha1.BundleCreationObjectStore{
+			URL: "s3://bundles/4.13",
+			Secret: &corev1.LocalObjectReference{
+				Name: "my-credentials",
+			},
+		}
+		client := makeClient(object)
+		_, err := reconcile(client)
+		Expect(err).ToNot(HaveOccurred())
+		jobs := listJobs(client)
+		Expect(jobs).To(HaveLen(1))
+		spec := jobs[0].Spec.Template.Spec
+		Expect(spec.Volumes).To(HaveLen(3))
+		Expect(spec.Volumes[0].EmptyDir).ToNot(BeNil())
+		Expect(spec.Volumes[2].Secret).ToNot(BeNil())
+		Expect(spec.Volumes[2].Secret.SecretName).To(Equal("my-credentials"))
+		container := spec.Containers[0]
+		Expect(container.VolumeMounts).To(HaveLen(3))
+		Expect(container.Command).To(ContainElements(
+			"--output=/output",
+			"--upload-url=s3://bundles/4.13",
+			"--s3-credentials-dir=/var/run/secrets/credentials",
+		))
+	})
+
+	It("Reports the URL of the bundle uploaded to the object store", func() {
+		object := makeCreation()
+		object.Spec.Storage.PersistentVolumeClaim = nil
+		object.Spec.Storage.ObjectStore = &v1alpha1.BundleCreationObjectStore{
+			URL: "s3://bundles/4.13/",
+		}
+		client := makeClient(object, makeJob(batchv1.JobStatus{
+			Conditions: []batchv1.JobCondition{{
+				Type:   batchv1.JobComplete,
+				Status: corev1.ConditionTrue,
+			}},
+		}))
+		creation, err := reconcile(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creation.Status.Phase).To(Equal(v1alpha1.BundleCreationSucceeded))
+		Expect(creation.Status.BundleFile).To(Equal(
+			"s3://bundles/4.13/upgrade-4.13.4-x86_64.tar",
+		))
+	})
+
+	It("Doesn't create the job again if it already exists", func() {
+		client := makeClient(makeCreation(), makeJob(batchv1.JobStatus{}))
+		_, err := reconcile(client)
+		Expect(err).ToNot(HaveOccurred())
+		jobs := listJobs(client)
+		Expect(jobs).To(HaveLen(1))
+		Expect(jobs[0].Spec.Template.Spec.Containers).To(BeEmpty())
+	})
+
+	It("Reports that the job is running", func() {
+		start := metav1.Now()
+		client := makeClient(makeCreation(), makeJob(batchv1.JobStatus{
+			Active:    1,
+			StartTime: &start,
+		}))
+		creation, err := reconcile(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creation.Status.Phase).To(Equal(v1alpha1.BundleCreationRunning))
+		Expect(creation.Status.Message).To(Equal("Creating bundle"))
+		Expect(creation.Status.StartTime).ToNot(BeNil())
+	})
+
+	It("Reports the failed attempts while the job is running", func() {
+		client := makeClient(makeCreation(), makeJob(batchv1.JobStatus{
+			Active: 1,
+			Failed: 2,
+		}))
+		creation, err := reconcile(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creation.Status.Phase).To(Equal(v1alpha1.BundleCreationRunning))
+		Expect(creation.Status.Message).To(Equal("Creating bundle after 2 failed attempts"))
+	})
+
+	It("Reports the bundle file when the job completes", func() {
+		completion := metav1.Now()
+		client := makeClient(makeCreation(), makeJob(batchv1.JobStatus{
+			CompletionTime: &completion,
+			Conditions: []batchv1.JobCondition{{
+				Type:   batchv1.JobComplete,
+				Status: corev1.ConditionTrue,
+			}},
+		}))
+		creation, err := reconcile(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creation.Status.Phase).To(Equal(v1alpha1.BundleCreationSucceeded))
+		Expect(creation.Status.Message).To(Equal("Bundle created"))
+		Expect(creation.Status.BundleFile).To(Equal("bundles/upgrade-4.13.4-x86_64.tar"))
+		Expect(creation.Status.CompletionTime).ToNot(BeNil())
+	})
+
+	It("Reports the failure of the job", func() {
+		client := makeClient(makeCreation(), makeJob(batchv1.JobStatus{
+			Conditions: []batchv1.JobCondition{{
+				Type:   batchv1.JobFailed,
+				Status: corev1.ConditionTrue,
+			}},
+		}))
+		creation, err := reconcile(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creation.Status.Phase).To(Equal(v1alpha1.BundleCreationFailed))
+		Expect(creation.Status.Message).To(Equal(
+			"Job 'bundle-creation-my-bundle' failed, check the logs of its pods for details",
+		))
+		Expect(creation.Status.BundleFile).To(BeEmpty())
+	})
+
+	It("Doesn't do anything once the bundle creation has finished", func() {
+		object := makeCreation()
+		object.Status.Phase = v1alpha1.BundleCreationSucceeded
+		client := makeClient(object)
+		creation, err := reconcile(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creation.Status.Phase).To(Equal(v1alpha1.BundleCreationSucceeded))
+		Expect(listJobs(client)).To(BeEmpty())
+	})
+
+	It("Ignores bundle creations that don't exist", func() {
+		client := fake.NewClientBuilder().
+			WithScheme(snapshotScheme()).
+			Build()
+		reconciler := &bundleCreationReconciler{
+			logger: logger,
+			client: client,
+		}
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{
+			NamespacedName: clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-bundle",
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(listJobs(client)).To(BeEmpty())
+	})
+})
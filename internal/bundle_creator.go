@@ -18,19 +18,27 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
 
 	dreference "github.com/distribution/distribution/v3/reference"
 	"github.com/go-logr/logr"
 	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
 	"github.com/jhernand/upgrade-tool/internal/exit"
 	"github.com/jhernand/upgrade-tool/internal/jq"
@@ -41,30 +49,67 @@ import (
 // create an upgrade bundle file. Don't create instances of this type directly, use the
 // NewBundleCreator function instead.
 type BundleCreatorBuilder struct {
-	logger     logr.Logger
-	console    *Console
-	version    string
-	arch       string
-	outputDir  string
-	pullSecret string
+	logger       logr.Logger
+	console      *Console
+	version      string
+	arch         string
+	outputDir    string
+	pullSecret   string
+	manifests    []string
+	maxBandwidth int64
+	signingKey   string
+	builderID    string
+	retries      int
+	retryDelay   time.Duration
+	force        bool
+	releaseRepo  string
+	distribution string
+	namespace    string
+	imageSet     string
+	channel      string
+	graphURL     string
+	uploadURL    string
+	s3Endpoint   string
+	s3Region     string
+	s3CredsDir   string
 }
 
 // BundleCreator knows how to create an upgrade bundle file. Don't create intances of this type
 // directly, use the NewBundleCreator function instead.
 type BundleCreator struct {
-	logger     logr.Logger
-	console    *Console
-	jq         *jqtool.Tool
-	version    string
-	arch       string
-	outputDir  string
-	pullSecret string
+	logger       logr.Logger
+	console      *Console
+	jq           *jqtool.Tool
+	version      string
+	arch         string
+	outputDir    string
+	pullSecret   string
+	manifests    []string
+	maxBandwidth int64
+	signer       *ProvenanceSigner
+	builderID    string
+	retrier      *Retrier
+	force        bool
+	releaseRepo  string
+	distribution string
+	namespace    string
+	imageSet     string
+	channel      string
+	graphURL     string
+	uploadURL    string
+	s3           *s3Client
 }
 
 // NewBundleCreator creates a builder that can then be used to create and configure a bundle
 // creator.
 func NewBundleCreator() *BundleCreatorBuilder {
-	return &BundleCreatorBuilder{}
+	return &BundleCreatorBuilder{
+		builderID:    bundleCreatorBuilderID,
+		retries:      5,
+		retryDelay:   10 * time.Second,
+		distribution: DistributionOCP,
+		namespace:    bundleCreatorNamespace,
+	}
 }
 
 // SetLogger sets the logger that the bundle creator will use to write messages to the log. This is
@@ -101,12 +146,155 @@ func (b *BundleCreatorBuilder) SetOutputDir(value string) *BundleCreatorBuilder
 }
 
 // SetPullSecret sets the file that contains the pull secret that the bundle creator will use to
-// authenticate to the image registry in order to pull the images. This is mandatory.
+// authenticate to the image registry in order to pull the images. This is mandatory for the OCP
+// distribution and optional for the OKD distribution, as OKD images are publicly available.
 func (b *BundleCreatorBuilder) SetPullSecret(value string) *BundleCreatorBuilder {
 	b.pullSecret = value
 	return b
 }
 
+// AddExtraManifest adds a file containing Kubernetes manifests that will be added to the bundle
+// metadata, so that the controller applies them to the cluster as part of the upgrade. This is
+// optional.
+func (b *BundleCreatorBuilder) AddExtraManifest(value string) *BundleCreatorBuilder {
+	b.manifests = append(b.manifests, value)
+	return b
+}
+
+// AddExtraManifests adds a list of files containing Kubernetes manifests. See the AddExtraManifest
+// method for details.
+func (b *BundleCreatorBuilder) AddExtraManifests(values ...string) *BundleCreatorBuilder {
+	b.manifests = append(b.manifests, values...)
+	return b
+}
+
+// SetMaxBandwidth sets the maximum number of bytes per second that will be used to download
+// images, adding all the downloads. This is optional and the default is to not limit the
+// bandwidth.
+func (b *BundleCreatorBuilder) SetMaxBandwidth(value int64) *BundleCreatorBuilder {
+	b.maxBandwidth = value
+	return b
+}
+
+// SetSigningKey sets the PEM file containing the private key that will be used to sign the
+// provenance attestation of the bundle. This is optional, and when not specified the bundle will
+// not contain a provenance attestation.
+func (b *BundleCreatorBuilder) SetSigningKey(value string) *BundleCreatorBuilder {
+	b.signingKey = value
+	return b
+}
+
+// SetBuilderID sets the identifier of the builder that will be written to the provenance
+// attestation. This is optional and the default is the URL of the project.
+func (b *BundleCreatorBuilder) SetBuilderID(value string) *BundleCreatorBuilder {
+	b.builderID = value
+	return b
+}
+
+// SetRetries sets the number of times that the inspection of the release and the download of each
+// image will be retried when it fails. This is optional and the default is five.
+func (b *BundleCreatorBuilder) SetRetries(value int) *BundleCreatorBuilder {
+	b.retries = value
+	return b
+}
+
+// SetRetryDelay sets the time to wait before the first retry. This time is doubled for each
+// subsequent retry. This is optional and the default is ten seconds.
+func (b *BundleCreatorBuilder) SetRetryDelay(value time.Duration) *BundleCreatorBuilder {
+	b.retryDelay = value
+	return b
+}
+
+// SetForce sets a flag that indicates that the bundle should be created even if the output
+// directory already contains a bundle for the same version and architecture. This is optional and
+// the default is false.
+func (b *BundleCreatorBuilder) SetForce(value bool) *BundleCreatorBuilder {
+	b.force = value
+	return b
+}
+
+// SetReleaseRepo sets the repository that contains the release images, for example
+// 'quay.io/openshift-release-dev/ocp-release-nightly' or the repository of a mirror. This is
+// optional and the default depends on the distribution: 'quay.io/openshift-release-dev/ocp-release'
+// for OCP and 'quay.io/okd/scos-release' for OKD.
+func (b *BundleCreatorBuilder) SetReleaseRepo(value string) *BundleCreatorBuilder {
+	b.releaseRepo = value
+	return b
+}
+
+// SetDistribution sets the distribution of the release, either 'ocp' or 'okd'. This changes the
+// default release repository, the format of the release tag and the need for a pull secret. This
+// is optional and the default is 'ocp'.
+func (b *BundleCreatorBuilder) SetDistribution(value string) *BundleCreatorBuilder {
+	b.distribution = value
+	return b
+}
+
+// SetNamespace sets the namespace where the generated manifest will create the controller. This is
+// optional and the default is 'upgrade-tool'.
+func (b *BundleCreatorBuilder) SetNamespace(value string) *BundleCreatorBuilder {
+	b.namespace = value
+	return b
+}
+
+// SetImageSet sets the name of an imageset archive created by the 'oc-mirror' tool that contains
+// the release images. When this is set the images are copied from the archive instead of
+// downloading them, and the pull secret isn't needed. This is optional.
+func (b *BundleCreatorBuilder) SetImageSet(value string) *BundleCreatorBuilder {
+	b.imageSet = value
+	return b
+}
+
+// SetChannel sets the update channel, for example 'stable-4.13'. When this is set the creator will
+// fetch the update graph of the channel from the update service and add to the bundle metadata the
+// part of the graph that describes the updates to the version of the bundle, so that the controller
+// can use it in disconnected clusters. This is optional.
+func (b *BundleCreatorBuilder) SetChannel(value string) *BundleCreatorBuilder {
+	b.channel = value
+	return b
+}
+
+// SetGraphURL sets the URL of the update graph of the update service. This is optional and the
+// default is the URL of the public update service for the OCP distribution. There is no default
+// for the OKD distribution.
+func (b *BundleCreatorBuilder) SetGraphURL(value string) *BundleCreatorBuilder {
+	b.graphURL = value
+	return b
+}
+
+// SetUploadURL sets the URL of the directory of an S3 compatible object store where the bundle, the
+// digest and the manifest files will be uploaded once they have been written to the output
+// directory, for example 's3://bundles/4.13'. This is optional.
+func (b *BundleCreatorBuilder) SetUploadURL(value string) *BundleCreatorBuilder {
+	b.uploadURL = value
+	return b
+}
+
+// SetS3Endpoint sets the URL of the S3 compatible object store used for the upload URL. This is
+// optional, and if not specified the endpoint will be read from the credentials directory, or else
+// the AWS endpoint of the region will be used.
+func (b *BundleCreatorBuilder) SetS3Endpoint(value string) *BundleCreatorBuilder {
+	b.s3Endpoint = value
+	return b
+}
+
+// SetS3Region sets the region of the S3 compatible object store. This is optional, and if not
+// specified the region will be read from the credentials directory, or else 'us-east-1' will be
+// used.
+func (b *BundleCreatorBuilder) SetS3Region(value string) *BundleCreatorBuilder {
+	b.s3Region = value
+	return b
+}
+
+// SetS3CredentialsDir sets the directory that contains the credentials used to access the S3
+// compatible object store, usually a secret mounted as a volume. The directory should contain the
+// 'access-key-id' and 'secret-access-key' files, and optionally the 'session-token', 'endpoint'
+// and 'region' files. This is optional, and if not specified the uploads will be anonymous.
+func (b *BundleCreatorBuilder) SetS3CredentialsDir(value string) *BundleCreatorBuilder {
+	b.s3CredsDir = value
+	return b
+}
+
 // Build uses the data stored in the builder to create and configure a new bundle creator.
 func (b *BundleCreatorBuilder) Build() (result *BundleCreator, err error) {
 	// Check parameters:
@@ -130,10 +318,94 @@ func (b *BundleCreatorBuilder) Build() (result *BundleCreator, err error) {
 		err = errors.New("output directory is mandatory")
 		return
 	}
-	if b.pullSecret == "" {
+	if !slices.Contains(Distributions(), b.distribution) {
+		err = fmt.Errorf(
+			"distribution '%s' isn't valid, it should be one of %v",
+			b.distribution, Distributions(),
+		)
+		return
+	}
+	if b.pullSecret == "" && b.distribution != DistributionOKD && b.imageSet == "" {
 		err = errors.New("pull secret is mandatory")
 		return
 	}
+	if b.maxBandwidth < 0 {
+		err = fmt.Errorf(
+			"maximum bandwidth %d isn't valid, it must be greater than or equal to zero",
+			b.maxBandwidth,
+		)
+		return
+	}
+
+	if b.namespace == "" {
+		err = errors.New("namespace is mandatory")
+		return
+	}
+	if b.builderID == "" {
+		err = errors.New("builder identifier is mandatory")
+		return
+	}
+	releaseRepo := b.releaseRepo
+	if releaseRepo == "" {
+		releaseRepo = distributionReleaseRepos[b.distribution]
+	}
+	graphURL := b.graphURL
+	if graphURL == "" {
+		graphURL = distributionGraphURLs[b.distribution]
+	}
+	if b.channel != "" && graphURL == "" {
+		err = fmt.Errorf(
+			"graph URL is mandatory for channel '%s' and distribution '%s'",
+			b.channel, b.distribution,
+		)
+		return
+	}
+	_, err = dreference.ParseNormalizedNamed(releaseRepo)
+	if err != nil {
+		err = fmt.Errorf("release repository '%s' isn't valid: %w", releaseRepo, err)
+		return
+	}
+	if b.retries < 0 {
+		err = fmt.Errorf(
+			"number of retries %d isn't valid, it must be greater than or equal to zero",
+			b.retries,
+		)
+		return
+	}
+
+	// Create the object store client:
+	var s3 *s3Client
+	uploadURL := strings.TrimSuffix(b.uploadURL, "/")
+	if uploadURL != "" {
+		parsed, err := url.Parse(uploadURL)
+		if err != nil || parsed.Scheme != "s3" || parsed.Host == "" {
+			err = fmt.Errorf(
+				"upload URL '%s' isn't valid, it should have the form 's3://bucket/dir'",
+				b.uploadURL,
+			)
+			return nil, err
+		}
+		s3, err = newS3Client(b.s3Endpoint, b.s3Region, b.s3CredsDir)
+		if err != nil {
+			err = fmt.Errorf("failed to create object store client: %w", err)
+			return nil, err
+		}
+	}
+
+	// Create the retrier:
+	maxRetryDelay := bundleCreatorMaxRetryDelay
+	if maxRetryDelay < b.retryDelay {
+		maxRetryDelay = b.retryDelay
+	}
+	retrier, err := NewRetrier().
+		SetLogger(b.logger).
+		SetAttempts(b.retries + 1).
+		SetDelay(b.retryDelay).
+		SetMaxDelay(maxRetryDelay).
+		Build()
+	if err != nil {
+		return
+	}
 
 	// Create the jq tool:
 	jq, err := jq.NewTool().
@@ -143,20 +415,94 @@ func (b *BundleCreatorBuilder) Build() (result *BundleCreator, err error) {
 		return
 	}
 
+	// Create the provenance signer:
+	var signer *ProvenanceSigner
+	if b.signingKey != "" {
+		signer, err = NewProvenanceSigner().
+			SetLogger(b.logger).
+			SetKey(b.signingKey).
+			Build()
+		if err != nil {
+			err = fmt.Errorf("failed to create provenance signer: %w", err)
+			return
+		}
+	}
+
 	// Create and populate the object:
 	result = &BundleCreator{
-		logger:     b.logger,
-		console:    b.console,
-		jq:         jq,
-		version:    b.version,
-		arch:       b.arch,
-		outputDir:  b.outputDir,
-		pullSecret: b.pullSecret,
+		logger:       b.logger,
+		console:      b.console,
+		jq:           jq,
+		version:      b.version,
+		arch:         b.arch,
+		outputDir:    b.outputDir,
+		pullSecret:   b.pullSecret,
+		manifests:    slices.Clone(b.manifests),
+		maxBandwidth: b.maxBandwidth,
+		signer:       signer,
+		builderID:    b.builderID,
+		retrier:      retrier,
+		force:        b.force,
+		releaseRepo:  releaseRepo,
+		distribution: b.distribution,
+		namespace:    b.namespace,
+		imageSet:     b.imageSet,
+		channel:      b.channel,
+		graphURL:     graphURL,
+		uploadURL:    uploadURL,
+		s3:           s3,
 	}
 	return
 }
 
 func (c *BundleCreator) Run(ctx context.Context) error {
+	// Remember when we started, as this is part of the provenance attestation:
+	startedOn := time.Now().UTC()
+
+	// Read the extra manifests early, so that we don't waste time downloading images if they
+	// aren't valid, and so that we can compare them to the ones of the existing bundle:
+	manifests, err := c.readManifests()
+	if err != nil {
+		c.console.Error("Failed to read extra manifests: %v", err)
+		return exit.Error(1)
+	}
+
+	// Check if the bundle already exists, so that running the command repeatedly doesn't
+	// download the images again:
+	if !c.force {
+		exists, err := c.checkBundle(manifests)
+		if err != nil {
+			c.console.Error("Failed to check existing bundle: %v", err)
+			return exit.Error(1)
+		}
+		if exists {
+			c.console.Info(
+				"Bundle '%s' already exists and is valid, use '--force' to create it again",
+				c.bundleFile(),
+			)
+			return c.uploadFiles(ctx)
+		}
+	}
+
+	// Creating the bundle again overwrites the existing file, so ask for confirmation:
+	if c.force {
+		_, err := os.Stat(c.bundleFile())
+		if err == nil {
+			confirmed, err := c.console.Confirm(
+				"Bundle '%s' already exists, do you want to overwrite it?",
+				c.bundleFile(),
+			)
+			if err != nil {
+				c.console.Error("Failed to confirm overwrite of bundle: %v", err)
+				return exit.Error(1)
+			}
+			if !confirmed {
+				c.console.Info("Bundle '%s' will not be overwritten", c.bundleFile())
+				return nil
+			}
+		}
+	}
+
 	// Determine the cache directories:
 	cacheDir, err := os.UserCacheDir()
 	if err != nil {
@@ -180,49 +526,85 @@ func (c *BundleCreator) Run(ctx context.Context) error {
 		return exit.Error(1)
 	}
 
-	// Find the images:
-	c.console.Info("Finding images ...")
-	release, images, err := c.findImages(ctx)
-	if err != nil {
-		c.console.Error("Failed to find release images: %v", err)
-		return exit.Error(1)
-	}
-	c.logger.Info(
-		"Found images",
-		"release", release,
-		"images", len(images),
-	)
+	// Import the images from the imageset archive, or else download them:
+	var release string
+	var images map[string]string
+	if c.imageSet != "" {
+		c.console.Info("Importing imageset '%s' ...", c.imageSet)
+		release, images, err = c.importImageSet(ctx, tmpDir)
+		if err != nil {
+			c.console.Error("Failed to import imageset: %v", err)
+			return exit.Error(1)
+		}
+	} else {
+		// Find the images:
+		c.console.Info("Finding images ...")
+		release, images, err = c.findImages(ctx)
+		if err != nil {
+			c.console.Error("Failed to find release images: %v", err)
+			return exit.Error(1)
+		}
+		c.logger.Info(
+			"Found images",
+			"release", release,
+			"images", len(images),
+		)
 
-	// Create the registry:
-	c.console.Info("Starting registry ...")
-	registry, err := c.createRegistry(ctx, tmpDir)
-	if err != nil {
-		c.console.Error("Failed to start registry: %v", err)
-	//	return exit.Error(1)
+		// Create the registry:
+		c.console.Info("Starting registry ...")
+		registry, err := c.createRegistry(ctx, tmpDir)
+		if err != nil {
+			c.console.Error("Failed to start registry: %v", err)
+		//	return exit.Error(1)
+		}
+
+		// Download the images:
+		err = c.downloadImages(ctx, registry, release, images)
+		if err != nil {
+			c.console.Error("Failed to download images: %v", err)
+			return exit.Error(1)
+		}
+
+		// Stop the registry:
+		c.console.Info("Stopping registry ...")
+		err = registry.Stop(ctx)
+		if err != nil {
+			c.console.Error("Failed to stop registry: %v", err)
+			return exit.Error(1)
+		}
 	}
 
-	// Download the images:
-	err = c.downloadImages(registry, release, images)
-	if err != nil {
-		c.console.Error("Failed to download images: %v", err)
-		return exit.Error(1)
+	// Fetch the update graph:
+	var graph *UpdateGraph
+	if c.channel != "" {
+		c.console.Info("Fetching update graph for channel '%s' ...", c.channel)
+		graph, err = c.fetchGraph(ctx)
+		if err != nil {
+			c.console.Error("Failed to fetch update graph: %v", err)
+			return exit.Error(1)
+		}
 	}
 
-	// Stop the registry:
-	c.console.Info("Stopping registry ...")
-	err = registry.Stop(ctx)
+	// Calculate the size of the extracted bundle:
+	size, err := c.calculateSize(filepath.Join(tmpDir, "docker"))
 	if err != nil {
-		c.console.Error("Failed to stop registry: %v", err)
+		c.console.Error("Failed to calculate bundle size: %v", err)
 		return exit.Error(1)
 	}
 
 	// Write the metadata:
 	c.console.Info("Writing metadata ...")
 	metadata := &Metadata{
-		Version: c.version,
-		Arch:    c.arch,
-		Release: release,
-		Images:  maps.Values(images),
+		Version:      c.version,
+		Arch:         c.arch,
+		Distribution: c.distribution,
+		Release:      release,
+		Images:       maps.Values(images),
+		Tags:         images,
+		Roles:        RoleImages(images),
+		Manifests:    manifests,
+		Graph:        graph,
+		Size:         size,
 	}
 	err = c.writeMetadata(metadata, tmpDir)
 	if err != nil {
@@ -230,6 +612,16 @@ func (c *BundleCreator) Run(ctx context.Context) error {
 		return exit.Error(1)
 	}
 
+	// Write the provenance attestation:
+	if c.signer != nil {
+		c.console.Info("Writing provenance attestation ...")
+		err = c.writeProvenance(metadata, tmpDir, startedOn)
+		if err != nil {
+			c.console.Error("Failed to write provenance attestation: %v", err)
+			return exit.Error(1)
+		}
+	}
+
 	// Write the bundle:
 	c.console.Info("Writing bundle to '%s' ...", c.bundleFile())
 	err = c.writeBundle(tmpDir)
@@ -248,21 +640,180 @@ func (c *BundleCreator) Run(ctx context.Context) error {
 
 	// Write the manifest:
 	c.console.Info("Writing manifest to '%s' ...", c.manifestFile())
-	err = c.writeManifest()
+	err = c.writeManifest(metadata)
 	if err != nil {
 		c.console.Error("Failed to write manifest: %v", err)
 		return exit.Error(1)
 	}
 
+	// Upload the files to the object store:
+	return c.uploadFiles(ctx)
+}
+
+// uploadFiles uploads the bundle, the digest and the manifest files to the object store, if an
+// upload URL has been configured.
+func (c *BundleCreator) uploadFiles(ctx context.Context) error {
+	if c.s3 == nil {
+		return nil
+	}
+	files := []string{
+		c.bundleFile(),
+		c.digestFile(),
+		c.manifestFile(),
+	}
+	for _, file := range files {
+		object := c.uploadURL + "/" + filepath.Base(file)
+		c.console.Info("Uploading '%s' to '%s' ...", file, object)
+		name := fmt.Sprintf("upload of '%s'", filepath.Base(file))
+		err := c.retrier.Do(ctx, name, func(ctx context.Context) error {
+			return c.s3.upload(ctx, file, object)
+		})
+		if err != nil {
+			c.console.Error("Failed to upload '%s' to '%s': %v", file, object, err)
+			return exit.Error(1)
+		}
+	}
 	return nil
 }
 
+// checkBundle checks if the output directory already contains the bundle and the digest files, if
+// the digest matches the content of the bundle and if the metadata of the bundle has the same
+// version, architecture, release repository and extra manifests.
+func (c *BundleCreator) checkBundle(manifests []string) (result bool, err error) {
+	// Read the expected digest:
+	data, err := os.ReadFile(c.digestFile())
+	if errors.Is(err, os.ErrNotExist) {
+		c.logger.Info(
+			"Digest file doesn't exist",
+			"file", c.digestFile(),
+		)
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		c.logger.Info(
+			"Digest file is empty",
+			"file", c.digestFile(),
+		)
+		return
+	}
+	expected := fields[0]
+
+	// Calculate the actual digest:
+	reader, err := os.Open(c.bundleFile())
+	if errors.Is(err, os.ErrNotExist) {
+		c.logger.Info(
+			"Bundle file doesn't exist",
+			"file", c.bundleFile(),
+		)
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	defer func() {
+		err := reader.Close()
+		if err != nil {
+			c.logger.Error(
+				err,
+				"Failed to close bundle file",
+				"file", c.bundleFile(),
+			)
+		}
+	}()
+	c.console.Info("Checking existing bundle '%s' ...", c.bundleFile())
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return
+	}
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if actual != expected {
+		c.console.Warn(
+			"Digest of existing bundle '%s' is '%s' but expected '%s', will create it again",
+			c.bundleFile(), actual, expected,
+		)
+		return
+	}
+
+	// Check the metadata:
+	_, err = reader.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+	metadata, err := readBundleMetadata(reader)
+	if err != nil {
+		return
+	}
+	if metadata == nil {
+		c.console.Warn(
+			"Existing bundle '%s' doesn't contain metadata, will create it again",
+			c.bundleFile(),
+		)
+		return
+	}
+	if metadata.Version != c.version || metadata.Arch != c.arch {
+		c.console.Warn(
+			"Existing bundle '%s' is for version '%s' and architecture '%s', will "+
+				"create it again",
+			c.bundleFile(), metadata.Version, metadata.Arch,
+		)
+		return
+	}
+
+	// Check the release repository. Note that when the images are imported from an imageset
+	// archive the release repository is the one inside the archive, so in that case we don't
+	// check it.
+	if c.imageSet == "" {
+		repo := c.releaseRepo
+		named, err := dreference.ParseNormalizedNamed(c.releaseRepo)
+		if err == nil {
+			repo = named.Name()
+		}
+		named, err = dreference.ParseNormalizedNamed(metadata.Release)
+		if err != nil || named.Name() != repo {
+			c.console.Warn(
+				"Existing bundle '%s' contains release '%s' but the release repository "+
+					"is '%s', will create it again",
+				c.bundleFile(), metadata.Release, c.releaseRepo,
+			)
+			return false, nil
+		}
+	}
+
+	// Check the extra manifests:
+	if !slices.Equal(metadata.Manifests, manifests) {
+		c.console.Warn(
+			"Existing bundle '%s' contains %d extra manifests that don't match the %d "+
+				"given, will create it again",
+			c.bundleFile(), len(metadata.Manifests), len(manifests),
+		)
+		return
+	}
+
+	result = true
+	return
+}
+
 func (c *BundleCreator) createRegistry(ctx context.Context,
 	dir string) (registry *Registry, err error) {
+	// Protect the registry with a random password, so that other processes running in the same
+	// host can't push to it:
+	password, err := makeRegistryPassword()
+	if err != nil {
+		return
+	}
 	registry, err = NewRegistry().
 		SetLogger(c.logger).
 		SetAddress("pws-registry.intel.lab:5000").
 		SetRoot(dir).
+		SetMaxBandwidth(c.maxBandwidth).
+		SetCredentials(registryUsername, password).
 		Build()
 	if err != nil {
 		return
@@ -273,66 +824,88 @@ func (c *BundleCreator) createRegistry(ctx context.Context,
 
 func (c *BundleCreator) findImages(ctx context.Context) (release string, images map[string]string,
 	err error) {
-	release = fmt.Sprintf("%s:%s-%s", bundleCreatorReleaseRepo, c.version, c.arch)
-	path, err := exec.LookPath("oc")
-	if err != nil {
-		return
+	finder := &releaseFinder{
+		logger:       c.logger,
+		jq:           c.jq,
+		retrier:      c.retrier,
+		releaseRepo:  c.releaseRepo,
+		version:      c.version,
+		arch:         c.arch,
+		distribution: c.distribution,
 	}
-	stdout := &bytes.Buffer{}
-	stderr := &bytes.Buffer{}
-	cmd := exec.Cmd{
-		Path: path,
-		Args: []string{
-			"oc", "adm", "release", "info",
-			"--output=json",
-			release,
-		},
-		Stdout: stdout,
-		Stderr: stderr,
+	return finder.find(ctx)
+}
+
+// fetchGraph fetches the update graph of the channel from the update service and returns the part
+// that contains the updates to the version of the bundle.
+func (c *BundleCreator) fetchGraph(ctx context.Context) (result *UpdateGraph, err error) {
+	query := url.Values{}
+	query.Set("channel", c.channel)
+	arch, ok := distributionOSArchs[c.arch]
+	if !ok {
+		arch = c.arch
 	}
-	err = cmd.Run()
-	c.logger.Info(
-		"Executed 'oc' command",
-		"args", cmd.Args,
-		"stdout", cmd.String(),
-		"stderr", cmd.String(),
-		"code", cmd.ProcessState.ExitCode(),
-	)
+	query.Set("arch", arch)
+	address := c.graphURL + "?" + query.Encode()
+	var graph UpdateGraph
+	err = c.retrier.Do(ctx, "update graph download", func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+		if err != nil {
+			return StopRetrying(err)
+		}
+		request.Header.Set("Accept", "application/json")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf(
+				"update service '%s' responded with status code %d",
+				c.graphURL, response.StatusCode,
+			)
+		}
+		return json.NewDecoder(response.Body).Decode(&graph)
+	})
 	if err != nil {
 		return
 	}
-	var digest string
-	err = c.jq.QueryBytes(
-		`.digest`,
-		stdout.Bytes(), &digest,
-	)
-	if err != nil {
+	graph.Channel = c.channel
+	result = graph.Filter(c.version)
+	if result == nil {
+		err = fmt.Errorf(
+			"channel '%s' doesn't contain version '%s'",
+			c.channel, c.version,
+		)
 		return
 	}
-	release = fmt.Sprintf("%s@%s", bundleCreatorReleaseRepo, digest)
-	type Tag struct {
-		Tag string `json:"tag"`
-		Ref string `json:"ref"`
-	}
-	var tags []Tag
-	err = c.jq.QueryBytes(
-		`[.references.spec.tags[] | {
-			"tag": .name,
-			"ref": .from.name
-		}]`,
-		stdout.Bytes(), &tags,
+	c.logger.Info(
+		"Fetched update graph",
+		"channel", c.channel,
+		"version", c.version,
+		"sources", len(result.Edges),
 	)
+	return
+}
+
+func (c *BundleCreator) importImageSet(ctx context.Context, dir string) (release string,
+	images map[string]string, err error) {
+	importer, err := NewImageSetImporter().
+		SetLogger(c.logger).
+		SetFile(c.imageSet).
+		SetDir(dir).
+		SetVersion(c.version).
+		SetArch(c.arch).
+		SetDistribution(c.distribution).
+		Build()
 	if err != nil {
 		return
 	}
-	images = map[string]string{}
-	for _, tag := range tags {
-		images[tag.Tag] = tag.Ref
-	}
+	release, images, err = importer.Run(ctx)
 	return
 }
 
-func (c *BundleCreator) downloadImages(registry *Registry, release string,
+func (c *BundleCreator) downloadImages(ctx context.Context, registry *Registry, release string,
 	images map[string]string) error {
 	// Save the TLS certificate of the registry to a temporary directory, so that we can later
 	// pass it to the '--dest-cert-dir' of the skopeo command.
@@ -357,13 +930,21 @@ func (c *BundleCreator) downloadImages(registry *Registry, release string,
 		return err
 	}
 
+	// Save the credentials of the registry to an authentication file in the same directory,
+	// so that we can pass it to the '--dest-authfile' option of the skopeo command without
+	// writing the password to the log:
+	err = c.writeAuthFile(certs, registry)
+	if err != nil {
+		return err
+	}
+
 	// Download the release image:
 	dst, err := c.dstRef(release, registry)
 	if err != nil {
 		return err
 	}
 	c.console.Info("Downloading release image '%s' ...", release)
-	err = c.downloadImage(certs, release, dst)
+	err = c.downloadImage(ctx, certs, release, dst)
 	if err != nil {
 		return err
 	}
@@ -382,7 +963,7 @@ func (c *BundleCreator) downloadImages(registry *Registry, release string,
 			return err
 		}
 		c.console.Info("dstRef finish,%s", dst)
-		err = c.downloadImage(certs, ref, dst)
+		err = c.downloadImage(ctx, certs, ref, dst)
 		if err != nil {
 			return err
 		}
@@ -411,34 +992,106 @@ func (c *BundleCreator) dstRef(src string, registry *Registry) (dst string, err
 	return
 }
 
-func (c *BundleCreator) downloadImage(certs string, src, dst string) error {
+// writeAuthFile writes to the given directory an 'auth.json' file containing the credentials of
+// the registry, in the format used by skopeo.
+func (c *BundleCreator) writeAuthFile(dir string, registry *Registry) error {
+	username, password := registry.Credentials()
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	data, err := json.Marshal(map[string]any{
+		"auths": map[string]any{
+			registry.Address(): map[string]any{
+				"auth": auth,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "auth.json"), data, 0400)
+}
+
+func (c *BundleCreator) downloadImage(ctx context.Context, certs string, src, dst string) error {
 	path, err := exec.LookPath("skopeo")
 	if err != nil {
 		return err
 	}
-	stdout := &bytes.Buffer{}
-	stderr := &bytes.Buffer{}
-	cmd := exec.Cmd{
-		Path: path,
-		Args: []string{
-			"skopeo", "copy",
-			fmt.Sprintf("--src-authfile=%s", c.pullSecret),
+	name := fmt.Sprintf("download of image '%s'", src)
+	return c.retrier.Do(ctx, name, func(ctx context.Context) error {
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+		args := []string{
+			"copy",
+		}
+		if c.pullSecret != "" {
+			args = append(args, fmt.Sprintf("--src-authfile=%s", c.pullSecret))
+		}
+		args = append(
+			args,
 			fmt.Sprintf("--dest-cert-dir=%s", certs),
+			fmt.Sprintf("--dest-authfile=%s", filepath.Join(certs, "auth.json")),
 			fmt.Sprintf("docker://%s", src),
 			fmt.Sprintf("docker://%s", dst),
-		},
-		Stdout: stdout,
-		Stderr: stderr,
+		)
+		cmd := exec.CommandContext(ctx, path, args...)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		err := cmd.Run()
+		c.logger.Info(
+			"Executed 'skopeo' command",
+			"args", cmd.Args,
+			"stdout", stdout.String(),
+			"stderr", stderr.String(),
+			"code", cmd.ProcessState.ExitCode(),
+		)
+		return err
+	})
+}
+
+func (c *BundleCreator) readManifests() (results []string, err error) {
+	for _, file := range c.manifests {
+		var data []byte
+		data, err = os.ReadFile(file)
+		if err != nil {
+			return
+		}
+		var objects []*unstructured.Unstructured
+		objects, err = ParseManifests(data)
+		if err != nil {
+			err = fmt.Errorf("failed to parse manifest file '%s': %w", file, err)
+			return
+		}
+		if len(objects) == 0 {
+			c.console.Warn("Manifest file '%s' doesn't contain any object", file)
+			continue
+		}
+		c.console.Info(
+			"Adding %d objects from manifest file '%s'",
+			len(objects), file,
+		)
+		results = append(results, string(data))
 	}
-	err = cmd.Run()
-	c.logger.Info(
-		"Executed 'skopeo' command",
-		"args", cmd.Args,
-		"stdout", stdout.String(),
-		"stderr", stderr.String(),
-		"code", cmd.ProcessState.ExitCode(),
-	)
-	return err
+	return
+}
+
+// calculateSize calculates the total size of the files inside the given directory. This is used
+// for the directory containing the images, as the rest of the files of the bundle are small enough
+// to ignore them.
+func (c *BundleCreator) calculateSize(dir string) (result int64, err error) {
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		result += info.Size()
+		return nil
+	})
+	return
 }
 
 func (c *BundleCreator) writeMetadata(metadata *Metadata, dir string) error {
@@ -450,24 +1103,132 @@ func (c *BundleCreator) writeMetadata(metadata *Metadata, dir string) error {
 	return os.WriteFile(file, data, 0644)
 }
 
+func (c *BundleCreator) writeProvenance(metadata *Metadata, dir string,
+	startedOn time.Time) error {
+	// Calculate the digest of the metadata file that we already wrote:
+	data, err := os.ReadFile(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	subjects := []ProvenanceSubject{{
+		Name: "metadata.json",
+		Digest: map[string]string{
+			"sha256": hex.EncodeToString(sum[:]),
+		},
+	}}
+
+	// Add the release and payload images, which are always referenced by digest:
+	refs := append([]string{metadata.Release}, metadata.Images...)
+	slices.Sort(refs[1:])
+	for _, ref := range refs {
+		var subject ProvenanceSubject
+		subject, err = c.provenanceSubject(ref)
+		if err != nil {
+			return err
+		}
+		subjects = append(subjects, subject)
+	}
+
+	// Create the statement:
+	release, err := c.provenanceSubject(metadata.Release)
+	if err != nil {
+		return err
+	}
+	finishedOn := time.Now().UTC()
+	statement := &ProvenanceStatement{
+		Type:          provenanceStatementType,
+		Subject:       subjects,
+		PredicateType: provenancePredicateType,
+		Predicate: ProvenancePredicate{
+			BuildDefinition: ProvenanceBuildDefinition{
+				BuildType: provenanceBuildType,
+				ExternalParameters: map[string]any{
+					"version":  c.version,
+					"arch":     c.arch,
+					"registry": c.releaseRepo,
+				},
+				ResolvedDependencies: []ProvenanceResourceDescriptor{{
+					URI:    fmt.Sprintf("docker://%s", release.Name),
+					Digest: release.Digest,
+				}},
+			},
+			RunDetails: ProvenanceRunDetails{
+				Builder: ProvenanceBuilder{
+					ID: c.builderID,
+					Version: map[string]string{
+						"upgrade-tool": provenanceToolVersion(),
+					},
+				},
+				Metadata: ProvenanceRunMetadata{
+					StartedOn:  &startedOn,
+					FinishedOn: &finishedOn,
+				},
+			},
+		},
+	}
+
+	// Sign and write it:
+	envelope, err := c.signer.Sign(statement)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dir, provenanceFile)
+	err = os.WriteFile(file, envelope, 0644)
+	if err != nil {
+		return err
+	}
+	c.logger.Info(
+		"Wrote provenance attestation",
+		"file", file,
+		"key", c.signer.KeyID(),
+		"subjects", len(subjects),
+	)
+	return nil
+}
+
+func (c *BundleCreator) provenanceSubject(ref string) (result ProvenanceSubject, err error) {
+	named, err := dreference.ParseNamed(ref)
+	if err != nil {
+		return
+	}
+	digested, ok := named.(dreference.Digested)
+	if !ok {
+		err = fmt.Errorf("image reference '%s' doesn't contain a digest", ref)
+		return
+	}
+	digest := digested.Digest()
+	result = ProvenanceSubject{
+		Name: ref,
+		Digest: map[string]string{
+			digest.Algorithm().String(): digest.Encoded(),
+		},
+	}
+	return
+}
+
 func (c *BundleCreator) writeBundle(dir string) error {
 	bundle := c.bundleFile()
 	path, err := exec.LookPath("tar")
 	if err != nil {
 		return err
 	}
+	args := []string{
+		"tar",
+		fmt.Sprintf("--directory=%s", dir),
+		"--create",
+		fmt.Sprintf("--file=%s", bundle),
+		"metadata.json",
+	}
+	if c.signer != nil {
+		args = append(args, provenanceFile)
+	}
+	args = append(args, "docker")
 	stdout := &bytes.Buffer{}
 	stderr := &bytes.Buffer{}
 	cmd := exec.Cmd{
-		Path: path,
-		Args: []string{
-			"tar",
-			fmt.Sprintf("--directory=%s", dir),
-			"--create",
-			fmt.Sprintf("--file=%s", bundle),
-			"metadata.json",
-			"docker",
-		},
+		Path:   path,
+		Args:   args,
 		Stdout: stdout,
 		Stderr: stderr,
 	}
@@ -526,19 +1287,73 @@ func (c *BundleCreator) writeDigest() error {
 	return nil
 }
 
-func (c *BundleCreator) writeManifest() error {
-	content, err := TemplatesFS.ReadFile("templates/manifest.yaml")
+func (c *BundleCreator) writeManifest(metadata *Metadata) error {
+	// Prepare the data for the template:
+	release, err := dreference.ParseNamed(metadata.Release)
+	if err != nil {
+		return err
+	}
+	var digest string
+	digested, ok := release.(dreference.Digested)
+	if ok {
+		digest = digested.Digest().String()
+	}
+	images := slices.Clone(metadata.Images)
+	slices.Sort(images)
+	rbac := &bytes.Buffer{}
+	err = WriteManifests(rbac, RBACManifests(c.namespace))
+	if err != nil {
+		return err
+	}
+	data := &bundleCreatorManifestData{
+		Version:   metadata.Version,
+		Arch:      metadata.Arch,
+		Release:   metadata.Release,
+		Digest:    digest,
+		Namespace: c.namespace,
+		Images:    images,
+		RBAC:      rbac.String(),
+	}
+
+	// Render the template:
+	source, err := TemplatesFS.ReadFile("templates/manifest.yaml")
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New("manifest.yaml").Option("missingkey=error").Parse(string(source))
+	if err != nil {
+		return err
+	}
+	buffer := &bytes.Buffer{}
+	err = tmpl.Execute(buffer, data)
 	if err != nil {
 		return err
 	}
+
+	// Write the result:
 	manifest := c.manifestFile()
-	err = os.WriteFile(manifest, content, 0644)
+	err = os.WriteFile(manifest, buffer.Bytes(), 0644)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// bundleCreatorManifestData is the data passed to the template used to generate the manifest that
+// accompanies the bundle.
+type bundleCreatorManifestData struct {
+	Version   string
+	Arch      string
+	Release   string
+	Digest    string
+	Namespace string
+	Images    []string
+
+	// RBAC contains the namespace and the service accounts, roles and role bindings of the
+	// controller and of the programs that run in the nodes.
+	RBAC string
+}
+
 func (c *BundleCreator) bundleFile() string {
 	return c.outputBase() + ".tar"
 }
@@ -564,4 +1379,12 @@ func (c *BundleCreator) createDir(dir string) error {
 	return err
 }
 
-const bundleCreatorReleaseRepo = "quay.io/openshift-release-dev/ocp-release"
+// bundleCreatorNamespace is the default namespace where the generated manifest creates the
+// controller.
+const bundleCreatorNamespace = "upgrade-tool"
+
+// bundleCreatorMaxRetryDelay is the maximum time to wait between retries.
+const bundleCreatorMaxRetryDelay = 5 * time.Minute
+
+// bundleCreatorBuilderID is the default builder identifier written to the provenance attestation.
+const bundleCreatorBuilderID = "https://github.com/jhernand/upgrade-tool"
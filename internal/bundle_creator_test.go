@@ -0,0 +1,439 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/ginkgo/v2/dsl/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Bundle creator", func() {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	It("Renders the manifest with the bundle details", func() {
+		// Render the manifest:
+		dir, err := os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+		creator := &BundleCreator{
+			version:   "4.13.4",
+			arch:      "x86_64",
+			outputDir: dir,
+			namespace: "my-ns",
+		}
+		metadata := &Metadata{
+			Version: "4.13.4",
+			Arch:    "x86_64",
+			Release: "quay.io/openshift-release-dev/ocp-release@" + digest,
+			Images: []string{
+				"quay.io/openshift-release-dev/ocp-v4.0-art-dev@sha256:b",
+				"quay.io/openshift-release-dev/ocp-v4.0-art-dev@sha256:a",
+			},
+		}
+		err = creator.writeManifest(metadata)
+		Expect(err).ToNot(HaveOccurred())
+		data, err := os.ReadFile(filepath.Join(dir, "upgrade-4.13.4-x86_64.yaml"))
+		Expect(err).ToNot(HaveOccurred())
+		text := string(data)
+
+		// Check the header:
+		Expect(text).To(ContainSubstring("version 4.13.4 for architecture x86_64"))
+		Expect(text).To(ContainSubstring("# Digest: " + digest))
+		Expect(text).To(ContainSubstring(
+			"# - quay.io/openshift-release-dev/ocp-v4.0-art-dev@sha256:a\n" +
+				"# - quay.io/openshift-release-dev/ocp-v4.0-art-dev@sha256:b\n",
+		))
+
+		// Check that the permissions are the generated ones, not the cluster admin role:
+		Expect(text).ToNot(ContainSubstring("cluster-admin"))
+		Expect(text).To(ContainSubstring("name: upgrade-tool:controller"))
+
+		// Check the controller pod:
+		decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+		var pod *corev1.Pod
+		for {
+			object := &corev1.Pod{}
+			err = decoder.Decode(object)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			Expect(err).ToNot(HaveOccurred())
+			if object.Kind == "Pod" {
+				pod = object
+			}
+		}
+		Expect(pod).ToNot(BeNil())
+		Expect(pod.Namespace).To(Equal("my-ns"))
+		Expect(pod.Annotations).To(HaveKeyWithValue("upgrade-tool/version", "4.13.4"))
+		Expect(pod.Annotations).To(HaveKeyWithValue("upgrade-tool/release", metadata.Release))
+		Expect(pod.Spec.Containers[0].Command).To(ContainElement("--namespace=my-ns"))
+	})
+
+	It("Fetches the update graph of the channel", func() {
+		// Start a fake update service:
+		var query url.Values
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.Query()
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{
+					"nodes": [
+						{"version": "4.13.3", "payload": "quay.io/ocp@sha256:3"},
+						{"version": "4.13.4", "payload": "quay.io/ocp@sha256:4"},
+						{"version": "4.13.5", "payload": "quay.io/ocp@sha256:5"}
+					],
+					"edges": [[0, 1], [1, 2]]
+				}`))
+			},
+		))
+		DeferCleanup(server.Close)
+
+		// Fetch the graph:
+		logger, err := logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		retrier, err := NewRetrier().
+			SetLogger(logger).
+			SetAttempts(1).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		creator := &BundleCreator{
+			logger:   logger,
+			retrier:  retrier,
+			version:  "4.13.4",
+			arch:     "x86_64",
+			channel:  "stable-4.13",
+			graphURL: server.URL,
+		}
+		graph, err := creator.fetchGraph(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+
+		// Check the request and the result:
+		Expect(query.Get("channel")).To(Equal("stable-4.13"))
+		Expect(query.Get("arch")).To(Equal("amd64"))
+		Expect(graph.Channel).To(Equal("stable-4.13"))
+		Expect(graph.HasEdge("4.13.3", "4.13.4")).To(BeTrue())
+		Expect(graph.Nodes).To(HaveLen(2))
+	})
+
+	Describe("Check of existing bundle", func() {
+		const repo = "quay.io/openshift-release-dev/ocp-release"
+
+		// writeBundle writes to the given directory a bundle containing the given metadata, and
+		// the corresponding digest file.
+		writeBundle := func(dir string, metadata *Metadata) {
+			data, err := json.Marshal(metadata)
+			Expect(err).ToNot(HaveOccurred())
+			buffer := &bytes.Buffer{}
+			writer := tar.NewWriter(buffer)
+			err = writer.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     "metadata.json",
+				Mode:     0600,
+				Size:     int64(len(data)),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = writer.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			err = writer.Close()
+			Expect(err).ToNot(HaveOccurred())
+			base := filepath.Join(dir, "upgrade-4.13.4-x86_64")
+			err = os.WriteFile(base+".tar", buffer.Bytes(), 0600)
+			Expect(err).ToNot(HaveOccurred())
+			sum := sha256.Sum256(buffer.Bytes())
+			err = os.WriteFile(base+".sha256", []byte(hex.EncodeToString(sum[:])+"\n"), 0600)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		DescribeTable(
+			"Compares the existing bundle to the requested one",
+			func(metadata *Metadata, releaseRepo, imageSet string, manifests []string,
+				expected bool) {
+				// Write the bundle:
+				dir, err := os.MkdirTemp("", "*.test")
+				Expect(err).ToNot(HaveOccurred())
+				DeferCleanup(os.RemoveAll, dir)
+				writeBundle(dir, metadata)
+
+				// Check it:
+				logger, err := logging.NewLogger().
+					SetWriter(GinkgoWriter).
+					SetLevel(2).
+					Build()
+				Expect(err).ToNot(HaveOccurred())
+				console, err := NewConsole().
+					SetLogger(logger).
+					SetOut(GinkgoWriter).
+					SetErr(GinkgoWriter).
+					Build()
+				Expect(err).ToNot(HaveOccurred())
+				creator := &BundleCreator{
+					logger:      logger,
+					console:     console,
+					version:     "4.13.4",
+					arch:        "x86_64",
+					releaseRepo: releaseRepo,
+					imageSet:    imageSet,
+					outputDir:   dir,
+				}
+				actual, err := creator.checkBundle(manifests)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(actual).To(Equal(expected))
+			},
+			Entry(
+				"Same bundle",
+				&Metadata{
+					Version: "4.13.4",
+					Arch:    "x86_64",
+					Release: repo + "@" + digest,
+				},
+				repo, "", nil,
+				true,
+			),
+			Entry(
+				"Same bundle with extra manifests",
+				&Metadata{
+					Version:   "4.13.4",
+					Arch:      "x86_64",
+					Release:   repo + "@" + digest,
+					Manifests: []string{"my-manifest"},
+				},
+				repo, "", []string{"my-manifest"},
+				true,
+			),
+			Entry(
+				"Different version",
+				&Metadata{
+					Version: "4.13.3",
+					Arch:    "x86_64",
+					Release: repo + "@" + digest,
+				},
+				repo, "", nil,
+				false,
+			),
+			Entry(
+				"Different architecture",
+				&Metadata{
+					Version: "4.13.4",
+					Arch:    "aarch64",
+					Release: repo + "@" + digest,
+				},
+				repo, "", nil,
+				false,
+			),
+			Entry(
+				"Different release repository",
+				&Metadata{
+					Version: "4.13.4",
+					Arch:    "x86_64",
+					Release: repo + "@" + digest,
+				},
+				"my-registry.example.com/ocp-release", "", nil,
+				false,
+			),
+			Entry(
+				"Release repository without domain",
+				&Metadata{
+					Version: "4.13.4",
+					Arch:    "x86_64",
+					Release: "docker.io/library/ocp-release@" + digest,
+				},
+				"ocp-release", "", nil,
+				true,
+			),
+			Entry(
+				"Different release repository ignored for imageset",
+				&Metadata{
+					Version: "4.13.4",
+					Arch:    "x86_64",
+					Release: repo + "@" + digest,
+				},
+				"my-registry.example.com/ocp-release", "my-imageset.tar", nil,
+				true,
+			),
+			Entry(
+				"Extra manifests added",
+				&Metadata{
+					Version: "4.13.4",
+					Arch:    "x86_64",
+					Release: repo + "@" + digest,
+				},
+				repo, "", []string{"my-manifest"},
+				false,
+			),
+			Entry(
+				"Extra manifests removed",
+				&Metadata{
+					Version:   "4.13.4",
+					Arch:      "x86_64",
+					Release:   repo + "@" + digest,
+					Manifests: []string{"my-manifest"},
+				},
+				repo, "", nil,
+				false,
+			),
+			Entry(
+				"Extra manifests changed",
+				&Metadata{
+					Version:   "4.13.4",
+					Arch:      "x86_64",
+					Release:   repo + "@" + digest,
+					Manifests: []string{"my-manifest"},
+				},
+				repo, "", []string{"your-manifest"},
+				false,
+			),
+		)
+
+		It("Detects that the digest doesn't match", func() {
+			dir, err := os.MkdirTemp("", "*.test")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, dir)
+			writeBundle(dir, &Metadata{
+				Version: "4.13.4",
+				Arch:    "x86_64",
+				Release: repo + "@" + digest,
+			})
+			err = os.WriteFile(
+				filepath.Join(dir, "upgrade-4.13.4-x86_64.sha256"),
+				[]byte("0123\n"), 0600,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			logger, err := logging.NewLogger().
+				SetWriter(GinkgoWriter).
+				SetLevel(2).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			console, err := NewConsole().
+				SetLogger(logger).
+				SetOut(GinkgoWriter).
+				SetErr(GinkgoWriter).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			creator := &BundleCreator{
+				logger:      logger,
+				console:     console,
+				version:     "4.13.4",
+				arch:        "x86_64",
+				releaseRepo: repo,
+				outputDir:   dir,
+			}
+			actual, err := creator.checkBundle(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual).To(BeFalse())
+		})
+	})
+
+	It("Rejects upload URLs that aren't in an object store", func() {
+		logger, err := logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		console, err := NewConsole().
+			SetLogger(logger).
+			SetOut(GinkgoWriter).
+			SetErr(GinkgoWriter).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = NewBundleCreator().
+			SetLogger(logger).
+			SetConsole(console).
+			SetVersion("4.13.4").
+			SetArch("x86_64").
+			SetOutputDir("/tmp").
+			SetPullSecret("pull-secret.json").
+			SetUploadURL("https://bundles.example.com/4.13").
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("s3://bucket/dir"))
+	})
+
+	It("Uploads the bundle files to the object store", func() {
+		// Start a fake object store that records the uploaded objects:
+		uploaded := map[string]string{}
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				uploaded[r.URL.Path] = string(data)
+				w.WriteHeader(http.StatusOK)
+			},
+		))
+		DeferCleanup(server.Close)
+
+		// Write the files:
+		dir, err := os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+		for _, suffix := range []string{".tar", ".sha256", ".yaml"} {
+			file := filepath.Join(dir, "upgrade-4.13.4-x86_64"+suffix)
+			err = os.WriteFile(file, []byte(suffix), 0600)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		// Upload them:
+		logger, err := logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		console, err := NewConsole().
+			SetLogger(logger).
+			SetOut(GinkgoWriter).
+			SetErr(GinkgoWriter).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		creator, err := NewBundleCreator().
+			SetLogger(logger).
+			SetConsole(console).
+			SetVersion("4.13.4").
+			SetArch("x86_64").
+			SetOutputDir(dir).
+			SetPullSecret("pull-secret.json").
+			SetUploadURL("s3://bundles/4.13/").
+			SetS3Endpoint(server.URL).
+			SetRetries(0).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		err = creator.uploadFiles(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(uploaded).To(Equal(map[string]string{
+			"/bundles/4.13/upgrade-4.13.4-x86_64.tar":    ".tar",
+			"/bundles/4.13/upgrade-4.13.4-x86_64.sha256": ".sha256",
+			"/bundles/4.13/upgrade-4.13.4-x86_64.yaml":   ".yaml",
+		}))
+	})
+})
@@ -0,0 +1,423 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	dreference "github.com/distribution/distribution/v3/reference"
+	"github.com/go-logr/logr"
+	godigest "github.com/opencontainers/go-digest"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	jqtool "github.com/jhernand/upgrade-tool/internal/jq"
+)
+
+// BundleEstimatorBuilder contains the data and logic needed to create a bundle estimator. Don't
+// create instances of this type directly, use the NewBundleEstimator function instead.
+type BundleEstimatorBuilder struct {
+	logger       logr.Logger
+	version      string
+	arch         string
+	pullSecret   string
+	releaseRepo  string
+	distribution string
+	bandwidth    int64
+	retries      int
+	retryDelay   time.Duration
+}
+
+// BundleEstimator calculates the amount of data that will be downloaded to create a bundle, the
+// size of the resulting bundle file and the time that the download will take, without actually
+// downloading the images. Don't create instances of this type directly, use the
+// NewBundleEstimator function instead.
+type BundleEstimator struct {
+	logger       logr.Logger
+	jq           *jqtool.Tool
+	retrier      *Retrier
+	version      string
+	arch         string
+	pullSecret   string
+	releaseRepo  string
+	distribution string
+	bandwidth    int64
+
+	// oc and skopeo are the paths of the 'oc' and 'skopeo' binaries. If empty they will be
+	// searched in the path.
+	oc     string
+	skopeo string
+}
+
+// BundleEstimate is the result of the estimation.
+type BundleEstimate struct {
+	// Release is the reference of the release image.
+	Release string `json:"release"`
+
+	// Images is the number of images, including the release image.
+	Images int `json:"images"`
+
+	// Blobs is the number of distinct blobs, as blobs shared by several images are downloaded
+	// only once.
+	Blobs int `json:"blobs"`
+
+	// DownloadBytes is the total size of the blobs and manifests that will be downloaded.
+	DownloadBytes int64 `json:"downloadBytes"`
+
+	// BundleBytes is the approximate size of the bundle file, including the overhead of the tar
+	// archive.
+	BundleBytes int64 `json:"bundleBytes"`
+
+	// Bandwidth is the bandwidth used to calculate the duration, in bytes per second.
+	Bandwidth int64 `json:"bandwidth"`
+
+	// Duration is the estimated time to download the images with the given bandwidth. It is
+	// encoded as a number of nanoseconds.
+	Duration time.Duration `json:"duration"`
+}
+
+// NewBundleEstimator creates a builder that can then be used to configure and create bundle
+// estimators.
+func NewBundleEstimator() *BundleEstimatorBuilder {
+	return &BundleEstimatorBuilder{
+		distribution: DistributionOCP,
+		retries:      5,
+		retryDelay:   10 * time.Second,
+	}
+}
+
+// SetLogger sets the logger that the estimator will use to write log messages. This is mandatory.
+func (b *BundleEstimatorBuilder) SetLogger(value logr.Logger) *BundleEstimatorBuilder {
+	b.logger = value
+	return b
+}
+
+// SetVersion sets the version of the release. This is mandatory.
+func (b *BundleEstimatorBuilder) SetVersion(value string) *BundleEstimatorBuilder {
+	b.version = value
+	return b
+}
+
+// SetArch sets the architecture of the release. This is mandatory.
+func (b *BundleEstimatorBuilder) SetArch(value string) *BundleEstimatorBuilder {
+	b.arch = value
+	return b
+}
+
+// SetPullSecret sets the file that contains the pull secret used to read the image manifests.
+// This is mandatory for the OCP distribution and optional for the OKD distribution.
+func (b *BundleEstimatorBuilder) SetPullSecret(value string) *BundleEstimatorBuilder {
+	b.pullSecret = value
+	return b
+}
+
+// SetReleaseRepo sets the repository that contains the release images. This is optional and the
+// default depends on the distribution.
+func (b *BundleEstimatorBuilder) SetReleaseRepo(value string) *BundleEstimatorBuilder {
+	b.releaseRepo = value
+	return b
+}
+
+// SetDistribution sets the distribution of the release, either 'ocp' or 'okd'. This is optional
+// and the default is 'ocp'.
+func (b *BundleEstimatorBuilder) SetDistribution(value string) *BundleEstimatorBuilder {
+	b.distribution = value
+	return b
+}
+
+// SetBandwidth sets the bandwidth, in bytes per second, used to calculate the duration of the
+// download. This is mandatory.
+func (b *BundleEstimatorBuilder) SetBandwidth(value int64) *BundleEstimatorBuilder {
+	b.bandwidth = value
+	return b
+}
+
+// SetRetries sets the number of times that the inspection of the release and of the images will
+// be retried if it fails. This is optional and the default is five.
+func (b *BundleEstimatorBuilder) SetRetries(value int) *BundleEstimatorBuilder {
+	b.retries = value
+	return b
+}
+
+// SetRetryDelay sets the time to wait before the first retry. This is optional and the default is
+// ten seconds.
+func (b *BundleEstimatorBuilder) SetRetryDelay(value time.Duration) *BundleEstimatorBuilder {
+	b.retryDelay = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new bundle estimator.
+func (b *BundleEstimatorBuilder) Build() (result *BundleEstimator, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+	if b.version == "" {
+		err = errors.New("version is mandatory")
+		return
+	}
+	if b.arch == "" {
+		err = errors.New("architecture is mandatory")
+		return
+	}
+	if !slices.Contains(Distributions(), b.distribution) {
+		err = fmt.Errorf(
+			"distribution '%s' isn't valid, it should be one of %v",
+			b.distribution, Distributions(),
+		)
+		return
+	}
+	if b.pullSecret == "" && b.distribution != DistributionOKD {
+		err = errors.New("pull secret is mandatory")
+		return
+	}
+	if b.bandwidth <= 0 {
+		err = fmt.Errorf(
+			"bandwidth %d isn't valid, it must be greater than zero",
+			b.bandwidth,
+		)
+		return
+	}
+	if b.retries < 0 {
+		err = fmt.Errorf(
+			"number of retries %d isn't valid, it must be greater than or equal to zero",
+			b.retries,
+		)
+		return
+	}
+	releaseRepo := b.releaseRepo
+	if releaseRepo == "" {
+		releaseRepo = distributionReleaseRepos[b.distribution]
+	}
+	_, err = dreference.ParseNormalizedNamed(releaseRepo)
+	if err != nil {
+		err = fmt.Errorf("release repository '%s' isn't valid: %w", releaseRepo, err)
+		return
+	}
+
+	// Create the retrier:
+	maxRetryDelay := bundleCreatorMaxRetryDelay
+	if maxRetryDelay < b.retryDelay {
+		maxRetryDelay = b.retryDelay
+	}
+	retrier, err := NewRetrier().
+		SetLogger(b.logger).
+		SetAttempts(b.retries + 1).
+		SetDelay(b.retryDelay).
+		SetMaxDelay(maxRetryDelay).
+		Build()
+	if err != nil {
+		return
+	}
+
+	// Create the jq tool:
+	jq, err := jqtool.NewTool().
+		SetLogger(b.logger).
+		Build()
+	if err != nil {
+		return
+	}
+
+	// Create and populate the object:
+	result = &BundleEstimator{
+		logger:       b.logger,
+		jq:           jq,
+		retrier:      retrier,
+		version:      b.version,
+		arch:         b.arch,
+		pullSecret:   b.pullSecret,
+		releaseRepo:  releaseRepo,
+		distribution: b.distribution,
+		bandwidth:    b.bandwidth,
+	}
+	return
+}
+
+// Run finds the release images, reads their manifests and calculates the estimate.
+func (e *BundleEstimator) Run(ctx context.Context) (result *BundleEstimate, err error) {
+	// Find the images:
+	finder := &releaseFinder{
+		logger:       e.logger,
+		jq:           e.jq,
+		retrier:      e.retrier,
+		oc:           e.oc,
+		releaseRepo:  e.releaseRepo,
+		version:      e.version,
+		arch:         e.arch,
+		distribution: e.distribution,
+	}
+	release, images, err := finder.find(ctx)
+	if err != nil {
+		return
+	}
+	refs := append([]string{release}, maps.Values(images)...)
+
+	// Read the manifests and collect the sizes of the distinct blobs. Note that manifests are
+	// also stored as blobs by the registry.
+	blobs := map[godigest.Digest]int64{}
+	for _, ref := range refs {
+		err = e.inspectImage(ctx, ref, blobs)
+		if err != nil {
+			return
+		}
+	}
+
+	// Calculate the totals. For the size of the bundle we add the tar header and the padding of
+	// each blob, and the small link files that the registry creates for each image.
+	var download int64
+	bundle := int64(len(refs)) * bundleEstimatorLinksPerImage * 2 * bundleEstimatorTarBlock
+	for _, size := range blobs {
+		download += size
+		bundle += bundleEstimatorTarBlock + e.roundUp(size)
+	}
+	duration := time.Duration(float64(download) / float64(e.bandwidth) * float64(time.Second))
+	result = &BundleEstimate{
+		Release:       release,
+		Images:        len(refs),
+		Blobs:         len(blobs),
+		DownloadBytes: download,
+		BundleBytes:   bundle,
+		Bandwidth:     e.bandwidth,
+		Duration:      duration,
+	}
+	e.logger.Info(
+		"Calculated estimate",
+		"release", result.Release,
+		"images", result.Images,
+		"blobs", result.Blobs,
+		"download", result.DownloadBytes,
+		"bundle", result.BundleBytes,
+		"duration", result.Duration.String(),
+	)
+	return
+}
+
+// inspectImage reads the manifest of the given image and adds its size and the sizes of its blobs
+// to the given map. If the manifest is a list it selects the manifest for the architecture.
+func (e *BundleEstimator) inspectImage(ctx context.Context, ref string,
+	blobs map[godigest.Digest]int64) (err error) {
+	data, err := e.readManifest(ctx, ref)
+	if err != nil {
+		return
+	}
+	blobs[godigest.FromBytes(data)] = int64(len(data))
+	var manifest registryManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		err = fmt.Errorf("failed to parse manifest of image '%s': %w", ref, err)
+		return
+	}
+	if len(manifest.Manifests) > 0 {
+		var child string
+		child, err = e.selectManifest(ref, &manifest)
+		if err != nil {
+			return
+		}
+		err = e.inspectImage(ctx, child, blobs)
+		return
+	}
+	if manifest.Config != nil {
+		blobs[manifest.Config.Digest] = manifest.Config.Size
+	}
+	for _, layer := range manifest.Layers {
+		blobs[layer.Digest] = layer.Size
+	}
+	return
+}
+
+// selectManifest returns the reference of the manifest of the list that corresponds to the
+// architecture.
+func (e *BundleEstimator) selectManifest(ref string, list *registryManifest) (result string,
+	err error) {
+	named, err := dreference.ParseNamed(ref)
+	if err != nil {
+		return
+	}
+	osArch := distributionOSArchs[e.arch]
+	for _, child := range list.Manifests {
+		if child.Platform != nil && child.Platform.OS == "linux" &&
+			child.Platform.Architecture == osArch {
+			result = fmt.Sprintf("%s@%s", named.Name(), child.Digest)
+			return
+		}
+	}
+	err = fmt.Errorf(
+		"manifest list of image '%s' doesn't contain a manifest for architecture '%s'",
+		ref, e.arch,
+	)
+	return
+}
+
+// readManifest uses the 'skopeo inspect --raw' command to read the manifest of the given image.
+func (e *BundleEstimator) readManifest(ctx context.Context, ref string) (result []byte,
+	err error) {
+	path := e.skopeo
+	if path == "" {
+		path, err = exec.LookPath("skopeo")
+		if err != nil {
+			return
+		}
+	}
+	args := []string{
+		"inspect",
+		"--raw",
+	}
+	if e.pullSecret != "" {
+		args = append(args, fmt.Sprintf("--authfile=%s", e.pullSecret))
+	}
+	args = append(args, fmt.Sprintf("docker://%s", ref))
+	stdout := &bytes.Buffer{}
+	name := fmt.Sprintf("inspection of image '%s'", ref)
+	err = e.retrier.Do(ctx, name, func(ctx context.Context) error {
+		stdout.Reset()
+		stderr := &bytes.Buffer{}
+		cmd := exec.CommandContext(ctx, path, args...)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		err := cmd.Run()
+		e.logger.V(1).Info(
+			"Executed 'skopeo' command",
+			"args", cmd.Args,
+			"stderr", stderr.String(),
+			"code", cmd.ProcessState.ExitCode(),
+		)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	result = stdout.Bytes()
+	return
+}
+
+func (e *BundleEstimator) roundUp(size int64) int64 {
+	return (size + bundleEstimatorTarBlock - 1) / bundleEstimatorTarBlock * bundleEstimatorTarBlock
+}
+
+// bundleEstimatorTarBlock is the size of the blocks of a tar archive. Each file uses one block for
+// the header, and the content is padded to a multiple of the block size.
+const bundleEstimatorTarBlock = 512
+
+// bundleEstimatorLinksPerImage is the approximate number of link files that the registry creates
+// for each image: one for the configuration, a few for the layers, one for the manifest revision
+// and two for the tag.
+const bundleEstimatorLinksPerImage = 8
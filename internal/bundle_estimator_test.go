@@ -0,0 +1,256 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	godigest "github.com/opencontainers/go-digest"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Bundle estimator", func() {
+	var (
+		ctx       context.Context
+		logger    logr.Logger
+		tmp       string
+		manifests string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create a temporary directory for the fake tools and the manifests:
+		tmp, err = os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		manifests = filepath.Join(tmp, "manifests")
+		err = os.Mkdir(manifests, 0700)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	// writeManifest writes the given manifest to the directory where the fake 'skopeo' command
+	// reads them, and returns its digest and size.
+	writeManifest := func(manifest *registryManifest) (digest godigest.Digest, size int64) {
+		data, err := json.Marshal(manifest)
+		Expect(err).ToNot(HaveOccurred())
+		digest = godigest.FromBytes(data)
+		size = int64(len(data))
+		err = os.WriteFile(filepath.Join(manifests, digest.String()), data, 0600)
+		Expect(err).ToNot(HaveOccurred())
+		return
+	}
+
+	// makeImage creates a manifest with the given configuration and layers.
+	makeImage := func(config registryDescriptor, layers ...registryDescriptor) *registryManifest {
+		return &registryManifest{
+			MediaType: "application/vnd.docker.distribution.manifest.v2+json",
+			Config:    &config,
+			Layers:    layers,
+		}
+	}
+
+	// makeBlob creates a descriptor for a blob with the given content and size.
+	makeBlob := func(content string, size int64) registryDescriptor {
+		return registryDescriptor{
+			Digest: godigest.FromString(content),
+			Size:   size,
+		}
+	}
+
+	// makeEstimator creates an estimator that uses fake 'oc' and 'skopeo' commands. The 'oc'
+	// command returns a release with the given digest and payload images, and the 'skopeo'
+	// command returns the manifests written with the writeManifest function.
+	makeEstimator := func(bandwidth int64, release godigest.Digest,
+		images map[string]string) *BundleEstimator {
+		// Write the release info:
+		tags := []any{}
+		for name, ref := range images {
+			tags = append(tags, map[string]any{
+				"name": name,
+				"from": map[string]any{
+					"name": ref,
+				},
+			})
+		}
+		info, err := json.Marshal(map[string]any{
+			"digest": release,
+			"references": map[string]any{
+				"spec": map[string]any{
+					"tags": tags,
+				},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		infoFile := filepath.Join(tmp, "info.json")
+		err = os.WriteFile(infoFile, info, 0600)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Write the fake tools:
+		oc := filepath.Join(tmp, "oc")
+		script := "#!/bin/sh\ncat " + infoFile + "\n"
+		err = os.WriteFile(oc, []byte(script), 0700)
+		Expect(err).ToNot(HaveOccurred())
+		skopeo := filepath.Join(tmp, "skopeo")
+		script = "#!/bin/sh\nfor arg in \"$@\"; do ref=\"$arg\"; done\n" +
+			"exec cat \"" + manifests + "/${ref##*@}\"\n"
+		err = os.WriteFile(skopeo, []byte(script), 0700)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create the estimator:
+		estimator, err := NewBundleEstimator().
+			SetLogger(logger).
+			SetVersion("4.13.0-okd-scos.0").
+			SetArch("x86_64").
+			SetDistribution(DistributionOKD).
+			SetBandwidth(bandwidth).
+			SetRetries(0).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		estimator.oc = oc
+		estimator.skopeo = skopeo
+		return estimator
+	}
+
+	It("Calculates the sizes and the duration", func() {
+		release, releaseSize := writeManifest(makeImage(
+			makeBlob("release-config", 1000),
+			makeBlob("release-layer", 5000),
+		))
+		download := releaseSize + 1000 + 5000
+		estimator := makeEstimator(download/2, release, nil)
+		estimate, err := estimator.Run(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(estimate.Release).To(Equal("quay.io/okd/scos-release@" + release.String()))
+		Expect(estimate.Images).To(Equal(1))
+		Expect(estimate.Blobs).To(Equal(3))
+		Expect(estimate.DownloadBytes).To(Equal(download))
+		Expect(estimate.BundleBytes).To(Equal(
+			1*8*2*512 +
+				512 + (releaseSize+511)/512*512 +
+				512 + 1024 +
+				512 + 5120,
+		))
+		Expect(estimate.Bandwidth).To(Equal(download / 2))
+		Expect(estimate.Duration).To(BeNumerically("~", 2*time.Second, time.Millisecond))
+	})
+
+	It("Counts blobs shared by several images only once", func() {
+		shared := makeBlob("shared-layer", 4000)
+		etcd, etcdSize := writeManifest(makeImage(
+			makeBlob("etcd-config", 100),
+			shared,
+			makeBlob("etcd-layer", 2000),
+		))
+		hyperkube, hyperkubeSize := writeManifest(makeImage(
+			makeBlob("hyperkube-config", 200),
+			shared,
+			makeBlob("hyperkube-layer", 3000),
+		))
+		release, releaseSize := writeManifest(makeImage(
+			makeBlob("release-config", 300),
+			shared,
+		))
+		estimator := makeEstimator(1024, release, map[string]string{
+			"etcd":      "quay.io/okd/scos-content@" + etcd.String(),
+			"hyperkube": "quay.io/okd/scos-content@" + hyperkube.String(),
+		})
+		estimate, err := estimator.Run(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(estimate.Images).To(Equal(3))
+		Expect(estimate.Blobs).To(Equal(9))
+		Expect(estimate.DownloadBytes).To(Equal(
+			releaseSize + etcdSize + hyperkubeSize +
+				100 + 200 + 300 +
+				4000 + 2000 + 3000,
+		))
+	})
+
+	It("Selects the manifest of the architecture from manifest lists", func() {
+		amd64, amd64Size := writeManifest(makeImage(
+			makeBlob("amd64-config", 100),
+			makeBlob("amd64-layer", 1000),
+		))
+		arm64, _ := writeManifest(makeImage(
+			makeBlob("arm64-config", 200),
+			makeBlob("arm64-layer", 2000),
+		))
+		release, releaseSize := writeManifest(&registryManifest{
+			MediaType: "application/vnd.docker.distribution.manifest.list.v2+json",
+			Manifests: []registryDescriptor{
+				{
+					Digest: arm64,
+					Platform: &registryPlatform{
+						OS:           "linux",
+						Architecture: "arm64",
+					},
+				},
+				{
+					Digest: amd64,
+					Platform: &registryPlatform{
+						OS:           "linux",
+						Architecture: "amd64",
+					},
+				},
+			},
+		})
+		estimator := makeEstimator(1024, release, nil)
+		estimate, err := estimator.Run(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(estimate.Images).To(Equal(1))
+		Expect(estimate.Blobs).To(Equal(4))
+		Expect(estimate.DownloadBytes).To(Equal(releaseSize + amd64Size + 100 + 1000))
+	})
+
+	It("Fails if the manifest list doesn't contain the architecture", func() {
+		arm64, _ := writeManifest(makeImage(
+			makeBlob("arm64-config", 200),
+			makeBlob("arm64-layer", 2000),
+		))
+		release, _ := writeManifest(&registryManifest{
+			MediaType: "application/vnd.docker.distribution.manifest.list.v2+json",
+			Manifests: []registryDescriptor{{
+				Digest: arm64,
+				Platform: &registryPlatform{
+					OS:           "linux",
+					Architecture: "arm64",
+				},
+			}},
+		})
+		estimator := makeEstimator(1024, release, nil)
+		_, err := estimator.Run(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("doesn't contain a manifest"))
+		Expect(err.Error()).To(ContainSubstring("x86_64"))
+	})
+})
@@ -15,28 +15,40 @@ License.
 package internal
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/go-logr/logr"
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/http/httpproxy"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	clnt "sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
 	"github.com/jhernand/upgrade-tool/internal/labels"
 )
 
@@ -46,29 +58,75 @@ type BundleExtractorBuilder struct {
 	logger     logr.Logger
 	client     clnt.Client
 	node       string
+	namespace  string
 	rootDir    string
 	bundleFile string
 	bundleDir  string
 	serverAddr string
+	replicate  bool
+	tokenFile  string
+	version    string
+	arch       string
+	digest     string
+
+	expectedVersion string
+	expectedArch    string
+
+	bundleURL        string
+	s3Endpoint       string
+	s3Region         string
+	s3CredentialsDir string
+	mediaDirs        []string
+	streaming        bool
+	proxy            string
+	noProxy          string
+	caFile           string
+
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+	waitTimeout   time.Duration
 }
 
 // BundleExtractor obtains the upgrade bundle, from a file or from the bundle server, extracts it to
 // a directory and marks the node with a label when it finishes. Don't create instances of this type
 // directly, use the NewBundleExtractor function instead.
 type BundleExtractor struct {
-	logger     logr.Logger
-	client     clnt.Client
-	node       string
-	rootDir    string
-	bundleFile string
-	bundleDir  string
-	serverAddr string
+	logger      logr.Logger
+	client      clnt.Client
+	node        string
+	rootDir     string
+	bundleFile  string
+	bundleDir   string
+	serverAddrs []string
+	replicate   bool
+	token       string
+	version     string
+	arch        string
+	digest      string
+	bundleURL   string
+	s3          *s3Client
+	media       *mediaScanner
+	mediaFile   string
+	streaming   bool
+	httpClient  *http.Client
+	retrier     *Retrier
+	status      *nodeStatusWriter
+	events      *nodeEventWriter
+
+	expectedVersion string
+	expectedArch    string
+
+	waitTimeout time.Duration
 }
 
 // NewBundleExtractor creates a builder that can then be used to configure and create bundle
 // extractors.
 func NewBundleExtractor() *BundleExtractorBuilder {
-	return &BundleExtractorBuilder{}
+	return &BundleExtractorBuilder{
+		retryDelay:    10 * time.Second,
+		maxRetryDelay: time.Minute,
+		waitTimeout:   time.Hour,
+	}
 }
 
 // SetLogger sets the logger that the extractor will use to write log messages. This is mandatory.
@@ -93,6 +151,14 @@ func (b *BundleExtractorBuilder) SetNode(value string) *BundleExtractorBuilder {
 	return b
 }
 
+// SetNamespace sets the namespace where the extractor will write the NodeUpgradeStatus object of
+// the node. This is optional, and when not specified the status is only reported using the
+// annotations and labels of the node.
+func (b *BundleExtractorBuilder) SetNamespace(value string) *BundleExtractorBuilder {
+	b.namespace = value
+	return b
+}
+
 // SetRootDir sets the root directory. This is optional, and when specified all the other
 // directories are relative to it. This is intended for running the extractor in a privileged pod
 // with the node root filesystem mounted in a regular directory.
@@ -103,12 +169,64 @@ func (b *BundleExtractorBuilder) SetRootDir(value string) *BundleExtractorBuilde
 
 // SetBundleFile sets the location of the bundle file. If that file exists the extractor will read
 // it and will not try to download the bundle from the bundle server. Note that this is mandatory
-// even if the file doesn't exist.
+// even if the file doesn't exist, unless the version is specified.
 func (b *BundleExtractorBuilder) SetBundleFile(value string) *BundleExtractorBuilder {
 	b.bundleFile = value
 	return b
 }
 
+// SetBundleURL sets the URL where the bundle can be downloaded from, instead of the bundle server.
+// This can be an 's3://bucket/key' URL, for bundles stored in an S3 compatible object store, or a
+// plain 'http' or 'https' URL. When this is specified the bundle server isn't used. This is
+// optional.
+func (b *BundleExtractorBuilder) SetBundleURL(value string) *BundleExtractorBuilder {
+	b.bundleURL = value
+	return b
+}
+
+// SetS3Endpoint sets the URL of the S3 compatible object store used for 's3://' bundle URLs. This
+// is optional, and if not specified the endpoint will be read from the credentials directory, or
+// else the AWS endpoint of the region will be used.
+func (b *BundleExtractorBuilder) SetS3Endpoint(value string) *BundleExtractorBuilder {
+	b.s3Endpoint = value
+	return b
+}
+
+// SetS3Region sets the region of the S3 compatible object store. This is optional, and if not
+// specified the region will be read from the credentials directory, or else 'us-east-1' will be
+// used.
+func (b *BundleExtractorBuilder) SetS3Region(value string) *BundleExtractorBuilder {
+	b.s3Region = value
+	return b
+}
+
+// SetS3CredentialsDir sets the directory that contains the credentials used to access the S3
+// compatible object store, usually a secret mounted as a volume. The directory should contain the
+// 'access-key-id' and 'secret-access-key' files, and optionally the 'session-token', 'endpoint'
+// and 'region' files. Note that this directory isn't relative to the root directory. This is
+// optional, and if not specified the requests will not be signed.
+func (b *BundleExtractorBuilder) SetS3CredentialsDir(value string) *BundleExtractorBuilder {
+	b.s3CredentialsDir = value
+	return b
+}
+
+// AddMediaDir adds a directory where removable media, like USB disks, are mounted. The extractor
+// will look in these directories, and in their subdirectories, for bundle files with names like
+// 'upgrade-4.12.3.tar', and will use the first one that has the expected digest. The digest is the
+// one configured with the SetDigest method, or else the one in the '.sha256' file next to the
+// bundle file. Note that these directories are relative to the root directory. This is optional.
+func (b *BundleExtractorBuilder) AddMediaDir(value string) *BundleExtractorBuilder {
+	b.mediaDirs = append(b.mediaDirs, value)
+	return b
+}
+
+// AddMediaDirs adds a list of directories where removable media are mounted. See the AddMediaDir
+// method for details.
+func (b *BundleExtractorBuilder) AddMediaDirs(values ...string) *BundleExtractorBuilder {
+	b.mediaDirs = append(b.mediaDirs, values...)
+	return b
+}
+
 // SetBundleDir sets the directory where the bundle will be extracted. If the directory exists its
 // contents will be completely removed and replaced with the new bundle. This is mandatory.
 func (b *BundleExtractorBuilder) SetBundleDir(value string) *BundleExtractorBuilder {
@@ -117,12 +235,135 @@ func (b *BundleExtractorBuilder) SetBundleDir(value string) *BundleExtractorBuil
 }
 
 // SetServerAddr sets the address of the server where the extractor will try to download the bundle
-// if the bundle file doesn't exist. This is mandatory.
+// if the bundle file doesn't exist. This can also be a comma separated list of addresses, and each
+// address can be a name that resolves to multiple IP addresses, like the name of a headless
+// Kubernetes service. The servers will be tried in the given order, and if one of them fails in the
+// middle of the download the extractor will continue downloading from the next one. This is
+// mandatory.
 func (b *BundleExtractorBuilder) SetServerAddr(value string) *BundleExtractorBuilder {
 	b.serverAddr = value
 	return b
 }
 
+// SetReplicate sets a flag that indicates that the extractor should save a copy of the bundle that
+// it downloads from the bundle server. The copy is saved to a file with the same name than the
+// bundle directory and the '.tar' extension, and the bundle server running in this node will then
+// serve it to other nodes. This is optional and the default is false.
+func (b *BundleExtractorBuilder) SetReplicate(value bool) *BundleExtractorBuilder {
+	b.replicate = value
+	return b
+}
+
+// SetStreaming sets a flag that indicates that the extractor should extract the bundle while it is
+// downloaded without saving it to a file, so that it only needs disk space for the extracted files
+// instead of twice the size of the bundle. The digest is still verified as the data arrives. The
+// drawback is that if the extractor is restarted the download will start again from the
+// beginning. This is ignored when replication is enabled, as then the file is needed to serve the
+// bundle to other nodes. This is optional and the default is false.
+func (b *BundleExtractorBuilder) SetStreaming(value bool) *BundleExtractorBuilder {
+	b.streaming = value
+	return b
+}
+
+// SetProxy sets the URL of the proxy server that will be used for the HTTP and HTTPS requests, for
+// example 'http://proxy.example.com:3128'. This is optional, and if not specified the proxy will
+// be obtained from the 'HTTP_PROXY', 'HTTPS_PROXY' and 'NO_PROXY' environment variables.
+func (b *BundleExtractorBuilder) SetProxy(value string) *BundleExtractorBuilder {
+	b.proxy = value
+	return b
+}
+
+// SetNoProxy sets a comma separated list of host names, domain names, IP addresses or CIDR
+// ranges that will be accessed without the proxy, for example '.svc,.cluster.local,10.0.0.0/8'.
+// Note that when the bundle is downloaded from the bundle server this should usually contain the
+// domain of the services of the cluster. This is only used when the proxy is set with the SetProxy
+// method. This is optional.
+func (b *BundleExtractorBuilder) SetNoProxy(value string) *BundleExtractorBuilder {
+	b.noProxy = value
+	return b
+}
+
+// SetCAFile sets a file containing PEM encoded CA certificates that will be trusted, in addition
+// to the system ones, when downloading the bundle using HTTPS. Note that this file isn't relative
+// to the root directory, as it is intended to be mounted from a config map or secret. This is
+// optional.
+func (b *BundleExtractorBuilder) SetCAFile(value string) *BundleExtractorBuilder {
+	b.caFile = value
+	return b
+}
+
+// SetTokenFile sets the file that contains the token that the extractor will send to the bundle
+// server in the 'Authorization' header. Note that this file isn't relative to the root directory,
+// as it is intended to be mounted from a secret. This is optional.
+func (b *BundleExtractorBuilder) SetTokenFile(value string) *BundleExtractorBuilder {
+	b.tokenFile = value
+	return b
+}
+
+// SetVersion sets the version of the bundle. When this is specified the extractor will use the
+// index of the bundle server to find the bundle that has this version, instead of downloading the
+// only bundle that the server has. This is optional.
+func (b *BundleExtractorBuilder) SetVersion(value string) *BundleExtractorBuilder {
+	b.version = value
+	return b
+}
+
+// SetArch sets the architecture of the bundle. This is used together with the version to find the
+// bundle in the index of the bundle server. This is optional, and if not specified the first
+// bundle that has the right version will be used.
+func (b *BundleExtractorBuilder) SetArch(value string) *BundleExtractorBuilder {
+	b.arch = value
+	return b
+}
+
+// SetDigest sets the expected SHA-256 digest of the bundle, as a hex string optionally prefixed
+// with 'sha256:'. When this isn't specified the extractor will use the digest from the '.sha256'
+// file next to the bundle file, or the digest returned by the bundle server. This is optional.
+func (b *BundleExtractorBuilder) SetDigest(value string) *BundleExtractorBuilder {
+	b.digest = value
+	return b
+}
+
+// SetExpectedVersion sets the version that the cluster expects. The extractor will check that the
+// version in the metadata of the bundle matches it, and will refuse to extract the bundle if it
+// doesn't. This is optional.
+func (b *BundleExtractorBuilder) SetExpectedVersion(value string) *BundleExtractorBuilder {
+	b.expectedVersion = value
+	return b
+}
+
+// SetExpectedArch sets the architecture that the cluster expects. It can be the name used in the
+// bundle metadata, like 'x86_64', or the name used by Kubernetes nodes, like 'amd64'. The
+// extractor will check that the architecture in the metadata of the bundle matches it, and will
+// refuse to extract the bundle if it doesn't. This is optional.
+func (b *BundleExtractorBuilder) SetExpectedArch(value string) *BundleExtractorBuilder {
+	b.expectedArch = value
+	return b
+}
+
+// SetRetryDelay sets the time to wait before trying again to obtain the bundle when it isn't
+// available yet, for example when the bundle server isn't ready. The time is doubled after each
+// failed attempt. This is optional and the default is ten seconds.
+func (b *BundleExtractorBuilder) SetRetryDelay(value time.Duration) *BundleExtractorBuilder {
+	b.retryDelay = value
+	return b
+}
+
+// SetMaxRetryDelay sets the maximum time to wait between attempts to obtain the bundle. This is
+// optional and the default is one minute.
+func (b *BundleExtractorBuilder) SetMaxRetryDelay(value time.Duration) *BundleExtractorBuilder {
+	b.maxRetryDelay = value
+	return b
+}
+
+// SetWaitTimeout sets the maximum time to wait for the bundle to be available. When this time
+// expires the extractor will fail. Note that this doesn't limit the time of the download once it
+// has started. This is optional and the default is one hour. A value of zero means waiting forever.
+func (b *BundleExtractorBuilder) SetWaitTimeout(value time.Duration) *BundleExtractorBuilder {
+	b.waitTimeout = value
+	return b
+}
+
 // Build uses the data stored in the builder to create and configure a new bundle extractor.
 func (b *BundleExtractorBuilder) Build() (result *BundleExtractor, err error) {
 	// Check parameters:
@@ -138,49 +379,244 @@ func (b *BundleExtractorBuilder) Build() (result *BundleExtractor, err error) {
 		err = errors.New("node name is mandatory")
 		return
 	}
-	if b.bundleFile == "" {
-		err = errors.New("bundle file is mandatory")
+	if b.bundleFile == "" && b.version == "" && b.bundleURL == "" && len(b.mediaDirs) == 0 {
+		err = errors.New("bundle file, version, URL or media directory is mandatory")
 		return
 	}
 	if b.bundleDir == "" {
 		err = errors.New("bundle directory is mandatory")
 		return
 	}
-	if b.serverAddr == "" {
+	if b.serverAddr == "" && b.bundleURL == "" && len(b.mediaDirs) == 0 {
+		err = errors.New("server address is mandatory")
+		return
+	}
+	var serverAddrs []string
+	for _, serverAddr := range strings.Split(b.serverAddr, ",") {
+		serverAddr = strings.TrimSpace(serverAddr)
+		if serverAddr == "" {
+			continue
+		}
+		_, _, err = net.SplitHostPort(serverAddr)
+		if err != nil {
+			err = fmt.Errorf("server address '%s' isn't valid: %w", serverAddr, err)
+			return
+		}
+		serverAddrs = append(serverAddrs, serverAddr)
+	}
+	if len(serverAddrs) == 0 && b.bundleURL == "" && len(b.mediaDirs) == 0 {
 		err = errors.New("server address is mandatory")
 		return
 	}
+	if b.waitTimeout < 0 {
+		err = fmt.Errorf(
+			"wait timeout %s isn't valid, it must be greater than or equal to zero",
+			b.waitTimeout,
+		)
+		return
+	}
+
+	// Create the retrier that will be used to wait for the bundle. The number of attempts is
+	// not limited, only the total time waiting.
+	retrier, err := NewRetrier().
+		SetLogger(b.logger).
+		SetAttempts(math.MaxInt32).
+		SetDelay(b.retryDelay).
+		SetMaxDelay(b.maxRetryDelay).
+		Build()
+	if err != nil {
+		return
+	}
+
+	// Calculate the URL of the bundle:
+	var bundleURL string
+	var s3 *s3Client
+	if b.bundleURL != "" {
+		bundleURL, s3, err = b.parseBundleURL()
+		if err != nil {
+			return
+		}
+	}
+
+	// Create the scanner for removable media:
+	var media *mediaScanner
+	if len(b.mediaDirs) > 0 {
+		media = &mediaScanner{
+			logger:  b.logger,
+			version: b.version,
+			digest:  strings.TrimPrefix(b.digest, bundleExtractorDigestPrefix),
+		}
+		for _, mediaDir := range b.mediaDirs {
+			if b.rootDir != "" {
+				mediaDir = filepath.Join(b.rootDir, mediaDir)
+			}
+			media.dirs = append(media.dirs, mediaDir)
+		}
+	}
+
+	// Create the HTTP client:
+	httpClient, err := b.createHTTPClient()
+	if err != nil {
+		return
+	}
+
+	// Read the token:
+	var token string
+	if b.tokenFile != "" {
+		token, err = readTokenFile(b.tokenFile)
+		if err != nil {
+			return
+		}
+	}
 
 	// Create and populate the object:
 	result = &BundleExtractor{
-		logger:     b.logger,
-		client:     b.client,
-		node:       b.node,
-		rootDir:    b.rootDir,
-		bundleFile: b.bundleFile,
-		bundleDir:  b.bundleDir,
-		serverAddr: b.serverAddr,
+		logger:      b.logger,
+		client:      b.client,
+		node:        b.node,
+		rootDir:     b.rootDir,
+		bundleFile:  b.bundleFile,
+		bundleDir:   b.bundleDir,
+		serverAddrs: serverAddrs,
+		replicate:   b.replicate,
+		token:       token,
+		version:     b.version,
+		arch:        b.arch,
+		digest:      strings.TrimPrefix(b.digest, bundleExtractorDigestPrefix),
+		bundleURL:   bundleURL,
+		s3:          s3,
+		media:       media,
+		streaming:   b.streaming,
+		httpClient:  httpClient,
+		retrier:     retrier,
+		status:      newNodeStatusWriter(b.logger, b.client, b.namespace, b.node),
+		events:      newNodeEventWriter(b.logger, b.client, b.node, nodeEventExtractorComponent),
+		waitTimeout: b.waitTimeout,
+
+		expectedVersion: b.expectedVersion,
+		expectedArch:    b.expectedArch,
+	}
+	return
+}
+
+// createHTTPClient creates the HTTP client that will be used to download the bundle, configured
+// with the proxy and the trusted CA certificates.
+func (b *BundleExtractorBuilder) createHTTPClient() (result *http.Client, err error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if b.proxy != "" {
+		_, err = url.Parse(b.proxy)
+		if err != nil {
+			err = fmt.Errorf("proxy URL '%s' isn't valid: %w", b.proxy, err)
+			return
+		}
+		config := &httpproxy.Config{
+			HTTPProxy:  b.proxy,
+			HTTPSProxy: b.proxy,
+			NoProxy:    b.noProxy,
+		}
+		proxy := config.ProxyFunc()
+		transport.Proxy = func(request *http.Request) (*url.URL, error) {
+			return proxy(request.URL)
+		}
+	}
+	if b.caFile != "" {
+		var pool *x509.CertPool
+		pool, err = x509.SystemCertPool()
+		if err != nil {
+			b.logger.Error(err, "Failed to load system CA certificates, will ignore them")
+			pool = x509.NewCertPool()
+		}
+		var data []byte
+		data, err = os.ReadFile(b.caFile)
+		if err != nil {
+			return
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			err = fmt.Errorf("CA file '%s' doesn't contain any PEM certificate", b.caFile)
+			return
+		}
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs: pool,
+		}
+	}
+	result = &http.Client{
+		Transport: transport,
+	}
+	return
+}
+
+// parseBundleURL checks the bundle URL and converts it into the HTTP URL that will be used to
+// download the bundle. For 's3://' URLs it also creates the client that signs the requests.
+func (b *BundleExtractorBuilder) parseBundleURL() (result string, s3 *s3Client, err error) {
+	parsed, err := url.Parse(b.bundleURL)
+	if err != nil {
+		err = fmt.Errorf("bundle URL '%s' isn't valid: %w", b.bundleURL, err)
+		return
+	}
+	switch parsed.Scheme {
+	case "s3":
+		s3, err = newS3Client(b.s3Endpoint, b.s3Region, b.s3CredentialsDir)
+		if err != nil {
+			return
+		}
+		result, err = s3.objectURL(b.bundleURL)
+	case "http", "https":
+		result = b.bundleURL
+	default:
+		err = fmt.Errorf(
+			"bundle URL '%s' isn't valid, scheme should be 's3', 'http' or 'https'",
+			b.bundleURL,
+		)
 	}
 	return
 }
 
 func (e *BundleExtractor) Run(ctx context.Context) error {
-	// Nothing to do if the bundle directory already exists:
+	// Start watching the log level annotation of the node, so that the verbosity can be changed
+	// while we are running:
+	watcher, err := e.startLogLevelWatcher(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := watcher.Stop(ctx)
+		if err != nil {
+			e.logger.Error(err, "Failed to stop log level watcher")
+		}
+	}()
+
+	// Nothing to do if the bundle directory already exists and it contains the same bundle that
+	// we would download:
 	exists, err := e.checkBundleDir(ctx)
 	if err != nil {
 		return err
 	}
 	if exists {
+		var current bool
+		current, err = e.checkBundleCurrent(ctx)
+		if err != nil {
+			return err
+		}
+		if current {
+			e.logger.Info(
+				"Bundle directory already exists",
+				"dir", e.bundleDir,
+			)
+			return nil
+		}
 		e.logger.Info(
-			"Bundle directory already exists",
+			"Bundle directory exists but contains a different bundle, will extract "+
+				"it again",
 			"dir", e.bundleDir,
 		)
-		return nil
 	}
 
 	// Obtain and extract the bundle:
+	e.status.start(ctx, v1alpha1.NodeUpgradeExtracting)
+	e.events.normal(ctx, nodeEventExtracting, "Started extracting bundle")
 	var reader io.ReadCloser
-	reader, err = e.openBundle(ctx)
+	var info *BundleInfo
+	reader, info, err = e.openBundle(ctx)
 	if err != nil {
 		return err
 	}
@@ -190,10 +626,47 @@ func (e *BundleExtractor) Run(ctx context.Context) error {
 			e.logger.Error(err, "Failed to close bundle")
 		}
 	}()
-	err = e.extractBundle(ctx, reader)
+
+	// If we already know the metadata of the bundle then check it before starting to download
+	// it, there is no point in downloading the wrong bundle:
+	if info != nil && info.Metadata != nil {
+		err = e.checkMetadata(ctx, info.Metadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	download, _ := reader.(*bundleExtractorDownloadReader)
+	progress := &bundleExtractorProgressReader{
+		logger: e.logger,
+		client: e.client,
+		node:   e.node,
+		status: e.status,
+		reader: reader,
+		phase:  ProgressPhaseExtracting,
+	}
+	if _, streaming := reader.(*bundleExtractorResumeReader); download != nil || streaming {
+		progress.phase = ProgressPhaseDownloading
+	}
+	if info != nil {
+		progress.total = info.Size
+	}
+	err = e.extractBundle(ctx, progress, e.expectedDigest(info))
 	if err != nil {
+		// If the download was complete then there is nothing to resume, and the data is
+		// probably corrupted, so we need to discard it. Otherwise we keep it so that the next
+		// attempt can resume the download.
+		if download != nil && download.complete {
+			e.discardDownload(download)
+		}
 		return err
 	}
+	if download != nil {
+		err = e.commitDownload(download)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Write the node annotations and labels that indicate the result. The annotation containin
 	// the metadata won't contain the full list of images, only the version, architecture and
@@ -203,6 +676,8 @@ func (e *BundleExtractor) Run(ctx context.Context) error {
 		return err
 	}
 	metadata.Images = nil
+	metadata.Tags = nil
+	metadata.Roles = nil
 	err = e.writeResult(ctx, metadata)
 	if err != nil {
 		return err
@@ -211,30 +686,267 @@ func (e *BundleExtractor) Run(ctx context.Context) error {
 	return nil
 }
 
-func (e *BundleExtractor) openBundle(ctx context.Context) (reader io.ReadCloser, err error) {
-	for {
-		reader, err = e.openBundleAttempt(ctx)
+func (e *BundleExtractor) startLogLevelWatcher(ctx context.Context) (result *LogLevelWatcher,
+	err error) {
+	result, err = NewLogLevelWatcher().
+		SetLogger(e.logger).
+		SetClient(e.client).
+		SetNode(e.node).
+		Build()
+	if err != nil {
+		return
+	}
+	err = result.Start(ctx)
+	return
+}
+
+// openBundle opens the bundle file or, if it doesn't exist, downloads it from the bundle server. It
+// waits till one of them is available, trying again with increasing delays, so that it doesn't
+// matter if the extractor starts before the bundle server is ready. It also returns the size,
+// digest and metadata of the bundle, which will be nil if they aren't known.
+func (e *BundleExtractor) openBundle(ctx context.Context) (reader io.ReadCloser, info *BundleInfo,
+	err error) {
+	// Note that the deadline only applies to the wait between attempts, the attempts
+	// themselves use the original context because it will also be used for the download.
+	waitCtx := ctx
+	if e.waitTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, e.waitTimeout)
+		defer cancel()
+	}
+	err = e.retrier.Do(waitCtx, "bundle download", func(_ context.Context) error {
+		var err error
+		reader, info, err = e.openBundleAttempt(ctx)
+		if err != nil {
+			return err
+		}
+		if reader == nil {
+			return errors.New("bundle isn't available yet")
+		}
+		return nil
+	})
+	if err != nil && ctx.Err() == nil && waitCtx.Err() != nil {
+		text := fmt.Sprintf(
+			"Bundle isn't available after waiting %s",
+			e.waitTimeout,
+		)
+		e.writeError(ctx, text)
+		err = errors.New(text)
+	}
+	return
+}
+
+func (e *BundleExtractor) openBundleAttempt(ctx context.Context) (reader io.ReadCloser,
+	info *BundleInfo, err error) {
+	// If the bundle file exists, or if there is a bundle file in removable media, we only need
+	// space to extract it:
+	reader, file, err := e.openBundleFile(ctx)
+	if err != nil {
+		return
+	}
+	if reader != nil {
+		info, err = e.fileInfo(file)
+		if err == nil {
+			err = e.checkSpace(ctx, info, 0)
+		}
+		if err != nil {
+			reader.Close()
+			reader = nil
+			info = nil
+		}
+		return
+	}
+
+	// If the bundle URL has been specified then download it from there, as there are no servers:
+	if e.bundleURL != "" {
+		reader, info, err = e.downloadBundle(ctx, e.bundleURL, nil)
+		return
+	}
+
+	// Otherwise try to download it from the servers, in order:
+	urls, err := e.selectBundleURLs(ctx)
+	if err != nil {
+		return
+	}
+	for _, url := range urls {
+		reader, info, err = e.downloadBundle(ctx, url, urls)
 		if err == nil && reader != nil {
 			return
 		}
+		var stop *retrierStopError
+		if errors.As(err, &stop) {
+			return
+		}
 		if err != nil {
-			e.logger.Error(err, "Failed to open bundle, will try again later")
-		} else {
-			e.logger.Info("Bundle is not yet available, will try again later")
+			e.logger.Error(
+				err,
+				"Failed to download bundle, will try the next server",
+				"url", url,
+			)
+		}
+	}
+	return
+}
+
+// downloadBundle starts downloading the bundle from the given URL. The rest of the URLs are used
+// to continue the download if this one fails.
+func (e *BundleExtractor) downloadBundle(ctx context.Context, url string,
+	urls []string) (reader io.ReadCloser, info *BundleInfo, err error) {
+	// If we need to download the bundle then we also need space for the download file, except
+	// for the part that has already been downloaded:
+	info, err = e.fetchInfo(ctx, url)
+	if err != nil {
+		e.logger.Error(
+			err,
+			"Failed to fetch bundle information, will not check digest or disk space",
+			"url", url,
+		)
+		info = nil
+		err = nil
+	}
+	if info != nil {
+		var download int64
+		if !e.useStreaming() {
+			var offset int64
+			offset, _, err = e.checkDownload(url)
+			if err != nil {
+				return
+			}
+			download = info.Size - offset
+		}
+		err = e.checkSpace(ctx, info, download)
+		if err != nil {
+			return
 		}
-		time.Sleep(10 * time.Second)
 	}
+	reader, err = e.openBundleURL(ctx, url, urls, e.expectedDigest(info))
+	return
 }
 
-func (e *BundleExtractor) openBundleAttempt(ctx context.Context) (reader io.ReadCloser, err error) {
-	reader, err = e.openBundleFile(ctx)
-	if err != nil || reader != nil {
+// fileInfo returns the size, digest and metadata of the given bundle file.
+func (e *BundleExtractor) fileInfo(file string) (result *BundleInfo, err error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+	digest, err := readBundleDigest(file)
+	if err != nil {
+		return
+	}
+	if digest != "" {
+		digest = bundleExtractorDigestPrefix + digest
+	}
+	reader, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	metadata, err := readBundleMetadata(reader)
+	if err != nil {
 		return
 	}
-	reader, err = e.openBundleURL(ctx)
+	result = &BundleInfo{
+		Name:     filepath.Base(file),
+		Digest:   digest,
+		Size:     stat.Size(),
+		Metadata: metadata,
+	}
 	return
 }
 
+// expectedDigest returns the digest that the bundle should have, as a hex string. The digest
+// explicitly configured takes precedence over the digest of the bundle information. Returns an
+// empty string if the digest isn't known.
+func (e *BundleExtractor) expectedDigest(info *BundleInfo) string {
+	if e.digest != "" {
+		return e.digest
+	}
+	if info == nil {
+		return ""
+	}
+	return strings.TrimPrefix(info.Digest, bundleExtractorDigestPrefix)
+}
+
+// checkSpace checks that the filesystem where the bundle will be extracted has enough space for
+// the extracted files and for the given number of bytes that still need to be downloaded. If it
+// doesn't it adds the error annotation to the node, so that the problem is visible without having
+// to look at the logs, and returns an error.
+func (e *BundleExtractor) checkSpace(ctx context.Context, info *BundleInfo,
+	download int64) error {
+	// When the metadata doesn't contain the extracted size we assume that it is the size of
+	// the bundle, which is a good approximation because the bundle isn't compressed:
+	extracted := info.Size
+	if info.Metadata != nil && info.Metadata.Size > 0 {
+		extracted = info.Metadata.Size
+	}
+	if download < 0 {
+		download = 0
+	}
+	required := uint64(extracted + download + bundleExtractorSpaceReserve)
+	dir := filepath.Dir(e.absolutePath(e.bundleDir))
+	available, err := availableSpace(dir)
+	if err != nil {
+		return err
+	}
+	e.logger.Info(
+		"Checked disk space",
+		"dir", dir,
+		"available", humanize.IBytes(available),
+		"required", humanize.IBytes(required),
+		"extracted", humanize.IBytes(uint64(extracted)),
+		"download", humanize.IBytes(uint64(download)),
+	)
+	if available >= required {
+		return nil
+	}
+	text := fmt.Sprintf(
+		"Not enough disk space to extract the bundle to '%s', %s are required but "+
+			"only %s are available",
+		e.bundleDir, humanize.IBytes(required), humanize.IBytes(available),
+	)
+	e.writeError(ctx, text)
+	return StopRetrying(errors.New(text))
+}
+
+// writeError adds to the node the annotation that describes the problem that prevents the
+// extractor from completing its task.
+func (e *BundleExtractor) writeError(ctx context.Context, text string) {
+	e.status.fail(ctx, text)
+	e.events.warning(ctx, nodeEventExtractionFailed, text)
+	data, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				annotations.Error: text,
+			},
+		},
+	})
+	if err != nil {
+		e.logger.Error(err, "Failed to create error patch")
+		return
+	}
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: e.node,
+		},
+	}
+	patch := clnt.RawPatch(types.MergePatchType, data)
+	err = e.client.Patch(ctx, node, patch)
+	if err != nil {
+		e.logger.Error(
+			err,
+			"Failed to write error",
+			"node", e.node,
+			"text", text,
+		)
+		return
+	}
+	e.logger.V(1).Info(
+		"Wrote error",
+		"node", e.node,
+		"text", text,
+	)
+}
+
 func (e *BundleExtractor) checkBundleDir(ctx context.Context) (exists bool, err error) {
 	dir := e.absolutePath(e.bundleDir)
 	_, err = os.Stat(dir)
@@ -253,12 +965,265 @@ func (e *BundleExtractor) checkBundleDir(ctx context.Context) (exists bool, err
 	return
 }
 
-func (e *BundleExtractor) openBundleFile(ctx context.Context) (reader io.ReadCloser,
+// checkBundleCurrent checks if the bundle directory contains the same bundle that is available in
+// the bundle file or in the bundle server, comparing the metadata. If the metadata of the available
+// bundle can't be obtained the existing directory is considered current, so that the extractor
+// doesn't remove it unnecessarily.
+func (e *BundleExtractor) checkBundleCurrent(ctx context.Context) (result bool, err error) {
+	local, err := e.readMetadata(ctx)
+	if errors.Is(err, os.ErrNotExist) {
+		e.logger.Info(
+			"Bundle directory doesn't contain metadata",
+			"dir", e.bundleDir,
+		)
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	available, err := e.fetchAvailableMetadata(ctx)
+	if err != nil {
+		e.logger.Error(err, "Failed to get metadata of available bundle")
+		err = nil
+		result = true
+		return
+	}
+	if available == nil {
+		result = true
+		return
+	}
+	result = local.Version == available.Version &&
+		local.Arch == available.Arch &&
+		local.Release == available.Release
+	return
+}
+
+// fetchAvailableMetadata returns the metadata of the bundle file if it exists, or else the metadata
+// that the bundle server returns in the info endpoint. Returns nil if none of them is available.
+func (e *BundleExtractor) fetchAvailableMetadata(ctx context.Context) (result *Metadata,
+	err error) {
+	reader, _, err := e.openBundleFile(ctx)
+	if err != nil {
+		return
+	}
+	if reader != nil {
+		defer reader.Close()
+		result, err = readBundleMetadata(reader)
+		return
+	}
+	url := e.bundleURL
+	if url == "" {
+		var urls []string
+		urls, err = e.selectBundleURLs(ctx)
+		if err != nil || len(urls) == 0 {
+			return
+		}
+		url = urls[0]
+	}
+	info, err := e.fetchInfo(ctx, url)
+	if err != nil || info == nil {
+		return
+	}
+	result = info.Metadata
+	return
+}
+
+// mirrorValidator checks that the bundle available in the given URL has the given digest, and
+// returns the validator that should be used to request parts of it.
+func (e *BundleExtractor) mirrorValidator(ctx context.Context, url,
+	digest string) (result string, err error) {
+	info, err := e.fetchInfo(ctx, url)
+	if err != nil {
+		return
+	}
+	actual := strings.TrimPrefix(info.Digest, bundleExtractorDigestPrefix)
+	if !strings.EqualFold(actual, digest) {
+		err = fmt.Errorf(
+			"mirror has digest '%s' but expected '%s'",
+			info.Digest, bundleExtractorDigestPrefix+digest,
+		)
+		return
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return
+	}
+	e.setHeaders(request)
+	response, err := e.httpClient.Do(request)
+	if err != nil {
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf(
+			"expected status %d when checking mirror, but received %d",
+			http.StatusOK, response.StatusCode,
+		)
+		return
+	}
+	result = e.responseValidator(response)
+	if result == "" {
+		err = errors.New("mirror doesn't support resuming downloads")
+	}
+	return
+}
+
+// fetchInfo fetches the digest and metadata of the bundle available in the given URL, using the
+// info endpoint of the bundle server.
+func (e *BundleExtractor) fetchInfo(ctx context.Context, url string) (result *BundleInfo,
+	err error) {
+	if e.bundleURL != "" && url == e.bundleURL {
+		result, err = e.fetchObjectInfo(ctx, url)
+		return
+	}
+	if strings.Contains(url, bundleServerBundlesPath) {
+		url = strings.Replace(url, bundleServerBundlesPath, bundleServerInfoPath+"/", 1)
+	} else {
+		url += bundleServerInfoPath
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	request.Header.Set("Accept", "application/json")
+	e.setHeaders(request)
+	response, err := e.httpClient.Do(request)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err := response.Body.Close()
+		if err != nil {
+			e.logger.Error(
+				err,
+				"Failed to close bundle information response body",
+				"url", url,
+			)
+		}
+	}()
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf(
+			"expected status %d when fetching bundle information, but received %d",
+			http.StatusOK, response.StatusCode,
+		)
+		return
+	}
+	err = json.NewDecoder(response.Body).Decode(&result)
+	return
+}
+
+// fetchObjectInfo fetches the size, digest and metadata of the bundle available in the given URL,
+// which isn't a bundle server, so there is no info endpoint. The size is obtained with a 'HEAD'
+// request, the digest from the '.sha256' object next to the bundle, and the metadata from the first
+// entries of the bundle. Returns nil if the bundle doesn't exist yet.
+func (e *BundleExtractor) fetchObjectInfo(ctx context.Context, url string) (result *BundleInfo,
 	err error) {
-	file := e.absolutePath(e.bundleFile)
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return
+	}
+	e.setHeaders(request)
+	response, err := e.httpClient.Do(request)
+	if err != nil {
+		return
+	}
+	response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return
+	default:
+		err = fmt.Errorf(
+			"expected status %d when fetching bundle information, but received %d",
+			http.StatusOK, response.StatusCode,
+		)
+		return
+	}
+	result = &BundleInfo{
+		Name: path.Base(request.URL.Path),
+	}
+	if response.ContentLength > 0 {
+		result.Size = response.ContentLength
+	}
+	digest, err := e.fetchObject(ctx, bundleDigestFile(url), "", bundleExtractorDigestLimit)
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(string(digest))
+	if len(fields) > 0 {
+		result.Digest = bundleExtractorDigestPrefix + fields[0]
+	}
+
+	// The metadata is usually the first entry of the archive, so it is enough to read the
+	// first bytes. If it isn't there the metadata will just be missing.
+	data, err := e.fetchObject(ctx, url, "bytes=0-"+strconv.Itoa(bundleExtractorMetadataLimit-1),
+		bundleExtractorMetadataLimit)
+	if err != nil {
+		return
+	}
+	result.Metadata, err = readBundleMetadata(bytes.NewReader(data))
+	if err != nil {
+		e.logger.V(1).Info(
+			"Metadata isn't at the beginning of the bundle",
+			"url", url,
+			"error", err.Error(),
+		)
+		result.Metadata = nil
+		err = nil
+	}
+	return
+}
+
+// fetchObject reads at most the given number of bytes of the object in the given URL, optionally
+// asking only for the given range. Returns nil if the object doesn't exist.
+func (e *BundleExtractor) fetchObject(ctx context.Context, url, byteRange string,
+	limit int64) (result []byte, err error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	if byteRange != "" {
+		request.Header.Set("Range", byteRange)
+	}
+	e.setHeaders(request)
+	response, err := e.httpClient.Do(request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusNotFound:
+		return
+	default:
+		err = fmt.Errorf(
+			"expected status %d when fetching '%s', but received %d",
+			http.StatusOK, url, response.StatusCode,
+		)
+		return
+	}
+	result, err = io.ReadAll(io.LimitReader(response.Body, limit))
+	return
+}
+
+// openBundleFile opens the bundle file if it exists, or else the bundle file found in removable
+// media. Returns nil if there is no bundle file.
+func (e *BundleExtractor) openBundleFile(ctx context.Context) (reader io.ReadCloser,
+	file string, err error) {
+	file, err = e.findBundleFile(ctx)
+	if err != nil || file == "" {
+		return
+	}
 	reader, err = os.Open(file)
 	if errors.Is(err, os.ErrNotExist) {
+		// The media may have been removed after finding the file, so we need to scan
+		// again in the next attempt:
+		if file == e.mediaFile {
+			e.mediaFile = ""
+		}
 		reader = nil
+		file = ""
 		err = nil
 	}
 	if reader != nil {
@@ -270,62 +1235,316 @@ func (e *BundleExtractor) openBundleFile(ctx context.Context) (reader io.ReadClo
 	return
 }
 
-func (e *BundleExtractor) openBundleURL(ctx context.Context) (stream io.ReadCloser, err error) {
-	var url string
-	url, err = e.selectBundleURL(ctx)
-	if err != nil || url == "" {
+// findBundleFile returns the absolute path of the bundle file if it exists, or else the path of
+// the bundle file found in removable media. Returns an empty string if there is no bundle file.
+// The result of scanning the media is saved because calculating the digest is expensive.
+func (e *BundleExtractor) findBundleFile(ctx context.Context) (result string, err error) {
+	if e.bundleFile != "" {
+		file := e.absolutePath(e.bundleFile)
+		_, err = os.Stat(file)
+		if err == nil {
+			result = file
+			return
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		err = nil
+	}
+	if e.media == nil {
 		return
 	}
+	if e.mediaFile == "" {
+		e.mediaFile, err = e.media.scan(ctx)
+		if err != nil {
+			return
+		}
+	}
+	result = e.mediaFile
+	return
+}
+
+// openBundleURL downloads the bundle from the given URL. The downloaded data is saved to the
+// download file, so that if the extractor is restarted the download can continue from where it
+// stopped instead of starting again. The mirrors are other URLs that serve the same bundle, and
+// they are used to continue the download if the connection to the server fails and the digest is
+// known.
+func (e *BundleExtractor) openBundleURL(ctx context.Context, url string, mirrors []string,
+	digest string) (stream io.ReadCloser, err error) {
 	e.logger.Info(
 		"Selected bundle URL",
 		"url", url,
 	)
+
+	// Check if there is a partial download of the same URL. In streaming mode there is no
+	// download file, so the download always starts from the beginning.
+	var offset int64
+	var validator string
+	if !e.useStreaming() {
+		offset, validator, err = e.checkDownload(url)
+		if err != nil {
+			return
+		}
+	}
+
+	// Send the request, asking only for the data that we don't have yet if there is a partial
+	// download:
 	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return
 	}
 	request.Header.Set("Accept", "application/octet-stream")
-	response, err := http.DefaultClient.Do(request)
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		request.Header.Set("If-Range", validator)
+	}
+	e.setHeaders(request)
+	response, err := e.httpClient.Do(request)
 	if err != nil {
 		return
 	}
 	switch response.StatusCode {
 	case http.StatusOK:
+		if offset > 0 {
+			e.logger.Info(
+				"Bundle has changed since the partial download, will start again",
+				"url", url,
+				"offset", offset,
+			)
+		}
 		e.logger.Info(
 			"Reading bundle from URL",
 			"url", url,
+			"streaming", e.useStreaming(),
+		)
+		if e.useStreaming() {
+			stream = e.createStream(ctx, url, e.responseValidator(response),
+				response.Body, mirrors, digest)
+			break
+		}
+		stream, err = e.createDownload(ctx, url, e.responseValidator(response), 0,
+			response.Body, mirrors, digest)
+	case http.StatusPartialContent:
+		e.logger.Info(
+			"Resuming partial bundle download",
+			"url", url,
+			"offset", offset,
+		)
+		stream, err = e.createDownload(ctx, url, validator, offset, response.Body, mirrors,
+			digest)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// This happens when the partial download is already complete or when it is longer
+		// than the bundle, so we discard it and the next attempt will start again:
+		e.logger.Info(
+			"Partial bundle download can't be resumed, will discard it",
+			"url", url,
+			"offset", offset,
 		)
-		stream = response.Body
+		response.Body.Close()
+		e.removeFile(e.downloadFile())
+		e.removeFile(e.downloadStateFile())
 	default:
 		e.logger.Info(
 			"Bundle download failed",
 			"url", url,
 			"status", response.StatusCode,
 		)
+		response.Body.Close()
+	}
+	return
+}
+
+// checkDownload checks if there is a partial download of the given URL that can be resumed. If
+// there is it returns the number of bytes already downloaded and the validator that should be sent
+// in the 'If-Range' header.
+func (e *BundleExtractor) checkDownload(url string) (offset int64, validator string, err error) {
+	state, err := e.readDownloadState()
+	if err != nil || state == nil {
+		return
+	}
+	if state.URL != url || state.Validator == "" {
+		return
+	}
+	info, err := os.Stat(e.downloadFile())
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	offset = info.Size()
+	validator = state.Validator
+	return
+}
+
+// createDownload creates the reader that returns the data of the bundle, first the data that was
+// already downloaded and then the data received from the server, which is also appended to the
+// download file.
+func (e *BundleExtractor) createDownload(ctx context.Context, url, validator string, offset int64,
+	body io.ReadCloser, mirrors []string, digest string) (result *bundleExtractorDownloadReader,
+	err error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(e.downloadFile(), flags, 0600)
+	if err != nil {
+		body.Close()
+		return
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err == nil {
+		err = e.writeDownloadState(&bundleExtractorDownloadState{
+			URL:       url,
+			Validator: validator,
+		})
+	}
+	if err != nil {
+		file.Close()
+		body.Close()
+		return
+	}
+	network := &bundleExtractorResumeReader{
+		ctx:       ctx,
+		extractor: e,
+		url:       url,
+		validator: validator,
+		body:      body,
+		offset:    offset,
+		mirrors:   mirrors,
+		digest:    digest,
+	}
+	result = &bundleExtractorDownloadReader{
+		network: network,
+		file:    file,
+		reader: io.MultiReader(
+			io.NewSectionReader(file, 0, offset),
+			io.TeeReader(network, file),
+		),
+	}
+	return
+}
+
+// createStream creates the reader that returns the data of the bundle directly from the server,
+// without saving it to the download file. Any partial download left by a previous run without
+// streaming is removed, as it will not be used and it takes disk space.
+func (e *BundleExtractor) createStream(ctx context.Context, url, validator string,
+	body io.ReadCloser, mirrors []string, digest string) *bundleExtractorResumeReader {
+	e.removeFile(e.downloadFile())
+	e.removeFile(e.downloadStateFile())
+	return &bundleExtractorResumeReader{
+		ctx:       ctx,
+		extractor: e,
+		url:       url,
+		validator: validator,
+		body:      body,
+		mirrors:   mirrors,
+		digest:    digest,
+	}
+}
+
+// useStreaming returns true if the bundle should be extracted while it is downloaded, without
+// saving it to the download file. That isn't possible when replication is enabled.
+func (e *BundleExtractor) useStreaming() bool {
+	return e.streaming && !e.replicate
+}
+
+// commitDownload is called when the bundle has been successfully extracted. If replication is
+// enabled it renames the download file so that the bundle server running in this node can serve
+// it to other nodes, otherwise it removes it.
+func (e *BundleExtractor) commitDownload(download *bundleExtractorDownloadReader) error {
+	err := download.file.Close()
+	if err != nil {
+		return err
+	}
+	if !e.replicate {
+		e.discardDownload(download)
+		return nil
+	}
+	file := e.replicaFile()
+	err = os.Rename(download.file.Name(), file)
+	if err != nil {
+		return err
+	}
+	e.logger.Info(
+		"Saved bundle replica",
+		"file", file,
+	)
+	e.removeFile(e.downloadStateFile())
+	return nil
+}
+
+// discardDownload removes the download file and its state.
+func (e *BundleExtractor) discardDownload(download *bundleExtractorDownloadReader) {
+	download.file.Close()
+	e.removeFile(download.file.Name())
+	e.removeFile(e.downloadStateFile())
+}
+
+func (e *BundleExtractor) removeFile(file string) {
+	err := os.Remove(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		e.logger.Error(
+			err,
+			"Failed to remove file",
+			"file", file,
+		)
 	}
-	return
 }
 
-func (e *BundleExtractor) selectBundleURL(ctx context.Context) (result string, err error) {
-	// Find the addresses of the servers:
-	host, port, err := net.SplitHostPort(e.serverAddr)
-	if err != nil {
+func (e *BundleExtractor) readDownloadState() (result *bundleExtractorDownloadState, err error) {
+	data, err := os.ReadFile(e.downloadStateFile())
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
 		return
 	}
-	addrs, err := net.LookupIP(host)
 	if err != nil {
 		return
 	}
-	urls := make([]string, len(addrs))
-	for i, addr := range addrs {
-		urls[i] = fmt.Sprintf("http://%s:%s", addr, port)
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		// A corrupted state file isn't a reason to fail, it only means that the download
+		// will start again:
+		e.logger.Error(
+			err,
+			"Failed to parse download state, will ignore it",
+			"file", e.downloadStateFile(),
+		)
+		result = nil
+		err = nil
+	}
+	return
+}
+
+func (e *BundleExtractor) writeDownloadState(state *bundleExtractorDownloadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(e.downloadStateFile(), data, 0600)
+}
+
+// selectBundleURLs returns the URLs where the bundle is available, in the order that they should
+// be tried.
+func (e *BundleExtractor) selectBundleURLs(ctx context.Context) (result []string, err error) {
+	// Find the URLs of the servers, preserving the order of the addresses:
+	var urls []string
+	for _, serverAddr := range e.serverAddrs {
+		urls = append(urls, e.findServerURLs(serverAddr)...)
 	}
 	e.logger.Info(
 		"Server URLs",
-		"server", e.serverAddr,
+		"servers", e.serverAddrs,
 		"urls", urls,
 	)
 
+	// If the version has been specified then replace the URLs of the servers with the URLs
+	// of the bundles that have that version:
+	if e.version != "" {
+		urls = e.findIndexURLs(ctx, urls)
+	}
+
 	// Find all the URLs that have the bundle file available:
 	var good []string
 	for _, url := range urls {
@@ -360,17 +1579,62 @@ func (e *BundleExtractor) selectBundleURL(ctx context.Context) (result string, e
 		"urls", good,
 	)
 
-	// Randomly select one of the good URLs:
-	result = good[rand.Intn(len(good))]
+	// If there is a partial download from one of the good URLs then try it first, so that the
+	// download can be resumed:
+	state, err := e.readDownloadState()
+	if err != nil {
+		return
+	}
+	if state != nil && slices.Contains(good, state.URL) {
+		result = append(result, state.URL)
+	}
+	for _, url := range good {
+		if state == nil || url != state.URL {
+			result = append(result, url)
+		}
+	}
 	return
 }
 
+// findServerURLs returns the URLs of the servers that have the given address. If the host name
+// resolves to multiple IP addresses, for example the name of a headless service, the URLs are
+// shuffled, so that the load is distributed.
+func (e *BundleExtractor) findServerURLs(serverAddr string) []string {
+	host, port, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		e.logger.Error(
+			err,
+			"Failed to parse server address",
+			"server", serverAddr,
+		)
+		return nil
+	}
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		e.logger.Error(
+			err,
+			"Failed to resolve server address",
+			"server", serverAddr,
+		)
+		return nil
+	}
+	rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	urls := make([]string, len(addrs))
+	for i, addr := range addrs {
+		urls[i] = fmt.Sprintf("http://%s", net.JoinHostPort(addr.String(), port))
+	}
+	return urls
+}
+
 func (e *BundleExtractor) checkBundleURL(ctx context.Context, url string) (ok bool, err error) {
 	request, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
 	if err != nil {
 		return
 	}
-	response, err := http.DefaultClient.Do(request)
+	e.setHeaders(request)
+	response, err := e.httpClient.Do(request)
 	if err != nil {
 		return
 	}
@@ -395,7 +1659,117 @@ func (e *BundleExtractor) checkBundleURL(ctx context.Context, url string) (ok bo
 	return
 }
 
-func (e *BundleExtractor) extractBundle(ctx context.Context, reader io.ReadCloser) error {
+// findIndexURLs reads the index of each of the given servers and returns the URLs of the bundles
+// that have the version and architecture of the extractor.
+func (e *BundleExtractor) findIndexURLs(ctx context.Context, urls []string) []string {
+	var results []string
+	for _, url := range urls {
+		index, err := e.fetchIndex(ctx, url)
+		if err != nil {
+			e.logger.Error(
+				err,
+				"Failed to fetch bundle index",
+				"url", url,
+			)
+			continue
+		}
+		var found bool
+		for _, entry := range index.Bundles {
+			if entry.Version != e.version {
+				continue
+			}
+			if e.arch != "" && entry.Arch != e.arch {
+				continue
+			}
+			results = append(results, url+bundleServerBundlesPath+entry.Name)
+			found = true
+			break
+		}
+		if !found {
+			e.logger.Info(
+				"Bundle isn't in the index",
+				"url", url,
+				"version", e.version,
+				"arch", e.arch,
+			)
+		}
+	}
+	return results
+}
+
+func (e *BundleExtractor) fetchIndex(ctx context.Context, url string) (result *BundleIndex,
+	err error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url+bundleServerIndexPath,
+		nil)
+	if err != nil {
+		return
+	}
+	request.Header.Set("Accept", "application/json")
+	e.setHeaders(request)
+	response, err := e.httpClient.Do(request)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err := response.Body.Close()
+		if err != nil {
+			e.logger.Error(
+				err,
+				"Failed to close bundle index response body",
+				"url", url,
+			)
+		}
+	}()
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf(
+			"expected status %d when fetching bundle index, but received %d",
+			http.StatusOK, response.StatusCode,
+		)
+		return
+	}
+	err = json.NewDecoder(response.Body).Decode(&result)
+	return
+}
+
+// responseValidator returns the value that should be used in the 'If-Range' header when resuming
+// the download of the given response. That is the entity tag if it is strong, or else the last
+// modification time. Returns an empty string if the response contains none of them.
+func (e *BundleExtractor) responseValidator(response *http.Response) string {
+	etag := response.Header.Get("ETag")
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return response.Header.Get("Last-Modified")
+}
+
+// setHeaders adds to the given request the name of the node, so that the bundle server can
+// report per node metrics, and the bearer token, if configured. Requests for the bundle URL don't
+// go to the bundle server, so they don't get those headers, and are instead signed when the bundle
+// is in an S3 compatible object store.
+func (e *BundleExtractor) setHeaders(request *http.Request) {
+	if e.bundleURL != "" {
+		if e.s3 != nil && e.s3.matches(request.URL) {
+			err := e.s3.sign(request, time.Now())
+			if err != nil {
+				e.logger.Error(
+					err,
+					"Failed to sign request",
+					"url", request.URL.String(),
+				)
+			}
+		}
+		return
+	}
+	request.Header.Set(bundleServerNodeHeader, e.node)
+	if e.token != "" {
+		request.Header.Set("Authorization", "Bearer "+e.token)
+	}
+}
+
+// extractBundle extracts the bundle to the bundle directory. If the digest isn't empty the data
+// read is checked against it, and the bundle directory is only replaced if they match.
+func (e *BundleExtractor) extractBundle(ctx context.Context, reader io.Reader,
+	digest string) error {
 	// Clean the bundle directory:
 	dir := e.absolutePath(e.bundleDir)
 	err := os.RemoveAll(dir)
@@ -422,42 +1796,60 @@ func (e *BundleExtractor) extractBundle(ctx context.Context, reader io.ReadClose
 		"dir", tmp,
 	)
 
-	// Wrap the reader so that we can report the progress:
-	reader = &bundleExtractorProgressReader{
+	// Wrap the reader so that we can calculate the digest:
+	hash := sha256.New()
+	hashed := io.TeeReader(reader, hash)
+
+	// Expand the bundle to the temporary directory:
+	e.logger.Info(
+		"Starting bundle extraction",
+		"dir", tmp,
+	)
+	extractor := &tarExtractor{
 		logger: e.logger,
-		client: e.client,
-		node:   e.node,
-		reader: reader,
+		dir:    tmp,
+	}
+	checked := false
+	if e.expectedVersion != "" || e.expectedArch != "" {
+		// The metadata is usually the first entry of the archive, so this stops the
+		// extraction almost immediately if the bundle isn't the expected one:
+		extractor.check = func(name, file string) error {
+			if name != "metadata.json" {
+				return nil
+			}
+			checked = true
+			return e.checkMetadataFile(ctx, file)
+		}
+	}
+	err = extractor.extract(ctx, hashed)
+	if err == nil && extractor.check != nil && !checked {
+		err = errors.New(
+			"bundle doesn't contain metadata, can't check the version and architecture",
+		)
 	}
-
-	// Execute the tar command to expand the bundle to the temporary directory:
-	path, err := exec.LookPath("tar")
 	if err != nil {
+		removeErr := os.RemoveAll(tmp)
+		if removeErr != nil {
+			e.logger.Error(
+				removeErr,
+				"Failed to remove temporary directory",
+				"dir", tmp,
+			)
+		}
 		return err
 	}
-	stdout := os.Stdout
-	stderr := os.Stderr
-	cmd := &exec.Cmd{
-		Path: path,
-		Args: []string{
-			"tar",
-			"--extract",
-			"--file=-",
-		},
-		Dir:    tmp,
-		Stdin:  reader,
-		Stdout: stdout,
-		Stderr: stderr,
-	}
-	e.logger.Info(
-		"Starting bundle extraction",
-		"args", cmd.Args,
-	)
-	err = cmd.Run()
 	e.logger.Info(
 		"Finished bundle extraction",
-		"args", cmd.Args,
+		"dir", tmp,
 	)
+
+	// The tar reader doesn't read the padding at the end of the archive, so we need to read the
+	// rest of the data to calculate the digest:
+	_, err = io.Copy(io.Discard, hashed)
+	if err != nil {
+		return err
+	}
+	err = e.checkDigest(tmp, digest, hex.EncodeToString(hash.Sum(nil)))
 	if err != nil {
 		return err
 	}
@@ -468,6 +1860,10 @@ func (e *BundleExtractor) extractBundle(ctx context.Context, reader io.ReadClose
 	if err != nil {
 		return err
 	}
+	err = syncDir(filepath.Dir(dir))
+	if err != nil {
+		return err
+	}
 	e.logger.Info(
 		"Renamed temporary directory",
 		"from", tmp,
@@ -481,6 +1877,96 @@ func (e *BundleExtractor) extractBundle(ctx context.Context, reader io.ReadClose
 	return nil
 }
 
+// checkMetadataFile reads the metadata file extracted from the bundle and checks that it contains
+// the expected version and architecture.
+func (e *BundleExtractor) checkMetadataFile(ctx context.Context, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var metadata *Metadata
+	err = json.Unmarshal(data, &metadata)
+	if err != nil {
+		return err
+	}
+	return e.checkMetadata(ctx, metadata)
+}
+
+// checkMetadata checks that the version and architecture of the bundle are the ones that the
+// cluster expects. If they aren't it writes the error annotation to the node and returns an error.
+func (e *BundleExtractor) checkMetadata(ctx context.Context, metadata *Metadata) error {
+	var problems []string
+	if e.expectedVersion != "" && metadata.Version != e.expectedVersion {
+		problems = append(problems, fmt.Sprintf(
+			"version is '%s' but the cluster expects '%s'",
+			metadata.Version, e.expectedVersion,
+		))
+	}
+	if e.expectedArch != "" && metadata.Arch != e.expectedArch &&
+		distributionOSArchs[metadata.Arch] != e.expectedArch {
+		problems = append(problems, fmt.Sprintf(
+			"architecture is '%s' but the cluster expects '%s'",
+			metadata.Arch, e.expectedArch,
+		))
+	}
+	if len(problems) == 0 {
+		e.logger.V(1).Info(
+			"Verified bundle version and architecture",
+			"version", metadata.Version,
+			"arch", metadata.Arch,
+		)
+		return nil
+	}
+	text := fmt.Sprintf("Wrong bundle, %s", strings.Join(problems, " and "))
+	e.writeError(ctx, text)
+	return errors.New(text)
+}
+
+// checkDigest compares the expected digest of the bundle with the actual digest of the data that
+// was read. If they don't match the temporary directory is removed and an error is returned. If the
+// expected digest is empty the verification is skipped.
+func (e *BundleExtractor) checkDigest(tmp, expected, actual string) error {
+	if expected == "" {
+		e.logger.Info(
+			"Expected bundle digest isn't available, will not verify it",
+			"actual", actual,
+		)
+		return nil
+	}
+	if !strings.EqualFold(expected, actual) {
+		err := os.RemoveAll(tmp)
+		if err != nil {
+			e.logger.Error(
+				err,
+				"Failed to remove temporary directory",
+				"dir", tmp,
+			)
+		}
+		return fmt.Errorf(
+			"digest of bundle is '%s%s' but expected '%s%s', the bundle is corrupted",
+			bundleExtractorDigestPrefix, actual,
+			bundleExtractorDigestPrefix, expected,
+		)
+	}
+	e.logger.Info(
+		"Verified bundle digest",
+		"digest", actual,
+	)
+	return nil
+}
+
+func (e *BundleExtractor) replicaFile() string {
+	return fmt.Sprintf("%s.tar", e.absolutePath(e.bundleDir))
+}
+
+func (e *BundleExtractor) downloadFile() string {
+	return fmt.Sprintf("%s.part", e.replicaFile())
+}
+
+func (e *BundleExtractor) downloadStateFile() string {
+	return fmt.Sprintf("%s.json", e.downloadFile())
+}
+
 func (c *BundleExtractor) readMetadata(ctx context.Context) (result *Metadata, err error) {
 	dir := c.absolutePath(c.bundleDir)
 	file := filepath.Join(dir, "metadata.json")
@@ -525,6 +2011,7 @@ func (c *BundleExtractor) writeResult(ctx context.Context, metadata *Metadata) e
 		nodeUpdate.Annotations = map[string]string{}
 	}
 	nodeUpdate.Annotations[annotations.BundleMetadata] = metadataText
+	delete(nodeUpdate.Annotations, annotations.Error)
 	if nodeUpdate.Labels == nil {
 		nodeUpdate.Labels = map[string]string{}
 	}
@@ -539,6 +2026,8 @@ func (c *BundleExtractor) writeResult(ctx context.Context, metadata *Metadata) e
 		"node", c.node,
 		"metadata", metadataText,
 	)
+	c.status.succeed(ctx, v1alpha1.NodeUpgradeExtracted)
+	c.events.normal(ctx, nodeEventExtracted, "Finished extracting bundle")
 	return nil
 }
 
@@ -550,29 +2039,231 @@ func (c *BundleExtractor) absolutePath(relPath string) string {
 	return absPath
 }
 
+// bundleExtractorDownloadState is saved next to the download file, so that the download can be
+// resumed if the extractor is restarted.
+type bundleExtractorDownloadState struct {
+	URL       string `json:"url"`
+	Validator string `json:"validator"`
+}
+
+// bundleExtractorDownloadReader returns the data of the bundle that was already saved to the
+// download file, followed by the data received from the bundle server, which is also appended to
+// the download file.
+type bundleExtractorDownloadReader struct {
+	network  io.ReadCloser
+	file     *os.File
+	reader   io.Reader
+	complete bool
+}
+
+func (r *bundleExtractorDownloadReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	if err == io.EOF {
+		r.complete = true
+	}
+	return
+}
+
+func (r *bundleExtractorDownloadReader) Close() error {
+	// Closing the file twice returns an error, but that is harmless because it only happens
+	// after the download has been committed or discarded.
+	r.file.Close()
+	return r.network.Close()
+}
+
+// bundleExtractorResumeReader reads the bundle from the body of the response sent by the bundle
+// server. When the connection fails it sends a new request with a 'Range' header, so that the
+// download continues from the last received byte instead of starting again. If the server doesn't
+// respond it tries the mirrors, which are other servers that have the same bundle.
+type bundleExtractorResumeReader struct {
+	ctx       context.Context
+	extractor *BundleExtractor
+	url       string
+	validator string
+	body      io.ReadCloser
+	offset    int64
+	mirrors   []string
+	digest    string
+}
+
+func (r *bundleExtractorResumeReader) Read(p []byte) (n int, err error) {
+	n, err = r.body.Read(p)
+	r.offset += int64(n)
+	if err == nil || errors.Is(err, io.EOF) {
+		return
+	}
+	if r.validator == "" || r.ctx.Err() != nil {
+		return
+	}
+	r.extractor.logger.Error(
+		err,
+		"Bundle download was interrupted, will try to resume it",
+		"url", r.url,
+		"offset", r.offset,
+	)
+	err = r.resume()
+	return
+}
+
+func (r *bundleExtractorResumeReader) Close() error {
+	return r.body.Close()
+}
+
+// resume closes the current response body and replaces it with the body of a new response that
+// starts at the current offset, either from the same server or from one of the mirrors.
+func (r *bundleExtractorResumeReader) resume() error {
+	// The body is already broken, so errors closing it aren't relevant:
+	r.body.Close()
+	attempt := 1
+	for {
+		var err error
+		for _, url := range r.candidates() {
+			err = r.resumeFrom(url)
+			if err == nil {
+				return nil
+			}
+			r.extractor.logger.Error(
+				err,
+				"Failed to resume bundle download",
+				"url", url,
+				"offset", r.offset,
+				"attempt", attempt,
+			)
+		}
+		if attempt >= bundleExtractorResumeAttempts {
+			return err
+		}
+		r.extractor.logger.Info(
+			"Will try to resume bundle download again later",
+			"offset", r.offset,
+			"attempt", attempt,
+		)
+		select {
+		case <-time.After(bundleExtractorResumeDelay):
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+		attempt++
+	}
+}
+
+// candidates returns the URLs that can be used to resume the download: the current one first and
+// then the mirrors. Mirrors can only be used if the digest is known, because that is the only way
+// to check that they have the same bundle.
+func (r *bundleExtractorResumeReader) candidates() []string {
+	result := []string{r.url}
+	if r.digest == "" {
+		return result
+	}
+	for _, mirror := range r.mirrors {
+		if mirror != r.url {
+			result = append(result, mirror)
+		}
+	}
+	return result
+}
+
+// resumeFrom resumes the download from the given URL. If it is a mirror it first checks that it has
+// the same bundle, and then it becomes the current URL.
+func (r *bundleExtractorResumeReader) resumeFrom(url string) error {
+	validator := r.validator
+	if url != r.url {
+		var err error
+		validator, err = r.extractor.mirrorValidator(r.ctx, url, r.digest)
+		if err != nil {
+			return err
+		}
+	}
+	err := r.resumeAttempt(url, validator)
+	if err != nil {
+		return err
+	}
+	if url == r.url {
+		return nil
+	}
+	r.extractor.logger.Info(
+		"Switched bundle download to mirror",
+		"from", r.url,
+		"to", url,
+	)
+	r.url = url
+	r.validator = validator
+	err = r.extractor.writeDownloadState(&bundleExtractorDownloadState{
+		URL:       url,
+		Validator: validator,
+	})
+	if err != nil {
+		r.extractor.logger.Error(
+			err,
+			"Failed to write download state",
+			"url", url,
+		)
+	}
+	return nil
+}
+
+func (r *bundleExtractorResumeReader) resumeAttempt(url, validator string) error {
+	request, err := http.NewRequestWithContext(r.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/octet-stream")
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+	request.Header.Set("If-Range", validator)
+	r.extractor.setHeaders(request)
+	response, err := r.extractor.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusPartialContent {
+		response.Body.Close()
+		return fmt.Errorf(
+			"expected status %d when resuming bundle download, but received %d",
+			http.StatusPartialContent, response.StatusCode,
+		)
+	}
+	r.body = response.Body
+	r.extractor.logger.Info(
+		"Resumed bundle download",
+		"url", url,
+		"offset", r.offset,
+	)
+	return nil
+}
+
+// bundleExtractorProgressReader reports the progress of the download and extraction of the bundle,
+// updating the progress annotations of the node. To avoid overloading the API server the
+// annotations are updated only at the start, at the end and at most once every few seconds.
 type bundleExtractorProgressReader struct {
-	logger logr.Logger
-	client clnt.Client
-	node   string
-	reader io.ReadCloser
-	last   time.Time
-	total  uint64
+	logger  logr.Logger
+	client  clnt.Client
+	node    string
+	status  *nodeStatusWriter
+	reader  io.ReadCloser
+	phase   string
+	total   int64
+	bytes   int64
+	started bool
+	last    time.Time
 }
 
 func (r *bundleExtractorProgressReader) Read(p []byte) (n int, err error) {
-	if r.total == 0 {
-		r.report("Extraction started")
+	if !r.started {
+		r.started = true
+		r.report()
 	}
 	n, err = r.reader.Read(p)
+	r.bytes += int64(n)
 	switch {
 	case err == io.EOF:
-		r.report("Extraction finished")
+		r.phase = ProgressPhaseFinished
+		r.report()
 	case err != nil:
-		r.report("Extraction failed")
+		r.phase = ProgressPhaseFailed
+		r.report()
 	default:
-		r.total += uint64(n)
-		if time.Since(r.last) > time.Minute {
-			r.report("Extracted %s", humanize.IBytes(r.total))
+		if time.Since(r.last) > bundleExtractorProgressInterval {
+			r.report()
 		}
 	}
 	return
@@ -582,15 +2273,67 @@ func (r *bundleExtractorProgressReader) Close() error {
 	return r.reader.Close()
 }
 
-func (r *bundleExtractorProgressReader) report(format string, args ...any) {
-	// Render the progress message text:
-	text := fmt.Sprintf(format, args...)
+// details returns the machine readable description of the progress.
+func (r *bundleExtractorProgressReader) details() *ProgressDetails {
+	result := &ProgressDetails{
+		Phase: r.phase,
+		Bytes: r.bytes,
+		Total: r.total,
+	}
+	if r.total > 0 {
+		result.Percent = int(r.bytes * 100 / r.total)
+		if result.Percent > 100 {
+			result.Percent = 100
+		}
+	}
+	return result
+}
+
+// text returns the human readable description of the progress.
+func (r *bundleExtractorProgressReader) text(details *ProgressDetails) string {
+	var action string
+	switch details.Phase {
+	case ProgressPhaseDownloading:
+		action = "Downloading and extracting bundle"
+	case ProgressPhaseExtracting:
+		action = "Extracting bundle"
+	case ProgressPhaseFinished:
+		return fmt.Sprintf("Extraction finished, %s", humanize.IBytes(uint64(details.Bytes)))
+	case ProgressPhaseFailed:
+		return fmt.Sprintf(
+			"Extraction failed after %s",
+			humanize.IBytes(uint64(details.Bytes)),
+		)
+	}
+	if details.Total == 0 {
+		return fmt.Sprintf("%s, %s", action, humanize.IBytes(uint64(details.Bytes)))
+	}
+	return fmt.Sprintf(
+		"%s, %s of %s (%d%%)",
+		action,
+		humanize.IBytes(uint64(details.Bytes)),
+		humanize.IBytes(uint64(details.Total)),
+		details.Percent,
+	)
+}
+
+func (r *bundleExtractorProgressReader) report() {
+	// Render the progress:
+	details := r.details()
+	text := r.text(details)
+	r.status.progress(context.Background(), text, details.Percent)
+	detailsData, err := json.Marshal(details)
+	if err != nil {
+		r.logger.Error(err, "Failed to render progress details")
+		return
+	}
 
-	// Create a patch to add the annotation containing the rendered message:
+	// Create a patch to add the annotations containing the rendered progress:
 	data, err := json.Marshal(map[string]any{
 		"metadata": map[string]any{
 			"annotations": map[string]string{
-				annotations.Progress: text,
+				annotations.Progress:        text,
+				annotations.ProgressDetails: string(detailsData),
 			},
 		},
 	})
@@ -630,3 +2373,38 @@ func (r *bundleExtractorProgressReader) report(format string, args ...any) {
 	// Update the last report time:
 	r.last = time.Now()
 }
+
+const (
+	bundleExtractorResumeAttempts = 10
+	bundleExtractorResumeDelay    = 10 * time.Second
+	bundleExtractorDigestPrefix   = "sha256:"
+
+	// bundleExtractorSpaceReserve is the disk space that should remain available after
+	// extracting the bundle, so that the node doesn't run out of space.
+	bundleExtractorSpaceReserve = 1 << 30
+
+	// bundleExtractorProgressInterval is the minimum time between updates of the progress
+	// annotations.
+	bundleExtractorProgressInterval = 10 * time.Second
+
+	// bundleExtractorDigestLimit and bundleExtractorMetadataLimit are the maximum number of
+	// bytes read from the digest object and from the beginning of the bundle when the bundle is
+	// downloaded from an URL that isn't a bundle server.
+	bundleExtractorDigestLimit   = 1 << 10
+	bundleExtractorMetadataLimit = 1 << 20
+)
+
+// bundleExtractorPermissions are the permissions that the extractor needs to read and update the
+// annotations and labels of the node, and to report the progress.
+var bundleExtractorPermissions = rbacPermissions{
+	cluster: append(
+		[]rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"nodes"},
+			Verbs:     []string{"get", "patch"},
+		}},
+		nodeEventRules...,
+	),
+	namespace:  nodeStatusRules,
+	privileged: true,
+}
@@ -0,0 +1,1184 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Bundle extractor", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		tmp    string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create a temporary directory:
+		tmp, err = os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+	})
+
+	Describe("Resume", func() {
+		var (
+			server   *httptest.Server
+			requests []string
+		)
+
+		BeforeEach(func() {
+			// Create the bundle file and a server that serves it:
+			err := os.WriteFile(
+				filepath.Join(tmp, "bundle.tar"),
+				[]byte("0123456789"),
+				0600,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			bundleServer, err := NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetListenAddr(":0").
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			handler := bundleServer.makeHandler()
+			requests = nil
+			server = httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					requests = append(requests, r.Header.Get("Range"))
+					handler.ServeHTTP(w, r)
+				},
+			))
+			DeferCleanup(server.Close)
+		})
+
+		It("Resumes from the last received byte", func() {
+			// Get the validator from a real response:
+			response, err := http.Head(server.URL)
+			Expect(err).ToNot(HaveOccurred())
+			response.Body.Close()
+			extractor := &BundleExtractor{
+				logger:     logger,
+				httpClient: http.DefaultClient,
+			}
+			validator := extractor.responseValidator(response)
+			Expect(validator).ToNot(BeEmpty())
+
+			// Simulate a connection that breaks after the first four bytes:
+			reader := &bundleExtractorResumeReader{
+				ctx:       ctx,
+				extractor: extractor,
+				url:       server.URL,
+				validator: validator,
+				body: io.NopCloser(io.MultiReader(
+					strings.NewReader("0123"),
+					&bundleExtractorBrokenReader{},
+				)),
+			}
+			data, err := io.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("0123456789"))
+			Expect(requests).To(ConsistOf("", "bytes=4-"))
+		})
+
+		It("Fails if the file has changed", func() {
+			reader := &bundleExtractorResumeReader{
+				ctx: ctx,
+				extractor: &BundleExtractor{
+					logger:     logger,
+					httpClient: http.DefaultClient,
+				},
+				url:       server.URL,
+				validator: `"junk"`,
+				body: io.NopCloser(io.MultiReader(
+					strings.NewReader("0123"),
+					&bundleExtractorBrokenReader{},
+				)),
+			}
+			err := reader.resumeAttempt(reader.url, reader.validator)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("206"))
+		})
+	})
+
+	It("Finds the bundle in the index", func() {
+		// Create a server with two bundles:
+		dir := filepath.Join(tmp, "bundles")
+		err := os.Mkdir(dir, 0700)
+		Expect(err).ToNot(HaveOccurred())
+		writeTestBundle(filepath.Join(dir, "upgrade-4.13.4-x86_64.tar"), "4.13.4")
+		writeTestBundle(filepath.Join(dir, "upgrade-4.13.5-x86_64.tar"), "4.13.5")
+		bundleServer, err := NewBundleServer().
+			SetLogger(logger).
+			SetRootDir(tmp).
+			SetBundleDir("bundles").
+			SetListenAddr(":0").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		server := httptest.NewServer(bundleServer.makeHandler())
+		DeferCleanup(server.Close)
+
+		// Check that the extractor selects the right one:
+		extractor := &BundleExtractor{
+			logger:     logger,
+			httpClient: http.DefaultClient,
+			version:    "4.13.5",
+			arch:       "x86_64",
+		}
+		urls := extractor.findIndexURLs(ctx, []string{server.URL})
+		Expect(urls).To(ConsistOf(server.URL + "/bundles/upgrade-4.13.5-x86_64.tar"))
+		extractor.version = "4.14.0"
+		urls = extractor.findIndexURLs(ctx, []string{server.URL})
+		Expect(urls).To(BeEmpty())
+	})
+
+	Describe("Check if bundle is current", func() {
+		var extractor *BundleExtractor
+
+		BeforeEach(func() {
+			// Create a server that has version 4.13.5:
+			writeTestBundle(filepath.Join(tmp, "bundle.tar"), "4.13.5")
+			bundleServer, err := NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetListenAddr(":0").
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			server := httptest.NewServer(bundleServer.makeHandler())
+			DeferCleanup(server.Close)
+
+			// Create an extractor that downloads from that server:
+			extractor = &BundleExtractor{
+				logger:      logger,
+				httpClient:  http.DefaultClient,
+				rootDir:     tmp,
+				bundleDir:   "extracted",
+				serverAddrs: []string{server.Listener.Addr().String()},
+			}
+			err = os.Mkdir(filepath.Join(tmp, "extracted"), 0700)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		writeMetadata := func(version string) {
+			data, err := json.Marshal(&Metadata{
+				Version: version,
+				Arch:    "x86_64",
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = os.WriteFile(filepath.Join(tmp, "extracted", "metadata.json"), data, 0600)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		It("Is current if the metadata matches", func() {
+			writeMetadata("4.13.5")
+			current, err := extractor.checkBundleCurrent(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(current).To(BeTrue())
+		})
+
+		It("Isn't current if the metadata doesn't match", func() {
+			writeMetadata("4.13.4")
+			current, err := extractor.checkBundleCurrent(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(current).To(BeFalse())
+		})
+
+		It("Isn't current if there is no metadata", func() {
+			current, err := extractor.checkBundleCurrent(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(current).To(BeFalse())
+		})
+	})
+
+	Describe("Resume after restart", func() {
+		var (
+			extractor *BundleExtractor
+			url       string
+			data      []byte
+			ranges    []string
+		)
+
+		BeforeEach(func() {
+			var err error
+
+			// Create the bundle file and a server that serves it, remembering the ranges
+			// requested:
+			file := filepath.Join(tmp, "bundle.tar")
+			writeTestBundle(file, "4.13.5")
+			data, err = os.ReadFile(file)
+			Expect(err).ToNot(HaveOccurred())
+			bundleServer, err := NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetListenAddr(":0").
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			handler := bundleServer.makeHandler()
+			ranges = nil
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					value := r.Header.Get("Range")
+					if value != "" {
+						ranges = append(ranges, value)
+					}
+					handler.ServeHTTP(w, r)
+				},
+			))
+			DeferCleanup(server.Close)
+			url = server.URL
+
+			// Create an extractor that downloads from that server:
+			extractor = &BundleExtractor{
+				logger:      logger,
+				httpClient:  http.DefaultClient,
+				rootDir:     tmp,
+				bundleDir:   "extracted",
+				serverAddrs: []string{server.Listener.Addr().String()},
+			}
+
+			// Simulate a previous download that was interrupted:
+			response, err := http.Head(server.URL)
+			Expect(err).ToNot(HaveOccurred())
+			response.Body.Close()
+			err = os.WriteFile(extractor.downloadFile(), data[:100], 0600)
+			Expect(err).ToNot(HaveOccurred())
+			err = extractor.writeDownloadState(&bundleExtractorDownloadState{
+				URL:       server.URL,
+				Validator: extractor.responseValidator(response),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Resumes the partial download", func() {
+			reader, err := extractor.openBundleURL(ctx, url, nil, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reader).ToNot(BeNil())
+			defer reader.Close()
+			actual, err := io.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual).To(Equal(data))
+			Expect(ranges).To(ConsistOf("bytes=100-"))
+
+			// Check that the download file is complete:
+			actual, err = os.ReadFile(extractor.downloadFile())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual).To(Equal(data))
+
+			// Check that the download file is removed when it isn't needed for replication:
+			err = extractor.commitDownload(reader.(*bundleExtractorDownloadReader))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(extractor.downloadFile()).ToNot(BeAnExistingFile())
+			Expect(extractor.downloadStateFile()).ToNot(BeAnExistingFile())
+		})
+
+		It("Starts again if the bundle has changed", func() {
+			state, err := extractor.readDownloadState()
+			Expect(err).ToNot(HaveOccurred())
+			state.Validator = `"junk"`
+			err = extractor.writeDownloadState(state)
+			Expect(err).ToNot(HaveOccurred())
+			err = os.WriteFile(extractor.downloadFile(), []byte(strings.Repeat("x", 100)), 0600)
+			Expect(err).ToNot(HaveOccurred())
+			reader, err := extractor.openBundleURL(ctx, url, nil, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reader).ToNot(BeNil())
+			defer reader.Close()
+			actual, err := io.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual).To(Equal(data))
+		})
+
+		It("Saves the replica when replication is enabled", func() {
+			extractor.replicate = true
+			reader, err := extractor.openBundleURL(ctx, url, nil, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reader).ToNot(BeNil())
+			defer reader.Close()
+			_, err = io.Copy(io.Discard, reader)
+			Expect(err).ToNot(HaveOccurred())
+			err = extractor.commitDownload(reader.(*bundleExtractorDownloadReader))
+			Expect(err).ToNot(HaveOccurred())
+			actual, err := os.ReadFile(extractor.replicaFile())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual).To(Equal(data))
+		})
+	})
+
+	Describe("Streaming", func() {
+		var (
+			extractor *BundleExtractor
+			url       string
+			data      []byte
+			ranges    []string
+		)
+
+		BeforeEach(func() {
+			var err error
+
+			// Create the bundle file and a server that serves it, remembering the ranges
+			// requested:
+			file := filepath.Join(tmp, "bundle.tar")
+			writeTestBundle(file, "4.13.5")
+			data, err = os.ReadFile(file)
+			Expect(err).ToNot(HaveOccurred())
+			bundleServer, err := NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetListenAddr(":0").
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			handler := bundleServer.makeHandler()
+			ranges = nil
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					value := r.Header.Get("Range")
+					if value != "" {
+						ranges = append(ranges, value)
+					}
+					handler.ServeHTTP(w, r)
+				},
+			))
+			DeferCleanup(server.Close)
+			url = server.URL
+
+			// Create an extractor that downloads from that server in streaming mode:
+			extractor = &BundleExtractor{
+				logger:      logger,
+				httpClient:  http.DefaultClient,
+				rootDir:     tmp,
+				bundleDir:   "extracted",
+				serverAddrs: []string{server.Listener.Addr().String()},
+				streaming:   true,
+			}
+		})
+
+		It("Doesn't save the download file", func() {
+			reader, err := extractor.openBundleURL(ctx, url, nil, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reader).ToNot(BeNil())
+			defer reader.Close()
+			actual, err := io.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual).To(Equal(data))
+			Expect(extractor.downloadFile()).ToNot(BeAnExistingFile())
+			Expect(extractor.downloadStateFile()).ToNot(BeAnExistingFile())
+		})
+
+		It("Discards the partial download of a previous run", func() {
+			err := os.WriteFile(extractor.downloadFile(), data[:100], 0600)
+			Expect(err).ToNot(HaveOccurred())
+			err = extractor.writeDownloadState(&bundleExtractorDownloadState{
+				URL:       url,
+				Validator: `"junk"`,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			reader, err := extractor.openBundleURL(ctx, url, nil, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reader).ToNot(BeNil())
+			defer reader.Close()
+			actual, err := io.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual).To(Equal(data))
+			Expect(ranges).To(BeEmpty())
+			Expect(extractor.downloadFile()).ToNot(BeAnExistingFile())
+		})
+
+		It("Saves the download file when replication is enabled", func() {
+			extractor.replicate = true
+			reader, err := extractor.openBundleURL(ctx, url, nil, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reader).ToNot(BeNil())
+			defer reader.Close()
+			_, err = io.Copy(io.Discard, reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(extractor.downloadFile()).To(BeARegularFile())
+		})
+	})
+
+	Describe("Multiple servers", func() {
+		var (
+			data []byte
+			urls []string
+		)
+
+		BeforeEach(func() {
+			// Create two servers that serve the same bundle from different files, so that
+			// they have the same digest but different validators:
+			urls = nil
+			for _, name := range []string{"first", "second"} {
+				dir := filepath.Join(tmp, name)
+				err := os.Mkdir(dir, 0700)
+				Expect(err).ToNot(HaveOccurred())
+				writeTestBundle(filepath.Join(dir, "bundle.tar"), "4.13.5")
+				data, err = os.ReadFile(filepath.Join(dir, "bundle.tar"))
+				Expect(err).ToNot(HaveOccurred())
+				bundleServer, err := NewBundleServer().
+					SetLogger(logger).
+					SetRootDir(dir).
+					SetBundleFile("bundle.tar").
+					SetListenAddr(":0").
+					Build()
+				Expect(err).ToNot(HaveOccurred())
+				server := httptest.NewServer(bundleServer.makeHandler())
+				DeferCleanup(server.Close)
+				urls = append(urls, server.URL)
+			}
+		})
+
+		It("Accepts a comma separated list of servers", func() {
+			extractor, err := NewBundleExtractor().
+				SetLogger(logger).
+				SetClient(fake.NewClientBuilder().Build()).
+				SetNode("my-node").
+				SetBundleFile("bundle.tar").
+				SetBundleDir("extracted").
+				SetServerAddr("first:8080, second:8080").
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(extractor.serverAddrs).To(Equal([]string{
+				"first:8080",
+				"second:8080",
+			}))
+		})
+
+		It("Rejects servers without port", func() {
+			_, err := NewBundleExtractor().
+				SetLogger(logger).
+				SetClient(fake.NewClientBuilder().Build()).
+				SetNode("my-node").
+				SetBundleFile("bundle.tar").
+				SetBundleDir("extracted").
+				SetServerAddr("first:8080,second").
+				Build()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("second"))
+		})
+
+		It("Tries the servers in order", func() {
+			extractor := &BundleExtractor{
+				logger:     logger,
+				httpClient: http.DefaultClient,
+				rootDir:    tmp,
+				bundleDir:  "extracted",
+				serverAddrs: []string{
+					strings.TrimPrefix(urls[1], "http://"),
+					strings.TrimPrefix(urls[0], "http://"),
+				},
+			}
+			selected, err := extractor.selectBundleURLs(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(selected).To(Equal([]string{urls[1], urls[0]}))
+		})
+
+		It("Continues the download from a mirror", func() {
+			// Get the validator and digest from the first server:
+			extractor := &BundleExtractor{
+				logger:     logger,
+				httpClient: http.DefaultClient,
+				rootDir:    tmp,
+				bundleDir:  "extracted",
+			}
+			response, err := http.Head(urls[0])
+			Expect(err).ToNot(HaveOccurred())
+			response.Body.Close()
+			info, err := extractor.fetchInfo(ctx, urls[0])
+			Expect(err).ToNot(HaveOccurred())
+
+			// Simulate a connection to the first server that breaks after the first four
+			// bytes, and a first server that isn't available any more:
+			reader := &bundleExtractorResumeReader{
+				ctx:       ctx,
+				extractor: extractor,
+				url:       "http://127.0.0.1:1",
+				validator: extractor.responseValidator(response),
+				body: io.NopCloser(io.MultiReader(
+					bytes.NewReader(data[:4]),
+					&bundleExtractorBrokenReader{},
+				)),
+				mirrors: urls[1:],
+				digest:  strings.TrimPrefix(info.Digest, "sha256:"),
+			}
+			actual, err := io.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual).To(Equal(data))
+			Expect(reader.url).To(Equal(urls[1]))
+		})
+
+		It("Doesn't use mirrors if the digest isn't known", func() {
+			reader := &bundleExtractorResumeReader{
+				ctx: ctx,
+				extractor: &BundleExtractor{
+					logger:     logger,
+					httpClient: http.DefaultClient,
+				},
+				url:     "http://127.0.0.1:1",
+				mirrors: urls,
+			}
+			Expect(reader.candidates()).To(ConsistOf("http://127.0.0.1:1"))
+		})
+	})
+
+	Describe("Wait for bundle", func() {
+		var (
+			client clnt.Client
+			addr   string
+			ready  bool
+		)
+
+		BeforeEach(func() {
+			// Create a server that isn't ready till the test says so:
+			writeTestBundle(filepath.Join(tmp, "bundle.tar"), "4.13.5")
+			bundleServer, err := NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetListenAddr(":0").
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			handler := bundleServer.makeHandler()
+			ready = false
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					if !ready {
+						ready = true
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					handler.ServeHTTP(w, r)
+				},
+			))
+			DeferCleanup(server.Close)
+			addr = server.Listener.Addr().String()
+
+			// Create the client:
+			client = fake.NewClientBuilder().
+				WithObjects(&corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: "my-node",
+					},
+				}).
+				Build()
+		})
+
+		It("Waits till the server is ready", func() {
+			extractor, err := NewBundleExtractor().
+				SetLogger(logger).
+				SetClient(client).
+				SetNode("my-node").
+				SetRootDir(tmp).
+				SetBundleFile("missing.tar").
+				SetBundleDir("extracted").
+				SetServerAddr(addr).
+				SetRetryDelay(10 * time.Millisecond).
+				SetMaxRetryDelay(10 * time.Millisecond).
+				SetWaitTimeout(10 * time.Second).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			reader, info, err := extractor.openBundle(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reader).ToNot(BeNil())
+			reader.Close()
+			Expect(info).ToNot(BeNil())
+			Expect(info.Metadata.Version).To(Equal("4.13.5"))
+		})
+
+		It("Fails when the wait timeout expires", func() {
+			extractor, err := NewBundleExtractor().
+				SetLogger(logger).
+				SetClient(client).
+				SetNode("my-node").
+				SetRootDir(tmp).
+				SetBundleFile("missing.tar").
+				SetBundleDir("extracted").
+				SetServerAddr("127.0.0.1:1").
+				SetRetryDelay(10 * time.Millisecond).
+				SetMaxRetryDelay(10 * time.Millisecond).
+				SetWaitTimeout(100 * time.Millisecond).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			_, _, err = extractor.openBundle(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("isn't available"))
+			node := &corev1.Node{}
+			err = client.Get(ctx, clnt.ObjectKey{Name: "my-node"}, node)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(node.Annotations).To(HaveKey(annotations.Error))
+		})
+
+		It("Rejects negative wait timeout", func() {
+			_, err := NewBundleExtractor().
+				SetLogger(logger).
+				SetClient(client).
+				SetNode("my-node").
+				SetBundleFile("bundle.tar").
+				SetBundleDir("extracted").
+				SetServerAddr(addr).
+				SetWaitTimeout(-time.Second).
+				Build()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("wait timeout"))
+		})
+	})
+
+	Describe("Check disk space", func() {
+		var (
+			client    clnt.Client
+			extractor *BundleExtractor
+		)
+
+		BeforeEach(func() {
+			client = fake.NewClientBuilder().
+				WithObjects(&corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: "my-node",
+					},
+				}).
+				Build()
+			extractor = &BundleExtractor{
+				logger:     logger,
+				httpClient: http.DefaultClient,
+				client:     client,
+				node:       "my-node",
+				rootDir:    tmp,
+				bundleDir:  "var/lib/upgrade",
+			}
+		})
+
+		It("Succeeds if there is enough space", func() {
+			info := &BundleInfo{
+				Size: 1024,
+			}
+			err := extractor.checkSpace(ctx, info, info.Size)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Fails and writes the error annotation if there isn't enough space", func() {
+			info := &BundleInfo{
+				Size: 1024,
+				Metadata: &Metadata{
+					Size: 1 << 60,
+				},
+			}
+			err := extractor.checkSpace(ctx, info, info.Size)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Not enough disk space"))
+			node := &corev1.Node{}
+			err = client.Get(ctx, clnt.ObjectKey{Name: "my-node"}, node)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(node.Annotations).To(HaveKeyWithValue(
+				annotations.Error,
+				ContainSubstring("Not enough disk space"),
+			))
+		})
+	})
+
+	Describe("Report progress", func() {
+		var client clnt.Client
+
+		BeforeEach(func() {
+			client = fake.NewClientBuilder().
+				WithObjects(&corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: "my-node",
+					},
+				}).
+				Build()
+		})
+
+		readDetails := func() *ProgressDetails {
+			node := &corev1.Node{}
+			err := client.Get(ctx, clnt.ObjectKey{Name: "my-node"}, node)
+			Expect(err).ToNot(HaveOccurred())
+			var result *ProgressDetails
+			err = json.Unmarshal([]byte(node.Annotations[annotations.ProgressDetails]), &result)
+			Expect(err).ToNot(HaveOccurred())
+			return result
+		}
+
+		It("Reports bytes and percentage", func() {
+			reader := &bundleExtractorProgressReader{
+				logger: logger,
+				client: client,
+				node:   "my-node",
+				reader: io.NopCloser(strings.NewReader(strings.Repeat("x", 1024))),
+				phase:  ProgressPhaseDownloading,
+				total:  1024,
+			}
+			buffer := make([]byte, 256)
+			_, err := reader.Read(buffer)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(readDetails()).To(Equal(&ProgressDetails{
+				Phase: ProgressPhaseDownloading,
+				Total: 1024,
+			}))
+
+			// Force the next report:
+			reader.last = time.Time{}
+			_, err = reader.Read(buffer)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(readDetails()).To(Equal(&ProgressDetails{
+				Phase:   ProgressPhaseDownloading,
+				Bytes:   512,
+				Total:   1024,
+				Percent: 50,
+			}))
+
+			// Check that reports are throttled:
+			_, err = reader.Read(buffer)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(readDetails().Bytes).To(BeNumerically("==", 512))
+
+			// Check the final report:
+			_, err = io.Copy(io.Discard, reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(readDetails()).To(Equal(&ProgressDetails{
+				Phase:   ProgressPhaseFinished,
+				Bytes:   1024,
+				Total:   1024,
+				Percent: 100,
+			}))
+		})
+
+		It("Renders the text", func() {
+			reader := &bundleExtractorProgressReader{}
+			Expect(reader.text(&ProgressDetails{
+				Phase:   ProgressPhaseExtracting,
+				Bytes:   512 * 1024 * 1024,
+				Total:   2 * 1024 * 1024 * 1024,
+				Percent: 25,
+			})).To(Equal("Extracting bundle, 512 MiB of 2.0 GiB (25%)"))
+			Expect(reader.text(&ProgressDetails{
+				Phase: ProgressPhaseDownloading,
+				Bytes: 1024,
+			})).To(Equal("Downloading and extracting bundle, 1.0 KiB"))
+		})
+	})
+
+	Describe("Download from object store", func() {
+		var (
+			data    []byte
+			digest  string
+			builder *BundleExtractorBuilder
+			headers []http.Header
+		)
+
+		BeforeEach(func() {
+			var err error
+
+			// Create the bundle and digest files:
+			store := filepath.Join(tmp, "store")
+			err = os.Mkdir(store, 0755)
+			Expect(err).ToNot(HaveOccurred())
+			file := filepath.Join(store, "bundle.tar")
+			writeTestBundle(file, "4.13.5")
+			data, err = os.ReadFile(file)
+			Expect(err).ToNot(HaveOccurred())
+			digest, err = calculateFileDigest(file)
+			Expect(err).ToNot(HaveOccurred())
+			err = os.WriteFile(bundleDigestFile(file), []byte(digest+"  bundle.tar\n"), 0600)
+			Expect(err).ToNot(HaveOccurred())
+
+			// Create a server that behaves like an object store, serving the files of the
+			// bucket only to requests that have been signed:
+			headers = nil
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					headers = append(headers, r.Header.Clone())
+					authorization := r.Header.Get("Authorization")
+					if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=my-key/") {
+						w.WriteHeader(http.StatusForbidden)
+						return
+					}
+					name, ok := strings.CutPrefix(r.URL.Path, "/my-bucket/")
+					if !ok {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+					http.ServeFile(w, r, filepath.Join(store, name))
+				},
+			))
+			DeferCleanup(server.Close)
+
+			// Create the credentials:
+			credentials := filepath.Join(tmp, "credentials")
+			err = os.Mkdir(credentials, 0700)
+			Expect(err).ToNot(HaveOccurred())
+			err = os.WriteFile(filepath.Join(credentials, "access-key-id"), []byte("my-key"), 0600)
+			Expect(err).ToNot(HaveOccurred())
+			err = os.WriteFile(
+				filepath.Join(credentials, "secret-access-key"),
+				[]byte("my-secret"),
+				0600,
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			// Prepare the builder:
+			builder = NewBundleExtractor().
+				SetLogger(logger).
+				SetClient(fake.NewClientBuilder().Build()).
+				SetNode("my-node").
+				SetRootDir(tmp).
+				SetBundleDir("extracted").
+				SetBundleURL("s3://my-bucket/bundle.tar").
+				SetS3Endpoint(server.URL).
+				SetS3CredentialsDir(credentials)
+		})
+
+		It("Downloads the bundle with signed requests", func() {
+			extractor, err := builder.Build()
+			Expect(err).ToNot(HaveOccurred())
+			reader, info, err := extractor.openBundleAttempt(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reader).ToNot(BeNil())
+			defer reader.Close()
+			actual, err := io.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual).To(Equal(data))
+
+			// Check the information obtained from the object store:
+			Expect(info).ToNot(BeNil())
+			Expect(info.Size).To(BeNumerically("==", len(data)))
+			Expect(extractor.expectedDigest(info)).To(Equal(digest))
+			Expect(info.Metadata).ToNot(BeNil())
+			Expect(info.Metadata.Version).To(Equal("4.13.5"))
+
+			// Check that the requests were signed and that they didn't contain the headers
+			// meant for the bundle server:
+			Expect(headers).ToNot(BeEmpty())
+			for _, header := range headers {
+				Expect(header.Get("X-Amz-Date")).ToNot(BeEmpty())
+				Expect(header.Get(bundleServerNodeHeader)).To(BeEmpty())
+			}
+		})
+
+		It("Doesn't download the bundle if the credentials are wrong", func() {
+			extractor, err := builder.SetS3CredentialsDir("").Build()
+			Expect(err).ToNot(HaveOccurred())
+			reader, _, err := extractor.openBundleAttempt(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reader).To(BeNil())
+		})
+
+		It("Doesn't require the server address", func() {
+			extractor, err := builder.Build()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(extractor.serverAddrs).To(BeEmpty())
+		})
+
+		It("Rejects URLs with unsupported schemes", func() {
+			_, err := builder.SetBundleURL("ftp://my-bucket/bundle.tar").Build()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("scheme"))
+		})
+	})
+
+	Describe("Check version", func() {
+		var (
+			extractor *BundleExtractor
+			client    clnt.Client
+			file      string
+		)
+
+		BeforeEach(func() {
+			// Create the bundle file:
+			file = filepath.Join(tmp, "bundle.tar")
+			writeTestBundle(file, "4.13.5")
+
+			// Create the extractor:
+			client = fake.NewClientBuilder().
+				WithObjects(&corev1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: "my-node",
+					},
+				}).
+				Build()
+			extractor = &BundleExtractor{
+				logger:     logger,
+				httpClient: http.DefaultClient,
+				client:     client,
+				node:       "my-node",
+				rootDir:    tmp,
+				bundleFile: "bundle.tar",
+				bundleDir:  "extracted",
+			}
+		})
+
+		It("Extracts the bundle if the version and architecture match", func() {
+			extractor.expectedVersion = "4.13.5"
+			extractor.expectedArch = "amd64"
+			reader, err := os.Open(file)
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+			err = extractor.extractBundle(ctx, reader, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(filepath.Join(tmp, "extracted", "metadata.json")).To(BeARegularFile())
+		})
+
+		It("Doesn't extract the bundle if the version doesn't match", func() {
+			extractor.expectedVersion = "4.14.0"
+			reader, err := os.Open(file)
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+			err = extractor.extractBundle(ctx, reader, "")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("4.14.0"))
+			Expect(filepath.Join(tmp, "extracted")).ToNot(BeADirectory())
+			Expect(filepath.Join(tmp, "extracted.tmp")).ToNot(BeADirectory())
+
+			// Check that the error was written to the node:
+			node := &corev1.Node{}
+			err = client.Get(ctx, clnt.ObjectKey{Name: "my-node"}, node)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(node.Annotations).To(HaveKeyWithValue(
+				annotations.Error,
+				"Wrong bundle, version is '4.13.5' but the cluster expects '4.14.0'",
+			))
+		})
+
+		It("Doesn't extract the bundle if the architecture doesn't match", func() {
+			extractor.expectedArch = "arm64"
+			reader, err := os.Open(file)
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+			err = extractor.extractBundle(ctx, reader, "")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("arm64"))
+		})
+
+		It("Doesn't extract the bundle if it doesn't contain metadata", func() {
+			extractor.expectedVersion = "4.13.5"
+			archive := makeTestArchive(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     "docker/data",
+				Mode:     0644,
+			})
+			err := extractor.extractBundle(ctx, archive, "")
+			Expect(err).To(HaveOccurred())
+			Expect(filepath.Join(tmp, "extracted")).ToNot(BeADirectory())
+		})
+
+		It("Checks the metadata before downloading", func() {
+			extractor.expectedVersion = "4.14.0"
+			err := extractor.checkMetadata(ctx, &Metadata{
+				Version: "4.13.5",
+				Arch:    "x86_64",
+			})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("HTTP client", func() {
+		var (
+			builder *BundleExtractorBuilder
+			server  *httptest.Server
+		)
+
+		BeforeEach(func() {
+			server = httptest.NewTLSServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusNoContent)
+				},
+			))
+			DeferCleanup(server.Close)
+			builder = NewBundleExtractor().
+				SetLogger(logger).
+				SetClient(fake.NewClientBuilder().Build()).
+				SetNode("my-node").
+				SetBundleFile("bundle.tar").
+				SetBundleDir("extracted").
+				SetServerAddr("localhost:8080")
+		})
+
+		It("Trusts the certificates of the CA file", func() {
+			// Without the CA file the request should fail:
+			extractor, err := builder.Build()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = extractor.httpClient.Get(server.URL)
+			Expect(err).To(HaveOccurred())
+
+			// With the CA file it should succeed:
+			caFile := filepath.Join(tmp, "ca.pem")
+			data := pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: server.Certificate().Raw,
+			})
+			err = os.WriteFile(caFile, data, 0600)
+			Expect(err).ToNot(HaveOccurred())
+			extractor, err = builder.SetCAFile(caFile).Build()
+			Expect(err).ToNot(HaveOccurred())
+			response, err := extractor.httpClient.Get(server.URL)
+			Expect(err).ToNot(HaveOccurred())
+			response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusNoContent))
+		})
+
+		It("Rejects CA files without certificates", func() {
+			caFile := filepath.Join(tmp, "ca.pem")
+			err := os.WriteFile(caFile, []byte("junk"), 0600)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = builder.SetCAFile(caFile).Build()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Sends the requests to the proxy", func() {
+			var requested []string
+			proxy := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					requested = append(requested, r.URL.String())
+					w.WriteHeader(http.StatusNoContent)
+				},
+			))
+			DeferCleanup(proxy.Close)
+			extractor, err := builder.
+				SetProxy(proxy.URL).
+				SetNoProxy(".svc").
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			response, err := extractor.httpClient.Get("http://bundles.example.com/bundle.tar")
+			Expect(err).ToNot(HaveOccurred())
+			response.Body.Close()
+			Expect(requested).To(ConsistOf("http://bundles.example.com/bundle.tar"))
+
+			// Check that the proxy isn't used for the excluded domains:
+			request, err := http.NewRequest(
+				http.MethodGet,
+				"http://bundle-server.upgrade-tool.svc:8080",
+				nil,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			transport := extractor.httpClient.Transport.(*http.Transport)
+			proxyURL, err := transport.Proxy(request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(proxyURL).To(BeNil())
+		})
+	})
+
+	Describe("Verify digest", func() {
+		var (
+			extractor *BundleExtractor
+			file      string
+			digest    string
+		)
+
+		BeforeEach(func() {
+			var err error
+
+			// Create the bundle file and calculate its digest:
+			file = filepath.Join(tmp, "bundle.tar")
+			writeTestBundle(file, "4.13.5")
+			digest, err = calculateFileDigest(file)
+			Expect(err).ToNot(HaveOccurred())
+
+			// Create the extractor:
+			extractor = &BundleExtractor{
+				logger:     logger,
+				httpClient: http.DefaultClient,
+				client:     fake.NewClientBuilder().Build(),
+				node:       "my-node",
+				rootDir:    tmp,
+				bundleFile: "bundle.tar",
+				bundleDir:  "extracted",
+			}
+		})
+
+		It("Extracts the bundle if the digest matches", func() {
+			reader, err := os.Open(file)
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+			err = extractor.extractBundle(ctx, reader, digest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(filepath.Join(tmp, "extracted", "metadata.json")).To(BeARegularFile())
+		})
+
+		It("Doesn't extract the bundle if the digest doesn't match", func() {
+			reader, err := os.Open(file)
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+			err = extractor.extractBundle(ctx, reader, strings.Repeat("0", 64))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("corrupted"))
+			Expect(filepath.Join(tmp, "extracted")).ToNot(BeADirectory())
+			Expect(filepath.Join(tmp, "extracted.tmp")).ToNot(BeADirectory())
+		})
+
+		It("Reads the expected digest from the digest file", func() {
+			err := os.WriteFile(
+				filepath.Join(tmp, "bundle.sha256"),
+				[]byte(digest+"  bundle.tar\n"),
+				0600,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			reader, info, err := extractor.openBundleAttempt(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+			Expect(extractor.expectedDigest(info)).To(Equal(digest))
+		})
+
+		It("Gives precedence to the explicitly configured digest", func() {
+			extractor.digest = "0123"
+			reader, info, err := extractor.openBundleAttempt(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			defer reader.Close()
+			Expect(extractor.expectedDigest(info)).To(Equal("0123"))
+		})
+	})
+})
+
+// bundleExtractorBrokenReader is a reader that always fails, used to simulate broken connections.
+type bundleExtractorBrokenReader struct {
+}
+
+func (r *bundleExtractorBrokenReader) Read(p []byte) (n int, err error) {
+	err = errors.New("connection reset")
+	return
+}
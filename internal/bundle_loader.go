@@ -16,48 +16,106 @@ package internal
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	dreference "github.com/distribution/distribution/v3/reference"
+	"github.com/dustin/go-humanize"
 	"github.com/go-logr/logr"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/slices"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	criv1 "k8s.io/cri-api/pkg/apis/runtime/v1"
 	clnt "sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
 	"github.com/jhernand/upgrade-tool/internal/labels"
 )
 
 // BundleLoaderBuilder contains the data and logic needed to create bundle loaders. Don't create
 // instances of this type directly, use the NewBundleLoader function instead.
 type BundleLoaderBuilder struct {
-	logger    logr.Logger
-	client    clnt.Client
-	node      string
-	rootDir   string
-	bundleDir string
+	logger          logr.Logger
+	client          clnt.Client
+	node            string
+	namespace       string
+	rootDir         string
+	bundleDir       string
+	provenanceKey   string
+	pullOrder       string
+	pullPriority    []string
+	pullConcurrency int
+	pullTimeout     time.Duration
+	pullAttempts    int
+	loadTimeout     time.Duration
+	loadMode        string
+	registryAddress string
+	registryCerts   string
+	registryMetrics string
+	keepBundle      bool
+	roleFilter      bool
+	metricsFile     string
 }
 
 // BundleLoader loads the images from the bundle into the CRI-O container storage directory. Don't
 // create instances of this type directly, use the NewBundleLoader function instead.
 type BundleLoader struct {
-	logger    logr.Logger
-	client    clnt.Client
-	node      string
-	rootDir   string
-	bundleDir string
-	crioTool  *CRIOTool
+	logger          logr.Logger
+	client          clnt.Client
+	node            string
+	rootDir         string
+	bundleDir       string
+	crioTool        *CRIOTool
+	verifier        *ProvenanceVerifier
+	pullOrder       string
+	pullPriority    []string
+	pullConcurrency int
+	pullTimeout     time.Duration
+	pullRetrier     *Retrier
+	loadTimeout     time.Duration
+	loadMode        string
+	copier          *storageCopier
+	registryAddress string
+	registryCerts   string
+	registryMetrics string
+	registryAuth    *criv1.AuthConfig
+	keepBundle      bool
+	roleFilter      bool
+	metrics         *bundleLoaderMetrics
+	metricsFile     string
+	status          *nodeStatusWriter
+	events          *nodeEventWriter
+	retrier         *Retrier
 }
 
 // NewBundleLoader creates a builder that can then be used to configure and create bundle
 // extractors.
 func NewBundleLoader() *BundleLoaderBuilder {
-	return &BundleLoaderBuilder{}
+	return &BundleLoaderBuilder{
+		pullOrder:       PullOrderDefault,
+		pullConcurrency: bundleLoaderDefaultPullConcurrency,
+		pullTimeout:     bundleLoaderDefaultPullTimeout,
+		pullAttempts:    bundleLoaderDefaultPullAttempts,
+		loadMode:        LoadModeDefault,
+		registryAddress: bundleLoaderDefaultRegistryAddress,
+	}
 }
 
 // SetLogger sets the logger that the loader will use to write log messages. This is mandatory.
@@ -81,6 +139,14 @@ func (b *BundleLoaderBuilder) SetNode(value string) *BundleLoaderBuilder {
 	return b
 }
 
+// SetNamespace sets the namespace where the loader will write the NodeUpgradeStatus object of the
+// node. This is optional, and when not specified the status is only reported using the annotations
+// and labels of the node.
+func (b *BundleLoaderBuilder) SetNamespace(value string) *BundleLoaderBuilder {
+	b.namespace = value
+	return b
+}
+
 // SetRootDir sets the root directory. This is optional, and when specified all the other
 // directories are relative to it. This is intended for running the loader in a privileged pod
 // with the node root filesystem mounted in a regular directory.
@@ -96,6 +162,120 @@ func (b *BundleLoaderBuilder) SetBundleDir(value string) *BundleLoaderBuilder {
 	return b
 }
 
+// SetProvenanceKey sets the PEM file containing the public key that will be used to verify the
+// provenance attestation of the bundle. Like the other paths it is relative to the root directory.
+// This is optional, and when specified the loader will refuse to load bundles that don't contain a
+// provenance attestation signed with that key, or whose content doesn't match the attestation.
+func (b *BundleLoaderBuilder) SetProvenanceKey(value string) *BundleLoaderBuilder {
+	b.provenanceKey = value
+	return b
+}
+
+// SetPullOrder sets the strategy used to decide the order of the image pulls. The release image is
+// always pulled first. See the PullOrder... constants for the supported values. This is optional
+// and the default is to pull the images in the order they appear in the bundle metadata.
+func (b *BundleLoaderBuilder) SetPullOrder(value string) *BundleLoaderBuilder {
+	b.pullOrder = value
+	return b
+}
+
+// SetPullPriority sets the names of the images that will be pulled first when the pull order is
+// 'priority', for example 'etcd'. This is optional and the default is the DefaultPullPriority
+// list.
+func (b *BundleLoaderBuilder) SetPullPriority(values ...string) *BundleLoaderBuilder {
+	b.pullPriority = values
+	return b
+}
+
+// SetPullConcurrency sets the maximum number of images that will be pulled in parallel. Note that
+// all the pulls compete for the disk and the CPU with the workloads running in the node, so high
+// values aren't recommended. This is optional and the default is two.
+func (b *BundleLoaderBuilder) SetPullConcurrency(value int) *BundleLoaderBuilder {
+	b.pullConcurrency = value
+	return b
+}
+
+// SetPullTimeout sets the maximum time that a single attempt to pull an image can take. When it is
+// exceeded the pull is cancelled and tried again. This is optional and the default is ten minutes.
+func (b *BundleLoaderBuilder) SetPullTimeout(value time.Duration) *BundleLoaderBuilder {
+	b.pullTimeout = value
+	return b
+}
+
+// SetPullAttempts sets the number of times that the pull of an image will be tried before marking
+// the node as failed. This is optional and the default is three.
+func (b *BundleLoaderBuilder) SetPullAttempts(value int) *BundleLoaderBuilder {
+	b.pullAttempts = value
+	return b
+}
+
+// SetLoadTimeout sets the maximum time that pulling all the images can take. When it is exceeded
+// the pulls in progress are cancelled and the node is marked as failed. This is optional and the
+// default is zero, which means that there is no limit.
+func (b *BundleLoaderBuilder) SetLoadTimeout(value time.Duration) *BundleLoaderBuilder {
+	b.loadTimeout = value
+	return b
+}
+
+// SetLoadMode sets the mode used to load the images into CRI-O. See the LoadMode... constants for
+// the supported values. This is optional and the default is to start a registry server and ask
+// CRI-O to pull the images from it.
+func (b *BundleLoaderBuilder) SetLoadMode(value string) *BundleLoaderBuilder {
+	b.loadMode = value
+	return b
+}
+
+// SetRegistryAddress sets the address where the registry server used to serve the images to CRI-O
+// will listen, for example 'localhost:5000'. Use port zero to select a random port. This is
+// optional and the default is to listen in a random port of the loopback interface.
+func (b *BundleLoaderBuilder) SetRegistryAddress(value string) *BundleLoaderBuilder {
+	b.registryAddress = value
+	return b
+}
+
+// SetRegistryCertDir sets the directory that contains the 'tls.crt' and 'tls.key' files that the
+// registry server will use, usually a mounted Kubernetes secret. The files are loaded again when
+// the secret is updated. Note that this isn't relative to the root directory. This is optional
+// and the default is to generate a self signed certificate each time that the loader starts.
+func (b *BundleLoaderBuilder) SetRegistryCertDir(value string) *BundleLoaderBuilder {
+	b.registryCerts = value
+	return b
+}
+
+// SetRegistryMetricsAddress sets the address where the registry server will serve its Prometheus
+// metrics, for example ':9101'. This is optional and the default is to not serve the metrics.
+func (b *BundleLoaderBuilder) SetRegistryMetricsAddress(value string) *BundleLoaderBuilder {
+	b.registryMetrics = value
+	return b
+}
+
+// SetKeepBundle sets a flag that indicates if the bundle directory should be kept after loading
+// the images, so that they can be loaded again, for example if the CRI-O storage is wiped, without
+// transferring the bundle again. The directory will then be removed by the bundle cleaner. This is
+// optional and the default is to remove the bundle directory.
+func (b *BundleLoaderBuilder) SetKeepBundle(value bool) *BundleLoaderBuilder {
+	b.keepBundle = value
+	return b
+}
+
+// SetRoleFilter sets a flag that indicates if the loader should load only the images needed by the
+// roles of the node, according to the image sets of the bundle metadata. For example, worker nodes
+// don't need the images that are only used in control plane nodes. This is optional and the
+// default is to load all the images.
+func (b *BundleLoaderBuilder) SetRoleFilter(value bool) *BundleLoaderBuilder {
+	b.roleFilter = value
+	return b
+}
+
+// SetMetricsFile sets the file where the loader will write the image pull metrics, in the text
+// format of Prometheus. This is intended for the textfile collector of the node exporter, for
+// example '/var/node_exporter/textfile/upgrade_tool_loader.prom'. The file is written when the
+// loader finishes, even if it fails. This is optional and by default the metrics aren't written.
+func (b *BundleLoaderBuilder) SetMetricsFile(value string) *BundleLoaderBuilder {
+	b.metricsFile = value
+	return b
+}
+
 // Build uses the data stored in the builder to create and configure a new bundle loader.
 func (b *BundleLoaderBuilder) Build() (result *BundleLoader, err error) {
 	// Check parameters:
@@ -115,6 +295,74 @@ func (b *BundleLoaderBuilder) Build() (result *BundleLoader, err error) {
 		err = errors.New("bundle directory is mandatory")
 		return
 	}
+	if b.pullOrder != "" && !slices.Contains(PullOrders(), b.pullOrder) {
+		err = fmt.Errorf(
+			"pull order '%s' isn't valid, it should be one of %v",
+			b.pullOrder, PullOrders(),
+		)
+		return
+	}
+	if b.pullConcurrency < 1 {
+		err = fmt.Errorf(
+			"pull concurrency %d isn't valid, it must be greater than zero",
+			b.pullConcurrency,
+		)
+		return
+	}
+	if b.pullTimeout <= 0 {
+		err = fmt.Errorf(
+			"pull timeout %s isn't valid, it must be greater than zero",
+			b.pullTimeout,
+		)
+		return
+	}
+	if b.pullAttempts < 1 {
+		err = fmt.Errorf(
+			"pull attempts %d isn't valid, it must be greater than zero",
+			b.pullAttempts,
+		)
+		return
+	}
+	if b.loadTimeout < 0 {
+		err = fmt.Errorf(
+			"load timeout %s isn't valid, it must be zero or greater than zero",
+			b.loadTimeout,
+		)
+		return
+	}
+	if b.loadMode != "" && !slices.Contains(LoadModes(), b.loadMode) {
+		err = fmt.Errorf(
+			"load mode '%s' isn't valid, it should be one of %v",
+			b.loadMode, LoadModes(),
+		)
+		return
+	}
+	if b.registryAddress == "" {
+		err = errors.New("registry address is mandatory")
+		return
+	}
+	_, registryPort, err := net.SplitHostPort(b.registryAddress)
+	if err != nil {
+		err = fmt.Errorf("registry address '%s' isn't valid: %w", b.registryAddress, err)
+		return
+	}
+	_, err = strconv.ParseUint(registryPort, 10, 16)
+	if err != nil {
+		err = fmt.Errorf(
+			"registry address '%s' isn't valid, port should be a number between 0 "+
+				"and 65535",
+			b.registryAddress,
+		)
+		return
+	}
+	loadMode := b.loadMode
+	if loadMode == "" {
+		loadMode = LoadModeDefault
+	}
+	pullPriority := b.pullPriority
+	if len(pullPriority) == 0 {
+		pullPriority = DefaultPullPriority
+	}
 
 	// Create the CRI-O tool:
 	crioTool, err := NewCRIOTool().
@@ -126,20 +374,137 @@ func (b *BundleLoaderBuilder) Build() (result *BundleLoader, err error) {
 		return
 	}
 
+	// Create the provenance verifier:
+	var verifier *ProvenanceVerifier
+	if b.provenanceKey != "" {
+		key := b.provenanceKey
+		if b.rootDir != "" {
+			key = filepath.Join(b.rootDir, key)
+		}
+		verifier, err = NewProvenanceVerifier().
+			SetLogger(b.logger).
+			SetKey(key).
+			Build()
+		if err != nil {
+			err = fmt.Errorf("failed to create provenance verifier: %w", err)
+			return
+		}
+	}
+
+	// Create the retrier used to wait till CRI-O is healthy after reloading it:
+	retrier, err := NewRetrier().
+		SetLogger(b.logger).
+		SetAttempts(bundleLoaderHealthAttempts).
+		SetDelay(time.Second).
+		SetMaxDelay(10 * time.Second).
+		Build()
+	if err != nil {
+		return
+	}
+
+	// Create the retrier used to pull images:
+	pullRetrier, err := NewRetrier().
+		SetLogger(b.logger).
+		SetAttempts(b.pullAttempts).
+		SetDelay(bundleLoaderPullRetryDelay).
+		SetMaxDelay(bundleLoaderPullRetryMaxDelay).
+		Build()
+	if err != nil {
+		return
+	}
+
+	// Create the storage copier:
+	var copier *storageCopier
+	if loadMode == LoadModeCopy {
+		bundleDir := b.bundleDir
+		graphRoot := bundleLoaderGraphRoot
+		runRoot := bundleLoaderRunRoot
+		if b.rootDir != "" {
+			bundleDir = filepath.Join(b.rootDir, bundleDir)
+			graphRoot = filepath.Join(b.rootDir, graphRoot)
+			runRoot = filepath.Join(b.rootDir, runRoot)
+		}
+		copier = &storageCopier{
+			logger:     b.logger,
+			bundleDir:  bundleDir,
+			layoutsDir: filepath.Join(bundleDir, bundleLoaderLayoutsDir),
+			graphRoot:  graphRoot,
+			runRoot:    runRoot,
+		}
+	}
+
+	// Generate the credentials that CRI-O will use to pull from the registry, so that other
+	// processes running in the node can't use it:
+	password, err := makeRegistryPassword()
+	if err != nil {
+		return
+	}
+	registryAuth := &criv1.AuthConfig{
+		Username: registryUsername,
+		Password: password,
+	}
+
 	// Create and populate the object:
 	result = &BundleLoader{
-		logger:    b.logger,
-		client:    b.client,
-		node:      b.node,
-		rootDir:   b.rootDir,
-		bundleDir: b.bundleDir,
-		crioTool:  crioTool,
+		logger:          b.logger,
+		client:          b.client,
+		node:            b.node,
+		rootDir:         b.rootDir,
+		bundleDir:       b.bundleDir,
+		crioTool:        crioTool,
+		verifier:        verifier,
+		pullOrder:       b.pullOrder,
+		pullPriority:    slices.Clone(pullPriority),
+		pullConcurrency: b.pullConcurrency,
+		pullTimeout:     b.pullTimeout,
+		pullRetrier:     pullRetrier,
+		loadTimeout:     b.loadTimeout,
+		loadMode:        loadMode,
+		copier:          copier,
+		registryAddress: b.registryAddress,
+		registryCerts:   b.registryCerts,
+		registryMetrics: b.registryMetrics,
+		registryAuth:    registryAuth,
+		keepBundle:      b.keepBundle,
+		roleFilter:      b.roleFilter,
+		metrics:         newBundleLoaderMetrics(b.node),
+		metricsFile:     b.metricsFile,
+		status:          newNodeStatusWriter(b.logger, b.client, b.namespace, b.node),
+		events:          newNodeEventWriter(b.logger, b.client, b.node, nodeEventLoaderComponent),
+		retrier:         retrier,
 	}
 	return
 }
 
+// Run loads the images of the bundle. If it fails after changing the configuration of CRI-O then
+// the original configuration is restored, so that CRI-O isn't left pointing to a registry that no
+// longer exists.
 func (l *BundleLoader) Run(ctx context.Context) error {
+	err := l.run(ctx)
+	if err != nil {
+		l.restoreCRIO()
+	}
+	l.writeMetrics()
+	return err
+}
+
+func (l *BundleLoader) run(ctx context.Context) error {
+	// Start watching the log level annotation of the node, so that the verbosity can be changed
+	// while we are running:
+	watcher, err := l.startLogLevelWatcher(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := watcher.Stop(ctx)
+		if err != nil {
+			l.logger.Error(err, "Failed to stop log level watcher")
+		}
+	}()
+
 	// Check that the bundle directory exists:
+	l.status.start(ctx, v1alpha1.NodeUpgradeLoading)
+	l.events.normal(ctx, nodeEventLoading, "Started loading bundle")
 	exists, err := l.checkBundleDir(ctx)
 	if err != nil {
 		return err
@@ -154,43 +519,90 @@ func (l *BundleLoader) Run(ctx context.Context) error {
 		return err
 	}
 
-	// Start the registry server:
-	registry, err := l.startRegistry(ctx)
+	// Verify the provenance attestation before loading anything:
+	if l.verifier != nil {
+		err = l.verifyProvenance(ctx, metadata)
+		if err != nil {
+			return fmt.Errorf("failed to verify provenance attestation: %w", err)
+		}
+	}
+
+	// Select the images needed by the roles of the node:
+	if l.roleFilter {
+		err = l.filterImages(ctx, metadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Check that there is enough space for the images before changing anything:
+	err = l.checkSpace(ctx, metadata)
 	if err != nil {
 		return err
 	}
 
+	// Start the registry server, unless the images are copied directly from the bundle
+	// directory:
+	var registry *Registry
+	if l.copier == nil {
+		registry, err = l.startRegistry(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Take note of the state of the image store before loading the images, so that we can later
+	// report what was added:
+	storeBefore := l.readImageStore(ctx)
+
 	// Write the CRI-O configuration and then ask it reload and pull the images:
-	l.logger.Info("Populating CRI-O")
-	err = l.configureCRIO(ctx, registry.Address(), metadata.Images)
+	l.logger.Info(
+		"Populating CRI-O",
+		"mode", l.loadMode,
+	)
+	err = l.configureCRIO(ctx, registry, metadata.Images)
 	if err != nil {
 		return err
 	}
-	err = l.populateCRIO(ctx, metadata.Release, metadata.Images)
+	err = l.checkCRIO(ctx, metadata.Images)
 	if err != nil {
 		return err
 	}
-	err = l.deconfigureCRIO(ctx)
+	refs, err := l.sortPulls(metadata)
+	if err != nil {
+		return err
+	}
+	err = l.populateCRIO(ctx, registry, metadata.Release, refs)
 	if err != nil {
 		return err
 	}
 	l.logger.Info("Populated CRI-O")
 
 	// Stop the registry server:
-	err = registry.Stop(ctx)
-	if err != nil {
-		return err
+	if registry != nil {
+		err = l.deconfigureCRIO(ctx)
+		if err != nil {
+			return err
+		}
+		err = registry.Stop(ctx)
+		if err != nil {
+			return err
+		}
+		l.logger.Info("Stopped registry")
 	}
-	l.logger.Info("Stopped registry")
 
-	// Delete the bundle directory:
+	// Calculate what was added to the image store:
+	storeAfter := l.readImageStore(ctx)
+	summary := l.summarizeImageStore(storeBefore, storeAfter)
+
+	// Delete the bundle directory, unless we have been asked to keep it:
 	err = l.deleteBundle(ctx)
 	if err != nil {
 		return err
 	}
 
 	// Write the node annotations and labels that indicate the result:
-	err = l.writeResult(ctx)
+	err = l.writeResult(ctx, summary)
 	if err != nil {
 		return err
 	}
@@ -198,6 +610,20 @@ func (l *BundleLoader) Run(ctx context.Context) error {
 	return nil
 }
 
+func (l *BundleLoader) startLogLevelWatcher(ctx context.Context) (result *LogLevelWatcher,
+	err error) {
+	result, err = NewLogLevelWatcher().
+		SetLogger(l.logger).
+		SetClient(l.client).
+		SetNode(l.node).
+		Build()
+	if err != nil {
+		return
+	}
+	err = result.Start(ctx)
+	return
+}
+
 func (l *BundleLoader) checkBundleDir(ctx context.Context) (exists bool, err error) {
 	dir := l.absolutePath(l.bundleDir)
 	_, err = os.Stat(dir)
@@ -217,21 +643,45 @@ func (l *BundleLoader) absolutePath(relPath string) string {
 	return absPath
 }
 
-func (l *BundleLoader) configureCRIO(ctx context.Context, addr string, refs []string) error {
-	// Create the configuration files:
-	err := l.crioTool.CreatePinConf(refs)
+// configureCRIO creates the configuration files that pin the images and, when there is a registry,
+// that tell CRI-O to pull the images from it.
+func (l *BundleLoader) configureCRIO(ctx context.Context, registry *Registry,
+	refs []string) error {
+	// Remove the mirroring configuration left by a previous loader that was killed before it
+	// could restore it, as it points to a registry that no longer exists:
+	_, err := l.crioTool.RemoveStaleMirrorConf()
 	if err != nil {
 		return err
 	}
-	err = l.crioTool.CreateMirrorConf(addr, refs)
+
+	// Create the configuration files:
+	err = l.crioTool.CreatePinConf(refs)
 	if err != nil {
 		return err
 	}
+	if registry != nil {
+		err = l.crioTool.CreateMirrorConf(registry.Address(), refs)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Reload the service:
 	return l.crioTool.ReloadService(ctx)
 }
 
+// restoreCRIO restores the CRI-O configuration files changed by the loader. Note that this uses a
+// new context because the original one may have been cancelled, and that is one of the reasons to
+// restore the configuration.
+func (l *BundleLoader) restoreCRIO() {
+	ctx, cancel := context.WithTimeout(context.Background(), bundleLoaderRestoreTimeout)
+	defer cancel()
+	err := l.crioTool.RestoreConf(ctx)
+	if err != nil {
+		l.logger.Error(err, "Failed to restore CRI-O configuration")
+	}
+}
+
 func (l *BundleLoader) deconfigureCRIO(ctx context.Context) error {
 	// Remove the configuration files. Note that the pinning configuration can't be removed at
 	// this point, it will be removed only when the upgrade has been completed.
@@ -244,25 +694,554 @@ func (l *BundleLoader) deconfigureCRIO(ctx context.Context) error {
 	return l.crioTool.ReloadService(ctx)
 }
 
-func (l *BundleLoader) populateCRIO(ctx context.Context, release string, refs []string) error {
+// checkCRIO waits till CRI-O is healthy after reloading it, and checks that the new configuration
+// has taken effect, so that we don't start pulling images into a broken runtime.
+func (l *BundleLoader) checkCRIO(ctx context.Context, refs []string) error {
+	err := l.retrier.Do(ctx, "CRI-O health check", func(ctx context.Context) error {
+		err := l.crioTool.CheckHealth(ctx)
+		if err != nil {
+			return err
+		}
+		return l.crioTool.CheckPinConf(ctx, refs)
+	})
+	if err != nil {
+		text := fmt.Sprintf("CRI-O isn't healthy after reloading it: %v", err)
+		l.writeError(ctx, text)
+		return errors.New(text)
+	}
+	l.logger.Info("CRI-O is healthy after reloading it")
+	return nil
+}
+
+// populateCRIO pulls the release image and then the rest of the images. If the load timeout is
+// exceeded the pulls in progress are cancelled and the error is written to the node.
+func (l *BundleLoader) populateCRIO(ctx context.Context, registry *Registry, release string,
+	refs []string) error {
+	pullCtx := ctx
+	if l.loadTimeout > 0 {
+		var cancel context.CancelFunc
+		pullCtx, cancel = context.WithTimeout(ctx, l.loadTimeout)
+		defer cancel()
+	}
+	err := l.populateCRIOWithContext(pullCtx, registry, release, refs)
+	if err != nil && ctx.Err() == nil && errors.Is(pullCtx.Err(), context.DeadlineExceeded) {
+		text := fmt.Sprintf("Loading images didn't finish in %s", l.loadTimeout)
+		l.writeError(ctx, text)
+		return errors.New(text)
+	}
+	return err
+}
+
+func (l *BundleLoader) populateCRIOWithContext(ctx context.Context, registry *Registry,
+	release string, refs []string) error {
 	// Pull the release image:
-	err := l.crioTool.PullImage(ctx, release)
+	err := l.pullImage(ctx, release)
 	if err != nil {
 		return err
 	}
+
+	// CRI-O always asks the registry for the manifest, even if it already has the image, so if
+	// the registry didn't receive any request then the mirror configuration didn't take effect
+	// and the image was pulled from somewhere else:
+	if registry != nil && registry.Requests() == 0 {
+		text := "CRI-O didn't pull the release image from the bundle registry, the mirror " +
+			"configuration didn't take effect"
+		l.writeError(ctx, text)
+		return errors.New(text)
+	}
 	l.reportProgress(ctx, "Pulled release image")
 
 	// Pull the payload images:
-	for i, ref := range refs {
-		err = l.crioTool.PullImage(ctx, ref)
-		if err != nil {
-			return err
+	return l.pullImages(ctx, refs)
+}
+
+// pullImages pulls the given images using as many workers as the configured concurrency. The
+// workers take the images in the given order, so the images that are first in the pull order
+// still start first. If any of the pulls fails the rest are cancelled and the first error is
+// returned.
+func (l *BundleLoader) pullImages(ctx context.Context, refs []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	workers := l.pullConcurrency
+	if workers > len(refs) {
+		workers = len(refs)
+	}
+	l.logger.Info(
+		"Pulling images",
+		"count", len(refs),
+		"workers", workers,
+	)
+	queue := make(chan string)
+	var (
+		lock   sync.Mutex
+		pulled int
+		failed error
+		group  sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for ref := range queue {
+				err := l.pullImage(ctx, ref)
+				lock.Lock()
+				if err != nil {
+					if failed == nil {
+						failed = err
+						cancel()
+					}
+				} else {
+					pulled++
+					l.reportProgress(ctx, "Pulled %d of %d images", pulled, len(refs))
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, ref := range refs {
+		select {
+		case queue <- ref:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	group.Wait()
+	if failed != nil {
+		return failed
+	}
+	return ctx.Err()
+}
+
+// pullImage pulls the given image, trying again if the pull fails or doesn't finish in the pull
+// timeout. If all the attempts fail the error is written to the node.
+func (l *BundleLoader) pullImage(ctx context.Context, ref string) error {
+	name := fmt.Sprintf("pull of image '%s'", ref)
+	start := time.Now()
+	attempts := 0
+	err := l.pullRetrier.Do(ctx, name, func(ctx context.Context) error {
+		attempts++
+		if attempts > 1 {
+			l.metrics.retries.WithLabelValues(ref).Inc()
 		}
-		l.reportProgress(ctx, "Pulled %d of %d images", i+1, len(refs))
+		return l.pullImageOnce(ctx, ref)
+	})
+	if err != nil {
+		l.metrics.failures.WithLabelValues(ref).Inc()
+		if ctx.Err() == nil && !errors.Is(err, errBundleLoaderCorruptedImage) {
+			l.writeError(ctx, fmt.Sprintf("Failed to pull image '%s': %v", ref, err))
+		}
+		return err
+	}
+	l.metrics.duration.WithLabelValues(ref).Set(time.Since(start).Seconds())
+	size, err := l.imageSize(ref)
+	if err != nil {
+		l.logger.V(1).Info(
+			"Failed to calculate image size for metrics",
+			"ref", ref,
+			"error", err.Error(),
+		)
+	} else {
+		l.metrics.bytes.WithLabelValues(ref).Set(float64(size))
 	}
 	return nil
 }
 
+// writeMetrics writes the image pull metrics to the metrics file, if configured. Failures are
+// written to the log but not returned, as the metrics aren't essential.
+func (l *BundleLoader) writeMetrics() {
+	if l.metricsFile == "" {
+		return
+	}
+	file := l.absolutePath(l.metricsFile)
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err == nil {
+		err = prometheus.WriteToTextfile(file, l.metrics.registry)
+	}
+	if err != nil {
+		l.logger.Error(
+			err,
+			"Failed to write metrics",
+			"file", file,
+		)
+		return
+	}
+	l.logger.V(1).Info(
+		"Wrote metrics",
+		"file", file,
+	)
+}
+
+// pullImageOnce pulls the given image, or copies it directly to the container storage when using
+// the copy mode, and then checks that the digest of the image stored by CRI-O matches the digest
+// recorded in the bundle. The pull is cancelled if it doesn't finish in the pull timeout. Errors
+// that will not go away trying again, like a manifest that isn't in the bundle, stop the retries.
+func (l *BundleLoader) pullImageOnce(ctx context.Context, ref string) error {
+	pullCtx, cancel := context.WithTimeout(ctx, l.pullTimeout)
+	defer cancel()
+	var err error
+	if l.copier != nil {
+		err = l.copier.copy(pullCtx, ref)
+	} else {
+		err = l.crioTool.PullImage(pullCtx, ref, l.registryAuth)
+	}
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(pullCtx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("pull didn't finish in %s", l.pullTimeout)
+		}
+		if isPermanentPullError(err) {
+			l.logger.Info(
+				"Pull failed with permanent error, will not try again",
+				"ref", ref,
+				"error", err.Error(),
+			)
+			return StopRetrying(err)
+		}
+		return err
+	}
+	err = l.verifyImage(ctx, ref)
+	if errors.Is(err, errBundleLoaderCorruptedImage) {
+		err = StopRetrying(err)
+	}
+	return err
+}
+
+// isPermanentPullError checks if the given pull error will happen again if the pull is tried again.
+// Errors returned by CRI-O are usually gRPC errors with the unknown code and the text of the
+// registry error, so both the code and the text are checked. Anything else, like a connection
+// refused because CRI-O is restarting, is considered transient.
+func isPermanentPullError(err error) bool {
+	switch grpcstatus.Code(err) {
+	case codes.InvalidArgument, codes.NotFound, codes.PermissionDenied, codes.Unimplemented:
+		return true
+	}
+	text := strings.ToLower(err.Error())
+	for _, permanent := range bundleLoaderPermanentPullErrors {
+		if strings.Contains(text, permanent) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyImage checks that the digest of the image stored by CRI-O is one of the digests recorded in
+// the bundle. If it isn't the content was corrupted in transit, and the error is written to the
+// node so that it is visible to the user. Images referenced without a digest can't be checked.
+func (l *BundleLoader) verifyImage(ctx context.Context, ref string) error {
+	named, err := dreference.ParseNamed(ref)
+	if err != nil {
+		return err
+	}
+	digested, ok := named.(dreference.Digested)
+	if !ok {
+		l.logger.V(1).Info(
+			"Skipping digest verification because the image reference doesn't contain a digest",
+			"ref", ref,
+		)
+		return nil
+	}
+
+	// Calculate the expected digests. That is the original digest from the reference, and the
+	// digest of the manifest that was actually stored in the bundle, which may be different if
+	// the image was converted.
+	expected := []string{
+		digested.Digest().String(),
+	}
+	stored, err := l.storedDigest(named, digested)
+	if err != nil {
+		l.logger.Error(
+			err,
+			"Failed to read stored digest, will only check the reference digest",
+			"ref", ref,
+		)
+	} else if !slices.Contains(expected, stored.String()) {
+		expected = append(expected, stored.String())
+	}
+
+	// Get the digests that CRI-O has and check that at least one matches:
+	actual, err := l.crioTool.ImageDigests(ctx, ref)
+	if err != nil {
+		return err
+	}
+	for _, digest := range actual {
+		if slices.Contains(expected, digest) {
+			l.logger.V(1).Info(
+				"Verified image digest",
+				"ref", ref,
+				"digest", digest,
+			)
+			return nil
+		}
+	}
+	text := fmt.Sprintf(
+		"Image '%s' was corrupted, expected digest '%s' but CRI-O has '%s'",
+		ref, strings.Join(expected, "' or '"), strings.Join(actual, "', '"),
+	)
+	l.writeError(ctx, text)
+	return fmt.Errorf("%w: %s", errBundleLoaderCorruptedImage, text)
+}
+
+// filterImages removes from the metadata the images that aren't needed by the roles of the node.
+func (l *BundleLoader) filterImages(ctx context.Context, metadata *Metadata) error {
+	node := &corev1.Node{}
+	key := clnt.ObjectKey{
+		Name: l.node,
+	}
+	err := l.client.Get(ctx, key, node)
+	if err != nil {
+		return err
+	}
+	roles := NodeRoles(node)
+	images := SelectRoleImages(metadata, roles)
+	l.logger.Info(
+		"Selected images for node roles",
+		"roles", roles,
+		"selected", len(images),
+		"total", len(metadata.Images),
+	)
+	metadata.Images = images
+	return nil
+}
+
+// sortPulls returns the payload image references sorted according to the configured pull order.
+func (l *BundleLoader) sortPulls(metadata *Metadata) (result []string, err error) {
+	var sizes map[string]int64
+	if l.pullOrder == PullOrderSize {
+		sizes = map[string]int64{}
+		for _, ref := range metadata.Images {
+			size, err := l.imageSize(ref)
+			if err != nil {
+				l.logger.Error(
+					err,
+					"Failed to calculate image size, will assume zero",
+					"ref", ref,
+				)
+				continue
+			}
+			sizes[ref] = size
+		}
+	}
+	result, err = SortPulls(l.pullOrder, metadata.Images, sizes, metadata.Tags, l.pullPriority)
+	if err != nil {
+		return
+	}
+	l.logger.Info(
+		"Sorted image pulls",
+		"order", l.pullOrder,
+		"refs", result,
+	)
+	return
+}
+
+// imageSize calculates the size of an image adding the sizes of the configuration and the layers
+// listed in the manifest stored in the bundle.
+func (l *BundleLoader) imageSize(ref string) (result int64, err error) {
+	manifest, err := l.imageManifest(ref)
+	if err != nil {
+		return
+	}
+	if manifest.Config != nil {
+		result = manifest.Config.Size
+	}
+	for _, layer := range manifest.Layers {
+		result += layer.Size
+	}
+	return
+}
+
+// imageManifest reads from the bundle the manifest of the given image reference.
+func (l *BundleLoader) imageManifest(ref string) (result *registryManifest, err error) {
+	named, err := dreference.ParseNamed(ref)
+	if err != nil {
+		return
+	}
+	digested, ok := named.(dreference.Digested)
+	if !ok {
+		err = fmt.Errorf("image reference '%s' doesn't contain a digest", ref)
+		return
+	}
+	digest, err := l.storedDigest(named, digested)
+	if err != nil {
+		return
+	}
+	storage := &registryStorage{
+		root: l.absolutePath(l.bundleDir),
+	}
+	result, err = storage.readManifest(digest)
+	return
+}
+
+// checkSpace checks that the filesystem that contains the container storage has enough space for
+// the layers of the images that aren't already there. Layers are stored uncompressed, so the
+// compressed size is multiplied by an expansion factor. If there isn't enough space it writes the
+// error to the node, and a node condition, and returns an error, so that the load fails before
+// causing disk pressure evictions.
+func (l *BundleLoader) checkSpace(ctx context.Context, metadata *Metadata) error {
+	graphRoot := l.absolutePath(bundleLoaderGraphRoot)
+	present, err := l.presentLayers(graphRoot)
+	if err != nil {
+		return err
+	}
+	blobs := map[godigest.Digest]int64{}
+	refs := append([]string{metadata.Release}, metadata.Images...)
+	for _, ref := range refs {
+		manifest, err := l.imageManifest(ref)
+		if err != nil {
+			l.logger.Error(
+				err,
+				"Failed to read image manifest, will not include it in the disk space check",
+				"ref", ref,
+			)
+			continue
+		}
+		descriptors := manifest.Layers
+		if manifest.Config != nil {
+			descriptors = append(descriptors, *manifest.Config)
+		}
+		for _, descriptor := range descriptors {
+			if !present[descriptor.Digest] {
+				blobs[descriptor.Digest] = descriptor.Size
+			}
+		}
+	}
+	var missing int64
+	for _, size := range blobs {
+		missing += size
+	}
+	required := uint64(missing*bundleLoaderSpaceExpansion + bundleLoaderSpaceReserve)
+	available, err := availableSpace(graphRoot)
+	if err != nil {
+		return err
+	}
+	l.logger.Info(
+		"Checked disk space",
+		"dir", graphRoot,
+		"available", humanize.IBytes(available),
+		"required", humanize.IBytes(required),
+		"missing", humanize.IBytes(uint64(missing)),
+		"blobs", len(blobs),
+		"present", len(present),
+	)
+	if available >= required {
+		l.writeSpaceCondition(ctx, false, "There is enough disk space to load the images")
+		return nil
+	}
+	text := fmt.Sprintf(
+		"Not enough disk space to load the images into '%s', %s are required but only %s "+
+			"are available",
+		bundleLoaderGraphRoot, humanize.IBytes(required), humanize.IBytes(available),
+	)
+	l.writeError(ctx, text)
+	l.writeSpaceCondition(ctx, true, text)
+	return errors.New(text)
+}
+
+// presentLayers returns the set of compressed digests of the layers that are already in the
+// container storage, reading the layers file of the overlay driver. If that file doesn't exist
+// it returns an empty set.
+func (l *BundleLoader) presentLayers(graphRoot string) (result map[godigest.Digest]bool,
+	err error) {
+	file := filepath.Join(graphRoot, "overlay-layers", "layers.json")
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		l.logger.V(1).Info(
+			"Layers file doesn't exist, will assume that there are no layers",
+			"file", file,
+		)
+		result = map[godigest.Digest]bool{}
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	var layers []struct {
+		CompressedDigest godigest.Digest `json:"compressed-diff-digest,omitempty"`
+	}
+	err = json.Unmarshal(data, &layers)
+	if err != nil {
+		err = fmt.Errorf("failed to parse layers file '%s': %w", file, err)
+		return
+	}
+	result = map[godigest.Digest]bool{}
+	for _, layer := range layers {
+		if layer.CompressedDigest != "" {
+			result[layer.CompressedDigest] = true
+		}
+	}
+	return
+}
+
+// writeSpaceCondition writes the node condition that indicates if there is enough disk space to
+// load the images. The condition is only added when there isn't enough space; if there is it is
+// only updated when it already exists. Failures are written to the log but not returned.
+func (l *BundleLoader) writeSpaceCondition(ctx context.Context, insufficient bool, text string) {
+	node := &corev1.Node{}
+	err := l.client.Get(ctx, clnt.ObjectKey{Name: l.node}, node)
+	if err != nil {
+		l.logger.Error(err, "Failed to get node to write disk space condition")
+		return
+	}
+	exists := slices.ContainsFunc(node.Status.Conditions, func(c corev1.NodeCondition) bool {
+		return c.Type == bundleLoaderSpaceCondition
+	})
+	if !insufficient && !exists {
+		return
+	}
+	status := corev1.ConditionFalse
+	reason := "SufficientDiskSpace"
+	if insufficient {
+		status = corev1.ConditionTrue
+		reason = "InsufficientDiskSpace"
+	}
+	now := metav1.Now()
+	update := node.DeepCopy()
+	condition := corev1.NodeCondition{
+		Type:               bundleLoaderSpaceCondition,
+		Status:             status,
+		Reason:             reason,
+		Message:            text,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+	}
+	index := slices.IndexFunc(update.Status.Conditions, func(c corev1.NodeCondition) bool {
+		return c.Type == bundleLoaderSpaceCondition
+	})
+	if index >= 0 {
+		if update.Status.Conditions[index].Status == status {
+			condition.LastTransitionTime = update.Status.Conditions[index].LastTransitionTime
+		}
+		update.Status.Conditions[index] = condition
+	} else {
+		update.Status.Conditions = append(update.Status.Conditions, condition)
+	}
+	err = l.client.Status().Patch(ctx, update, clnt.StrategicMergeFrom(node))
+	if err != nil {
+		l.logger.Error(err, "Failed to write disk space condition")
+		return
+	}
+	l.logger.V(1).Info(
+		"Wrote disk space condition",
+		"node", l.node,
+		"status", status,
+		"reason", reason,
+	)
+}
+
+// storedDigest returns the digest of the manifest that was stored in the bundle for the given image
+// reference. The bundle creator uses the hex part of the digest as tag, so we need to read the tag
+// link to find the digest of the manifest that was actually stored, which may be different from
+// the original one if the image was converted.
+func (l *BundleLoader) storedDigest(named dreference.Named,
+	digested dreference.Digested) (result godigest.Digest, err error) {
+	storage := &registryStorage{
+		root: l.absolutePath(l.bundleDir),
+	}
+	result, err = storage.readTag(dreference.Path(named), digested.Digest().Encoded())
+	return
+}
+
 func (l *BundleLoader) readMetadata(ctx context.Context) (result *Metadata, err error) {
 	dir := l.absolutePath(l.bundleDir)
 	file := filepath.Join(dir, "metadata.json")
@@ -284,13 +1263,103 @@ func (l *BundleLoader) readMetadata(ctx context.Context) (result *Metadata, err
 	return
 }
 
+func (l *BundleLoader) verifyProvenance(ctx context.Context, metadata *Metadata) error {
+	// Read and verify the signature of the attestation:
+	dir := l.absolutePath(l.bundleDir)
+	data, err := os.ReadFile(filepath.Join(dir, provenanceFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("bundle doesn't contain a provenance attestation")
+	}
+	if err != nil {
+		return err
+	}
+	statement, err := l.verifier.Verify(data)
+	if err != nil {
+		return err
+	}
+
+	// Check that the metadata is the one described in the attestation. As the images are
+	// referenced by digest this is enough to guarantee that the images are the ones that were
+	// used to create the bundle.
+	data, err = os.ReadFile(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	err = l.checkProvenanceSubject(
+		statement, "metadata.json",
+		"sha256", hex.EncodeToString(sum[:]),
+	)
+	if err != nil {
+		return err
+	}
+	refs := append([]string{metadata.Release}, metadata.Images...)
+	for _, ref := range refs {
+		named, err := dreference.ParseNamed(ref)
+		if err != nil {
+			return err
+		}
+		digested, ok := named.(dreference.Digested)
+		if !ok {
+			return fmt.Errorf("image reference '%s' doesn't contain a digest", ref)
+		}
+		digest := digested.Digest()
+		err = l.checkProvenanceSubject(
+			statement, ref,
+			digest.Algorithm().String(), digest.Encoded(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	l.logger.Info(
+		"Verified provenance attestation",
+		"builder", statement.Predicate.RunDetails.Builder.ID,
+		"subjects", len(statement.Subject),
+	)
+	return nil
+}
+
+func (l *BundleLoader) checkProvenanceSubject(statement *ProvenanceStatement, name, algorithm,
+	value string) error {
+	subject := statement.FindSubject(name)
+	if subject == nil {
+		return fmt.Errorf("attestation doesn't contain subject '%s'", name)
+	}
+	expected, ok := subject.Digest[algorithm]
+	if !ok {
+		return fmt.Errorf(
+			"attestation doesn't contain '%s' digest for subject '%s'",
+			algorithm, name,
+		)
+	}
+	if expected != value {
+		return fmt.Errorf(
+			"digest of subject '%s' is '%s:%s' but attestation says '%s:%s'",
+			name, algorithm, value, algorithm, expected,
+		)
+	}
+	return nil
+}
+
 func (l *BundleLoader) startRegistry(ctx context.Context) (registry *Registry, err error) {
 	dir := l.absolutePath(l.bundleDir)
-	registry, err = NewRegistry().
+	builder := NewRegistry().
 		SetLogger(l.logger).
-		SetAddress("localhost:0").
+		SetAddress(l.registryAddress).
 		SetRoot(dir).
-		Build()
+		SetReadOnly(true).
+		SetMetricsAddress(l.registryMetrics)
+	if l.registryAuth != nil {
+		builder.SetCredentials(l.registryAuth.Username, l.registryAuth.Password)
+	}
+	if l.registryCerts != "" {
+		builder.SetCertificateFiles(
+			filepath.Join(l.registryCerts, corev1.TLSCertKey),
+			filepath.Join(l.registryCerts, corev1.TLSPrivateKeyKey),
+		)
+	}
+	registry, err = builder.Build()
 	if err != nil {
 		return
 	}
@@ -306,8 +1375,16 @@ func (l *BundleLoader) startRegistry(ctx context.Context) (registry *Registry, e
 	return
 }
 
+// deleteBundle deletes the bundle directory, unless the loader has been configured to keep it.
 func (l *BundleLoader) deleteBundle(ctx context.Context) error {
 	dir := l.absolutePath(l.bundleDir)
+	if l.keepBundle {
+		l.logger.Info(
+			"Keeping bundle",
+			"dir", dir,
+		)
+		return nil
+	}
 	err := os.RemoveAll(dir)
 	if err != nil {
 		return err
@@ -319,7 +1396,56 @@ func (l *BundleLoader) deleteBundle(ctx context.Context) error {
 	return nil
 }
 
-func (l *BundleLoader) writeResult(ctx context.Context) error {
+// readImageStore reads the state of the CRI-O image store, including the layers that are in the
+// container storage. Failures are logged and ignored, as this is only used to report debugging
+// information.
+func (l *BundleLoader) readImageStore(ctx context.Context) *CRIOImageStore {
+	store, err := l.crioTool.ImageStore(ctx)
+	if err != nil {
+		l.logger.Error(err, "Failed to read image store")
+		return nil
+	}
+	store.Layers, err = l.presentLayers(l.absolutePath(bundleLoaderGraphRoot))
+	if err != nil {
+		l.logger.Error(err, "Failed to read image store layers")
+	}
+	return store
+}
+
+// summarizeImageStore calculates what was added to the image store between the two given states.
+// Returns nil if any of the states isn't available.
+func (l *BundleLoader) summarizeImageStore(before, after *CRIOImageStore) *bundleLoaderImageStore {
+	if before == nil || after == nil {
+		return nil
+	}
+	result := &bundleLoaderImageStore{
+		GraphRoot: after.Path,
+	}
+	for id := range after.Images {
+		_, ok := before.Images[id]
+		if !ok {
+			result.Images++
+		}
+	}
+	for digest := range after.Layers {
+		if !before.Layers[digest] {
+			result.Blobs++
+		}
+	}
+	if after.UsedBytes > before.UsedBytes {
+		result.Bytes = after.UsedBytes - before.UsedBytes
+	}
+	l.logger.Info(
+		"Calculated image store changes",
+		"graph_root", result.GraphRoot,
+		"images", result.Images,
+		"blobs", result.Blobs,
+		"bytes", result.Bytes,
+	)
+	return result
+}
+
+func (l *BundleLoader) writeResult(ctx context.Context, summary *bundleLoaderImageStore) error {
 	// Fetch the node:
 	nodeObject := &corev1.Node{}
 	nodeKey := clnt.ObjectKey{
@@ -337,6 +1463,18 @@ func (l *BundleLoader) writeResult(ctx context.Context) error {
 		nodeUpdate.Labels = map[string]string{}
 	}
 	nodeUpdate.Labels[labels.BundleLoaded] = loadedText
+	if summary != nil {
+		var summaryBytes []byte
+		summaryBytes, err = json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		if nodeUpdate.Annotations == nil {
+			nodeUpdate.Annotations = map[string]string{}
+		}
+		nodeUpdate.Annotations[annotations.ImageStore] = string(summaryBytes)
+	}
+	delete(nodeUpdate.Annotations, annotations.Error)
 	nodePatch := clnt.MergeFrom(nodeObject)
 	err = l.client.Patch(ctx, nodeUpdate, nodePatch)
 	if err != nil {
@@ -346,12 +1484,52 @@ func (l *BundleLoader) writeResult(ctx context.Context) error {
 		"Wrote success",
 		"node", l.node,
 	)
+	l.status.succeed(ctx, v1alpha1.NodeUpgradeLoaded)
+	l.events.normal(ctx, nodeEventLoaded, "Finished loading bundle")
 	return nil
 }
 
+func (l *BundleLoader) writeError(ctx context.Context, text string) {
+	l.status.fail(ctx, text)
+	l.events.warning(ctx, nodeEventLoadingFailed, text)
+	data, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				annotations.Error: text,
+			},
+		},
+	})
+	if err != nil {
+		l.logger.Error(err, "Failed to create error patch")
+		return
+	}
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: l.node,
+		},
+	}
+	patch := clnt.RawPatch(types.MergePatchType, data)
+	err = l.client.Patch(ctx, node, patch)
+	if err != nil {
+		l.logger.Error(
+			err,
+			"Failed to write error",
+			"node", l.node,
+			"text", text,
+		)
+		return
+	}
+	l.logger.V(1).Info(
+		"Wrote error",
+		"node", l.node,
+		"text", text,
+	)
+}
+
 func (l *BundleLoader) reportProgress(ctx context.Context, format string, args ...any) {
 	// Render the progress message text:
 	text := fmt.Sprintf(format, args...)
+	l.status.progress(ctx, text, 0)
 
 	// Create a patch to add the annotation containing the rendered message:
 	data, err := json.Marshal(map[string]any{
@@ -394,3 +1572,178 @@ func (l *BundleLoader) reportProgress(ctx context.Context, format string, args .
 		"text", text,
 	)
 }
+
+const (
+	// bundleLoaderDefaultPullConcurrency is the default number of images that are pulled in
+	// parallel.
+	bundleLoaderDefaultPullConcurrency = 2
+
+	// bundleLoaderDefaultPullTimeout is the default maximum time that a single attempt to pull
+	// an image can take.
+	bundleLoaderDefaultPullTimeout = 10 * time.Minute
+
+	// bundleLoaderDefaultPullAttempts is the default number of times that the pull of an image
+	// is tried.
+	bundleLoaderDefaultPullAttempts = 3
+
+	// bundleLoaderPullRetryDelay and bundleLoaderPullRetryMaxDelay are the initial and maximum
+	// delays between attempts to pull an image.
+	bundleLoaderPullRetryDelay    = time.Second
+	bundleLoaderPullRetryMaxDelay = 30 * time.Second
+
+	// bundleLoaderDefaultRegistryAddress is the default address where the registry server
+	// listens. Port zero means that a random port is selected.
+	bundleLoaderDefaultRegistryAddress = "localhost:0"
+
+	// bundleLoaderRestoreTimeout is the maximum time to restore the CRI-O configuration when
+	// the loader fails.
+	bundleLoaderRestoreTimeout = time.Minute
+
+	// bundleLoaderHealthAttempts is the number of times that the loader checks if CRI-O is
+	// healthy after reloading it before giving up.
+	bundleLoaderHealthAttempts = 10
+
+	// bundleLoaderGraphRoot and bundleLoaderRunRoot are the directories of the container
+	// storage used by CRI-O, where images are copied when using the copy mode.
+	bundleLoaderGraphRoot = "/var/lib/containers/storage"
+	bundleLoaderRunRoot   = "/run/containers/storage"
+
+	// bundleLoaderSpaceExpansion is the factor used to estimate the disk space that the layers
+	// take once they are uncompressed in the container storage.
+	bundleLoaderSpaceExpansion = 2
+
+	// bundleLoaderSpaceReserve is the disk space that should remain available after loading the
+	// images, so that the node doesn't run out of space.
+	bundleLoaderSpaceReserve = 1 << 30
+
+	// bundleLoaderSpaceCondition is the type of the node condition that indicates that there
+	// isn't enough disk space to load the images.
+	bundleLoaderSpaceCondition corev1.NodeConditionType = "UpgradeToolInsufficientDiskSpace"
+
+	// bundleLoaderMetricsNamespace and bundleLoaderMetricsSubsystem are the prefixes of the
+	// names of the metrics.
+	bundleLoaderMetricsNamespace = "upgrade_tool"
+	bundleLoaderMetricsSubsystem = "bundle_loader"
+
+	// bundleLoaderLayoutsDir is the directory, inside the bundle directory, where the
+	// temporary OCI layouts are created when using the copy mode.
+	bundleLoaderLayoutsDir = "layouts"
+)
+
+// bundleLoaderMetrics contains the Prometheus metrics of the image pulls. They are registered in
+// their own registry, instead of the global one, so that only these are written to the metrics
+// file.
+type bundleLoaderMetrics struct {
+	registry *prometheus.Registry
+	duration *prometheus.GaugeVec
+	bytes    *prometheus.GaugeVec
+	retries  *prometheus.CounterVec
+	failures *prometheus.CounterVec
+}
+
+func newBundleLoaderMetrics(node string) *bundleLoaderMetrics {
+	registry := prometheus.NewRegistry()
+	constLabels := prometheus.Labels{
+		"node": node,
+	}
+	duration := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   bundleLoaderMetricsNamespace,
+			Subsystem:   bundleLoaderMetricsSubsystem,
+			Name:        "image_pull_duration_seconds",
+			Help:        "Time that it took to pull the image, including retries.",
+			ConstLabels: constLabels,
+		},
+		[]string{"image"},
+	)
+	bytes := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   bundleLoaderMetricsNamespace,
+			Subsystem:   bundleLoaderMetricsSubsystem,
+			Name:        "image_pull_bytes",
+			Help:        "Size of the configuration and layers of the pulled image.",
+			ConstLabels: constLabels,
+		},
+		[]string{"image"},
+	)
+	retries := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   bundleLoaderMetricsNamespace,
+			Subsystem:   bundleLoaderMetricsSubsystem,
+			Name:        "image_pull_retries_total",
+			Help:        "Number of times that the pull of the image was tried again.",
+			ConstLabels: constLabels,
+		},
+		[]string{"image"},
+	)
+	failures := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   bundleLoaderMetricsNamespace,
+			Subsystem:   bundleLoaderMetricsSubsystem,
+			Name:        "image_pull_failures_total",
+			Help:        "Number of pulls of the image that failed after all the attempts.",
+			ConstLabels: constLabels,
+		},
+		[]string{"image"},
+	)
+	registry.MustRegister(
+		duration,
+		bytes,
+		retries,
+		failures,
+	)
+	return &bundleLoaderMetrics{
+		registry: registry,
+		duration: duration,
+		bytes:    bytes,
+		retries:  retries,
+		failures: failures,
+	}
+}
+
+// bundleLoaderPermanentPullErrors are the texts of pull errors that will not go away trying again.
+// They are mostly the error codes of the registry API, and they are compared in lower case.
+var bundleLoaderPermanentPullErrors = []string{
+	"manifest unknown",
+	"name unknown",
+	"blob unknown",
+	"invalid reference format",
+	"unauthorized",
+	"denied",
+}
+
+// errBundleLoaderCorruptedImage is the error returned when the digest of a pulled image doesn't
+// match the digest recorded in the bundle. Pulls that fail with this error aren't retried because
+// the content of the bundle will not change.
+var errBundleLoaderCorruptedImage = errors.New("image was corrupted")
+
+// bundleLoaderImageStore is the content of the annotation that describes what the loader added to
+// the image store.
+type bundleLoaderImageStore struct {
+	GraphRoot string `json:"graphRoot,omitempty"`
+	Images    int    `json:"images"`
+	Blobs     int    `json:"blobs"`
+	Bytes     uint64 `json:"bytes"`
+}
+
+// bundleLoaderPermissions are the permissions that the loader needs to read and update the
+// annotations, labels and conditions of the node, and to report the progress.
+var bundleLoaderPermissions = rbacPermissions{
+	cluster: append(
+		[]rbacv1.PolicyRule{
+			{
+				APIGroups: []string{""},
+				Resources: []string{"nodes"},
+				Verbs:     []string{"get", "patch"},
+			},
+			{
+				APIGroups: []string{""},
+				Resources: []string{"nodes/status"},
+				Verbs:     []string{"patch"},
+			},
+		},
+		nodeEventRules...,
+	),
+	namespace:  nodeStatusRules,
+	privileged: true,
+}
@@ -0,0 +1,881 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	criv1 "k8s.io/cri-api/pkg/apis/runtime/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Bundle loader", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		tmp    string
+		client clnt.Client
+		images *bundleLoaderFakeImageClient
+		loader *BundleLoader
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create a temporary directory for the bundle:
+		tmp, err = os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+
+		// Create the API client with the node:
+		client = fake.NewClientBuilder().
+			WithObjects(&corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "my-node",
+				},
+			}).
+			Build()
+
+		// Create the loader with a fake CRI-O image service:
+		images = &bundleLoaderFakeImageClient{
+			delay: 10 * time.Millisecond,
+		}
+		retrier, err := NewRetrier().
+			SetLogger(logger).
+			SetAttempts(1).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		loader = &BundleLoader{
+			logger:    logger,
+			client:    client,
+			node:      "my-node",
+			rootDir:   tmp,
+			bundleDir: "bundle",
+			crioTool: &CRIOTool{
+				logger:      logger,
+				imageClient: images,
+			},
+			pullConcurrency: 1,
+			pullTimeout:     time.Minute,
+			pullRetrier:     retrier,
+			metrics:         newBundleLoaderMetrics("my-node"),
+		}
+	})
+
+	makeRefs := func(count int) []string {
+		refs := make([]string, count)
+		for i := range refs {
+			refs[i] = fmt.Sprintf("quay.io/openshift/image-%d", i)
+		}
+		return refs
+	}
+
+	// getError returns the error annotation written to the node.
+	getError := func() string {
+		node := &corev1.Node{}
+		err := client.Get(ctx, clnt.ObjectKey{Name: "my-node"}, node)
+		Expect(err).ToNot(HaveOccurred())
+		return node.Annotations[annotations.Error]
+	}
+
+	It("Pulls images sequentially by default", func() {
+		refs := makeRefs(5)
+		err := loader.pullImages(ctx, refs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(images.pulled).To(Equal(refs))
+		Expect(images.max).To(Equal(1))
+	})
+
+	It("Pulls images in parallel", func() {
+		loader.pullConcurrency = 3
+		refs := makeRefs(12)
+		err := loader.pullImages(ctx, refs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(images.pulled).To(ConsistOf(refs))
+		Expect(images.max).To(Equal(3))
+
+		// Check the progress reported:
+		node := &corev1.Node{}
+		err = client.Get(ctx, clnt.ObjectKey{Name: "my-node"}, node)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(node.Annotations).To(HaveKeyWithValue(
+			annotations.Progress,
+			"Pulled 12 of 12 images",
+		))
+	})
+
+	It("Doesn't use more workers than images", func() {
+		loader.pullConcurrency = 10
+		refs := makeRefs(2)
+		err := loader.pullImages(ctx, refs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(images.pulled).To(ConsistOf(refs))
+		Expect(images.max).To(BeNumerically("<=", 2))
+	})
+
+	It("Stops pulling when one of the pulls fails", func() {
+		loader.pullConcurrency = 2
+		refs := makeRefs(20)
+		images.fail = refs[3]
+		err := loader.pullImages(ctx, refs)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("image-3"))
+		Expect(len(images.pulled)).To(BeNumerically("<", len(refs)))
+	})
+
+	It("Rejects invalid pull concurrency", func() {
+		_, err := NewBundleLoader().
+			SetLogger(logger).
+			SetClient(client).
+			SetNode("my-node").
+			SetBundleDir("/var/lib/upgrade").
+			SetPullConcurrency(0).
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("concurrency"))
+	})
+
+	It("Rejects invalid load mode", func() {
+		_, err := NewBundleLoader().
+			SetLogger(logger).
+			SetClient(client).
+			SetNode("my-node").
+			SetBundleDir("/var/lib/upgrade").
+			SetLoadMode("junk").
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("load mode"))
+	})
+
+	It("Accepts valid registry addresses", func() {
+		addresses := []string{
+			"localhost:0",
+			"127.0.0.1:5000",
+			"[::1]:5000",
+			":5000",
+		}
+		for _, address := range addresses {
+			_, err := NewBundleLoader().
+				SetLogger(logger).
+				SetClient(client).
+				SetNode("my-node").
+				SetBundleDir("/var/lib/upgrade").
+				SetRegistryAddress(address).
+				Build()
+			Expect(err).ToNot(HaveOccurred(), "address '%s'", address)
+		}
+	})
+
+	It("Rejects invalid registry addresses", func() {
+		addresses := []string{
+			"",
+			"localhost",
+			"localhost:http",
+			"localhost:70000",
+		}
+		for _, address := range addresses {
+			_, err := NewBundleLoader().
+				SetLogger(logger).
+				SetClient(client).
+				SetNode("my-node").
+				SetBundleDir("/var/lib/upgrade").
+				SetRegistryAddress(address).
+				Build()
+			Expect(err).To(HaveOccurred(), "address '%s'", address)
+		}
+	})
+
+	It("Uses the copier instead of pulling in copy mode", func() {
+		loader.copier = &storageCopier{
+			logger:    logger,
+			bundleDir: filepath.Join(tmp, "bundle"),
+			skopeo:    "/bin/true",
+		}
+		err := loader.pullImages(ctx, []string{"quay.io/openshift/image:latest"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("digest"))
+		Expect(images.pulled).To(BeEmpty())
+	})
+
+	It("Rejects invalid pull timeout", func() {
+		_, err := NewBundleLoader().
+			SetLogger(logger).
+			SetClient(client).
+			SetNode("my-node").
+			SetBundleDir("/var/lib/upgrade").
+			SetPullTimeout(0).
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("pull timeout"))
+	})
+
+	It("Rejects invalid pull attempts", func() {
+		_, err := NewBundleLoader().
+			SetLogger(logger).
+			SetClient(client).
+			SetNode("my-node").
+			SetBundleDir("/var/lib/upgrade").
+			SetPullAttempts(0).
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("pull attempts"))
+	})
+
+	It("Rejects invalid load timeout", func() {
+		_, err := NewBundleLoader().
+			SetLogger(logger).
+			SetClient(client).
+			SetNode("my-node").
+			SetBundleDir("/var/lib/upgrade").
+			SetLoadTimeout(-time.Second).
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("load timeout"))
+	})
+
+	Describe("Timeouts and retries", func() {
+		BeforeEach(func() {
+			var err error
+			loader.pullRetrier, err = NewRetrier().
+				SetLogger(logger).
+				SetAttempts(3).
+				SetDelay(10 * time.Millisecond).
+				SetMaxDelay(10 * time.Millisecond).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Retries pulls that fail", func() {
+			refs := makeRefs(3)
+			images.failures = map[string]int{
+				refs[1]: 2,
+			}
+			err := loader.pullImages(ctx, refs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(images.pulled).To(Equal(refs))
+			Expect(getError()).To(BeEmpty())
+
+			// Check the metrics:
+			retries := loader.metrics.retries
+			Expect(testutil.ToFloat64(retries.WithLabelValues(refs[0]))).To(BeZero())
+			Expect(testutil.ToFloat64(retries.WithLabelValues(refs[1]))).To(Equal(2.0))
+			duration := loader.metrics.duration.WithLabelValues(refs[1])
+			Expect(testutil.ToFloat64(duration)).To(BeNumerically(">", 0))
+		})
+
+		It("Fails and writes the error when all the attempts fail", func() {
+			refs := makeRefs(3)
+			images.failures = map[string]int{
+				refs[1]: 3,
+			}
+			err := loader.pullImages(ctx, refs)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("3 attempts"))
+			Expect(getError()).To(ContainSubstring(refs[1]))
+			failures := loader.metrics.failures.WithLabelValues(refs[1])
+			Expect(testutil.ToFloat64(failures)).To(Equal(1.0))
+		})
+
+		It("Retries pulls that fail with transient errors", func() {
+			refs := makeRefs(1)
+			images.failures = map[string]int{
+				refs[0]: 2,
+			}
+			images.err = grpcstatus.Error(codes.Unavailable, "connection refused")
+			err := loader.pullImages(ctx, refs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(images.attempts[refs[0]]).To(Equal(3))
+		})
+
+		It("Doesn't retry pulls that fail with permanent errors", func() {
+			refs := makeRefs(1)
+			images.failures = map[string]int{
+				refs[0]: 3,
+			}
+			images.err = grpcstatus.Error(
+				codes.Unknown,
+				"reading manifest in quay.io/openshift/image-0: manifest unknown",
+			)
+			err := loader.pullImages(ctx, refs)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("manifest unknown"))
+			Expect(images.attempts[refs[0]]).To(Equal(1))
+			Expect(getError()).To(ContainSubstring("manifest unknown"))
+		})
+
+		It("Classifies pull errors", func() {
+			permanent := []error{
+				grpcstatus.Error(codes.NotFound, "image not found"),
+				grpcstatus.Error(codes.InvalidArgument, "invalid image name"),
+				grpcstatus.Error(codes.Unknown, "name unknown: repository not found"),
+				errors.New("copying image: blob unknown to registry"),
+				errors.New("invalid reference format"),
+			}
+			for _, err := range permanent {
+				Expect(isPermanentPullError(err)).To(BeTrue(), err.Error())
+			}
+			transient := []error{
+				grpcstatus.Error(codes.Unavailable, "connection refused"),
+				grpcstatus.Error(codes.Unknown, "pinging container registry: EOF"),
+				errors.New("connection reset by peer"),
+			}
+			for _, err := range transient {
+				Expect(isPermanentPullError(err)).To(BeFalse(), err.Error())
+			}
+		})
+
+		It("Cancels and retries pulls that exceed the pull timeout", func() {
+			loader.pullTimeout = 50 * time.Millisecond
+			refs := makeRefs(1)
+			images.hang = refs[0]
+			err := loader.pullImages(ctx, refs)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("didn't finish in 50ms"))
+			Expect(images.attempts[refs[0]]).To(Equal(3))
+			Expect(getError()).To(ContainSubstring(refs[0]))
+		})
+
+		It("Cancels the pulls when the load timeout is exceeded", func() {
+			loader.loadTimeout = 100 * time.Millisecond
+			refs := makeRefs(3)
+			images.hang = refs[1]
+			err := loader.populateCRIO(ctx, nil, "quay.io/openshift/release", refs)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("didn't finish in 100ms"))
+			Expect(images.pulled).ToNot(ContainElement(refs[2]))
+			Expect(getError()).To(ContainSubstring("100ms"))
+		})
+	})
+
+	It("Writes the metrics file", func() {
+		loader.metricsFile = "metrics/loader.prom"
+		err := loader.pullImages(ctx, makeRefs(2))
+		Expect(err).ToNot(HaveOccurred())
+		loader.writeMetrics()
+		data, err := os.ReadFile(filepath.Join(tmp, "metrics", "loader.prom"))
+		Expect(err).ToNot(HaveOccurred())
+		text := string(data)
+		Expect(text).To(ContainSubstring(
+			`upgrade_tool_bundle_loader_image_pull_duration_seconds{` +
+				`image="quay.io/openshift/image-1",node="my-node"}`,
+		))
+	})
+
+	Describe("Bundle directory", func() {
+		// writeBundle creates the bundle directory with a file inside and returns its path.
+		writeBundle := func() string {
+			dir := filepath.Join(tmp, "bundle")
+			err := os.MkdirAll(dir, 0700)
+			Expect(err).ToNot(HaveOccurred())
+			err = os.WriteFile(filepath.Join(dir, "metadata.json"), []byte("{}"), 0600)
+			Expect(err).ToNot(HaveOccurred())
+			return dir
+		}
+
+		It("Deletes the bundle directory by default", func() {
+			dir := writeBundle()
+			err := loader.deleteBundle(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dir).ToNot(BeAnExistingFile())
+		})
+
+		It("Keeps the bundle directory when requested", func() {
+			dir := writeBundle()
+			loader.keepBundle = true
+			err := loader.deleteBundle(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dir).To(BeADirectory())
+			Expect(filepath.Join(dir, "metadata.json")).To(BeARegularFile())
+		})
+	})
+
+	Describe("Disk space check", func() {
+		var (
+			storage *registryStorage
+			layer   godigest.Digest
+		)
+
+		// writeImage writes to the bundle an image with a layer of the given digest and size,
+		// and returns its reference.
+		writeImage := func(name string, layer godigest.Digest, size int64) string {
+			data, err := json.Marshal(map[string]any{
+				"schemaVersion": 2,
+				"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+				"layers": []any{
+					map[string]any{
+						"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+						"digest":    layer,
+						"size":      size,
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			digest := godigest.FromBytes(data)
+			err = storage.writeBlob(digest, bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+			err = storage.tagManifest("openshift/"+name, digest.Encoded(), digest)
+			Expect(err).ToNot(HaveOccurred())
+			return "quay.io/openshift/" + name + "@" + digest.String()
+		}
+
+		// writeLayers writes the layers file of the container storage with the given digests.
+		writeLayers := func(digests ...godigest.Digest) {
+			layers := make([]any, len(digests))
+			for i, digest := range digests {
+				layers[i] = map[string]any{
+					"id":                     fmt.Sprintf("layer-%d", i),
+					"compressed-diff-digest": digest,
+				}
+			}
+			data, err := json.Marshal(layers)
+			Expect(err).ToNot(HaveOccurred())
+			file := filepath.Join(tmp, bundleLoaderGraphRoot, "overlay-layers", "layers.json")
+			err = os.MkdirAll(filepath.Dir(file), 0755)
+			Expect(err).ToNot(HaveOccurred())
+			err = os.WriteFile(file, data, 0644)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		// getCondition returns the disk space condition of the node, or nil if it doesn't
+		// exist.
+		getCondition := func() *corev1.NodeCondition {
+			node := &corev1.Node{}
+			err := client.Get(ctx, clnt.ObjectKey{Name: "my-node"}, node)
+			Expect(err).ToNot(HaveOccurred())
+			for i, condition := range node.Status.Conditions {
+				if condition.Type == bundleLoaderSpaceCondition {
+					return &node.Status.Conditions[i]
+				}
+			}
+			return nil
+		}
+
+		BeforeEach(func() {
+			storage = &registryStorage{
+				root: filepath.Join(tmp, "bundle"),
+			}
+			layer = godigest.FromString("my-layer")
+		})
+
+		It("Succeeds if there is enough space", func() {
+			metadata := &Metadata{
+				Release: writeImage("release", layer, 1024),
+			}
+			err := loader.checkSpace(ctx, metadata)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getError()).To(BeEmpty())
+			Expect(getCondition()).To(BeNil())
+		})
+
+		It("Fails and writes the condition if there isn't enough space", func() {
+			metadata := &Metadata{
+				Release: writeImage("release", layer, 1<<60),
+			}
+			err := loader.checkSpace(ctx, metadata)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Not enough disk space"))
+			Expect(getError()).To(ContainSubstring("Not enough disk space"))
+			condition := getCondition()
+			Expect(condition).ToNot(BeNil())
+			Expect(condition.Status).To(Equal(corev1.ConditionTrue))
+			Expect(condition.Reason).To(Equal("InsufficientDiskSpace"))
+		})
+
+		It("Doesn't count layers that are already in the container storage", func() {
+			writeLayers(layer)
+			metadata := &Metadata{
+				Release: writeImage("release", layer, 1<<60),
+			}
+			err := loader.checkSpace(ctx, metadata)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Counts layers shared by several images only once", func() {
+			available, err := availableSpace(tmp)
+			Expect(err).ToNot(HaveOccurred())
+			size := int64(available-bundleLoaderSpaceReserve) / (2 * bundleLoaderSpaceExpansion)
+			metadata := &Metadata{
+				Release: writeImage("release", layer, size),
+				Images: []string{
+					writeImage("image-1", layer, size),
+					writeImage("image-2", layer, size),
+				},
+			}
+			err = loader.checkSpace(ctx, metadata)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Clears the condition when there is enough space again", func() {
+			metadata := &Metadata{
+				Release: writeImage("release", layer, 1<<60),
+			}
+			err := loader.checkSpace(ctx, metadata)
+			Expect(err).To(HaveOccurred())
+			writeLayers(layer)
+			err = loader.checkSpace(ctx, metadata)
+			Expect(err).ToNot(HaveOccurred())
+			condition := getCondition()
+			Expect(condition).ToNot(BeNil())
+			Expect(condition.Status).To(Equal(corev1.ConditionFalse))
+		})
+	})
+
+	Describe("Digest verification", func() {
+		var (
+			ref    string
+			digest string
+		)
+
+		BeforeEach(func() {
+			digest = "sha256:" + strings.Repeat("a", 64)
+			ref = "quay.io/openshift/image@" + digest
+		})
+
+		It("Accepts image whose digest matches the reference", func() {
+			err := loader.pullImages(ctx, []string{ref})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getError()).To(BeEmpty())
+		})
+
+		It("Accepts image whose digest matches the one stored in the bundle", func() {
+			// Write the tag link that the bundle creator writes when the image is
+			// converted, so that the stored manifest has a different digest:
+			stored := "sha256:" + strings.Repeat("b", 64)
+			link := filepath.Join(
+				tmp, "bundle", "docker", "registry", "v2", "repositories",
+				"openshift", "image", "_manifests", "tags", strings.Repeat("a", 64),
+				"current", "link",
+			)
+			err := os.MkdirAll(filepath.Dir(link), 0700)
+			Expect(err).ToNot(HaveOccurred())
+			err = os.WriteFile(link, []byte(stored), 0600)
+			Expect(err).ToNot(HaveOccurred())
+			images.digests = map[string][]string{
+				ref: {stored},
+			}
+			err = loader.pullImages(ctx, []string{ref})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getError()).To(BeEmpty())
+		})
+
+		It("Fails and writes the error if the digest doesn't match", func() {
+			corrupted := "sha256:" + strings.Repeat("c", 64)
+			images.digests = map[string][]string{
+				ref: {corrupted},
+			}
+			err := loader.pullImages(ctx, []string{ref})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("corrupted"))
+			text := getError()
+			Expect(text).To(ContainSubstring(ref))
+			Expect(text).To(ContainSubstring(corrupted))
+		})
+
+		It("Fails if CRI-O doesn't have the image", func() {
+			images.digests = map[string][]string{
+				ref: {},
+			}
+			err := loader.pullImages(ctx, []string{ref})
+			Expect(err).To(HaveOccurred())
+			Expect(getError()).ToNot(BeEmpty())
+		})
+
+		It("Skips images without digest", func() {
+			images.digests = map[string][]string{
+				"quay.io/openshift/image:latest": {"sha256:" + strings.Repeat("c", 64)},
+			}
+			err := loader.pullImages(ctx, []string{"quay.io/openshift/image:latest"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getError()).To(BeEmpty())
+		})
+	})
+
+	Describe("Image store summary", func() {
+		// makeStore creates an image store state with the given images and layers.
+		makeStore := func(used uint64, images []string,
+			layers ...godigest.Digest) *CRIOImageStore {
+			result := &CRIOImageStore{
+				Path:      "/var/lib/containers/storage/overlay-images",
+				UsedBytes: used,
+				Images:    map[string]uint64{},
+				Layers:    map[godigest.Digest]bool{},
+			}
+			for _, image := range images {
+				result.Images[image] = 1
+			}
+			for _, layer := range layers {
+				result.Layers[layer] = true
+			}
+			return result
+		}
+
+		It("Returns nil when one of the states isn't available", func() {
+			store := makeStore(0, nil)
+			Expect(loader.summarizeImageStore(nil, store)).To(BeNil())
+			Expect(loader.summarizeImageStore(store, nil)).To(BeNil())
+		})
+
+		It("Counts only the images and blobs that were added", func() {
+			layer1 := godigest.FromString("layer-1")
+			layer2 := godigest.FromString("layer-2")
+			layer3 := godigest.FromString("layer-3")
+			before := makeStore(1000, []string{"image-1"}, layer1)
+			after := makeStore(3000, []string{"image-1", "image-2"}, layer1, layer2, layer3)
+			summary := loader.summarizeImageStore(before, after)
+			Expect(summary).ToNot(BeNil())
+			Expect(summary.GraphRoot).To(Equal("/var/lib/containers/storage/overlay-images"))
+			Expect(summary.Images).To(Equal(1))
+			Expect(summary.Blobs).To(Equal(2))
+			Expect(summary.Bytes).To(BeEquivalentTo(2000))
+		})
+
+		It("Doesn't count the blobs of the bundle that were already in the store", func() {
+			layer := godigest.FromString("my-layer")
+			before := makeStore(1000, []string{"image-1"}, layer)
+			after := makeStore(1000, []string{"image-1"}, layer)
+			summary := loader.summarizeImageStore(before, after)
+			Expect(summary).ToNot(BeNil())
+			Expect(summary.Images).To(BeZero())
+			Expect(summary.Blobs).To(BeZero())
+		})
+
+		It("Doesn't report negative sizes when the store shrinks", func() {
+			before := makeStore(3000, nil)
+			after := makeStore(1000, nil)
+			summary := loader.summarizeImageStore(before, after)
+			Expect(summary).ToNot(BeNil())
+			Expect(summary.Bytes).To(BeZero())
+		})
+
+		It("Annotates the node with the image store changes", func() {
+			// Read the state before pulling the images, when the container storage
+			// doesn't have any layer yet:
+			before := loader.readImageStore(ctx)
+			Expect(before).ToNot(BeNil())
+
+			// Pull the images and write the layers that CRI-O would have added:
+			err := loader.pullImages(ctx, makeRefs(2))
+			Expect(err).ToNot(HaveOccurred())
+			layers := []any{
+				map[string]any{
+					"id":                     "layer-0",
+					"compressed-diff-digest": godigest.FromString("layer-0"),
+				},
+				map[string]any{
+					"id":                     "layer-1",
+					"compressed-diff-digest": godigest.FromString("layer-1"),
+				},
+			}
+			data, err := json.Marshal(layers)
+			Expect(err).ToNot(HaveOccurred())
+			file := filepath.Join(tmp, bundleLoaderGraphRoot, "overlay-layers", "layers.json")
+			err = os.MkdirAll(filepath.Dir(file), 0755)
+			Expect(err).ToNot(HaveOccurred())
+			err = os.WriteFile(file, data, 0644)
+			Expect(err).ToNot(HaveOccurred())
+			after := loader.readImageStore(ctx)
+			Expect(after).ToNot(BeNil())
+
+			// Write the result:
+			err = loader.writeResult(ctx, loader.summarizeImageStore(before, after))
+			Expect(err).ToNot(HaveOccurred())
+
+			// Check the annotation:
+			node := &corev1.Node{}
+			err = client.Get(ctx, clnt.ObjectKey{Name: "my-node"}, node)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(node.Annotations).To(HaveKey(annotations.ImageStore))
+			Expect(node.Annotations[annotations.ImageStore]).To(MatchJSON(`{
+				"graphRoot": "/var/lib/containers/storage",
+				"images": 2,
+				"blobs": 2,
+				"bytes": 2048
+			}`))
+		})
+
+		It("Doesn't annotate the node when the image store isn't available", func() {
+			err := loader.writeResult(ctx, nil)
+			Expect(err).ToNot(HaveOccurred())
+			node := &corev1.Node{}
+			err = client.Get(ctx, clnt.ObjectKey{Name: "my-node"}, node)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(node.Annotations).ToNot(HaveKey(annotations.ImageStore))
+		})
+	})
+})
+
+// bundleLoaderFakeImageClient is an implementation of the CRI image service that only supports
+// pulling, listing and checking the status of images, remembering the images pulled and the
+// maximum number of concurrent pulls. Each pulled image uses 1 KiB of the image file system.
+type bundleLoaderFakeImageClient struct {
+	criv1.ImageServiceClient
+
+	delay time.Duration
+	fail  string
+
+	// hang is an image whose pulls never finish, till the context is cancelled.
+	hang string
+
+	// failures is the number of times that the pull of each image fails before succeeding.
+	failures map[string]int
+
+	// err is the error returned when a pull fails. If nil a generic error is returned.
+	err error
+
+	// digests are the digests returned for each image. If an image isn't in this map the
+	// digest of the reference is returned.
+	digests map[string][]string
+
+	lock     sync.Mutex
+	current  int
+	max      int
+	pulled   []string
+	attempts map[string]int
+}
+
+func (c *bundleLoaderFakeImageClient) PullImage(ctx context.Context,
+	request *criv1.PullImageRequest, opts ...grpc.CallOption) (*criv1.PullImageResponse, error) {
+	ref := request.Image.Image
+	c.lock.Lock()
+	c.current++
+	if c.current > c.max {
+		c.max = c.current
+	}
+	if c.attempts == nil {
+		c.attempts = map[string]int{}
+	}
+	c.attempts[ref]++
+	failure := c.failures[ref] > 0
+	if failure {
+		c.failures[ref]--
+	}
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		c.current--
+		c.lock.Unlock()
+	}()
+	delay := c.delay
+	if ref == c.hang {
+		delay = time.Hour
+	}
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if ref == c.fail || failure {
+		if c.err != nil {
+			return nil, c.err
+		}
+		return nil, errors.New("failed to pull " + ref)
+	}
+	c.lock.Lock()
+	c.pulled = append(c.pulled, ref)
+	c.lock.Unlock()
+	return &criv1.PullImageResponse{
+		ImageRef: ref,
+	}, nil
+}
+
+func (c *bundleLoaderFakeImageClient) ImageStatus(ctx context.Context,
+	request *criv1.ImageStatusRequest, opts ...grpc.CallOption) (*criv1.ImageStatusResponse,
+	error) {
+	ref := request.Image.Image
+	digests, ok := c.digests[ref]
+	if !ok {
+		index := strings.LastIndex(ref, "@")
+		if index >= 0 {
+			digests = []string{ref[index+1:]}
+		}
+	}
+	repoDigests := make([]string, len(digests))
+	for i, digest := range digests {
+		repoDigests[i] = "quay.io/openshift/image@" + digest
+	}
+	return &criv1.ImageStatusResponse{
+		Image: &criv1.Image{
+			Id:          ref,
+			RepoDigests: repoDigests,
+		},
+	}, nil
+}
+
+func (c *bundleLoaderFakeImageClient) ListImages(ctx context.Context,
+	request *criv1.ListImagesRequest, opts ...grpc.CallOption) (*criv1.ListImagesResponse,
+	error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	images := make([]*criv1.Image, len(c.pulled))
+	for i, ref := range c.pulled {
+		images[i] = &criv1.Image{
+			Id:    ref,
+			Size_: 1024,
+		}
+	}
+	return &criv1.ListImagesResponse{
+		Images: images,
+	}, nil
+}
+
+func (c *bundleLoaderFakeImageClient) ImageFsInfo(ctx context.Context,
+	request *criv1.ImageFsInfoRequest, opts ...grpc.CallOption) (*criv1.ImageFsInfoResponse,
+	error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return &criv1.ImageFsInfoResponse{
+		ImageFilesystems: []*criv1.FilesystemUsage{{
+			FsId: &criv1.FilesystemIdentifier{
+				Mountpoint: "/var/lib/containers/storage",
+			},
+			UsedBytes: &criv1.UInt64Value{
+				Value: uint64(1024 * len(c.pulled)),
+			},
+		}},
+	}, nil
+}
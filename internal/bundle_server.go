@@ -16,14 +16,28 @@ package internal
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
 	clnt "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -31,26 +45,54 @@ import (
 // bundle file. Don't create instances of this type directly, use the NewBundleServer function
 // instead.
 type BundleServerBuilder struct {
-	logger     logr.Logger
-	rootDir    string
-	bundleFile string
-	listenAddr string
+	logger      logr.Logger
+	rootDir     string
+	bundleFile  string
+	bundleDir   string
+	replicaFile string
+	listenAddr  string
+	tokenFile   string
+
+	maxBandwidth       int64
+	maxClientBandwidth int64
+	maxDownloads       int
+	drainTimeout       time.Duration
 }
 
 // BundleServer is an HTTP server that servers the bundle file. Don't instances of this type
 // directly, use the NewBundleServer function instead.
 type BundleServer struct {
-	logger     logr.Logger
-	client     clnt.Client
-	rootDir    string
-	bundleFile string
-	listenAddr string
+	logger      logr.Logger
+	client      clnt.Client
+	rootDir     string
+	bundleFile  string
+	bundleDir   string
+	replicaFile string
+	listenAddr  string
+	token       string
+	metrics     *bundleServerMetrics
+	validator   *bundleServerValidator
+	digests     *bundleServerDigests
+
+	// limiter limits the bandwidth used by all the downloads, and clientBandwidth the bandwidth
+	// used by each download. The downloads channel is used as a semaphore to limit the number
+	// of concurrent downloads.
+	limiter         *rate.Limiter
+	clientBandwidth int64
+	downloads       chan struct{}
+
+	// transfers is the number of transfers in progress, used to report how many were aborted
+	// when the server is stopped.
+	transfers    *atomic.Int64
+	drainTimeout time.Duration
 }
 
 // NewBundleServer creates a builder that can then be used to configure and create bundle
 // servers.
 func NewBundleServer() *BundleServerBuilder {
-	return &BundleServerBuilder{}
+	return &BundleServerBuilder{
+		drainTimeout: bundleServerDefaultDrainTimeout,
+	}
 }
 
 // SetLogger sets the logger that the server will use to write log messages. This is mandatory.
@@ -69,18 +111,75 @@ func (b *BundleServerBuilder) SetRootDir(value string) *BundleServerBuilder {
 
 // SetBundleFile sets the location of the bundle file. If that file exists the server will respond
 // with '200 Ok', otherwise it will return with '404 Not found'. Note that this is mandatory even if
-// the file doesn't exist.
+// the file doesn't exist, unless the bundle directory is specified.
 func (b *BundleServerBuilder) SetBundleFile(value string) *BundleServerBuilder {
 	b.bundleFile = value
 	return b
 }
 
+// SetBundleDir sets the location of a directory containing multiple bundle files. The server will
+// list them in the '/index' endpoint, including their version, architecture, digest and size, and
+// will serve them from the '/bundles/{name}' endpoint. This is optional.
+func (b *BundleServerBuilder) SetBundleDir(value string) *BundleServerBuilder {
+	b.bundleDir = value
+	return b
+}
+
+// SetReplicaFile sets the location of the replica of the bundle file that is created by the bundle
+// extractor when replication is enabled. If the bundle file doesn't exist but this one does then
+// the server will serve it. This is optional.
+func (b *BundleServerBuilder) SetReplicaFile(value string) *BundleServerBuilder {
+	b.replicaFile = value
+	return b
+}
+
 // SetListenAddr sets the address where this server should listen. This is mandatory.
 func (b *BundleServerBuilder) SetListenAddr(value string) *BundleServerBuilder {
 	b.listenAddr = value
 	return b
 }
 
+// SetTokenFile sets the file that contains the token that clients must send in the 'Authorization'
+// header, using the 'Bearer' scheme. Requests without that token will be rejected with '401
+// Unauthorized'. Note that this file isn't relative to the root directory, as it is intended to be
+// mounted from a secret. This is optional, and when not specified the server doesn't require
+// authentication.
+func (b *BundleServerBuilder) SetTokenFile(value string) *BundleServerBuilder {
+	b.tokenFile = value
+	return b
+}
+
+// SetMaxBandwidth sets the maximum number of bytes per second that the server will send, adding all
+// the downloads. This is optional, and the default is to not limit the bandwidth.
+func (b *BundleServerBuilder) SetMaxBandwidth(value int64) *BundleServerBuilder {
+	b.maxBandwidth = value
+	return b
+}
+
+// SetMaxClientBandwidth sets the maximum number of bytes per second that the server will send to
+// each client. This is optional, and the default is to not limit the bandwidth.
+func (b *BundleServerBuilder) SetMaxClientBandwidth(value int64) *BundleServerBuilder {
+	b.maxClientBandwidth = value
+	return b
+}
+
+// SetMaxDownloads sets the maximum number of downloads that the server will handle at the same
+// time. When this limit is reached the server will respond to additional download requests with
+// '503 Service Unavailable', and clients are expected to try again later. This is optional, and the
+// default is to not limit the number of downloads.
+func (b *BundleServerBuilder) SetMaxDownloads(value int) *BundleServerBuilder {
+	b.maxDownloads = value
+	return b
+}
+
+// SetDrainTimeout sets the maximum time that the server will wait for downloads in progress to
+// finish when it is stopped. Downloads that don't finish in that time will be aborted. This is
+// optional, and the default is 30 seconds.
+func (b *BundleServerBuilder) SetDrainTimeout(value time.Duration) *BundleServerBuilder {
+	b.drainTimeout = value
+	return b
+}
+
 // Build uses the data stored in the builder to create and configure a new bundle server.
 func (b *BundleServerBuilder) Build() (result *BundleServer, err error) {
 	// Check parameters:
@@ -88,84 +187,534 @@ func (b *BundleServerBuilder) Build() (result *BundleServer, err error) {
 		err = errors.New("logger is mandatory")
 		return
 	}
-	if b.bundleFile == "" {
-		err = errors.New("bundle file is mandatory")
+	if b.bundleFile == "" && b.bundleDir == "" {
+		err = errors.New("bundle file or bundle directory is mandatory")
 		return
 	}
 	if b.listenAddr == "" {
 		err = errors.New("listen address is mandatory")
 		return
 	}
+	if b.maxBandwidth < 0 {
+		err = fmt.Errorf(
+			"maximum bandwidth %d isn't valid, it must be greater than or equal to zero",
+			b.maxBandwidth,
+		)
+		return
+	}
+	if b.maxClientBandwidth < 0 {
+		err = fmt.Errorf(
+			"maximum client bandwidth %d isn't valid, it must be greater than or equal "+
+				"to zero",
+			b.maxClientBandwidth,
+		)
+		return
+	}
+	if b.drainTimeout < 0 {
+		err = fmt.Errorf(
+			"drain timeout %s isn't valid, it must be greater than or equal to zero",
+			b.drainTimeout,
+		)
+		return
+	}
+	if b.maxDownloads < 0 {
+		err = fmt.Errorf(
+			"maximum downloads %d isn't valid, it must be greater than or equal to zero",
+			b.maxDownloads,
+		)
+		return
+	}
+
+	// Read the token:
+	var token string
+	if b.tokenFile != "" {
+		token, err = readTokenFile(b.tokenFile)
+		if err != nil {
+			return
+		}
+	}
 
 	// Create and populate the object:
 	result = &BundleServer{
-		logger:     b.logger,
-		rootDir:    b.rootDir,
-		bundleFile: b.bundleFile,
-		listenAddr: b.listenAddr,
+		logger:      b.logger,
+		rootDir:     b.rootDir,
+		bundleFile:  b.bundleFile,
+		bundleDir:   b.bundleDir,
+		replicaFile: b.replicaFile,
+		listenAddr:  b.listenAddr,
+		token:       token,
+		metrics:     newBundleServerMetrics(),
+		digests:     &bundleServerDigests{},
+
+		limiter:         NewBandwidthLimiter(b.maxBandwidth),
+		clientBandwidth: b.maxClientBandwidth,
+		transfers:       &atomic.Int64{},
+		drainTimeout:    b.drainTimeout,
+	}
+	if b.maxDownloads > 0 {
+		result.downloads = make(chan struct{}, b.maxDownloads)
+	}
+	result.validator = &bundleServerValidator{
+		logger:  b.logger,
+		handler: result.makeHandler(),
 	}
 	return
 }
 
+// Run runs the server till the context is cancelled. When that happens the server stops accepting
+// new connections and waits for the downloads in progress to finish, up to the drain timeout.
 func (s *BundleServer) Run(ctx context.Context) error {
-	handler := &bundleServerHandler{
-		logger:     s.logger,
-		rootDir:    s.rootDir,
-		bundleFile: s.bundleFile,
+	go s.validator.run(ctx)
+	listener, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler: s.makeHandler(),
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+	s.logger.Info(
+		"Server started",
+		"address", listener.Addr().String(),
+	)
+	select {
+	case err = <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Stop accepting new connections and wait for the downloads in progress:
+	s.logger.Info(
+		"Stopping server",
+		"transfers", s.transfers.Load(),
+		"timeout", s.drainTimeout.String(),
+	)
+	drainCtx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	err = server.Shutdown(drainCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		aborted := s.transfers.Load()
+		err = server.Close()
+		s.logger.Info(
+			"Drain timeout expired, transfers in progress were aborted",
+			"aborted", aborted,
+		)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	s.logger.Info(
+		"Server stopped",
+		"aborted", 0,
+	)
+	return nil
+}
+
+func (s *BundleServer) makeHandler() *bundleServerHandler {
+	return &bundleServerHandler{
+		logger:      s.logger,
+		rootDir:     s.rootDir,
+		bundleFile:  s.bundleFile,
+		bundleDir:   s.bundleDir,
+		replicaFile: s.replicaFile,
+		token:       s.token,
+		metrics:     s.metrics,
+		validator:   s.validator,
+		digests:     s.digests,
+
+		limiter:         s.limiter,
+		clientBandwidth: s.clientBandwidth,
+		downloads:       s.downloads,
+		transfers:       s.transfers,
 	}
-	return http.ListenAndServe(s.listenAddr, handler)
 }
 
 type bundleServerHandler struct {
-	logger     logr.Logger
-	rootDir    string
-	bundleFile string
+	logger      logr.Logger
+	rootDir     string
+	bundleFile  string
+	bundleDir   string
+	replicaFile string
+	token       string
+	metrics     *bundleServerMetrics
+	validator   *bundleServerValidator
+	digests     *bundleServerDigests
+
+	limiter         *rate.Limiter
+	clientBandwidth int64
+	downloads       chan struct{}
+	transfers       *atomic.Int64
 }
 
 func (h *bundleServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodHead:
-		h.serveHead(w, r)
-	case http.MethodGet:
-		h.serveGet(w, r)
-	default:
+	// The metrics and probe endpoints don't require authentication, so that they can be used by
+	// the monitoring stack of the cluster and by the kubelet:
+	switch r.URL.Path {
+	case bundleServerMetricsPath:
+		h.metrics.handler.ServeHTTP(w, r)
+		return
+	case bundleServerHealthPath:
+		h.serveHealth(w, r)
+		return
+	case bundleServerReadyPath:
+		h.serveReady(w, r)
+		return
+	}
+
+	// Wrap the response writer so that we can count the bytes sent and the errors:
+	writer := &bundleServerResponseWriter{
+		ResponseWriter: w,
+		metrics:        h.metrics,
+	}
+	h.serve(writer, r)
+	if writer.code >= http.StatusBadRequest {
+		h.metrics.errors.WithLabelValues(strconv.Itoa(writer.code)).Inc()
+	}
+}
+
+func (h *bundleServerHandler) serve(w *bundleServerResponseWriter, r *http.Request) {
+	if !h.checkToken(r) {
+		h.logger.Info(
+			"Request isn't authorized",
+			"method", r.Method,
+			"remote", r.RemoteAddr,
+		)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="bundle-server"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodHead && r.Method != http.MethodGet {
 		h.logger.Info(
 			"Method isn't implemented",
 			"method", r.Method,
 		)
 		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case r.URL.Path == bundleServerIndexPath:
+		h.serveIndex(w, r)
+	case r.URL.Path == bundleServerInfoPath:
+		h.serveInfo(w, r, "")
+	case strings.HasPrefix(r.URL.Path, bundleServerInfoPath+"/"):
+		h.serveInfo(w, r, strings.TrimPrefix(r.URL.Path, bundleServerInfoPath+"/"))
+	case strings.HasPrefix(r.URL.Path, bundleServerBundlesPath):
+		h.serveBundle(w, r)
+	default:
+		h.serveDefault(w, r)
 	}
 }
 
-func (h *bundleServerHandler) serveHead(w http.ResponseWriter, r *http.Request) {
-	exists, err := h.checkFile()
+// serveHealth always responds with '200 OK', as the server is healthy if it can respond.
+func (h *bundleServerHandler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// serveReady responds with '200 OK' if the bundle file exists and its digest has been validated,
+// and with '503 Service Unavailable' otherwise.
+func (h *bundleServerHandler) serveReady(w http.ResponseWriter, r *http.Request) {
+	ready, reason := h.validator.status()
+	w.Header().Set("Content-Type", "text/plain")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, reason)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// serveDefault sends the bundle file, or the replica if the bundle file doesn't exist.
+func (h *bundleServerHandler) serveDefault(w *bundleServerResponseWriter, r *http.Request) {
+	if h.bundleFile == "" {
+		h.logger.Info("Bundle file hasn't been configured")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	file, err := h.findFile()
 	if err != nil {
 		h.logger.Error(err, "Failed to check file")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if !exists {
+	if file == "" {
 		h.logger.Info("File doesn't exist")
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	h.logger.Info("Sent response")
+	h.serveFile(w, r, file)
 }
 
-func (h *bundleServerHandler) serveGet(w http.ResponseWriter, r *http.Request) {
-	exists, err := h.checkFile()
+// serveBundle sends one of the bundle files of the bundle directory, or the replica.
+func (h *bundleServerHandler) serveBundle(w *bundleServerResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, bundleServerBundlesPath)
+	file, err := h.lookupBundle(name)
 	if err != nil {
 		h.logger.Error(err, "Failed to check file")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if !exists {
-		h.logger.Info("File doesn't exist")
+	if file == "" {
+		h.logger.Info(
+			"Bundle doesn't exist",
+			"name", name,
+		)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	file := h.absolutePath(h.bundleFile)
+	h.serveFile(w, r, file)
+}
+
+// serveInfo sends the digest and the metadata of a bundle, so that clients can decide if they need
+// to download it, and can validate it after downloading. If the name is empty it describes the
+// bundle file, or the replica, otherwise it describes the bundle with that name.
+func (h *bundleServerHandler) serveInfo(w *bundleServerResponseWriter, r *http.Request,
+	name string) {
+	var file string
+	var err error
+	if name == "" {
+		if h.bundleFile != "" {
+			file, err = h.findFile()
+		}
+	} else {
+		file, err = h.lookupBundle(name)
+	}
+	if err != nil {
+		h.logger.Error(err, "Failed to check file")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if file == "" {
+		h.logger.Info(
+			"Bundle doesn't exist",
+			"name", name,
+		)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	info, err := h.makeInfo(file)
+	if err != nil {
+		h.logger.Error(
+			err,
+			"Failed to get bundle information",
+			"file", file,
+		)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.writeJSON(w, r, info)
+	h.logger.Info(
+		"Sent bundle information",
+		"file", file,
+		"digest", info.Digest,
+	)
+}
+
+func (h *bundleServerHandler) makeInfo(file string) (result *BundleInfo, err error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err := reader.Close()
+		if err != nil {
+			h.logger.Error(
+				err,
+				"Failed to close bundle file",
+				"file", file,
+			)
+		}
+	}()
+	stat, err := reader.Stat()
+	if err != nil {
+		return
+	}
+	metadata, err := readBundleMetadata(reader)
+	if err != nil {
+		return
+	}
+	digest, err := h.digests.digest(file)
+	if err != nil {
+		return
+	}
+	result = &BundleInfo{
+		Name:     filepath.Base(file),
+		Digest:   "sha256:" + digest,
+		Size:     stat.Size(),
+		Metadata: metadata,
+	}
+	return
+}
+
+// lookupBundle returns the absolute path of the bundle file with the given name, or an empty
+// string if it doesn't exist.
+func (h *bundleServerHandler) lookupBundle(name string) (result string, err error) {
+	file := h.bundlePath(name)
+	if file == "" {
+		return
+	}
+	_, err = os.Stat(file)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	result = file
+	return
+}
+
+// serveIndex sends the list of bundles available in the bundle directory.
+func (h *bundleServerHandler) serveIndex(w *bundleServerResponseWriter, r *http.Request) {
+	index, err := h.makeIndex()
+	if err != nil {
+		h.logger.Error(err, "Failed to create index")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.writeJSON(w, r, index)
+	h.logger.Info(
+		"Sent index",
+		"bundles", len(index.Bundles),
+	)
+}
+
+// writeJSON sends the given value as the JSON body of the response.
+func (h *bundleServerHandler) writeJSON(w http.ResponseWriter, r *http.Request, value any) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		h.logger.Error(err, "Failed to marshal response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, err = w.Write(data)
+		if err != nil {
+			h.logger.Error(err, "Failed to send response")
+		}
+	}
+}
+
+// bundlePath returns the absolute path of the bundle file with the given name. That is the replica
+// if the name matches, or else a file inside the bundle directory. Returns an empty string if the
+// name isn't valid.
+func (h *bundleServerHandler) bundlePath(name string) string {
+	if !h.validBundleName(name) {
+		return ""
+	}
+	if h.replicaFile != "" && name == filepath.Base(h.replicaFile) {
+		return h.absolutePath(h.replicaFile)
+	}
+	if h.bundleDir != "" {
+		return filepath.Join(h.absolutePath(h.bundleDir), name)
+	}
+	return ""
+}
+
+// makeIndex creates the index of the bundles available in the bundle directory, including also the
+// replica if it exists. The version and architecture are read from the metadata of each bundle,
+// and the digest from the '.sha256' file that is created next to the bundle file, if it exists.
+func (h *bundleServerHandler) makeIndex() (result *BundleIndex, err error) {
+	index := &BundleIndex{
+		Bundles: []BundleIndexEntry{},
+	}
+	var files []string
+	if h.bundleDir != "" {
+		var entries []os.DirEntry
+		entries, err = os.ReadDir(h.absolutePath(h.bundleDir))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		err = nil
+		for _, entry := range entries {
+			if h.validBundleName(entry.Name()) && entry.Type().IsRegular() {
+				files = append(files, h.bundlePath(entry.Name()))
+			}
+		}
+	}
+	if h.replicaFile != "" {
+		var exists bool
+		exists, err = h.checkFile(h.replicaFile)
+		if err != nil {
+			return
+		}
+		if exists {
+			files = append(files, h.absolutePath(h.replicaFile))
+		}
+	}
+	for _, file := range files {
+		var entry BundleIndexEntry
+		entry, err = h.makeIndexEntry(file)
+		if err != nil {
+			return
+		}
+		index.Bundles = append(index.Bundles, entry)
+	}
+	result = index
+	return
+}
+
+func (h *bundleServerHandler) makeIndexEntry(file string) (result BundleIndexEntry, err error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err := reader.Close()
+		if err != nil {
+			h.logger.Error(
+				err,
+				"Failed to close bundle file",
+				"file", file,
+			)
+		}
+	}()
+	info, err := reader.Stat()
+	if err != nil {
+		return
+	}
+	result.Name = filepath.Base(file)
+	result.Size = info.Size()
+	metadata, err := readBundleMetadata(reader)
+	if err != nil {
+		return
+	}
+	if metadata != nil {
+		result.Version = metadata.Version
+		result.Arch = metadata.Arch
+	}
+	digest, err := readBundleDigest(file)
+	if err != nil || digest == "" {
+		return
+	}
+	result.Digest = "sha256:" + digest
+	return
+}
+
+// validBundleName checks that the given name is the name of a bundle file inside the bundle
+// directory. This is used to make sure that clients can't access other files.
+func (h *bundleServerHandler) validBundleName(name string) bool {
+	return name != "" &&
+		!strings.ContainsAny(name, "/\\") &&
+		!strings.HasPrefix(name, ".") &&
+		strings.HasSuffix(name, ".tar")
+}
+
+// serveFile sends the given bundle file. It uses the 'http.ServeContent' function so that range
+// requests are supported, which allows clients to resume interrupted downloads. The entity tag is
+// calculated from the size and modification time of the file, so that clients can use the
+// 'If-Range' header to make sure that they don't mix parts of different files.
+func (h *bundleServerHandler) serveFile(w *bundleServerResponseWriter, r *http.Request,
+	file string) {
 	stream, err := os.Open(file)
 	if err != nil {
 		h.logger.Error(err, "Failed to open file")
@@ -178,24 +727,135 @@ func (h *bundleServerHandler) serveGet(w http.ResponseWriter, r *http.Request) {
 			h.logger.Error(err, "Failed to close file")
 		}
 	}()
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/octet-stream")
-	h.logger.Info("Sending file")
-	before := time.Now()
-	_, err = io.Copy(w, stream)
+	info, err := stream.Stat()
 	if err != nil {
-		h.logger.Error(err, "Failed to send file")
+		h.logger.Error(err, "Failed to get file details")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	if r.Method == http.MethodHead {
+		http.ServeContent(w, r, file, info.ModTime(), stream)
+		h.logger.Info("Sent response")
 		return
 	}
+	node := h.clientNode(r)
+	if h.downloads != nil {
+		select {
+		case h.downloads <- struct{}{}:
+			defer func() {
+				<-h.downloads
+			}()
+		default:
+			h.logger.Info(
+				"Too many downloads, will ask client to try later",
+				"node", node,
+				"max", cap(h.downloads),
+			)
+			w.Header().Set("Retry-After", bundleServerRetryAfter)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+	h.logger.Info(
+		"Sending file",
+		"file", file,
+		"range", r.Header.Get("Range"),
+		"node", node,
+	)
+	h.metrics.active.Inc()
+	h.transfers.Add(1)
+	defer func() {
+		h.metrics.active.Dec()
+		h.transfers.Add(-1)
+	}()
+	throttled := &bundleServerThrottledWriter{
+		ResponseWriter: w,
+		writer: ThrottleWriter(
+			r.Context(), w,
+			h.limiter, NewBandwidthLimiter(h.clientBandwidth),
+		),
+	}
+	before := time.Now()
+	http.ServeContent(throttled, r, file, info.ModTime(), stream)
 	elapsed := time.Since(before)
+
+	// Check if the complete body was sent, as otherwise the transfer was aborted, for example
+	// because the client closed the connection:
+	if w.code != http.StatusOK && w.code != http.StatusPartialContent {
+		return
+	}
+	length, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+	if err != nil || w.sent < length {
+		h.logger.Info(
+			"Transfer was aborted",
+			"node", node,
+			"sent", w.sent,
+			"elapsed", elapsed.String(),
+		)
+		h.metrics.errors.WithLabelValues(bundleServerAbortedReason).Inc()
+		return
+	}
+	h.metrics.completed.WithLabelValues(node).Inc()
 	h.logger.Info(
 		"Sent file",
+		"node", node,
+		"sent", w.sent,
 		"elapsed", elapsed.String(),
 	)
 }
 
-func (h *bundleServerHandler) checkFile() (exists bool, err error) {
-	file := h.absolutePath(h.bundleFile)
+// clientNode returns the name of the node that sent the request, taken from the header that the
+// extractor adds. If that header isn't present it returns the IP address of the client.
+func (h *bundleServerHandler) clientNode(r *http.Request) string {
+	node := r.Header.Get(bundleServerNodeHeader)
+	if node != "" {
+		return node
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkToken checks that the request contains the bearer token. Always returns true if no token has
+// been configured.
+func (h *bundleServerHandler) checkToken(r *http.Request) bool {
+	if h.token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+// findFile returns the absolute path of the file that should be served, either the bundle file or
+// the replica file. Returns an empty string if none of them exist.
+func (h *bundleServerHandler) findFile() (result string, err error) {
+	candidates := []string{h.bundleFile}
+	if h.replicaFile != "" {
+		candidates = append(candidates, h.replicaFile)
+	}
+	for _, candidate := range candidates {
+		var exists bool
+		exists, err = h.checkFile(candidate)
+		if err != nil {
+			return
+		}
+		if exists {
+			result = h.absolutePath(candidate)
+			return
+		}
+	}
+	return
+}
+
+func (h *bundleServerHandler) checkFile(relative string) (exists bool, err error) {
+	file := h.absolutePath(relative)
 	_, err = os.Stat(file)
 	if errors.Is(err, os.ErrNotExist) {
 		err = nil
@@ -215,3 +875,465 @@ func (h *bundleServerHandler) absolutePath(relative string) string {
 	}
 	return absolute
 }
+
+// readTokenFile reads a bearer token from a file, removing the leading and trailing white space.
+func readTokenFile(file string) (result string, err error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	result = strings.TrimSpace(string(data))
+	if result == "" {
+		err = fmt.Errorf("token file '%s' is empty", file)
+		return
+	}
+	return
+}
+
+// bundleServerValidator checks periodically that the bundle file exists and that its digest matches
+// the content of the digest file created next to it, so that the readiness endpoint can report it.
+// The digest is calculated only when the bundle file or the digest file change, as that is
+// expensive for large bundles.
+type bundleServerValidator struct {
+	logger  logr.Logger
+	handler *bundleServerHandler
+	lock    sync.Mutex
+	ready   bool
+	reason  string
+	checked bundleServerValidatorState
+}
+
+// bundleServerValidatorState contains the details of the bundle file and of the digest file that
+// are used to detect changes. The details of the digest file are zero when it doesn't exist.
+type bundleServerValidatorState struct {
+	file          string
+	size          int64
+	modTime       time.Time
+	digestSize    int64
+	digestModTime time.Time
+}
+
+func (s bundleServerValidatorState) equal(other bundleServerValidatorState) bool {
+	return s.file == other.file &&
+		s.size == other.size &&
+		s.modTime.Equal(other.modTime) &&
+		s.digestSize == other.digestSize &&
+		s.digestModTime.Equal(other.digestModTime)
+}
+
+func (v *bundleServerValidator) run(ctx context.Context) {
+	ticker := time.NewTicker(bundleServerValidateInterval)
+	defer ticker.Stop()
+	for {
+		v.check()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// status returns the result of the last check, and the reason if the server isn't ready.
+func (v *bundleServerValidator) status() (ready bool, reason string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	ready = v.ready
+	reason = v.reason
+	if !ready && reason == "" {
+		reason = "bundle file hasn't been validated yet"
+	}
+	return
+}
+
+func (v *bundleServerValidator) check() {
+	// When there is no bundle file the server only serves the bundle directory, and then there
+	// is nothing to wait for:
+	if v.handler.bundleFile == "" {
+		v.update(true, "")
+		return
+	}
+
+	// Find the file and check if it or its digest file have changed since the last check:
+	file, err := v.handler.findFile()
+	if err != nil {
+		v.logger.Error(err, "Failed to check file")
+		v.update(false, err.Error())
+		return
+	}
+	if file == "" {
+		v.update(false, "bundle file doesn't exist")
+		return
+	}
+	state, err := v.state(file)
+	if err != nil {
+		v.logger.Error(err, "Failed to get file details")
+		v.update(false, err.Error())
+		return
+	}
+	v.lock.Lock()
+	changed := !state.equal(v.checked)
+	v.lock.Unlock()
+	if !changed {
+		return
+	}
+
+	// The result is saved only when the check reaches a conclusion, so that failures to read
+	// the files are retried in the next check even if the files don't change:
+	ready, reason, err := v.validate(file)
+	if err != nil {
+		v.update(false, err.Error())
+		return
+	}
+	v.lock.Lock()
+	v.checked = state
+	v.lock.Unlock()
+	v.update(ready, reason)
+}
+
+// state returns the details of the given bundle file and of its digest file.
+func (v *bundleServerValidator) state(file string) (result bundleServerValidatorState,
+	err error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+	result.file = file
+	result.size = info.Size()
+	result.modTime = info.ModTime()
+	info, err = os.Stat(bundleDigestFile(file))
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	result.digestSize = info.Size()
+	result.digestModTime = info.ModTime()
+	return
+}
+
+// validate checks the digest of the given bundle file. The digest file is required for the bundle
+// file, but not for the replica, as the bundle extractor doesn't create it. In that case the digest
+// is calculated and saved, so that it is ready to be sent to the clients.
+func (v *bundleServerValidator) validate(file string) (ready bool, reason string, err error) {
+	expected, err := readBundleDigest(file)
+	if err != nil {
+		v.logger.Error(err, "Failed to read digest file")
+		return
+	}
+	replica := v.handler.replicaFile != "" &&
+		file == v.handler.absolutePath(v.handler.replicaFile)
+	if expected == "" && !replica {
+		v.logger.Info(
+			"Digest file doesn't exist, can't validate the bundle file",
+			"file", file,
+			"digest_file", bundleDigestFile(file),
+		)
+		reason = fmt.Sprintf(
+			"digest file '%s' doesn't exist, can't validate the bundle file",
+			bundleDigestFile(file),
+		)
+		return
+	}
+	v.update(false, "bundle file is being validated")
+	v.logger.Info(
+		"Validating bundle file",
+		"file", file,
+	)
+	if expected == "" {
+		var actual string
+		actual, err = v.handler.digests.digest(file)
+		if err != nil {
+			v.logger.Error(err, "Failed to calculate digest")
+			return
+		}
+		v.logger.Info(
+			"Calculated digest of bundle replica",
+			"file", file,
+			"digest", actual,
+		)
+		ready = true
+		return
+	}
+	actual, err := calculateFileDigest(file)
+	if err != nil {
+		v.logger.Error(err, "Failed to calculate digest")
+		return
+	}
+	if actual != expected {
+		v.logger.Info(
+			"Bundle file digest doesn't match",
+			"file", file,
+			"expected", expected,
+			"actual", actual,
+		)
+		reason = fmt.Sprintf(
+			"digest of bundle file is '%s' but expected '%s'",
+			actual, expected,
+		)
+		return
+	}
+	v.logger.Info(
+		"Bundle file is valid",
+		"file", file,
+		"digest", actual,
+	)
+	ready = true
+	return
+}
+
+func (v *bundleServerValidator) update(ready bool, reason string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.ready = ready
+	v.reason = reason
+}
+
+// bundleServerDigests returns the digests of bundle files. The digest is read from the digest file
+// created next to the bundle file if it exists. Otherwise, for example for replicas, it is
+// calculated and saved in memory, so that it is calculated again only if the file changes.
+type bundleServerDigests struct {
+	lock    sync.Mutex
+	entries map[string]bundleServerDigest
+}
+
+type bundleServerDigest struct {
+	size    int64
+	modTime time.Time
+	value   string
+}
+
+func (d *bundleServerDigests) digest(file string) (result string, err error) {
+	result, err = readBundleDigest(file)
+	if err != nil || result != "" {
+		return
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+	d.lock.Lock()
+	entry, ok := d.entries[file]
+	d.lock.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		result = entry.value
+		return
+	}
+	result, err = calculateFileDigest(file)
+	if err != nil {
+		return
+	}
+	d.lock.Lock()
+	if d.entries == nil {
+		d.entries = map[string]bundleServerDigest{}
+	}
+	d.entries[file] = bundleServerDigest{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		value:   result,
+	}
+	d.lock.Unlock()
+	return
+}
+
+// bundleServerMetrics contains the Prometheus metrics of the bundle server. They are registered in
+// a registry owned by the server instead of the global one, so that multiple servers can be created
+// in the same process, for example in tests.
+type bundleServerMetrics struct {
+	registry  *prometheus.Registry
+	handler   http.Handler
+	sent      prometheus.Counter
+	active    prometheus.Gauge
+	completed *prometheus.CounterVec
+	errors    *prometheus.CounterVec
+}
+
+func newBundleServerMetrics() *bundleServerMetrics {
+	registry := prometheus.NewRegistry()
+	sent := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: bundleServerMetricsNamespace,
+		Subsystem: bundleServerMetricsSubsystem,
+		Name:      "sent_bytes_total",
+		Help:      "Number of bytes of bundle files sent to clients.",
+	})
+	active := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: bundleServerMetricsNamespace,
+		Subsystem: bundleServerMetricsSubsystem,
+		Name:      "active_downloads",
+		Help:      "Number of bundle downloads in progress.",
+	})
+	completed := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: bundleServerMetricsNamespace,
+			Subsystem: bundleServerMetricsSubsystem,
+			Name:      "completed_downloads_total",
+			Help:      "Number of bundle downloads completed, per node.",
+		},
+		[]string{"node"},
+	)
+	failures := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: bundleServerMetricsNamespace,
+			Subsystem: bundleServerMetricsSubsystem,
+			Name:      "errors_total",
+			Help: "Number of failed requests, per HTTP status code, and of " +
+				"aborted transfers.",
+		},
+		[]string{"reason"},
+	)
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		sent,
+		active,
+		completed,
+		failures,
+	)
+	return &bundleServerMetrics{
+		registry:  registry,
+		handler:   promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		sent:      sent,
+		active:    active,
+		completed: completed,
+		errors:    failures,
+	}
+}
+
+// bundleServerResponseWriter wraps the response writer to save the status code and to count the
+// bytes sent.
+type bundleServerResponseWriter struct {
+	http.ResponseWriter
+	metrics *bundleServerMetrics
+	code    int
+	sent    int64
+}
+
+func (w *bundleServerResponseWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *bundleServerResponseWriter) Write(data []byte) (n int, err error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err = w.ResponseWriter.Write(data)
+	w.sent += int64(n)
+	w.metrics.sent.Add(float64(n))
+	return
+}
+
+// bundleServerThrottledWriter replaces the Write method of the response writer with a writer that
+// limits the bandwidth.
+type bundleServerThrottledWriter struct {
+	http.ResponseWriter
+	writer io.Writer
+}
+
+func (w *bundleServerThrottledWriter) Write(data []byte) (n int, err error) {
+	return w.writer.Write(data)
+}
+
+// BundleIndex is the list of bundles that is returned by the '/index' endpoint of the bundle
+// server.
+type BundleIndex struct {
+	Bundles []BundleIndexEntry `json:"bundles"`
+}
+
+// BundleInfo is the response of the '/info' endpoint of the bundle server. It contains the digest
+// and the metadata of the bundle, without the rest of the content.
+type BundleInfo struct {
+	Name     string    `json:"name"`
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	Metadata *Metadata `json:"metadata,omitempty"`
+}
+
+// BundleIndexEntry describes one of the bundles available in the bundle server. The bundle can be
+// downloaded from the '/bundles/{name}' endpoint.
+type BundleIndexEntry struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Arch    string `json:"arch,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+	Size    int64  `json:"size"`
+}
+
+const (
+	bundleServerIndexPath   = "/index"
+	bundleServerBundlesPath = "/bundles/"
+	bundleServerInfoPath    = "/info"
+	bundleServerMetricsPath = "/metrics"
+	bundleServerHealthPath  = "/healthz"
+	bundleServerReadyPath   = "/readyz"
+)
+
+// bundleServerDefaultDrainTimeout is the default time that the server waits for downloads in
+// progress when it is stopped.
+const bundleServerDefaultDrainTimeout = 30 * time.Second
+
+// bundleServerValidateInterval is the interval between checks of the bundle file.
+const bundleServerValidateInterval = 10 * time.Second
+
+// bundleServerRetryAfter is the number of seconds that clients should wait before trying again when
+// the maximum number of downloads has been reached.
+const bundleServerRetryAfter = "10"
+
+// bundleServerNodeHeader is the header that the bundle extractor uses to tell the bundle server
+// the name of the node where it runs.
+const bundleServerNodeHeader = "X-Upgrade-Tool-Node"
+
+const (
+	bundleServerMetricsNamespace = "upgrade_tool"
+	bundleServerMetricsSubsystem = "bundle_server"
+	bundleServerAbortedReason    = "aborted"
+)
+
+// bundleDigestFile returns the name of the file that contains the digest of the given bundle file.
+// The bundle creator writes it next to the bundle file, replacing the '.tar' extension with
+// '.sha256'.
+func bundleDigestFile(file string) string {
+	return strings.TrimSuffix(file, ".tar") + ".sha256"
+}
+
+// readBundleDigest reads the SHA-256 digest of the given bundle file from the digest file, as hex
+// string. Returns an empty string if the digest file doesn't exist.
+func readBundleDigest(file string) (result string, err error) {
+	data, err := os.ReadFile(bundleDigestFile(file))
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) > 0 {
+		result = fields[0]
+	}
+	return
+}
+
+// calculateFileDigest calculates the SHA-256 digest of the given file, as hex string.
+func calculateFileDigest(file string) (result string, err error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return
+	}
+	result = hex.EncodeToString(hash.Sum(nil))
+	return
+}
+
+// bundleServerPermissions are the permissions of the bundle server. It doesn't use the API, but
+// it needs to read the bundle from the host and to use the network of the host.
+var bundleServerPermissions = rbacPermissions{
+	privileged: true,
+}
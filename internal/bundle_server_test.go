@@ -0,0 +1,647 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Bundle server", func() {
+	var (
+		logger logr.Logger
+		tmp    string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create a temporary directory containing the bundle and the token:
+		tmp, err = os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		err = os.WriteFile(filepath.Join(tmp, "bundle.tar"), []byte("bundle"), 0600)
+		Expect(err).ToNot(HaveOccurred())
+		err = os.WriteFile(filepath.Join(tmp, "token"), []byte("mytoken\n"), 0600)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("Authentication", func() {
+		var handler http.Handler
+
+		BeforeEach(func() {
+			server, err := NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetListenAddr(":0").
+				SetTokenFile(filepath.Join(tmp, "token")).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			handler = server.makeHandler()
+		})
+
+		It("Rejects request without token", func() {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(recorder.Header().Get("WWW-Authenticate")).To(HavePrefix("Bearer"))
+		})
+
+		It("Rejects request with wrong token", func() {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.Header.Set("Authorization", "Bearer junk")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("Accepts request with correct token", func() {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.Header.Set("Authorization", "Bearer mytoken")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(Equal("bundle"))
+		})
+	})
+
+	Describe("Ranges", func() {
+		var handler http.Handler
+
+		BeforeEach(func() {
+			server, err := NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetListenAddr(":0").
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			handler = server.makeHandler()
+		})
+
+		It("Advertises support for ranges", func() {
+			request := httptest.NewRequest(http.MethodHead, "/", nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Header().Get("Accept-Ranges")).To(Equal("bytes"))
+			Expect(recorder.Header().Get("ETag")).ToNot(BeEmpty())
+		})
+
+		It("Sends the requested range", func() {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.Header.Set("Range", "bytes=2-")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusPartialContent))
+			Expect(recorder.Body.String()).To(Equal("ndle"))
+		})
+
+		It("Sends the complete file if the entity tag doesn't match", func() {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.Header.Set("Range", "bytes=2-")
+			request.Header.Set("If-Range", `"junk"`)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(Equal("bundle"))
+		})
+	})
+
+	Describe("Index", func() {
+		var handler http.Handler
+
+		BeforeEach(func() {
+			// Create a directory containing two bundles, only one of them with a digest
+			// file:
+			dir := filepath.Join(tmp, "bundles")
+			err := os.Mkdir(dir, 0700)
+			Expect(err).ToNot(HaveOccurred())
+			writeTestBundle(filepath.Join(dir, "upgrade-4.13.4-x86_64.tar"), "4.13.4")
+			err = os.WriteFile(
+				filepath.Join(dir, "upgrade-4.13.4-x86_64.sha256"),
+				[]byte("0123abcd  upgrade-4.13.4-x86_64.tar\n"),
+				0600,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			writeTestBundle(filepath.Join(dir, "upgrade-4.13.5-x86_64.tar"), "4.13.5")
+
+			// Create the server:
+			server, err := NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleDir("bundles").
+				SetListenAddr(":0").
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			handler = server.makeHandler()
+		})
+
+		It("Lists the bundles", func() {
+			request := httptest.NewRequest(http.MethodGet, "/index", nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			var index BundleIndex
+			err := json.Unmarshal(recorder.Body.Bytes(), &index)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(index.Bundles).To(HaveLen(2))
+			first := index.Bundles[0]
+			Expect(first.Name).To(Equal("upgrade-4.13.4-x86_64.tar"))
+			Expect(first.Version).To(Equal("4.13.4"))
+			Expect(first.Arch).To(Equal("x86_64"))
+			Expect(first.Digest).To(Equal("sha256:0123abcd"))
+			Expect(first.Size).To(BeNumerically(">", 0))
+			second := index.Bundles[1]
+			Expect(second.Name).To(Equal("upgrade-4.13.5-x86_64.tar"))
+			Expect(second.Version).To(Equal("4.13.5"))
+			Expect(second.Digest).To(BeEmpty())
+		})
+
+		It("Sends a bundle from the directory", func() {
+			request := httptest.NewRequest(
+				http.MethodGet,
+				"/bundles/upgrade-4.13.5-x86_64.tar",
+				nil,
+			)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			metadata, err := readBundleMetadata(recorder.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metadata.Version).To(Equal("4.13.5"))
+		})
+
+		It("Rejects names outside of the directory", func() {
+			request := httptest.NewRequest(http.MethodGet, "/bundles/..%2Fbundle.tar", nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("Returns not found for the default path", func() {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	It("Reports metrics", func() {
+		server, err := NewBundleServer().
+			SetLogger(logger).
+			SetRootDir(tmp).
+			SetBundleFile("bundle.tar").
+			SetListenAddr(":0").
+			SetTokenFile(filepath.Join(tmp, "token")).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		handler := server.makeHandler()
+
+		// Send a request that will be rejected and another that will succeed:
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+		request = httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("Authorization", "Bearer mytoken")
+		request.Header.Set(bundleServerNodeHeader, "node0")
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+
+		// Check the metrics, note that they don't require the token:
+		request = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		body := recorder.Body.String()
+		Expect(body).To(ContainSubstring(
+			"upgrade_tool_bundle_server_sent_bytes_total 6\n",
+		))
+		Expect(body).To(ContainSubstring(
+			"upgrade_tool_bundle_server_active_downloads 0\n",
+		))
+		Expect(body).To(ContainSubstring(
+			`upgrade_tool_bundle_server_completed_downloads_total{node="node0"} 1` + "\n",
+		))
+		Expect(body).To(ContainSubstring(
+			`upgrade_tool_bundle_server_errors_total{reason="401"} 1` + "\n",
+		))
+	})
+
+	Describe("Probes", func() {
+		var server *BundleServer
+
+		BeforeEach(func() {
+			var err error
+			server, err = NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetListenAddr(":0").
+				SetTokenFile(filepath.Join(tmp, "token")).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		probe := func(path string) int {
+			request := httptest.NewRequest(http.MethodGet, path, nil)
+			recorder := httptest.NewRecorder()
+			server.makeHandler().ServeHTTP(recorder, request)
+			return recorder.Code
+		}
+
+		It("Is healthy without token", func() {
+			Expect(probe("/healthz")).To(Equal(http.StatusOK))
+		})
+
+		It("Isn't ready before the bundle file is checked", func() {
+			Expect(probe("/readyz")).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("Isn't ready if there is no digest file", func() {
+			server.validator.check()
+			Expect(probe("/readyz")).To(Equal(http.StatusServiceUnavailable))
+			_, reason := server.validator.status()
+			Expect(reason).To(ContainSubstring("bundle.sha256"))
+		})
+
+		It("Is ready once the digest file is created", func() {
+			server.validator.check()
+			Expect(probe("/readyz")).To(Equal(http.StatusServiceUnavailable))
+			err := os.WriteFile(
+				filepath.Join(tmp, "bundle.sha256"),
+				[]byte(
+					"1e6ed65d77d6364eeaed5a745ba5c4985ae2b700dd85d7cf7f027bdf294a33fc"+
+						"  bundle.tar\n",
+				),
+				0600,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			server.validator.check()
+			Expect(probe("/readyz")).To(Equal(http.StatusOK))
+		})
+
+		It("Checks again after failing to read the digest file", func() {
+			err := os.Mkdir(filepath.Join(tmp, "bundle.sha256"), 0700)
+			Expect(err).ToNot(HaveOccurred())
+			server.validator.check()
+			Expect(probe("/readyz")).To(Equal(http.StatusServiceUnavailable))
+			Expect(server.validator.checked).To(BeZero())
+		})
+
+		It("Is ready with a replica that has no digest file", func() {
+			err := os.Rename(filepath.Join(tmp, "bundle.tar"), filepath.Join(tmp, "replica.tar"))
+			Expect(err).ToNot(HaveOccurred())
+			server, err = NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetReplicaFile("replica.tar").
+				SetListenAddr(":0").
+				SetTokenFile(filepath.Join(tmp, "token")).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			server.validator.check()
+			Expect(probe("/readyz")).To(Equal(http.StatusOK))
+		})
+
+		It("Is ready if the digest matches", func() {
+			err := os.WriteFile(
+				filepath.Join(tmp, "bundle.sha256"),
+				[]byte(
+					"1e6ed65d77d6364eeaed5a745ba5c4985ae2b700dd85d7cf7f027bdf294a33fc"+
+						"  bundle.tar\n",
+				),
+				0600,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			server.validator.check()
+			Expect(probe("/readyz")).To(Equal(http.StatusOK))
+		})
+
+		It("Isn't ready if the digest doesn't match", func() {
+			err := os.WriteFile(
+				filepath.Join(tmp, "bundle.sha256"),
+				[]byte("0123abcd  bundle.tar\n"),
+				0600,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			server.validator.check()
+			Expect(probe("/readyz")).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("Isn't ready if the bundle file doesn't exist", func() {
+			err := os.Remove(filepath.Join(tmp, "bundle.tar"))
+			Expect(err).ToNot(HaveOccurred())
+			server.validator.check()
+			Expect(probe("/readyz")).To(Equal(http.StatusServiceUnavailable))
+		})
+	})
+
+	Describe("Info", func() {
+		var handler http.Handler
+
+		BeforeEach(func() {
+			// Replace the bundle file with one that contains metadata, and create a
+			// bundle directory with another bundle that has a digest file:
+			writeTestBundle(filepath.Join(tmp, "bundle.tar"), "4.13.4")
+			dir := filepath.Join(tmp, "bundles")
+			err := os.Mkdir(dir, 0700)
+			Expect(err).ToNot(HaveOccurred())
+			writeTestBundle(filepath.Join(dir, "upgrade-4.13.5-x86_64.tar"), "4.13.5")
+			err = os.WriteFile(
+				filepath.Join(dir, "upgrade-4.13.5-x86_64.sha256"),
+				[]byte("0123abcd  upgrade-4.13.5-x86_64.tar\n"),
+				0600,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			server, err := NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetBundleDir("bundles").
+				SetListenAddr(":0").
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			handler = server.makeHandler()
+		})
+
+		get := func(path string) (code int, info *BundleInfo) {
+			request := httptest.NewRequest(http.MethodGet, path, nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			code = recorder.Code
+			if code == http.StatusOK {
+				err := json.Unmarshal(recorder.Body.Bytes(), &info)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			return
+		}
+
+		It("Calculates the digest of the bundle file if there is no digest file", func() {
+			code, info := get("/info")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(info.Name).To(Equal("bundle.tar"))
+			Expect(info.Digest).To(HavePrefix("sha256:"))
+			Expect(info.Digest).To(HaveLen(len("sha256:") + 64))
+			Expect(info.Size).To(BeNumerically(">", 0))
+			Expect(info.Metadata).ToNot(BeNil())
+			Expect(info.Metadata.Version).To(Equal("4.13.4"))
+		})
+
+		It("Reads the digest file of a bundle from the directory", func() {
+			code, info := get("/info/upgrade-4.13.5-x86_64.tar")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(info.Digest).To(Equal("sha256:0123abcd"))
+			Expect(info.Metadata.Version).To(Equal("4.13.5"))
+		})
+
+		It("Returns not found for bundles that don't exist", func() {
+			code, _ := get("/info/upgrade-4.14.0-x86_64.tar")
+			Expect(code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Limits", func() {
+		It("Rejects downloads when the maximum is reached", func() {
+			server, err := NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetListenAddr(":0").
+				SetMaxDownloads(1).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+
+			// Simulate a download in progress:
+			server.downloads <- struct{}{}
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			recorder := httptest.NewRecorder()
+			server.makeHandler().ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(recorder.Header().Get("Retry-After")).ToNot(BeEmpty())
+
+			// Finish the download in progress and try again:
+			<-server.downloads
+			recorder = httptest.NewRecorder()
+			server.makeHandler().ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(server.downloads).To(BeEmpty())
+		})
+
+		It("Limits the bandwidth of each client", func() {
+			server, err := NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetListenAddr(":0").
+				SetMaxClientBandwidth(4).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+
+			// The bundle has six bytes, and the burst is four, so sending the last two
+			// should take half a second:
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			recorder := httptest.NewRecorder()
+			start := time.Now()
+			server.makeHandler().ServeHTTP(recorder, request)
+			elapsed := time.Since(start)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(Equal("bundle"))
+			Expect(elapsed).To(BeNumerically(">=", 400*time.Millisecond))
+		})
+
+		It("Rejects negative limits", func() {
+			_, err := NewBundleServer().
+				SetLogger(logger).
+				SetBundleFile("bundle.tar").
+				SetListenAddr(":0").
+				SetMaxBandwidth(-1).
+				Build()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Shutdown", func() {
+		var address string
+
+		BeforeEach(func() {
+			// Find a free port:
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			address = listener.Addr().String()
+			err = listener.Close()
+			Expect(err).ToNot(HaveOccurred())
+
+			// Replace the bundle with a larger one, so that transfers take longer:
+			err = os.WriteFile(
+				filepath.Join(tmp, "bundle.tar"),
+				make([]byte, 64),
+				0600,
+			)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		// start runs the server in the background and returns a channel where the result
+		// will be written.
+		start := func(ctx context.Context, server *BundleServer) chan error {
+			result := make(chan error, 1)
+			go func() {
+				defer GinkgoRecover()
+				result <- server.Run(ctx)
+			}()
+			Eventually(func() error {
+				response, err := http.Get("http://" + address + "/healthz")
+				if err != nil {
+					return err
+				}
+				return response.Body.Close()
+			}).Should(Succeed())
+			return result
+		}
+
+		// download starts a download in the background, returns a channel where the
+		// downloaded data will be written. Note that when the download is aborted the
+		// data may be incomplete or empty.
+		download := func() chan []byte {
+			result := make(chan []byte, 1)
+			go func() {
+				response, err := http.Get("http://" + address)
+				if err != nil {
+					result <- nil
+					return
+				}
+				defer response.Body.Close()
+				data, _ := io.ReadAll(response.Body)
+				result <- data
+			}()
+			return result
+		}
+
+		It("Waits for transfers in progress", func() {
+			server, err := NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetListenAddr(address).
+				SetMaxClientBandwidth(32).
+				SetDrainTimeout(time.Minute).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			result := start(ctx, server)
+			data := download()
+			Eventually(server.transfers.Load).Should(BeNumerically("==", 1))
+			cancel()
+			Eventually(result, 5*time.Second).Should(Receive(BeNil()))
+			Eventually(data).Should(Receive(HaveLen(64)))
+		})
+
+		It("Aborts transfers when the drain timeout expires", func() {
+			server, err := NewBundleServer().
+				SetLogger(logger).
+				SetRootDir(tmp).
+				SetBundleFile("bundle.tar").
+				SetListenAddr(address).
+				SetMaxClientBandwidth(4).
+				SetDrainTimeout(100 * time.Millisecond).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			result := start(ctx, server)
+			data := download()
+			Eventually(server.transfers.Load).Should(BeNumerically("==", 1))
+			cancel()
+			Eventually(result, 5*time.Second).Should(Receive())
+			var received []byte
+			Eventually(data, 5*time.Second).Should(Receive(&received))
+			Expect(len(received)).To(BeNumerically("<", 64))
+		})
+	})
+
+	It("Accepts any request if no token is configured", func() {
+		server, err := NewBundleServer().
+			SetLogger(logger).
+			SetRootDir(tmp).
+			SetBundleFile("bundle.tar").
+			SetListenAddr(":0").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		request := httptest.NewRequest(http.MethodHead, "/", nil)
+		recorder := httptest.NewRecorder()
+		server.makeHandler().ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+	})
+
+	It("Fails if the token file is empty", func() {
+		file := filepath.Join(tmp, "empty")
+		err := os.WriteFile(file, nil, 0600)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = NewBundleServer().
+			SetLogger(logger).
+			SetBundleFile("bundle.tar").
+			SetListenAddr(":0").
+			SetTokenFile(file).
+			Build()
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+// writeTestBundle writes a bundle file that contains only the metadata.
+func writeTestBundle(file, version string) {
+	data, err := json.Marshal(&Metadata{
+		Version: version,
+		Arch:    "x86_64",
+	})
+	Expect(err).ToNot(HaveOccurred())
+	stream, err := os.Create(file)
+	Expect(err).ToNot(HaveOccurred())
+	defer stream.Close()
+	archive := tar.NewWriter(stream)
+	err = archive.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "metadata.json",
+		Mode:     0644,
+		Size:     int64(len(data)),
+	})
+	Expect(err).ToNot(HaveOccurred())
+	_, err = archive.Write(data)
+	Expect(err).ToNot(HaveOccurred())
+	err = archive.Close()
+	Expect(err).ToNot(HaveOccurred())
+}
@@ -0,0 +1,588 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blang/semver/v4"
+	"github.com/go-logr/logr"
+	configv1 "github.com/openshift/api/config/v1"
+	"golang.org/x/exp/slices"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+)
+
+// clusterUpgradeValidator is the admission webhook that rejects cluster upgrades that can't
+// succeed, so that mistakes are detected before any node is touched.
+type clusterUpgradeValidator struct {
+	logger    logr.Logger
+	client    clnt.Reader
+	namespace string
+}
+
+// Make sure that we implement the interface:
+var _ admission.CustomValidator = (*clusterUpgradeValidator)(nil)
+
+// ValidateCreate checks the cluster upgrade and that there is no other upgrade in progress.
+func (v *clusterUpgradeValidator) ValidateCreate(ctx context.Context,
+	obj runtime.Object) (warnings admission.Warnings, err error) {
+	upgrade, ok := obj.(*v1alpha1.ClusterUpgrade)
+	if !ok {
+		err = fmt.Errorf("expected a cluster upgrade but got a %T", obj)
+		return
+	}
+	warnings, errs, err := v.validate(ctx, upgrade)
+	if err != nil {
+		return
+	}
+	if len(errs) == 0 {
+		errs, err = v.validateConcurrency(ctx, upgrade)
+		if err != nil {
+			return
+		}
+	}
+	err = v.result(upgrade, errs)
+	return
+}
+
+// ValidateUpdate checks the cluster upgrade when the spec changes. Changes to the spec, other than
+// pausing or resuming the upgrade, aren't allowed once the controller has started to work on it.
+func (v *clusterUpgradeValidator) ValidateUpdate(ctx context.Context,
+	oldObj, newObj runtime.Object) (warnings admission.Warnings, err error) {
+	oldUpgrade, ok := oldObj.(*v1alpha1.ClusterUpgrade)
+	if !ok {
+		err = fmt.Errorf("expected a cluster upgrade but got a %T", oldObj)
+		return
+	}
+	newUpgrade, ok := newObj.(*v1alpha1.ClusterUpgrade)
+	if !ok {
+		err = fmt.Errorf("expected a cluster upgrade but got a %T", newObj)
+		return
+	}
+	var oldSpec v1alpha1.ClusterUpgradeSpec
+	oldUpgrade.Spec.DeepCopyInto(&oldSpec)
+	oldSpec.Paused = newUpgrade.Spec.Paused
+	oldSpec.Rollout.ExcludedNodes = newUpgrade.Spec.Rollout.ExcludedNodes
+	oldSpec.Schedule = newUpgrade.Spec.Schedule
+	if equality.Semantic.DeepEqual(oldSpec, newUpgrade.Spec) {
+		err = v.result(newUpgrade, v.validateSchedule(
+			newUpgrade.Spec.Schedule,
+			field.NewPath("spec", "schedule"),
+		))
+		return
+	}
+	phase := oldUpgrade.Status.Phase
+	if phase != "" && phase != v1alpha1.ClusterUpgradePending {
+		err = v.result(newUpgrade, field.ErrorList{
+			field.Forbidden(
+				field.NewPath("spec"),
+				fmt.Sprintf(
+					"can't be changed because the upgrade is already in phase '%s'",
+					phase,
+				),
+			),
+		})
+		return
+	}
+	warnings, errs, err := v.validate(ctx, newUpgrade)
+	if err != nil {
+		return
+	}
+	err = v.result(newUpgrade, errs)
+	return
+}
+
+// ValidateDelete always accepts the deletion, but warns if the upgrade is in progress.
+func (v *clusterUpgradeValidator) ValidateDelete(ctx context.Context,
+	obj runtime.Object) (warnings admission.Warnings, err error) {
+	upgrade, ok := obj.(*v1alpha1.ClusterUpgrade)
+	if !ok {
+		err = fmt.Errorf("expected a cluster upgrade but got a %T", obj)
+		return
+	}
+	switch upgrade.Status.Phase {
+	case "", v1alpha1.ClusterUpgradePending, v1alpha1.ClusterUpgradeCompleted:
+	default:
+		warnings = append(warnings, fmt.Sprintf(
+			"Upgrade '%s' is in phase '%s', some nodes may keep partially distributed "+
+				"bundles",
+			upgrade.Name, upgrade.Status.Phase,
+		))
+	}
+	return
+}
+
+// validate checks the spec of the upgrade. It returns the problems found in the spec as a list
+// of field errors, and the errors that prevented the checks as a regular error.
+func (v *clusterUpgradeValidator) validate(ctx context.Context,
+	upgrade *v1alpha1.ClusterUpgrade) (warnings admission.Warnings, errs field.ErrorList,
+	err error) {
+	spec := field.NewPath("spec")
+
+	// The controller only processes the upgrades of its own namespace:
+	if upgrade.Namespace != v.namespace {
+		errs = append(errs, field.Invalid(
+			field.NewPath("metadata", "namespace"),
+			upgrade.Namespace,
+			fmt.Sprintf("must be '%s'", v.namespace),
+		))
+	}
+
+	// Check the version:
+	versionWarnings, versionErrs, err := v.validateVersion(ctx, upgrade, spec.Child("version"))
+	if err != nil {
+		return
+	}
+	warnings = append(warnings, versionWarnings...)
+	errs = append(errs, versionErrs...)
+
+	// Check the architecture:
+	if upgrade.Spec.Arch != "" || len(upgrade.Spec.ArchBundles) > 0 {
+		var archErrs field.ErrorList
+		archErrs, err = v.validateArch(ctx, upgrade, spec)
+		if err != nil {
+			return
+		}
+		errs = append(errs, archErrs...)
+	}
+
+	// Check the bundle:
+	bundleErrs, err := v.validateBundle(ctx, upgrade, spec.Child("bundle"))
+	if err != nil {
+		return
+	}
+	errs = append(errs, bundleErrs...)
+
+	// Check the rollout:
+	replicas := upgrade.Spec.Rollout.Replicas
+	if replicas != nil && *replicas < 0 {
+		errs = append(errs, field.Invalid(
+			spec.Child("rollout", "replicas"),
+			*replicas,
+			"must be greater than or equal to zero",
+		))
+	}
+	retries := upgrade.Spec.Rollout.MaxRetries
+	if retries != nil && *retries < 0 {
+		errs = append(errs, field.Invalid(
+			spec.Child("rollout", "maxRetries"),
+			*retries,
+			"must be greater than or equal to zero",
+		))
+	}
+	budget := upgrade.Spec.Rollout.FailureBudget
+	if budget != nil && !v.validBudget(*budget) {
+		errs = append(errs, field.Invalid(
+			spec.Child("rollout", "failureBudget"),
+			budget.String(),
+			"must be a number greater than or equal to zero or a percentage between 0% "+
+				"and 100%",
+		))
+	}
+	concurrency := upgrade.Spec.Rollout.MaxConcurrency
+	if concurrency != nil && !v.validBudget(*concurrency) {
+		errs = append(errs, field.Invalid(
+			spec.Child("rollout", "maxConcurrency"),
+			concurrency.String(),
+			"must be a number greater than or equal to zero or a percentage between 0% "+
+				"and 100%",
+		))
+	}
+	batchesPath := spec.Child("rollout", "batches")
+	for i, batch := range upgrade.Spec.Rollout.Batches {
+		if !v.validBatch(batch) {
+			errs = append(errs, field.Invalid(
+				batchesPath.Index(i),
+				batch.String(),
+				"must be a number greater than zero or a percentage between 1% and 100%",
+			))
+		}
+	}
+	selector := upgrade.Spec.Rollout.NodeSelector
+	if selector != nil {
+		_, err = metav1.LabelSelectorAsSelector(selector)
+		if err != nil {
+			errs = append(errs, field.Invalid(
+				spec.Child("rollout", "nodeSelector"),
+				metav1.FormatLabelSelector(selector),
+				err.Error(),
+			))
+			err = nil
+		}
+	}
+
+	// Check the pull order:
+	pullOrder := upgrade.Spec.PullOrder
+	if pullOrder != "" && !slices.Contains(PullOrders(), pullOrder) {
+		errs = append(errs, field.NotSupported(
+			spec.Child("pullOrder"),
+			pullOrder,
+			PullOrders(),
+		))
+	}
+
+	// Check the schedule:
+	errs = append(errs, v.validateSchedule(upgrade.Spec.Schedule, spec.Child("schedule"))...)
+	return
+}
+
+// validateSchedule checks the time zone and the maintenance windows of the schedule.
+func (v *clusterUpgradeValidator) validateSchedule(schedule *v1alpha1.ClusterUpgradeSchedule,
+	path *field.Path) (errs field.ErrorList) {
+	if schedule == nil {
+		return
+	}
+	location, err := parseTimeZone(schedule.TimeZone)
+	if err != nil {
+		errs = append(errs, field.Invalid(
+			path.Child("timeZone"),
+			schedule.TimeZone,
+			err.Error(),
+		))
+		location = time.UTC
+	}
+	windowsPath := path.Child("windows")
+	for i, window := range schedule.Windows {
+		_, err = parseMaintenanceWindow(window, location)
+		if err != nil {
+			errs = append(errs, field.Invalid(
+				windowsPath.Index(i),
+				window.Cron,
+				err.Error(),
+			))
+		}
+	}
+	return
+}
+
+// validBatch checks that the size of a rollout batch is a positive number of nodes or a
+// percentage between one and one hundred.
+func (v *clusterUpgradeValidator) validBatch(batch intstr.IntOrString) bool {
+	if batch.Type == intstr.Int {
+		return batch.IntVal > 0
+	}
+	percent, ok := v.parsePercent(batch.StrVal)
+	return ok && percent > 0
+}
+
+// validBudget checks that the failure budget is a non negative number of nodes or a percentage
+// between zero and one hundred.
+func (v *clusterUpgradeValidator) validBudget(budget intstr.IntOrString) bool {
+	if budget.Type == intstr.Int {
+		return budget.IntVal >= 0
+	}
+	_, ok := v.parsePercent(budget.StrVal)
+	return ok
+}
+
+// parsePercent parses a percentage like '10%', and checks that it is between zero and one hundred.
+func (v *clusterUpgradeValidator) parsePercent(text string) (result int, ok bool) {
+	if !strings.HasSuffix(text, "%") {
+		return
+	}
+	result, err := strconv.Atoi(strings.TrimSuffix(text, "%"))
+	ok = err == nil && result >= 0 && result <= 100
+	return
+}
+
+// validateVersion checks that the requested version is a valid upgrade from the current version
+// of the cluster: it must be newer, have the same major version and skip at most one minor
+// version.
+func (v *clusterUpgradeValidator) validateVersion(ctx context.Context,
+	upgrade *v1alpha1.ClusterUpgrade, path *field.Path) (warnings admission.Warnings,
+	errs field.ErrorList, err error) {
+	value := upgrade.Spec.Version
+	if value == "" {
+		errs = append(errs, field.Required(path, "version is mandatory"))
+		return
+	}
+	target, err := semver.Parse(value)
+	if err != nil {
+		errs = append(errs, field.Invalid(path, value, err.Error()))
+		err = nil
+		return
+	}
+
+	// Get the current version from the cluster version object:
+	object := &configv1.ClusterVersion{}
+	key := clnt.ObjectKey{
+		Name: "version",
+	}
+	err = v.client.Get(ctx, key, object)
+	if apierrors.IsNotFound(err) {
+		warnings = append(warnings, fmt.Sprintf(
+			"Cluster version doesn't exist, can't check if version '%s' is a valid upgrade",
+			value,
+		))
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	current, err := semver.Parse(object.Status.Desired.Version)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf(
+			"Current version '%s' isn't valid, can't check if version '%s' is a valid "+
+				"upgrade",
+			object.Status.Desired.Version, value,
+		))
+		err = nil
+		return
+	}
+	v.logger.V(1).Info(
+		"Checking version",
+		"current", current.String(),
+		"target", target.String(),
+	)
+
+	// Check the skip:
+	switch {
+	case target.EQ(current):
+		errs = append(errs, field.Invalid(
+			path, value,
+			"is already the current version of the cluster",
+		))
+	case target.LT(current):
+		errs = append(errs, field.Invalid(
+			path, value,
+			fmt.Sprintf(
+				"is older than the current version '%s', downgrades aren't supported",
+				current,
+			),
+		))
+	case target.Major != current.Major:
+		errs = append(errs, field.Invalid(
+			path, value,
+			fmt.Sprintf(
+				"has a different major version than the current version '%s'",
+				current,
+			),
+		))
+	case target.Minor > current.Minor+1:
+		errs = append(errs, field.Invalid(
+			path, value,
+			fmt.Sprintf(
+				"skips minor versions, the current version is '%s' and the target can be "+
+					"at most %d.%d",
+				current, current.Major, current.Minor+1,
+			),
+		))
+	}
+	return
+}
+
+// validateArch checks that the architectures of the upgrade and of the architecture specific
+// bundles are supported, and that all the nodes of the cluster have one of those architectures.
+// When the architecture of the upgrade isn't specified the main bundle is assumed to cover the
+// nodes that don't have an architecture specific bundle.
+func (v *clusterUpgradeValidator) validateArch(ctx context.Context,
+	upgrade *v1alpha1.ClusterUpgrade, path *field.Path) (errs field.ErrorList, err error) {
+	archs := map[string]bool{}
+	archPath := path.Child("arch")
+	value := upgrade.Spec.Arch
+	if value != "" {
+		arch := distributionOSArch(value)
+		if arch == "" {
+			errs = append(errs, field.NotSupported(archPath, value, v.supportedArchs()))
+			return
+		}
+		archs[arch] = true
+	}
+	bundlesPath := path.Child("archBundles")
+	for i, bundle := range upgrade.Spec.ArchBundles {
+		bundlePath := bundlesPath.Index(i)
+		arch := distributionOSArch(bundle.Arch)
+		switch {
+		case bundle.Arch == "":
+			errs = append(errs, field.Required(bundlePath.Child("arch"), ""))
+		case arch == "":
+			errs = append(errs, field.NotSupported(
+				bundlePath.Child("arch"), bundle.Arch, v.supportedArchs(),
+			))
+		case archs[arch]:
+			errs = append(errs, field.Duplicate(bundlePath.Child("arch"), bundle.Arch))
+		default:
+			archs[arch] = true
+		}
+		if bundle.URL == "" {
+			errs = append(errs, field.Required(bundlePath.Child("url"), ""))
+		}
+		if bundle.Digest != "" && !v.validDigest(bundle.Digest) {
+			errs = append(errs, field.Invalid(
+				bundlePath.Child("digest"), bundle.Digest,
+				"must be a SHA-256 digest, for example 'sha256:3a4c...'",
+			))
+		}
+	}
+	if value == "" || len(errs) > 0 {
+		return
+	}
+	nodes := &corev1.NodeList{}
+	err = v.client.List(ctx, nodes)
+	if err != nil {
+		return
+	}
+	for _, node := range nodes.Items {
+		nodeArch := node.Status.NodeInfo.Architecture
+		if nodeArch == "" || archs[distributionOSArch(nodeArch)] {
+			continue
+		}
+		errs = append(errs, field.Invalid(
+			archPath, value,
+			fmt.Sprintf(
+				"doesn't match architecture '%s' of node '%s'",
+				nodeArch, node.Name,
+			),
+		))
+	}
+	return
+}
+
+func (v *clusterUpgradeValidator) supportedArchs() []string {
+	result := make([]string, 0, len(distributionOSArchs))
+	for arch := range distributionOSArchs {
+		result = append(result, arch)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// validateBundle checks that exactly one location of the bundle is specified, and that the
+// secret containing the credentials exists.
+func (v *clusterUpgradeValidator) validateBundle(ctx context.Context,
+	upgrade *v1alpha1.ClusterUpgrade, path *field.Path) (errs field.ErrorList, err error) {
+	bundle := upgrade.Spec.Bundle
+	count := 0
+	for _, value := range []string{bundle.File, bundle.Dir, bundle.URL} {
+		if value != "" {
+			count++
+		}
+	}
+	switch {
+	case count == 0:
+		errs = append(errs, field.Required(
+			path,
+			"one of 'file', 'dir' or 'url' is mandatory",
+		))
+	case count > 1:
+		errs = append(errs, field.Invalid(
+			path, "",
+			"only one of 'file', 'dir' or 'url' can be specified",
+		))
+	}
+	if bundle.URLSecret != nil {
+		secretPath := path.Child("urlSecret")
+		if bundle.URL == "" && len(upgrade.Spec.ArchBundles) == 0 {
+			errs = append(errs, field.Forbidden(
+				secretPath,
+				"can only be specified together with 'url' or 'archBundles'",
+			))
+		} else {
+			secret := &corev1.Secret{}
+			key := clnt.ObjectKey{
+				Namespace: upgrade.Namespace,
+				Name:      bundle.URLSecret.Name,
+			}
+			err = v.client.Get(ctx, key, secret)
+			if apierrors.IsNotFound(err) {
+				errs = append(errs, field.NotFound(
+					secretPath.Child("name"),
+					bundle.URLSecret.Name,
+				))
+				err = nil
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	if bundle.Digest != "" && !v.validDigest(bundle.Digest) {
+		errs = append(errs, field.Invalid(
+			path.Child("digest"), bundle.Digest,
+			"must be a SHA-256 digest, for example 'sha256:3a4c...'",
+		))
+	}
+	return
+}
+
+// validDigest checks that the digest of a bundle is a SHA-256 digest, optionally with the 'sha256:'
+// prefix.
+func (v *clusterUpgradeValidator) validDigest(value string) bool {
+	digest := strings.TrimPrefix(value, bundleExtractorDigestPrefix)
+	data, err := hex.DecodeString(digest)
+	return err == nil && len(data) == 32
+}
+
+// validateConcurrency checks that there is no other upgrade in progress in the namespace.
+func (v *clusterUpgradeValidator) validateConcurrency(ctx context.Context,
+	upgrade *v1alpha1.ClusterUpgrade) (errs field.ErrorList, err error) {
+	list := &v1alpha1.ClusterUpgradeList{}
+	err = v.client.List(ctx, list, clnt.InNamespace(upgrade.Namespace))
+	if err != nil {
+		return
+	}
+	for _, item := range list.Items {
+		if item.Name == upgrade.Name {
+			continue
+		}
+		if item.Status.Phase == v1alpha1.ClusterUpgradeCompleted {
+			continue
+		}
+		errs = append(errs, field.Forbidden(
+			field.NewPath("metadata", "name"),
+			fmt.Sprintf(
+				"upgrade '%s' hasn't completed yet, wait till it completes or delete it",
+				item.Name,
+			),
+		))
+	}
+	return
+}
+
+// result converts the list of field errors into the error returned to the API server.
+func (v *clusterUpgradeValidator) result(upgrade *v1alpha1.ClusterUpgrade,
+	errs field.ErrorList) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	v.logger.V(1).Info(
+		"Rejected upgrade",
+		"namespace", upgrade.Namespace,
+		"name", upgrade.Name,
+		"errors", errs.ToAggregate().Error(),
+	)
+	return apierrors.NewInvalid(
+		v1alpha1.GroupVersion.WithKind("ClusterUpgrade").GroupKind(),
+		upgrade.Name,
+		errs,
+	)
+}
@@ -0,0 +1,506 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/pointer"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Cluster upgrade webhook", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		ctx = context.Background()
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	// makeValidator creates a validator that uses a fake client containing a cluster version
+	// with version 4.13.4, an 'amd64' node and the given additional objects.
+	makeValidator := func(objects ...clnt.Object) *clusterUpgradeValidator {
+		version := &configv1.ClusterVersion{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "version",
+			},
+			Status: configv1.ClusterVersionStatus{
+				Desired: configv1.Release{
+					Version: "4.13.4",
+				},
+			},
+		}
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "node0",
+			},
+			Status: corev1.NodeStatus{
+				NodeInfo: corev1.NodeSystemInfo{
+					Architecture: "amd64",
+				},
+			},
+		}
+		client := fake.NewClientBuilder().
+			WithScheme(snapshotScheme()).
+			WithObjects(version, node).
+			WithObjects(objects...).
+			Build()
+		return &clusterUpgradeValidator{
+			logger:    logger,
+			client:    client,
+			namespace: "upgrade-tool",
+		}
+	}
+
+	// makeUpgrade creates a valid cluster upgrade to version 4.13.5.
+	makeUpgrade := func(name string) *v1alpha1.ClusterUpgrade {
+		return &v1alpha1.ClusterUpgrade{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "upgrade-tool",
+				Name:      name,
+			},
+			Spec: v1alpha1.ClusterUpgradeSpec{
+				Version: "4.13.5",
+				Bundle: v1alpha1.ClusterUpgradeBundle{
+					File: "/var/lib/upgrade/bundle.tar",
+				},
+			},
+		}
+	}
+
+	// expectInvalid checks that the error is an invalid error that mentions the given text.
+	expectInvalid := func(err error, text string) {
+		Expect(err).To(HaveOccurred())
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring(text))
+	}
+
+	It("Accepts a valid upgrade", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Arch = "x86_64"
+		warnings, err := validator.ValidateCreate(ctx, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(warnings).To(BeEmpty())
+	})
+
+	It("Accepts an upgrade to the next minor version", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Version = "4.14.0"
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Rejects an upgrade that skips minor versions", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Version = "4.15.0"
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "skips minor versions")
+	})
+
+	It("Rejects a downgrade", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Version = "4.13.3"
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "downgrades aren't supported")
+	})
+
+	It("Rejects a different major version", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Version = "5.0.0"
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "different major version")
+	})
+
+	It("Rejects the current version", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Version = "4.13.4"
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "already the current version")
+	})
+
+	It("Rejects an invalid version", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Version = "junk"
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "spec.version")
+	})
+
+	It("Warns if the cluster version doesn't exist", func() {
+		validator := &clusterUpgradeValidator{
+			logger: logger,
+			client: fake.NewClientBuilder().
+				WithScheme(snapshotScheme()).
+				Build(),
+			namespace: "upgrade-tool",
+		}
+		upgrade := makeUpgrade("my-upgrade")
+		warnings, err := validator.ValidateCreate(ctx, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(warnings).To(HaveLen(1))
+		Expect(warnings[0]).To(ContainSubstring("doesn't exist"))
+	})
+
+	It("Rejects an architecture that doesn't match the nodes", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Arch = "aarch64"
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "doesn't match architecture 'amd64' of node 'node0'")
+	})
+
+	It("Rejects an unsupported architecture", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Arch = "junk"
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "spec.arch")
+	})
+
+	It("Accepts an architecture specific bundle for nodes of other architecture", func() {
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "node1",
+			},
+			Status: corev1.NodeStatus{
+				NodeInfo: corev1.NodeSystemInfo{
+					Architecture: "arm64",
+				},
+			},
+		}
+		validator := makeValidator(node)
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Arch = "x86_64"
+		upgrade.Spec.ArchBundles = []v1alpha1.ClusterUpgradeArchBundle{{
+			Arch: "aarch64",
+			URL:  "s3://bundles/4.13.5-aarch64.tar",
+		}}
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Rejects invalid architecture specific bundles", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Arch = "x86_64"
+		upgrade.Spec.ArchBundles = []v1alpha1.ClusterUpgradeArchBundle{
+			{
+				Arch: "amd64",
+				URL:  "s3://bundles/4.13.5-x86_64.tar",
+			},
+			{
+				Arch:   "aarch64",
+				Digest: "junk",
+			},
+		}
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "spec.archBundles[0].arch")
+		expectInvalid(err, "spec.archBundles[1].url")
+		expectInvalid(err, "spec.archBundles[1].digest")
+	})
+
+	It("Rejects an upgrade without bundle", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Bundle.File = ""
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "one of 'file', 'dir' or 'url' is mandatory")
+	})
+
+	It("Rejects an upgrade with multiple bundle locations", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Bundle.URL = "s3://bundles/4.13.5.tar"
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "only one of 'file', 'dir' or 'url' can be specified")
+	})
+
+	It("Rejects a missing bundle secret", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Bundle.File = ""
+		upgrade.Spec.Bundle.URL = "s3://bundles/4.13.5.tar"
+		upgrade.Spec.Bundle.URLSecret = &corev1.LocalObjectReference{
+			Name: "my-credentials",
+		}
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "spec.bundle.urlSecret.name")
+	})
+
+	It("Accepts an existing bundle secret", func() {
+		validator := makeValidator(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "upgrade-tool",
+				Name:      "my-credentials",
+			},
+		})
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Bundle.File = ""
+		upgrade.Spec.Bundle.URL = "s3://bundles/4.13.5.tar"
+		upgrade.Spec.Bundle.URLSecret = &corev1.LocalObjectReference{
+			Name: "my-credentials",
+		}
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Rejects an invalid digest", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Bundle.Digest = "sha256:1234"
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "spec.bundle.digest")
+	})
+
+	It("Rejects a negative number of replicas", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Rollout.Replicas = pointer.Int32(-1)
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "spec.rollout.replicas")
+	})
+
+	It("Accepts valid rollout batches", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Rollout.Batches = []intstr.IntOrString{
+			intstr.FromInt(1),
+			intstr.FromString("10%"),
+		}
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Rejects invalid rollout batches", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Rollout.Batches = []intstr.IntOrString{
+			intstr.FromInt(0),
+			intstr.FromString("150%"),
+			intstr.FromString("junk"),
+		}
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "spec.rollout.batches[0]")
+		expectInvalid(err, "spec.rollout.batches[1]")
+		expectInvalid(err, "spec.rollout.batches[2]")
+	})
+
+	It("Rejects invalid retries and failure budget", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		budget := intstr.FromString("200%")
+		upgrade.Spec.Rollout.MaxRetries = pointer.Int32(-1)
+		upgrade.Spec.Rollout.FailureBudget = &budget
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "spec.rollout.maxRetries")
+		expectInvalid(err, "spec.rollout.failureBudget")
+	})
+
+	It("Rejects an invalid maximum concurrency", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		concurrency := intstr.FromInt(-1)
+		upgrade.Spec.Rollout.MaxConcurrency = &concurrency
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "spec.rollout.maxConcurrency")
+	})
+
+	It("Rejects an invalid rollout node selector", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Rollout.NodeSelector = &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{{
+				Key:      "my-label",
+				Operator: "Junk",
+			}},
+		}
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "spec.rollout.nodeSelector")
+	})
+
+	It("Accepts a supported pull order", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.PullOrder = PullOrderSize
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Rejects an unsupported pull order", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.PullOrder = "junk"
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "spec.pullOrder")
+	})
+
+	It("Rejects an invalid schedule", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Spec.Schedule = &v1alpha1.ClusterUpgradeSchedule{
+			TimeZone: "Junk/Junk",
+			Windows: []v1alpha1.ClusterUpgradeWindow{{
+				Cron: "0 25 * * *",
+				Duration: &metav1.Duration{
+					Duration: time.Hour,
+				},
+			}},
+		}
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "spec.schedule.timeZone")
+		expectInvalid(err, "spec.schedule.windows[0]")
+	})
+
+	It("Rejects an upgrade in other namespace", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Namespace = "other"
+		_, err := validator.ValidateCreate(ctx, upgrade)
+		expectInvalid(err, "metadata.namespace")
+	})
+
+	It("Rejects a concurrent upgrade", func() {
+		validator := makeValidator(makeUpgrade("first"))
+		_, err := validator.ValidateCreate(ctx, makeUpgrade("second"))
+		expectInvalid(err, "upgrade 'first' hasn't completed yet")
+	})
+
+	It("Accepts an upgrade when the previous one has completed", func() {
+		first := makeUpgrade("first")
+		first.Status.Phase = v1alpha1.ClusterUpgradeCompleted
+		validator := makeValidator(first)
+		_, err := validator.ValidateCreate(ctx, makeUpgrade("second"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Rejects changes to the spec once the upgrade has started", func() {
+		validator := makeValidator()
+		oldUpgrade := makeUpgrade("my-upgrade")
+		oldUpgrade.Status.Phase = v1alpha1.ClusterUpgradeExtracting
+		newUpgrade := oldUpgrade.DeepCopy()
+		newUpgrade.Spec.Version = "4.13.6"
+		_, err := validator.ValidateUpdate(ctx, oldUpgrade, newUpgrade)
+		expectInvalid(err, "already in phase 'Extracting'")
+	})
+
+	It("Accepts pausing the upgrade once it has started", func() {
+		validator := makeValidator()
+		oldUpgrade := makeUpgrade("my-upgrade")
+		oldUpgrade.Status.Phase = v1alpha1.ClusterUpgradeLoading
+		newUpgrade := oldUpgrade.DeepCopy()
+		newUpgrade.Spec.Paused = true
+		_, err := validator.ValidateUpdate(ctx, oldUpgrade, newUpgrade)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Accepts excluding nodes once the upgrade has started", func() {
+		validator := makeValidator()
+		oldUpgrade := makeUpgrade("my-upgrade")
+		oldUpgrade.Status.Phase = v1alpha1.ClusterUpgradeLoading
+		newUpgrade := oldUpgrade.DeepCopy()
+		newUpgrade.Spec.Rollout.ExcludedNodes = []string{"node1"}
+		_, err := validator.ValidateUpdate(ctx, oldUpgrade, newUpgrade)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Accepts changes to the schedule once the upgrade has started", func() {
+		validator := makeValidator()
+		oldUpgrade := makeUpgrade("my-upgrade")
+		oldUpgrade.Status.Phase = v1alpha1.ClusterUpgradeLoading
+		newUpgrade := oldUpgrade.DeepCopy()
+		newUpgrade.Spec.Schedule = &v1alpha1.ClusterUpgradeSchedule{
+			Windows: []v1alpha1.ClusterUpgradeWindow{{
+				Cron: "0 22 * * 6",
+				Duration: &metav1.Duration{
+					Duration: 6 * time.Hour,
+				},
+			}},
+		}
+		_, err := validator.ValidateUpdate(ctx, oldUpgrade, newUpgrade)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Rejects an invalid schedule once the upgrade has started", func() {
+		validator := makeValidator()
+		oldUpgrade := makeUpgrade("my-upgrade")
+		oldUpgrade.Status.Phase = v1alpha1.ClusterUpgradeLoading
+		newUpgrade := oldUpgrade.DeepCopy()
+		newUpgrade.Spec.Schedule = &v1alpha1.ClusterUpgradeSchedule{
+			Windows: []v1alpha1.ClusterUpgradeWindow{{
+				Cron: "0 22 * * 6",
+			}},
+		}
+		_, err := validator.ValidateUpdate(ctx, oldUpgrade, newUpgrade)
+		expectInvalid(err, "spec.schedule.windows[0]")
+	})
+
+	It("Accepts changes to the spec before the upgrade has started", func() {
+		validator := makeValidator()
+		oldUpgrade := makeUpgrade("my-upgrade")
+		newUpgrade := oldUpgrade.DeepCopy()
+		newUpgrade.Spec.Version = "4.13.6"
+		_, err := validator.ValidateUpdate(ctx, oldUpgrade, newUpgrade)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Accepts updates that don't change the spec", func() {
+		validator := makeValidator()
+		oldUpgrade := makeUpgrade("my-upgrade")
+		oldUpgrade.Spec.Version = "4.13.4"
+		oldUpgrade.Status.Phase = v1alpha1.ClusterUpgradeCompleted
+		newUpgrade := oldUpgrade.DeepCopy()
+		newUpgrade.Labels = map[string]string{
+			"my-label": "my-value",
+		}
+		_, err := validator.ValidateUpdate(ctx, oldUpgrade, newUpgrade)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Warns when an upgrade in progress is deleted", func() {
+		validator := makeValidator()
+		upgrade := makeUpgrade("my-upgrade")
+		upgrade.Status.Phase = v1alpha1.ClusterUpgradeLoading
+		warnings, err := validator.ValidateDelete(ctx, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(warnings).To(HaveLen(1))
+	})
+})
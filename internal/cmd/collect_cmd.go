@@ -0,0 +1,113 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jhernand/upgrade-tool/internal"
+	"github.com/jhernand/upgrade-tool/internal/exit"
+)
+
+// Collect creates and returns the `collect` command.
+func Collect() *cobra.Command {
+	command := &collectCommand{}
+	result := &cobra.Command{
+		Use:   "collect",
+		Short: "Collects a snapshot of the cluster",
+		Long: "Collects a snapshot of the objects that the controller uses to make " +
+			"decisions, so that they can later be used to simulate the controller with " +
+			"the '--snapshot' option of the 'start controller' command.",
+		Args: cobra.NoArgs,
+		RunE: command.run,
+	}
+	flags := result.Flags()
+	flags.StringVar(
+		&command.flags.namespace,
+		"namespace",
+		"upgrade-tool",
+		"Namespace where the controller creates its objects.",
+	)
+	flags.StringVar(
+		&command.flags.output,
+		"output",
+		"-",
+		"File where the snapshot will be written. The default is to write it to the "+
+			"standard output.",
+	)
+	return result
+}
+
+type collectCommand struct {
+	flags struct {
+		namespace string
+		output    string
+	}
+}
+
+func (c *collectCommand) run(cmd *cobra.Command, argv []string) error {
+	// Get the context:
+	ctx := cmd.Context()
+
+	// Get the dependencies from the context:
+	tool := internal.ToolFromContext(ctx)
+	logger := internal.LoggerFromContext(ctx)
+	console := internal.ConsoleFromContext(ctx)
+
+	// Check the flags:
+	if c.flags.namespace == "" {
+		console.Error("Namespace is mandatory")
+		return exit.Error(1)
+	}
+
+	// Open the output:
+	var writer io.Writer
+	if c.flags.output == "-" {
+		writer = tool.Out()
+	} else {
+		file, err := os.OpenFile(c.flags.output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			console.Error("Failed to open output file '%s': %v", c.flags.output, err)
+			return exit.Error(1)
+		}
+		defer func() {
+			err := file.Close()
+			if err != nil {
+				logger.Error(err, "Failed to close output file")
+			}
+		}()
+		writer = file
+	}
+
+	// Create and run the collector:
+	collector, err := internal.NewSnapshotCollector().
+		SetLogger(logger).
+		SetNamespace(c.flags.namespace).
+		Build()
+	if err != nil {
+		console.Error("Failed to create collector: %v", err)
+		return exit.Error(1)
+	}
+	err = collector.Run(ctx, writer)
+	if err != nil {
+		console.Error("Failed to collect snapshot: %v", err)
+		return exit.Error(1)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package convert
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/jhernand/upgrade-tool/internal"
+	"github.com/jhernand/upgrade-tool/internal/exit"
+)
+
+// ConvertBundle creates and returns the `convert bundle` command.
+func ConvertBundle() *cobra.Command {
+	command := &convertBundleCommand{}
+	result := &cobra.Command{
+		Use:   "bundle",
+		Short: "Converts an upgrade bundle to other formats",
+		Long: "Converts an upgrade bundle to an imageset archive with the format used by " +
+			"the 'oc-mirror' tool, so that it can be published to a mirror registry " +
+			"with the 'oc-mirror --from' command.",
+		Args: cobra.NoArgs,
+		RunE: command.run,
+	}
+	flags := result.Flags()
+	flags.StringVar(
+		&command.flags.bundle,
+		"bundle",
+		"",
+		"Name of the bundle file, for example 'upgrade-4.13.4-x86_64.tar'.",
+	)
+	flags.StringVar(
+		&command.flags.imageSet,
+		"to-imageset",
+		"",
+		"Name of the imageset archive file that will be created, for example "+
+			"'mirror_seq1_000000.tar'.",
+	)
+	return result
+}
+
+type convertBundleCommand struct {
+	flags struct {
+		bundle   string
+		imageSet string
+	}
+}
+
+func (c *convertBundleCommand) run(cmd *cobra.Command, argv []string) error {
+	// Get the context:
+	ctx := cmd.Context()
+
+	// Get the dependencies from the context:
+	logger := internal.LoggerFromContext(ctx)
+	console := internal.ConsoleFromContext(ctx)
+
+	// Check the flags:
+	ok := true
+	if c.flags.bundle == "" {
+		console.Error("Bundle is mandatory")
+		ok = false
+	}
+	if c.flags.imageSet == "" {
+		console.Error("Imageset is mandatory")
+		ok = false
+	}
+	if !ok {
+		return exit.Error(1)
+	}
+
+	// Create and run the exporter:
+	exporter, err := internal.NewImageSetExporter().
+		SetLogger(logger).
+		SetBundle(c.flags.bundle).
+		SetFile(c.flags.imageSet).
+		Build()
+	if err != nil {
+		console.Error("Failed to create exporter: %v", err)
+		return exit.Error(1)
+	}
+	console.Info("Converting bundle '%s' to imageset '%s' ...", c.flags.bundle, c.flags.imageSet)
+	err = exporter.Run(ctx)
+	if err != nil {
+		console.Error("Failed to convert bundle: %v", err)
+		return exit.Error(1)
+	}
+
+	return nil
+}
@@ -15,7 +15,13 @@ License.
 package create
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
+	"golang.org/x/exp/slices"
 
 	"github.com/jhernand/upgrade-tool/internal"
 	"github.com/jhernand/upgrade-tool/internal/exit"
@@ -53,17 +59,165 @@ func CreateBundle() *cobra.Command {
 		&command.flags.pullSecret,
 		"pull-secret",
 		"",
-		"Name of the file containing the pull secret",
+		"Name of the file containing the pull secret. Mandatory for the 'ocp' distribution.",
+	)
+	flags.StringVar(
+		&command.flags.distribution,
+		"distribution",
+		internal.DistributionOCP,
+		fmt.Sprintf(
+			"Distribution of the release, one of %s. For 'okd' the version is the "+
+				"complete release tag, for example '4.14.0-0.okd-scos-2023-10-21-013046'.",
+			strings.Join(internal.Distributions(), ", "),
+		),
+	)
+	flags.StringVar(
+		&command.flags.releaseRepo,
+		"release-repo",
+		"",
+		"Repository containing the release images, for example a mirror or "+
+			"'quay.io/openshift-release-dev/ocp-release-nightly'. The default is "+
+			"'quay.io/openshift-release-dev/ocp-release' for the 'ocp' distribution and "+
+			"'quay.io/okd/scos-release' for the 'okd' distribution.",
+	)
+	flags.StringVar(
+		&command.flags.imageSet,
+		"from-imageset",
+		"",
+		"Name of an imageset archive created with 'oc-mirror' that contains the release. "+
+			"The images will be copied from the archive instead of downloading them.",
+	)
+	flags.StringVar(
+		&command.flags.channel,
+		"channel",
+		"",
+		"Update channel, for example 'stable-4.13'. When specified the part of the update "+
+			"graph of the channel that describes the updates to the version will be "+
+			"added to the bundle, so that it can be used in disconnected clusters.",
+	)
+	flags.StringVar(
+		&command.flags.graphURL,
+		"graph-url",
+		"",
+		"URL of the update graph of the update service. The default is the public "+
+			"update service for the 'ocp' distribution.",
+	)
+	flags.StringVar(
+		&command.flags.namespace,
+		"namespace",
+		"upgrade-tool",
+		"Namespace where the manifest generated with the bundle will create the controller.",
+	)
+	flags.StringArrayVar(
+		&command.flags.extraManifests,
+		"extra-manifest",
+		[]string{},
+		"Name of a file containing additional Kubernetes manifests that will be added to "+
+			"the bundle and applied to the cluster as part of the upgrade. Can be "+
+			"used multiple times.",
+	)
+	flags.StringVar(
+		&command.flags.maxBandwidth,
+		"max-bandwidth",
+		"",
+		"Maximum bandwidth used to download images, adding all the downloads, in bytes "+
+			"per second. Accepts units, for example '50MiB' or '10MB'. The default is "+
+			"to not limit the bandwidth.",
+	)
+	flags.IntVar(
+		&command.flags.retries,
+		"retries",
+		5,
+		"Number of times that the inspection of the release and the download of each "+
+			"image will be retried if it fails.",
+	)
+	flags.DurationVar(
+		&command.flags.retryDelay,
+		"retry-delay",
+		10*time.Second,
+		"Time to wait before the first retry. This time is doubled for each "+
+			"subsequent retry, up to a maximum of five minutes.",
+	)
+	flags.BoolVar(
+		&command.flags.force,
+		"force",
+		false,
+		"Create the bundle even if the output directory already contains a valid "+
+			"bundle for the same version and architecture.",
+	)
+	flags.StringVar(
+		&command.flags.signingKey,
+		"signing-key",
+		"",
+		"Name of the PEM file containing the private key used to sign the provenance "+
+			"attestation of the bundle. ECDSA, Ed25519 and RSA keys are supported. If "+
+			"not specified the bundle will not contain a provenance attestation.",
+	)
+	flags.StringVar(
+		&command.flags.builderID,
+		"builder-id",
+		"",
+		"Identifier of the builder written to the provenance attestation. The default "+
+			"is the URL of the project.",
+	)
+	flags.StringVar(
+		&command.flags.uploadURL,
+		"upload-url",
+		"",
+		"URL of a directory of an S3 compatible object store, for example "+
+			"'s3://bundles/4.13', where the bundle, digest and manifest files will be "+
+			"uploaded after writing them to the output directory.",
+	)
+	flags.StringVar(
+		&command.flags.s3Endpoint,
+		"s3-endpoint",
+		"",
+		"URL of the S3 compatible object store, for example 'https://minio.example.com'. "+
+			"If this isn't specified it will be read from the 'endpoint' file of the "+
+			"credentials directory, or else the AWS endpoint of the region will be used.",
+	)
+	flags.StringVar(
+		&command.flags.s3Region,
+		"s3-region",
+		"",
+		"Region of the S3 compatible object store. If this isn't specified it will be "+
+			"read from the 'region' file of the credentials directory, or else "+
+			"'us-east-1' will be used.",
+	)
+	flags.StringVar(
+		&command.flags.s3CredentialsDir,
+		"s3-credentials-dir",
+		"",
+		"Path of the directory containing the 'access-key-id', 'secret-access-key' and "+
+			"optionally 'session-token' files used to access the S3 compatible object "+
+			"store, usually mounted from a secret.",
 	)
 	return result
 }
 
 type createBundleCommand struct {
 	flags struct {
-		version    string
-		arch       string
-		outputDir  string
-		pullSecret string
+		version          string
+		arch             string
+		outputDir        string
+		pullSecret       string
+		distribution     string
+		releaseRepo      string
+		namespace        string
+		imageSet         string
+		channel          string
+		graphURL         string
+		extraManifests   []string
+		maxBandwidth     string
+		retries          int
+		retryDelay       time.Duration
+		force            bool
+		signingKey       string
+		builderID        string
+		uploadURL        string
+		s3Endpoint       string
+		s3Region         string
+		s3CredentialsDir string
 	}
 }
 
@@ -91,23 +245,72 @@ func (c *createBundleCommand) run(cmd *cobra.Command, argv []string) error {
 		console.Error("Output directory is mandatory")
 		ok = false
 	}
-	if c.flags.pullSecret == "" {
+	if !slices.Contains(internal.Distributions(), c.flags.distribution) {
+		console.Error(
+			"Distribution '%s' isn't valid, it should be one of %s",
+			c.flags.distribution, strings.Join(internal.Distributions(), ", "),
+		)
+		ok = false
+	}
+	if c.flags.pullSecret == "" && c.flags.distribution != internal.DistributionOKD &&
+		c.flags.imageSet == "" {
 		console.Error("Pull secret is mandatory")
 		ok = false
 	}
+	var maxBandwidth uint64
+	if c.flags.maxBandwidth != "" {
+		maxBandwidth, err = humanize.ParseBytes(c.flags.maxBandwidth)
+		if err != nil {
+			console.Error(
+				"Maximum bandwidth '%s' isn't valid: %v",
+				c.flags.maxBandwidth, err,
+			)
+			ok = false
+		}
+	}
+	if c.flags.retries < 0 {
+		console.Error(
+			"Number of retries %d isn't valid, it must be greater than or equal to zero",
+			c.flags.retries,
+		)
+		ok = false
+	}
+	if c.flags.namespace == "" {
+		console.Error("Namespace is mandatory")
+		ok = false
+	}
 	if !ok {
 		return exit.Error(1)
 	}
 
 	// Create and run the bundle creator:
-	creator, err := internal.NewBundleCreator().
+	builder := internal.NewBundleCreator().
 		SetLogger(logger).
 		SetConsole(console).
 		SetVersion(c.flags.version).
 		SetArch(c.flags.arch).
 		SetPullSecret(c.flags.pullSecret).
 		SetOutputDir(c.flags.outputDir).
-		Build()
+		SetDistribution(c.flags.distribution).
+		SetReleaseRepo(c.flags.releaseRepo).
+		SetNamespace(c.flags.namespace).
+		SetImageSet(c.flags.imageSet).
+		SetChannel(c.flags.channel).
+		SetGraphURL(c.flags.graphURL).
+		AddExtraManifests(c.flags.extraManifests...).
+		SetMaxBandwidth(int64(maxBandwidth)).
+		SetRetries(c.flags.retries).
+		SetRetryDelay(c.flags.retryDelay).
+		SetForce(c.flags.force).
+		SetSigningKey(c.flags.signingKey).
+		SetUploadURL(c.flags.uploadURL).
+		SetS3Endpoint(c.flags.s3Endpoint).
+		SetS3Region(c.flags.s3Region).
+		SetS3CredentialsDir(c.flags.s3CredentialsDir)
+	if c.flags.builderID != "" {
+		builder.SetBuilderID(c.flags.builderID)
+	}
+	creator, err := builder.Build()
 	if err != nil {
 		logger.Error(err, "Failed to create creator")
 		return exit.Error(1)
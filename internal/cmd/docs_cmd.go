@@ -0,0 +1,140 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+	"golang.org/x/exp/slices"
+
+	"github.com/jhernand/upgrade-tool/internal"
+	"github.com/jhernand/upgrade-tool/internal/exit"
+)
+
+// Docs creates and returns the `docs` command.
+func Docs() *cobra.Command {
+	command := &docsCommand{}
+	result := &cobra.Command{
+		Use:   "docs",
+		Short: "Generates the documentation of the command line",
+		Long: "Generates the man pages and the Markdown reference of all the commands and " +
+			"flags, so that the documentation packaged with the binary always matches it. " +
+			"Man pages are written to the 'man' sub-directory of the output directory and " +
+			"the Markdown reference to the 'markdown' sub-directory.",
+		Args:   cobra.NoArgs,
+		Hidden: true,
+		RunE:   command.run,
+	}
+	flags := result.Flags()
+	flags.StringVar(
+		&command.flags.dir,
+		"dir",
+		"docs",
+		"Directory where the documentation will be written. It will be created if it "+
+			"doesn't exist.",
+	)
+	flags.StringSliceVar(
+		&command.flags.formats,
+		"format",
+		docsFormats,
+		"Formats of the documentation, one or more of 'man' and 'markdown'.",
+	)
+	return result
+}
+
+type docsCommand struct {
+	flags struct {
+		dir     string
+		formats []string
+	}
+}
+
+func (c *docsCommand) run(cmd *cobra.Command, argv []string) error {
+	// Get the context:
+	ctx := cmd.Context()
+
+	// Get the dependencies from the context:
+	console := internal.ConsoleFromContext(ctx)
+
+	// Check the flags:
+	ok := true
+	if c.flags.dir == "" {
+		console.Error("Output directory is mandatory")
+		ok = false
+	}
+	if len(c.flags.formats) == 0 {
+		console.Error("At least one format is mandatory")
+		ok = false
+	}
+	for _, format := range c.flags.formats {
+		if !slices.Contains(docsFormats, format) {
+			console.Error(
+				"Format '%s' isn't valid, it should be one of %s",
+				format, strings.Join(docsFormats, ", "),
+			)
+			ok = false
+		}
+	}
+	if !ok {
+		return exit.Error(1)
+	}
+
+	// The documentation is generated for the complete tree of commands, not just for the
+	// command that is running. Note that the automatically generated tag contains the current
+	// date, so we disable it in order to generate the same documentation for the same binary.
+	root := cmd.Root()
+	root.DisableAutoGenTag = true
+	for _, format := range c.flags.formats {
+		dir := filepath.Join(c.flags.dir, format)
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			console.Error("Failed to create directory '%s': %v", dir, err)
+			return exit.Error(1)
+		}
+		switch format {
+		case docsFormatMan:
+			err = doc.GenManTree(root, &doc.GenManHeader{
+				Title:   strings.ToUpper(root.Name()),
+				Section: "1",
+				Source:  root.Name(),
+				Manual:  "Upgrade Tool Manual",
+			}, dir)
+		case docsFormatMarkdown:
+			err = doc.GenMarkdownTree(root, dir)
+		}
+		if err != nil {
+			console.Error("Failed to generate '%s' documentation: %v", format, err)
+			return exit.Error(1)
+		}
+		console.Info("Generated '%s' documentation in '%s'", format, dir)
+	}
+
+	return nil
+}
+
+// Supported documentation formats:
+const (
+	docsFormatMan      = "man"
+	docsFormatMarkdown = "markdown"
+)
+
+var docsFormats = []string{
+	docsFormatMan,
+	docsFormatMarkdown,
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slices"
+
+	"github.com/jhernand/upgrade-tool/internal"
+	"github.com/jhernand/upgrade-tool/internal/exit"
+)
+
+// Estimate creates and returns the `estimate` command.
+func Estimate() *cobra.Command {
+	command := &estimateCommand{}
+	result := &cobra.Command{
+		Use:   "estimate",
+		Short: "Estimates the size of a bundle and the time to create it",
+		Long: "Inspects the release image and the manifests of the payload images, without " +
+			"downloading them, and reports the amount of data that will be downloaded, " +
+			"the approximate size of the bundle file and the time that the download " +
+			"will take with the given bandwidth.",
+		Args: cobra.NoArgs,
+		RunE: command.run,
+	}
+	flags := result.Flags()
+	flags.StringVar(
+		&command.flags.version,
+		"version",
+		"",
+		"Version number, for example 4.13.4",
+	)
+	flags.StringVar(
+		&command.flags.arch,
+		"arch",
+		"",
+		"Architecture, for example x86_64",
+	)
+	flags.StringVar(
+		&command.flags.pullSecret,
+		"pull-secret",
+		"",
+		"Name of the file containing the pull secret. Mandatory for the 'ocp' distribution.",
+	)
+	flags.StringVar(
+		&command.flags.distribution,
+		"distribution",
+		internal.DistributionOCP,
+		fmt.Sprintf(
+			"Distribution of the release, one of %s.",
+			strings.Join(internal.Distributions(), ", "),
+		),
+	)
+	flags.StringVar(
+		&command.flags.releaseRepo,
+		"release-repo",
+		"",
+		"Repository containing the release images. The default depends on the "+
+			"distribution.",
+	)
+	flags.StringVar(
+		&command.flags.bandwidth,
+		"bandwidth",
+		"10MiB",
+		"Bandwidth used to calculate the download time, in bytes per second. Accepts "+
+			"units, for example '50MiB' or '10MB'.",
+	)
+	flags.IntVar(
+		&command.flags.retries,
+		"retries",
+		5,
+		"Number of times that the inspection of the release and of each image will be "+
+			"retried if it fails.",
+	)
+	flags.StringVar(
+		&command.flags.output,
+		"output",
+		internal.OutputText,
+		fmt.Sprintf(
+			"Format of the result, one of %s. The 'json' and 'yaml' formats contain the "+
+				"'release', 'images', 'blobs', 'downloadBytes', 'bundleBytes', "+
+				"'bandwidth' and 'duration' fields. Sizes are in bytes, the bandwidth "+
+				"in bytes per second and the duration in nanoseconds.",
+			strings.Join(internal.OutputFormats(), ", "),
+		),
+	)
+	return result
+}
+
+type estimateCommand struct {
+	flags struct {
+		version      string
+		arch         string
+		pullSecret   string
+		distribution string
+		releaseRepo  string
+		bandwidth    string
+		retries      int
+		output       string
+	}
+}
+
+func (c *estimateCommand) run(cmd *cobra.Command, argv []string) error {
+	var err error
+
+	// Get the context:
+	ctx := cmd.Context()
+
+	// Get the dependencies from the context:
+	tool := internal.ToolFromContext(ctx)
+	logger := internal.LoggerFromContext(ctx)
+	console := internal.ConsoleFromContext(ctx)
+
+	// Check the flags:
+	ok := true
+	if c.flags.version == "" {
+		console.Error("Version is mandatory")
+		ok = false
+	}
+	if c.flags.arch == "" {
+		console.Error("Architecture is mandatory")
+		ok = false
+	}
+	if !slices.Contains(internal.Distributions(), c.flags.distribution) {
+		console.Error(
+			"Distribution '%s' isn't valid, it should be one of %s",
+			c.flags.distribution, strings.Join(internal.Distributions(), ", "),
+		)
+		ok = false
+	}
+	if c.flags.pullSecret == "" && c.flags.distribution != internal.DistributionOKD {
+		console.Error("Pull secret is mandatory")
+		ok = false
+	}
+	bandwidth, err := humanize.ParseBytes(c.flags.bandwidth)
+	if err != nil || bandwidth == 0 {
+		console.Error("Bandwidth '%s' isn't valid", c.flags.bandwidth)
+		ok = false
+	}
+	if !slices.Contains(internal.OutputFormats(), c.flags.output) {
+		console.Error(
+			"Output format '%s' isn't valid, it should be one of %s",
+			c.flags.output, strings.Join(internal.OutputFormats(), ", "),
+		)
+		ok = false
+	}
+	if !ok {
+		return exit.Error(1)
+	}
+
+	// Create and run the estimator:
+	estimator, err := internal.NewBundleEstimator().
+		SetLogger(logger).
+		SetVersion(c.flags.version).
+		SetArch(c.flags.arch).
+		SetPullSecret(c.flags.pullSecret).
+		SetDistribution(c.flags.distribution).
+		SetReleaseRepo(c.flags.releaseRepo).
+		SetBandwidth(int64(bandwidth)).
+		SetRetries(c.flags.retries).
+		Build()
+	if err != nil {
+		console.Error("Failed to create estimator: %v", err)
+		return exit.Error(1)
+	}
+	estimate, err := estimator.Run(ctx)
+	if err != nil {
+		console.Error("Failed to calculate estimate: %v", err)
+		return exit.Error(1)
+	}
+
+	// Write the result:
+	switch c.flags.output {
+	case internal.OutputJSON, internal.OutputYAML:
+		err = internal.WriteOutput(tool.Out(), c.flags.output, estimate)
+		if err != nil {
+			console.Error("Failed to write estimate: %v", err)
+			return exit.Error(1)
+		}
+	default:
+		// The report is the result of the command, so it is written to the standard output
+		// instead of the console, as otherwise it would be hidden when the console is muted:
+		_, err = fmt.Fprintf(
+			tool.Out(),
+			"Release is '%s'\n"+
+				"Images: %d, distinct blobs: %d\n"+
+				"Download size: %s\n"+
+				"Bundle size: %s\n"+
+				"Download time at %s/s: %s\n",
+			estimate.Release,
+			estimate.Images, estimate.Blobs,
+			humanize.IBytes(uint64(estimate.DownloadBytes)),
+			humanize.IBytes(uint64(estimate.BundleBytes)),
+			humanize.IBytes(uint64(estimate.Bandwidth)), estimate.Duration.Round(time.Second),
+		)
+		if err != nil {
+			console.Error("Failed to write estimate: %v", err)
+			return exit.Error(1)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package gc
+
+import (
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/jhernand/upgrade-tool/internal"
+	"github.com/jhernand/upgrade-tool/internal/exit"
+)
+
+// GCRegistry creates and returns the `gc registry` command.
+func GCRegistry() *cobra.Command {
+	command := &gcRegistryCommand{}
+	result := &cobra.Command{
+		Use:   "registry",
+		Short: "Removes the unused blobs from the storage of a registry",
+		Long: "Removes from the storage directory of the embedded registry the blobs that " +
+			"aren't referenced by any manifest, for example the blobs left behind by " +
+			"repeated bundle creations. The registry must not be running while this is " +
+			"executed, as the blobs of the images being pushed would be removed.",
+		Args: cobra.NoArgs,
+		RunE: command.run,
+	}
+	flags := result.Flags()
+	flags.StringVar(
+		&command.flags.dir,
+		"dir",
+		"",
+		"Storage directory of the registry, for example the directory where a bundle "+
+			"has been extracted.",
+	)
+	flags.BoolVar(
+		&command.flags.removeUntagged,
+		"remove-untagged",
+		false,
+		"Remove also the manifests that aren't referenced by any tag, and the blobs that "+
+			"are only referenced by them.",
+	)
+	return result
+}
+
+type gcRegistryCommand struct {
+	flags struct {
+		dir            string
+		removeUntagged bool
+	}
+}
+
+func (c *gcRegistryCommand) run(cmd *cobra.Command, argv []string) error {
+	// Get the context:
+	ctx := cmd.Context()
+
+	// Get the dependencies from the context:
+	logger := internal.LoggerFromContext(ctx)
+	console := internal.ConsoleFromContext(ctx)
+
+	// Check the flags:
+	if c.flags.dir == "" {
+		console.Error("Storage directory is mandatory")
+		return exit.Error(1)
+	}
+	info, err := os.Stat(c.flags.dir)
+	if err != nil {
+		console.Error("Failed to check storage directory '%s': %v", c.flags.dir, err)
+		return exit.Error(1)
+	}
+	if !info.IsDir() {
+		console.Error("Storage directory '%s' isn't a directory", c.flags.dir)
+		return exit.Error(1)
+	}
+
+	// Ask for confirmation, as the removed blobs can't be recovered:
+	confirmed, err := console.Confirm(
+		"Unused blobs will be removed from '%s', do you want to continue?",
+		c.flags.dir,
+	)
+	if err != nil {
+		console.Error("Failed to confirm garbage collection: %v", err)
+		return exit.Error(1)
+	}
+	if !confirmed {
+		console.Info("Garbage collection cancelled")
+		return nil
+	}
+
+	// Create the registry, but don't start it, as that isn't needed to collect the garbage:
+	registry, err := internal.NewRegistry().
+		SetLogger(logger).
+		SetAddress("localhost:0").
+		SetRoot(c.flags.dir).
+		Build()
+	if err != nil {
+		console.Error("Failed to create registry: %v", err)
+		return exit.Error(1)
+	}
+	console.Info("Collecting garbage from '%s' ...", c.flags.dir)
+	reclaimed, err := registry.GarbageCollect(ctx, c.flags.removeUntagged)
+	if err != nil {
+		console.Error("Failed to collect garbage: %v", err)
+		return exit.Error(1)
+	}
+	console.Info("Reclaimed %s", humanize.IBytes(uint64(reclaimed)))
+
+	return nil
+}
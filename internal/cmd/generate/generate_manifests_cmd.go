@@ -0,0 +1,108 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package generate
+
+import (
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jhernand/upgrade-tool/internal"
+	"github.com/jhernand/upgrade-tool/internal/exit"
+)
+
+// GenerateManifests creates and returns the `generate manifests` command.
+func GenerateManifests() *cobra.Command {
+	command := &generateManifestsCommand{}
+	result := &cobra.Command{
+		Use:   "manifests",
+		Short: "Generates the namespace and RBAC manifests",
+		Long: "Generates the namespace, service accounts, roles and role bindings that the " +
+			"controller and the programs that run in the nodes need, with only the " +
+			"permissions that they use, so that there is no need to grant the " +
+			"cluster-admin role to the tool. Note that the additional manifests " +
+			"included in bundles may need other permissions that have to be granted " +
+			"explicitly to the 'controller' service account.",
+		Args: cobra.NoArgs,
+		RunE: command.run,
+	}
+	flags := result.Flags()
+	flags.StringVar(
+		&command.flags.namespace,
+		"namespace",
+		"upgrade-tool",
+		"Namespace where the controller creates its objects.",
+	)
+	flags.StringVar(
+		&command.flags.output,
+		"output",
+		"-",
+		"File where the manifests will be written. The default is to write them to the "+
+			"standard output.",
+	)
+	return result
+}
+
+type generateManifestsCommand struct {
+	flags struct {
+		namespace string
+		output    string
+	}
+}
+
+func (c *generateManifestsCommand) run(cmd *cobra.Command, argv []string) error {
+	// Get the context:
+	ctx := cmd.Context()
+
+	// Get the dependencies from the context:
+	tool := internal.ToolFromContext(ctx)
+	logger := internal.LoggerFromContext(ctx)
+	console := internal.ConsoleFromContext(ctx)
+
+	// Check the flags:
+	if c.flags.namespace == "" {
+		console.Error("Namespace is mandatory")
+		return exit.Error(1)
+	}
+
+	// Open the output:
+	var writer io.Writer
+	if c.flags.output == "-" {
+		writer = tool.Out()
+	} else {
+		file, err := os.OpenFile(c.flags.output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			console.Error("Failed to open output file '%s': %v", c.flags.output, err)
+			return exit.Error(1)
+		}
+		defer func() {
+			err := file.Close()
+			if err != nil {
+				logger.Error(err, "Failed to close output file")
+			}
+		}()
+		writer = file
+	}
+
+	// Write the manifests:
+	err := internal.WriteManifests(writer, internal.RBACManifests(c.flags.namespace))
+	if err != nil {
+		console.Error("Failed to write manifests: %v", err)
+		return exit.Error(1)
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package start
+
+import (
+	sgnl "os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/runtime"
+	core "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/jhernand/upgrade-tool/internal"
+	"github.com/jhernand/upgrade-tool/internal/exit"
+)
+
+// StartBundleAgent creates and returns the `start bundle-agent` command.
+func StartBundleAgent() *cobra.Command {
+	command := &startBundleAgentCommand{}
+	result := &cobra.Command{
+		Use:   "bundle-agent",
+		Short: "Starts the agent that extracts bundles and loads images when requested",
+		Args:  cobra.NoArgs,
+		RunE:  command.run,
+	}
+	flags := result.Flags()
+	flags.StringVar(
+		&command.flags.node,
+		"node",
+		"",
+		"Name of the node where this is running.",
+	)
+	flags.DurationVar(
+		&command.flags.interval,
+		"interval",
+		10*time.Second,
+		"Interval between checks of the commands requested by the controller.",
+	)
+	flags.IntVar(
+		&command.flags.retries,
+		"retries",
+		3,
+		"Number of times that a command that fails will be executed again. The delay "+
+			"between retries grows exponentially.",
+	)
+	return result
+}
+
+type startBundleAgentCommand struct {
+	flags struct {
+		node     string
+		interval time.Duration
+		retries  int
+	}
+}
+
+func (c *startBundleAgentCommand) run(cmd *cobra.Command, argv []string) error {
+	// Get the context:
+	ctx := cmd.Context()
+
+	// Get the dependencies from the context:
+	logger := internal.LoggerFromContext(ctx)
+
+	// Check the flags:
+	if c.flags.node == "" {
+		logger.Error(nil, "Node is mandatory")
+		return exit.Error(1)
+	}
+
+	// Create the API client:
+	scheme := runtime.NewScheme()
+	core.AddToScheme(scheme)
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		logger.Error(err, "Failed to load API configuration")
+		return exit.Error(1)
+	}
+	options := clnt.Options{
+		Scheme: scheme,
+	}
+	client, err := clnt.New(config, options)
+	if err != nil {
+		logger.Error(err, "Failed to create API client")
+		return exit.Error(1)
+	}
+
+	// Create the agent:
+	agent, err := internal.NewBundleAgent().
+		SetLogger(logger).
+		SetClient(client).
+		SetNode(c.flags.node).
+		SetInterval(c.flags.interval).
+		SetRetries(c.flags.retries).
+		Build()
+	if err != nil {
+		logger.Error(err, "Failed to create agent")
+		return exit.Error(1)
+	}
+
+	// Run the agent till we receive the stop signal:
+	ctx, stop := sgnl.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	err = agent.Run(ctx)
+	if err != nil {
+		logger.Error(err, "Failed to run agent")
+		return exit.Error(1)
+	}
+
+	return nil
+}
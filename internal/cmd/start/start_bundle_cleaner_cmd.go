@@ -15,6 +15,11 @@ License.
 package start
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
+	configv1 "github.com/openshift/api/config/v1"
 	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/runtime"
 	core "k8s.io/client-go/kubernetes/scheme"
@@ -22,12 +27,13 @@ import (
 	clnt "sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/jhernand/upgrade-tool/internal"
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
 	"github.com/jhernand/upgrade-tool/internal/exit"
 )
 
 // StartBundleCleaner creates and returns the `start bundle-cleaner` command.
 func StartBundleCleaner() *cobra.Command {
-	command := &startBundleLoaderCommand{}
+	command := &startBundleCleanerCommand{}
 	result := &cobra.Command{
 		Use:   "bundle-cleaner",
 		Short: "Starts the program that cleans after the upgrade",
@@ -48,20 +54,67 @@ func StartBundleCleaner() *cobra.Command {
 		"",
 		"Name of the node where this is running.",
 	)
+	flags.StringVar(
+		&command.flags.namespace,
+		"namespace",
+		"",
+		"Namespace where the status of the node will be written. If not specified the "+
+			"status is only written to the labels of the node.",
+	)
 	flags.StringVar(
 		&command.flags.bundleDir,
 		"bundle-dir",
 		"/var/lib/upgrade",
 		"Bundle directory.",
 	)
+	flags.BoolVar(
+		&command.flags.force,
+		"force",
+		false,
+		"Clean even if the cluster version or the machine configuration of the node "+
+			"indicate that the upgrade is still in progress.",
+	)
+	flags.BoolVar(
+		&command.flags.keepPinning,
+		"keep-pinning",
+		false,
+		"Keep the CRI-O configuration that pins the images of the release, so that they "+
+			"will not be garbage collected.",
+	)
+	flags.BoolVar(
+		&command.flags.removeOldImages,
+		"remove-old-images",
+		false,
+		"Remove the images of previous releases that aren't used by any container.",
+	)
+	flags.BoolVar(
+		&command.flags.dryRun,
+		"dry-run",
+		false,
+		"Only report the directories, CRI-O configuration files and images that would "+
+			"be removed, without changing anything.",
+	)
+	flags.DurationVar(
+		&command.flags.tempAge,
+		"temp-age",
+		time.Hour,
+		"Minimum age of the temporary directories left behind by the registry and skopeo "+
+			"that will be removed. Younger directories are assumed to be still in use.",
+	)
 	return result
 }
 
 type startBundleCleanerCommand struct {
 	flags struct {
-		root      string
-		node      string
-		bundleDir string
+		root            string
+		node            string
+		namespace       string
+		bundleDir       string
+		force           bool
+		keepPinning     bool
+		removeOldImages bool
+		dryRun          bool
+		tempAge         time.Duration
 	}
 }
 
@@ -71,6 +124,7 @@ func (c *startBundleCleanerCommand) run(cmd *cobra.Command, argv []string) error
 
 	// Get the dependencies from the context:
 	logger := internal.LoggerFromContext(ctx)
+	console := internal.ConsoleFromContext(ctx)
 
 	// Check the flags:
 	ok := true
@@ -86,9 +140,37 @@ func (c *startBundleCleanerCommand) run(cmd *cobra.Command, argv []string) error
 		return exit.Error(1)
 	}
 
+	// Ask for confirmation, as the cleaner removes files from the node, unless this is a dry
+	// run:
+	if !c.flags.dryRun {
+		removed := []string{
+			fmt.Sprintf("the bundle directory '%s'", c.flags.bundleDir),
+		}
+		if !c.flags.keepPinning {
+			removed = append(removed, "the CRI-O configuration that pins the release images")
+		}
+		if c.flags.removeOldImages {
+			removed = append(removed, "the images of previous releases")
+		}
+		confirmed, err := console.Confirm(
+			"The cleaner will remove %s from node '%s', do you want to continue?",
+			strings.Join(removed, ", "), c.flags.node,
+		)
+		if err != nil {
+			logger.Error(err, "Failed to confirm cleaning")
+			return exit.Error(1)
+		}
+		if !confirmed {
+			logger.Info("Cleaning cancelled")
+			return nil
+		}
+	}
+
 	// Create the API client:
 	scheme := runtime.NewScheme()
 	core.AddToScheme(scheme)
+	configv1.AddToScheme(scheme)
+	v1alpha1.AddToScheme(scheme)
 	config, err := ctrl.GetConfig()
 	if err != nil {
 		logger.Error(err, "Failed to load API configuration")
@@ -103,20 +185,27 @@ func (c *startBundleCleanerCommand) run(cmd *cobra.Command, argv []string) error
 		return exit.Error(1)
 	}
 
-	// Start and execute the bundle loader:
-	loader, err := internal.NewBundleExtractor().
+	// Start and execute the bundle cleaner:
+	cleaner, err := internal.NewBundleCleaner().
 		SetLogger(logger).
 		SetClient(client).
 		SetNode(c.flags.node).
+		SetNamespace(c.flags.namespace).
+		SetRootDir(c.flags.root).
 		SetBundleDir(c.flags.bundleDir).
+		SetForce(c.flags.force).
+		SetKeepPinning(c.flags.keepPinning).
+		SetRemoveOldImages(c.flags.removeOldImages).
+		SetDryRun(c.flags.dryRun).
+		SetTempAge(c.flags.tempAge).
 		Build()
 	if err != nil {
-		logger.Error(err, "Failed to create loader")
+		logger.Error(err, "Failed to create cleaner")
 		return exit.Error(1)
 	}
-	err = loader.Run(ctx)
+	err = cleaner.Run(ctx)
 	if err != nil {
-		logger.Error(err, "Failed to execute loader")
+		logger.Error(err, "Failed to execute cleaner")
 		return exit.Error(1)
 	}
 
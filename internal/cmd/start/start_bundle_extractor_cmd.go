@@ -15,6 +15,8 @@ License.
 package start
 
 import (
+	"time"
+
 	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/runtime"
 	core "k8s.io/client-go/kubernetes/scheme"
@@ -22,6 +24,7 @@ import (
 	clnt "sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/jhernand/upgrade-tool/internal"
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
 	"github.com/jhernand/upgrade-tool/internal/exit"
 )
 
@@ -48,6 +51,13 @@ func StartBundleExtractor() *cobra.Command {
 		"",
 		"Name of the node where this is running.",
 	)
+	flags.StringVar(
+		&command.flags.namespace,
+		"namespace",
+		"",
+		"Namespace where the status of the node will be written. If not specified the "+
+			"status is only written to the annotations and labels of the node.",
+	)
 	flags.StringVar(
 		&command.flags.bundleFile,
 		"bundle-file",
@@ -56,6 +66,87 @@ func StartBundleExtractor() *cobra.Command {
 			"exists then it will not be necessary to download it from other nodes "+
 			"of the cluster.",
 	)
+	flags.StringVar(
+		&command.flags.bundleVersion,
+		"bundle-version",
+		"",
+		"Version of the bundle. If this is specified then the bundle will be searched "+
+			"in the index of the bundle servers, so that servers containing multiple "+
+			"bundles can be used.",
+	)
+	flags.StringVar(
+		&command.flags.bundleArch,
+		"bundle-arch",
+		"",
+		"Architecture of the bundle. This is used together with the version to find "+
+			"the bundle in the index of the bundle servers.",
+	)
+	flags.StringVar(
+		&command.flags.bundleDigest,
+		"bundle-digest",
+		"",
+		"Expected SHA-256 digest of the bundle, for example 'sha256:3a4c...'. If this "+
+			"isn't specified the digest will be read from the '.sha256' file next to "+
+			"the bundle file, or obtained from the bundle server.",
+	)
+	flags.StringVar(
+		&command.flags.expectedVersion,
+		"expected-version",
+		"",
+		"Version that the cluster expects. If the version in the metadata of the bundle "+
+			"is different the bundle will not be extracted.",
+	)
+	flags.StringVar(
+		&command.flags.expectedArch,
+		"expected-arch",
+		"",
+		"Architecture that the cluster expects, for example 'x86_64' or 'amd64'. If the "+
+			"architecture in the metadata of the bundle is different the bundle will "+
+			"not be extracted.",
+	)
+	flags.StringVar(
+		&command.flags.bundleURL,
+		"bundle-url",
+		"",
+		"URL where the bundle can be downloaded from instead of the bundle server. This "+
+			"can be an 's3://bucket/key' URL for bundles stored in an S3 compatible "+
+			"object store, or a plain 'http' or 'https' URL.",
+	)
+	flags.StringVar(
+		&command.flags.s3Endpoint,
+		"s3-endpoint",
+		"",
+		"URL of the S3 compatible object store, for example 'https://minio.example.com'. "+
+			"If this isn't specified it will be read from the 'endpoint' file of the "+
+			"credentials directory, or else the AWS endpoint of the region will be used.",
+	)
+	flags.StringVar(
+		&command.flags.s3Region,
+		"s3-region",
+		"",
+		"Region of the S3 compatible object store. If this isn't specified it will be "+
+			"read from the 'region' file of the credentials directory, or else "+
+			"'us-east-1' will be used.",
+	)
+	flags.StringVar(
+		&command.flags.s3CredentialsDir,
+		"s3-credentials-dir",
+		"",
+		"Path of the directory containing the 'access-key-id', 'secret-access-key' and "+
+			"optionally 'session-token' files used to access the S3 compatible object "+
+			"store, usually mounted from a secret. Note that this isn't relative to the "+
+			"filesystem root.",
+	)
+	flags.StringSliceVar(
+		&command.flags.mediaDirs,
+		"media-dir",
+		[]string{},
+		"Directory where removable media are mounted, for example '/run/media'. The "+
+			"extractor will look there and in its subdirectories for bundle files named "+
+			"'upgrade-*.tar' and will use the first one whose digest matches the one "+
+			"given with '--bundle-digest' or the one in the '.sha256' file next to it. "+
+			"Can be specified multiple times.",
+	)
 	flags.StringVar(
 		&command.flags.bundleDir,
 		"bundle-dir",
@@ -66,18 +157,108 @@ func StartBundleExtractor() *cobra.Command {
 		&command.flags.bundleServer,
 		"bundle-server",
 		"localhost:8080",
-		"Address of the server where the bundle can be downloaded from.",
+		"Address of the server where the bundle can be downloaded from. This can also "+
+			"be a comma separated list of addresses, which will be tried in order. If "+
+			"the download fails in the middle it will continue from the next server "+
+			"that has the same bundle.",
+	)
+	flags.BoolVar(
+		&command.flags.replicate,
+		"replicate",
+		false,
+		"Save a copy of the downloaded bundle next to the bundle directory, so that "+
+			"the bundle server running in this node can serve it to other nodes.",
+	)
+	flags.BoolVar(
+		&command.flags.streaming,
+		"streaming",
+		false,
+		"Extract the bundle while it is downloaded, without saving it to a file. This "+
+			"halves the disk space needed, but if the extractor is restarted the "+
+			"download will start again from the beginning. Ignored when '--replicate' "+
+			"is used.",
+	)
+	flags.StringVar(
+		&command.flags.tokenFile,
+		"token-file",
+		"",
+		"Path of a file containing the bearer token that will be sent to the bundle "+
+			"server. Note that this isn't relative to the filesystem root.",
+	)
+	flags.StringVar(
+		&command.flags.proxy,
+		"proxy",
+		"",
+		"URL of the proxy server used to download the bundle, for example "+
+			"'http://proxy.example.com:3128'. If this isn't specified the proxy will be "+
+			"obtained from the 'HTTP_PROXY', 'HTTPS_PROXY' and 'NO_PROXY' environment "+
+			"variables.",
+	)
+	flags.StringVar(
+		&command.flags.noProxy,
+		"no-proxy",
+		"",
+		"Comma separated list of host names, domains, IP addresses or CIDR ranges that "+
+			"will be accessed without the proxy, for example '.svc,.cluster.local'.",
+	)
+	flags.StringVar(
+		&command.flags.caFile,
+		"ca-file",
+		"",
+		"Path of a file containing PEM encoded CA certificates that will be trusted, in "+
+			"addition to the system ones, when downloading the bundle with HTTPS. Note "+
+			"that this isn't relative to the filesystem root.",
+	)
+	flags.DurationVar(
+		&command.flags.retryDelay,
+		"retry-delay",
+		10*time.Second,
+		"Time to wait before trying again to obtain the bundle when it isn't available, "+
+			"for example when the bundle server isn't ready yet. This time is doubled "+
+			"for each subsequent attempt.",
+	)
+	flags.DurationVar(
+		&command.flags.maxRetryDelay,
+		"max-retry-delay",
+		time.Minute,
+		"Maximum time to wait between attempts to obtain the bundle.",
+	)
+	flags.DurationVar(
+		&command.flags.waitTimeout,
+		"wait-timeout",
+		time.Hour,
+		"Maximum time to wait for the bundle to be available. Zero means waiting forever.",
 	)
 	return result
 }
 
 type startBundleExtractorCommand struct {
 	flags struct {
-		root         string
-		node         string
-		bundleFile   string
-		bundleDir    string
-		bundleServer string
+		root             string
+		node             string
+		namespace        string
+		bundleFile       string
+		bundleVersion    string
+		bundleArch       string
+		bundleDigest     string
+		expectedVersion  string
+		expectedArch     string
+		bundleURL        string
+		s3Endpoint       string
+		s3Region         string
+		s3CredentialsDir string
+		mediaDirs        []string
+		bundleDir        string
+		bundleServer     string
+		replicate        bool
+		streaming        bool
+		tokenFile        string
+		proxy            string
+		noProxy          string
+		caFile           string
+		retryDelay       time.Duration
+		maxRetryDelay    time.Duration
+		waitTimeout      time.Duration
 	}
 }
 
@@ -94,15 +275,19 @@ func (c *startBundleExtractorCommand) run(cmd *cobra.Command, argv []string) err
 		logger.Error(nil, "Node is madatory")
 		ok = false
 	}
-	if c.flags.bundleFile == "" {
-		logger.Error(nil, "Bundle file is mandatory")
+	if c.flags.bundleFile == "" && c.flags.bundleVersion == "" && c.flags.bundleURL == "" &&
+		len(c.flags.mediaDirs) == 0 {
+		logger.Error(
+			nil,
+			"Bundle file, bundle version, bundle URL or media directory is mandatory",
+		)
 		ok = false
 	}
 	if c.flags.bundleDir == "" {
 		logger.Error(nil, "Bundle directory is mandatory")
 		ok = false
 	}
-	if c.flags.bundleServer == "" {
+	if c.flags.bundleServer == "" && c.flags.bundleURL == "" {
 		logger.Error(nil, "Bundle server is mandatory")
 		ok = false
 	}
@@ -113,6 +298,7 @@ func (c *startBundleExtractorCommand) run(cmd *cobra.Command, argv []string) err
 	// Create the API client:
 	scheme := runtime.NewScheme()
 	core.AddToScheme(scheme)
+	v1alpha1.AddToScheme(scheme)
 	config, err := ctrl.GetConfig()
 	if err != nil {
 		logger.Error(err, "Failed to load API configuration")
@@ -132,10 +318,30 @@ func (c *startBundleExtractorCommand) run(cmd *cobra.Command, argv []string) err
 		SetLogger(logger).
 		SetClient(client).
 		SetNode(c.flags.node).
+		SetNamespace(c.flags.namespace).
 		SetRootDir(c.flags.root).
 		SetBundleFile(c.flags.bundleFile).
 		SetBundleDir(c.flags.bundleDir).
+		SetVersion(c.flags.bundleVersion).
+		SetArch(c.flags.bundleArch).
+		SetDigest(c.flags.bundleDigest).
+		SetExpectedVersion(c.flags.expectedVersion).
+		SetExpectedArch(c.flags.expectedArch).
+		SetBundleURL(c.flags.bundleURL).
+		SetS3Endpoint(c.flags.s3Endpoint).
+		SetS3Region(c.flags.s3Region).
+		SetS3CredentialsDir(c.flags.s3CredentialsDir).
+		AddMediaDirs(c.flags.mediaDirs...).
 		SetServerAddr(c.flags.bundleServer).
+		SetReplicate(c.flags.replicate).
+		SetStreaming(c.flags.streaming).
+		SetTokenFile(c.flags.tokenFile).
+		SetProxy(c.flags.proxy).
+		SetNoProxy(c.flags.noProxy).
+		SetCAFile(c.flags.caFile).
+		SetRetryDelay(c.flags.retryDelay).
+		SetMaxRetryDelay(c.flags.maxRetryDelay).
+		SetWaitTimeout(c.flags.waitTimeout).
 		Build()
 	if err != nil {
 		logger.Error(err, "Failed to create extractor")
@@ -15,6 +15,10 @@ License.
 package start
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/runtime"
 	core "k8s.io/client-go/kubernetes/scheme"
@@ -22,6 +26,7 @@ import (
 	clnt "sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/jhernand/upgrade-tool/internal"
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
 	"github.com/jhernand/upgrade-tool/internal/exit"
 )
 
@@ -48,20 +53,157 @@ func StartBundleLoader() *cobra.Command {
 		"",
 		"Name of the node where this is running.",
 	)
+	flags.StringVar(
+		&command.flags.namespace,
+		"namespace",
+		"",
+		"Namespace where the status of the node will be written. If not specified the "+
+			"status is only written to the annotations and labels of the node.",
+	)
 	flags.StringVar(
 		&command.flags.bundleDir,
 		"bundle-dir",
 		"/var/lib/upgrade",
 		"Bundle directory.",
 	)
+	flags.StringVar(
+		&command.flags.provenanceKey,
+		"provenance-key",
+		"",
+		"Name of the PEM file containing the public key used to verify the provenance "+
+			"attestation of the bundle. If specified bundles without a valid "+
+			"attestation will not be loaded.",
+	)
+	flags.StringVar(
+		&command.flags.pullOrder,
+		"pull-order",
+		internal.PullOrderDefault,
+		fmt.Sprintf(
+			"Strategy used to decide the order of image pulls. The release image is "+
+				"always pulled first. Valid values are %s.",
+			strings.Join(internal.PullOrders(), ", "),
+		),
+	)
+	flags.StringSliceVar(
+		&command.flags.pullPriority,
+		"pull-priority",
+		[]string{},
+		fmt.Sprintf(
+			"Names of the images that will be pulled first when the pull order is "+
+				"'priority'. The default is '%s'.",
+			strings.Join(internal.DefaultPullPriority, ","),
+		),
+	)
+	flags.IntVar(
+		&command.flags.pullConcurrency,
+		"pull-concurrency",
+		2,
+		"Maximum number of images pulled in parallel. Higher values make loading faster "+
+			"but take more disk and CPU from the workloads running in the node.",
+	)
+	flags.DurationVar(
+		&command.flags.pullTimeout,
+		"pull-timeout",
+		10*time.Minute,
+		"Maximum time that a single attempt to pull an image can take. When exceeded the "+
+			"pull is cancelled and tried again.",
+	)
+	flags.IntVar(
+		&command.flags.pullAttempts,
+		"pull-attempts",
+		3,
+		"Number of times that the pull of an image is tried before marking the node as "+
+			"failed.",
+	)
+	flags.DurationVar(
+		&command.flags.loadTimeout,
+		"load-timeout",
+		0,
+		"Maximum time that pulling all the images can take. When exceeded the pulls are "+
+			"cancelled and the node is marked as failed. Zero means no limit.",
+	)
+	flags.StringVar(
+		&command.flags.loadMode,
+		"load-mode",
+		internal.LoadModeDefault,
+		fmt.Sprintf(
+			"Mode used to load the images into CRI-O. The '%s' mode starts a temporary "+
+				"registry and asks CRI-O to pull the images from it. The '%s' mode "+
+				"copies the images directly from the bundle directory into the "+
+				"container storage. Valid values are %s.",
+			internal.LoadModePull, internal.LoadModeCopy,
+			strings.Join(internal.LoadModes(), ", "),
+		),
+	)
+	flags.StringVar(
+		&command.flags.registryAddress,
+		"registry-address",
+		"localhost:0",
+		"Address where the registry that serves the images to CRI-O will listen. Use "+
+			"port zero to select a random port.",
+	)
+	flags.StringVar(
+		&command.flags.registryMetrics,
+		"registry-metrics-address",
+		"",
+		"Address where the registry that serves the images to CRI-O will serve its "+
+			"Prometheus metrics. If not specified the metrics aren't served.",
+	)
+	flags.StringVar(
+		&command.flags.registryCertDir,
+		"registry-cert-dir",
+		"",
+		"Directory containing the 'tls.crt' and 'tls.key' files used by the registry, "+
+			"usually a mounted secret. The files are loaded again when they change. If "+
+			"not specified a self signed certificate is generated. Note that this isn't "+
+			"relative to the filesystem root.",
+	)
+	flags.BoolVar(
+		&command.flags.keepBundle,
+		"keep-bundle",
+		false,
+		"Keep the bundle directory after loading the images, so that they can be loaded "+
+			"again without transferring the bundle. The bundle cleaner removes it "+
+			"when the upgrade finishes.",
+	)
+	flags.BoolVar(
+		&command.flags.roleFilter,
+		"role-filter",
+		false,
+		"Load only the images needed by the roles of the node. For example, worker nodes "+
+			"will not load the images that are only used in control plane nodes.",
+	)
+	flags.StringVar(
+		&command.flags.metricsFile,
+		"metrics-file",
+		"",
+		"File where the image pull metrics will be written in the Prometheus text "+
+			"format, for example for the textfile collector of the node exporter. If "+
+			"not specified the metrics aren't written.",
+	)
 	return result
 }
 
 type startBundleLoaderCommand struct {
 	flags struct {
-		root      string
-		node      string
-		bundleDir string
+		root            string
+		node            string
+		namespace       string
+		bundleDir       string
+		provenanceKey   string
+		pullOrder       string
+		pullPriority    []string
+		pullConcurrency int
+		pullTimeout     time.Duration
+		pullAttempts    int
+		loadTimeout     time.Duration
+		loadMode        string
+		registryAddress string
+		registryCertDir string
+		registryMetrics string
+		keepBundle      bool
+		roleFilter      bool
+		metricsFile     string
 	}
 }
 
@@ -89,6 +231,7 @@ func (c *startBundleLoaderCommand) run(cmd *cobra.Command, argv []string) error
 	// Create the API client:
 	scheme := runtime.NewScheme()
 	core.AddToScheme(scheme)
+	v1alpha1.AddToScheme(scheme)
 	config, err := ctrl.GetConfig()
 	if err != nil {
 		logger.Error(err, "Failed to load API configuration")
@@ -108,8 +251,23 @@ func (c *startBundleLoaderCommand) run(cmd *cobra.Command, argv []string) error
 		SetLogger(logger).
 		SetClient(client).
 		SetNode(c.flags.node).
+		SetNamespace(c.flags.namespace).
 		SetRootDir(c.flags.root).
 		SetBundleDir(c.flags.bundleDir).
+		SetProvenanceKey(c.flags.provenanceKey).
+		SetPullOrder(c.flags.pullOrder).
+		SetPullPriority(c.flags.pullPriority...).
+		SetPullConcurrency(c.flags.pullConcurrency).
+		SetPullTimeout(c.flags.pullTimeout).
+		SetPullAttempts(c.flags.pullAttempts).
+		SetLoadTimeout(c.flags.loadTimeout).
+		SetLoadMode(c.flags.loadMode).
+		SetRegistryAddress(c.flags.registryAddress).
+		SetRegistryCertDir(c.flags.registryCertDir).
+		SetRegistryMetricsAddress(c.flags.registryMetrics).
+		SetKeepBundle(c.flags.keepBundle).
+		SetRoleFilter(c.flags.roleFilter).
+		SetMetricsFile(c.flags.metricsFile).
 		Build()
 	if err != nil {
 		logger.Error(err, "Failed to create loader")
@@ -15,6 +15,11 @@ License.
 package start
 
 import (
+	sgnl "os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 
 	"github.com/jhernand/upgrade-tool/internal"
@@ -44,20 +49,82 @@ func StartBundleServer() *cobra.Command {
 		"",
 		"Path of the bundle file previously copied or mounted to the node.",
 	)
+	flags.StringVar(
+		&command.flags.bundleDir,
+		"bundle-dir",
+		"",
+		"Path of a directory containing multiple bundle files. The server will list "+
+			"them in the '/index' endpoint and serve them from the '/bundles/{name}' "+
+			"endpoint.",
+	)
+	flags.StringVar(
+		&command.flags.replicaFile,
+		"replica-file",
+		"",
+		"Path of the replica of the bundle file created by the bundle extractor. If "+
+			"the bundle file doesn't exist but this one does then it will be served "+
+			"instead.",
+	)
 	flags.StringVar(
 		&command.flags.listenAddr,
 		"listen-addr",
 		":8080",
 		"Listen address",
 	)
+	flags.StringVar(
+		&command.flags.tokenFile,
+		"token-file",
+		"",
+		"Path of a file containing the bearer token that clients must send. If not "+
+			"specified then clients aren't authenticated. Note that this isn't "+
+			"relative to the filesystem root.",
+	)
+	flags.StringVar(
+		&command.flags.maxBandwidth,
+		"max-bandwidth",
+		"",
+		"Maximum bandwidth used to send bundles, adding all the downloads, in bytes "+
+			"per second. Accepts units, for example '50MiB' or '10MB'. The default is "+
+			"to not limit the bandwidth.",
+	)
+	flags.StringVar(
+		&command.flags.maxClientBandwidth,
+		"max-client-bandwidth",
+		"",
+		"Maximum bandwidth used to send bundles to each client, in bytes per second. "+
+			"Accepts units, for example '50MiB' or '10MB'. The default is to not "+
+			"limit the bandwidth.",
+	)
+	flags.IntVar(
+		&command.flags.maxDownloads,
+		"max-downloads",
+		0,
+		"Maximum number of concurrent downloads. Additional clients will be asked to "+
+			"try again later. The default is to not limit the number of downloads.",
+	)
+	flags.DurationVar(
+		&command.flags.drainTimeout,
+		"drain-timeout",
+		30*time.Second,
+		"Maximum time to wait for downloads in progress to finish when the server "+
+			"receives the stop signal.",
+	)
 	return result
 }
 
 type startBundleServerCommand struct {
 	flags struct {
-		root       string
-		listenAddr string
-		bundleFile string
+		root        string
+		listenAddr  string
+		bundleFile  string
+		bundleDir   string
+		replicaFile string
+		tokenFile   string
+
+		maxBandwidth       string
+		maxClientBandwidth string
+		maxDownloads       int
+		drainTimeout       time.Duration
 	}
 }
 
@@ -74,8 +141,34 @@ func (c *startBundleServerCommand) run(cmd *cobra.Command, argv []string) error
 		logger.Error(nil, "Listen address is mandatory")
 		ok = false
 	}
-	if c.flags.bundleFile == "" {
-		logger.Error(nil, "Bundle file is mandatory")
+	if c.flags.bundleFile == "" && c.flags.bundleDir == "" {
+		logger.Error(nil, "Bundle file or bundle directory is mandatory")
+		ok = false
+	}
+	maxBandwidth, err := c.parseBandwidth(c.flags.maxBandwidth)
+	if err != nil {
+		logger.Error(
+			err,
+			"Maximum bandwidth isn't valid",
+			"value", c.flags.maxBandwidth,
+		)
+		ok = false
+	}
+	maxClientBandwidth, err := c.parseBandwidth(c.flags.maxClientBandwidth)
+	if err != nil {
+		logger.Error(
+			err,
+			"Maximum client bandwidth isn't valid",
+			"value", c.flags.maxClientBandwidth,
+		)
+		ok = false
+	}
+	if c.flags.maxDownloads < 0 {
+		logger.Error(
+			nil,
+			"Maximum downloads must be greater than or equal to zero",
+			"value", c.flags.maxDownloads,
+		)
 		ok = false
 	}
 	if !ok {
@@ -85,13 +178,24 @@ func (c *startBundleServerCommand) run(cmd *cobra.Command, argv []string) error
 	// Create and start the server:
 	server, err := internal.NewBundleServer().
 		SetLogger(logger).
+		SetRootDir(c.flags.root).
 		SetBundleFile(c.flags.bundleFile).
+		SetBundleDir(c.flags.bundleDir).
+		SetReplicaFile(c.flags.replicaFile).
 		SetListenAddr(c.flags.listenAddr).
+		SetTokenFile(c.flags.tokenFile).
+		SetMaxBandwidth(int64(maxBandwidth)).
+		SetMaxClientBandwidth(int64(maxClientBandwidth)).
+		SetMaxDownloads(c.flags.maxDownloads).
+		SetDrainTimeout(c.flags.drainTimeout).
 		Build()
 	if err != nil {
 		logger.Error(err, "Failed to create server")
 		return exit.Error(1)
 	}
+	// Run the server till we receive the stop signal:
+	ctx, stop := sgnl.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	err = server.Run(ctx)
 	if err != nil {
 		logger.Error(err, "Failed to run server")
@@ -100,3 +204,13 @@ func (c *startBundleServerCommand) run(cmd *cobra.Command, argv []string) error
 
 	return nil
 }
+
+// parseBandwidth parses a bandwidth that may contain units, like '50MiB'. Returns zero if the text
+// is empty.
+func (c *startBundleServerCommand) parseBandwidth(text string) (result uint64, err error) {
+	if text == "" {
+		return
+	}
+	result, err = humanize.ParseBytes(text)
+	return
+}
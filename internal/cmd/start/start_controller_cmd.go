@@ -18,9 +18,12 @@ import (
 	"os"
 	sgnl "os/signal"
 	"syscall"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	ctrl "sigs.k8s.io/controller-runtime"
 
 	"github.com/jhernand/upgrade-tool/internal"
@@ -43,13 +46,196 @@ func StartController() *cobra.Command {
 		"upgrade-tool",
 		"Namespace where objects will be created",
 	)
+	flags.BoolVar(
+		&command.flags.bundleCreation,
+		"bundle-creation",
+		false,
+		"Enables creation of bundles inside the cluster using BundleCreation objects. "+
+			"Requires the BundleCreation custom resource definition.",
+	)
+	flags.BoolVar(
+		&command.flags.clusterUpgrade,
+		"cluster-upgrades",
+		false,
+		"Enables the use of ClusterUpgrade objects to describe the upgrade, instead of the "+
+			"annotations of the cluster version. Requires the ClusterUpgrade custom "+
+			"resource definition.",
+	)
+	flags.BoolVar(
+		&command.flags.managedUpgrade,
+		"managed-cluster-upgrades",
+		false,
+		"Enables the upgrade of Advanced Cluster Management managed clusters using "+
+			"ManagedClusterUpgrade objects. This is intended for controllers running "+
+			"in the hub, and requires the ManagedClusterUpgrade custom resource "+
+			"definition. The managed clusters need to run the controller with the "+
+			"'--cluster-upgrades' flag.",
+	)
+	flags.IntVar(
+		&command.flags.replicas,
+		"bundle-replicas",
+		0,
+		"Number of nodes that will receive the bundle before the rest, and that will "+
+			"then serve it to the rest of the nodes. The default is zero, which means "+
+			"that all the nodes download the bundle from the nodes that have it "+
+			"initially.",
+	)
+	flags.IntVar(
+		&command.flags.jobRetries,
+		"job-retries",
+		3,
+		"Number of times that the job that extracts the bundle or loads the images in a "+
+			"node is created again when it fails. The delay between retries grows "+
+			"exponentially.",
+	)
+	flags.DurationVar(
+		&command.flags.jobRetention,
+		"job-retention",
+		time.Hour,
+		"How long the jobs that extract the bundle, load the images or clean the nodes are "+
+			"kept after they complete successfully. Failed jobs are always kept so "+
+			"that they can be inspected. A value of zero means that completed jobs "+
+			"are never deleted.",
+	)
+	flags.StringVar(
+		&command.flags.failureBudget,
+		"failure-budget",
+		"0",
+		"Number or percentage of nodes that can fail without marking the upgrade as "+
+			"degraded, for example '5%'.",
+	)
+	flags.StringVar(
+		&command.flags.maxConcurrency,
+		"max-concurrency",
+		"0",
+		"Number or percentage of nodes that can extract the bundle or load the images at "+
+			"the same time, for example '10%'. A value of zero means that there is no "+
+			"limit.",
+	)
+	flags.BoolVar(
+		&command.flags.preflight,
+		"preflight-checks",
+		true,
+		"Checks the health of the cluster before starting an upgrade: that the cluster "+
+			"operators are available and not degraded, that all the etcd members are "+
+			"ready, that the nodes are ready and have enough disk space, and that the "+
+			"certificate of the API server doesn't expire soon. Upgrades don't start "+
+			"till the checks pass, unless they set 'skipPreflightChecks' in the spec.",
+	)
+	flags.StringVar(
+		&command.flags.preflightDisk,
+		"preflight-disk-space",
+		"0",
+		"Minimum allocatable ephemeral storage that the nodes need to pass the preflight "+
+			"checks, for example '20Gi'. The default is zero, which means that only "+
+			"the disk pressure condition of the nodes is checked.",
+	)
+	flags.IntVar(
+		&command.flags.nodeLogLevel,
+		"node-log-level",
+		1,
+		"Log level of the programs that run in the nodes to extract the bundle, load the "+
+			"images and clean the nodes. Their messages are written to the standard "+
+			"output, so use zero to reduce the amount of logs that they generate.",
+	)
+	flags.StringVar(
+		&command.flags.distribution,
+		"distribution-mode",
+		"jobs",
+		"How the programs that extract the bundle and load the images run in the nodes. "+
+			"Can be 'jobs', to create one job per node, or 'daemonset', to deploy a "+
+			"long lived agent in all the nodes, which reduces the number of objects "+
+			"created in large clusters.",
+	)
+	flags.StringArrayVar(
+		&command.flags.notifications,
+		"notification-webhook",
+		nil,
+		"URL where notifications are sent, using HTTP POST requests with a JSON body, when "+
+			"an upgrade starts, when a batch of nodes completes, when a node fails and "+
+			"when the upgrade completes. The URL can be prefixed with the name of a "+
+			"template and an equals sign to change the body: 'slack' and 'teams' "+
+			"generate the payloads of their incoming webhooks, and any other name is "+
+			"the path of a Go template file, for example "+
+			"'slack=https://hooks.slack.com/services/...'. Can be repeated to send "+
+			"the notifications to multiple URLs. Requires the '--cluster-upgrades' flag.",
+	)
+	flags.StringVar(
+		&command.flags.metricsAddr,
+		"metrics-addr",
+		"",
+		"Address where the Prometheus metrics will be served, for example ':8080'. If not "+
+			"specified the metrics aren't served.",
+	)
+	flags.IntVar(
+		&command.flags.webhookPort,
+		"webhook-port",
+		9443,
+		"Port where the admission webhook that validates ClusterUpgrade objects will be "+
+			"served.",
+	)
+	flags.StringVar(
+		&command.flags.webhookCertDir,
+		"webhook-cert-dir",
+		"",
+		"Directory containing the 'tls.crt' and 'tls.key' files used by the admission "+
+			"webhook that validates ClusterUpgrade objects. If not specified the "+
+			"webhook isn't served. Requires the '--cluster-upgrades' flag.",
+	)
+	flags.StringVar(
+		&command.flags.hostedCluster,
+		"hosted-cluster",
+		"",
+		"Namespace and name of the HostedCluster object that describes the hosted cluster "+
+			"to upgrade, for example 'clusters/my-cluster'. If specified the "+
+			"controller runs in the management cluster, distributes the bundle only "+
+			"to the worker nodes of the hosted cluster, and requests the upgrade "+
+			"changing the release image of the HostedCluster object. Requires the "+
+			"'--cluster-upgrades' and '--hosted-kubeconfig' flags.",
+	)
+	flags.StringVar(
+		&command.flags.hostedKubeconfig,
+		"hosted-kubeconfig",
+		"",
+		"Kubeconfig file used to connect to the hosted cluster. The namespace and the "+
+			"permissions needed by the controller, which can be generated with the "+
+			"'generate manifests' command, need to exist in the hosted cluster.",
+	)
+	flags.StringVar(
+		&command.flags.snapshot,
+		"snapshot",
+		"",
+		"File containing a snapshot of the cluster generated with the 'collect' command. "+
+			"If specified the controller will not connect to the cluster, instead it "+
+			"will run one reconciliation cycle against the snapshot, report the "+
+			"changes it would make, and exit.",
+	)
 	return result
 }
 
 type startControllerCommand struct {
 	logger logr.Logger
 	flags  struct {
-		namespace string
+		namespace        string
+		snapshot         string
+		metricsAddr      string
+		webhookCertDir   string
+		hostedCluster    string
+		hostedKubeconfig string
+		webhookPort      int
+		failureBudget    string
+		maxConcurrency   string
+		distribution     string
+		preflightDisk    string
+		notifications    []string
+		jobRetries       int
+		nodeLogLevel     int
+		jobRetention     time.Duration
+		bundleCreation   bool
+		clusterUpgrade   bool
+		managedUpgrade   bool
+		preflight        bool
+		replicas         int
 	}
 }
 
@@ -71,14 +257,46 @@ func (c *startControllerCommand) run(cmd *cobra.Command, argv []string) error {
 		c.logger.Error(nil, "Namespace is mandatory")
 		ok = false
 	}
+	preflightDisk, err := resource.ParseQuantity(c.flags.preflightDisk)
+	if err != nil {
+		c.logger.Error(
+			err,
+			"Preflight disk space isn't valid",
+			"value", c.flags.preflightDisk,
+		)
+		ok = false
+	}
 	if !ok {
 		return exit.Error(1)
 	}
 
+	// If a snapshot has been specified then run the simulation instead of the real controller:
+	if c.flags.snapshot != "" {
+		return c.simulate(cmd)
+	}
+
 	// Create and start the controller:
 	controller, err := internal.NewController().
 		SetLogger(c.logger).
 		SetNamespace(c.flags.namespace).
+		SetBundleCreation(c.flags.bundleCreation).
+		SetClusterUpgrade(c.flags.clusterUpgrade).
+		SetManagedClusterUpgrade(c.flags.managedUpgrade).
+		SetReplicas(c.flags.replicas).
+		SetJobRetries(c.flags.jobRetries).
+		SetJobRetention(c.flags.jobRetention).
+		SetFailureBudget(intstr.Parse(c.flags.failureBudget)).
+		SetMaxConcurrency(intstr.Parse(c.flags.maxConcurrency)).
+		SetPreflightChecks(c.flags.preflight).
+		SetPreflightDiskSpace(preflightDisk).
+		SetDistributionMode(c.flags.distribution).
+		SetNodeLogLevel(c.flags.nodeLogLevel).
+		SetMetricsAddress(c.flags.metricsAddr).
+		SetWebhookPort(c.flags.webhookPort).
+		SetWebhookCertDir(c.flags.webhookCertDir).
+		SetHostedCluster(c.flags.hostedCluster).
+		SetHostedKubeconfig(c.flags.hostedKubeconfig).
+		SetNotificationWebhooks(c.flags.notifications).
 		Build()
 	if err != nil {
 		c.logger.Error(err, "Failed to create controller")
@@ -108,3 +326,30 @@ func (c *startControllerCommand) run(cmd *cobra.Command, argv []string) error {
 
 	return nil
 }
+
+func (c *startControllerCommand) simulate(cmd *cobra.Command) error {
+	// Get the context:
+	ctx := cmd.Context()
+
+	// Get the dependencies from the context:
+	console := internal.ConsoleFromContext(ctx)
+
+	// Create and run the simulator:
+	simulator, err := internal.NewControllerSimulator().
+		SetLogger(c.logger).
+		SetConsole(console).
+		SetNamespace(c.flags.namespace).
+		SetSnapshot(c.flags.snapshot).
+		Build()
+	if err != nil {
+		c.logger.Error(err, "Failed to create simulator")
+		return exit.Error(1)
+	}
+	err = simulator.Run(ctx)
+	if err != nil {
+		c.logger.Error(err, "Failed to run simulator")
+		return exit.Error(1)
+	}
+
+	return nil
+}
@@ -0,0 +1,456 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package start
+
+import (
+	"context"
+	"os"
+	sgnl "os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/jhernand/upgrade-tool/internal"
+	"github.com/jhernand/upgrade-tool/internal/exit"
+)
+
+// StartRegistry creates and returns the `start registry` command.
+func StartRegistry() *cobra.Command {
+	command := &startRegistryCommand{}
+	result := &cobra.Command{
+		Use:   "registry",
+		Short: "Starts an image registry that serves the images of an extracted bundle",
+		Args:  cobra.NoArgs,
+		RunE:  command.run,
+	}
+	flags := result.Flags()
+	flags.StringVar(
+		&command.flags.root,
+		"root",
+		"",
+		"Filesystem root. If this is specified then the rest of the paths will be "+
+			"relative to it.",
+	)
+	flags.StringVar(
+		&command.flags.bundleDir,
+		"bundle-dir",
+		"/var/lib/upgrade",
+		"Directory where the bundle has been extracted. The registry serves the images "+
+			"stored in this directory, and stores in it the images pushed to it unless "+
+			"the read only mode is enabled.",
+	)
+	flags.StringVar(
+		&command.flags.s3Storage,
+		"s3-storage",
+		"",
+		"URL of an S3 bucket where the registry will store the images instead of the "+
+			"bundle directory, for example 's3://bucket/prefix'. The prefix is optional.",
+	)
+	flags.StringVar(
+		&command.flags.s3Endpoint,
+		"s3-endpoint",
+		"",
+		"URL of the S3 compatible object store, for example 'https://minio.example.com'. "+
+			"If this isn't specified it will be read from the 'endpoint' file of the "+
+			"credentials directory, or else the AWS endpoint of the region will be used.",
+	)
+	flags.StringVar(
+		&command.flags.s3Region,
+		"s3-region",
+		"",
+		"Region of the S3 compatible object store. If this isn't specified it will be "+
+			"read from the 'region' file of the credentials directory, or else "+
+			"'us-east-1' will be used.",
+	)
+	flags.StringVar(
+		&command.flags.s3CredentialsDir,
+		"s3-credentials-dir",
+		"",
+		"Path of the directory containing the 'access-key-id' and 'secret-access-key' "+
+			"files used to access the S3 compatible object store, usually mounted from "+
+			"a secret. Note that this isn't relative to the filesystem root.",
+	)
+	flags.StringVar(
+		&command.flags.listenAddr,
+		"listen-addr",
+		":5000",
+		"Listen address",
+	)
+	flags.StringVar(
+		&command.flags.metricsAddr,
+		"metrics-addr",
+		"",
+		"Address where the Prometheus metrics will be served, using plain HTTP. If not "+
+			"specified the metrics aren't served.",
+	)
+	flags.StringVar(
+		&command.flags.tlsCert,
+		"tls-cert",
+		"",
+		"Path of the file containing the TLS certificate, in PEM format. If not specified "+
+			"then a self signed certificate will be generated. Note that this isn't "+
+			"relative to the filesystem root.",
+	)
+	flags.StringVar(
+		&command.flags.tlsKey,
+		"tls-key",
+		"",
+		"Path of the file containing the TLS key, in PEM format. Note that this isn't "+
+			"relative to the filesystem root.",
+	)
+	flags.StringVar(
+		&command.flags.keyAlgorithm,
+		"key-algorithm",
+		"ecdsa",
+		"Algorithm of the key generated for the self signed certificate when the TLS "+
+			"certificate isn't specified. Can be 'ecdsa' or 'rsa'. Use 'rsa' only for old "+
+			"clients that don't support ECDSA, as generating the key is much slower.",
+	)
+	flags.DurationVar(
+		&command.flags.tlsValidity,
+		"tls-validity",
+		365*24*time.Hour,
+		"Validity of the generated certificate when the TLS certificate isn't specified.",
+	)
+	flags.StringSliceVar(
+		&command.flags.tlsNames,
+		"tls-san",
+		nil,
+		"Additional host names or IP addresses added as subject alternative names to the "+
+			"generated certificate when the TLS certificate isn't specified. Can be used "+
+			"multiple times.",
+	)
+	flags.StringVar(
+		&command.flags.tlsCACert,
+		"tls-ca-cert",
+		"",
+		"Path of the file containing the certificate of the CA used to sign the generated "+
+			"certificate, in PEM format. If not specified then the generated certificate "+
+			"will be self signed. Note that this isn't relative to the filesystem root.",
+	)
+	flags.StringVar(
+		&command.flags.tlsCAKey,
+		"tls-ca-key",
+		"",
+		"Path of the file containing the key of the CA used to sign the generated "+
+			"certificate, in PEM format. Note that this isn't relative to the filesystem "+
+			"root.",
+	)
+	flags.StringVar(
+		&command.flags.username,
+		"username",
+		"",
+		"User name that clients must send using basic authentication. If this, the "+
+			"htpasswd file and the token file aren't specified then clients aren't "+
+			"authenticated.",
+	)
+	flags.StringVar(
+		&command.flags.passwordFile,
+		"password-file",
+		"",
+		"Path of a file containing the password that clients must send using basic "+
+			"authentication. Note that this isn't relative to the filesystem root.",
+	)
+	flags.StringVar(
+		&command.flags.htpasswdFile,
+		"htpasswd-file",
+		"",
+		"Path of an htpasswd file containing the bcrypt hashed passwords of the users "+
+			"that are allowed to use the registry. Note that this isn't relative to the "+
+			"filesystem root.",
+	)
+	flags.StringVar(
+		&command.flags.tokenFile,
+		"token-file",
+		"",
+		"Path of a file containing the bearer token that clients must send. Note that "+
+			"this isn't relative to the filesystem root.",
+	)
+	flags.StringVar(
+		&command.flags.maxBandwidth,
+		"max-bandwidth",
+		"",
+		"Maximum bandwidth used to receive images pushed to the registry, adding all the "+
+			"requests, in bytes per second. Accepts units, for example '50MiB' or "+
+			"'10MB'. The default is to not limit the bandwidth.",
+	)
+	flags.IntVar(
+		&command.flags.catalogMax,
+		"catalog-max-entries",
+		1000,
+		"Maximum number of repositories returned in each page of the catalog.",
+	)
+	flags.BoolVar(
+		&command.flags.readOnly,
+		"read-only",
+		false,
+		"Reject pushes, so that the content of the bundle directory can't be modified.",
+	)
+	flags.DurationVar(
+		&command.flags.drainTimeout,
+		"drain-timeout",
+		30*time.Second,
+		"Maximum time to wait for requests in progress to finish when the registry "+
+			"receives the stop signal.",
+	)
+	return result
+}
+
+type startRegistryCommand struct {
+	flags struct {
+		root             string
+		bundleDir        string
+		s3Storage        string
+		s3Endpoint       string
+		s3Region         string
+		s3CredentialsDir string
+		listenAddr       string
+		metricsAddr      string
+		tlsCert          string
+		tlsKey           string
+		keyAlgorithm     string
+		tlsValidity      time.Duration
+		tlsNames         []string
+		tlsCACert        string
+		tlsCAKey         string
+		username         string
+		passwordFile     string
+		htpasswdFile     string
+		tokenFile        string
+		maxBandwidth     string
+		readOnly         bool
+		catalogMax       int
+		drainTimeout     time.Duration
+	}
+}
+
+func (c *startRegistryCommand) run(cmd *cobra.Command, argv []string) error {
+	// Get the context:
+	ctx := cmd.Context()
+
+	// Get the dependencies from the context:
+	logger := internal.LoggerFromContext(ctx)
+
+	// Check the flags:
+	ok := true
+	if c.flags.bundleDir == "" {
+		logger.Error(nil, "Bundle directory is mandatory")
+		ok = false
+	}
+	if c.flags.listenAddr == "" {
+		logger.Error(nil, "Listen address is mandatory")
+		ok = false
+	}
+	if (c.flags.tlsCert == "") != (c.flags.tlsKey == "") {
+		logger.Error(nil, "TLS certificate and key must be specified together")
+		ok = false
+	}
+	if (c.flags.tlsCACert == "") != (c.flags.tlsCAKey == "") {
+		logger.Error(nil, "TLS CA certificate and key must be specified together")
+		ok = false
+	}
+	if c.flags.tlsCACert != "" && c.flags.tlsCert != "" {
+		logger.Error(nil, "TLS CA and TLS certificate are mutually exclusive")
+		ok = false
+	}
+	if (c.flags.username == "") != (c.flags.passwordFile == "") {
+		logger.Error(nil, "User name and password file must be specified together")
+		ok = false
+	}
+	var maxBandwidth uint64
+	if c.flags.maxBandwidth != "" {
+		var err error
+		maxBandwidth, err = humanize.ParseBytes(c.flags.maxBandwidth)
+		if err != nil {
+			logger.Error(
+				err,
+				"Maximum bandwidth isn't valid",
+				"value", c.flags.maxBandwidth,
+			)
+			ok = false
+		}
+	}
+	if c.flags.drainTimeout < 0 {
+		logger.Error(
+			nil,
+			"Drain timeout must be greater than or equal to zero",
+			"value", c.flags.drainTimeout,
+		)
+		ok = false
+	}
+	if !ok {
+		return exit.Error(1)
+	}
+
+	// Read the TLS certificate and key:
+	var tlsCert, tlsKey []byte
+	if c.flags.tlsCert != "" {
+		var err error
+		tlsCert, err = os.ReadFile(c.flags.tlsCert)
+		if err != nil {
+			logger.Error(
+				err,
+				"Failed to read TLS certificate",
+				"file", c.flags.tlsCert,
+			)
+			return exit.Error(1)
+		}
+		tlsKey, err = os.ReadFile(c.flags.tlsKey)
+		if err != nil {
+			logger.Error(
+				err,
+				"Failed to read TLS key",
+				"file", c.flags.tlsKey,
+			)
+			return exit.Error(1)
+		}
+	}
+
+	// Read the TLS CA certificate and key:
+	var tlsCACert, tlsCAKey []byte
+	if c.flags.tlsCACert != "" {
+		var err error
+		tlsCACert, err = os.ReadFile(c.flags.tlsCACert)
+		if err != nil {
+			logger.Error(
+				err,
+				"Failed to read TLS CA certificate",
+				"file", c.flags.tlsCACert,
+			)
+			return exit.Error(1)
+		}
+		tlsCAKey, err = os.ReadFile(c.flags.tlsCAKey)
+		if err != nil {
+			logger.Error(
+				err,
+				"Failed to read TLS CA key",
+				"file", c.flags.tlsCAKey,
+			)
+			return exit.Error(1)
+		}
+	}
+
+	// Read the password:
+	var password string
+	if c.flags.passwordFile != "" {
+		data, err := os.ReadFile(c.flags.passwordFile)
+		if err != nil {
+			logger.Error(
+				err,
+				"Failed to read password",
+				"file", c.flags.passwordFile,
+			)
+			return exit.Error(1)
+		}
+		password = strings.TrimSpace(string(data))
+		if password == "" {
+			logger.Error(
+				nil,
+				"Password file is empty",
+				"file", c.flags.passwordFile,
+			)
+			return exit.Error(1)
+		}
+	}
+
+	// Check that the bundle directory exists, as otherwise the registry would silently serve
+	// an empty catalog. When the images are stored in S3 the bundle directory isn't used.
+	var bundleDir string
+	if c.flags.s3Storage == "" {
+		bundleDir = c.flags.bundleDir
+		if c.flags.root != "" {
+			bundleDir = filepath.Join(c.flags.root, bundleDir)
+		}
+		info, err := os.Stat(bundleDir)
+		if err == nil && !info.IsDir() {
+			logger.Error(
+				nil,
+				"Bundle directory isn't a directory",
+				"dir", bundleDir,
+			)
+			return exit.Error(1)
+		}
+		if err != nil {
+			logger.Error(
+				err,
+				"Failed to check bundle directory",
+				"dir", bundleDir,
+			)
+			return exit.Error(1)
+		}
+	}
+
+	// Create and start the registry:
+	registry, err := internal.NewRegistry().
+		SetLogger(logger).
+		SetAddress(c.flags.listenAddr).
+		SetRoot(bundleDir).
+		SetS3Storage(c.flags.s3Storage).
+		SetS3Endpoint(c.flags.s3Endpoint).
+		SetS3Region(c.flags.s3Region).
+		SetS3CredentialsDir(c.flags.s3CredentialsDir).
+		SetCertificate(tlsCert, tlsKey).
+		SetKeyAlgorithm(c.flags.keyAlgorithm).
+		SetCertificateValidity(c.flags.tlsValidity).
+		AddCertificateNames(c.flags.tlsNames...).
+		SetCA(tlsCACert, tlsCAKey).
+		SetCredentials(c.flags.username, password).
+		SetHtpasswdFile(c.flags.htpasswdFile).
+		SetTokenFile(c.flags.tokenFile).
+		SetMaxBandwidth(int64(maxBandwidth)).
+		SetReadOnly(c.flags.readOnly).
+		SetCatalogMaxEntries(c.flags.catalogMax).
+		SetMetricsAddress(c.flags.metricsAddr).
+		Build()
+	if err != nil {
+		logger.Error(err, "Failed to create registry")
+		return exit.Error(1)
+	}
+	err = registry.Start(ctx)
+	if err != nil {
+		logger.Error(err, "Failed to start registry")
+		return exit.Error(1)
+	}
+	logger.Info(
+		"Started registry",
+		"address", registry.Address(),
+		"dir", bundleDir,
+		"s3", c.flags.s3Storage,
+		"auth", c.flags.username != "" || c.flags.htpasswdFile != "" ||
+			c.flags.tokenFile != "",
+	)
+
+	// Wait till we receive the stop signal:
+	ctx, stop := sgnl.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	logger.Info("Stopping registry")
+
+	// Stop the registry, giving the requests in progress some time to finish:
+	stopCtx, cancel := context.WithTimeout(context.Background(), c.flags.drainTimeout)
+	defer cancel()
+	err = registry.Stop(stopCtx)
+	if err != nil {
+		logger.Error(err, "Failed to stop registry")
+		return exit.Error(1)
+	}
+	logger.Info("Stopped registry")
+
+	return nil
+}
@@ -27,10 +27,12 @@ func Start() *cobra.Command {
 		Short: "Starts components",
 		Args:  cobra.NoArgs,
 	}
+	command.AddCommand(start.StartBundleAgent())
 	command.AddCommand(start.StartBundleCleaner())
 	command.AddCommand(start.StartBundleExtractor())
 	command.AddCommand(start.StartBundleLoader())
 	command.AddCommand(start.StartBundleServer())
 	command.AddCommand(start.StartController())
+	command.AddCommand(start.StartRegistry())
 	return command
 }
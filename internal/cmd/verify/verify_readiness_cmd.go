@@ -0,0 +1,151 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package verify
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slices"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/jhernand/upgrade-tool/internal"
+	"github.com/jhernand/upgrade-tool/internal/exit"
+)
+
+// VerifyReadiness creates and returns the `verify readiness` command.
+func VerifyReadiness() *cobra.Command {
+	command := &verifyReadinessCommand{}
+	result := &cobra.Command{
+		Use:   "readiness",
+		Short: "Verifies that the cluster is ready to be upgraded",
+		Long: "Checks that the cluster version and the machine config pools are healthy, " +
+			"that the bundle has been extracted and loaded in all the nodes and that " +
+			"the release signature is available. It also runs the preflight checks that " +
+			"the controller runs before starting an upgrade: cluster operators, etcd " +
+			"quorum, node readiness, disk space and API server certificate. It reports " +
+			"a 'go' or 'no-go' verdict. The command exits with a non zero code when the verdict is " +
+			"'no-go'.",
+		Args: cobra.NoArgs,
+		RunE: command.run,
+	}
+	flags := result.Flags()
+	flags.StringVar(
+		&command.flags.output,
+		"output",
+		internal.OutputText,
+		fmt.Sprintf(
+			"Format of the report, one of %s. The 'json' and 'yaml' formats contain the "+
+				"'verdict' field, either 'go' or 'no-go', and the 'checks' list, where "+
+				"each check has the 'name', 'status' and 'message' fields. The status is "+
+				"one of 'pass', 'warn' or 'fail'.",
+			strings.Join(internal.OutputFormats(), ", "),
+		),
+	)
+	flags.BoolVar(
+		&command.flags.allowUnsigned,
+		"allow-unsigned",
+		false,
+		"Accept a release whose signature isn't available in the cluster. By default a "+
+			"missing signature makes the verdict 'no-go'.",
+	)
+	flags.StringVar(
+		&command.flags.diskSpace,
+		"disk-space",
+		"0",
+		"Minimum allocatable ephemeral storage that the nodes need, for example '20Gi'. "+
+			"The default is to check only the disk pressure condition of the nodes.",
+	)
+	return result
+}
+
+type verifyReadinessCommand struct {
+	flags struct {
+		output        string
+		allowUnsigned bool
+		diskSpace     string
+	}
+}
+
+func (c *verifyReadinessCommand) run(cmd *cobra.Command, argv []string) error {
+	// Get the context:
+	ctx := cmd.Context()
+
+	// Get the dependencies from the context:
+	tool := internal.ToolFromContext(ctx)
+	logger := internal.LoggerFromContext(ctx)
+	console := internal.ConsoleFromContext(ctx)
+
+	// Check the flags:
+	if !slices.Contains(internal.OutputFormats(), c.flags.output) {
+		console.Error(
+			"Output format '%s' isn't valid, it should be one of %s",
+			c.flags.output, strings.Join(internal.OutputFormats(), ", "),
+		)
+		return exit.Error(1)
+	}
+	diskSpace, err := resource.ParseQuantity(c.flags.diskSpace)
+	if err != nil {
+		console.Error("Disk space '%s' isn't valid: %v", c.flags.diskSpace, err)
+		return exit.Error(1)
+	}
+
+	// Create and run the checker:
+	checker, err := internal.NewReadinessChecker().
+		SetLogger(logger).
+		SetAllowUnsigned(c.flags.allowUnsigned).
+		SetPreflightDiskSpace(diskSpace).
+		Build()
+	if err != nil {
+		console.Error("Failed to create readiness checker: %v", err)
+		return exit.Error(1)
+	}
+	report, err := checker.Run(ctx)
+	if err != nil {
+		console.Error("Failed to check readiness: %v", err)
+		return exit.Error(1)
+	}
+
+	// Write the report:
+	switch c.flags.output {
+	case internal.OutputJSON, internal.OutputYAML:
+		err = internal.WriteOutput(tool.Out(), c.flags.output, report)
+		if err != nil {
+			console.Error("Failed to write report: %v", err)
+			return exit.Error(1)
+		}
+	default:
+		for _, check := range report.Checks {
+			text := fmt.Sprintf("%s: %s", check.Name, check.Message)
+			switch check.Status {
+			case internal.ReadinessFail:
+				console.Error("%s", text)
+			case internal.ReadinessWarn:
+				console.Warn("%s", text)
+			default:
+				console.Info("%s", text)
+			}
+		}
+		console.Info("Verdict is '%s'", report.Verdict)
+	}
+
+	// Return a non zero exit code if the cluster isn't ready:
+	if report.Verdict != internal.ReadinessGo {
+		return exit.Error(1)
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slices"
+
+	"github.com/jhernand/upgrade-tool/internal"
+	"github.com/jhernand/upgrade-tool/internal/exit"
+)
+
+// Wait creates and returns the `wait` command.
+func Wait() *cobra.Command {
+	command := &waitCommand{}
+	result := &cobra.Command{
+		Use:   "wait",
+		Short: "Waits till a condition is met",
+		Long: "Checks periodically the state of the cluster and blocks till the given " +
+			"condition is met. The command exits with code 2 if the condition isn't met " +
+			"before the timeout, and with code 1 for other errors. For example, to wait " +
+			"till the bundle has been loaded in all the nodes:\n\n" +
+			"  upgrade-tool wait --for bundle-loaded --timeout 2h",
+		Args: cobra.NoArgs,
+		RunE: command.run,
+	}
+	flags := result.Flags()
+	flags.StringVar(
+		&command.flags.condition,
+		"for",
+		"",
+		fmt.Sprintf(
+			"Condition to wait for, one of %s.",
+			strings.Join(internal.WaitConditions, ", "),
+		),
+	)
+	flags.DurationVar(
+		&command.flags.timeout,
+		"timeout",
+		0,
+		"Maximum time to wait, for example '2h' or '30m'. The default is to wait forever.",
+	)
+	flags.DurationVar(
+		&command.flags.interval,
+		"interval",
+		10*time.Second,
+		"Time to wait between checks.",
+	)
+	flags.StringVar(
+		&command.flags.upgrade,
+		"upgrade",
+		"",
+		"Namespace and name of the ClusterUpgrade object to check for the "+
+			"'upgrade-complete' condition, separated by a slash. For example "+
+			"'upgrade-tool/my-upgrade'. If not specified the cluster version is checked "+
+			"instead.",
+	)
+	return result
+}
+
+type waitCommand struct {
+	flags struct {
+		condition string
+		timeout   time.Duration
+		interval  time.Duration
+		upgrade   string
+	}
+}
+
+func (c *waitCommand) run(cmd *cobra.Command, argv []string) error {
+	var err error
+
+	// Get the context:
+	ctx := cmd.Context()
+
+	// Get the dependencies from the context:
+	logger := internal.LoggerFromContext(ctx)
+	console := internal.ConsoleFromContext(ctx)
+
+	// Check the flags:
+	ok := true
+	if c.flags.condition == "" {
+		console.Error("Condition is mandatory")
+		ok = false
+	} else if !slices.Contains(internal.WaitConditions, c.flags.condition) {
+		console.Error(
+			"Condition '%s' isn't valid, it should be one of %s",
+			c.flags.condition, strings.Join(internal.WaitConditions, ", "),
+		)
+		ok = false
+	}
+	if c.flags.timeout < 0 {
+		console.Error("Timeout '%s' isn't valid, it should be positive", c.flags.timeout)
+		ok = false
+	}
+	if c.flags.interval <= 0 {
+		console.Error("Interval '%s' isn't valid, it should be positive", c.flags.interval)
+		ok = false
+	}
+	var namespace, name string
+	if c.flags.upgrade != "" {
+		var found bool
+		namespace, name, found = strings.Cut(c.flags.upgrade, "/")
+		if !found || namespace == "" || name == "" {
+			console.Error(
+				"Upgrade '%s' isn't valid, it should be the namespace and the name "+
+					"separated by a slash",
+				c.flags.upgrade,
+			)
+			ok = false
+		}
+		if c.flags.condition != internal.WaitUpgradeComplete {
+			console.Error(
+				"Upgrade can only be used with the '%s' condition",
+				internal.WaitUpgradeComplete,
+			)
+			ok = false
+		}
+	}
+	if !ok {
+		return exit.Error(1)
+	}
+
+	// Create the waiter:
+	waiter, err := internal.NewWaiter().
+		SetLogger(logger).
+		SetCondition(c.flags.condition).
+		SetUpgrade(namespace, name).
+		SetInterval(c.flags.interval).
+		Build()
+	if err != nil {
+		console.Error("Failed to create waiter: %v", err)
+		return exit.Error(1)
+	}
+
+	// Wait for the condition:
+	if c.flags.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.flags.timeout)
+		defer cancel()
+	}
+	console.Info("Waiting for condition '%s'", c.flags.condition)
+	err = waiter.Wait(ctx)
+	if errors.Is(err, internal.ErrWaitTimeout) {
+		console.Error("Condition '%s' wasn't met: %v", c.flags.condition, err)
+		return exit.Error(2)
+	}
+	if err != nil {
+		console.Error("Failed to wait for condition '%s': %v", c.flags.condition, err)
+		return exit.Error(1)
+	}
+	console.Info("Condition '%s' is met", c.flags.condition)
+
+	return nil
+}
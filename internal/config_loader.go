@@ -0,0 +1,360 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigLoaderBuilder contains the data and logic needed to create a configuration loader. Don't
+// create instances of this type directly, use the NewConfigLoader function instead.
+type ConfigLoaderBuilder struct {
+	logger logr.Logger
+	flags  *pflag.FlagSet
+	prefix string
+	file   string
+	files  []string
+	env    func(string) (string, bool)
+}
+
+// ConfigLoader takes the values of the command line flags that weren't explicitly given in the
+// command line from environment variables and from a configuration file. This is intended for
+// situations where passing flags is awkward, for example when running the node programs from
+// static pod manifests or systemd units. The precedence is, from highest to lowest: the command
+// line, the environment and the configuration file. Don't create instances of this type directly,
+// use the NewConfigLoader function instead.
+type ConfigLoader struct {
+	logger logr.Logger
+	flags  *pflag.FlagSet
+	prefix string
+	file   string
+	files  []string
+	env    func(string) (string, bool)
+}
+
+// NewConfigLoader creates a builder that can then be used to configure and create a configuration
+// loader.
+func NewConfigLoader() *ConfigLoaderBuilder {
+	return &ConfigLoaderBuilder{
+		prefix: configEnvPrefix,
+		files:  configDefaultFiles(),
+		env:    os.LookupEnv,
+	}
+}
+
+// SetLogger sets the logger that the loader will use to write log messages. This is mandatory.
+func (b *ConfigLoaderBuilder) SetLogger(value logr.Logger) *ConfigLoaderBuilder {
+	b.logger = value
+	return b
+}
+
+// SetFlags sets the flag set whose values will be loaded. This is mandatory.
+func (b *ConfigLoaderBuilder) SetFlags(value *pflag.FlagSet) *ConfigLoaderBuilder {
+	b.flags = value
+	return b
+}
+
+// SetPrefix sets the prefix of the names of the environment variables. This is optional and the
+// default is 'UPGRADE_TOOL_'. The name of the environment variable for a flag is this prefix
+// followed by the name of the flag in upper case and with dashes replaced by underscores. For
+// example the value of the '--log-level' flag is taken from the 'UPGRADE_TOOL_LOG_LEVEL'
+// environment variable.
+func (b *ConfigLoaderBuilder) SetPrefix(value string) *ConfigLoaderBuilder {
+	b.prefix = value
+	return b
+}
+
+// SetFile sets the configuration file. This is optional, and when it isn't set the loader will
+// use the value of the '--config' flag, if it exists, and then the first of the default files that
+// exists: 'upgrade-tool/config.yaml' inside the user configuration directory and
+// '/etc/upgrade-tool/config.yaml'. An explicitly given file must exist, default files are ignored
+// when they don't.
+func (b *ConfigLoaderBuilder) SetFile(value string) *ConfigLoaderBuilder {
+	b.file = value
+	return b
+}
+
+// SetDefaultFiles sets the list of files that will be checked when no configuration file has been
+// explicitly given. This is optional and intended for unit tests.
+func (b *ConfigLoaderBuilder) SetDefaultFiles(values ...string) *ConfigLoaderBuilder {
+	b.files = values
+	return b
+}
+
+// SetEnv sets the function that will be used to lookup environment variables. This is optional
+// and intended for unit tests. The default is to use the os.LookupEnv function.
+func (b *ConfigLoaderBuilder) SetEnv(value func(string) (string, bool)) *ConfigLoaderBuilder {
+	b.env = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new configuration loader.
+func (b *ConfigLoaderBuilder) Build() (result *ConfigLoader, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+	if b.flags == nil {
+		err = errors.New("flags are mandatory")
+		return
+	}
+	if b.env == nil {
+		err = errors.New("environment lookup function is mandatory")
+		return
+	}
+
+	// Create and populate the object:
+	result = &ConfigLoader{
+		logger: b.logger,
+		flags:  b.flags,
+		prefix: b.prefix,
+		file:   b.file,
+		files:  b.files,
+		env:    b.env,
+	}
+	return
+}
+
+// Load sets the values of the flags that weren't given in the command line from the environment
+// variables and the configuration file.
+func (l *ConfigLoader) Load() error {
+	// Load the configuration file first, so that we can report errors in it even if all the
+	// flags are given in the command line or in the environment:
+	file, config, err := l.readFile()
+	if err != nil {
+		return err
+	}
+
+	// Collect the values for the flags that weren't explicitly set in the command line. Note
+	// that we need to first collect and then set them because setting a flag while visiting the
+	// flag set marks it as changed and that would affect the rest of the visit.
+	type item struct {
+		flag   *pflag.Flag
+		values []string
+		source string
+	}
+	var items []item
+	l.flags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Changed || flag.Name == configFileFlagName {
+			return
+		}
+		variable := l.envName(flag.Name)
+		value, ok := l.env(variable)
+		if ok {
+			items = append(items, item{
+				flag:   flag,
+				values: []string{value},
+				source: variable,
+			})
+			return
+		}
+		values, ok := config[flag.Name]
+		if ok {
+			items = append(items, item{
+				flag:   flag,
+				values: values,
+				source: file,
+			})
+		}
+	})
+	for _, item := range items {
+		for _, value := range item.values {
+			err = l.flags.Set(item.flag.Name, value)
+			if err != nil {
+				return fmt.Errorf(
+					"failed to set flag '--%s' from '%s': %w",
+					item.flag.Name, item.source, err,
+				)
+			}
+		}
+		l.logger.V(1).Info(
+			"Loaded flag",
+			"flag", item.flag.Name,
+			"source", item.source,
+		)
+	}
+	return nil
+}
+
+// readFile reads the configuration file and returns its name and a map where the keys are the
+// names of the flags and the values are the textual representations of the values. Lists are
+// returned as multiple values so that they can be set one by one, as that is what the slice and
+// array flags expect.
+func (l *ConfigLoader) readFile() (file string, result map[string][]string, err error) {
+	// Find the file:
+	file, err = l.findFile()
+	if err != nil || file == "" {
+		return
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		err = fmt.Errorf("failed to read configuration file '%s': %w", file, err)
+		return
+	}
+
+	// Parse it:
+	var config map[string]any
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		err = fmt.Errorf("failed to parse configuration file '%s': %w", file, err)
+		return
+	}
+	result = map[string][]string{}
+	for key, value := range config {
+		switch typed := value.(type) {
+		case nil:
+		case []any:
+			values := make([]string, len(typed))
+			for i, item := range typed {
+				values[i], err = l.formatValue(item)
+				if err != nil {
+					err = fmt.Errorf(
+						"value of '%s' in configuration file '%s' isn't valid: %w",
+						key, file, err,
+					)
+					return
+				}
+			}
+			result[key] = values
+		default:
+			var text string
+			text, err = l.formatValue(typed)
+			if err != nil {
+				err = fmt.Errorf(
+					"value of '%s' in configuration file '%s' isn't valid: %w",
+					key, file, err,
+				)
+				return
+			}
+			result[key] = []string{text}
+		}
+	}
+
+	// Write to the log the keys that don't correspond to any flag. Note that this isn't an error
+	// because the same file is used for all the commands and most of them don't have all the
+	// flags.
+	var unknown []string
+	for key := range result {
+		if l.flags.Lookup(key) == nil {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	l.logger.V(1).Info(
+		"Read configuration file",
+		"file", file,
+		"ignored", unknown,
+	)
+	return
+}
+
+func (l *ConfigLoader) findFile() (result string, err error) {
+	// Explicitly given files must exist:
+	result = l.file
+	if result == "" {
+		flag := l.flags.Lookup(configFileFlagName)
+		if flag != nil {
+			result = flag.Value.String()
+		}
+	}
+	if result == "" {
+		result, _ = l.env(l.envName(configFileFlagName))
+	}
+	if result != "" {
+		return
+	}
+
+	// Default files are optional:
+	for _, file := range l.files {
+		_, err = os.Stat(file)
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		result = file
+		return
+	}
+	return
+}
+
+func (l *ConfigLoader) formatValue(value any) (result string, err error) {
+	switch typed := value.(type) {
+	case string:
+		result = typed
+	case bool:
+		result = strconv.FormatBool(typed)
+	case float64:
+		// Numbers are always parsed as floating point, so we need to make sure that integers
+		// aren't formatted using the exponent notation, as the integer flags don't accept it:
+		result = strconv.FormatFloat(typed, 'f', -1, 64)
+	default:
+		err = fmt.Errorf(
+			"type %T isn't supported, it must be a string, number, boolean or list",
+			typed,
+		)
+	}
+	return
+}
+
+func (l *ConfigLoader) envName(flag string) string {
+	return l.prefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// AddConfigFlags adds the flag that selects the configuration file to the given flag set.
+func AddConfigFlags(set *pflag.FlagSet) {
+	_ = set.String(
+		configFileFlagName,
+		"",
+		"Configuration file containing default values for the flags, where the keys are "+
+			"the names of the flags. The values of the flags can also be taken from "+
+			"environment variables, for example '--log-level' from 'UPGRADE_TOOL_LOG_LEVEL'. "+
+			"Flags given in the command line take precedence over environment variables, "+
+			"and environment variables over the configuration file. By default the file "+
+			"'upgrade-tool/config.yaml' inside the user configuration directory or "+
+			"'/etc/upgrade-tool/config.yaml' is used if it exists.",
+	)
+}
+
+// configDefaultFiles returns the list of configuration files that are used when no file has been
+// explicitly given.
+func configDefaultFiles() []string {
+	var result []string
+	dir, err := os.UserConfigDir()
+	if err == nil {
+		result = append(result, filepath.Join(dir, "upgrade-tool", "config.yaml"))
+	}
+	result = append(result, filepath.Join("/etc", "upgrade-tool", "config.yaml"))
+	return result
+}
+
+// configFileFlagName is the name of the flag that selects the configuration file.
+const configFileFlagName = "config"
+
+// configEnvPrefix is the default prefix for the names of the environment variables.
+const configEnvPrefix = "UPGRADE_TOOL_"
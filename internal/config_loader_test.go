@@ -0,0 +1,188 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/pflag"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Configuration loader", func() {
+	var (
+		logger logr.Logger
+		tmp    string
+		flags  *pflag.FlagSet
+		env    map[string]string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create the logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create a temporary directory for the configuration files:
+		tmp, err = os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+
+		// Create the flags:
+		flags = pflag.NewFlagSet("", pflag.ContinueOnError)
+		AddConfigFlags(flags)
+		_ = flags.String("my-text", "default", "")
+		_ = flags.Int("my-number", 0, "")
+		_ = flags.Bool("my-bool", false, "")
+		_ = flags.StringArray("my-list", nil, "")
+
+		// Start with an empty environment:
+		env = map[string]string{}
+	})
+
+	// load creates a loader with the fake environment and no default files and runs it.
+	load := func() error {
+		loader, err := NewConfigLoader().
+			SetLogger(logger).
+			SetFlags(flags).
+			SetEnv(func(name string) (value string, ok bool) {
+				value, ok = env[name]
+				return
+			}).
+			SetDefaultFiles(filepath.Join(tmp, "default.yaml")).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		return loader.Load()
+	}
+
+	// writeFile writes a configuration file with the given content and returns its path.
+	writeFile := func(name, content string) string {
+		file := filepath.Join(tmp, name)
+		err := os.WriteFile(file, []byte(content), 0600)
+		Expect(err).ToNot(HaveOccurred())
+		return file
+	}
+
+	It("Can't be created without a logger", func() {
+		loader, err := NewConfigLoader().
+			SetFlags(flags).
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("logger"))
+		Expect(loader).To(BeNil())
+	})
+
+	It("Can't be created without flags", func() {
+		loader, err := NewConfigLoader().
+			SetLogger(logger).
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("flags"))
+		Expect(loader).To(BeNil())
+	})
+
+	It("Keeps the defaults when there is no environment or configuration file", func() {
+		err := load()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(flags.GetString("my-text")).To(Equal("default"))
+		Expect(flags.Changed("my-text")).To(BeFalse())
+	})
+
+	It("Takes values from the environment", func() {
+		env["UPGRADE_TOOL_MY_TEXT"] = "from-env"
+		env["UPGRADE_TOOL_MY_NUMBER"] = "42"
+		env["UPGRADE_TOOL_MY_BOOL"] = "true"
+		err := load()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(flags.GetString("my-text")).To(Equal("from-env"))
+		Expect(flags.GetInt("my-number")).To(Equal(42))
+		Expect(flags.GetBool("my-bool")).To(BeTrue())
+	})
+
+	It("Takes values from the default configuration file", func() {
+		writeFile("default.yaml", `
+my-text: from-file
+my-number: 1000000
+my-bool: true
+my-list:
+- a
+- b
+unknown: ignored
+`)
+		err := load()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(flags.GetString("my-text")).To(Equal("from-file"))
+		Expect(flags.GetInt("my-number")).To(Equal(1000000))
+		Expect(flags.GetBool("my-bool")).To(BeTrue())
+		Expect(flags.GetStringArray("my-list")).To(Equal([]string{"a", "b"}))
+	})
+
+	It("Takes the configuration file from the flag", func() {
+		file := writeFile("my.yaml", "my-text: from-flag-file\n")
+		err := flags.Parse([]string{"--config", file})
+		Expect(err).ToNot(HaveOccurred())
+		err = load()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(flags.GetString("my-text")).To(Equal("from-flag-file"))
+	})
+
+	It("Takes the configuration file from the environment", func() {
+		env["UPGRADE_TOOL_CONFIG"] = writeFile("my.yaml", "my-text: from-env-file\n")
+		err := load()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(flags.GetString("my-text")).To(Equal("from-env-file"))
+	})
+
+	It("Fails if the explicitly given configuration file doesn't exist", func() {
+		env["UPGRADE_TOOL_CONFIG"] = filepath.Join(tmp, "missing.yaml")
+		err := load()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("missing.yaml"))
+	})
+
+	It("Fails if a value can't be parsed", func() {
+		env["UPGRADE_TOOL_MY_NUMBER"] = "junk"
+		err := load()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("--my-number"))
+		Expect(err.Error()).To(ContainSubstring("UPGRADE_TOOL_MY_NUMBER"))
+	})
+
+	It("Gives precedence to the command line, then the environment and then the file", func() {
+		writeFile("default.yaml", `
+my-text: from-file
+my-number: 1
+my-bool: true
+`)
+		env["UPGRADE_TOOL_MY_TEXT"] = "from-env"
+		env["UPGRADE_TOOL_MY_NUMBER"] = "2"
+		err := flags.Parse([]string{"--my-text", "from-line"})
+		Expect(err).ToNot(HaveOccurred())
+		err = load()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(flags.GetString("my-text")).To(Equal("from-line"))
+		Expect(flags.GetInt("my-number")).To(Equal(2))
+		Expect(flags.GetBool("my-bool")).To(BeTrue())
+	})
+})
@@ -15,10 +15,12 @@ License.
 package internal
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
 
 	"github.com/go-logr/logr"
@@ -31,28 +33,37 @@ import (
 // ConsoleBuilder contains the data and logic needed to create an instance of the console. Don't
 // create instances of this directly, use the NewConsole function instead.
 type ConsoleBuilder struct {
-	logger logr.Logger
-	color  bool
-	mute   bool
-	out    io.Writer
-	err    io.Writer
+	logger   logr.Logger
+	color    bool
+	mute     bool
+	yes      bool
+	in       io.Reader
+	out      io.Writer
+	err      io.Writer
+	env      func(string) (string, bool)
+	terminal func(any) bool
 }
 
 // Console knows how to write messages to the terminal. Don't create instances of this directly, use
 // the NewConsole function instead.
 type Console struct {
-	logger   logr.Logger
-	lock     *sync.Mutex
-	mute     bool
-	prefixes consolePrefixes
-	out      io.Writer
-	err      io.Writer
+	logger      logr.Logger
+	lock        *sync.Mutex
+	mute        bool
+	yes         bool
+	interactive bool
+	styles      consoleStyles
+	in          *bufio.Reader
+	out         io.Writer
+	err         io.Writer
 }
 
 // NewConsole creates a builder that can then be used to configure and create a console.
 func NewConsole() *ConsoleBuilder {
 	return &ConsoleBuilder{
-		color: true,
+		color:    true,
+		env:      os.LookupEnv,
+		terminal: consoleIsTerminal,
 	}
 }
 
@@ -63,8 +74,11 @@ func (b *ConsoleBuilder) SetLogger(value logr.Logger) *ConsoleBuilder {
 	return b
 }
 
-// SetColor enables or disables use of color in the console. By default color is enabled if the
-// console is a terminal and disabled otherwise.
+// SetColor enables or disables use of color in the console. By default color is enabled for the
+// output and error streams that are terminals, and disabled for streams that are redirected to
+// files or pipes. It is also disabled when the 'NO_COLOR' environment variable is set to a non
+// empty value or when the 'TERM' environment variable is 'dumb'. Note that setting this to true
+// doesn't force the use of color when the streams aren't terminals.
 func (b *ConsoleBuilder) SetColor(value bool) *ConsoleBuilder {
 	b.color = value
 	return b
@@ -82,6 +96,22 @@ func (b *ConsoleBuilder) SetMute(value bool) *ConsoleBuilder {
 	return b
 }
 
+// SetYes sets or clears the flag that indicates that all the confirmations should be answered
+// automatically with 'yes', without prompting the user. This is optional and by default the user
+// is prompted.
+func (b *ConsoleBuilder) SetYes(value bool) *ConsoleBuilder {
+	b.yes = value
+	return b
+}
+
+// SetIn sets the standard input stream used to read the answers to confirmations. This is
+// optional, but without it or when it isn't a terminal confirmations fail unless they are answered
+// automatically with the SetYes method.
+func (b *ConsoleBuilder) SetIn(value io.Reader) *ConsoleBuilder {
+	b.in = value
+	return b
+}
+
 // SetOut sets the standard output stream. This is mandatory, but will be ignored if the console is
 // muted.
 func (b *ConsoleBuilder) SetOut(value io.Writer) *ConsoleBuilder {
@@ -105,12 +135,24 @@ func (b *ConsoleBuilder) SetFlags(flags *pflag.FlagSet) *ConsoleBuilder {
 			b.SetColor(value)
 		}
 	}
+	if flags.Changed(consoleNoColorFlag) {
+		value, err := flags.GetBool(consoleNoColorFlag)
+		if err == nil && value {
+			b.SetColor(false)
+		}
+	}
 	if flags.Changed(consoleMuteFlag) {
 		value, err := flags.GetBool(consoleMuteFlag)
 		if err == nil {
 			b.SetMute(value)
 		}
 	}
+	if flags.Changed(consoleYesFlag) {
+		value, err := flags.GetBool(consoleYesFlag)
+		if err == nil {
+			b.SetYes(value)
+		}
+	}
 	return b
 }
 
@@ -130,29 +172,56 @@ func (b *ConsoleBuilder) Build() (result *Console, err error) {
 		return
 	}
 
-	// Check if the ouptput is a terminal:
-	terminal := b.isTerminal(b.out) && b.isTerminal(b.err)
+	// Select the styles. Info and warning messages are written to the output stream and error
+	// messages to the error stream, and each of them may or may not be a terminal, so we need
+	// to check them separately.
+	color := b.color && b.colorAllowed()
+	styles := consoleMonoStyles
+	if color && b.terminal(b.out) {
+		styles.info = consoleColorStyles.info
+		styles.warn = consoleColorStyles.warn
+	}
+	if color && b.terminal(b.err) {
+		styles.error = consoleColorStyles.error
+		styles.prompt = consoleColorStyles.prompt
+	}
 
-	// Select the color prefixes:
-	prefixes := consoleMonoPrefixes
-	if b.color && terminal {
-		prefixes = consoleColorPrefixes
+	// Confirmations can only be asked when the input is a terminal and the prompt is visible:
+	var in *bufio.Reader
+	if b.in != nil {
+		in = bufio.NewReader(b.in)
 	}
+	interactive := in != nil && !b.mute && b.terminal(b.in)
 
 	// Create and populate the object:
 	result = &Console{
-		logger:   b.logger,
-		lock:     &sync.Mutex{},
-		mute:     b.mute,
-		prefixes: prefixes,
-		out:      b.out,
-		err:      b.err,
+		logger:      b.logger,
+		lock:        &sync.Mutex{},
+		mute:        b.mute,
+		yes:         b.yes,
+		interactive: interactive,
+		styles:      styles,
+		in:          in,
+		out:         b.out,
+		err:         b.err,
 	}
 	return
 }
 
-func (c *ConsoleBuilder) isTerminal(w io.Writer) bool {
-	file, ok := w.(*os.File)
+// colorAllowed checks the environment variables that disable color. See https://no-color.org for
+// details about the 'NO_COLOR' environment variable.
+func (b *ConsoleBuilder) colorAllowed() bool {
+	value, _ := b.env("NO_COLOR")
+	if value != "" {
+		return false
+	}
+	value, _ = b.env("TERM")
+	return value != "dumb"
+}
+
+// consoleIsTerminal checks if the given stream is a terminal.
+func consoleIsTerminal(stream any) bool {
+	file, ok := stream.(*os.File)
 	if !ok {
 		return false
 	}
@@ -165,33 +234,71 @@ func (c *Console) Info(format string, args ...any) {
 	defer c.lock.Unlock()
 	text := fmt.Sprintf(format, c.replaceArgs(args)...)
 	if !c.mute {
-		fmt.Fprintf(c.out, "%s%s\n", c.prefixes.info, text)
+		c.styles.info.write(c.out, text)
 	}
 	c.logger.Info("Console info", "text", text)
 }
 
-// Wanr writes an warning message to the console.
+// Warn writes a warning message to the console.
 func (c *Console) Warn(format string, args ...any) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	text := fmt.Sprintf(format, c.replaceArgs(args)...)
 	if !c.mute {
-		fmt.Fprintf(c.out, "%s%s\n", c.prefixes.warn, text)
+		c.styles.warn.write(c.out, text)
 	}
 	c.logger.Info("Console warn", "text", text)
 }
 
-// Info writes an error message to the console.
+// Error writes an error message to the console.
 func (c *Console) Error(format string, args ...any) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	text := fmt.Sprintf(format, c.replaceArgs(args)...)
 	if !c.mute {
-		fmt.Fprintf(c.err, "%s%s\n", c.prefixes.error, text)
+		c.styles.error.write(c.err, text)
 	}
 	c.logger.Info("Console error", "text", text)
 }
 
+// Confirm asks the user to confirm an operation, writing the given question to the error stream
+// and reading the answer from the input stream. It returns true if the answer is 'y' or 'yes', and
+// false for any other answer, including an empty one. If confirmations are answered automatically,
+// for example with the '--yes' flag, it returns true without asking. If they aren't and the input
+// isn't a terminal it returns an error, so that scripts don't block waiting for an answer that
+// will never come and destructive operations aren't executed by accident.
+func (c *Console) Confirm(format string, args ...any) (result bool, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	text := fmt.Sprintf(format, c.replaceArgs(args)...)
+	if c.yes {
+		c.logger.Info("Console confirm", "text", text, "answer", "yes", "automatic", true)
+		result = true
+		return
+	}
+	if !c.interactive {
+		err = fmt.Errorf(
+			"confirmation '%s' is required but the console isn't interactive, use "+
+				"'--%s' to confirm",
+			text, consoleYesFlag,
+		)
+		return
+	}
+	fmt.Fprintf(c.err, "%s%s [y/N]: %s", c.styles.prompt.prefix, text, c.styles.prompt.suffix)
+	line, err := c.in.ReadString('\n')
+	if errors.Is(err, io.EOF) {
+		fmt.Fprintln(c.err)
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	answer := strings.ToLower(strings.TrimSpace(line))
+	result = answer == "y" || answer == "yes"
+	c.logger.Info("Console confirm", "text", text, "answer", answer, "automatic", false)
+	return
+}
+
 func (c *Console) replaceArgs(args []any) []any {
 	result := make([]any, len(args))
 	for i, arg := range args {
@@ -215,25 +322,57 @@ func (c *Console) replaceArg(arg any) any {
 	}
 }
 
-// consolePrefixes stores the prefixes used for messages.
-type consolePrefixes struct {
-	info  string
-	warn  string
-	error string
+// consoleStyle stores the text written before and after the text of a message.
+type consoleStyle struct {
+	prefix string
+	suffix string
+}
+
+func (s consoleStyle) write(w io.Writer, text string) {
+	fmt.Fprintf(w, "%s%s%s\n", s.prefix, text, s.suffix)
+}
+
+// consoleStyles stores the styles used for each kind of message.
+type consoleStyles struct {
+	info   consoleStyle
+	warn   consoleStyle
+	error  consoleStyle
+	prompt consoleStyle
 }
 
-// consoleColorPrefixes contains the prefixes that use ANSI sequences to set colors when the output
-// is a terminal that supports color.
-var consoleColorPrefixes = consolePrefixes{
-	info:  "\033[32;1mI:\033[0m ",
-	warn:  "\033[33;1mW:\033[0m ",
-	error: "\033[31;1mE:\033[0m ",
+// consoleColorStyles contains the styles that use ANSI sequences to set colors when the output is
+// a terminal that supports color. Info messages only have a green prefix, warnings are completely
+// yellow and errors completely bold red, so that they stand out.
+var consoleColorStyles = consoleStyles{
+	info: consoleStyle{
+		prefix: "\033[32;1mI:\033[0m ",
+	},
+	warn: consoleStyle{
+		prefix: "\033[33;1mW:\033[0;33m ",
+		suffix: "\033[0m",
+	},
+	error: consoleStyle{
+		prefix: "\033[31;1mE: ",
+		suffix: "\033[0m",
+	},
+	prompt: consoleStyle{
+		prefix: "\033[36;1m?:\033[0m ",
+	},
 }
 
-// consoleMonoPrefixes contains the monochrome prefixes that are used when the output isn't a
-// terminal or when the terminal doesn't support color.
-var consoleMonoPrefixes = consolePrefixes{
-	info:  "I: ",
-	warn:  "W: ",
-	error: "E: ",
+// consoleMonoStyles contains the monochrome styles that are used when the output isn't a terminal
+// or when color is disabled.
+var consoleMonoStyles = consoleStyles{
+	info: consoleStyle{
+		prefix: "I: ",
+	},
+	warn: consoleStyle{
+		prefix: "W: ",
+	},
+	error: consoleStyle{
+		prefix: "E: ",
+	},
+	prompt: consoleStyle{
+		prefix: "?: ",
+	},
 }
@@ -24,17 +24,33 @@ func AddConsoleFlags(set *pflag.FlagSet) {
 		consoleColorFlag,
 		true,
 		"Enables or disables use of color in the console. By default color is used when "+
-			"the console is a terminal and disabled otherwise.",
+			"the console is a terminal, unless the 'NO_COLOR' environment variable is set, "+
+			"and disabled otherwise.",
+	)
+	_ = set.Bool(
+		consoleNoColorFlag,
+		false,
+		"Disables use of color in the console. This is equivalent to '--color=false'.",
 	)
 	_ = set.Bool(
 		consoleMuteFlag,
 		true,
 		"Enables or disables writing to the console.",
 	)
+	_ = set.BoolP(
+		consoleYesFlag,
+		"y",
+		false,
+		"Answer 'yes' to all the confirmations of destructive operations. Without this "+
+			"the user is asked for confirmation when the console is a terminal, and the "+
+			"operations fail otherwise.",
+	)
 }
 
 // Names of the flags:
 const (
-	consoleColorFlag = "color"
-	consoleMuteFlag  = "mute"
+	consoleColorFlag   = "color"
+	consoleNoColorFlag = "no-color"
+	consoleMuteFlag    = "mute"
+	consoleYesFlag     = "yes"
 )
@@ -312,5 +312,158 @@ var _ = Describe("Console", func() {
 				"--mute=false",
 			),
 		)
+
+		DescribeTable(
+			"Uses color only when enabled and the stream is a terminal",
+			func(terminal bool, env map[string]string, args []string, outColor, errColor bool) {
+				// Prepare the flags:
+				flags := pflag.NewFlagSet("", pflag.ContinueOnError)
+				AddConsoleFlags(flags)
+				err := flags.Parse(args)
+				Expect(err).ToNot(HaveOccurred())
+
+				// Create the console, replacing the terminal detection so that only the
+				// output stream is considered a terminal, and the environment:
+				stdout := &bytes.Buffer{}
+				stderr := &bytes.Buffer{}
+				builder := NewConsole().
+					SetLogger(logger).
+					SetFlags(flags).
+					SetOut(stdout).
+					SetErr(stderr)
+				builder.terminal = func(stream any) bool {
+					return terminal && stream == stdout
+				}
+				builder.env = func(name string) (value string, ok bool) {
+					value, ok = env[name]
+					return
+				}
+				console, err := builder.Build()
+				Expect(err).ToNot(HaveOccurred())
+
+				// Check the result:
+				console.Warn("Hello!")
+				console.Error("Hello!")
+				if outColor {
+					Expect(stdout.String()).To(Equal("\033[33;1mW:\033[0;33m Hello!\033[0m\n"))
+				} else {
+					Expect(stdout.String()).To(Equal("W: Hello!\n"))
+				}
+				if errColor {
+					Expect(stderr.String()).To(Equal("\033[31;1mE: Hello!\033[0m\n"))
+				} else {
+					Expect(stderr.String()).To(Equal("E: Hello!\n"))
+				}
+			},
+			Entry(
+				"Terminal",
+				true, nil, nil,
+				true, false,
+			),
+			Entry(
+				"Not a terminal",
+				false, nil, nil,
+				false, false,
+			),
+			Entry(
+				"Terminal with --no-color",
+				true, nil, []string{"--no-color"},
+				false, false,
+			),
+			Entry(
+				"Terminal with --color=false",
+				true, nil, []string{"--color=false"},
+				false, false,
+			),
+			Entry(
+				"Terminal with NO_COLOR",
+				true, map[string]string{"NO_COLOR": "1"}, nil,
+				false, false,
+			),
+			Entry(
+				"Terminal with empty NO_COLOR",
+				true, map[string]string{"NO_COLOR": ""}, nil,
+				true, false,
+			),
+			Entry(
+				"Dumb terminal",
+				true, map[string]string{"TERM": "dumb"}, nil,
+				false, false,
+			),
+		)
+	})
+
+	Describe("Confirmations", func() {
+		// makeConsole creates a console that reads the answers from the given text. The input
+		// is considered a terminal if the interactive parameter is true.
+		makeConsole := func(answers string, interactive bool,
+			args ...string) (console *Console, prompts *bytes.Buffer) {
+			flags := pflag.NewFlagSet("", pflag.ContinueOnError)
+			AddConsoleFlags(flags)
+			err := flags.Parse(args)
+			Expect(err).ToNot(HaveOccurred())
+			in := bytes.NewBufferString(answers)
+			prompts = &bytes.Buffer{}
+			builder := NewConsole().
+				SetLogger(logger).
+				SetFlags(flags).
+				SetIn(in).
+				SetOut(io.Discard).
+				SetErr(prompts)
+			builder.terminal = func(stream any) bool {
+				return interactive && stream == in
+			}
+			console, err = builder.Build()
+			Expect(err).ToNot(HaveOccurred())
+			return
+		}
+
+		DescribeTable(
+			"Interprets the answer",
+			func(answer string, expected bool) {
+				console, prompts := makeConsole(answer, true)
+				confirmed, err := console.Confirm("Remove '%s'?", "my-file")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(confirmed).To(Equal(expected))
+				Expect(prompts.String()).To(HavePrefix("?: Remove 'my-file'? [y/N]: "))
+			},
+			Entry("Yes", "yes\n", true),
+			Entry("Short yes", "y\n", true),
+			Entry("Upper case yes", "YES\n", true),
+			Entry("No", "no\n", false),
+			Entry("Empty", "\n", false),
+			Entry("Anything else", "maybe\n", false),
+			Entry("End of input", "", false),
+		)
+
+		It("Doesn't prompt when '--yes' is used", func() {
+			console, prompts := makeConsole("", false, "--yes")
+			confirmed, err := console.Confirm("Remove everything?")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(confirmed).To(BeTrue())
+			Expect(prompts.String()).To(BeEmpty())
+		})
+
+		It("Accepts the '-y' short flag", func() {
+			console, _ := makeConsole("", false, "-y")
+			confirmed, err := console.Confirm("Remove everything?")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(confirmed).To(BeTrue())
+		})
+
+		It("Fails if the input isn't a terminal", func() {
+			console, prompts := makeConsole("yes\n", false)
+			confirmed, err := console.Confirm("Remove everything?")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("'--yes'"))
+			Expect(confirmed).To(BeFalse())
+			Expect(prompts.String()).To(BeEmpty())
+		})
+
+		It("Fails if the console is muted", func() {
+			console, _ := makeConsole("yes\n", true, "--mute")
+			_, err := console.Confirm("Remove everything?")
+			Expect(err).To(HaveOccurred())
+		})
 	})
 })
@@ -16,10 +16,15 @@ package internal
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	config "github.com/openshift/api/config"
@@ -29,47 +34,222 @@ import (
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	core "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
 	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/cluster"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
 	"github.com/jhernand/upgrade-tool/internal/labels"
 )
 
 // ControllerBuilder contains the data and logic needed to build an upgrade controller. Don't
 // create instance of this type directly, use the NewController function instead.
 type ControllerBuilder struct {
-	logger    logr.Logger
-	namespace string
+	logger         logr.Logger
+	namespace      string
+	bundleCreation bool
+	clusterUpgrade bool
+	managedUpgrade bool
+	replicas       int
+	metricsAddr    string
+	webhookPort    int
+	webhookCertDir string
+	jobRetries     int
+	jobRetention   time.Duration
+	failureBudget  intstr.IntOrString
+	maxConcurrency intstr.IntOrString
+	distribution   string
+	hostedCluster  string
+	hostedConfig   string
+	preflight      bool
+	preflightDisk  resource.Quantity
+	notifications  []string
+	nodeLogLevel   int
 }
 
 // Coodinator knows how to coordinate the activities needed to perform an upgrade without a
 // registry. Don't create instances of this type directly, use the NewController function instead.
 type Controller struct {
-	logger    logr.Logger
-	namespace string
-	manager   ctrl.Manager
-	client    clnt.Client
-	cancel    context.CancelFunc
+	logger         logr.Logger
+	namespace      string
+	clusterUpgrade bool
+	replicas       int
+	jobRetries     int
+	jobRetention   time.Duration
+	failureBudget  intstr.IntOrString
+	maxConcurrency intstr.IntOrString
+	daemonSet      bool
+	nodeLogLevel   int
+	metrics        *controllerMetrics
+	manager        ctrl.Manager
+	cancel         context.CancelFunc
+
+	// preflight indicates if the checks of the health of the cluster should run before starting
+	// an upgrade, and preflightDisk is the minimum disk space that the nodes need to pass them.
+	// The checks read the objects with preflightReader, which doesn't use the cache because
+	// it is restricted to the namespace of the tool, and use preflightConfig to check the
+	// certificate of the API server.
+	preflight       bool
+	preflightDisk   resource.Quantity
+	preflightReader clnt.Reader
+	preflightConfig *rest.Config
+
+	// notifier sends the notifications of the progress of the upgrade. It is nil when there are
+	// no notification webhooks.
+	notifier *Notifier
+
+	// client is used for the nodes, the cluster version and the objects that the controller
+	// creates to distribute the bundle, and upgradeClient is used for the ClusterUpgrade objects.
+	// They are different only in hosted mode, where client is connected to the hosted cluster
+	// and upgradeClient to the management cluster.
+	client        clnt.Client
+	upgradeClient clnt.Client
+
+	// hostedCluster is the namespace and name of the HostedCluster object, in the management
+	// cluster, that describes the hosted cluster. It is empty when not running in hosted mode.
+	hostedCluster clnt.ObjectKey
+
+	// resynced indicates that the view of the upgrade has already been rebuilt from the state of
+	// the cluster after starting. It is protected by resyncLock, as the reconcilers of the
+	// different kinds of objects can run in parallel.
+	resyncLock sync.Mutex
+	resynced   bool
 }
 
 type controllerReconcileTask struct {
-	logger    logr.Logger
-	client    clnt.Client
-	namespace string
-	version   *configv1.ClusterVersion
-	nodes     []*corev1.Node
+	logger        logr.Logger
+	client        clnt.Client
+	upgradeClient clnt.Client
+	namespace     string
+	replicas      int
+	version       *configv1.ClusterVersion
+	nodes         []*corev1.Node
+
+	// upgrade describes the requested upgrade. It is either a ClusterUpgrade object or, when
+	// those objects aren't enabled, an object built from the annotations of the cluster version,
+	// which will not be saved.
+	upgrade *v1alpha1.ClusterUpgrade
+
+	// bundleDir and bundleVersion are used to select the bundle when the bundle server
+	// contains multiple bundles.
+	bundleDir     string
+	bundleVersion string
+
+	// bundleDigest is the expected digest of the bundle, passed to the extractors so that they
+	// can check it before extracting the bundle.
+	bundleDigest string
+
+	// expectedVersion is the version that the extractors check that the bundle contains.
+	expectedVersion string
+
+	// bundleURL and bundleURLSecret are used when the extractors download the bundle directly
+	// from an URL, usually an object store, instead of from the bundle server.
+	bundleURL       string
+	bundleURLSecret string
+
+	// archBundles contains the bundles that the nodes of some architectures download from an URL
+	// instead of using the main bundle.
+	archBundles []v1alpha1.ClusterUpgradeArchBundle
+
+	// streaming indicates if the extractors should extract the bundle while it is downloaded,
+	// without saving it to a file.
+	streaming bool
+
+	// requeue is set when the task needs to check again later something that doesn't generate
+	// events that the controller watches, like the readiness of the bundle server.
+	requeue bool
+
+	// batch is the number, starting with one, of the batch of nodes that can load the images,
+	// and batches is the total number of batches. Both are zero when the rollout isn't split in
+	// batches.
+	batch   int
+	batches int
+
+	// jobRetries is the number of times that failed jobs are created again, and failureBudget
+	// is the number or percentage of nodes that can fail without marking the upgrade as
+	// degraded. The nodes whose jobs failed and have no retries left are saved in exhausted.
+	jobRetries    int
+	failureBudget intstr.IntOrString
+	exhausted     []*corev1.Node
+
+	// maxConcurrency is the number or percentage of nodes that can extract the bundle or load
+	// the images at the same time. Zero means no limit.
+	maxConcurrency intstr.IntOrString
+
+	// daemonSet indicates that the extractors and loaders are executed by the bundle agent
+	// daemon set instead of by one job per node.
+	daemonSet bool
+
+	// nodeLogLevel is the log level of the programs that run in the nodes.
+	nodeLogLevel int
+
+	// tolerations are added to the pods that extract the bundle and load the images, in
+	// addition to the tolerations of the taints of the control plane nodes.
+	tolerations []corev1.Toleration
+
+	// outsideWindow indicates that the upgrade has maintenance windows and that none of them is
+	// open, and nextWindow is the time when the next one opens, or zero if there are no more.
+	outsideWindow bool
+	nextWindow    time.Time
+
+	// preflight indicates if the checks of the health of the cluster should run before starting
+	// the upgrade, using preflightDisk, preflightReader and preflightConfig. The result is saved
+	// in preflightReport, or preflightSkipped is set when they were skipped as requested in the
+	// spec.
+	preflight        bool
+	preflightDisk    resource.Quantity
+	preflightReader  clnt.Reader
+	preflightConfig  *rest.Config
+	preflightReport  *ReadinessReport
+	preflightSkipped bool
+
+	// unsupported is the description of the problem when the update graph of the bundle says
+	// that the update isn't supported and the controller refused to request it.
+	unsupported string
+
+	// notifier sends the notifications when the status of the upgrade changes. It is nil when
+	// notifications aren't enabled.
+	notifier *Notifier
+
+	// hostedCluster is the HostedCluster object that describes the hosted cluster when running
+	// in hosted mode, and nil otherwise. In that mode the upgrade is requested changing the
+	// release image of this object instead of the desired update of the cluster version.
+	hostedCluster *unstructured.Unstructured
+
+	// phase and message describe the state of the upgrade after executing the task, and are used
+	// to update the status of the ClusterUpgrade object.
+	phase   v1alpha1.ClusterUpgradePhase
+	message string
 }
 
 // NewController creates a builder that can then be used to configure and create a coordiator.
 func NewController() *ControllerBuilder {
-	return &ControllerBuilder{}
+	return &ControllerBuilder{
+		jobRetries:   controllerDefaultJobRetries,
+		jobRetention: controllerDefaultJobRetention,
+		distribution: controllerDistributionJobs,
+		preflight:    true,
+		nodeLogLevel: controllerDefaultNodeLogLevel,
+	}
 }
 
 // SetLogger sets the logger that the controller will use to write messages to the log. This is
@@ -86,6 +266,174 @@ func (b *ControllerBuilder) SetNamespace(value string) *ControllerBuilder {
 	return b
 }
 
+// SetBundleCreation enables or disables the reconciliation of BundleCreation objects. This is
+// optional and the default is disabled. Note that when this is enabled the BundleCreation custom
+// resource definition must be installed in the cluster.
+func (b *ControllerBuilder) SetBundleCreation(value bool) *ControllerBuilder {
+	b.bundleCreation = value
+	return b
+}
+
+// SetClusterUpgrade enables or disables the use of ClusterUpgrade objects to describe the upgrade.
+// When enabled the controller performs the upgrade described by the oldest ClusterUpgrade object
+// of the namespace that hasn't completed yet, and reports the progress in its status. When
+// disabled the upgrade is described by the annotations of the cluster version object. This is
+// optional and the default is disabled. Note that when this is enabled the ClusterUpgrade custom
+// resource definition must be installed in the cluster.
+func (b *ControllerBuilder) SetClusterUpgrade(value bool) *ControllerBuilder {
+	b.clusterUpgrade = value
+	return b
+}
+
+// SetManagedClusterUpgrade enables or disables the reconciliation of ManagedClusterUpgrade objects.
+// This is intended for controllers running in an Advanced Cluster Management hub: for each of
+// those objects the controller creates ClusterUpgrade objects in the selected managed clusters
+// using ManifestWork objects, and aggregates in the status of the ManagedClusterUpgrade the
+// progress that the managed clusters report back. This is optional and the default is disabled.
+// Note that when this is enabled the ManagedClusterUpgrade custom resource definition must be
+// installed in the hub, and the controller must be running in the managed clusters with
+// ClusterUpgrade objects enabled.
+func (b *ControllerBuilder) SetManagedClusterUpgrade(value bool) *ControllerBuilder {
+	b.managedUpgrade = value
+	return b
+}
+
+// SetReplicas sets the number of nodes that will receive the bundle before the rest. Those nodes
+// keep a copy of the bundle and serve it to the rest of the nodes, so that large clusters download
+// it from multiple sources instead of from only one. This is optional and the default is zero,
+// which means that all nodes download the bundle directly from the nodes that have it initially.
+func (b *ControllerBuilder) SetReplicas(value int) *ControllerBuilder {
+	b.replicas = value
+	return b
+}
+
+// SetMetricsAddress sets the address where the controller will serve the Prometheus metrics, for
+// example ':8080'. This is optional and the default is to not serve the metrics.
+func (b *ControllerBuilder) SetMetricsAddress(value string) *ControllerBuilder {
+	b.metricsAddr = value
+	return b
+}
+
+// SetJobRetries sets the number of times that the controller will create again the job that
+// extracts the bundle or loads the images in a node when it fails. The delay between retries grows
+// exponentially, starting with thirty seconds and up to ten minutes. This is optional and the
+// default is three.
+func (b *ControllerBuilder) SetJobRetries(value int) *ControllerBuilder {
+	b.jobRetries = value
+	return b
+}
+
+// SetJobRetention sets how long the jobs that extract the bundle, load the images or clean the
+// nodes are kept after they complete successfully. Once that time has passed the controller deletes
+// them, together with their pods, so that large clusters don't accumulate thousands of finished
+// jobs. Failed jobs are never deleted, so that they can be inspected. This is optional and the
+// default is one hour. A value of zero means that completed jobs are never deleted.
+func (b *ControllerBuilder) SetJobRetention(value time.Duration) *ControllerBuilder {
+	b.jobRetention = value
+	return b
+}
+
+// SetFailureBudget sets the number or percentage of nodes, rounded down, that can fail without
+// marking the upgrade as degraded, for example '5%'. This is optional and the default is zero,
+// which means that the upgrade is marked as degraded as soon as one node fails.
+func (b *ControllerBuilder) SetFailureBudget(value intstr.IntOrString) *ControllerBuilder {
+	b.failureBudget = value
+	return b
+}
+
+// SetMaxConcurrency sets the number or percentage of nodes, rounded up, that can extract the bundle
+// or load the images at the same time, for example '10%'. This is optional and the default is zero,
+// which means that there is no limit.
+func (b *ControllerBuilder) SetMaxConcurrency(value intstr.IntOrString) *ControllerBuilder {
+	b.maxConcurrency = value
+	return b
+}
+
+// SetPreflightChecks sets the flag that indicates if the controller checks the health of the
+// cluster before starting an upgrade: that the cluster operators are available and not degraded,
+// that all the etcd members are ready, that all the nodes are ready and have enough disk space,
+// and that the certificate of the API server doesn't expire soon. Upgrades don't start till the
+// checks pass, unless they are explicitly skipped in the ClusterUpgrade object. This is optional
+// and the default is true. It has no effect unless cluster upgrades are enabled.
+func (b *ControllerBuilder) SetPreflightChecks(value bool) *ControllerBuilder {
+	b.preflight = value
+	return b
+}
+
+// SetPreflightDiskSpace sets the minimum allocatable ephemeral storage that the nodes need to
+// pass the checks that run before starting an upgrade, for example '20Gi'. This is optional and
+// the default is zero, which means that only the disk pressure condition of the nodes is checked.
+func (b *ControllerBuilder) SetPreflightDiskSpace(value resource.Quantity) *ControllerBuilder {
+	b.preflightDisk = value
+	return b
+}
+
+// SetNodeLogLevel sets the log level of the programs that the controller runs in the nodes to
+// extract the bundle, load the images and clean the nodes, and of the bundle server and agent.
+// This is optional and the default is one, which includes basic debug messages. Note that the
+// level of programs that are already running can also be changed with an annotation of the node.
+func (b *ControllerBuilder) SetNodeLogLevel(value int) *ControllerBuilder {
+	b.nodeLogLevel = value
+	return b
+}
+
+// SetDistributionMode sets how the controller runs the programs that extract the bundle and load
+// the images in the nodes. The value can be 'jobs', to create one job per node, or 'daemonset', to
+// deploy a long lived bundle agent daemon set that runs them when the controller requests it, so
+// that large clusters don't create and delete thousands of objects for each upgrade. This is
+// optional and the default is 'jobs'.
+func (b *ControllerBuilder) SetDistributionMode(value string) *ControllerBuilder {
+	b.distribution = value
+	return b
+}
+
+// SetWebhookPort sets the port where the controller will serve the admission webhook that
+// validates ClusterUpgrade objects. This is optional and the default is 9443.
+func (b *ControllerBuilder) SetWebhookPort(value int) *ControllerBuilder {
+	b.webhookPort = value
+	return b
+}
+
+// SetWebhookCertDir sets the directory that contains the 'tls.crt' and 'tls.key' files that the
+// admission webhook will use. This is optional and the default is to not serve the webhook. Note
+// that the webhook requires ClusterUpgrade objects to be enabled, and that the validating webhook
+// configuration pointing to the controller must be created in the cluster.
+func (b *ControllerBuilder) SetWebhookCertDir(value string) *ControllerBuilder {
+	b.webhookCertDir = value
+	return b
+}
+
+// SetNotificationWebhooks sets the URLs where the controller sends notifications when an upgrade
+// starts, when a batch of nodes completes, when a node fails and when the upgrade completes. Each
+// value can be prefixed with the name of a template and an equals sign in order to send a payload
+// other than the default JSON document, for example 'slack=https://hooks.slack.com/...'. See the
+// AddWebhook method of the notifier for details. This is optional and the default is to not send
+// notifications. Note that this requires ClusterUpgrade objects to be enabled.
+func (b *ControllerBuilder) SetNotificationWebhooks(values []string) *ControllerBuilder {
+	b.notifications = values
+	return b
+}
+
+// SetHostedCluster sets the namespace and name of the HostedCluster object, for example
+// 'clusters/my-cluster', that describes the hosted cluster that will be upgraded. When this is set
+// the controller runs in the management cluster, distributes the bundle only to the worker nodes of
+// the hosted cluster, as there are no control plane nodes, and requests the upgrade changing the
+// release image of the HostedCluster object. This is optional and the default is to upgrade the
+// cluster where the controller runs. Note that this requires ClusterUpgrade objects to be enabled,
+// and the kubeconfig of the hosted cluster.
+func (b *ControllerBuilder) SetHostedCluster(value string) *ControllerBuilder {
+	b.hostedCluster = value
+	return b
+}
+
+// SetHostedKubeconfig sets the kubeconfig file that the controller will use to connect to the
+// hosted cluster in order to watch and label the nodes and to create the objects needed to
+// distribute the bundle. This is mandatory when the hosted cluster is set.
+func (b *ControllerBuilder) SetHostedKubeconfig(value string) *ControllerBuilder {
+	b.hostedConfig = value
+	return b
+}
+
 // Build uses the configuration stored in the builder to create a new controller.
 func (b *ControllerBuilder) Build() (result *Controller, err error) {
 	// Check parameters:
@@ -97,51 +445,284 @@ func (b *ControllerBuilder) Build() (result *Controller, err error) {
 		err = errors.New("namespace is mandatory")
 		return
 	}
+	if b.replicas < 0 {
+		err = fmt.Errorf(
+			"number of replicas %d isn't valid, it must be greater than or equal to zero",
+			b.replicas,
+		)
+		return
+	}
+	if b.jobRetries < 0 {
+		err = fmt.Errorf(
+			"number of job retries %d isn't valid, it must be greater than or equal to zero",
+			b.jobRetries,
+		)
+		return
+	}
+	if b.jobRetention < 0 {
+		err = fmt.Errorf(
+			"job retention %s isn't valid, it must be greater than or equal to zero",
+			b.jobRetention,
+		)
+		return
+	}
+	budget, err := intstr.GetScaledValueFromIntOrPercent(&b.failureBudget, 100, false)
+	if err != nil {
+		err = fmt.Errorf(
+			"failure budget '%s' isn't valid: %w",
+			b.failureBudget.String(), err,
+		)
+		return
+	}
+	if budget < 0 {
+		err = fmt.Errorf(
+			"failure budget '%s' isn't valid, it must be greater than or equal to zero",
+			b.failureBudget.String(),
+		)
+		return
+	}
+	concurrency, err := intstr.GetScaledValueFromIntOrPercent(&b.maxConcurrency, 100, true)
+	if err != nil {
+		err = fmt.Errorf(
+			"maximum concurrency '%s' isn't valid: %w",
+			b.maxConcurrency.String(), err,
+		)
+		return
+	}
+	if concurrency < 0 {
+		err = fmt.Errorf(
+			"maximum concurrency '%s' isn't valid, it must be greater than or equal to zero",
+			b.maxConcurrency.String(),
+		)
+		return
+	}
+	if b.nodeLogLevel < 0 {
+		err = fmt.Errorf(
+			"node log level %d isn't valid, it must be greater than or equal to zero",
+			b.nodeLogLevel,
+		)
+		return
+	}
+	if b.distribution != controllerDistributionJobs &&
+		b.distribution != controllerDistributionDaemonSet {
+		err = fmt.Errorf(
+			"distribution mode '%s' isn't valid, it must be '%s' or '%s'",
+			b.distribution, controllerDistributionJobs, controllerDistributionDaemonSet,
+		)
+		return
+	}
+	if b.webhookCertDir != "" && !b.clusterUpgrade {
+		err = errors.New("webhook requires cluster upgrades to be enabled")
+		return
+	}
+	if len(b.notifications) > 0 && !b.clusterUpgrade {
+		err = errors.New("notifications require cluster upgrades to be enabled")
+		return
+	}
+	if b.webhookPort < 0 {
+		err = fmt.Errorf(
+			"webhook port %d isn't valid, it must be greater than or equal to zero",
+			b.webhookPort,
+		)
+		return
+	}
+	var hostedCluster clnt.ObjectKey
+	if b.hostedCluster != "" {
+		var ok bool
+		hostedCluster.Namespace, hostedCluster.Name, ok = strings.Cut(b.hostedCluster, "/")
+		if !ok || hostedCluster.Namespace == "" || hostedCluster.Name == "" {
+			err = fmt.Errorf(
+				"hosted cluster '%s' isn't valid, it must be the namespace and the "+
+					"name separated by a slash, for example 'clusters/my-cluster'",
+				b.hostedCluster,
+			)
+			return
+		}
+		if b.hostedConfig == "" {
+			err = errors.New("hosted cluster requires the hosted kubeconfig")
+			return
+		}
+		if !b.clusterUpgrade {
+			err = errors.New("hosted cluster requires cluster upgrades to be enabled")
+			return
+		}
+	}
+	if b.hostedConfig != "" && b.hostedCluster == "" {
+		err = errors.New("hosted kubeconfig requires the hosted cluster")
+		return
+	}
 
 	// Creat the scheme and register the types that we will be using:
 	scheme := runtime.NewScheme()
 	core.AddToScheme(scheme)
 	config.Install(scheme)
+	v1alpha1.AddToScheme(scheme)
 
 	// Create the controller manager:
 	cfg, err := ctrl.GetConfig()
 	if err != nil {
 		return
 	}
+	metricsAddr := b.metricsAddr
+	if metricsAddr == "" {
+		metricsAddr = "0"
+	}
 	options := ctrl.Options{
 		Scheme:                 scheme,
 		Logger:                 b.logger,
 		Namespace:              b.namespace,
-		MetricsBindAddress:     "0",
+		MetricsBindAddress:     metricsAddr,
 		HealthProbeBindAddress: "0",
 	}
+	if b.webhookCertDir != "" {
+		options.WebhookServer = webhook.NewServer(webhook.Options{
+			Port:    b.webhookPort,
+			CertDir: b.webhookCertDir,
+		})
+	}
 	manager, err := ctrl.NewManager(cfg, options)
 	if err != nil {
 		return
 	}
 
+	// In hosted mode the nodes, the cluster version and the objects used to distribute the bundle
+	// are in the hosted cluster, so we need an additional cluster object connected to it, with
+	// its own cache:
+	var nodesCluster cluster.Cluster = manager
+	nodesCfg := cfg
+	if b.hostedConfig != "" {
+		var hostedCfg *rest.Config
+		hostedCfg, err = clientcmd.BuildConfigFromFlags("", b.hostedConfig)
+		if err != nil {
+			return
+		}
+		nodesCfg = hostedCfg
+		nodesCluster, err = cluster.New(hostedCfg, func(options *cluster.Options) {
+			options.Scheme = scheme
+			options.Logger = b.logger
+			options.Namespace = b.namespace
+		})
+		if err != nil {
+			return
+		}
+		err = manager.Add(nodesCluster)
+		if err != nil {
+			return
+		}
+	}
+
+	// Create the metrics, in the registry that the manager uses to serve them:
+	metrics, err := newControllerMetrics(ctrlmetrics.Registry)
+	if err != nil {
+		return
+	}
+
+	// Create the notifier:
+	var notifier *Notifier
+	if len(b.notifications) > 0 {
+		notifier, err = NewNotifier().
+			SetLogger(b.logger.WithName("notifier")).
+			AddWebhooks(b.notifications...).
+			Build()
+		if err != nil {
+			return
+		}
+	}
+
 	// Create and populate the object:
 	controller := &Controller{
-		logger:    b.logger,
-		namespace: b.namespace,
-		manager:   manager,
-		client:    manager.GetClient(),
+		logger:          b.logger,
+		namespace:       b.namespace,
+		clusterUpgrade:  b.clusterUpgrade,
+		replicas:        b.replicas,
+		jobRetries:      b.jobRetries,
+		jobRetention:    b.jobRetention,
+		failureBudget:   b.failureBudget,
+		maxConcurrency:  b.maxConcurrency,
+		daemonSet:       b.distribution == controllerDistributionDaemonSet,
+		nodeLogLevel:    b.nodeLogLevel,
+		metrics:         metrics,
+		manager:         manager,
+		client:          nodesCluster.GetClient(),
+		upgradeClient:   manager.GetClient(),
+		hostedCluster:   hostedCluster,
+		preflight:       b.preflight,
+		preflightDisk:   b.preflightDisk,
+		preflightReader: nodesCluster.GetAPIReader(),
+		preflightConfig: nodesCfg,
+		notifier:        notifier,
 	}
 
 	// Add the controllers:
 	_, err = ctrl.NewControllerManagedBy(manager).
-		For(&configv1.ClusterVersion{}).
+		Named("clusterversion").
+		WatchesRawSource(
+			source.Kind(nodesCluster.GetCache(), &configv1.ClusterVersion{}),
+			&handler.EnqueueRequestForObject{},
+		).
 		Build(controller)
 	if err != nil {
 		return
 	}
 	_, err = ctrl.NewControllerManagedBy(manager).
-		For(&corev1.Node{}).
+		Named("node").
+		WatchesRawSource(
+			source.Kind(nodesCluster.GetCache(), &corev1.Node{}),
+			&handler.EnqueueRequestForObject{},
+		).
 		Build(controller)
 	if err != nil {
 		return
 	}
 
+	if b.clusterUpgrade {
+		_, err = ctrl.NewControllerManagedBy(manager).
+			For(&v1alpha1.ClusterUpgrade{}).
+			Build(controller)
+		if err != nil {
+			return
+		}
+	}
+
+	if b.webhookCertDir != "" {
+		err = ctrl.NewWebhookManagedBy(manager).
+			For(&v1alpha1.ClusterUpgrade{}).
+			WithValidator(&clusterUpgradeValidator{
+				logger:    b.logger.WithName("webhook"),
+				client:    manager.GetAPIReader(),
+				namespace: b.namespace,
+			}).
+			Complete()
+		if err != nil {
+			return
+		}
+	}
+
+	if b.bundleCreation {
+		_, err = ctrl.NewControllerManagedBy(manager).
+			For(&v1alpha1.BundleCreation{}).
+			Owns(&batchv1.Job{}).
+			Build(&bundleCreationReconciler{
+				logger: b.logger.WithName("bundle-creation"),
+				client: manager.GetClient(),
+			})
+		if err != nil {
+			return
+		}
+	}
+
+	if b.managedUpgrade {
+		_, err = ctrl.NewControllerManagedBy(manager).
+			For(&v1alpha1.ManagedClusterUpgrade{}).
+			Build(&managedClusterUpgradeReconciler{
+				logger: b.logger.WithName("managed-cluster-upgrade"),
+				client: manager.GetClient(),
+			})
+		if err != nil {
+			return
+		}
+	}
+
 	// Return the result:
 	result = controller
 	return
@@ -170,6 +751,12 @@ func (c *Controller) Stop(ctx context.Context) error {
 
 func (c *Controller) Reconcile(ctx context.Context, request ctrl.Request) (result ctrl.Result,
 	err error) {
+	defer func() {
+		if err != nil {
+			c.metrics.observeError()
+		}
+	}()
+
 	// Fetch the relevant objects:
 	version, err := c.fetchVersion(ctx)
 	if err != nil {
@@ -179,19 +766,109 @@ func (c *Controller) Reconcile(ctx context.Context, request ctrl.Request) (resul
 	if err != nil {
 		return
 	}
+	c.metrics.observeNodes(nodes)
+	err = c.observeJobs(ctx)
+	if err != nil {
+		return
+	}
+
+	// Delete the jobs that completed long ago, and check again when the next one expires, as
+	// jobs aren't watched:
+	expiration, err := c.collectJobs(ctx)
+	if err != nil {
+		return
+	}
+	result.RequeueAfter = expiration
 
 	// Create and execute the task:
 	task := &controllerReconcileTask{
-		logger:    c.logger,
-		client:    c.client,
-		namespace: c.namespace,
-		version:   version,
-		nodes:     nodes,
+		logger:         c.logger,
+		client:         c.client,
+		upgradeClient:  c.upgradeClient,
+		namespace:      c.namespace,
+		replicas:       c.replicas,
+		jobRetries:     c.jobRetries,
+		failureBudget:  c.failureBudget,
+		maxConcurrency: c.maxConcurrency,
+		daemonSet:      c.daemonSet,
+		nodeLogLevel:   c.nodeLogLevel,
+		version:        version,
+		nodes:          nodes,
+	}
+	if c.hostedCluster.Name != "" {
+		task.hostedCluster, err = c.fetchHostedCluster(ctx)
+		if err != nil {
+			return
+		}
+	}
+
+	// Get the description of the upgrade:
+	if c.clusterUpgrade {
+		task.upgrade, err = c.fetchUpgrade(ctx)
+		if err != nil {
+			return
+		}
+		if task.upgrade == nil {
+			// Make sure that the machine config pools aren't left paused if the upgrade
+			// was deleted while the images were being loaded:
+			c.logger.V(1).Info("There is no pending cluster upgrade")
+			err = task.syncMachineConfigPools(ctx, nil)
+			return
+		}
+		if task.upgrade.Spec.Rollout.Replicas != nil {
+			task.replicas = int(*task.upgrade.Spec.Rollout.Replicas)
+		}
+		if task.upgrade.Spec.Rollout.MaxRetries != nil {
+			task.jobRetries = int(*task.upgrade.Spec.Rollout.MaxRetries)
+		}
+		if task.upgrade.Spec.Rollout.FailureBudget != nil {
+			task.failureBudget = *task.upgrade.Spec.Rollout.FailureBudget
+		}
+		if task.upgrade.Spec.Rollout.MaxConcurrency != nil {
+			task.maxConcurrency = *task.upgrade.Spec.Rollout.MaxConcurrency
+		}
+		task.preflight = c.preflight
+		task.preflightDisk = c.preflightDisk
+		task.preflightReader = c.preflightReader
+		task.preflightConfig = c.preflightConfig
+		task.notifier = c.notifier
+	} else {
+		task.upgrade = task.upgradeFromAnnotations()
+	}
+
+	// The first time after starting rebuild the view of the upgrade from the state of the
+	// cluster, as the controller may have been restarted in the middle of the upgrade:
+	err = c.resync(ctx, nodes, task.upgrade)
+	if err != nil {
+		return
 	}
+
 	err = task.execute(ctx)
 	if err != nil {
 		return
 	}
+	c.metrics.observePhase(task.phase)
+	if c.clusterUpgrade {
+		err = task.updateStatus(ctx)
+		if err != nil {
+			return
+		}
+	}
+	if task.requeue && (result.RequeueAfter == 0 || result.RequeueAfter > controllerRequeueDelay) {
+		result.RequeueAfter = controllerRequeueDelay
+	}
+
+	// If the upgrade is waiting for a maintenance window then make sure that it is reconciled
+	// again when the window opens, as that doesn't generate any event:
+	if task.outsideWindow && !task.nextWindow.IsZero() {
+		delay := time.Until(task.nextWindow)
+		if delay < time.Second {
+			delay = time.Second
+		}
+		if result.RequeueAfter == 0 || result.RequeueAfter > delay {
+			result.RequeueAfter = delay
+		}
+	}
 
 	return
 }
@@ -202,7 +879,7 @@ func (c *Controller) fetchVersion(ctx context.Context) (result *configv1.Cluster
 	key := clnt.ObjectKey{
 		Name: "version",
 	}
-	c.client.Get(ctx, key, version)
+	err = c.client.Get(ctx, key, version)
 	if err != nil {
 		return
 	}
@@ -210,78 +887,455 @@ func (c *Controller) fetchVersion(ctx context.Context) (result *configv1.Cluster
 	return
 }
 
-func (c *Controller) fetchNodes(ctx context.Context) (results []*corev1.Node, err error) {
-	list := &corev1.NodeList{}
-	err = c.client.List(ctx, list)
+// fetchUpgrade returns the oldest cluster upgrade of the namespace that hasn't completed yet, or
+// nil if there is no such upgrade.
+func (c *Controller) fetchUpgrade(ctx context.Context) (result *v1alpha1.ClusterUpgrade,
+	err error) {
+	list := &v1alpha1.ClusterUpgradeList{}
+	err = c.upgradeClient.List(ctx, list, clnt.InNamespace(c.namespace))
 	if err != nil {
 		return
 	}
-	results = make([]*corev1.Node, len(list.Items))
-	for i, item := range list.Items {
-		results[i] = item.DeepCopy()
+	for i := range list.Items {
+		item := &list.Items[i]
+		if item.Status.Phase == v1alpha1.ClusterUpgradeCompleted {
+			continue
+		}
+		if result == nil || c.olderUpgrade(item, result) {
+			result = item
+		}
+	}
+	if result != nil {
+		result = result.DeepCopy()
 	}
 	return
 }
 
-func (t *controllerReconcileTask) execute(ctx context.Context) error {
-	var err error
+// fetchHostedCluster returns the HostedCluster object that describes the hosted cluster.
+func (c *Controller) fetchHostedCluster(ctx context.Context) (result *unstructured.Unstructured,
+	err error) {
+	object := &unstructured.Unstructured{}
+	object.SetGroupVersionKind(controllerHostedClusterGVK)
+	err = c.upgradeClient.Get(ctx, c.hostedCluster, object)
+	if err != nil {
+		return
+	}
+	result = object
+	return
+}
 
-	// Don't try to do anything if an upgrade has already been requested:
-	if t.upgradeRequested() {
-		t.logger.V(1).Info(
-			"Upgrade has already been requested",
-			"version", t.version.Spec.DesiredUpdate.Version,
-			"image", t.version.Spec.DesiredUpdate.Image,
-		)
-		return nil
+func (c *Controller) olderUpgrade(a, b *v1alpha1.ClusterUpgrade) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
 	}
+	return a.Name < b.Name
+}
 
-	// Don't try to do anything if the bundle hasn't been specified:
-	bundleFile := t.stringAnnotation(t.version, annotations.BundleFile)
-	if bundleFile == "" {
-		t.logger.V(1).Info("Bundle file hasn't been specified yet")
+// observeJobs fetches the jobs and pods created by the controller and updates the metrics.
+func (c *Controller) observeJobs(ctx context.Context) error {
+	if c.metrics == nil {
 		return nil
 	}
+	jobs := &batchv1.JobList{}
+	err := c.client.List(ctx, jobs, clnt.InNamespace(c.namespace))
+	if err != nil {
+		return err
+	}
+	pods := &corev1.PodList{}
+	err = c.client.List(ctx, pods, clnt.InNamespace(c.namespace))
+	if err != nil {
+		return err
+	}
+	c.metrics.observeJobs(jobs.Items, pods.Items)
+	return nil
+}
 
-	// Classify nodes according to what actions they need:
-	var needExtractor, needLoader, needNothing []*corev1.Node
-	for _, node := range t.nodes {
-		bundleExtracted := t.boolLabel(node, labels.BundleExtracted)
-		bundleLoaded := t.boolLabel(node, labels.BundleLoaded)
-		if !bundleExtracted {
-			needExtractor = append(needExtractor, node)
+// collectJobs deletes the jobs that extract the bundle, load the images or clean the nodes, and
+// their pods, when they completed successfully more than the retention time ago. Failed jobs are
+// kept so that they can be inspected. It returns the time till the next completed job expires, or
+// zero if there is no such job.
+func (c *Controller) collectJobs(ctx context.Context) (next time.Duration, err error) {
+	if c.jobRetention == 0 {
+		return
+	}
+	list := &batchv1.JobList{}
+	err = c.client.List(ctx, list, clnt.InNamespace(c.namespace), clnt.HasLabels{labels.Job})
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for i := range list.Items {
+		job := &list.Items[i]
+		switch job.Labels[labels.Job] {
+		case bundleExtractor, bundleLoader, bundleCleaner:
+		default:
+			continue
 		}
-		if bundleExtracted && !bundleLoaded {
-			needLoader = append(needLoader, node)
+
+		// Note that the completion time is only set when the job succeeds:
+		if job.DeletionTimestamp != nil || job.Status.CompletionTime == nil {
+			continue
 		}
-		if bundleExtracted && bundleLoaded {
-			needNothing = append(needNothing, node)
+		remaining := job.Status.CompletionTime.Add(c.jobRetention).Sub(now)
+		if remaining > 0 {
+			if next == 0 || remaining < next {
+				next = remaining
+			}
+			continue
 		}
-	}
-
-	// If there are nodes that need the bundle extracted then we need to start the bundle server
-	// daemon set and the bundle extractor job for each of those nodes.
-	if len(needExtractor) > 0 {
-		t.logger.Info(
-			"Some nodes don't have the bundle extracted yet, will start the bundle "+
-				"server and the bundle extractor for those nodes",
-			"nodes", t.nodeNames(needExtractor),
+		err = c.client.Delete(
+			ctx, job,
+			clnt.PropagationPolicy(metav1.DeletePropagationBackground),
 		)
-		err = t.startBundleServer(ctx, bundleFile)
-		if err != nil {
-			return err
+		if apierrors.IsNotFound(err) {
+			err = nil
+			continue
 		}
-		for _, node := range needExtractor {
-			err = t.startBundleExtractor(ctx, node, bundleFile)
-			if err != nil {
-				return err
-			}
+		if err != nil {
+			c.logger.Error(
+				err,
+				"Failed to delete completed job",
+				"job", job.Name,
+			)
+			return
 		}
+		c.logger.Info(
+			"Deleted completed job",
+			"job", job.Name,
+			"node", job.Spec.Template.Spec.NodeName,
+			"completed", job.Status.CompletionTime.Time,
+		)
 	}
+	return
+}
 
-	// If all the nodes have the bundle extracted already then we can stop the bundle server:
-	if len(needExtractor) == 0 {
-		t.logger.Info("All nodes have the bundle extracted, will stop the bundle server")
+// fetchNodes returns the nodes that need the bundle. In hosted mode those are only the worker
+// nodes, as the control plane runs in the management cluster.
+func (c *Controller) fetchNodes(ctx context.Context) (results []*corev1.Node, err error) {
+	list := &corev1.NodeList{}
+	err = c.client.List(ctx, list)
+	if err != nil {
+		return
+	}
+	results = make([]*corev1.Node, 0, len(list.Items))
+	for _, item := range list.Items {
+		if c.hostedCluster.Name != "" {
+			_, worker := item.Labels[controllerWorkerRoleLabel]
+			if !worker {
+				continue
+			}
+		}
+		results = append(results, item.DeepCopy())
+	}
+	return
+}
+
+func (t *controllerReconcileTask) execute(ctx context.Context) error {
+	var err error
+
+	// Only the nodes selected by the rollout are part of the upgrade:
+	err = t.selectNodes()
+	if err != nil {
+		t.logger.Error(err, "Rollout node selector isn't valid")
+		t.phase = v1alpha1.ClusterUpgradePending
+		t.message = fmt.Sprintf("Rollout node selector isn't valid: %v", err)
+		return nil
+	}
+
+	// If the upgrade has already been requested then check the progress reported by the cluster
+	// version operator. Once it has completed there is nothing else to do, but while it is in
+	// progress nodes that join the cluster still need the bundle.
+	requested := t.upgradeRequested()
+	if requested {
+		desiredUpdate := t.desiredUpdate()
+		t.logger.V(1).Info(
+			"Upgrade has already been requested",
+			"version", desiredUpdate.Version,
+			"image", desiredUpdate.Image,
+		)
+		t.checkUpgradeProgress()
+		if t.phase == v1alpha1.ClusterUpgradeCompleted {
+			return t.syncMachineConfigPools(ctx, nil)
+		}
+	}
+
+	// Don't try to do anything if the bundle hasn't been specified, either as a single file, as
+	// a version to select from a directory containing multiple bundles, or as an URL:
+	spec := t.upgrade.Spec
+	bundleFile := spec.Bundle.File
+	t.bundleDir = spec.Bundle.Dir
+	if t.bundleDir != "" {
+		t.bundleVersion = spec.Version
+	}
+	t.expectedVersion = spec.Version
+	t.bundleDigest = spec.Bundle.Digest
+	t.bundleURL = spec.Bundle.URL
+	if spec.Bundle.URLSecret != nil {
+		t.bundleURLSecret = spec.Bundle.URLSecret.Name
+	}
+	t.archBundles = spec.ArchBundles
+	t.streaming = spec.Rollout.Streaming
+	t.tolerations = spec.Rollout.Tolerations
+	if bundleFile == "" && t.bundleURL == "" && (t.bundleDir == "" || t.bundleVersion == "") {
+		if requested {
+			return nil
+		}
+		t.logger.V(1).Info("Bundle file hasn't been specified yet")
+		t.phase = v1alpha1.ClusterUpgradePending
+		t.message = "Bundle hasn't been specified"
+		return t.syncMachineConfigPools(ctx, nil)
+	}
+
+	// Check if the upgrade is inside of one of its maintenance windows. This has no effect once
+	// the upgrade has been requested.
+	if !requested {
+		schedule, err := parseMaintenanceSchedule(spec.Schedule)
+		if err != nil {
+			t.logger.Error(err, "Schedule isn't valid")
+			t.phase = v1alpha1.ClusterUpgradePending
+			t.message = fmt.Sprintf("Schedule isn't valid: %v", err)
+			return nil
+		}
+		if schedule != nil {
+			var open bool
+			open, t.nextWindow = schedule.check(time.Now())
+			t.outsideWindow = !open
+		}
+	}
+
+	// Check the health of the cluster before distributing anything. This has no effect once the
+	// upgrade has been requested.
+	if !requested && t.preflight {
+		passed, err := t.checkPreflight(ctx)
+		if err != nil {
+			return err
+		}
+		if !passed {
+			failures := t.preflightFailures()
+			t.logger.Info(
+				"Preflight checks failed, will not start the upgrade",
+				"failures", failures,
+			)
+			t.phase = v1alpha1.ClusterUpgradePending
+			t.message = fmt.Sprintf("Preflight checks failed: %s", failures)
+			t.requeue = true
+			return t.syncMachineConfigPools(ctx, nil)
+		}
+	}
+
+	// Classify nodes according to what actions they need. Excluded nodes that need actions are
+	// deferred till they are no longer excluded.
+	var needExtractor, needLoader, needNothing, deferred []*corev1.Node
+	for _, node := range t.nodes {
+		bundleExtracted := t.boolLabel(node, labels.BundleExtracted)
+		bundleLoaded := t.boolLabel(node, labels.BundleLoaded)
+		if !(bundleExtracted && bundleLoaded) && t.nodeExcluded(node) {
+			deferred = append(deferred, node)
+			continue
+		}
+		if !bundleExtracted {
+			needExtractor = append(needExtractor, node)
+		}
+		if bundleExtracted && !bundleLoaded {
+			needLoader = append(needLoader, node)
+		}
+		if bundleExtracted && bundleLoaded {
+			needNothing = append(needNothing, node)
+		}
+	}
+
+	// If the rollout is split in batches then only the nodes of the current batch can load the
+	// images, and only if the nodes of the previous batches are healthy. This doesn't apply to
+	// the nodes that join the cluster once the upgrade has been requested.
+	var unhealthy []*corev1.Node
+	if len(spec.Rollout.Batches) > 0 && !requested {
+		batches, err := t.splitBatches()
+		if err != nil {
+			t.logger.Error(err, "Rollout batches aren't valid")
+			t.phase = v1alpha1.ClusterUpgradePending
+			t.message = fmt.Sprintf("Rollout batches aren't valid: %v", err)
+			return nil
+		}
+		needLoader, unhealthy = t.selectBatch(batches, needLoader)
+	}
+
+	// Save the phase, so that it can be reported in the status:
+	switch {
+	case requested && len(needNothing) < len(t.nodes):
+		var pending []*corev1.Node
+		pending = append(pending, needExtractor...)
+		pending = append(pending, needLoader...)
+		pending = append(pending, deferred...)
+		t.message = fmt.Sprintf(
+			"%s, waiting for new nodes %s to have the bundle",
+			t.message, strings.Join(t.nodeNames(pending), ", "),
+		)
+	case requested:
+		// Keep the progress reported by the cluster version operator.
+	case len(needExtractor) > 0:
+		t.phase = v1alpha1.ClusterUpgradeExtracting
+		t.message = fmt.Sprintf(
+			"Extracting bundle, %d of %d nodes pending",
+			len(needExtractor), len(t.nodes),
+		)
+	case len(unhealthy) > 0:
+		t.phase = v1alpha1.ClusterUpgradeLoading
+		t.message = fmt.Sprintf(
+			"Waiting for nodes %s to be healthy before loading images in batch %d of %d",
+			strings.Join(t.nodeNames(unhealthy), ", "), t.batch, t.batches,
+		)
+	case len(needLoader) > 0 && t.batch > 0:
+		t.phase = v1alpha1.ClusterUpgradeLoading
+		t.message = fmt.Sprintf(
+			"Loading images in batch %d of %d, %d of %d nodes pending",
+			t.batch, t.batches, len(t.nodes)-len(needNothing), len(t.nodes),
+		)
+	case len(needLoader) > 0:
+		t.phase = v1alpha1.ClusterUpgradeLoading
+		t.message = fmt.Sprintf(
+			"Loading images, %d of %d nodes pending",
+			len(needLoader), len(t.nodes),
+		)
+	case len(deferred) > 0:
+		t.phase = v1alpha1.ClusterUpgradeLoading
+		t.message = fmt.Sprintf(
+			"Waiting for excluded nodes %s to be included again",
+			strings.Join(t.nodeNames(deferred), ", "),
+		)
+	default:
+		t.phase = v1alpha1.ClusterUpgradeUpgrading
+		t.message = "Upgrade has been requested"
+	}
+
+	// If the upgrade is paused then don't start new jobs and don't request the upgrade. The jobs
+	// that are already running will finish, and as the progress is stored in the labels of the
+	// nodes the upgrade will continue from where it was when it is resumed. This has no effect
+	// once the upgrade has been requested. The same happens when the upgrade is outside of its
+	// maintenance windows.
+	if (spec.Paused || t.outsideWindow) && !requested {
+		if t.phase == v1alpha1.ClusterUpgradeUpgrading {
+			t.phase = v1alpha1.ClusterUpgradeLoading
+			t.message = "Images have been loaded in all the nodes"
+		}
+		switch {
+		case spec.Paused:
+			t.logger.Info(
+				"Upgrade is paused, will not start new jobs",
+				"phase", t.phase,
+			)
+			t.message = fmt.Sprintf("Upgrade is paused: %s", t.message)
+		case t.nextWindow.IsZero():
+			t.logger.Info(
+				"Upgrade is outside of the maintenance windows and there are no "+
+					"more windows, will not start new jobs",
+				"phase", t.phase,
+			)
+			t.message = fmt.Sprintf(
+				"Upgrade is outside of the maintenance windows and there are no more "+
+					"windows: %s",
+				t.message,
+			)
+		default:
+			t.logger.Info(
+				"Upgrade is outside of the maintenance windows, will not start new "+
+					"jobs till the next window opens",
+				"phase", t.phase,
+				"next", t.nextWindow,
+			)
+			t.message = fmt.Sprintf(
+				"Upgrade is waiting for the maintenance window that opens at %s: %s",
+				t.nextWindow.UTC().Format(time.RFC3339), t.message,
+			)
+		}
+		return nil
+	}
+
+	// The machine config operator could reboot nodes while the bundle is being extracted or
+	// loaded, or, once the upgrade has been requested, it could update nodes that joined the
+	// cluster before they have the images. To avoid that the machine config pools of those nodes
+	// are paused till they have the images.
+	var staging []*corev1.Node
+	staging = append(staging, needExtractor...)
+	staging = append(staging, needLoader...)
+	err = t.syncMachineConfigPools(ctx, staging)
+	if err != nil {
+		return err
+	}
+
+	// If the number of nodes that can extract the bundle or load the images at the same time is
+	// limited then only some of the nodes that need it can start:
+	startExtractor, startLoader, err := t.limitConcurrency(ctx, needExtractor, needLoader)
+	if err != nil {
+		return err
+	}
+
+	// Nodes that download the bundle from an URL don't need the bundle server, the rest of the
+	// nodes get the bundle from the server:
+	var needDownload, needServer []*corev1.Node
+	for _, node := range startExtractor {
+		if t.nodeBundleURL(node) != "" {
+			needDownload = append(needDownload, node)
+		} else {
+			needServer = append(needServer, node)
+		}
+	}
+	serverNeeded := slices.ContainsFunc(needExtractor, func(node *corev1.Node) bool {
+		return t.nodeBundleURL(node) == ""
+	})
+
+	// If the bundle is downloaded from an URL then the bundle server isn't needed, we only need
+	// to start the bundle extractor job for each of the nodes that don't have it:
+	if len(needDownload) > 0 {
+		t.logger.Info(
+			"Some nodes don't have the bundle extracted yet, will start the bundle "+
+				"extractor for those nodes",
+			"nodes", t.nodeNames(needDownload),
+		)
+		err = t.startBundleExtractors(ctx, needDownload, bundleFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	// If there are nodes that need the bundle extracted from the bundle server then we need to
+	// start the bundle server daemon set and the bundle extractor job for each of those nodes.
+	if len(needServer) > 0 {
+		t.logger.Info(
+			"Some nodes don't have the bundle extracted yet, will start the bundle "+
+				"server and the bundle extractor for those nodes",
+			"nodes", t.nodeNames(needServer),
+		)
+		err = t.startBundleServer(ctx, bundleFile)
+		if err != nil {
+			return err
+		}
+
+		// Don't start the extractors till at least one of the bundle servers is ready,
+		// which means that it has the bundle file and that it has been validated:
+		ready, err := t.checkBundleServerReady(ctx)
+		if err != nil {
+			return err
+		}
+		if ready {
+			err = t.startBundleExtractors(ctx, needServer, bundleFile)
+			if err != nil {
+				return err
+			}
+		} else {
+			t.logger.Info(
+				"Bundle server isn't ready yet, will start the bundle extractors later",
+			)
+			t.requeue = true
+		}
+	}
+
+	// If all the nodes that use the bundle server have the bundle extracted already then we can
+	// stop it:
+	if !serverNeeded {
+		t.logger.Info(
+			"All nodes have the bundle extracted from the bundle server, will stop the " +
+				"bundle server",
+		)
 		err = t.stopBundleServer(ctx)
 		if err != nil {
 			return err
@@ -290,13 +1344,13 @@ func (t *controllerReconcileTask) execute(ctx context.Context) error {
 
 	// If there are nodes that need the bundle loaded then we need to start the bundle loader
 	// job for them:
-	if len(needLoader) > 0 {
+	if len(startLoader) > 0 {
 		t.logger.Info(
 			"Some nodes don't have the bundle loaded yet, will start the bundle "+
 				"loader for those nodes",
-			"nodes", t.nodeNames(needLoader),
+			"nodes", t.nodeNames(startLoader),
 		)
-		for _, node := range needLoader {
+		for _, node := range startLoader {
 			err = t.startBundleLoader(ctx, node)
 			if err != nil {
 				return err
@@ -305,7 +1359,7 @@ func (t *controllerReconcileTask) execute(ctx context.Context) error {
 	}
 
 	// If none of the nodes needs an action then we can request the upgrade:
-	if len(needNothing) == len(t.nodes) {
+	if len(needNothing) == len(t.nodes) && !requested {
 		t.logger.Info("All nodes are ready, will request the upgrade")
 		err = t.requestUpgrade(ctx)
 		if err != nil {
@@ -316,78 +1370,863 @@ func (t *controllerReconcileTask) execute(ctx context.Context) error {
 	return nil
 }
 
-func (t *controllerReconcileTask) startBundleServer(ctx context.Context, bundleFile string) error {
-	// Create the service account:
-	err := t.createPrivilegedServiceAccount(ctx, bundleServer)
-	if err != nil {
-		return err
+// checkPreflight runs the checks of the health of the cluster that need to pass before starting the
+// upgrade, and returns true if they passed or if they were skipped as requested in the spec. The
+// checks don't run again once they have passed for the current generation of the upgrade, as they
+// are relatively expensive.
+func (t *controllerReconcileTask) checkPreflight(ctx context.Context) (passed bool, err error) {
+	if t.upgrade.Spec.SkipPreflightChecks {
+		t.logger.Info("Preflight checks have been skipped as requested in the spec")
+		t.preflightSkipped = true
+		passed = true
+		return
+	}
+	condition := meta.FindStatusCondition(
+		t.upgrade.Status.Conditions,
+		v1alpha1.ClusterUpgradePreflightChecksPassed,
+	)
+	if condition != nil &&
+		condition.Status == metav1.ConditionTrue &&
+		condition.Reason == v1alpha1.ClusterUpgradePassedReason &&
+		condition.ObservedGeneration == t.upgrade.Generation {
+		passed = true
+		return
+	}
+	checker, err := NewPreflightChecker().
+		SetLogger(t.logger).
+		SetClient(t.preflightReader).
+		SetConfig(t.preflightConfig).
+		SetDiskSpace(t.preflightDisk).
+		Build()
+	if err != nil {
+		return
+	}
+	t.preflightReport, err = checker.Run(ctx)
+	if err != nil {
+		return
+	}
+	passed = t.preflightReport.Verdict == ReadinessGo
+	return
+}
+
+// preflightFailures returns a message containing the failed preflight checks.
+func (t *controllerReconcileTask) preflightFailures() string {
+	var messages []string
+	for _, check := range t.preflightReport.Checks {
+		if check.Status == ReadinessFail {
+			messages = append(messages, check.Message)
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// selectNodes removes from the list of nodes of the task the nodes that aren't selected by the node
+// selector of the rollout.
+func (t *controllerReconcileTask) selectNodes() error {
+	if t.upgrade.Spec.Rollout.NodeSelector == nil {
+		return nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(t.upgrade.Spec.Rollout.NodeSelector)
+	if err != nil {
+		return err
+	}
+	var selected []*corev1.Node
+	for _, node := range t.nodes {
+		if selector.Matches(k8slabels.Set(node.Labels)) {
+			selected = append(selected, node)
+		}
+	}
+	t.nodes = selected
+	return nil
+}
+
+func (t *controllerReconcileTask) startBundleExtractors(ctx context.Context,
+	nodes []*corev1.Node, bundleFile string) error {
+	// If replication is enabled then the replica nodes need to have the bundle before the rest
+	// of the nodes start to download it:
+	replicas := t.selectReplicas()
+	var pendingReplicas []*corev1.Node
+	for _, node := range replicas {
+		if slices.Contains(nodes, node) {
+			pendingReplicas = append(pendingReplicas, node)
+		}
+	}
+	if len(pendingReplicas) > 0 {
+		t.logger.Info(
+			"Some replica nodes don't have the bundle extracted yet, will start the "+
+				"bundle extractor only for those nodes",
+			"nodes", t.nodeNames(pendingReplicas),
+		)
+		nodes = pendingReplicas
+	}
+	for _, node := range nodes {
+		replica := slices.Contains(replicas, node)
+		err := t.startBundleExtractor(ctx, node, bundleFile, replica)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limitConcurrency returns the nodes that can start extracting the bundle and loading the images
+// without exceeding the maximum number of nodes that can do it at the same time. Nodes that have
+// already started are always returned, so that failed attempts can be retried. The rest of the
+// nodes are returned only if there are free slots, giving priority to the nodes that need to load
+// the images, as they are closer to complete, and then to the replicas, as the rest of the nodes
+// need them to get the bundle.
+func (t *controllerReconcileTask) limitConcurrency(ctx context.Context, needExtractor,
+	needLoader []*corev1.Node) (extractors, loaders []*corev1.Node, err error) {
+	limit, err := intstr.GetScaledValueFromIntOrPercent(&t.maxConcurrency, len(t.nodes), true)
+	if err != nil {
+		t.logger.Error(
+			err,
+			"Failed to calculate maximum concurrency, will not limit it",
+			"concurrency", t.maxConcurrency.String(),
+		)
+		limit = 0
+		err = nil
+	}
+	if limit <= 0 {
+		extractors = needExtractor
+		loaders = needLoader
+		return
+	}
+
+	// Find the jobs that have already been created:
+	jobs := map[string]*batchv1.Job{}
+	if !t.daemonSet {
+		list := &batchv1.JobList{}
+		err = t.client.List(ctx, list, clnt.InNamespace(t.namespace), clnt.HasLabels{labels.Job})
+		if err != nil {
+			return
+		}
+		for i := range list.Items {
+			jobs[list.Items[i].Name] = &list.Items[i]
+		}
+	}
+
+	// Count the nodes that are running and add the ones that have already started:
+	var waitingExtractor, waitingLoader []*corev1.Node
+	running := 0
+	for _, node := range needLoader {
+		started, active := t.nodeStarted(node, bundleLoader, jobs)
+		if started {
+			loaders = append(loaders, node)
+		} else {
+			waitingLoader = append(waitingLoader, node)
+		}
+		if active {
+			running++
+		}
+	}
+	for _, node := range needExtractor {
+		started, active := t.nodeStarted(node, bundleExtractor, jobs)
+		if started {
+			extractors = append(extractors, node)
+		} else {
+			waitingExtractor = append(waitingExtractor, node)
+		}
+		if active {
+			running++
+		}
+	}
+
+	// Fill the free slots:
+	replicas := t.selectReplicas()
+	slices.SortStableFunc(waitingExtractor, func(a, b *corev1.Node) bool {
+		return slices.Contains(replicas, a) && !slices.Contains(replicas, b)
+	})
+	waiting := 0
+	for _, node := range waitingLoader {
+		if running >= limit {
+			waiting++
+			continue
+		}
+		loaders = append(loaders, node)
+		running++
+	}
+	for _, node := range waitingExtractor {
+		if running >= limit {
+			waiting++
+			continue
+		}
+		extractors = append(extractors, node)
+		running++
+	}
+	if waiting > 0 {
+		t.logger.Info(
+			"Maximum concurrency reached, some nodes will start later",
+			"limit", limit,
+			"waiting", waiting,
+		)
+	}
+	return
+}
+
+// nodeStarted checks if the given program has already been started in the node, either creating
+// a job or requesting the command to the bundle agent, and if it is still running.
+func (t *controllerReconcileTask) nodeStarted(node *corev1.Node, program string,
+	jobs map[string]*batchv1.Job) (started, running bool) {
+	if t.daemonSet {
+		command := t.stringAnnotation(node, annotations.AgentCommand)
+		started = strings.HasPrefix(command, fmt.Sprintf("[%q", program))
+		running = started
+		return
+	}
+	job, ok := jobs[fmt.Sprintf("%s-%s", program, node.Name)]
+	if !ok {
+		return
+	}
+	started = true
+	running = job.Status.CompletionTime == nil && !slices.ContainsFunc(
+		job.Status.Conditions,
+		func(condition batchv1.JobCondition) bool {
+			return condition.Type == batchv1.JobFailed &&
+				condition.Status == corev1.ConditionTrue
+		},
+	)
+	return
+}
+
+// selectReplicas returns the nodes that will receive the bundle first and then serve it to the
+// rest of the nodes. The nodes are selected sorting them by name, so that the selection is the
+// same in all the reconciliation cycles. The nodes that download the bundle from an URL are never
+// replicas, as all of them can download it from there.
+func (t *controllerReconcileTask) selectReplicas() []*corev1.Node {
+	if t.replicas == 0 {
+		return nil
+	}
+	var nodes []*corev1.Node
+	for _, node := range t.nodes {
+		if t.nodeBundleURL(node) == "" {
+			nodes = append(nodes, node)
+		}
+	}
+	slices.SortFunc(nodes, func(a, b *corev1.Node) bool {
+		return a.Name < b.Name
+	})
+	if len(nodes) > t.replicas {
+		nodes = nodes[:t.replicas]
+	}
+	return nodes
+}
+
+// nodeArchBundle returns the architecture specific bundle that matches the architecture of the
+// given node, or nil if the node uses the main bundle.
+func (t *controllerReconcileTask) nodeArchBundle(
+	node *corev1.Node) *v1alpha1.ClusterUpgradeArchBundle {
+	arch := distributionOSArch(node.Status.NodeInfo.Architecture)
+	if arch == "" {
+		return nil
+	}
+	for i, bundle := range t.archBundles {
+		if distributionOSArch(bundle.Arch) == arch {
+			return &t.archBundles[i]
+		}
+	}
+	return nil
+}
+
+// nodeBundleURL returns the URL where the given node should download the bundle from, or an empty
+// string if it should get it from the bundle server.
+func (t *controllerReconcileTask) nodeBundleURL(node *corev1.Node) string {
+	bundle := t.nodeArchBundle(node)
+	if bundle != nil {
+		return bundle.URL
+	}
+	return t.bundleURL
+}
+
+// splitBatches splits the nodes in the batches described in the rollout of the upgrade. The nodes
+// are sorted by name, so that the batches are the same in all the reconciliation cycles. The nodes
+// that aren't part of any of the batches of the spec are added as an additional last batch.
+func (t *controllerReconcileTask) splitBatches() (result [][]*corev1.Node, err error) {
+	nodes := slices.Clone(t.nodes)
+	slices.SortFunc(nodes, func(a, b *corev1.Node) bool {
+		return a.Name < b.Name
+	})
+	for _, batch := range t.upgrade.Spec.Rollout.Batches {
+		if len(nodes) == 0 {
+			break
+		}
+		var size int
+		size, err = intstr.GetScaledValueFromIntOrPercent(&batch, len(t.nodes), true)
+		if err != nil {
+			return
+		}
+		if size < 1 {
+			err = fmt.Errorf(
+				"batch size '%s' isn't valid, it must be greater than zero",
+				batch.String(),
+			)
+			return
+		}
+		if size > len(nodes) {
+			size = len(nodes)
+		}
+		result = append(result, nodes[:size])
+		nodes = nodes[size:]
+	}
+	if len(nodes) > 0 {
+		result = append(result, nodes)
+	}
+	return
+}
+
+// selectBatch finds the first batch that contains nodes that don't have the images loaded yet,
+// and returns the nodes of that batch that can start loading them. If some of the nodes of the
+// previous batches aren't healthy then no node can start loading the images, and those unhealthy
+// nodes are returned instead. Excluded nodes are ignored, so that they don't block the rest.
+func (t *controllerReconcileTask) selectBatch(batches [][]*corev1.Node,
+	needLoader []*corev1.Node) (selected, unhealthy []*corev1.Node) {
+	t.batches = len(batches)
+	for i, batch := range batches {
+		pending := slices.ContainsFunc(batch, func(node *corev1.Node) bool {
+			return !t.boolLabel(node, labels.BundleLoaded) && !t.nodeExcluded(node)
+		})
+		if !pending {
+			for _, node := range batch {
+				if !t.nodeHealthy(node) && !t.nodeExcluded(node) {
+					unhealthy = append(unhealthy, node)
+				}
+			}
+			continue
+		}
+		t.batch = i + 1
+		if len(unhealthy) > 0 {
+			t.logger.Info(
+				"Some nodes of previous batches aren't healthy, will not load images "+
+					"in the next batch",
+				"batch", t.batch,
+				"unhealthy", t.nodeNames(unhealthy),
+			)
+			return
+		}
+		for _, node := range needLoader {
+			if slices.Contains(batch, node) {
+				selected = append(selected, node)
+			}
+		}
+		return
+	}
+
+	// All the batches have the images loaded, so there is nothing to wait for:
+	unhealthy = nil
+	return
+}
+
+// nodeExcluded checks if the node is in the list of nodes excluded from the rollout.
+func (t *controllerReconcileTask) nodeExcluded(node *corev1.Node) bool {
+	return slices.Contains(t.upgrade.Spec.Rollout.ExcludedNodes, node.Name)
+}
+
+// nodeHealthy checks if the node is ready and doesn't report errors.
+func (t *controllerReconcileTask) nodeHealthy(node *corev1.Node) bool {
+	if t.stringAnnotation(node, annotations.Error) != "" {
+		return false
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func (t *controllerReconcileTask) startBundleServer(ctx context.Context, bundleFile string) error {
+	// Create the service account:
+	err := t.createPrivilegedServiceAccount(ctx, bundleServer)
+	if err != nil {
+		return err
+	}
+
+	// Create the secret containing the token that the extractors will use to authenticate:
+	err = t.createBundleServerToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Create the service:
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: t.namespace,
+			Name:      bundleServer,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:      corev1.ServiceTypeClusterIP,
+			ClusterIP: corev1.ClusterIPNone,
+			Selector: map[string]string{
+				labels.App: bundleServer,
+			},
+			Ports: []corev1.ServicePort{{
+				Name:       "http",
+				Protocol:   corev1.ProtocolTCP,
+				Port:       8080,
+				TargetPort: intstr.FromInt(8080),
+			}},
+		},
+	}
+	err = t.client.Create(ctx, service)
+	switch {
+	case err == nil:
+		t.logger.Info(
+			"Created bundle server service",
+			"service", service.Name,
+		)
+	case apierrors.IsAlreadyExists(err):
+		t.logger.V(2).Info(
+			"Bundle server service already exists",
+			"service", service.Name,
+		)
+	default:
+		t.logger.Error(
+			err,
+			"Failed to create bundle server service",
+			"daemonset", service.Name,
+		)
+		return err
+	}
+
+	// Create the daemon set:
+	daemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: t.namespace,
+			Name:      bundleServer,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					labels.App: bundleServer,
+				},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						labels.App: bundleServer,
+					},
+				},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: bundleServer,
+					TerminationGracePeriodSeconds: pointer.Int64(
+						int64((controllerDrainTimeout + time.Minute).Seconds()),
+					),
+					Volumes: []corev1.Volume{
+						t.makeHostVolume(),
+						t.makeTokenVolume(),
+					},
+					Containers: []corev1.Container{{
+						Name:            bundleServer,
+						Image:           controllerImage,
+						ImagePullPolicy: controllerImagePullPolicy,
+						SecurityContext: &corev1.SecurityContext{
+							Privileged: pointer.Bool(true),
+							RunAsUser:  pointer.Int64(0),
+						},
+						VolumeMounts: []corev1.VolumeMount{
+							t.makeHostMount(),
+							t.makeTokenMount(),
+						},
+						LivenessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								HTTPGet: &corev1.HTTPGetAction{
+									Path: "/healthz",
+									Port: intstr.FromInt(8080),
+								},
+							},
+						},
+						ReadinessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								HTTPGet: &corev1.HTTPGetAction{
+									Path: "/readyz",
+									Port: intstr.FromInt(8080),
+								},
+							},
+							PeriodSeconds: 10,
+						},
+						Command: []string{
+							"/usr/bin/upgrade-tool",
+							"start",
+							"bundle-server",
+							"--log-file=stdout",
+							fmt.Sprintf("--log-level=%d", t.nodeLogLevel),
+							"--mute=true",
+							fmt.Sprintf(
+								"--root=%s",
+								controllerHostVolumeMountPath,
+							),
+							fmt.Sprintf(
+								"--bundle-file=%s",
+								bundleFile,
+							),
+							fmt.Sprintf(
+								"--bundle-dir=%s",
+								t.bundleDir,
+							),
+							fmt.Sprintf(
+								"--replica-file=%s.tar",
+								controllerBundleDir,
+							),
+							"--listen-addr=:8080",
+							fmt.Sprintf(
+								"--drain-timeout=%s",
+								controllerDrainTimeout,
+							),
+							fmt.Sprintf(
+								"--token-file=%s/%s",
+								controllerTokenVolumeMountPath,
+								controllerTokenKey,
+							),
+						},
+					}},
+					Tolerations: t.makeTolerations(),
+				},
+			},
+		},
+	}
+	err = t.client.Create(ctx, daemonSet)
+	switch {
+	case err == nil:
+		t.logger.Info(
+			"Created bundle server daemon set",
+			"daemonset", daemonSet.Name,
+		)
+	case apierrors.IsAlreadyExists(err):
+		t.logger.V(2).Info(
+			"Bundle server daemon set already exists",
+			"daemonset", daemonSet.Name,
+		)
+	default:
+		t.logger.Error(
+			err,
+			"Failed to create bundle server daemon set",
+			"daemonset", daemonSet.Name,
+		)
+		return err
+	}
+
+	return nil
+}
+
+// checkBundleServerReady checks if at least one of the pods of the bundle server daemon set is
+// ready.
+func (t *controllerReconcileTask) checkBundleServerReady(ctx context.Context) (ready bool,
+	err error) {
+	daemonSet := &appsv1.DaemonSet{}
+	key := clnt.ObjectKey{
+		Namespace: t.namespace,
+		Name:      bundleServer,
+	}
+	err = t.client.Get(ctx, key, daemonSet)
+	if apierrors.IsNotFound(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	ready = daemonSet.Status.NumberReady > 0
+	return
+}
+
+func (t *controllerReconcileTask) stopBundleServer(ctx context.Context) error {
+	// Delete the service:
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: t.namespace,
+			Name:      bundleServer,
+		},
+	}
+	err := t.client.Delete(ctx, service)
+	switch {
+	case err == nil:
+		t.logger.Info(
+			"Deleted bundle server service",
+			"service", service.Name,
+		)
+	case apierrors.IsNotFound(err):
+		t.logger.V(2).Info(
+			"Bundle server service doesn't exist",
+			"service", service.Name,
+		)
+	default:
+		t.logger.Error(
+			err,
+			"Failed to create bundle server service",
+			"daemonset", service.Name,
+		)
+		return err
+	}
+
+	// Delete the daemon set:
+	daemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: t.namespace,
+			Name:      bundleServer,
+		},
+	}
+	err = t.client.Delete(ctx, daemonSet)
+	switch {
+	case err == nil:
+		t.logger.Info(
+			"Deleted bundle server daemon set",
+			"daemonset", daemonSet.Name,
+		)
+	case apierrors.IsNotFound(err):
+		t.logger.V(2).Info(
+			"Bundle server daemon set doesn't exist",
+			"daemonset", daemonSet.Name,
+		)
+	default:
+		t.logger.Error(
+			err,
+			"Failed to deleted bundle server daemon set",
+			"daemonset", daemonSet.Name,
+		)
+		return err
+	}
+
+	// Delete the token:
+	err = t.deleteBundleServerToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Delete the service account:
+	err = t.deletePrivilegedServiceAccount(ctx, bundleServer)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *controllerReconcileTask) startBundleExtractor(ctx context.Context, node *corev1.Node,
+	bundleFile string, replica bool) error {
+	// Nodes with an architecture specific bundle download it from its URL, the rest use the
+	// main bundle:
+	bundleURL := t.bundleURL
+	bundleDigest := t.bundleDigest
+	archBundle := t.nodeArchBundle(node)
+	if archBundle != nil {
+		bundleURL = archBundle.URL
+		bundleDigest = archBundle.Digest
 	}
 
-	// Create the service:
-	service := &corev1.Service{
+	// Prepare the volumes and the command line, which depend on where the extractor will
+	// download the bundle from: the URL if it has been specified, or else the bundle server.
+	volumes := []corev1.Volume{
+		t.makeHostVolume(),
+	}
+	mounts := []corev1.VolumeMount{
+		t.makeHostMount(),
+	}
+	command := []string{
+		"/bin/upgrade-tool",
+		"start",
+		"bundle-extractor",
+		"--log-file=stdout",
+		fmt.Sprintf("--log-level=%d", t.nodeLogLevel),
+		"--mute=true",
+		fmt.Sprintf(
+			"--node=%s",
+			node.Name,
+		),
+		fmt.Sprintf(
+			"--namespace=%s",
+			t.namespace,
+		),
+		fmt.Sprintf(
+			"--root=%s",
+			controllerHostVolumeMountPath,
+		),
+		fmt.Sprintf(
+			"--bundle-file=%s",
+			bundleFile,
+		),
+		fmt.Sprintf(
+			"--bundle-version=%s",
+			t.bundleVersion,
+		),
+		fmt.Sprintf(
+			"--bundle-digest=%s",
+			bundleDigest,
+		),
+		"--bundle-dir=/var/lib/upgrade",
+		fmt.Sprintf(
+			"--streaming=%t",
+			t.streaming,
+		),
+	}
+
+	// Ask the extractor to check that the bundle has the version that was requested and the
+	// architecture of the node, so that the wrong bundle isn't extracted by accident:
+	if t.expectedVersion != "" {
+		command = append(
+			command,
+			fmt.Sprintf(
+				"--expected-version=%s",
+				t.expectedVersion,
+			),
+		)
+	}
+	if node.Status.NodeInfo.Architecture != "" {
+		command = append(
+			command,
+			fmt.Sprintf(
+				"--expected-arch=%s",
+				node.Status.NodeInfo.Architecture,
+			),
+		)
+	}
+	if bundleURL != "" {
+		command = append(
+			command,
+			fmt.Sprintf(
+				"--bundle-url=%s",
+				bundleURL,
+			),
+		)
+		if t.bundleURLSecret != "" {
+			volumes = append(volumes, t.makeCredentialsVolume())
+			mounts = append(mounts, t.makeCredentialsMount())
+			command = append(
+				command,
+				fmt.Sprintf(
+					"--s3-credentials-dir=%s",
+					controllerCredentialsVolumeMountPath,
+				),
+			)
+		}
+	} else {
+		volumes = append(volumes, t.makeTokenVolume())
+		mounts = append(mounts, t.makeTokenMount())
+		command = append(
+			command,
+			fmt.Sprintf(
+				"--bundle-server=bundle-server.%s.svc.cluster.local:8080",
+				t.namespace,
+			),
+			fmt.Sprintf(
+				"--replicate=%t",
+				replica,
+			),
+			fmt.Sprintf(
+				"--token-file=%s/%s",
+				controllerTokenVolumeMountPath,
+				controllerTokenKey,
+			),
+		)
+
+		// When the bundle server has multiple bundles select the one that has the
+		// architecture of the node, as the cluster may have nodes with different
+		// architectures:
+		bundleArch := distributionTagArch(node.Status.NodeInfo.Architecture)
+		if t.bundleVersion != "" && bundleArch != "" {
+			command = append(
+				command,
+				fmt.Sprintf(
+					"--bundle-arch=%s",
+					bundleArch,
+				),
+			)
+		}
+	}
+
+	// Create the extractor job:
+	extractorJob := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: t.namespace,
-			Name:      bundleServer,
+			Name:      fmt.Sprintf("%s-%s", bundleExtractor, node.Name),
+			Labels: map[string]string{
+				labels.Job: bundleExtractor,
+			},
 		},
-		Spec: corev1.ServiceSpec{
-			Type:      corev1.ServiceTypeClusterIP,
-			ClusterIP: corev1.ClusterIPNone,
-			Selector: map[string]string{
-				labels.App: bundleServer,
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					NodeName:           node.Name,
+					ServiceAccountName: bundleExtractor,
+					Volumes:            volumes,
+					Containers: []corev1.Container{{
+						Name:            bundleExtractor,
+						Image:           controllerImage,
+						ImagePullPolicy: controllerImagePullPolicy,
+						SecurityContext: &corev1.SecurityContext{
+							Privileged: pointer.Bool(true),
+							RunAsUser:  pointer.Int64(0),
+						},
+						VolumeMounts: mounts,
+						Command:      command,
+					}},
+					Tolerations:   t.makeTolerations(),
+					RestartPolicy: corev1.RestartPolicyOnFailure,
+				},
 			},
-			Ports: []corev1.ServicePort{{
-				Protocol:   corev1.ProtocolTCP,
-				Port:       8080,
-				TargetPort: intstr.FromInt(8080),
-			}},
 		},
 	}
-	err = t.client.Create(ctx, service)
+
+	// In daemon set mode the command is executed by the bundle agent instead of by a job:
+	if t.daemonSet {
+		return t.requestAgentCommand(ctx, node, extractorJob)
+	}
+
+	// Create the service account:
+	err := t.createPrivilegedServiceAccount(ctx, bundleExtractor)
+	if err != nil {
+		return err
+	}
+	create, err := t.retryJob(ctx, node, extractorJob, annotations.ExtractorRetries)
+	if err != nil || !create {
+		return err
+	}
+	err = t.client.Create(ctx, extractorJob)
 	switch {
 	case err == nil:
 		t.logger.Info(
-			"Created bundle server service",
-			"service", service.Name,
+			"Created bundle extractor",
+			"node", node.Name,
+			"job", extractorJob.Name,
 		)
 	case apierrors.IsAlreadyExists(err):
 		t.logger.V(2).Info(
-			"Bundle server service already exists",
-			"service", service.Name,
+			"Bundle extractor already exists",
+			"node", node.Name,
+			"name", extractorJob.Name,
 		)
 	default:
 		t.logger.Error(
 			err,
-			"Failed to create bundle server service",
-			"daemonset", service.Name,
+			"Failed to create bundle extractor",
+			"node", node.Name,
+			"job", extractorJob.Name,
 		)
 		return err
 	}
+	return nil
+}
 
-	// Create the daemon set:
-	daemonSet := &appsv1.DaemonSet{
+func (t *controllerReconcileTask) startBundleLoader(ctx context.Context, node *corev1.Node) error {
+	// Create the loader job:
+	loaderJob := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: t.namespace,
-			Name:      bundleServer,
-		},
-		Spec: appsv1.DaemonSetSpec{
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					labels.App: bundleServer,
-				},
+			Name:      fmt.Sprintf("%s-%s", bundleLoader, node.Name),
+			Labels: map[string]string{
+				labels.Job: bundleLoader,
 			},
+		},
+		Spec: batchv1.JobSpec{
 			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						labels.App: bundleServer,
-					},
-				},
 				Spec: corev1.PodSpec{
-					ServiceAccountName: bundleServer,
+					NodeName:           node.Name,
+					ServiceAccountName: bundleLoader,
 					Volumes: []corev1.Volume{
 						t.makeHostVolume(),
 					},
+					HostNetwork: true,
 					Containers: []corev1.Container{{
-						Name:            bundleServer,
+						Name:            bundleLoader,
 						Image:           controllerImage,
 						ImagePullPolicy: controllerImagePullPolicy,
 						SecurityContext: &corev1.SecurityContext{
@@ -398,45 +2237,162 @@ func (t *controllerReconcileTask) startBundleServer(ctx context.Context, bundleF
 							t.makeHostMount(),
 						},
 						Command: []string{
-							"/usr/bin/upgrade-tool",
+							"/bin/upgrade-tool",
 							"start",
-							"bundle-server",
+							"bundle-loader",
 							"--log-file=stdout",
-							"--log-level=1",
+							fmt.Sprintf("--log-level=%d", t.nodeLogLevel),
 							"--mute=true",
 							fmt.Sprintf(
-								"--root=%s",
-								controllerHostVolumeMountPath,
+								"--node=%s",
+								node.Name,
 							),
 							fmt.Sprintf(
-								"--bundle-file=%s",
-								bundleFile,
+								"--namespace=%s",
+								t.namespace,
 							),
-							"--listen-addr=:8080",
+							fmt.Sprintf(
+								"--root=%s",
+								controllerHostVolumeMountPath,
+							),
+							"--bundle-dir=/var/lib/upgrade",
 						},
 					}},
-					Tolerations: t.makeTolerations(),
+					Tolerations:   t.makeTolerations(),
+					RestartPolicy: corev1.RestartPolicyOnFailure,
 				},
 			},
 		},
 	}
-	err = t.client.Create(ctx, daemonSet)
+	loaderContainer := &loaderJob.Spec.Template.Spec.Containers[0]
+	pullOrder := t.stringAnnotation(t.version, annotations.PullOrder)
+	if t.upgrade != nil && t.upgrade.Spec.PullOrder != "" {
+		pullOrder = t.upgrade.Spec.PullOrder
+	}
+	if pullOrder != "" {
+		loaderContainer.Command = append(
+			loaderContainer.Command,
+			fmt.Sprintf("--pull-order=%s", pullOrder),
+		)
+	}
+	pullPriority := t.stringAnnotation(t.version, annotations.PullPriority)
+	if pullPriority != "" {
+		loaderContainer.Command = append(
+			loaderContainer.Command,
+			fmt.Sprintf("--pull-priority=%s", pullPriority),
+		)
+	}
+	pullConcurrency := t.stringAnnotation(t.version, annotations.PullConcurrency)
+	if pullConcurrency != "" {
+		loaderContainer.Command = append(
+			loaderContainer.Command,
+			fmt.Sprintf("--pull-concurrency=%s", pullConcurrency),
+		)
+	}
+	pullTimeout := t.stringAnnotation(t.version, annotations.PullTimeout)
+	if pullTimeout != "" {
+		loaderContainer.Command = append(
+			loaderContainer.Command,
+			fmt.Sprintf("--pull-timeout=%s", pullTimeout),
+		)
+	}
+	pullAttempts := t.stringAnnotation(t.version, annotations.PullAttempts)
+	if pullAttempts != "" {
+		loaderContainer.Command = append(
+			loaderContainer.Command,
+			fmt.Sprintf("--pull-attempts=%s", pullAttempts),
+		)
+	}
+	loadTimeout := t.stringAnnotation(t.version, annotations.LoadTimeout)
+	if loadTimeout != "" {
+		loaderContainer.Command = append(
+			loaderContainer.Command,
+			fmt.Sprintf("--load-timeout=%s", loadTimeout),
+		)
+	}
+	loadMode := t.stringAnnotation(t.version, annotations.LoadMode)
+	if loadMode != "" {
+		loaderContainer.Command = append(
+			loaderContainer.Command,
+			fmt.Sprintf("--load-mode=%s", loadMode),
+		)
+	}
+	if t.boolAnnotation(t.version, annotations.KeepBundle) {
+		loaderContainer.Command = append(
+			loaderContainer.Command,
+			"--keep-bundle=true",
+		)
+	}
+	if t.boolAnnotation(t.version, annotations.RoleFilter) {
+		loaderContainer.Command = append(
+			loaderContainer.Command,
+			"--role-filter=true",
+		)
+	}
+	metricsFile := t.stringAnnotation(t.version, annotations.LoaderMetricsFile)
+	if metricsFile != "" {
+		loaderContainer.Command = append(
+			loaderContainer.Command,
+			fmt.Sprintf("--metrics-file=%s", metricsFile),
+		)
+	}
+	registryMetrics := t.stringAnnotation(t.version, annotations.RegistryMetricsAddress)
+	if registryMetrics != "" {
+		loaderContainer.Command = append(
+			loaderContainer.Command,
+			fmt.Sprintf("--registry-metrics-address=%s", registryMetrics),
+		)
+	}
+	registryCertSecret := t.stringAnnotation(t.version, annotations.RegistryCertSecret)
+	if registryCertSecret != "" {
+		loaderJob.Spec.Template.Spec.Volumes = append(
+			loaderJob.Spec.Template.Spec.Volumes,
+			t.makeRegistryCertVolume(registryCertSecret),
+		)
+		loaderContainer.VolumeMounts = append(
+			loaderContainer.VolumeMounts,
+			t.makeRegistryCertMount(),
+		)
+		loaderContainer.Command = append(
+			loaderContainer.Command,
+			fmt.Sprintf("--registry-cert-dir=%s", controllerRegistryCertVolumeMountPath),
+		)
+	}
+
+	// In daemon set mode the command is executed by the bundle agent instead of by a job:
+	if t.daemonSet {
+		return t.requestAgentCommand(ctx, node, loaderJob)
+	}
+
+	// Create the service account:
+	err := t.createPrivilegedServiceAccount(ctx, bundleLoader)
+	if err != nil {
+		return err
+	}
+	create, err := t.retryJob(ctx, node, loaderJob, annotations.LoaderRetries)
+	if err != nil || !create {
+		return err
+	}
+	err = t.client.Create(ctx, loaderJob)
 	switch {
 	case err == nil:
 		t.logger.Info(
-			"Created bundle server daemon set",
-			"daemonset", daemonSet.Name,
+			"Created bundle loader",
+			"node", node.Name,
+			"job", loaderJob.Name,
 		)
 	case apierrors.IsAlreadyExists(err):
 		t.logger.V(2).Info(
-			"Bundle server daemon set already exists",
-			"daemonset", daemonSet.Name,
+			"Bundle loader already exists",
+			"node", node.Name,
+			"name", loaderJob.Name,
 		)
 	default:
 		t.logger.Error(
 			err,
-			"Failed to create bundle server daemon set",
-			"daemonset", daemonSet.Name,
+			"Failed to create bundle loader",
+			"node", node.Name,
+			"job", loaderJob.Name,
 		)
 		return err
 	}
@@ -444,193 +2400,379 @@ func (t *controllerReconcileTask) startBundleServer(ctx context.Context, bundleF
 	return nil
 }
 
-func (t *controllerReconcileTask) stopBundleServer(ctx context.Context) error {
-	// Delete the service:
-	service := &corev1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: t.namespace,
-			Name:      bundleServer,
-		},
+// requestAgentCommand asks the bundle agent running in the node to execute the command of the
+// given job, writing it to the agent command annotation of the node. The volumes that the job
+// needs are added to the bundle agent daemon set if it doesn't have them already.
+func (t *controllerReconcileTask) requestAgentCommand(ctx context.Context, node *corev1.Node,
+	job *batchv1.Job) error {
+	// Make sure that the agent is running and has the needed volumes:
+	err := t.startBundleAgent(ctx, &job.Spec.Template.Spec)
+	if err != nil {
+		return err
 	}
-	err := t.client.Delete(ctx, service)
-	switch {
-	case err == nil:
-		t.logger.Info(
-			"Deleted bundle server service",
-			"service", service.Name,
-		)
-	case apierrors.IsNotFound(err):
+
+	// The first two arguments of the command are the executable and the 'start' command, the
+	// agent only needs the rest:
+	command := job.Spec.Template.Spec.Containers[0].Command
+	data, err := json.Marshal(command[2:])
+	if err != nil {
+		return err
+	}
+	value := string(data)
+	if t.stringAnnotation(node, annotations.AgentCommand) == value {
 		t.logger.V(2).Info(
-			"Bundle server service doesn't exist",
-			"service", service.Name,
+			"Bundle agent command has already been requested",
+			"node", node.Name,
+			"program", command[2],
 		)
-	default:
+		return nil
+	}
+	update := node.DeepCopy()
+	if update.Annotations == nil {
+		update.Annotations = map[string]string{}
+	}
+	update.Annotations[annotations.AgentCommand] = value
+	err = t.client.Patch(ctx, update, clnt.MergeFrom(node))
+	if err != nil {
 		t.logger.Error(
 			err,
-			"Failed to create bundle server service",
-			"daemonset", service.Name,
+			"Failed to request bundle agent command",
+			"node", node.Name,
+			"program", command[2],
 		)
 		return err
 	}
+	t.logger.Info(
+		"Requested bundle agent command",
+		"node", node.Name,
+		"program", command[2],
+	)
+	return nil
+}
 
-	// Delete the daemon set:
-	daemonSet := &appsv1.DaemonSet{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: t.namespace,
-			Name:      bundleServer,
-		},
+// startBundleAgent creates the bundle agent daemon set if it doesn't exist yet, and updates it if
+// it doesn't have the volumes used by the given pod or if its command has changed.
+func (t *controllerReconcileTask) startBundleAgent(ctx context.Context,
+	pod *corev1.PodSpec) error {
+	// Create the service account:
+	err := t.createPrivilegedServiceAccount(ctx, bundleAgent)
+	if err != nil {
+		return err
 	}
-	err = t.client.Delete(ctx, daemonSet)
+
+	// Fetch the current daemon set:
+	daemonSet := &appsv1.DaemonSet{}
+	key := clnt.ObjectKey{
+		Namespace: t.namespace,
+		Name:      bundleAgent,
+	}
+	err = t.client.Get(ctx, key, daemonSet)
 	switch {
 	case err == nil:
+	case apierrors.IsNotFound(err):
+		daemonSet = t.makeBundleAgent()
+	default:
+		return err
+	}
+	exists := daemonSet.ResourceVersion != ""
+
+	// Update the command, as the number of retries may have changed:
+	agentSpec := &daemonSet.Spec.Template.Spec
+	agentContainer := &agentSpec.Containers[0]
+	changed := false
+	command := t.makeBundleAgent().Spec.Template.Spec.Containers[0].Command
+	if !slices.Equal(agentContainer.Command, command) {
+		agentContainer.Command = command
+		changed = true
+	}
+
+	// Add the volumes and mounts used by the pod. The secrets are optional because the agent
+	// can run without them till a command needs them.
+	for _, volume := range pod.Volumes {
+		volume = *volume.DeepCopy()
+		if volume.Secret != nil {
+			volume.Secret.Optional = pointer.Bool(true)
+		}
+		index := slices.IndexFunc(agentSpec.Volumes, func(v corev1.Volume) bool {
+			return v.Name == volume.Name
+		})
+		switch {
+		case index == -1:
+			agentSpec.Volumes = append(agentSpec.Volumes, volume)
+			changed = true
+		case !equality.Semantic.DeepEqual(agentSpec.Volumes[index], volume):
+			agentSpec.Volumes[index] = volume
+			changed = true
+		}
+	}
+	for _, mount := range pod.Containers[0].VolumeMounts {
+		index := slices.IndexFunc(agentContainer.VolumeMounts, func(m corev1.VolumeMount) bool {
+			return m.Name == mount.Name
+		})
+		switch {
+		case index == -1:
+			agentContainer.VolumeMounts = append(agentContainer.VolumeMounts, mount)
+			changed = true
+		case !equality.Semantic.DeepEqual(agentContainer.VolumeMounts[index], mount):
+			agentContainer.VolumeMounts[index] = mount
+			changed = true
+		}
+	}
+
+	// Create or update the daemon set:
+	switch {
+	case !exists:
+		err = t.client.Create(ctx, daemonSet)
+		if err != nil {
+			t.logger.Error(
+				err,
+				"Failed to create bundle agent daemon set",
+				"daemonset", daemonSet.Name,
+			)
+			return err
+		}
 		t.logger.Info(
-			"Deleted bundle server daemon set",
+			"Created bundle agent daemon set",
 			"daemonset", daemonSet.Name,
 		)
-	case apierrors.IsNotFound(err):
-		t.logger.V(2).Info(
-			"Bundle server daemon set doesn't exist",
+	case changed:
+		err = t.client.Update(ctx, daemonSet)
+		if err != nil {
+			t.logger.Error(
+				err,
+				"Failed to update bundle agent daemon set",
+				"daemonset", daemonSet.Name,
+			)
+			return err
+		}
+		t.logger.Info(
+			"Updated bundle agent daemon set",
 			"daemonset", daemonSet.Name,
 		)
 	default:
-		t.logger.Error(
-			err,
-			"Failed to deleted bundle server daemon set",
+		t.logger.V(2).Info(
+			"Bundle agent daemon set is up to date",
 			"daemonset", daemonSet.Name,
 		)
-		return err
-	}
-
-	// Delete the service account:
-	err = t.deletePrivilegedServiceAccount(ctx, bundleServer)
-	if err != nil {
-		return err
 	}
-
 	return nil
 }
 
-func (t *controllerReconcileTask) startBundleExtractor(ctx context.Context, node *corev1.Node,
-	bundleFile string) error {
-	// Create the service account:
-	err := t.createPrivilegedServiceAccount(ctx, bundleExtractor)
-	if err != nil {
-		return err
-	}
-
-	// Create the extractor job:
-	extractorJob := &batchv1.Job{
+// makeBundleAgent creates the bundle agent daemon set, initially only with the host volume.
+func (t *controllerReconcileTask) makeBundleAgent() *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: t.namespace,
-			Name:      fmt.Sprintf("%s-%s", bundleExtractor, node.Name),
-			Labels: map[string]string{
-				labels.Job: bundleExtractor,
-			},
+			Name:      bundleAgent,
 		},
-		Spec: batchv1.JobSpec{
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					labels.App: bundleAgent,
+				},
+			},
 			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						labels.App: bundleAgent,
+					},
+				},
 				Spec: corev1.PodSpec{
-					NodeName:           node.Name,
-					ServiceAccountName: bundleExtractor,
+					ServiceAccountName: bundleAgent,
+					HostNetwork:        true,
 					Volumes: []corev1.Volume{
 						t.makeHostVolume(),
 					},
 					Containers: []corev1.Container{{
-						Name:            bundleExtractor,
+						Name:            bundleAgent,
 						Image:           controllerImage,
 						ImagePullPolicy: controllerImagePullPolicy,
 						SecurityContext: &corev1.SecurityContext{
 							Privileged: pointer.Bool(true),
 							RunAsUser:  pointer.Int64(0),
 						},
+						Env: []corev1.EnvVar{{
+							Name: "NODE_NAME",
+							ValueFrom: &corev1.EnvVarSource{
+								FieldRef: &corev1.ObjectFieldSelector{
+									FieldPath: "spec.nodeName",
+								},
+							},
+						}},
 						VolumeMounts: []corev1.VolumeMount{
 							t.makeHostMount(),
 						},
 						Command: []string{
 							"/bin/upgrade-tool",
 							"start",
-							"bundle-extractor",
+							"bundle-agent",
 							"--log-file=stdout",
-							"--log-level=1",
-							"--mute=true",
-							fmt.Sprintf(
-								"--node=%s",
-								node.Name,
-							),
-							fmt.Sprintf(
-								"--root=%s",
-								controllerHostVolumeMountPath,
-							),
-							fmt.Sprintf(
-								"--bundle-file=%s",
-								bundleFile,
-							),
-							"--bundle-dir=/var/lib/upgrade",
+							fmt.Sprintf("--log-level=%d", t.nodeLogLevel),
+							"--node=$(NODE_NAME)",
 							fmt.Sprintf(
-								"--bundle-server=bundle-server.%s.svc.cluster.local:8080",
-								t.namespace,
+								"--retries=%d",
+								t.jobRetries,
 							),
 						},
 					}},
-					Tolerations:   t.makeTolerations(),
-					RestartPolicy: corev1.RestartPolicyOnFailure,
+					Tolerations: t.makeTolerations(),
 				},
 			},
 		},
 	}
-	err = t.client.Create(ctx, extractorJob)
-	switch {
-	case err == nil:
-		t.logger.Info(
-			"Created bundle extractor",
+}
+
+// retryJob checks if the given job needs to be created. It does if it doesn't exist yet. If it
+// exists and has failed it is deleted, so that it will be created again in a later reconciliation
+// cycle, but only after an exponential backoff delay and if the number of retries, stored in the
+// given annotation of the node, hasn't reached the limit.
+func (t *controllerReconcileTask) retryJob(ctx context.Context, node *corev1.Node,
+	job *batchv1.Job, annotation string) (create bool, err error) {
+	existing := &batchv1.Job{}
+	err = t.client.Get(ctx, clnt.ObjectKeyFromObject(job), existing)
+	if apierrors.IsNotFound(err) {
+		create = true
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	// Wait till the previous attempt has been completely deleted:
+	if existing.DeletionTimestamp != nil {
+		t.logger.V(1).Info(
+			"Waiting for failed job to be deleted",
 			"node", node.Name,
-			"job", extractorJob.Name,
+			"job", existing.Name,
 		)
-	case apierrors.IsAlreadyExists(err):
+		t.requeue = true
+		return
+	}
+
+	// Nothing to do if the job hasn't failed:
+	var failed *batchv1.JobCondition
+	for i, condition := range existing.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			failed = &existing.Status.Conditions[i]
+			break
+		}
+	}
+	if failed == nil {
 		t.logger.V(2).Info(
-			"Bundle extractor already exists",
+			"Job already exists",
 			"node", node.Name,
-			"name", extractorJob.Name,
+			"job", existing.Name,
 		)
-	default:
-		t.logger.Error(
-			err,
-			"Failed to create bundle extractor",
+		return
+	}
+
+	// Check if there are retries left:
+	retries := 0
+	text := t.stringAnnotation(node, annotation)
+	if text != "" {
+		retries, err = strconv.Atoi(text)
+		if err != nil {
+			t.logger.Error(
+				err,
+				"Failed to parse number of retries, will assume zero",
+				"node", node.Name,
+				"annotation", annotation,
+				"value", text,
+			)
+			retries = 0
+			err = nil
+		}
+	}
+	if retries >= t.jobRetries {
+		t.logger.Info(
+			"Job failed and there are no retries left",
 			"node", node.Name,
-			"job", extractorJob.Name,
+			"job", existing.Name,
+			"retries", retries,
 		)
-		return err
+		t.exhausted = append(t.exhausted, node)
+		return
 	}
-	return nil
+
+	// Check if the backoff delay has passed:
+	delay := controllerRetryBaseDelay
+	for i := 0; i < retries && delay < controllerRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > controllerRetryMaxDelay {
+		delay = controllerRetryMaxDelay
+	}
+	elapsed := time.Since(failed.LastTransitionTime.Time)
+	if elapsed < delay {
+		t.logger.Info(
+			"Job failed, will retry it later",
+			"node", node.Name,
+			"job", existing.Name,
+			"retry", retries+1,
+			"delay", delay-elapsed,
+		)
+		t.requeue = true
+		return
+	}
+
+	// Save the number of retries in the node before deleting the job, so that it isn't lost if
+	// the controller is restarted:
+	nodeUpdate := node.DeepCopy()
+	if nodeUpdate.Annotations == nil {
+		nodeUpdate.Annotations = map[string]string{}
+	}
+	nodeUpdate.Annotations[annotation] = strconv.Itoa(retries + 1)
+	err = t.client.Patch(ctx, nodeUpdate, clnt.MergeFrom(node))
+	if err != nil {
+		return
+	}
+	err = t.client.Delete(
+		ctx, existing,
+		clnt.PropagationPolicy(metav1.DeletePropagationBackground),
+	)
+	if apierrors.IsNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	t.logger.Info(
+		"Deleted failed job, will create it again",
+		"node", node.Name,
+		"job", existing.Name,
+		"retry", retries+1,
+	)
+	t.requeue = true
+	return
 }
 
-func (t *controllerReconcileTask) startBundleLoader(ctx context.Context, node *corev1.Node) error {
+func (t *controllerReconcileTask) startBundleCleaner(ctx context.Context, node *corev1.Node) error {
 	// Create the service account:
-	err := t.createPrivilegedServiceAccount(ctx, bundleLoader)
+	err := t.createPrivilegedServiceAccount(ctx, bundleCleaner)
 	if err != nil {
 		return err
 	}
 
-	// Create the loader job:
-	loaderJob := &batchv1.Job{
+	// Create the cleaner job:
+	cleanerJob := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: t.namespace,
-			Name:      fmt.Sprintf("%s-%s", bundleLoader, node.Name),
+			Name:      fmt.Sprintf("%s-%s", bundleCleaner, node.Name),
 			Labels: map[string]string{
-				labels.Job: bundleLoader,
+				labels.Job: bundleCleaner,
 			},
 		},
 		Spec: batchv1.JobSpec{
 			Template: corev1.PodTemplateSpec{
 				Spec: corev1.PodSpec{
 					NodeName:           node.Name,
-					ServiceAccountName: bundleLoader,
+					ServiceAccountName: bundleCleaner,
 					Volumes: []corev1.Volume{
 						t.makeHostVolume(),
 					},
-					HostNetwork: true,
 					Containers: []corev1.Container{{
-						Name:            bundleLoader,
+						Name:            bundleCleaner,
 						Image:           controllerImage,
 						ImagePullPolicy: controllerImagePullPolicy,
 						SecurityContext: &corev1.SecurityContext{
@@ -643,14 +2785,19 @@ func (t *controllerReconcileTask) startBundleLoader(ctx context.Context, node *c
 						Command: []string{
 							"/bin/upgrade-tool",
 							"start",
-							"bundle-loader",
+							"bundle-cleaner",
 							"--log-file=stdout",
-							"--log-level=1",
+							fmt.Sprintf("--log-level=%d", t.nodeLogLevel),
 							"--mute=true",
+							"--yes",
 							fmt.Sprintf(
 								"--node=%s",
 								node.Name,
 							),
+							fmt.Sprintf(
+								"--namespace=%s",
+								t.namespace,
+							),
 							fmt.Sprintf(
 								"--root=%s",
 								controllerHostVolumeMountPath,
@@ -664,26 +2811,26 @@ func (t *controllerReconcileTask) startBundleLoader(ctx context.Context, node *c
 			},
 		},
 	}
-	err = t.client.Create(ctx, loaderJob)
+	err = t.client.Create(ctx, cleanerJob)
 	switch {
 	case err == nil:
 		t.logger.Info(
-			"Created bundle loader",
+			"Created bundle cleaner",
 			"node", node.Name,
-			"job", loaderJob.Name,
+			"job", cleanerJob.Name,
 		)
 	case apierrors.IsAlreadyExists(err):
 		t.logger.V(2).Info(
-			"Bundle loader already exists",
+			"Bundle cleaner already exists",
 			"node", node.Name,
-			"name", loaderJob.Name,
+			"name", cleanerJob.Name,
 		)
 	default:
 		t.logger.Error(
 			err,
 			"Failed to create bundle loader",
 			"node", node.Name,
-			"job", loaderJob.Name,
+			"job", cleanerJob.Name,
 		)
 		return err
 	}
@@ -691,114 +2838,161 @@ func (t *controllerReconcileTask) startBundleLoader(ctx context.Context, node *c
 	return nil
 }
 
-func (t *controllerReconcileTask) startBundleCleaner(ctx context.Context, node *corev1.Node) error {
-	// Create the service account:
-	err := t.createPrivilegedServiceAccount(ctx, bundleCleaner)
-	if err != nil {
-		return err
+func (t *controllerReconcileTask) makeHostVolume() corev1.Volume {
+	directory := corev1.HostPathDirectory
+	return corev1.Volume{
+		Name: controllerHostVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{
+				Type: &directory,
+				Path: controllerHostVolumePath,
+			},
+		},
 	}
+}
 
-	// Create the cleaner job:
-	cleanerJob := &batchv1.Job{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: t.namespace,
-			Name:      fmt.Sprintf("%s-%s", bundleCleaner, node.Name),
-			Labels: map[string]string{
-				labels.Job: bundleCleaner,
+func (t *controllerReconcileTask) makeHostMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      controllerHostVolumeName,
+		MountPath: controllerHostVolumeMountPath,
+	}
+}
+
+func (t *controllerReconcileTask) makeTokenVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: controllerTokenVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: bundleServerToken,
 			},
 		},
-		Spec: batchv1.JobSpec{
-			Template: corev1.PodTemplateSpec{
-				Spec: corev1.PodSpec{
-					NodeName:           node.Name,
-					ServiceAccountName: bundleCleaner,
-					Volumes: []corev1.Volume{
-						t.makeHostVolume(),
-					},
-					Containers: []corev1.Container{{
-						Name:            bundleCleaner,
-						Image:           controllerImage,
-						ImagePullPolicy: controllerImagePullPolicy,
-						SecurityContext: &corev1.SecurityContext{
-							Privileged: pointer.Bool(true),
-							RunAsUser:  pointer.Int64(0),
-						},
-						VolumeMounts: []corev1.VolumeMount{
-							t.makeHostMount(),
-						},
-						Command: []string{
-							"/bin/upgrade-tool",
-							"start",
-							"bundle-cleaner",
-							"--log-file=stdout",
-							"--log-level=1",
-							"--mute=true",
-							fmt.Sprintf(
-								"--node=%s",
-								node.Name,
-							),
-							fmt.Sprintf(
-								"--root=%s",
-								controllerHostVolumeMountPath,
-							),
-							"--bundle-dir=/var/lib/upgrade",
-						},
-					}},
-					Tolerations:   t.makeTolerations(),
-					RestartPolicy: corev1.RestartPolicyOnFailure,
-				},
+	}
+}
+
+func (t *controllerReconcileTask) makeTokenMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      controllerTokenVolumeName,
+		MountPath: controllerTokenVolumeMountPath,
+		ReadOnly:  true,
+	}
+}
+
+// makeCredentialsVolume creates the volume that contains the secret with the credentials used to
+// download the bundle from the bundle URL.
+func (t *controllerReconcileTask) makeCredentialsVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: controllerCredentialsVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: t.bundleURLSecret,
+			},
+		},
+	}
+}
+
+func (t *controllerReconcileTask) makeCredentialsMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      controllerCredentialsVolumeName,
+		MountPath: controllerCredentialsVolumeMountPath,
+		ReadOnly:  true,
+	}
+}
+
+// makeRegistryCertVolume creates the volume that contains the secret with the TLS certificate and
+// key used by the registries of the bundle loaders.
+func (t *controllerReconcileTask) makeRegistryCertVolume(secret string) corev1.Volume {
+	return corev1.Volume{
+		Name: controllerRegistryCertVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: secret,
 			},
 		},
 	}
-	err = t.client.Create(ctx, cleanerJob)
+}
+
+func (t *controllerReconcileTask) makeRegistryCertMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      controllerRegistryCertVolumeName,
+		MountPath: controllerRegistryCertVolumeMountPath,
+		ReadOnly:  true,
+	}
+}
+
+// createBundleServerToken creates the secret that contains the token that the bundle extractors
+// use to authenticate to the bundle server. If the secret already exists it will be preserved, so
+// that servers and extractors that are already running continue using the same token.
+func (t *controllerReconcileTask) createBundleServerToken(ctx context.Context) error {
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		return err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: t.namespace,
+			Name:      bundleServerToken,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			controllerTokenKey: []byte(hex.EncodeToString(data)),
+		},
+	}
+	err = t.client.Create(ctx, secret)
 	switch {
 	case err == nil:
 		t.logger.Info(
-			"Created bundle cleaner",
-			"node", node.Name,
-			"job", cleanerJob.Name,
+			"Created bundle server token",
+			"secret", secret.Name,
 		)
 	case apierrors.IsAlreadyExists(err):
 		t.logger.V(2).Info(
-			"Bundle cleaner already exists",
-			"node", node.Name,
-			"name", cleanerJob.Name,
+			"Bundle server token already exists",
+			"secret", secret.Name,
 		)
 	default:
 		t.logger.Error(
 			err,
-			"Failed to create bundle loader",
-			"node", node.Name,
-			"job", cleanerJob.Name,
+			"Failed to create bundle server token",
+			"secret", secret.Name,
 		)
 		return err
 	}
-
 	return nil
 }
 
-func (t *controllerReconcileTask) makeHostVolume() corev1.Volume {
-	directory := corev1.HostPathDirectory
-	return corev1.Volume{
-		Name: controllerHostVolumeName,
-		VolumeSource: corev1.VolumeSource{
-			HostPath: &corev1.HostPathVolumeSource{
-				Type: &directory,
-				Path: controllerHostVolumePath,
-			},
+func (t *controllerReconcileTask) deleteBundleServerToken(ctx context.Context) error {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: t.namespace,
+			Name:      bundleServerToken,
 		},
 	}
-}
-
-func (t *controllerReconcileTask) makeHostMount() corev1.VolumeMount {
-	return corev1.VolumeMount{
-		Name:      controllerHostVolumeName,
-		MountPath: controllerHostVolumeMountPath,
+	err := t.client.Delete(ctx, secret)
+	switch {
+	case err == nil:
+		t.logger.Info(
+			"Deleted bundle server token",
+			"secret", secret.Name,
+		)
+	case apierrors.IsNotFound(err):
+		t.logger.V(2).Info(
+			"Bundle server token doesn't exist",
+			"secret", secret.Name,
+		)
+	default:
+		t.logger.Error(
+			err,
+			"Failed to delete bundle server token",
+			"secret", secret.Name,
+		)
+		return err
 	}
+	return nil
 }
 
 func (t *controllerReconcileTask) makeTolerations() []corev1.Toleration {
-	return []corev1.Toleration{
+	tolerations := []corev1.Toleration{
 		{
 			Key:      "node-role.kubernetes.io/control-plane",
 			Operator: corev1.TolerationOpExists,
@@ -810,209 +3004,720 @@ func (t *controllerReconcileTask) makeTolerations() []corev1.Toleration {
 			Effect:   corev1.TaintEffectNoSchedule,
 		},
 	}
+	return append(tolerations, t.tolerations...)
 }
 
 func (t *controllerReconcileTask) createPrivilegedServiceAccount(ctx context.Context,
 	name string) error {
-	// Create the service account:
-	serviceAccount := &corev1.ServiceAccount{
+	// Create the service account and the bindings to the roles that contain the permissions
+	// that the component needs. The roles themselves aren't created here, they are part of the
+	// manifests generated with the 'generate manifests' command.
+	permissions, ok := rbacComponents[name]
+	if !ok {
+		return fmt.Errorf("there are no permissions for component '%s'", name)
+	}
+	objects := permissions.objects(t.namespace, name)
+	for _, object := range objects.bindings() {
+		kind := object.GetObjectKind().GroupVersionKind().Kind
+		err := t.client.Create(ctx, object)
+		switch {
+		case err == nil:
+			t.logger.Info(
+				"Created object",
+				"kind", kind,
+				"name", object.GetName(),
+			)
+		case apierrors.IsAlreadyExists(err):
+			t.logger.V(2).Info(
+				"Object already exists",
+				"kind", kind,
+				"name", object.GetName(),
+			)
+		default:
+			t.logger.Error(
+				err,
+				"Failed to create object",
+				"kind", kind,
+				"name", object.GetName(),
+			)
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *controllerReconcileTask) deletePrivilegedServiceAccount(ctx context.Context,
+	name string) error {
+	permissions, ok := rbacComponents[name]
+	if !ok {
+		return fmt.Errorf("there are no permissions for component '%s'", name)
+	}
+	objects := permissions.objects(t.namespace, name)
+
+	// Older versions of the controller bound the cluster admin role to the service accounts, so
+	// make sure that those bindings are removed as well:
+	legacyBinding := &rbacv1.ClusterRoleBinding{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: rbacv1.SchemeGroupVersion.String(),
+			Kind:       "ClusterRoleBinding",
+		},
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace: t.namespace,
-			Name:      name,
+			Name: fmt.Sprintf("%s-%s-cluster-admin", t.namespace, name),
 		},
 	}
-	err := t.client.Create(ctx, serviceAccount)
-	switch {
-	case err == nil:
-		t.logger.Info(
-			"Created service account",
-			"name", serviceAccount.Name,
-		)
-	case apierrors.IsAlreadyExists(err):
-		t.logger.V(2).Info(
-			"Service account already exists",
-			"name", serviceAccount.Name,
+	for _, object := range append(objects.bindings(), legacyBinding) {
+		kind := object.GetObjectKind().GroupVersionKind().Kind
+		err := t.client.Delete(ctx, object)
+		switch {
+		case err == nil:
+			t.logger.Info(
+				"Deleted object",
+				"kind", kind,
+				"name", object.GetName(),
+			)
+		case apierrors.IsNotFound(err):
+			t.logger.V(2).Info(
+				"Object doesn't exist",
+				"kind", kind,
+				"name", object.GetName(),
+			)
+		default:
+			t.logger.Error(
+				err,
+				"Failed to delete object",
+				"kind", kind,
+				"name", object.GetName(),
+			)
+			return err
+		}
+	}
+	return nil
+}
+
+// syncMachineConfigPools pauses the machine config pools that contain any of the given nodes, and
+// resumes the rest. Pools are marked with an annotation when they are paused, so that only the
+// pools paused by the controller are resumed later. Passing no nodes resumes all of them.
+func (t *controllerReconcileTask) syncMachineConfigPools(ctx context.Context,
+	nodes []*corev1.Node) error {
+	pools, err := t.listMachineConfigPools(ctx)
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		var selected []*corev1.Node
+		selected, err = t.selectPoolNodes(pool, nodes)
+		if err != nil {
+			return err
+		}
+		paused, _, _ := unstructured.NestedBool(pool.Object, "spec", "paused")
+		owned := t.boolAnnotation(pool, annotations.PoolPaused)
+		switch {
+		case len(selected) > 0 && !paused:
+			err = t.pauseMachineConfigPool(ctx, pool, t.nodeNames(selected))
+		case len(selected) == 0 && owned:
+			err = t.resumeMachineConfigPool(ctx, pool)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectPoolNodes returns the nodes that are selected by the node selector of the given machine
+// config pool. Pools without node selector don't select any node.
+func (t *controllerReconcileTask) selectPoolNodes(pool *unstructured.Unstructured,
+	nodes []*corev1.Node) (results []*corev1.Node, err error) {
+	data, ok, err := unstructured.NestedMap(pool.Object, "spec", "nodeSelector")
+	if !ok || err != nil {
+		return
+	}
+	selector := &metav1.LabelSelector{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(data, selector)
+	if err != nil {
+		return
+	}
+	matcher, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return
+	}
+	for _, node := range nodes {
+		if matcher.Matches(k8slabels.Set(node.Labels)) {
+			results = append(results, node)
+		}
+	}
+	return
+}
+
+// pauseMachineConfigPool pauses the given machine config pool and adds the annotation that
+// indicates that it was paused by the controller.
+func (t *controllerReconcileTask) pauseMachineConfigPool(ctx context.Context,
+	pool *unstructured.Unstructured, nodes []string) error {
+	update := pool.DeepCopy()
+	err := unstructured.SetNestedField(update.Object, true, "spec", "paused")
+	if err != nil {
+		return err
+	}
+	values := update.GetAnnotations()
+	if values == nil {
+		values = map[string]string{}
+	}
+	values[annotations.PoolPaused] = "true"
+	update.SetAnnotations(values)
+	err = t.client.Patch(ctx, update, clnt.MergeFrom(pool))
+	if err != nil {
+		t.logger.Error(
+			err,
+			"Failed to pause machine config pool",
+			"pool", pool.GetName(),
 		)
-	default:
+		return err
+	}
+	t.logger.Info(
+		"Paused machine config pool till its nodes have the bundle",
+		"pool", pool.GetName(),
+		"nodes", nodes,
+	)
+	return nil
+}
+
+// resumeMachineConfigPool resumes the given machine config pool and removes the annotation that
+// indicates that it was paused by the controller.
+func (t *controllerReconcileTask) resumeMachineConfigPool(ctx context.Context,
+	pool *unstructured.Unstructured) error {
+	update := pool.DeepCopy()
+	err := unstructured.SetNestedField(update.Object, false, "spec", "paused")
+	if err != nil {
+		return err
+	}
+	values := update.GetAnnotations()
+	delete(values, annotations.PoolPaused)
+	update.SetAnnotations(values)
+	err = t.client.Patch(ctx, update, clnt.MergeFrom(pool))
+	if err != nil {
 		t.logger.Error(
 			err,
-			"Failed to create service account",
-			"name", serviceAccount.Name,
+			"Failed to resume machine config pool",
+			"pool", pool.GetName(),
 		)
 		return err
 	}
+	t.logger.Info(
+		"Resumed machine config pool",
+		"pool", pool.GetName(),
+	)
+	return nil
+}
 
-	// Create the admin role binding:
-	adminBinding := &rbacv1.ClusterRoleBinding{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: fmt.Sprintf("%s-%s-cluster-admin", t.namespace, name),
-		},
-		RoleRef: rbacv1.RoleRef{
-			APIGroup: "rbac.authorization.k8s.io",
-			Kind:     "ClusterRole",
-			Name:     "cluster-admin",
-		},
-		Subjects: []rbacv1.Subject{{
-			Kind:      rbacv1.ServiceAccountKind,
-			Namespace: t.namespace,
-			Name:      name,
-		}},
+// listMachineConfigPools returns the machine config pools of the cluster, or an empty list if the
+// cluster doesn't support them.
+func (t *controllerReconcileTask) listMachineConfigPools(
+	ctx context.Context) (results []*unstructured.Unstructured, err error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(readinessPoolListGVK)
+	err = t.client.List(ctx, list)
+	if meta.IsNoMatchError(err) || apierrors.IsNotFound(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	for i := range list.Items {
+		results = append(results, &list.Items[i])
+	}
+	return
+}
+
+// upgradeRequested checks if the upgrade to the release of the bundle has already been requested
+// to the cluster version operator. Note that the desired update of the cluster version stays set
+// after an upgrade completes, so it is only considered requested when it matches the release or
+// the version of the bundle.
+func (t *controllerReconcileTask) upgradeRequested() bool {
+	desiredUpdate := t.desiredUpdate()
+	if desiredUpdate == nil {
+		return false
+	}
+	if desiredUpdate.Image != "" {
+		metadata, err := t.findMetadata()
+		if err != nil {
+			t.logger.Error(err, "Failed to find bundle metadata")
+		}
+		if metadata != nil && metadata.Release == desiredUpdate.Image {
+			return true
+		}
+	}
+	version := t.upgrade.Spec.Version
+	return version != "" && desiredUpdate.Version == version
+}
+
+// checkUpgradeProgress checks the progress of the upgrade reported by the cluster version operator
+// and saves it in the phase and message of the task.
+func (t *controllerReconcileTask) checkUpgradeProgress() {
+	t.phase = v1alpha1.ClusterUpgradeUpgrading
+	t.message = "Upgrade has been requested"
+	if t.upgradeCompleted() {
+		t.phase = v1alpha1.ClusterUpgradeCompleted
+		t.message = fmt.Sprintf(
+			"Upgrade to version '%s' has completed",
+			t.version.Status.History[0].Version,
+		)
+		t.logger.V(1).Info(
+			"Upgrade has completed",
+			"version", t.version.Status.History[0].Version,
+			"image", t.version.Status.History[0].Image,
+		)
+		return
 	}
-	err = t.client.Create(ctx, adminBinding)
+	failing := t.versionCondition(configv1.ClusterStatusConditionType("Failing"))
+	progressing := t.versionCondition(configv1.OperatorProgressing)
 	switch {
-	case err == nil:
-		t.logger.Info(
-			"Created admin cluster role binding",
-			"name", adminBinding.Name,
+	case failing != nil && failing.Status == configv1.ConditionTrue:
+		t.message = fmt.Sprintf("Upgrade is failing: %s", failing.Message)
+	case progressing != nil && progressing.Status == configv1.ConditionTrue:
+		t.message = fmt.Sprintf("Upgrade is in progress: %s", progressing.Message)
+	}
+	t.logger.V(1).Info(
+		"Upgrade is in progress",
+		"message", t.message,
+	)
+}
+
+// upgradeCompleted checks if the cluster version operator has completed the requested upgrade.
+func (t *controllerReconcileTask) upgradeCompleted() bool {
+	history := t.version.Status.History
+	if len(history) == 0 {
+		return false
+	}
+	latest := history[0]
+	if latest.State != configv1.CompletedUpdate {
+		return false
+	}
+	desired := t.desiredUpdate()
+	if desired == nil {
+		return false
+	}
+	if desired.Image != "" {
+		return latest.Image == desired.Image
+	}
+	return latest.Version == desired.Version
+}
+
+// desiredUpdate returns the update that has been requested to the cluster version operator, or nil
+// if none has been requested. In hosted mode the desired update of the cluster version is managed
+// by the hosted control plane, so the requested update is the release image of the hosted cluster.
+func (t *controllerReconcileTask) desiredUpdate() *configv1.Update {
+	if t.hostedCluster == nil {
+		return t.version.Spec.DesiredUpdate
+	}
+	image, _, _ := unstructured.NestedString(t.hostedCluster.Object, "spec", "release", "image")
+	if image == "" {
+		return nil
+	}
+	return &configv1.Update{
+		Image: image,
+	}
+}
+
+// versionCondition returns the condition of the cluster version with the given type, or nil if
+// there is no such condition.
+func (t *controllerReconcileTask) versionCondition(
+	kind configv1.ClusterStatusConditionType) *configv1.ClusterOperatorStatusCondition {
+	for i := range t.version.Status.Conditions {
+		condition := &t.version.Status.Conditions[i]
+		if condition.Type == kind {
+			return condition
+		}
+	}
+	return nil
+}
+
+// upgradeFromAnnotations creates the description of the upgrade from the annotations of the
+// cluster version. This is used when ClusterUpgrade objects aren't enabled.
+func (t *controllerReconcileTask) upgradeFromAnnotations() *v1alpha1.ClusterUpgrade {
+	upgrade := &v1alpha1.ClusterUpgrade{
+		Spec: v1alpha1.ClusterUpgradeSpec{
+			Version: t.stringAnnotation(t.version, annotations.BundleVersion),
+			Bundle: v1alpha1.ClusterUpgradeBundle{
+				File:   t.stringAnnotation(t.version, annotations.BundleFile),
+				Dir:    t.stringAnnotation(t.version, annotations.BundleDir),
+				URL:    t.stringAnnotation(t.version, annotations.BundleURL),
+				Digest: t.stringAnnotation(t.version, annotations.BundleDigest),
+			},
+			Rollout: v1alpha1.ClusterUpgradeRollout{
+				Streaming: t.boolAnnotation(t.version, annotations.Streaming),
+			},
+			Paused: t.boolAnnotation(t.version, annotations.Paused),
+			Force:  t.boolAnnotation(t.version, annotations.Force),
+			AllowUnsupportedUpdate: t.boolAnnotation(
+				t.version, annotations.AllowUnsupportedUpdate,
+			),
+		},
+	}
+	secret := t.stringAnnotation(t.version, annotations.BundleURLSecret)
+	if secret != "" {
+		upgrade.Spec.Bundle.URLSecret = &corev1.LocalObjectReference{
+			Name: secret,
+		}
+	}
+	return upgrade
+}
+
+// updateStatus updates the status of the ClusterUpgrade object with the result of executing the
+// task.
+func (t *controllerReconcileTask) updateStatus(ctx context.Context) error {
+	update := t.upgrade.DeepCopy()
+	status := &update.Status
+	status.ObservedGeneration = update.Generation
+	status.Phase = t.phase
+	status.Message = t.message
+	status.Nodes = len(t.nodes)
+	status.ExtractedNodes = 0
+	status.LoadedNodes = 0
+	status.Batch = t.batch
+	for _, node := range t.nodes {
+		if t.boolLabel(node, labels.BundleExtracted) {
+			status.ExtractedNodes++
+		}
+		if t.boolLabel(node, labels.BundleLoaded) {
+			status.LoadedNodes++
+		}
+	}
+	t.updateConditions(update)
+	t.updateHistory(status)
+	if equality.Semantic.DeepEqual(update.Status, t.upgrade.Status) {
+		return nil
+	}
+	err := t.upgradeClient.Status().Update(ctx, update)
+	if err != nil {
+		return err
+	}
+	t.logger.Info(
+		"Updated cluster upgrade status",
+		"name", update.Name,
+		"phase", update.Status.Phase,
+		"message", update.Status.Message,
+	)
+
+	// Send the notifications only once the status has been saved, so that they aren't sent
+	// again if the controller is restarted:
+	for _, notification := range t.notifications(&t.upgrade.Status, status) {
+		t.notifier.Notify(ctx, notification)
+	}
+	t.upgrade = update
+	return nil
+}
+
+// notifications compares the previous and the new status of the upgrade and returns the
+// notifications for the events that happened between them.
+func (t *controllerReconcileTask) notifications(previous,
+	current *v1alpha1.ClusterUpgradeStatus) []*Notification {
+	if t.notifier == nil {
+		return nil
+	}
+	var results []*Notification
+	add := func(event, message string) *Notification {
+		notification := &Notification{
+			Event:     event,
+			Time:      time.Now().UTC(),
+			Namespace: t.upgrade.Namespace,
+			Name:      t.upgrade.Name,
+			Version:   t.upgrade.Spec.Version,
+			Phase:     string(current.Phase),
+			Message:   message,
+		}
+		results = append(results, notification)
+		return notification
+	}
+
+	// The upgrade starts when the first nodes start to extract the bundle:
+	started := func(phase v1alpha1.ClusterUpgradePhase) bool {
+		return phase != "" && phase != v1alpha1.ClusterUpgradePending
+	}
+	if started(current.Phase) && !started(previous.Phase) {
+		add(NotificationUpgradeStarted, current.Message)
+	}
+
+	// A batch completes when the next one starts, or when the last one completes and the
+	// upgrade is requested:
+	upgrading := func(phase v1alpha1.ClusterUpgradePhase) bool {
+		return phase == v1alpha1.ClusterUpgradeUpgrading ||
+			phase == v1alpha1.ClusterUpgradeCompleted
+	}
+	requested := upgrading(current.Phase) && !upgrading(previous.Phase)
+	if previous.Batch > 0 && (current.Batch > previous.Batch || requested) {
+		notification := add(
+			NotificationBatchCompleted,
+			fmt.Sprintf(
+				"Images have been loaded in the nodes of batch %d of %d",
+				previous.Batch, t.batches,
+			),
 		)
-	case apierrors.IsAlreadyExists(err):
-		t.logger.V(2).Info(
-			"Admin cluster role binding already exists",
-			"name", adminBinding.Name,
+		notification.Batch = previous.Batch
+		notification.Batches = t.batches
+	}
+
+	// Nodes fail when they report a new error or when they have no job retries left:
+	var records []v1alpha1.ClusterUpgradeNodeRecord
+	if previous.History != nil {
+		records = previous.History.Nodes
+	}
+	if current.History != nil {
+		for _, record := range current.History.Nodes {
+			index := slices.IndexFunc(
+				records,
+				func(item v1alpha1.ClusterUpgradeNodeRecord) bool {
+					return item.Name == record.Name
+				},
+			)
+			var old v1alpha1.ClusterUpgradeNodeRecord
+			if index != -1 {
+				old = records[index]
+			}
+			var message string
+			switch {
+			case record.Error != "" && record.Error != old.Error:
+				message = fmt.Sprintf(
+					"Node '%s' reported an error: %s",
+					record.Name, record.Error,
+				)
+			case record.Failed && !old.Failed:
+				message = fmt.Sprintf(
+					"Jobs of node '%s' failed and there are no retries left",
+					record.Name,
+				)
+			default:
+				continue
+			}
+			notification := add(NotificationNodeFailed, message)
+			notification.Node = record.Name
+		}
+	}
+
+	// The upgrade completes when the cluster version operator says so:
+	if current.Phase == v1alpha1.ClusterUpgradeCompleted &&
+		previous.Phase != v1alpha1.ClusterUpgradeCompleted {
+		add(NotificationUpgradeCompleted, current.Message)
+	}
+
+	return results
+}
+
+// updateConditions updates the conditions of the given cluster upgrade according to the phase of
+// the task and the state of the nodes and of the cluster version. The transition times are only
+// changed when the status of a condition changes.
+func (t *controllerReconcileTask) updateConditions(upgrade *v1alpha1.ClusterUpgrade) {
+	status := &upgrade.Status
+	upgrading := t.phase == v1alpha1.ClusterUpgradeUpgrading ||
+		t.phase == v1alpha1.ClusterUpgradeCompleted
+	setCondition := func(kind string, value bool, reason, message string) {
+		condition := metav1.Condition{
+			Type:               kind,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: upgrade.Generation,
+			Reason:             reason,
+			Message:            message,
+		}
+		if value {
+			condition.Status = metav1.ConditionTrue
+		}
+		meta.SetStatusCondition(&status.Conditions, condition)
+	}
+
+	// The bundle is distributed and the images are loaded when all the nodes have the
+	// corresponding labels, or when the upgrade has already been requested, as the labels may
+	// have been removed by then:
+	if upgrading || (status.Nodes > 0 && status.ExtractedNodes == status.Nodes) {
+		setCondition(
+			v1alpha1.ClusterUpgradeBundleDistributed, true,
+			v1alpha1.ClusterUpgradeDistributedReason,
+			"Bundle has been extracted in all the nodes",
+		)
+	} else {
+		setCondition(
+			v1alpha1.ClusterUpgradeBundleDistributed, false,
+			v1alpha1.ClusterUpgradeDistributingReason,
+			fmt.Sprintf(
+				"Bundle has been extracted in %d of %d nodes",
+				status.ExtractedNodes, status.Nodes,
+			),
 		)
-		err = nil
-	default:
-		t.logger.Error(
-			err,
-			"Failed to create admin cluster role binding",
-			"name", adminBinding.Name,
+	}
+	if upgrading || (status.Nodes > 0 && status.LoadedNodes == status.Nodes) {
+		setCondition(
+			v1alpha1.ClusterUpgradeImagesLoaded, true,
+			v1alpha1.ClusterUpgradeLoadedReason,
+			"Images have been loaded in all the nodes",
+		)
+	} else {
+		setCondition(
+			v1alpha1.ClusterUpgradeImagesLoaded, false,
+			v1alpha1.ClusterUpgradeLoadingReason,
+			fmt.Sprintf(
+				"Images have been loaded in %d of %d nodes",
+				status.LoadedNodes, status.Nodes,
+			),
 		)
-		return err
 	}
 
-	// Create the privileged role binding:
-	privilegedBinding := &rbacv1.RoleBinding{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: t.namespace,
-			Name:      fmt.Sprintf("%s-privileged", name),
-		},
-		RoleRef: rbacv1.RoleRef{
-			APIGroup: "rbac.authorization.k8s.io",
-			Kind:     "ClusterRole",
-			Name:     "system:openshift:scc:privileged",
-		},
-		Subjects: []rbacv1.Subject{{
-			Kind:      rbacv1.ServiceAccountKind,
-			Namespace: t.namespace,
-			Name:      name,
-		}},
+	// The upgrade is triggered once it has been requested to the cluster version operator:
+	if upgrading {
+		setCondition(
+			v1alpha1.ClusterUpgradeUpgradeTriggered, true,
+			v1alpha1.ClusterUpgradeTriggeredReason,
+			fmt.Sprintf(
+				"Upgrade to release '%s' has been requested",
+				t.desiredUpdate().Image,
+			),
+		)
+	} else {
+		setCondition(
+			v1alpha1.ClusterUpgradeUpgradeTriggered, false,
+			v1alpha1.ClusterUpgradeWaitingReason,
+			"Waiting for all the nodes to have the images loaded",
+		)
 	}
-	err = t.client.Create(ctx, privilegedBinding)
-	switch {
-	case err == nil:
-		t.logger.Info(
-			"Created privileged role binding",
-			"name", privilegedBinding.Name,
+	switch t.phase {
+	case v1alpha1.ClusterUpgradeCompleted:
+		setCondition(
+			v1alpha1.ClusterUpgradeUpgradeCompleted, true,
+			v1alpha1.ClusterUpgradeCompletedReason,
+			t.message,
 		)
-	case apierrors.IsAlreadyExists(err):
-		t.logger.V(2).Info(
-			"Privileged role binding already exists",
-			"name", privilegedBinding.Name,
+	case v1alpha1.ClusterUpgradeUpgrading:
+		setCondition(
+			v1alpha1.ClusterUpgradeUpgradeCompleted, false,
+			v1alpha1.ClusterUpgradeInProgressReason,
+			t.message,
 		)
 	default:
-		t.logger.Error(
-			err,
-			"Failed to create privileged role binding",
-			"name", privilegedBinding.Name,
+		setCondition(
+			v1alpha1.ClusterUpgradeUpgradeCompleted, false,
+			v1alpha1.ClusterUpgradeNotStartedReason,
+			"Upgrade hasn't been requested yet",
 		)
-		return err
 	}
 
-	return nil
-}
-
-func (t *controllerReconcileTask) deletePrivilegedServiceAccount(ctx context.Context,
-	name string) error {
-	// Create the service account:
-	serviceAccount := &corev1.ServiceAccount{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: t.namespace,
-			Name:      name,
-		},
-	}
-	err := t.client.Delete(ctx, serviceAccount)
+	// The upgrade is paused when requested in the spec, but only till it is requested to the
+	// cluster version operator, as then pausing has no effect:
+	// The same happens when the upgrade is outside of its maintenance windows:
 	switch {
-	case err == nil:
-		t.logger.Info(
-			"Deleted service account",
-			"name", serviceAccount.Name,
+	case upgrade.Spec.Paused && !upgrading:
+		setCondition(
+			v1alpha1.ClusterUpgradePaused, true,
+			v1alpha1.ClusterUpgradePausedReason,
+			"Upgrade is paused, new jobs will not be started",
 		)
-	case apierrors.IsNotFound(err):
-		t.logger.V(2).Info(
-			"Service account doesn't exist",
-			"name", serviceAccount.Name,
+	case t.outsideWindow && !upgrading && t.nextWindow.IsZero():
+		setCondition(
+			v1alpha1.ClusterUpgradePaused, true,
+			v1alpha1.ClusterUpgradeOutsideWindowReason,
+			"Upgrade is outside of the maintenance windows and there are no more "+
+				"windows, new jobs will not be started",
+		)
+	case t.outsideWindow && !upgrading:
+		setCondition(
+			v1alpha1.ClusterUpgradePaused, true,
+			v1alpha1.ClusterUpgradeOutsideWindowReason,
+			fmt.Sprintf(
+				"Upgrade is outside of the maintenance windows, new jobs will be "+
+					"started when the next window opens at %s",
+				t.nextWindow.UTC().Format(time.RFC3339),
+			),
 		)
 	default:
-		t.logger.Error(
-			err,
-			"Failed to delete service account",
-			"name", serviceAccount.Name,
+		setCondition(
+			v1alpha1.ClusterUpgradePaused, false,
+			v1alpha1.ClusterUpgradeAsExpectedReason,
+			"Upgrade isn't paused",
 		)
-		return err
 	}
 
-	// Delete the admin role binding:
-	adminBinding := &rbacv1.ClusterRoleBinding{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: fmt.Sprintf("%s-%s-cluster-admin", t.namespace, name),
-		},
-	}
-	err = t.client.Delete(ctx, adminBinding)
+	// The result of the preflight checks is only updated when they run, so the result of the last
+	// run is kept once the upgrade starts:
 	switch {
-	case err == nil:
-		t.logger.Info(
-			"Deleted admin cluster role binding",
-			"name", adminBinding.Name,
+	case t.preflightSkipped:
+		setCondition(
+			v1alpha1.ClusterUpgradePreflightChecksPassed, true,
+			v1alpha1.ClusterUpgradeSkippedReason,
+			"Preflight checks have been skipped as requested in the spec",
 		)
-	case apierrors.IsNotFound(err):
-		t.logger.V(2).Info(
-			"Admin cluster role binding doesn't exist",
-			"name", adminBinding.Name,
+	case t.preflightReport == nil:
+		// The checks didn't run.
+	case t.preflightReport.Verdict == ReadinessGo:
+		setCondition(
+			v1alpha1.ClusterUpgradePreflightChecksPassed, true,
+			v1alpha1.ClusterUpgradePassedReason,
+			"All the preflight checks passed",
 		)
-		err = nil
 	default:
-		t.logger.Error(
-			err,
-			"Failed to delete admin cluster role binding",
-			"name", adminBinding.Name,
+		setCondition(
+			v1alpha1.ClusterUpgradePreflightChecksPassed, false,
+			v1alpha1.ClusterUpgradePreflightFailedReason,
+			t.preflightFailures(),
 		)
-		return err
 	}
 
-	// Delete the privileged role binding:
-	privilegedBinding := &rbacv1.RoleBinding{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: t.namespace,
-			Name:      fmt.Sprintf("%s-privileged", name),
-		},
+	// The upgrade is degraded when the update isn't supported according to the update graph of
+	// the bundle, when the number of nodes that report an error or that have no job retries left
+	// exceeds the failure budget, or when the cluster version operator reports that the upgrade
+	// is failing:
+	var failed []*corev1.Node
+	for _, node := range t.nodes {
+		if t.stringAnnotation(node, annotations.Error) != "" ||
+			slices.Contains(t.exhausted, node) {
+			failed = append(failed, node)
+		}
+	}
+	budget, err := intstr.GetScaledValueFromIntOrPercent(&t.failureBudget, len(t.nodes), false)
+	if err != nil {
+		t.logger.Error(
+			err,
+			"Failed to calculate failure budget, will assume zero",
+			"budget", t.failureBudget.String(),
+		)
+		budget = 0
 	}
-	err = t.client.Delete(ctx, privilegedBinding)
+	failing := t.versionCondition(configv1.ClusterStatusConditionType("Failing"))
 	switch {
-	case err == nil:
-		t.logger.Info(
-			"Deleted privileged role binding",
-			"name", privilegedBinding.Name,
+	case t.unsupported != "":
+		setCondition(
+			v1alpha1.ClusterUpgradeDegraded, true,
+			v1alpha1.ClusterUpgradeUnsupportedUpdateReason,
+			t.unsupported,
 		)
-	case apierrors.IsNotFound(err):
-		t.logger.V(2).Info(
-			"Privileged role binding doesn't exist",
-			"name", privilegedBinding.Name,
+	case len(failed) > budget:
+		setCondition(
+			v1alpha1.ClusterUpgradeDegraded, true,
+			v1alpha1.ClusterUpgradeNodeErrorsReason,
+			fmt.Sprintf(
+				"Nodes %s reported errors, check the '%s' annotation for details",
+				strings.Join(t.nodeNames(failed), ", "), annotations.Error,
+			),
+		)
+	case upgrading && failing != nil && failing.Status == configv1.ConditionTrue:
+		setCondition(
+			v1alpha1.ClusterUpgradeDegraded, true,
+			v1alpha1.ClusterUpgradeUpgradeFailingReason,
+			failing.Message,
+		)
+	case len(failed) > 0:
+		setCondition(
+			v1alpha1.ClusterUpgradeDegraded, false,
+			v1alpha1.ClusterUpgradeWithinBudgetReason,
+			fmt.Sprintf(
+				"Nodes %s reported errors, but that is within the failure budget of "+
+					"%d nodes",
+				strings.Join(t.nodeNames(failed), ", "), budget,
+			),
 		)
 	default:
-		t.logger.Error(
-			err,
-			"Failed to delete privileged role binding",
-			"name", privilegedBinding.Name,
+		setCondition(
+			v1alpha1.ClusterUpgradeDegraded, false,
+			v1alpha1.ClusterUpgradeAsExpectedReason,
+			"Upgrade is progressing as expected",
 		)
-		return err
 	}
-
-	return nil
-}
-
-func (t *controllerReconcileTask) upgradeRequested() bool {
-	desiredUpdate := t.version.Spec.DesiredUpdate
-	return desiredUpdate != nil && (desiredUpdate.Version != "" || desiredUpdate.Image != "")
 }
 
 func (t *controllerReconcileTask) requestUpgrade(ctx context.Context) error {
@@ -1022,37 +3727,317 @@ func (t *controllerReconcileTask) requestUpgrade(ctx context.Context) error {
 	if len(t.nodes) == 0 {
 		return errors.New("there are no nodes")
 	}
-	var metadata *Metadata
+	metadata, err := t.findMetadata()
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		return errors.New("no node has metadata")
+	}
+
+	// When the cluster has nodes with different architectures each node has extracted the bundle
+	// of its architecture, and all those bundles need to have been created from the same multi
+	// architecture release, as otherwise there is no release image that works for all of them:
 	for _, node := range t.nodes {
-		metadata, err = t.readMetadata(node)
+		var nodeMetadata *Metadata
+		nodeMetadata, err = t.readMetadata(node)
 		if err != nil {
 			return err
 		}
-		if metadata != nil {
-			break
+		if nodeMetadata != nil && nodeMetadata.Release != metadata.Release {
+			return fmt.Errorf(
+				"release image '%s' of the bundle of node '%s' is different to "+
+					"release image '%s' of the other nodes, clusters with nodes "+
+					"of different architectures need bundles created from the "+
+					"same multi-architecture release",
+				nodeMetadata.Release, node.Name, metadata.Release,
+			)
 		}
 	}
-	if metadata == nil {
-		return errors.New("no node has metadata")
+
+	// The upgrade is requested as an explicit upgrade to the release image, like the
+	// '--allow-explicit-upgrade' option of 'oc adm upgrade' does, so that the cluster version
+	// operator accepts it even if it isn't one of the available updates. That requires a
+	// reference by digest, as otherwise the cluster version operator would pull whatever the tag
+	// points to:
+	if !strings.Contains(metadata.Release, "@sha256:") {
+		return fmt.Errorf(
+			"release image '%s' of the bundle isn't a reference by digest",
+			metadata.Release,
+		)
+	}
+
+	// If the bundle contains a snapshot of the update graph then use it to check that the update
+	// is supported, as the update service would do in a connected cluster, and refuse to request
+	// it otherwise, unless explicitly allowed in the spec:
+	supported := false
+	if t.hostedCluster == nil && metadata.Graph != nil {
+		current := t.version.Status.Desired.Version
+		supported = metadata.Graph.HasEdge(current, metadata.Version)
+		switch {
+		case supported:
+		case t.upgrade.Spec.AllowUnsupportedUpdate:
+			t.logger.Info(
+				"Update isn't supported according to the update graph of the bundle, "+
+					"will request it anyway as allowed in the spec",
+				"channel", metadata.Graph.Channel,
+				"from", current,
+				"to", metadata.Version,
+			)
+		default:
+			t.logger.Info(
+				"Update isn't supported according to the update graph of the bundle, "+
+					"will not request it",
+				"channel", metadata.Graph.Channel,
+				"from", current,
+				"to", metadata.Version,
+			)
+			t.unsupported = fmt.Sprintf(
+				"Update from version '%s' to version '%s' isn't supported according "+
+					"to the update graph of the bundle, set 'allowUnsupportedUpdate' "+
+					"in the spec to request it anyway",
+				current, metadata.Version,
+			)
+			t.phase = v1alpha1.ClusterUpgradeLoading
+			t.message = t.unsupported
+			return nil
+		}
 	}
 
-	// Request the upgrade:
+	// Apply the extra manifests that were added to the bundle:
+	err = t.applyManifests(ctx, metadata.Manifests)
+	if err != nil {
+		return err
+	}
+
+	// In hosted mode the upgrade is requested to the management cluster:
+	if t.hostedCluster != nil {
+		return t.requestHostedUpgrade(ctx, metadata)
+	}
+
+	// Request the upgrade. It is only forced, skipping the verification of the signature and the
+	// preconditions, when explicitly requested in the spec:
 	versionUpdate := t.version.DeepCopy()
 	versionUpdate.Spec.DesiredUpdate = &configv1.Update{
 		Image: metadata.Release,
-		Force: true,
+		Force: t.upgrade.Spec.Force,
+	}
+
+	// If the bundle contains a snapshot of the update graph then configure the channel, and the
+	// version when the update is supported, as the update service would do in a connected
+	// cluster:
+	if metadata.Graph != nil {
+		if supported {
+			versionUpdate.Spec.DesiredUpdate.Version = metadata.Version
+		}
+		if metadata.Graph.Channel != "" {
+			versionUpdate.Spec.Channel = metadata.Graph.Channel
+		}
 	}
 	versionPatch := clnt.MergeFrom(t.version)
-	t.client.Patch(ctx, versionUpdate, versionPatch)
+	err = t.client.Patch(ctx, versionUpdate, versionPatch)
+	if err != nil {
+		t.logger.Error(
+			err,
+			"Failed to request upgrade",
+			"version", metadata.Version,
+			"image", metadata.Release,
+		)
+		return err
+	}
+	t.version = versionUpdate
 	t.logger.Info(
 		"Requested upgrade",
 		"version", metadata.Version,
 		"image", metadata.Release,
+		"force", versionUpdate.Spec.DesiredUpdate.Force,
+	)
+
+	return nil
+}
+
+// requestHostedUpgrade requests the upgrade changing the release image of the hosted cluster. The
+// channel is also changed if the bundle contains a snapshot of the update graph.
+func (t *controllerReconcileTask) requestHostedUpgrade(ctx context.Context,
+	metadata *Metadata) error {
+	update := t.hostedCluster.DeepCopy()
+	err := unstructured.SetNestedField(update.Object, metadata.Release, "spec", "release", "image")
+	if err != nil {
+		return err
+	}
+	if metadata.Graph != nil && metadata.Graph.Channel != "" {
+		err = unstructured.SetNestedField(
+			update.Object, metadata.Graph.Channel, "spec", "channel",
+		)
+		if err != nil {
+			return err
+		}
+	}
+	err = t.upgradeClient.Patch(ctx, update, clnt.MergeFrom(t.hostedCluster))
+	if err != nil {
+		t.logger.Error(
+			err,
+			"Failed to request upgrade of hosted cluster",
+			"namespace", t.hostedCluster.GetNamespace(),
+			"name", t.hostedCluster.GetName(),
+			"version", metadata.Version,
+			"image", metadata.Release,
+		)
+		return err
+	}
+	t.hostedCluster = update
+	t.logger.Info(
+		"Requested upgrade of hosted cluster",
+		"namespace", t.hostedCluster.GetNamespace(),
+		"name", t.hostedCluster.GetName(),
+		"version", metadata.Version,
+		"image", metadata.Release,
 	)
+	return nil
+}
 
+func (t *controllerReconcileTask) applyManifests(ctx context.Context, manifests []string) error {
+	for _, manifest := range manifests {
+		objects, err := ParseManifests([]byte(manifest))
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			err = t.client.Patch(
+				ctx, object, clnt.Apply,
+				clnt.FieldOwner(controllerFieldOwner),
+				clnt.ForceOwnership,
+			)
+			if err != nil {
+				t.logger.Error(
+					err,
+					"Failed to apply extra manifest object",
+					"kind", object.GetKind(),
+					"namespace", object.GetNamespace(),
+					"name", object.GetName(),
+				)
+				return err
+			}
+			t.logger.Info(
+				"Applied extra manifest object",
+				"kind", object.GetKind(),
+				"namespace", object.GetNamespace(),
+				"name", object.GetName(),
+			)
+		}
+	}
 	return nil
 }
 
+// updateHistory records in the history of the upgrade the changes of phase and the nodes where
+// extracting the bundle or loading the images failed. Node records are never removed, so that they
+// are preserved when the retry annotations of the nodes are removed.
+func (t *controllerReconcileTask) updateHistory(status *v1alpha1.ClusterUpgradeStatus) {
+	if t.phase == "" {
+		return
+	}
+	now := metav1.NewTime(time.Now().Truncate(time.Second))
+	history := status.History
+	if history == nil {
+		history = &v1alpha1.ClusterUpgradeHistory{
+			StartTime: &now,
+		}
+		status.History = history
+	}
+	history.BundleDigest = t.upgrade.Spec.Bundle.Digest
+	if history.Release == "" {
+		metadata, err := t.findMetadata()
+		if err != nil {
+			t.logger.Error(err, "Failed to find bundle metadata for the history")
+		}
+		if metadata != nil {
+			history.Release = metadata.Release
+		}
+	}
+
+	// Close the record of the previous phase and open a new one when the phase changes:
+	count := len(history.Phases)
+	if count == 0 || history.Phases[count-1].Phase != t.phase {
+		if count > 0 {
+			previous := &history.Phases[count-1]
+			end := now
+			previous.EndTime = &end
+			previous.Duration = &metav1.Duration{
+				Duration: now.Sub(previous.StartTime.Time),
+			}
+		}
+		history.Phases = append(history.Phases, v1alpha1.ClusterUpgradePhaseRecord{
+			Phase:     t.phase,
+			StartTime: now,
+		})
+		if len(history.Phases) > controllerMaxPhaseRecords {
+			history.Phases = history.Phases[len(history.Phases)-controllerMaxPhaseRecords:]
+		}
+	}
+	if t.phase == v1alpha1.ClusterUpgradeCompleted && history.CompletionTime == nil {
+		completion := now
+		history.CompletionTime = &completion
+	}
+
+	// Record the nodes that had problems:
+	retries := func(node *corev1.Node, annotation string) int32 {
+		value, err := strconv.ParseInt(t.stringAnnotation(node, annotation), 10, 32)
+		if err != nil {
+			return 0
+		}
+		return int32(value)
+	}
+	for _, node := range t.nodes {
+		extractorRetries := retries(node, annotations.ExtractorRetries)
+		loaderRetries := retries(node, annotations.LoaderRetries)
+		failed := slices.Contains(t.exhausted, node)
+		message := t.stringAnnotation(node, annotations.Error)
+		if extractorRetries == 0 && loaderRetries == 0 && !failed && message == "" {
+			continue
+		}
+		index := slices.IndexFunc(
+			history.Nodes,
+			func(record v1alpha1.ClusterUpgradeNodeRecord) bool {
+				return record.Name == node.Name
+			},
+		)
+		if index == -1 {
+			history.Nodes = append(history.Nodes, v1alpha1.ClusterUpgradeNodeRecord{
+				Name: node.Name,
+			})
+			index = len(history.Nodes) - 1
+		}
+		record := &history.Nodes[index]
+		if extractorRetries > record.ExtractorRetries {
+			record.ExtractorRetries = extractorRetries
+		}
+		if loaderRetries > record.LoaderRetries {
+			record.LoaderRetries = loaderRetries
+		}
+		if failed {
+			record.Failed = true
+		}
+		if message != "" {
+			record.Error = message
+		}
+	}
+	slices.SortFunc(history.Nodes, func(a, b v1alpha1.ClusterUpgradeNodeRecord) bool {
+		return a.Name < b.Name
+	})
+}
+
+// findMetadata returns the bundle metadata from the first node that has it, or nil if no node has
+// it yet.
+func (t *controllerReconcileTask) findMetadata() (result *Metadata, err error) {
+	for _, node := range t.nodes {
+		result, err = t.readMetadata(node)
+		if err != nil || result != nil {
+			return
+		}
+	}
+	return
+}
+
 func (t *controllerReconcileTask) readMetadata(node *corev1.Node) (metadata *Metadata, err error) {
 	value := t.stringAnnotation(node, annotations.BundleMetadata)
 	if value == "" {
@@ -1062,7 +4047,7 @@ func (t *controllerReconcileTask) readMetadata(node *corev1.Node) (metadata *Met
 	if err != nil {
 		return
 	}
-	t.logger.Info(
+	t.logger.V(1).Info(
 		"Read metadata",
 		"node", node.Name,
 		"version", metadata.Version,
@@ -1094,6 +4079,24 @@ func (c *controllerReconcileTask) boolLabel(object clnt.Object, label string) bo
 	return result
 }
 
+func (t *controllerReconcileTask) boolAnnotation(object clnt.Object, name string) bool {
+	value := t.stringAnnotation(object, name)
+	if value == "" {
+		return false
+	}
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		t.logger.Error(
+			err,
+			"Invalid value for boolean annotation, will return false",
+			"annotation", name,
+			"value", value,
+		)
+		return false
+	}
+	return result
+}
+
 func (t *controllerReconcileTask) stringAnnotation(object clnt.Object, name string) string {
 	values := object.GetAnnotations()
 	if values == nil {
@@ -1120,11 +4123,183 @@ const (
 	controllerHostVolumePath      = "/"
 	controllerHostVolumeMountPath = "/host"
 
+	controllerTokenVolumeName      = "token"
+	controllerTokenVolumeMountPath = "/etc/upgrade-tool"
+	controllerTokenKey             = "token"
+
+	controllerCredentialsVolumeName      = "credentials"
+	controllerCredentialsVolumeMountPath = "/etc/upgrade-tool/credentials"
+
+	controllerRegistryCertVolumeName      = "registry-cert"
+	controllerRegistryCertVolumeMountPath = "/etc/upgrade-tool/registry-cert"
+
+	controllerFieldOwner = "upgrade-tool"
+
+	controllerServiceAccount = "controller"
+
+	// controllerWorkerRoleLabel is the label that identifies the worker nodes, which are the only
+	// ones that need the bundle in hosted mode.
+	controllerWorkerRoleLabel = "node-role.kubernetes.io/worker"
+
+	controllerRequeueDelay = 30 * time.Second
+
+	// controllerDefaultJobRetries is the default number of times that failed jobs are created
+	// again. The delay between retries starts with controllerRetryBaseDelay and doubles with each
+	// retry, up to controllerRetryMaxDelay.
+	controllerDefaultJobRetries = 3
+	controllerRetryBaseDelay    = 30 * time.Second
+	controllerRetryMaxDelay     = 10 * time.Minute
+
+	// controllerDefaultJobRetention is the default time that jobs are kept after they complete
+	// successfully.
+	controllerDefaultJobRetention = time.Hour
+
+	// controllerDefaultNodeLogLevel is the default log level of the programs that run in the
+	// nodes.
+	controllerDefaultNodeLogLevel = 1
+
+	// controllerMaxPhaseRecords is the maximum number of phase changes that are kept in the
+	// history of an upgrade. When there are more the oldest ones are discarded.
+	controllerMaxPhaseRecords = 50
+
+	// controllerDrainTimeout is the time that the bundle server waits for downloads in progress
+	// when the pod is stopped. The termination grace period of the pod is a bit longer.
+	controllerDrainTimeout = 5 * time.Minute
+
+	controllerBundleDir = "/var/lib/upgrade"
+
 	controllerImage           = "quay.io/jhernand/upgrade-tool:latest"
 	controllerImagePullPolicy = corev1.PullIfNotPresent
 
+	// Distribution modes:
+	controllerDistributionJobs      = "jobs"
+	controllerDistributionDaemonSet = "daemonset"
+
+	bundleAgent     = "bundle-agent"
 	bundleCleaner   = "bundle-cleaner"
 	bundleExtractor = "bundle-extractor"
 	bundleLoader    = "bundle-loader"
 	bundleServer    = "bundle-server"
+
+	bundleServerToken = "bundle-server-token"
 )
+
+// controllerHostedClusterGVK is the group, version and kind of the HostedCluster objects that
+// describe hosted clusters in the management cluster.
+var controllerHostedClusterGVK = schema.GroupVersionKind{
+	Group:   "hypershift.openshift.io",
+	Version: "v1beta1",
+	Kind:    "HostedCluster",
+}
+
+// controllerPermissions are the permissions that the controller needs to watch the cluster version,
+// the nodes and the custom resources, to read the cluster operators and the etcd pods checked
+// before starting the upgrade, and to create the jobs, daemon sets and other objects used to
+// distribute the bundle. Note that the additional manifests included in bundles may need other
+// permissions that have to be granted explicitly.
+var controllerPermissions = rbacPermissions{
+	cluster: []rbacv1.PolicyRule{
+		{
+			APIGroups: []string{configv1.GroupName},
+			Resources: []string{"clusterversions"},
+			Verbs:     []string{"get", "list", "watch", "patch", "update"},
+		},
+		{
+			APIGroups: []string{configv1.GroupName},
+			Resources: []string{"clusteroperators"},
+			Verbs:     []string{"get", "list"},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"pods"},
+			Verbs:     []string{"list"},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"nodes"},
+			Verbs:     []string{"get", "list", "watch", "patch"},
+		},
+		{
+			APIGroups: []string{"machineconfiguration.openshift.io"},
+			Resources: []string{"machineconfigpools"},
+			Verbs:     []string{"get", "list", "patch"},
+		},
+		{
+			APIGroups: []string{controllerHostedClusterGVK.Group},
+			Resources: []string{"hostedclusters"},
+			Verbs:     []string{"get", "patch"},
+		},
+		{
+			APIGroups: []string{managedClusterListGVK.Group},
+			Resources: []string{"managedclusters"},
+			Verbs:     []string{"get", "list"},
+		},
+		{
+			APIGroups: []string{manifestWorkGVK.Group},
+			Resources: []string{"manifestworks"},
+			Verbs:     []string{"get", "list", "create", "update", "delete"},
+		},
+		{
+			APIGroups: []string{rbacv1.GroupName},
+			Resources: []string{"clusterrolebindings"},
+			Verbs:     []string{"create", "delete"},
+		},
+	},
+	namespace: []rbacv1.PolicyRule{
+		{
+			APIGroups: []string{v1alpha1.GroupVersion.Group},
+			Resources: []string{"clusterupgrades", "bundlecreations"},
+			Verbs:     []string{"get", "list", "watch"},
+		},
+		{
+			APIGroups: []string{v1alpha1.GroupVersion.Group},
+			Resources: []string{"managedclusterupgrades"},
+			Verbs:     []string{"get", "list", "watch", "patch"},
+		},
+		{
+			APIGroups: []string{v1alpha1.GroupVersion.Group},
+			Resources: []string{
+				"clusterupgrades/status",
+				"bundlecreations/status",
+				"managedclusterupgrades/status",
+			},
+			Verbs: []string{"get", "update", "patch"},
+		},
+		{
+			APIGroups: []string{v1alpha1.GroupVersion.Group},
+			Resources: []string{"bundlecreations/finalizers", "managedclusterupgrades/finalizers"},
+			Verbs:     []string{"update"},
+		},
+		{
+			APIGroups: []string{batchv1.GroupName},
+			Resources: []string{"jobs"},
+			Verbs:     []string{"get", "list", "watch", "create", "delete"},
+		},
+		{
+			APIGroups: []string{appsv1.GroupName},
+			Resources: []string{"daemonsets"},
+			Verbs:     []string{"get", "list", "watch", "create", "update", "delete"},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"services", "secrets"},
+			Verbs:     []string{"get", "list", "watch", "create", "delete"},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"pods"},
+			Verbs:     []string{"get", "list", "watch"},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"serviceaccounts"},
+			Verbs:     []string{"create", "delete"},
+		},
+		{
+			APIGroups: []string{rbacv1.GroupName},
+			Resources: []string{"rolebindings"},
+			Verbs:     []string{"create", "delete"},
+		},
+	},
+	binder: true,
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+	"github.com/jhernand/upgrade-tool/internal/labels"
+)
+
+// controllerMetrics contains the Prometheus metrics of the controller. The methods can be called
+// with a nil receiver, and then they do nothing, so that the reconciliation logic can also be used
+// without metrics, for example in the simulator.
+type controllerMetrics struct {
+	nodes       *prometheus.GaugeVec
+	phases      *prometheus.GaugeVec
+	retries     *prometheus.GaugeVec
+	errors      prometheus.Counter
+	distributed prometheus.Counter
+
+	// lock protects the fields below, as the reconcilers of the different kinds of objects can
+	// run in parallel.
+	lock       sync.Mutex
+	phase      v1alpha1.ClusterUpgradePhase
+	phaseStart time.Time
+	downloaded map[string]int64
+}
+
+func newControllerMetrics(registerer prometheus.Registerer) (result *controllerMetrics,
+	err error) {
+	nodes := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: controllerMetricsNamespace,
+			Subsystem: controllerMetricsSubsystem,
+			Name:      "nodes",
+			Help:      "Number of nodes, per phase of the upgrade.",
+		},
+		[]string{"phase"},
+	)
+	phases := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: controllerMetricsNamespace,
+			Subsystem: controllerMetricsSubsystem,
+			Name:      "phase_seconds",
+			Help: "Time spent in each phase of the upgrade. The value of the current " +
+				"phase grows, and the values of the previous phases stay fixed.",
+		},
+		[]string{"phase"},
+	)
+	retries := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: controllerMetricsNamespace,
+			Subsystem: controllerMetricsSubsystem,
+			Name:      "job_retries",
+			Help: "Number of times that the pods of the jobs failed and were retried, " +
+				"per kind of job.",
+		},
+		[]string{"job"},
+	)
+	failures := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: controllerMetricsNamespace,
+			Subsystem: controllerMetricsSubsystem,
+			Name:      "reconcile_errors_total",
+			Help:      "Number of reconciliation cycles that failed.",
+		},
+	)
+	distributed := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: controllerMetricsNamespace,
+			Subsystem: controllerMetricsSubsystem,
+			Name:      "distributed_bytes_total",
+			Help: "Number of bytes of the bundle downloaded by the nodes, as reported " +
+				"by the extractors. The rate of this is the distribution throughput.",
+		},
+	)
+	collectors := []prometheus.Collector{
+		nodes,
+		phases,
+		retries,
+		failures,
+		distributed,
+	}
+	for _, collector := range collectors {
+		err = registerer.Register(collector)
+		if err != nil {
+			return
+		}
+	}
+	result = &controllerMetrics{
+		nodes:       nodes,
+		phases:      phases,
+		retries:     retries,
+		errors:      failures,
+		distributed: distributed,
+		downloaded:  map[string]int64{},
+	}
+	return
+}
+
+// observeError counts a failed reconciliation cycle.
+func (m *controllerMetrics) observeError() {
+	if m == nil {
+		return
+	}
+	m.errors.Inc()
+}
+
+// observePhase updates the time spent in the current phase of the upgrade.
+func (m *controllerMetrics) observePhase(phase v1alpha1.ClusterUpgradePhase) {
+	if m == nil || phase == "" {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	if phase != m.phase {
+		m.phase = phase
+		m.phaseStart = now
+	}
+	m.phases.WithLabelValues(string(phase)).Set(now.Sub(m.phaseStart).Seconds())
+}
+
+// restorePhase sets the time when the current phase of the upgrade started, so that the time spent
+// in it isn't reset when the controller is restarted.
+func (m *controllerMetrics) restorePhase(phase v1alpha1.ClusterUpgradePhase, start time.Time) {
+	if m == nil || phase == "" {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.phase = phase
+	m.phaseStart = start
+}
+
+// observeNodes updates the number of nodes per phase, and the number of bytes downloaded by the
+// extractors.
+func (m *controllerMetrics) observeNodes(nodes []*corev1.Node) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	counts := map[string]int{
+		controllerNodePending:   0,
+		controllerNodeExtracted: 0,
+		controllerNodeLoaded:    0,
+		controllerNodeFailed:    0,
+	}
+	downloaded := map[string]int64{}
+	for _, node := range nodes {
+		values := node.GetAnnotations()
+		nodeLabels := node.GetLabels()
+		switch {
+		case values[annotations.Error] != "":
+			counts[controllerNodeFailed]++
+		case nodeLabels[labels.BundleLoaded] == "true":
+			counts[controllerNodeLoaded]++
+		case nodeLabels[labels.BundleExtracted] == "true":
+			counts[controllerNodeExtracted]++
+		default:
+			counts[controllerNodePending]++
+		}
+
+		// Add the bytes downloaded since the previous cycle. If the count is smaller than
+		// the previous one it means that the download was restarted, and then all the bytes
+		// are new.
+		data := values[annotations.ProgressDetails]
+		if data == "" {
+			continue
+		}
+		var details ProgressDetails
+		err := json.Unmarshal([]byte(data), &details)
+		if err != nil || details.Phase != ProgressPhaseDownloading {
+			continue
+		}
+		previous := m.downloaded[node.Name]
+		delta := details.Bytes - previous
+		if details.Bytes < previous {
+			delta = details.Bytes
+		}
+		m.distributed.Add(float64(delta))
+		downloaded[node.Name] = details.Bytes
+	}
+	m.downloaded = downloaded
+	for phase, count := range counts {
+		m.nodes.WithLabelValues(phase).Set(float64(count))
+	}
+}
+
+// observeJobs updates the number of retries of the jobs, calculated adding the failed pods of
+// the jobs and the restarts of the containers of the pods that are still running.
+func (m *controllerMetrics) observeJobs(jobs []batchv1.Job, pods []corev1.Pod) {
+	if m == nil {
+		return
+	}
+	kinds := map[string]string{}
+	counts := map[string]int{}
+	for _, job := range jobs {
+		kind := job.Labels[labels.Job]
+		if kind == "" {
+			continue
+		}
+		kinds[job.Name] = kind
+		counts[kind] += int(job.Status.Failed)
+	}
+	for _, pod := range pods {
+		kind, ok := kinds[pod.Labels[controllerJobNameLabel]]
+		if !ok {
+			continue
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			counts[kind] += int(status.RestartCount)
+		}
+	}
+	m.retries.Reset()
+	for kind, count := range counts {
+		m.retries.WithLabelValues(kind).Set(float64(count))
+	}
+}
+
+const (
+	controllerMetricsNamespace = "upgrade_tool"
+	controllerMetricsSubsystem = "controller"
+
+	controllerNodePending   = "pending"
+	controllerNodeExtracted = "extracted"
+	controllerNodeLoaded    = "loaded"
+	controllerNodeFailed    = "failed"
+
+	// controllerJobNameLabel is the label that Kubernetes adds to the pods created by jobs.
+	controllerJobNameLabel = "job-name"
+)
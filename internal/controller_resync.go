@@ -0,0 +1,131 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+	"github.com/jhernand/upgrade-tool/internal/labels"
+)
+
+// resync rebuilds the view of the upgrade from the state of the cluster the first time that the
+// controller reconciles after starting, usually after a restart in the middle of an upgrade. The
+// reconciliation doesn't keep state in memory, the progress is stored in the labels and annotations
+// of the nodes, in the jobs and in the status of the ClusterUpgrade object, but some of those
+// objects may have changed while the controller wasn't running. Jobs that are still running are
+// adopted, as the reconciliation doesn't create again jobs that already exist. Jobs of nodes that
+// were removed from the cluster in the meantime are deleted, as they would never complete. The
+// given upgrade may be nil if there is no pending upgrade.
+func (c *Controller) resync(ctx context.Context, nodes []*corev1.Node,
+	upgrade *v1alpha1.ClusterUpgrade) error {
+	c.resyncLock.Lock()
+	defer c.resyncLock.Unlock()
+	if c.resynced {
+		return nil
+	}
+
+	// Restore the time when the current phase started, so that the metrics don't report it
+	// starting again:
+	var phase v1alpha1.ClusterUpgradePhase
+	if upgrade != nil {
+		phase = upgrade.Status.Phase
+		history := upgrade.Status.History
+		if history != nil && len(history.Phases) > 0 {
+			record := history.Phases[len(history.Phases)-1]
+			if record.EndTime == nil && record.Phase == phase {
+				c.metrics.restorePhase(phase, record.StartTime.Time)
+			}
+		}
+	}
+
+	// Find the jobs that are still running and delete the ones whose nodes no longer exist:
+	exists := map[string]bool{}
+	for _, node := range nodes {
+		exists[node.Name] = true
+	}
+	list := &batchv1.JobList{}
+	err := c.client.List(ctx, list, clnt.InNamespace(c.namespace), clnt.HasLabels{labels.Job})
+	if err != nil {
+		return err
+	}
+	deleted := 0
+	for i := range list.Items {
+		job := &list.Items[i]
+		switch job.Labels[labels.Job] {
+		case bundleExtractor, bundleLoader, bundleCleaner:
+		default:
+			continue
+		}
+		node := job.Spec.Template.Spec.NodeName
+		if job.DeletionTimestamp != nil || node == "" {
+			continue
+		}
+		if !exists[node] {
+			err = c.client.Delete(
+				ctx, job,
+				clnt.PropagationPolicy(metav1.DeletePropagationBackground),
+			)
+			if apierrors.IsNotFound(err) {
+				err = nil
+			}
+			if err != nil {
+				return err
+			}
+			c.logger.Info(
+				"Deleted job of node that no longer exists",
+				"job", job.Name,
+				"node", node,
+			)
+			deleted++
+			continue
+		}
+		if c.jobRunning(job) {
+			c.logger.V(1).Info(
+				"Found job in progress, will wait for it to finish",
+				"job", job.Name,
+				"node", node,
+			)
+		}
+	}
+
+	c.logger.Info(
+		"Resynchronized upgrade state from the cluster",
+		"phase", phase,
+		"nodes", len(nodes),
+		"deleted", deleted,
+	)
+	c.resynced = true
+	return nil
+}
+
+// jobRunning checks if the given job hasn't completed or failed yet.
+func (c *Controller) jobRunning(job *batchv1.Job) bool {
+	if job.Status.CompletionTime != nil {
+		return false
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+)
+
+// ControllerSimulatorBuilder contains the data and logic needed to create a controller simulator.
+// Don't create instances of this type directly, use the NewControllerSimulator function instead.
+type ControllerSimulatorBuilder struct {
+	logger    logr.Logger
+	console   *Console
+	namespace string
+	snapshot  string
+}
+
+// ControllerSimulator runs the reconciliation logic of the controller against a snapshot of the
+// cluster generated by the snapshot collector, and writes to the console the changes that the
+// controller would make, without actually making them. Don't create instances of this type
+// directly, use the NewControllerSimulator function instead.
+type ControllerSimulator struct {
+	logger    logr.Logger
+	console   *Console
+	namespace string
+	snapshot  string
+}
+
+// NewControllerSimulator creates a builder that can then be used to configure and create
+// controller simulators.
+func NewControllerSimulator() *ControllerSimulatorBuilder {
+	return &ControllerSimulatorBuilder{}
+}
+
+// SetLogger sets the logger that the simulator will use to write log messages. This is mandatory.
+func (b *ControllerSimulatorBuilder) SetLogger(value logr.Logger) *ControllerSimulatorBuilder {
+	b.logger = value
+	return b
+}
+
+// SetConsole sets the console that the simulator will use to report the decisions made by the
+// controller. This is mandatory.
+func (b *ControllerSimulatorBuilder) SetConsole(value *Console) *ControllerSimulatorBuilder {
+	b.console = value
+	return b
+}
+
+// SetNamespace sets the namespace where the controller would create the objects it needs. This is
+// mandatory.
+func (b *ControllerSimulatorBuilder) SetNamespace(value string) *ControllerSimulatorBuilder {
+	b.namespace = value
+	return b
+}
+
+// SetSnapshot sets the file containing the snapshot of the cluster. This is mandatory.
+func (b *ControllerSimulatorBuilder) SetSnapshot(value string) *ControllerSimulatorBuilder {
+	b.snapshot = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new controller simulator.
+func (b *ControllerSimulatorBuilder) Build() (result *ControllerSimulator, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+	if b.console == nil {
+		err = errors.New("console is mandatory")
+		return
+	}
+	if b.namespace == "" {
+		err = errors.New("namespace is mandatory")
+		return
+	}
+	if b.snapshot == "" {
+		err = errors.New("snapshot is mandatory")
+		return
+	}
+
+	// Create and populate the object:
+	result = &ControllerSimulator{
+		logger:    b.logger,
+		console:   b.console,
+		namespace: b.namespace,
+		snapshot:  b.snapshot,
+	}
+	return
+}
+
+// Run loads the snapshot and runs one reconciliation cycle.
+func (s *ControllerSimulator) Run(ctx context.Context) error {
+	// Load the snapshot:
+	data, err := os.ReadFile(s.snapshot)
+	if err != nil {
+		return err
+	}
+	objects, err := LoadSnapshot(data)
+	if err != nil {
+		return err
+	}
+	s.console.Info("Loaded %d objects from snapshot '%s'", len(objects), s.snapshot)
+
+	// Create a fake client that contains the objects of the snapshot, and wrap it so that we
+	// can report the changes:
+	scheme := snapshotScheme()
+	delegate := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objects...).
+		WithStatusSubresource(&v1alpha1.ClusterUpgrade{}).
+		Build()
+	client := &controllerSimulatorClient{
+		Client:  delegate,
+		console: s.console,
+	}
+
+	// Run the reconciliation logic of the controller, using cluster upgrade objects if the
+	// snapshot contains any:
+	clusterUpgrade := false
+	for _, object := range objects {
+		_, ok := object.(*v1alpha1.ClusterUpgrade)
+		if ok {
+			clusterUpgrade = true
+			break
+		}
+	}
+	controller := &Controller{
+		logger:         s.logger,
+		namespace:      s.namespace,
+		clusterUpgrade: clusterUpgrade,
+		jobRetries:     controllerDefaultJobRetries,
+		nodeLogLevel:   controllerDefaultNodeLogLevel,
+		client:         client,
+		upgradeClient:  client,
+	}
+	_, err = controller.Reconcile(ctx, ctrl.Request{})
+	if err != nil {
+		s.console.Error("Reconciliation failed: %v", err)
+		return err
+	}
+	if client.changes == 0 {
+		s.console.Info("Controller would make no changes")
+	} else {
+		s.console.Info("Controller would make %d changes", client.changes)
+	}
+	return nil
+}
+
+// controllerSimulatorClient wraps a client and writes to the console the changes that are applied
+// to the objects.
+type controllerSimulatorClient struct {
+	clnt.Client
+	console *Console
+	changes int
+}
+
+func (c *controllerSimulatorClient) Create(ctx context.Context, object clnt.Object,
+	opts ...clnt.CreateOption) error {
+	c.report("create", object)
+	return c.Client.Create(ctx, object, opts...)
+}
+
+func (c *controllerSimulatorClient) Update(ctx context.Context, object clnt.Object,
+	opts ...clnt.UpdateOption) error {
+	c.report("update", object)
+	return c.Client.Update(ctx, object, opts...)
+}
+
+func (c *controllerSimulatorClient) Patch(ctx context.Context, object clnt.Object,
+	patch clnt.Patch, opts ...clnt.PatchOption) error {
+	c.report("patch", object)
+
+	// The fake client doesn't support server side apply, so in that case we just report the
+	// change and do nothing else.
+	if patch.Type() == types.ApplyPatchType {
+		return nil
+	}
+	return c.Client.Patch(ctx, object, patch, opts...)
+}
+
+func (c *controllerSimulatorClient) Delete(ctx context.Context, object clnt.Object,
+	opts ...clnt.DeleteOption) error {
+	c.report("delete", object)
+	return c.Client.Delete(ctx, object, opts...)
+}
+
+func (c *controllerSimulatorClient) Status() clnt.SubResourceWriter {
+	return &controllerSimulatorStatusClient{
+		SubResourceWriter: c.Client.Status(),
+		parent:            c,
+	}
+}
+
+func (c *controllerSimulatorClient) report(verb string, object clnt.Object) {
+	c.changes++
+	kind := object.GetObjectKind().GroupVersionKind().Kind
+	if kind == "" {
+		gvk, err := apiutil.GVKForObject(object, c.Scheme())
+		if err == nil {
+			kind = gvk.Kind
+		}
+	}
+	c.console.Info("Would %s %s '%s'", verb, kind, object)
+}
+
+// controllerSimulatorStatusClient wraps the status writer of a client and writes to the console
+// the changes that are applied to the status of the objects.
+type controllerSimulatorStatusClient struct {
+	clnt.SubResourceWriter
+	parent *controllerSimulatorClient
+}
+
+func (c *controllerSimulatorStatusClient) Update(ctx context.Context, object clnt.Object,
+	opts ...clnt.SubResourceUpdateOption) error {
+	c.parent.report("update status of", object)
+	return c.SubResourceWriter.Update(ctx, object, opts...)
+}
+
+func (c *controllerSimulatorStatusClient) Patch(ctx context.Context, object clnt.Object,
+	patch clnt.Patch, opts ...clnt.SubResourcePatchOption) error {
+	c.parent.report("patch status of", object)
+	return c.SubResourceWriter.Patch(ctx, object, patch, opts...)
+}
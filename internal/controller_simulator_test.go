@@ -0,0 +1,143 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Controller simulator", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		tmp    string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create a temporary directory for the snapshot:
+		tmp, err = os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+	})
+
+	// simulate writes the given snapshot to a file, runs the simulator and returns the text
+	// written to the console.
+	simulate := func(snapshot string) string {
+		file := filepath.Join(tmp, "snapshot.yaml")
+		err := os.WriteFile(file, []byte(snapshot), 0600)
+		Expect(err).ToNot(HaveOccurred())
+		out := &bytes.Buffer{}
+		console, err := NewConsole().
+			SetLogger(logger).
+			SetOut(out).
+			SetErr(io.Discard).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		simulator, err := NewControllerSimulator().
+			SetLogger(logger).
+			SetConsole(console).
+			SetNamespace("upgrade-tool").
+			SetSnapshot(file).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		err = simulator.Run(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		return out.String()
+	}
+
+	It("Reports the jobs that the controller would create", func() {
+		text := simulate(`
+apiVersion: v1
+kind: List
+items:
+- apiVersion: config.openshift.io/v1
+  kind: ClusterVersion
+  metadata:
+    name: version
+- apiVersion: v1
+  kind: Node
+  metadata:
+    name: node0
+- apiVersion: v1
+  kind: Node
+  metadata:
+    name: node1
+    labels:
+      upgrade-tool/bundle-extracted: "true"
+- apiVersion: upgrade-tool.io/v1alpha1
+  kind: ClusterUpgrade
+  metadata:
+    namespace: upgrade-tool
+    name: my-upgrade
+  spec:
+    version: 4.13.4
+    bundle:
+      url: s3://bundles/4.13.4.tar
+`)
+		Expect(text).To(ContainSubstring("Loaded 4 objects from snapshot"))
+		Expect(text).To(ContainSubstring(
+			"Would create Job 'upgrade-tool/bundle-extractor-node0'",
+		))
+		Expect(text).To(ContainSubstring(
+			"Would create Job 'upgrade-tool/bundle-loader-node1'",
+		))
+		Expect(text).To(ContainSubstring(
+			"Would update status of ClusterUpgrade 'upgrade-tool/my-upgrade'",
+		))
+		Expect(text).ToNot(ContainSubstring("bundle-extractor-node1"))
+		Expect(text).To(MatchRegexp(`Controller would make \d+ changes`))
+	})
+
+	It("Reports that there are no changes when there is no upgrade", func() {
+		text := simulate(`
+apiVersion: v1
+kind: List
+items:
+- apiVersion: config.openshift.io/v1
+  kind: ClusterVersion
+  metadata:
+    name: version
+- apiVersion: v1
+  kind: Node
+  metadata:
+    name: node0
+`)
+		Expect(text).To(ContainSubstring("Loaded 2 objects from snapshot"))
+		Expect(text).ToNot(ContainSubstring("Would "))
+		Expect(text).To(ContainSubstring("Controller would make no changes"))
+	})
+})
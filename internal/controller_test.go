@@ -0,0 +1,2636 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+	"github.com/jhernand/upgrade-tool/internal/labels"
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Controller", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		ctx = context.Background()
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	// makeNode creates a node with the given labels and annotations.
+	makeNode := func(name string, labels, annotations map[string]string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Labels:      labels,
+				Annotations: annotations,
+			},
+		}
+	}
+
+	// makeVersion creates a cluster version with the given desired update and history.
+	makeVersion := func(desired *configv1.Update,
+		history ...configv1.UpdateHistory) *configv1.ClusterVersion {
+		return &configv1.ClusterVersion{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "version",
+			},
+			Spec: configv1.ClusterVersionSpec{
+				DesiredUpdate: desired,
+			},
+			Status: configv1.ClusterVersionStatus{
+				History: history,
+			},
+		}
+	}
+
+	// makeMetadata creates the bundle metadata annotations for a node.
+	makeMetadata := func() map[string]string {
+		data, err := json.Marshal(&Metadata{
+			Version: "4.13.4",
+			Arch:    "x86_64",
+			Release: "quay.io/openshift-release-dev/ocp-release@sha256:1234",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return map[string]string{
+			annotations.BundleMetadata: string(data),
+		}
+	}
+
+	// makeUpgrade creates a cluster upgrade that downloads the bundle from an URL.
+	makeUpgrade := func() *v1alpha1.ClusterUpgrade {
+		return &v1alpha1.ClusterUpgrade{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:  "upgrade-tool",
+				Name:       "my-upgrade",
+				Generation: 1,
+			},
+			Spec: v1alpha1.ClusterUpgradeSpec{
+				Version: "4.13.4",
+				Bundle: v1alpha1.ClusterUpgradeBundle{
+					URL: "s3://bundles/4.13.4.tar",
+				},
+			},
+		}
+	}
+
+	// makeClient creates a fake client containing the given cluster version, a cluster upgrade
+	// and the given nodes.
+	makeClient := func(version *configv1.ClusterVersion, nodes ...clnt.Object) clnt.Client {
+		upgrade := makeUpgrade()
+		return fake.NewClientBuilder().
+			WithScheme(snapshotScheme()).
+			WithObjects(version, upgrade).
+			WithObjects(nodes...).
+			WithStatusSubresource(upgrade).
+			Build()
+	}
+
+	// reconcileWithMetrics runs one reconciliation cycle updating the given metrics, and
+	// returns the resulting cluster upgrade.
+	reconcileWithMetrics := func(client clnt.Client,
+		metrics *controllerMetrics) *v1alpha1.ClusterUpgrade {
+		controller := &Controller{
+			logger:         logger,
+			namespace:      "upgrade-tool",
+			clusterUpgrade: true,
+			jobRetries:     controllerDefaultJobRetries,
+			metrics:        metrics,
+			client:         client,
+			upgradeClient:  client,
+		}
+		_, err := controller.Reconcile(ctx, ctrl.Request{})
+		Expect(err).ToNot(HaveOccurred())
+		upgrade := &v1alpha1.ClusterUpgrade{}
+		key := clnt.ObjectKey{
+			Namespace: "upgrade-tool",
+			Name:      "my-upgrade",
+		}
+		err = client.Get(ctx, key, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+		return upgrade
+	}
+
+	// reconcile runs one reconciliation cycle and returns the resulting cluster upgrade.
+	reconcile := func(client clnt.Client) *v1alpha1.ClusterUpgrade {
+		return reconcileWithMetrics(client, nil)
+	}
+
+	// updateRollout changes the rollout of the cluster upgrade using the given function.
+	updateRollout := func(client clnt.Client,
+		update func(rollout *v1alpha1.ClusterUpgradeRollout)) {
+		upgrade := &v1alpha1.ClusterUpgrade{}
+		key := clnt.ObjectKey{
+			Namespace: "upgrade-tool",
+			Name:      "my-upgrade",
+		}
+		err := client.Get(ctx, key, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+		update(&upgrade.Spec.Rollout)
+		err = client.Update(ctx, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	// jobNodes returns the names of the nodes where jobs have been created.
+	jobNodes := func(client clnt.Client) []string {
+		jobs := &batchv1.JobList{}
+		err := client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+		Expect(err).ToNot(HaveOccurred())
+		var result []string
+		for _, job := range jobs.Items {
+			result = append(result, job.Spec.Template.Spec.NodeName)
+		}
+		return result
+	}
+
+	It("Starts the extractors described by the cluster upgrade", func() {
+		client := makeClient(
+			makeVersion(nil),
+			makeNode("node0", nil, nil),
+			makeNode("node1", nil, nil),
+		)
+		upgrade := reconcile(client)
+
+		// Check the jobs:
+		jobs := &batchv1.JobList{}
+		err := client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(jobs.Items).To(HaveLen(2))
+		command := jobs.Items[0].Spec.Template.Spec.Containers[0].Command
+		Expect(command).To(ContainElement("--bundle-url=s3://bundles/4.13.4.tar"))
+		Expect(command).To(ContainElement("--expected-version=4.13.4"))
+
+		// Check the status:
+		Expect(upgrade.Status.ObservedGeneration).To(BeEquivalentTo(1))
+		Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeExtracting))
+		Expect(upgrade.Status.Nodes).To(Equal(2))
+		Expect(upgrade.Status.ExtractedNodes).To(BeZero())
+		Expect(upgrade.Status.LoadedNodes).To(BeZero())
+		distributed := meta.FindStatusCondition(
+			upgrade.Status.Conditions,
+			v1alpha1.ClusterUpgradeBundleDistributed,
+		)
+		Expect(distributed).ToNot(BeNil())
+		Expect(distributed.Status).To(Equal(metav1.ConditionFalse))
+		Expect(distributed.Reason).To(Equal(v1alpha1.ClusterUpgradeDistributingReason))
+		Expect(distributed.Message).To(Equal("Bundle has been extracted in 0 of 2 nodes"))
+		Expect(distributed.ObservedGeneration).To(BeEquivalentTo(1))
+		Expect(distributed.LastTransitionTime.IsZero()).To(BeFalse())
+		Expect(meta.IsStatusConditionFalse(
+			upgrade.Status.Conditions,
+			v1alpha1.ClusterUpgradeDegraded,
+		)).To(BeTrue())
+	})
+
+	Describe("Pull order", func() {
+		// loaderCommand runs one reconciliation cycle with a node that has the bundle
+		// extracted and returns the command of the bundle loader job created for it.
+		loaderCommand := func(annotation, pullOrder string) []string {
+			version := makeVersion(nil)
+			if annotation != "" {
+				version.SetAnnotations(map[string]string{
+					annotations.PullOrder: annotation,
+				})
+			}
+			client := makeClient(
+				version,
+				makeNode("node0", map[string]string{
+					labels.BundleExtracted: "true",
+				}, nil),
+			)
+			upgrade := &v1alpha1.ClusterUpgrade{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			}
+			err := client.Get(ctx, key, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			upgrade.Spec.PullOrder = pullOrder
+			err = client.Update(ctx, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			reconcile(client)
+			jobs := &batchv1.JobList{}
+			err = client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(jobs.Items).To(HaveLen(1))
+			Expect(jobs.Items[0].Labels[labels.Job]).To(Equal(bundleLoader))
+			return jobs.Items[0].Spec.Template.Spec.Containers[0].Command
+		}
+
+		It("Passes the pull order of the spec to the loaders", func() {
+			command := loaderCommand("", PullOrderSize)
+			Expect(command).To(ContainElement("--pull-order=size"))
+		})
+
+		It("Prefers the pull order of the spec to the annotation", func() {
+			command := loaderCommand(PullOrderPriority, PullOrderSize)
+			Expect(command).To(ContainElement("--pull-order=size"))
+			Expect(command).ToNot(ContainElement("--pull-order=priority"))
+		})
+
+		It("Uses the annotation when the spec doesn't have a pull order", func() {
+			command := loaderCommand(PullOrderPriority, "")
+			Expect(command).To(ContainElement("--pull-order=priority"))
+		})
+
+		It("Doesn't pass the pull order when it isn't configured", func() {
+			command := loaderCommand("", "")
+			Expect(command).ToNot(ContainElement(HavePrefix("--pull-order=")))
+		})
+	})
+
+	Describe("Keep bundle", func() {
+		// loaderCommand runs one reconciliation cycle with a node that has the bundle
+		// extracted and returns the command of the bundle loader job created for it.
+		loaderCommand := func(keepBundle string) []string {
+			version := makeVersion(nil)
+			if keepBundle != "" {
+				version.SetAnnotations(map[string]string{
+					annotations.KeepBundle: keepBundle,
+				})
+			}
+			client := makeClient(
+				version,
+				makeNode("node0", map[string]string{
+					labels.BundleExtracted: "true",
+				}, nil),
+			)
+			reconcile(client)
+			jobs := &batchv1.JobList{}
+			err := client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(jobs.Items).To(HaveLen(1))
+			Expect(jobs.Items[0].Labels[labels.Job]).To(Equal(bundleLoader))
+			return jobs.Items[0].Spec.Template.Spec.Containers[0].Command
+		}
+
+		It("Asks the loaders to keep the bundle when the annotation is set", func() {
+			command := loaderCommand("true")
+			Expect(command).To(ContainElement("--keep-bundle=true"))
+		})
+
+		It("Doesn't ask the loaders to keep the bundle when the annotation is false", func() {
+			command := loaderCommand("false")
+			Expect(command).ToNot(ContainElement(HavePrefix("--keep-bundle")))
+		})
+
+		It("Doesn't ask the loaders to keep the bundle by default", func() {
+			command := loaderCommand("")
+			Expect(command).ToNot(ContainElement(HavePrefix("--keep-bundle")))
+		})
+	})
+
+	It("Reports degraded when nodes have errors", func() {
+		client := makeClient(
+			makeVersion(nil),
+			makeNode("node0", nil, map[string]string{
+				annotations.Error: "Not enough disk space",
+			}),
+			makeNode("node1", nil, nil),
+		)
+		upgrade := reconcile(client)
+		degraded := meta.FindStatusCondition(
+			upgrade.Status.Conditions,
+			v1alpha1.ClusterUpgradeDegraded,
+		)
+		Expect(degraded).ToNot(BeNil())
+		Expect(degraded.Status).To(Equal(metav1.ConditionTrue))
+		Expect(degraded.Reason).To(Equal(v1alpha1.ClusterUpgradeNodeErrorsReason))
+		Expect(degraded.Message).To(ContainSubstring("node0"))
+		Expect(degraded.Message).ToNot(ContainSubstring("node1"))
+	})
+
+	It("Preserves the transition time of conditions that don't change", func() {
+		client := makeClient(
+			makeVersion(nil),
+			makeNode("node0", nil, nil),
+		)
+		first := reconcile(client)
+		second := reconcile(client)
+		Expect(second.Status.Conditions).To(Equal(first.Status.Conditions))
+	})
+
+	It("Ignores the desired update of a previous upgrade", func() {
+		client := makeClient(
+			makeVersion(
+				&configv1.Update{
+					Version: "4.12.20",
+					Image:   "quay.io/openshift-release-dev/ocp-release@sha256:5678",
+				},
+				configv1.UpdateHistory{
+					State:   configv1.CompletedUpdate,
+					Version: "4.12.20",
+					Image:   "quay.io/openshift-release-dev/ocp-release@sha256:5678",
+				},
+			),
+			makeNode("node0", nil, nil),
+		)
+		upgrade := reconcile(client)
+		Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeExtracting))
+	})
+
+	It("Requests the upgrade when all nodes are ready", func() {
+		ready := map[string]string{
+			labels.BundleExtracted: "true",
+			labels.BundleLoaded:    "true",
+		}
+		client := makeClient(
+			makeVersion(nil),
+			makeNode("node0", ready, makeMetadata()),
+			makeNode("node1", ready, nil),
+		)
+		upgrade := reconcile(client)
+
+		// Check the cluster version:
+		version := &configv1.ClusterVersion{}
+		err := client.Get(ctx, clnt.ObjectKey{Name: "version"}, version)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(version.Spec.DesiredUpdate).ToNot(BeNil())
+		Expect(version.Spec.DesiredUpdate.Image).To(Equal(
+			"quay.io/openshift-release-dev/ocp-release@sha256:1234",
+		))
+		Expect(version.Spec.DesiredUpdate.Force).To(BeFalse())
+
+		// Check the status:
+		Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeUpgrading))
+		Expect(upgrade.Status.ExtractedNodes).To(Equal(2))
+		Expect(upgrade.Status.LoadedNodes).To(Equal(2))
+		conditions := upgrade.Status.Conditions
+		Expect(meta.IsStatusConditionTrue(
+			conditions, v1alpha1.ClusterUpgradeBundleDistributed,
+		)).To(BeTrue())
+		Expect(meta.IsStatusConditionTrue(
+			conditions, v1alpha1.ClusterUpgradeImagesLoaded,
+		)).To(BeTrue())
+		Expect(meta.IsStatusConditionTrue(
+			conditions, v1alpha1.ClusterUpgradeUpgradeTriggered,
+		)).To(BeTrue())
+		Expect(meta.IsStatusConditionFalse(
+			conditions, v1alpha1.ClusterUpgradeUpgradeCompleted,
+		)).To(BeTrue())
+	})
+
+	It("Forces the upgrade when requested in the spec", func() {
+		ready := map[string]string{
+			labels.BundleExtracted: "true",
+			labels.BundleLoaded:    "true",
+		}
+		client := makeClient(
+			makeVersion(nil),
+			makeNode("node0", ready, makeMetadata()),
+		)
+		upgrade := &v1alpha1.ClusterUpgrade{}
+		key := clnt.ObjectKey{
+			Namespace: "upgrade-tool",
+			Name:      "my-upgrade",
+		}
+		err := client.Get(ctx, key, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+		upgrade.Spec.Force = true
+		err = client.Update(ctx, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+		reconcile(client)
+		version := &configv1.ClusterVersion{}
+		err = client.Get(ctx, clnt.ObjectKey{Name: "version"}, version)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(version.Spec.DesiredUpdate).ToNot(BeNil())
+		Expect(version.Spec.DesiredUpdate.Force).To(BeTrue())
+	})
+
+	Describe("Update graph", func() {
+		ready := map[string]string{
+			labels.BundleExtracted: "true",
+			labels.BundleLoaded:    "true",
+		}
+
+		// makeGraphMetadata creates the bundle metadata annotations for a node, with an
+		// update graph that supports the update from 4.13.3 to 4.13.4.
+		makeGraphMetadata := func() map[string]string {
+			data, err := json.Marshal(&Metadata{
+				Version: "4.13.4",
+				Arch:    "x86_64",
+				Release: "quay.io/openshift-release-dev/ocp-release@sha256:1234",
+				Graph: &UpdateGraph{
+					Channel: "stable-4.13",
+					Nodes: []UpdateGraphNode{
+						{Version: "4.13.4"},
+						{Version: "4.13.3"},
+					},
+					Edges: [][2]int{
+						{1, 0},
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			return map[string]string{
+				annotations.BundleMetadata: string(data),
+			}
+		}
+
+		// makeCurrentVersion creates a cluster version whose current version is the given
+		// one.
+		makeCurrentVersion := func(current string) *configv1.ClusterVersion {
+			version := makeVersion(nil)
+			version.Status.Desired.Version = current
+			return version
+		}
+
+		// getVersion returns the cluster version.
+		getVersion := func(client clnt.Client) *configv1.ClusterVersion {
+			version := &configv1.ClusterVersion{}
+			err := client.Get(ctx, clnt.ObjectKey{Name: "version"}, version)
+			Expect(err).ToNot(HaveOccurred())
+			return version
+		}
+
+		It("Requests the upgrade when it is supported", func() {
+			client := makeClient(
+				makeCurrentVersion("4.13.3"),
+				makeNode("node0", ready, makeGraphMetadata()),
+			)
+			upgrade := reconcile(client)
+			version := getVersion(client)
+			Expect(version.Spec.DesiredUpdate).ToNot(BeNil())
+			Expect(version.Spec.DesiredUpdate.Version).To(Equal("4.13.4"))
+			Expect(version.Spec.Channel).To(Equal("stable-4.13"))
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeUpgrading))
+			Expect(meta.IsStatusConditionFalse(
+				upgrade.Status.Conditions, v1alpha1.ClusterUpgradeDegraded,
+			)).To(BeTrue())
+		})
+
+		It("Refuses to request the upgrade when it isn't supported", func() {
+			client := makeClient(
+				makeCurrentVersion("4.13.2"),
+				makeNode("node0", ready, makeGraphMetadata()),
+			)
+			upgrade := reconcile(client)
+			version := getVersion(client)
+			Expect(version.Spec.DesiredUpdate).To(BeNil())
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeLoading))
+			Expect(upgrade.Status.Message).To(ContainSubstring("allowUnsupportedUpdate"))
+			condition := meta.FindStatusCondition(
+				upgrade.Status.Conditions,
+				v1alpha1.ClusterUpgradeDegraded,
+			)
+			Expect(condition).ToNot(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+			Expect(condition.Reason).To(Equal(
+				v1alpha1.ClusterUpgradeUnsupportedUpdateReason,
+			))
+			Expect(condition.Message).To(ContainSubstring("'4.13.2'"))
+		})
+
+		It("Requests the upgrade that isn't supported when allowed in the spec", func() {
+			client := makeClient(
+				makeCurrentVersion("4.13.2"),
+				makeNode("node0", ready, makeGraphMetadata()),
+			)
+			upgrade := &v1alpha1.ClusterUpgrade{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			}
+			err := client.Get(ctx, key, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			upgrade.Spec.AllowUnsupportedUpdate = true
+			err = client.Update(ctx, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			upgrade = reconcile(client)
+			version := getVersion(client)
+			Expect(version.Spec.DesiredUpdate).ToNot(BeNil())
+			Expect(version.Spec.DesiredUpdate.Image).To(Equal(
+				"quay.io/openshift-release-dev/ocp-release@sha256:1234",
+			))
+			Expect(version.Spec.DesiredUpdate.Version).To(BeEmpty())
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeUpgrading))
+		})
+	})
+
+	It("Reports the progress of the cluster version operator", func() {
+		ready := map[string]string{
+			labels.BundleExtracted: "true",
+			labels.BundleLoaded:    "true",
+		}
+		version := makeVersion(&configv1.Update{
+			Image: "quay.io/openshift-release-dev/ocp-release@sha256:1234",
+			Force: true,
+		})
+		version.Status.Conditions = []configv1.ClusterOperatorStatusCondition{{
+			Type:    configv1.OperatorProgressing,
+			Status:  configv1.ConditionTrue,
+			Message: "Working towards 4.13.4: 106 of 841 done (12% complete)",
+		}}
+		client := makeClient(version, makeNode("node0", ready, makeMetadata()))
+		upgrade := reconcile(client)
+		Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeUpgrading))
+		Expect(upgrade.Status.Message).To(Equal(
+			"Upgrade is in progress: Working towards 4.13.4: 106 of 841 done " +
+				"(12% complete)",
+		))
+	})
+
+	It("Reports the completion of the upgrade", func() {
+		ready := map[string]string{
+			labels.BundleExtracted: "true",
+			labels.BundleLoaded:    "true",
+		}
+		client := makeClient(
+			makeVersion(
+				&configv1.Update{
+					Image: "quay.io/openshift-release-dev/ocp-release@sha256:1234",
+					Force: true,
+				},
+				configv1.UpdateHistory{
+					State:   configv1.CompletedUpdate,
+					Version: "4.13.4",
+					Image:   "quay.io/openshift-release-dev/ocp-release@sha256:1234",
+				},
+			),
+			makeNode("node0", ready, makeMetadata()),
+		)
+		upgrade := reconcile(client)
+		Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeCompleted))
+		Expect(upgrade.Status.Message).To(Equal("Upgrade to version '4.13.4' has completed"))
+		Expect(meta.IsStatusConditionTrue(
+			upgrade.Status.Conditions,
+			v1alpha1.ClusterUpgradeUpgradeCompleted,
+		)).To(BeTrue())
+	})
+
+	// makePool creates a machine config pool with the given name, paused state and annotations.
+	// The pool selects the nodes that have the 'node-role.kubernetes.io/<name>' label.
+	makePool := func(name string, paused bool,
+		annotations map[string]string) *unstructured.Unstructured {
+		pool := &unstructured.Unstructured{}
+		pool.SetAPIVersion("machineconfiguration.openshift.io/v1")
+		pool.SetKind("MachineConfigPool")
+		pool.SetName(name)
+		pool.SetAnnotations(annotations)
+		err := unstructured.SetNestedField(pool.Object, paused, "spec", "paused")
+		Expect(err).ToNot(HaveOccurred())
+		err = unstructured.SetNestedStringMap(
+			pool.Object,
+			map[string]string{
+				"node-role.kubernetes.io/" + name: "",
+			},
+			"spec", "nodeSelector", "matchLabels",
+		)
+		Expect(err).ToNot(HaveOccurred())
+		return pool
+	}
+
+	// getPool returns the machine config pool with the given name.
+	getPool := func(client clnt.Client, name string) *unstructured.Unstructured {
+		pool := &unstructured.Unstructured{}
+		pool.SetAPIVersion("machineconfiguration.openshift.io/v1")
+		pool.SetKind("MachineConfigPool")
+		err := client.Get(ctx, clnt.ObjectKey{Name: name}, pool)
+		Expect(err).ToNot(HaveOccurred())
+		return pool
+	}
+
+	// isPaused checks if the machine config pool with the given name is paused.
+	isPaused := func(client clnt.Client, name string) bool {
+		pool := getPool(client, name)
+		paused, _, err := unstructured.NestedBool(pool.Object, "spec", "paused")
+		Expect(err).ToNot(HaveOccurred())
+		return paused
+	}
+
+	Describe("Machine config pools", func() {
+		worker := map[string]string{
+			"node-role.kubernetes.io/worker": "",
+		}
+
+		It("Pauses the pools of the nodes that are loading the images", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", map[string]string{
+					"node-role.kubernetes.io/worker": "",
+					labels.BundleExtracted:           "true",
+				}, nil),
+				makePool("worker", false, nil),
+				makePool("master", false, nil),
+			)
+			upgrade := reconcile(client)
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeLoading))
+			Expect(isPaused(client, "worker")).To(BeTrue())
+			Expect(getPool(client, "worker").GetAnnotations()).To(HaveKeyWithValue(
+				annotations.PoolPaused, "true",
+			))
+			Expect(isPaused(client, "master")).To(BeFalse())
+		})
+
+		It("Pauses the pools of the nodes that are extracting the bundle", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", worker, nil),
+				makePool("worker", false, nil),
+			)
+			upgrade := reconcile(client)
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeExtracting))
+			Expect(isPaused(client, "worker")).To(BeTrue())
+		})
+
+		It("Resumes the pools when the images have been loaded", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", map[string]string{
+					"node-role.kubernetes.io/worker": "",
+					labels.BundleExtracted:           "true",
+					labels.BundleLoaded:              "true",
+				}, makeMetadata()),
+				makePool("worker", true, map[string]string{
+					annotations.PoolPaused: "true",
+				}),
+			)
+			upgrade := reconcile(client)
+			Expect(isPaused(client, "worker")).To(BeFalse())
+			Expect(getPool(client, "worker").GetAnnotations()).ToNot(HaveKey(
+				annotations.PoolPaused,
+			))
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeUpgrading))
+		})
+
+		It("Doesn't resume the pools that were paused by the user", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", map[string]string{
+					"node-role.kubernetes.io/worker": "",
+					labels.BundleExtracted:           "true",
+					labels.BundleLoaded:              "true",
+				}, makeMetadata()),
+				makePool("worker", true, nil),
+			)
+			reconcile(client)
+			Expect(isPaused(client, "worker")).To(BeTrue())
+		})
+
+		It("Doesn't pause the pools while the upgrade is paused", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", worker, nil),
+				makePool("worker", false, nil),
+			)
+			upgrade := &v1alpha1.ClusterUpgrade{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			}
+			err := client.Get(ctx, key, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			upgrade.Spec.Paused = true
+			err = client.Update(ctx, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			reconcile(client)
+			Expect(isPaused(client, "worker")).To(BeFalse())
+		})
+	})
+
+	Describe("Preflight checks", func() {
+		// reconcilePreflight runs one reconciliation cycle with the preflight checks enabled
+		// and returns the resulting cluster upgrade.
+		reconcilePreflight := func(client clnt.Client) *v1alpha1.ClusterUpgrade {
+			controller := &Controller{
+				logger:          logger,
+				namespace:       "upgrade-tool",
+				clusterUpgrade:  true,
+				jobRetries:      controllerDefaultJobRetries,
+				client:          client,
+				upgradeClient:   client,
+				preflight:       true,
+				preflightReader: client,
+			}
+			_, err := controller.Reconcile(ctx, ctrl.Request{})
+			Expect(err).ToNot(HaveOccurred())
+			upgrade := &v1alpha1.ClusterUpgrade{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			}
+			err = client.Get(ctx, key, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			return upgrade
+		}
+
+		// makeReadyNode creates a node that has the ready condition.
+		makeReadyNode := func(name string) *corev1.Node {
+			node := makeNode(name, nil, nil)
+			node.Status.Conditions = []corev1.NodeCondition{{
+				Type:   corev1.NodeReady,
+				Status: corev1.ConditionTrue,
+			}}
+			return node
+		}
+
+		It("Doesn't start the extractors when the checks fail", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeReadyNode("node0"),
+				makeNode("node1", nil, nil),
+			)
+			upgrade := reconcilePreflight(client)
+			Expect(jobNodes(client)).To(BeEmpty())
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradePending))
+			Expect(upgrade.Status.Message).To(ContainSubstring("Nodes node1 aren't ready"))
+			condition := meta.FindStatusCondition(
+				upgrade.Status.Conditions,
+				v1alpha1.ClusterUpgradePreflightChecksPassed,
+			)
+			Expect(condition).ToNot(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal(v1alpha1.ClusterUpgradePreflightFailedReason))
+			Expect(condition.Message).To(Equal("Nodes node1 aren't ready"))
+		})
+
+		It("Starts the extractors when the checks pass", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeReadyNode("node0"),
+			)
+			upgrade := reconcilePreflight(client)
+			Expect(jobNodes(client)).To(ConsistOf("node0"))
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeExtracting))
+			condition := meta.FindStatusCondition(
+				upgrade.Status.Conditions,
+				v1alpha1.ClusterUpgradePreflightChecksPassed,
+			)
+			Expect(condition).ToNot(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+			Expect(condition.Reason).To(Equal(v1alpha1.ClusterUpgradePassedReason))
+		})
+
+		It("Starts the extractors when the checks are skipped", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+			)
+			upgrade := &v1alpha1.ClusterUpgrade{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			}
+			err := client.Get(ctx, key, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			upgrade.Spec.SkipPreflightChecks = true
+			err = client.Update(ctx, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			upgrade = reconcilePreflight(client)
+			Expect(jobNodes(client)).To(ConsistOf("node0"))
+			condition := meta.FindStatusCondition(
+				upgrade.Status.Conditions,
+				v1alpha1.ClusterUpgradePreflightChecksPassed,
+			)
+			Expect(condition).ToNot(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+			Expect(condition.Reason).To(Equal(v1alpha1.ClusterUpgradeSkippedReason))
+		})
+	})
+
+	Describe("Nodes added during the upgrade", func() {
+		// makeRequestedVersion creates a cluster version where the upgrade to the release
+		// of the bundle has been requested but hasn't completed yet.
+		makeRequestedVersion := func() *configv1.ClusterVersion {
+			return makeVersion(&configv1.Update{
+				Image: "quay.io/openshift-release-dev/ocp-release@sha256:1234",
+				Force: true,
+			})
+		}
+
+		ready := map[string]string{
+			labels.BundleExtracted: "true",
+			labels.BundleLoaded:    "true",
+		}
+
+		It("Stages the new nodes and pauses the pools", func() {
+			client := makeClient(
+				makeRequestedVersion(),
+				makeNode("node0", ready, makeMetadata()),
+				makeNode("node1", map[string]string{
+					"node-role.kubernetes.io/worker": "",
+				}, nil),
+				makePool("worker", false, nil),
+			)
+			upgrade := reconcile(client)
+
+			// Check that the extractor has been started for the new node:
+			jobs := &batchv1.JobList{}
+			err := client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(jobs.Items).To(HaveLen(1))
+			Expect(jobs.Items[0].Spec.Template.Spec.NodeName).To(Equal("node1"))
+
+			// Check that the pool has been paused:
+			Expect(isPaused(client, "worker")).To(BeTrue())
+			Expect(getPool(client, "worker").GetAnnotations()).To(HaveKeyWithValue(
+				annotations.PoolPaused, "true",
+			))
+
+			// Check the status:
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeUpgrading))
+			Expect(upgrade.Status.Message).To(Equal(
+				"Upgrade has been requested, waiting for new nodes node1 to have the " +
+					"bundle",
+			))
+		})
+
+		It("Resumes only the pools that it paused when the new nodes are staged", func() {
+			client := makeClient(
+				makeRequestedVersion(),
+				makeNode("node0", ready, makeMetadata()),
+				makeNode("node1", ready, nil),
+				makePool("worker", true, map[string]string{
+					annotations.PoolPaused: "true",
+				}),
+				makePool("master", true, nil),
+			)
+			upgrade := reconcile(client)
+			Expect(isPaused(client, "worker")).To(BeFalse())
+			Expect(getPool(client, "worker").GetAnnotations()).ToNot(HaveKey(
+				annotations.PoolPaused,
+			))
+			Expect(isPaused(client, "master")).To(BeTrue())
+			Expect(upgrade.Status.Message).To(Equal("Upgrade has been requested"))
+		})
+
+		It("Doesn't stage new nodes once the upgrade has completed", func() {
+			version := makeRequestedVersion()
+			version.Status.History = []configv1.UpdateHistory{{
+				State:   configv1.CompletedUpdate,
+				Version: "4.13.4",
+				Image:   "quay.io/openshift-release-dev/ocp-release@sha256:1234",
+			}}
+			client := makeClient(
+				version,
+				makeNode("node0", ready, makeMetadata()),
+				makeNode("node1", nil, nil),
+			)
+			upgrade := reconcile(client)
+			jobs := &batchv1.JobList{}
+			err := client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(jobs.Items).To(BeEmpty())
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeCompleted))
+		})
+	})
+
+	It("Requests the commands to the bundle agent in daemon set mode", func() {
+		client := makeClient(
+			makeVersion(nil),
+			makeNode("node0", nil, nil),
+		)
+		controller := &Controller{
+			logger:         logger,
+			namespace:      "upgrade-tool",
+			clusterUpgrade: true,
+			jobRetries:     controllerDefaultJobRetries,
+			daemonSet:      true,
+			client:         client,
+			upgradeClient:  client,
+		}
+		_, err := controller.Reconcile(ctx, ctrl.Request{})
+		Expect(err).ToNot(HaveOccurred())
+
+		// Check that no job has been created:
+		jobs := &batchv1.JobList{}
+		err = client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(jobs.Items).To(BeEmpty())
+
+		// Check the daemon set:
+		daemonSet := &appsv1.DaemonSet{}
+		key := clnt.ObjectKey{
+			Namespace: "upgrade-tool",
+			Name:      bundleAgent,
+		}
+		err = client.Get(ctx, key, daemonSet)
+		Expect(err).ToNot(HaveOccurred())
+		container := daemonSet.Spec.Template.Spec.Containers[0]
+		Expect(container.Command).To(ContainElement("bundle-agent"))
+		Expect(container.Command).To(ContainElement("--node=$(NODE_NAME)"))
+
+		// Check the command requested to the agent:
+		node := &corev1.Node{}
+		err = client.Get(ctx, clnt.ObjectKey{Name: "node0"}, node)
+		Expect(err).ToNot(HaveOccurred())
+		var command []string
+		err = json.Unmarshal([]byte(node.Annotations[annotations.AgentCommand]), &command)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(command).ToNot(BeEmpty())
+		Expect(command[0]).To(Equal(bundleExtractor))
+		Expect(command).To(ContainElement("--node=node0"))
+		Expect(command).To(ContainElement("--bundle-url=s3://bundles/4.13.4.tar"))
+	})
+
+	Describe("Hosted clusters", func() {
+		// makeHostedCluster creates a hosted cluster with the given release image.
+		makeHostedCluster := func(image string) *unstructured.Unstructured {
+			object := &unstructured.Unstructured{}
+			object.SetGroupVersionKind(controllerHostedClusterGVK)
+			object.SetNamespace("clusters")
+			object.SetName("my-cluster")
+			err := unstructured.SetNestedField(object.Object, image, "spec", "release", "image")
+			Expect(err).ToNot(HaveOccurred())
+			return object
+		}
+
+		// makeManagementClient creates a fake client for the management cluster containing
+		// the cluster upgrade and the given hosted cluster.
+		makeManagementClient := func(hostedCluster *unstructured.Unstructured) clnt.Client {
+			upgrade := makeUpgrade()
+			return fake.NewClientBuilder().
+				WithScheme(snapshotScheme()).
+				WithObjects(upgrade, hostedCluster).
+				WithStatusSubresource(upgrade).
+				Build()
+		}
+
+		// reconcileHosted runs one reconciliation cycle in hosted mode and returns the
+		// resulting cluster upgrade, which is in the management cluster.
+		reconcileHosted := func(hostedClient,
+			managementClient clnt.Client) *v1alpha1.ClusterUpgrade {
+			controller := &Controller{
+				logger:         logger,
+				namespace:      "upgrade-tool",
+				clusterUpgrade: true,
+				jobRetries:     controllerDefaultJobRetries,
+				client:         hostedClient,
+				upgradeClient:  managementClient,
+				hostedCluster: clnt.ObjectKey{
+					Namespace: "clusters",
+					Name:      "my-cluster",
+				},
+			}
+			_, err := controller.Reconcile(ctx, ctrl.Request{})
+			Expect(err).ToNot(HaveOccurred())
+			upgrade := &v1alpha1.ClusterUpgrade{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			}
+			err = managementClient.Get(ctx, key, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			return upgrade
+		}
+
+		// getReleaseImage returns the release image of the hosted cluster.
+		getReleaseImage := func(client clnt.Client) string {
+			object := &unstructured.Unstructured{}
+			object.SetGroupVersionKind(controllerHostedClusterGVK)
+			key := clnt.ObjectKey{
+				Namespace: "clusters",
+				Name:      "my-cluster",
+			}
+			err := client.Get(ctx, key, object)
+			Expect(err).ToNot(HaveOccurred())
+			image, _, err := unstructured.NestedString(
+				object.Object, "spec", "release", "image",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			return image
+		}
+
+		release := "quay.io/openshift-release-dev/ocp-release@sha256:1234"
+
+		It("Stages only the worker nodes of the hosted cluster", func() {
+			hostedClient := fake.NewClientBuilder().
+				WithScheme(snapshotScheme()).
+				WithObjects(
+					makeVersion(nil),
+					makeNode("node0", map[string]string{
+						controllerWorkerRoleLabel: "",
+					}, nil),
+					makeNode("node1", map[string]string{
+						"node-role.kubernetes.io/master": "",
+					}, nil),
+				).
+				Build()
+			managementClient := makeManagementClient(makeHostedCluster(""))
+			upgrade := reconcileHosted(hostedClient, managementClient)
+
+			// Check that the job has been created in the hosted cluster only for the
+			// worker node:
+			jobs := &batchv1.JobList{}
+			err := hostedClient.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(jobs.Items).To(HaveLen(1))
+			Expect(jobs.Items[0].Spec.Template.Spec.NodeName).To(Equal("node0"))
+
+			// Check the status:
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeExtracting))
+			Expect(upgrade.Status.Nodes).To(Equal(1))
+		})
+
+		It("Requests the upgrade changing the release image of the hosted cluster", func() {
+			version := makeVersion(nil)
+			hostedClient := fake.NewClientBuilder().
+				WithScheme(snapshotScheme()).
+				WithObjects(
+					version,
+					makeNode("node0", map[string]string{
+						controllerWorkerRoleLabel: "",
+						labels.BundleExtracted:    "true",
+						labels.BundleLoaded:       "true",
+					}, makeMetadata()),
+				).
+				Build()
+			managementClient := makeManagementClient(makeHostedCluster(
+				"quay.io/openshift-release-dev/ocp-release@sha256:5678",
+			))
+			upgrade := reconcileHosted(hostedClient, managementClient)
+
+			// Check that the release image of the hosted cluster has been changed:
+			Expect(getReleaseImage(managementClient)).To(Equal(release))
+
+			// Check that the cluster version of the hosted cluster hasn't been changed:
+			err := hostedClient.Get(ctx, clnt.ObjectKeyFromObject(version), version)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.Spec.DesiredUpdate).To(BeNil())
+
+			// Check the status:
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeUpgrading))
+		})
+
+		It("Reports the completion using the cluster version of the hosted cluster", func() {
+			hostedClient := fake.NewClientBuilder().
+				WithScheme(snapshotScheme()).
+				WithObjects(
+					makeVersion(nil, configv1.UpdateHistory{
+						State:   configv1.CompletedUpdate,
+						Version: "4.13.4",
+						Image:   release,
+					}),
+					makeNode("node0", map[string]string{
+						controllerWorkerRoleLabel: "",
+						labels.BundleExtracted:    "true",
+						labels.BundleLoaded:       "true",
+					}, makeMetadata()),
+				).
+				Build()
+			managementClient := makeManagementClient(makeHostedCluster(release))
+			upgrade := reconcileHosted(hostedClient, managementClient)
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeCompleted))
+			Expect(upgrade.Status.Message).To(Equal(
+				"Upgrade to version '4.13.4' has completed",
+			))
+		})
+	})
+
+	It("Sends notifications only when the status changes", func() {
+		// Start a server that saves the events of the notifications:
+		var lock sync.Mutex
+		var events []string
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				var notification Notification
+				err := json.NewDecoder(r.Body).Decode(&notification)
+				Expect(err).ToNot(HaveOccurred())
+				lock.Lock()
+				events = append(events, notification.Event+" "+notification.Node)
+				lock.Unlock()
+			},
+		))
+		DeferCleanup(server.Close)
+		notifier, err := NewNotifier().
+			SetLogger(logger).
+			AddWebhook(server.URL).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Run two cycles, and check that the notifications are sent only in the first one:
+		client := makeClient(
+			makeVersion(nil),
+			makeNode("node0", nil, map[string]string{
+				annotations.Error: "Not enough disk space",
+			}),
+			makeNode("node1", nil, nil),
+		)
+		for i := 0; i < 2; i++ {
+			controller := &Controller{
+				logger:         logger,
+				namespace:      "upgrade-tool",
+				clusterUpgrade: true,
+				jobRetries:     controllerDefaultJobRetries,
+				client:         client,
+				upgradeClient:  client,
+				notifier:       notifier,
+			}
+			_, err = controller.Reconcile(ctx, ctrl.Request{})
+			Expect(err).ToNot(HaveOccurred())
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		Expect(events).To(ConsistOf(
+			NotificationUpgradeStarted+" ",
+			NotificationNodeFailed+" node0",
+		))
+	})
+
+	Describe("Restart", func() {
+		// makeRunningJob creates a job of the given kind for the given node that is still
+		// running. It has no containers, so that it is possible to check that it wasn't
+		// created again.
+		makeRunningJob := func(kind, node string) *batchv1.Job {
+			return &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "upgrade-tool",
+					Name:      fmt.Sprintf("%s-%s", kind, node),
+					Labels: map[string]string{
+						labels.Job: kind,
+					},
+				},
+				Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							NodeName: node,
+						},
+					},
+				},
+				Status: batchv1.JobStatus{
+					Active: 1,
+				},
+			}
+		}
+
+		// getJob returns the job with the given name, or nil if it doesn't exist.
+		getJob := func(client clnt.Client, name string) *batchv1.Job {
+			job := &batchv1.Job{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      name,
+			}
+			err := client.Get(ctx, key, job)
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			Expect(err).ToNot(HaveOccurred())
+			return job
+		}
+
+		// setStatus replaces the status of the cluster upgrade with the status that it had
+		// before the restart, in the given phase that started the given time ago.
+		setStatus := func(client clnt.Client, phase v1alpha1.ClusterUpgradePhase,
+			ago time.Duration) {
+			upgrade := &v1alpha1.ClusterUpgrade{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			}
+			err := client.Get(ctx, key, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			start := metav1.NewTime(time.Now().Add(-ago).Truncate(time.Second))
+			upgrade.Status.Phase = phase
+			upgrade.Status.History = &v1alpha1.ClusterUpgradeHistory{
+				StartTime: &start,
+				Phases: []v1alpha1.ClusterUpgradePhaseRecord{{
+					Phase:     phase,
+					StartTime: start,
+				}},
+			}
+			err = client.Status().Update(ctx, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		ready := map[string]string{
+			labels.BundleExtracted: "true",
+			labels.BundleLoaded:    "true",
+		}
+
+		It("Adopts the extractor jobs that were in progress", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+				makeRunningJob(bundleExtractor, "node0"),
+			)
+			setStatus(client, v1alpha1.ClusterUpgradeExtracting, time.Hour)
+			upgrade := reconcile(client)
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeExtracting))
+			job := getJob(client, bundleExtractor+"-node0")
+			Expect(job).ToNot(BeNil())
+			Expect(job.Spec.Template.Spec.Containers).To(BeEmpty())
+		})
+
+		It("Doesn't extract the bundle again when interrupted while loading", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", map[string]string{
+					labels.BundleExtracted: "true",
+				}, makeMetadata()),
+				makeRunningJob(bundleLoader, "node0"),
+			)
+			setStatus(client, v1alpha1.ClusterUpgradeLoading, time.Hour)
+			upgrade := reconcile(client)
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeLoading))
+			Expect(getJob(client, bundleExtractor+"-node0")).To(BeNil())
+			job := getJob(client, bundleLoader+"-node0")
+			Expect(job).ToNot(BeNil())
+			Expect(job.Spec.Template.Spec.Containers).To(BeEmpty())
+		})
+
+		It("Doesn't request the upgrade again when interrupted while upgrading", func() {
+			desired := &configv1.Update{
+				Image: "quay.io/openshift-release-dev/ocp-release@sha256:1234",
+				Force: true,
+			}
+			client := makeClient(
+				makeVersion(desired),
+				makeNode("node0", ready, makeMetadata()),
+			)
+			setStatus(client, v1alpha1.ClusterUpgradeUpgrading, time.Hour)
+			before := &configv1.ClusterVersion{}
+			err := client.Get(ctx, clnt.ObjectKey{Name: "version"}, before)
+			Expect(err).ToNot(HaveOccurred())
+			upgrade := reconcile(client)
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeUpgrading))
+			Expect(upgrade.Status.History.Phases).To(HaveLen(1))
+			Expect(jobNodes(client)).To(BeEmpty())
+			after := &configv1.ClusterVersion{}
+			err = client.Get(ctx, clnt.ObjectKey{Name: "version"}, after)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(after.ResourceVersion).To(Equal(before.ResourceVersion))
+		})
+
+		It("Deletes the jobs of the nodes that no longer exist", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+				makeRunningJob(bundleExtractor, "node0"),
+				makeRunningJob(bundleExtractor, "node1"),
+			)
+			reconcile(client)
+			Expect(getJob(client, bundleExtractor+"-node0")).ToNot(BeNil())
+			Expect(getJob(client, bundleExtractor+"-node1")).To(BeNil())
+		})
+
+		It("Restores the time spent in the current phase", func() {
+			metrics, err := newControllerMetrics(prometheus.NewRegistry())
+			Expect(err).ToNot(HaveOccurred())
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+				makeRunningJob(bundleExtractor, "node0"),
+			)
+			setStatus(client, v1alpha1.ClusterUpgradeExtracting, time.Hour)
+			reconcileWithMetrics(client, metrics)
+			seconds := testutil.ToFloat64(
+				metrics.phases.WithLabelValues(string(v1alpha1.ClusterUpgradeExtracting)),
+			)
+			Expect(seconds).To(BeNumerically(">=", time.Hour.Seconds()))
+		})
+	})
+
+	Describe("Completed jobs", func() {
+		// makeCompletedJob creates a job of the given kind for the given node that completed
+		// successfully the given time ago.
+		makeCompletedJob := func(kind, node string, ago time.Duration) *batchv1.Job {
+			completed := metav1.NewTime(time.Now().Add(-ago))
+			return &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "upgrade-tool",
+					Name:      fmt.Sprintf("%s-%s", kind, node),
+					Labels: map[string]string{
+						labels.Job: kind,
+					},
+				},
+				Status: batchv1.JobStatus{
+					CompletionTime: &completed,
+					Conditions: []batchv1.JobCondition{{
+						Type:               batchv1.JobComplete,
+						Status:             corev1.ConditionTrue,
+						LastTransitionTime: completed,
+					}},
+				},
+			}
+		}
+
+		// collect runs one reconciliation cycle with the given job retention and returns the
+		// result.
+		collect := func(client clnt.Client, retention time.Duration) ctrl.Result {
+			controller := &Controller{
+				logger:         logger,
+				namespace:      "upgrade-tool",
+				clusterUpgrade: true,
+				jobRetries:     controllerDefaultJobRetries,
+				jobRetention:   retention,
+				client:         client,
+				upgradeClient:  client,
+			}
+			result, err := controller.Reconcile(ctx, ctrl.Request{})
+			Expect(err).ToNot(HaveOccurred())
+			return result
+		}
+
+		// listJobs returns the names of the jobs of the namespace.
+		listJobs := func(client clnt.Client) []string {
+			list := &batchv1.JobList{}
+			err := client.List(ctx, list, clnt.InNamespace("upgrade-tool"))
+			Expect(err).ToNot(HaveOccurred())
+			var names []string
+			for _, job := range list.Items {
+				names = append(names, job.Name)
+			}
+			return names
+		}
+
+		// extracted are the labels of a node that has the bundle extracted and the images
+		// loaded.
+		extracted := map[string]string{
+			labels.BundleExtracted: "true",
+			labels.BundleLoaded:    "true",
+		}
+
+		It("Deletes the jobs that completed before the retention time", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", extracted, makeMetadata()),
+				makeNode("node1", extracted, makeMetadata()),
+				makeCompletedJob(bundleExtractor, "node0", 2*time.Hour),
+				makeCompletedJob(bundleLoader, "node0", 2*time.Hour),
+				makeCompletedJob(bundleExtractor, "node1", 10*time.Minute),
+			)
+			result := collect(client, time.Hour)
+			Expect(listJobs(client)).To(ConsistOf(bundleExtractor + "-node1"))
+
+			// Check that the controller will check again when the remaining job expires:
+			Expect(result.RequeueAfter).To(BeNumerically("~", 50*time.Minute, time.Minute))
+		})
+
+		It("Keeps the failed jobs", func() {
+			failed := makeCompletedJob(bundleLoader, "node0", 2*time.Hour)
+			failed.Status.CompletionTime = nil
+			failed.Status.Conditions[0].Type = batchv1.JobFailed
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, map[string]string{
+					annotations.LoaderRetries: "3",
+				}),
+				failed,
+			)
+			collect(client, time.Hour)
+			Expect(listJobs(client)).To(ContainElement(failed.Name))
+		})
+
+		It("Keeps the jobs that it didn't create", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", extracted, makeMetadata()),
+				makeCompletedJob(bundleCreation, "my-bundle", 2*time.Hour),
+			)
+			collect(client, time.Hour)
+			Expect(listJobs(client)).To(ConsistOf(bundleCreation + "-my-bundle"))
+		})
+
+		It("Keeps all the jobs when the retention is zero", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", extracted, makeMetadata()),
+				makeCompletedJob(bundleExtractor, "node0", 24*time.Hour),
+			)
+			result := collect(client, 0)
+			Expect(listJobs(client)).To(ConsistOf(bundleExtractor + "-node0"))
+			Expect(result.RequeueAfter).To(BeZero())
+		})
+	})
+
+	Describe("Job retries", func() {
+		// makeFailedJob creates a bundle extractor job for the given node that failed the
+		// given time ago.
+		makeFailedJob := func(node string, ago time.Duration) *batchv1.Job {
+			return &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "upgrade-tool",
+					Name:      fmt.Sprintf("%s-%s", bundleExtractor, node),
+					Labels: map[string]string{
+						labels.Job: bundleExtractor,
+					},
+				},
+				Status: batchv1.JobStatus{
+					Conditions: []batchv1.JobCondition{{
+						Type:   batchv1.JobFailed,
+						Status: corev1.ConditionTrue,
+						LastTransitionTime: metav1.NewTime(
+							time.Now().Add(-ago),
+						),
+					}},
+				},
+			}
+		}
+
+		// fetchJob returns the job with the given name, or nil if it doesn't exist.
+		fetchJob := func(client clnt.Client, name string) *batchv1.Job {
+			job := &batchv1.Job{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      name,
+			}
+			err := client.Get(ctx, key, job)
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			Expect(err).ToNot(HaveOccurred())
+			return job
+		}
+
+		// fetchNode returns the node with the given name.
+		fetchNode := func(client clnt.Client, name string) *corev1.Node {
+			node := &corev1.Node{}
+			err := client.Get(ctx, clnt.ObjectKey{Name: name}, node)
+			Expect(err).ToNot(HaveOccurred())
+			return node
+		}
+
+		It("Creates again a failed job after the backoff delay", func() {
+			job := makeFailedJob("node0", time.Hour)
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+				job,
+			)
+
+			// The first cycle should delete the job and count the retry:
+			reconcile(client)
+			Expect(fetchJob(client, job.Name)).To(BeNil())
+			node := fetchNode(client, "node0")
+			Expect(node.Annotations).To(HaveKeyWithValue(annotations.ExtractorRetries, "1"))
+
+			// The second cycle should create it again:
+			reconcile(client)
+			job = fetchJob(client, job.Name)
+			Expect(job).ToNot(BeNil())
+			Expect(job.Status.Conditions).To(BeEmpty())
+		})
+
+		It("Waits for the backoff delay before creating again a failed job", func() {
+			job := makeFailedJob("node0", time.Second)
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+				job,
+			)
+			reconcile(client)
+			Expect(fetchJob(client, job.Name)).ToNot(BeNil())
+			node := fetchNode(client, "node0")
+			Expect(node.Annotations).ToNot(HaveKey(annotations.ExtractorRetries))
+		})
+
+		It("Doesn't create again a failed job when there are no retries left", func() {
+			job := makeFailedJob("node0", time.Hour)
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, map[string]string{
+					annotations.ExtractorRetries: "3",
+				}),
+				job,
+			)
+			upgrade := reconcile(client)
+			Expect(fetchJob(client, job.Name)).ToNot(BeNil())
+			degraded := meta.FindStatusCondition(
+				upgrade.Status.Conditions,
+				v1alpha1.ClusterUpgradeDegraded,
+			)
+			Expect(degraded).ToNot(BeNil())
+			Expect(degraded.Status).To(Equal(metav1.ConditionTrue))
+			Expect(degraded.Message).To(ContainSubstring("node0"))
+		})
+
+		It("Doesn't report degraded when failures are within the budget", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, map[string]string{
+					annotations.Error: "Not enough disk space",
+				}),
+				makeNode("node1", nil, nil),
+				makeNode("node2", nil, nil),
+				makeNode("node3", nil, nil),
+			)
+			upgrade := &v1alpha1.ClusterUpgrade{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			}
+			err := client.Get(ctx, key, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			budget := intstr.FromString("25%")
+			upgrade.Spec.Rollout.FailureBudget = &budget
+			err = client.Update(ctx, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			upgrade = reconcile(client)
+			degraded := meta.FindStatusCondition(
+				upgrade.Status.Conditions,
+				v1alpha1.ClusterUpgradeDegraded,
+			)
+			Expect(degraded).ToNot(BeNil())
+			Expect(degraded.Status).To(Equal(metav1.ConditionFalse))
+			Expect(degraded.Reason).To(Equal(v1alpha1.ClusterUpgradeWithinBudgetReason))
+		})
+	})
+
+	It("Doesn't start jobs while the upgrade is paused", func() {
+		client := makeClient(
+			makeVersion(nil),
+			makeNode("node0", nil, nil),
+		)
+
+		// Pause the upgrade:
+		upgrade := &v1alpha1.ClusterUpgrade{}
+		key := clnt.ObjectKey{
+			Namespace: "upgrade-tool",
+			Name:      "my-upgrade",
+		}
+		err := client.Get(ctx, key, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+		upgrade.Spec.Paused = true
+		err = client.Update(ctx, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Check that no job is started:
+		upgrade = reconcile(client)
+		jobs := &batchv1.JobList{}
+		err = client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(jobs.Items).To(BeEmpty())
+		Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeExtracting))
+		Expect(upgrade.Status.Message).To(Equal(
+			"Upgrade is paused: Extracting bundle, 1 of 1 nodes pending",
+		))
+		Expect(meta.IsStatusConditionTrue(
+			upgrade.Status.Conditions,
+			v1alpha1.ClusterUpgradePaused,
+		)).To(BeTrue())
+
+		// Resume the upgrade and check that the job is started:
+		upgrade.Spec.Paused = false
+		err = client.Update(ctx, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+		upgrade = reconcile(client)
+		err = client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(jobs.Items).To(HaveLen(1))
+		Expect(meta.IsStatusConditionFalse(
+			upgrade.Status.Conditions,
+			v1alpha1.ClusterUpgradePaused,
+		)).To(BeTrue())
+	})
+
+	Describe("Batched rollout", func() {
+		// makeBatchNodes creates four nodes that have the bundle extracted. The first node
+		// has the images loaded too, and it is ready only if requested.
+		makeBatchNodes := func(ready bool) []clnt.Object {
+			node0 := makeNode("node0", map[string]string{
+				labels.BundleExtracted: "true",
+				labels.BundleLoaded:    "true",
+			}, makeMetadata())
+			if ready {
+				node0.Status.Conditions = []corev1.NodeCondition{{
+					Type:   corev1.NodeReady,
+					Status: corev1.ConditionTrue,
+				}}
+			}
+			extracted := map[string]string{
+				labels.BundleExtracted: "true",
+			}
+			return []clnt.Object{
+				node0,
+				makeNode("node1", extracted, nil),
+				makeNode("node2", extracted, nil),
+				makeNode("node3", extracted, nil),
+			}
+		}
+
+		// setBatches changes the cluster upgrade so that it uses a canary node, then half of
+		// the nodes and then the rest.
+		setBatches := func(client clnt.Client) {
+			upgrade := &v1alpha1.ClusterUpgrade{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			}
+			err := client.Get(ctx, key, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			upgrade.Spec.Rollout.Batches = []intstr.IntOrString{
+				intstr.FromInt(1),
+				intstr.FromString("50%"),
+			}
+			err = client.Update(ctx, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		// loaderNodes returns the names of the nodes where bundle loader jobs have been
+		// created.
+		loaderNodes := func(client clnt.Client) []string {
+			jobs := &batchv1.JobList{}
+			err := client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+			Expect(err).ToNot(HaveOccurred())
+			var result []string
+			for _, job := range jobs.Items {
+				if job.Labels[labels.Job] == bundleLoader {
+					result = append(result, job.Spec.Template.Spec.NodeName)
+				}
+			}
+			return result
+		}
+
+		It("Loads the images only in the canary node first", func() {
+			nodes := makeBatchNodes(false)
+			nodes[0].SetLabels(map[string]string{
+				labels.BundleExtracted: "true",
+			})
+			client := makeClient(makeVersion(nil), nodes...)
+			setBatches(client)
+			upgrade := reconcile(client)
+			Expect(loaderNodes(client)).To(ConsistOf("node0"))
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeLoading))
+			Expect(upgrade.Status.Batch).To(Equal(1))
+			Expect(upgrade.Status.Message).To(Equal(
+				"Loading images in batch 1 of 3, 4 of 4 nodes pending",
+			))
+		})
+
+		It("Waits till the nodes of the previous batch are healthy", func() {
+			client := makeClient(makeVersion(nil), makeBatchNodes(false)...)
+			setBatches(client)
+			upgrade := reconcile(client)
+			Expect(loaderNodes(client)).To(BeEmpty())
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeLoading))
+			Expect(upgrade.Status.Batch).To(Equal(2))
+			Expect(upgrade.Status.Message).To(Equal(
+				"Waiting for nodes node0 to be healthy before loading images in batch 2 of 3",
+			))
+		})
+
+		It("Loads the images in the next batch when the previous one is healthy", func() {
+			client := makeClient(makeVersion(nil), makeBatchNodes(true)...)
+			setBatches(client)
+			upgrade := reconcile(client)
+			Expect(loaderNodes(client)).To(ConsistOf("node1", "node2"))
+			Expect(upgrade.Status.Batch).To(Equal(2))
+			Expect(upgrade.Status.Message).To(Equal(
+				"Loading images in batch 2 of 3, 3 of 4 nodes pending",
+			))
+		})
+	})
+
+	Describe("Node selection", func() {
+		It("Ignores the nodes that aren't selected", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", map[string]string{"upgrade": "yes"}, nil),
+				makeNode("node1", nil, nil),
+			)
+			updateRollout(client, func(rollout *v1alpha1.ClusterUpgradeRollout) {
+				rollout.NodeSelector = &metav1.LabelSelector{
+					MatchLabels: map[string]string{"upgrade": "yes"},
+				}
+			})
+			upgrade := reconcile(client)
+			Expect(jobNodes(client)).To(ConsistOf("node0"))
+			Expect(upgrade.Status.Nodes).To(Equal(1))
+			Expect(upgrade.Status.Message).To(Equal("Extracting bundle, 1 of 1 nodes pending"))
+		})
+
+		It("Requests the upgrade when all the selected nodes are ready", func() {
+			ready := map[string]string{
+				"upgrade":              "yes",
+				labels.BundleExtracted: "true",
+				labels.BundleLoaded:    "true",
+			}
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", ready, makeMetadata()),
+				makeNode("node1", nil, nil),
+			)
+			updateRollout(client, func(rollout *v1alpha1.ClusterUpgradeRollout) {
+				rollout.NodeSelector = &metav1.LabelSelector{
+					MatchLabels: map[string]string{"upgrade": "yes"},
+				}
+			})
+			upgrade := reconcile(client)
+			Expect(jobNodes(client)).To(BeEmpty())
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeUpgrading))
+		})
+
+		It("Doesn't start jobs in the excluded nodes", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+				makeNode("node1", nil, nil),
+			)
+			updateRollout(client, func(rollout *v1alpha1.ClusterUpgradeRollout) {
+				rollout.ExcludedNodes = []string{"node1"}
+			})
+			reconcile(client)
+			Expect(jobNodes(client)).To(ConsistOf("node0"))
+		})
+
+		It("Doesn't request the upgrade till the excluded nodes are included again", func() {
+			ready := map[string]string{
+				labels.BundleExtracted: "true",
+				labels.BundleLoaded:    "true",
+			}
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", ready, makeMetadata()),
+				makeNode("node1", nil, nil),
+			)
+			updateRollout(client, func(rollout *v1alpha1.ClusterUpgradeRollout) {
+				rollout.ExcludedNodes = []string{"node1"}
+			})
+			upgrade := reconcile(client)
+			Expect(jobNodes(client)).To(BeEmpty())
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeLoading))
+			Expect(upgrade.Status.Message).To(Equal(
+				"Waiting for excluded nodes node1 to be included again",
+			))
+			version := &configv1.ClusterVersion{}
+			err := client.Get(ctx, clnt.ObjectKey{Name: "version"}, version)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.Spec.DesiredUpdate).To(BeNil())
+
+			// Include the node again:
+			updateRollout(client, func(rollout *v1alpha1.ClusterUpgradeRollout) {
+				rollout.ExcludedNodes = nil
+			})
+			upgrade = reconcile(client)
+			Expect(jobNodes(client)).To(ConsistOf("node1"))
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeExtracting))
+		})
+
+		It("Adds the tolerations to the jobs", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+			)
+			toleration := corev1.Toleration{
+				Key:      "dedicated",
+				Operator: corev1.TolerationOpEqual,
+				Value:    "storage",
+				Effect:   corev1.TaintEffectNoSchedule,
+			}
+			updateRollout(client, func(rollout *v1alpha1.ClusterUpgradeRollout) {
+				rollout.Tolerations = []corev1.Toleration{toleration}
+			})
+			reconcile(client)
+			jobs := &batchv1.JobList{}
+			err := client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(jobs.Items).To(HaveLen(1))
+			Expect(jobs.Items[0].Spec.Template.Spec.Tolerations).To(ContainElement(toleration))
+		})
+	})
+
+	Describe("Maximum concurrency", func() {
+		// makeRunningJob creates a bundle extractor job for the given node that is still
+		// running.
+		makeRunningJob := func(node string) *batchv1.Job {
+			return &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "upgrade-tool",
+					Name:      fmt.Sprintf("%s-%s", bundleExtractor, node),
+					Labels: map[string]string{
+						labels.Job: bundleExtractor,
+					},
+				},
+				Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							NodeName: node,
+						},
+					},
+				},
+			}
+		}
+
+		// setConcurrency changes the maximum concurrency of the cluster upgrade.
+		setConcurrency := func(client clnt.Client, value intstr.IntOrString) {
+			updateRollout(client, func(rollout *v1alpha1.ClusterUpgradeRollout) {
+				rollout.MaxConcurrency = &value
+			})
+		}
+
+		It("Starts only the allowed number of extractors", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+				makeNode("node1", nil, nil),
+				makeNode("node2", nil, nil),
+			)
+			setConcurrency(client, intstr.FromInt(1))
+			upgrade := reconcile(client)
+			Expect(jobNodes(client)).To(HaveLen(1))
+			Expect(upgrade.Status.Message).To(Equal("Extracting bundle, 3 of 3 nodes pending"))
+		})
+
+		It("Calculates the limit from a percentage of the nodes", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+				makeNode("node1", nil, nil),
+				makeNode("node2", nil, nil),
+			)
+			setConcurrency(client, intstr.FromString("50%"))
+			reconcile(client)
+			Expect(jobNodes(client)).To(HaveLen(2))
+		})
+
+		It("Doesn't start new extractors while the running ones use all the slots", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+				makeNode("node1", nil, nil),
+				makeRunningJob("node1"),
+			)
+			setConcurrency(client, intstr.FromInt(1))
+			reconcile(client)
+			Expect(jobNodes(client)).To(ConsistOf("node1"))
+		})
+
+		It("Gives priority to the nodes that need to load the images", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+				makeNode("node1", map[string]string{
+					labels.BundleExtracted: "true",
+				}, nil),
+			)
+			setConcurrency(client, intstr.FromInt(1))
+			reconcile(client)
+			jobs := &batchv1.JobList{}
+			err := client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(jobs.Items).To(HaveLen(1))
+			Expect(jobs.Items[0].Name).To(Equal(fmt.Sprintf("%s-node1", bundleLoader)))
+		})
+	})
+
+	Describe("Maintenance windows", func() {
+		// setWindow changes the cluster upgrade so that it has a single maintenance window
+		// that starts and ends the given times from now.
+		setWindow := func(client clnt.Client, start, end time.Duration) {
+			now := time.Now().Truncate(time.Second)
+			upgrade := &v1alpha1.ClusterUpgrade{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			}
+			err := client.Get(ctx, key, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			startTime := metav1.NewTime(now.Add(start))
+			endTime := metav1.NewTime(now.Add(end))
+			upgrade.Spec.Schedule = &v1alpha1.ClusterUpgradeSchedule{
+				Windows: []v1alpha1.ClusterUpgradeWindow{{
+					Start: &startTime,
+					End:   &endTime,
+				}},
+			}
+			err = client.Update(ctx, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		It("Doesn't start jobs before the window opens", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+			)
+			setWindow(client, time.Hour, 2*time.Hour)
+			upgrade := reconcile(client)
+			Expect(jobNodes(client)).To(BeEmpty())
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeExtracting))
+			Expect(upgrade.Status.Message).To(HavePrefix(
+				"Upgrade is waiting for the maintenance window that opens at",
+			))
+			paused := meta.FindStatusCondition(
+				upgrade.Status.Conditions,
+				v1alpha1.ClusterUpgradePaused,
+			)
+			Expect(paused).ToNot(BeNil())
+			Expect(paused.Status).To(Equal(metav1.ConditionTrue))
+			Expect(paused.Reason).To(Equal(v1alpha1.ClusterUpgradeOutsideWindowReason))
+		})
+
+		It("Reconciles again when the window opens", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+			)
+			setWindow(client, time.Hour, 2*time.Hour)
+			controller := &Controller{
+				logger:         logger,
+				namespace:      "upgrade-tool",
+				clusterUpgrade: true,
+				jobRetries:     controllerDefaultJobRetries,
+				client:         client,
+				upgradeClient:  client,
+			}
+			result, err := controller.Reconcile(ctx, ctrl.Request{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically("~", time.Hour, time.Minute))
+		})
+
+		It("Starts jobs while the window is open", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+			)
+			setWindow(client, -time.Hour, time.Hour)
+			upgrade := reconcile(client)
+			Expect(jobNodes(client)).To(ConsistOf("node0"))
+			Expect(meta.IsStatusConditionFalse(
+				upgrade.Status.Conditions,
+				v1alpha1.ClusterUpgradePaused,
+			)).To(BeTrue())
+		})
+
+		It("Doesn't request the upgrade after the window closes", func() {
+			ready := map[string]string{
+				labels.BundleExtracted: "true",
+				labels.BundleLoaded:    "true",
+			}
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", ready, makeMetadata()),
+			)
+			setWindow(client, -2*time.Hour, -time.Hour)
+			upgrade := reconcile(client)
+			version := &configv1.ClusterVersion{}
+			err := client.Get(ctx, clnt.ObjectKey{Name: "version"}, version)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.Spec.DesiredUpdate).To(BeNil())
+			Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ClusterUpgradeLoading))
+			Expect(upgrade.Status.Message).To(Equal(
+				"Upgrade is outside of the maintenance windows and there are no more " +
+					"windows: Images have been loaded in all the nodes",
+			))
+		})
+	})
+
+	Describe("History", func() {
+		// updateNode replaces the labels and annotations of the given node.
+		updateNode := func(client clnt.Client, name string, nodeLabels,
+			nodeAnnotations map[string]string) {
+			node := &corev1.Node{}
+			err := client.Get(ctx, clnt.ObjectKey{Name: name}, node)
+			Expect(err).ToNot(HaveOccurred())
+			node.Labels = nodeLabels
+			node.Annotations = nodeAnnotations
+			err = client.Update(ctx, node)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		It("Records the changes of phase", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, nil),
+			)
+			upgrade := reconcile(client)
+			history := upgrade.Status.History
+			Expect(history).ToNot(BeNil())
+			Expect(history.StartTime).ToNot(BeNil())
+			Expect(history.CompletionTime).To(BeNil())
+			Expect(history.Phases).To(HaveLen(1))
+			Expect(history.Phases[0].Phase).To(Equal(v1alpha1.ClusterUpgradeExtracting))
+			Expect(history.Phases[0].EndTime).To(BeNil())
+
+			// Simulate that the node has the images loaded:
+			updateNode(client, "node0", map[string]string{
+				labels.BundleExtracted: "true",
+				labels.BundleLoaded:    "true",
+			}, makeMetadata())
+			upgrade = reconcile(client)
+			history = upgrade.Status.History
+			Expect(history.Release).To(Equal(
+				"quay.io/openshift-release-dev/ocp-release@sha256:1234",
+			))
+			Expect(history.Phases).To(HaveLen(2))
+			Expect(history.Phases[0].Phase).To(Equal(v1alpha1.ClusterUpgradeExtracting))
+			Expect(history.Phases[0].EndTime).ToNot(BeNil())
+			Expect(history.Phases[0].Duration).ToNot(BeNil())
+			Expect(history.Phases[1].Phase).To(Equal(v1alpha1.ClusterUpgradeUpgrading))
+			Expect(history.Phases[1].EndTime).To(BeNil())
+		})
+
+		It("Records the completion time", func() {
+			ready := map[string]string{
+				labels.BundleExtracted: "true",
+				labels.BundleLoaded:    "true",
+			}
+			client := makeClient(
+				makeVersion(
+					&configv1.Update{
+						Image: "quay.io/openshift-release-dev/ocp-release@sha256:1234",
+						Force: true,
+					},
+					configv1.UpdateHistory{
+						State:   configv1.CompletedUpdate,
+						Version: "4.13.4",
+						Image:   "quay.io/openshift-release-dev/ocp-release@sha256:1234",
+					},
+				),
+				makeNode("node0", ready, makeMetadata()),
+			)
+			upgrade := reconcile(client)
+			history := upgrade.Status.History
+			Expect(history).ToNot(BeNil())
+			Expect(history.CompletionTime).ToNot(BeNil())
+			Expect(history.Phases).To(HaveLen(1))
+			Expect(history.Phases[0].Phase).To(Equal(v1alpha1.ClusterUpgradeCompleted))
+		})
+
+		It("Keeps the nodes that had problems", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeNode("node0", nil, map[string]string{
+					annotations.ExtractorRetries: "2",
+					annotations.Error:            "Not enough disk space",
+				}),
+				makeNode("node1", nil, nil),
+			)
+			upgrade := reconcile(client)
+			expected := []v1alpha1.ClusterUpgradeNodeRecord{{
+				Name:             "node0",
+				ExtractorRetries: 2,
+				Error:            "Not enough disk space",
+			}}
+			Expect(upgrade.Status.History.Nodes).To(Equal(expected))
+
+			// Remove the annotations, as the bundle cleaner does, and check that the record
+			// is preserved:
+			updateNode(client, "node0", nil, nil)
+			upgrade = reconcile(client)
+			Expect(upgrade.Status.History.Nodes).To(Equal(expected))
+		})
+	})
+
+	Describe("Extra manifests", func() {
+		// appliedObject records an object applied by the controller.
+		type appliedObject struct {
+			kind      string
+			namespace string
+			name      string
+			owner     string
+			force     bool
+		}
+
+		// makeTask creates a reconcile task with a client that records the objects that are
+		// applied instead of applying them, as the fake client doesn't support server side
+		// apply. Applying the object with the given name fails.
+		makeTask := func(applied *[]appliedObject, fail string) *controllerReconcileTask {
+			client := fake.NewClientBuilder().
+				WithScheme(snapshotScheme()).
+				WithInterceptorFuncs(interceptor.Funcs{
+					Patch: func(ctx context.Context, client clnt.WithWatch,
+						object clnt.Object, patch clnt.Patch,
+						opts ...clnt.PatchOption) error {
+						Expect(patch.Type()).To(Equal(types.ApplyPatchType))
+						if object.GetName() == fail {
+							return errors.New("failed to apply")
+						}
+						options := &clnt.PatchOptions{}
+						options.ApplyOptions(opts)
+						*applied = append(*applied, appliedObject{
+							kind:      object.GetObjectKind().GroupVersionKind().Kind,
+							namespace: object.GetNamespace(),
+							name:      object.GetName(),
+							owner:     options.FieldManager,
+							force:     options.Force != nil && *options.Force,
+						})
+						return nil
+					},
+				}).
+				Build()
+			return &controllerReconcileTask{
+				logger: logger,
+				client: client,
+			}
+		}
+
+		It("Applies all the objects of all the manifests", func() {
+			var applied []appliedObject
+			task := makeTask(&applied, "")
+			err := task.applyManifests(ctx, []string{
+				`
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: my-ns
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  namespace: my-ns
+  name: my-config
+`,
+				`
+apiVersion: v1
+kind: Secret
+metadata:
+  namespace: my-ns
+  name: my-secret
+`,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(applied).To(Equal([]appliedObject{
+				{
+					kind:  "Namespace",
+					name:  "my-ns",
+					owner: controllerFieldOwner,
+					force: true,
+				},
+				{
+					kind:      "ConfigMap",
+					namespace: "my-ns",
+					name:      "my-config",
+					owner:     controllerFieldOwner,
+					force:     true,
+				},
+				{
+					kind:      "Secret",
+					namespace: "my-ns",
+					name:      "my-secret",
+					owner:     controllerFieldOwner,
+					force:     true,
+				},
+			}))
+		})
+
+		It("Doesn't apply anything when there are no manifests", func() {
+			var applied []appliedObject
+			task := makeTask(&applied, "")
+			err := task.applyManifests(ctx, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(applied).To(BeEmpty())
+		})
+
+		It("Fails if a manifest isn't valid", func() {
+			var applied []appliedObject
+			task := makeTask(&applied, "")
+			err := task.applyManifests(ctx, []string{
+				`
+apiVersion: v1
+metadata:
+  name: my-ns
+`,
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("doesn't have a kind"))
+			Expect(applied).To(BeEmpty())
+		})
+
+		It("Stops when applying an object fails", func() {
+			var applied []appliedObject
+			task := makeTask(&applied, "my-config")
+			err := task.applyManifests(ctx, []string{
+				`
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: my-ns
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  namespace: my-ns
+  name: my-config
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  namespace: my-ns
+  name: my-secret
+`,
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(applied).To(HaveLen(1))
+			Expect(applied[0].name).To(Equal("my-ns"))
+		})
+	})
+
+	Describe("Heterogeneous clusters", func() {
+		// makeArchNode creates a node with the given architecture.
+		makeArchNode := func(name, arch string, labels,
+			annotations map[string]string) *corev1.Node {
+			node := makeNode(name, labels, annotations)
+			node.Status.NodeInfo.Architecture = arch
+			return node
+		}
+
+		// setBundles changes the cluster upgrade so that it uses the given main bundle and
+		// an additional bundle for the 'aarch64' nodes.
+		setBundles := func(client clnt.Client, bundle v1alpha1.ClusterUpgradeBundle) {
+			upgrade := &v1alpha1.ClusterUpgrade{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			}
+			err := client.Get(ctx, key, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			upgrade.Spec.Bundle = bundle
+			upgrade.Spec.ArchBundles = []v1alpha1.ClusterUpgradeArchBundle{{
+				Arch: "aarch64",
+				URL:  "s3://bundles/4.13.4-aarch64.tar",
+			}}
+			err = client.Update(ctx, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		// extractorCommands returns the commands of the bundle extractor jobs indexed by
+		// node name.
+		extractorCommands := func(client clnt.Client) map[string][]string {
+			jobs := &batchv1.JobList{}
+			err := client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+			Expect(err).ToNot(HaveOccurred())
+			result := map[string][]string{}
+			for _, job := range jobs.Items {
+				if job.Labels[labels.Job] != bundleExtractor {
+					continue
+				}
+				spec := job.Spec.Template.Spec
+				result[spec.NodeName] = spec.Containers[0].Command
+			}
+			return result
+		}
+
+		It("Downloads the bundle of the architecture of each node", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeArchNode("node0", "amd64", nil, nil),
+				makeArchNode("node1", "arm64", nil, nil),
+			)
+			setBundles(client, v1alpha1.ClusterUpgradeBundle{
+				URL: "s3://bundles/4.13.4-x86_64.tar",
+			})
+			reconcile(client)
+			commands := extractorCommands(client)
+			Expect(commands).To(HaveLen(2))
+			Expect(commands["node0"]).To(ContainElements(
+				"--bundle-url=s3://bundles/4.13.4-x86_64.tar",
+				"--expected-arch=amd64",
+			))
+			Expect(commands["node1"]).To(ContainElements(
+				"--bundle-url=s3://bundles/4.13.4-aarch64.tar",
+				"--expected-arch=arm64",
+			))
+		})
+
+		It("Selects the bundle of the architecture of each node from the directory", func() {
+			server := &appsv1.DaemonSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "upgrade-tool",
+					Name:      bundleServer,
+				},
+				Status: appsv1.DaemonSetStatus{
+					NumberReady: 1,
+				},
+			}
+			client := makeClient(
+				makeVersion(nil),
+				makeArchNode("node0", "amd64", nil, nil),
+				makeArchNode("node1", "arm64", nil, nil),
+				server,
+			)
+			upgrade := &v1alpha1.ClusterUpgrade{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			}
+			err := client.Get(ctx, key, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			upgrade.Spec.Bundle = v1alpha1.ClusterUpgradeBundle{
+				Dir: "/var/lib/upgrade/bundles",
+			}
+			err = client.Update(ctx, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			reconcile(client)
+			commands := extractorCommands(client)
+			Expect(commands).To(HaveLen(2))
+			Expect(commands["node0"]).To(ContainElement("--bundle-arch=x86_64"))
+			Expect(commands["node1"]).To(ContainElement("--bundle-arch=aarch64"))
+		})
+
+		It("Uses the bundle server only for the nodes without an URL", func() {
+			client := makeClient(
+				makeVersion(nil),
+				makeArchNode("node0", "amd64", nil, nil),
+				makeArchNode("node1", "arm64", nil, nil),
+			)
+			setBundles(client, v1alpha1.ClusterUpgradeBundle{
+				File: "/var/lib/upgrade/bundle.tar",
+			})
+			reconcile(client)
+
+			// The 'arm64' node downloads the bundle directly, but the 'amd64' node waits
+			// till the bundle server is ready:
+			commands := extractorCommands(client)
+			Expect(commands).To(HaveLen(1))
+			Expect(commands["node1"]).To(ContainElement(
+				"--bundle-url=s3://bundles/4.13.4-aarch64.tar",
+			))
+			server := &appsv1.DaemonSet{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      bundleServer,
+			}
+			err := client.Get(ctx, key, server)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Doesn't request the upgrade if the bundles have different releases", func() {
+			ready := map[string]string{
+				labels.BundleExtracted: "true",
+				labels.BundleLoaded:    "true",
+			}
+			data, err := json.Marshal(&Metadata{
+				Version: "4.13.4",
+				Arch:    "aarch64",
+				Release: "quay.io/openshift-release-dev/ocp-release@sha256:5678",
+			})
+			Expect(err).ToNot(HaveOccurred())
+			client := makeClient(
+				makeVersion(nil),
+				makeArchNode("node0", "amd64", ready, makeMetadata()),
+				makeArchNode("node1", "arm64", ready, map[string]string{
+					annotations.BundleMetadata: string(data),
+				}),
+			)
+			controller := &Controller{
+				logger:         logger,
+				namespace:      "upgrade-tool",
+				clusterUpgrade: true,
+				jobRetries:     controllerDefaultJobRetries,
+				client:         client,
+				upgradeClient:  client,
+			}
+			_, err = controller.Reconcile(ctx, ctrl.Request{})
+			Expect(err).To(MatchError(ContainSubstring(
+				"same multi-architecture release",
+			)))
+			version := &configv1.ClusterVersion{}
+			err = client.Get(ctx, clnt.ObjectKey{Name: "version"}, version)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version.Spec.DesiredUpdate).To(BeNil())
+		})
+	})
+
+	It("Updates the metrics", func() {
+		// Create the metrics:
+		metrics, err := newControllerMetrics(prometheus.NewRegistry())
+		Expect(err).ToNot(HaveOccurred())
+
+		// Run the first cycle with one node downloading the bundle, one with the bundle
+		// extracted and one that failed:
+		node0 := makeNode("node0", nil, map[string]string{
+			annotations.ProgressDetails: `{"phase":"downloading","bytes":1000}`,
+		})
+		node1 := makeNode("node1", map[string]string{
+			labels.BundleExtracted: "true",
+		}, nil)
+		node2 := makeNode("node2", nil, map[string]string{
+			annotations.Error: "Not enough disk space",
+		})
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "upgrade-tool",
+				Name:      "bundle-extractor-node0",
+				Labels: map[string]string{
+					labels.Job: bundleExtractor,
+				},
+			},
+			Status: batchv1.JobStatus{
+				Failed: 1,
+			},
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "upgrade-tool",
+				Name:      "bundle-extractor-node0-abcde",
+				Labels: map[string]string{
+					controllerJobNameLabel: job.Name,
+				},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{{
+					RestartCount: 2,
+				}},
+			},
+		}
+		client := makeClient(makeVersion(nil), node0, node1, node2, job, pod)
+		reconcileWithMetrics(client, metrics)
+		Expect(testutil.ToFloat64(metrics.nodes.WithLabelValues("pending"))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(metrics.nodes.WithLabelValues("extracted"))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(metrics.nodes.WithLabelValues("failed"))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(metrics.distributed)).To(Equal(1000.0))
+		Expect(testutil.ToFloat64(metrics.retries.WithLabelValues(bundleExtractor))).To(
+			Equal(3.0),
+		)
+
+		// Run the second cycle with more bytes downloaded, and check that only the difference
+		// is added:
+		err = client.Get(ctx, clnt.ObjectKeyFromObject(node0), node0)
+		Expect(err).ToNot(HaveOccurred())
+		node0.Annotations[annotations.ProgressDetails] = `{"phase":"downloading","bytes":2500}`
+		err = client.Update(ctx, node0)
+		Expect(err).ToNot(HaveOccurred())
+		reconcileWithMetrics(client, metrics)
+		Expect(testutil.ToFloat64(metrics.distributed)).To(Equal(2500.0))
+		Expect(testutil.ToFloat64(metrics.errors)).To(BeZero())
+	})
+
+	Describe("Replication", func() {
+		// makeTask creates a reconcile task with the given number of replicas and nodes.
+		makeTask := func(replicas int, nodes ...*corev1.Node) *controllerReconcileTask {
+			return &controllerReconcileTask{
+				logger:   logger,
+				replicas: replicas,
+				nodes:    nodes,
+			}
+		}
+
+		// replicaNames returns the names of the nodes selected as replicas.
+		replicaNames := func(task *controllerReconcileTask) []string {
+			var result []string
+			for _, node := range task.selectReplicas() {
+				result = append(result, node.Name)
+			}
+			return result
+		}
+
+		It("Selects the first nodes sorted by name", func() {
+			task := makeTask(
+				2,
+				makeNode("node2", nil, nil),
+				makeNode("node0", nil, nil),
+				makeNode("node1", nil, nil),
+			)
+			Expect(replicaNames(task)).To(Equal([]string{"node0", "node1"}))
+		})
+
+		It("Doesn't select replicas when replication is disabled", func() {
+			task := makeTask(
+				0,
+				makeNode("node0", nil, nil),
+				makeNode("node1", nil, nil),
+			)
+			Expect(task.selectReplicas()).To(BeEmpty())
+		})
+
+		It("Selects all the nodes when there are less nodes than replicas", func() {
+			task := makeTask(
+				3,
+				makeNode("node1", nil, nil),
+				makeNode("node0", nil, nil),
+			)
+			Expect(replicaNames(task)).To(Equal([]string{"node0", "node1"}))
+		})
+
+		It("Doesn't select the nodes that download the bundle from an URL", func() {
+			node0 := makeNode("node0", nil, nil)
+			node0.Status.NodeInfo.Architecture = "arm64"
+			node1 := makeNode("node1", nil, nil)
+			node1.Status.NodeInfo.Architecture = "amd64"
+			node2 := makeNode("node2", nil, nil)
+			node2.Status.NodeInfo.Architecture = "amd64"
+			task := makeTask(1, node0, node1, node2)
+			task.archBundles = []v1alpha1.ClusterUpgradeArchBundle{{
+				Arch: "aarch64",
+				URL:  "s3://bundles/4.13.4-aarch64.tar",
+			}}
+			Expect(replicaNames(task)).To(Equal([]string{"node1"}))
+		})
+
+		It("Doesn't select any node when all download the bundle from an URL", func() {
+			task := makeTask(
+				2,
+				makeNode("node0", nil, nil),
+				makeNode("node1", nil, nil),
+			)
+			task.bundleURL = "s3://bundles/4.13.4.tar"
+			Expect(task.selectReplicas()).To(BeEmpty())
+		})
+
+		// makeReplicatedClient creates a fake client containing the given nodes, a ready bundle
+		// server and a cluster upgrade that uses the bundle server with one replica.
+		makeReplicatedClient := func(nodes ...clnt.Object) clnt.Client {
+			server := &appsv1.DaemonSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "upgrade-tool",
+					Name:      bundleServer,
+				},
+				Status: appsv1.DaemonSetStatus{
+					NumberReady: 1,
+				},
+			}
+			objects := append([]clnt.Object{server}, nodes...)
+			client := makeClient(makeVersion(nil), objects...)
+			upgrade := &v1alpha1.ClusterUpgrade{}
+			key := clnt.ObjectKey{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			}
+			err := client.Get(ctx, key, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			replicas := int32(1)
+			upgrade.Spec.Bundle = v1alpha1.ClusterUpgradeBundle{
+				File: "/var/lib/upgrade/bundle.tar",
+			}
+			upgrade.Spec.Rollout.Replicas = &replicas
+			err = client.Update(ctx, upgrade)
+			Expect(err).ToNot(HaveOccurred())
+			return client
+		}
+
+		// extractorCommands returns the commands of the bundle extractor jobs indexed by
+		// node name.
+		extractorCommands := func(client clnt.Client) map[string][]string {
+			jobs := &batchv1.JobList{}
+			err := client.List(ctx, jobs, clnt.InNamespace("upgrade-tool"))
+			Expect(err).ToNot(HaveOccurred())
+			result := map[string][]string{}
+			for _, job := range jobs.Items {
+				if job.Labels[labels.Job] != bundleExtractor {
+					continue
+				}
+				spec := job.Spec.Template.Spec
+				result[spec.NodeName] = spec.Containers[0].Command
+			}
+			return result
+		}
+
+		It("Starts the extractors of the replicas before the rest of the nodes", func() {
+			client := makeReplicatedClient(
+				makeNode("node0", nil, nil),
+				makeNode("node1", nil, nil),
+				makeNode("node2", nil, nil),
+			)
+			reconcile(client)
+			commands := extractorCommands(client)
+			Expect(commands).To(HaveLen(1))
+			Expect(commands).To(HaveKey("node0"))
+			Expect(commands["node0"]).To(ContainElement("--replicate=true"))
+		})
+
+		It("Starts the rest of the extractors when the replicas have the bundle", func() {
+			client := makeReplicatedClient(
+				makeNode("node0", map[string]string{
+					labels.BundleExtracted: "true",
+				}, makeMetadata()),
+				makeNode("node1", nil, nil),
+				makeNode("node2", nil, nil),
+			)
+			reconcile(client)
+			commands := extractorCommands(client)
+			Expect(commands).To(HaveLen(2))
+			Expect(commands["node1"]).To(ContainElement("--replicate=false"))
+			Expect(commands["node2"]).To(ContainElement("--replicate=false"))
+		})
+	})
+})
@@ -19,13 +19,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-systemd/v22/dbus"
 	dreference "github.com/distribution/distribution/v3/reference"
 	"github.com/go-logr/logr"
+	godigest "github.com/opencontainers/go-digest"
 	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 	"google.golang.org/grpc"
@@ -33,6 +39,22 @@ import (
 	criv1 "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
+// CRIOImageStore describes the storage that CRI-O uses for images.
+type CRIOImageStore struct {
+	// Path is the directory where the images are stored, as reported by CRI-O.
+	Path string
+
+	// UsedBytes is the number of bytes used by the images.
+	UsedBytes uint64
+
+	// Images contains the identifiers of the images in the store and their sizes.
+	Images map[string]uint64
+
+	// Layers contains the compressed digests of the layers in the store. CRI-O doesn't report
+	// this, so it is empty unless the caller reads it from the container storage.
+	Layers map[godigest.Digest]bool
+}
+
 // CRIOToolBuilder contains the data and logic needed to create a tool that helps with management of
 // CRI-O. Don't create instances of this type directly, use the NewCRIOTool function instead.
 type CRIOToolBuilder struct {
@@ -44,10 +66,21 @@ type CRIOToolBuilder struct {
 // configuration files. Don't create instances of this type directly, use the NewCRIOTool function
 // instead.
 type CRIOTool struct {
-	logger      logr.Logger
-	rootDir     string
-	grpcConn    *grpc.ClientConn
-	imageClient criv1.ImageServiceClient
+	logger        logr.Logger
+	rootDir       string
+	grpcConn      *grpc.ClientConn
+	imageClient   criv1.ImageServiceClient
+	runtimeClient criv1.RuntimeServiceClient
+
+	// saved contains the original content of the configuration files that have been written,
+	// indexed by absolute path, so that they can be restored.
+	saved map[string]*crioSavedConf
+}
+
+// crioSavedConf is the original content of a configuration file.
+type crioSavedConf struct {
+	exists bool
+	data   []byte
 }
 
 // NewCRIOTool creates a builder that can then be used to configure and create a CRI-O tool.
@@ -90,15 +123,17 @@ func (b *CRIOToolBuilder) Build() (result *CRIOTool, err error) {
 		return
 	}
 
-	// Create the client for the image service:
+	// Create the clients for the image and runtime services:
 	imageClient := criv1.NewImageServiceClient(grpcConn)
+	runtimeClient := criv1.NewRuntimeServiceClient(grpcConn)
 
 	// Create and populate the object:
 	result = &CRIOTool{
-		logger:      b.logger,
-		rootDir:     b.rootDir,
-		grpcConn:    grpcConn,
-		imageClient: imageClient,
+		logger:        b.logger,
+		rootDir:       b.rootDir,
+		grpcConn:      grpcConn,
+		imageClient:   imageClient,
+		runtimeClient: runtimeClient,
 	}
 	return
 }
@@ -123,7 +158,7 @@ func (t *CRIOTool) CreatePinConf(refs []string) error {
 	fmt.Fprintf(buffer, "]\n")
 	file := t.absolutePath(crioPinConf)
 	data := buffer.Bytes()
-	err := os.WriteFile(file, data, 0644)
+	err := t.writeConf(file, data)
 	if err != nil {
 		return err
 	}
@@ -136,10 +171,13 @@ func (t *CRIOTool) CreatePinConf(refs []string) error {
 }
 
 // RemovePinConf removes the configuration file that instruct CRI-O to not garbage collect the
-// images.
+// images. It does nothing if the file doesn't exist.
 func (t *CRIOTool) RemovePinConf() error {
 	file := t.absolutePath(crioPinConf)
 	err := os.Remove(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -182,7 +220,7 @@ func (t *CRIOTool) CreateMirrorConf(mirror string, refs []string) error {
 	}
 	file := t.absolutePath(crioMirrorConf)
 	data := buffer.Bytes()
-	err := os.WriteFile(file, data, 0644)
+	err := t.writeConf(file, data)
 	if err != nil {
 		return err
 	}
@@ -194,10 +232,18 @@ func (t *CRIOTool) CreateMirrorConf(mirror string, refs []string) error {
 	return nil
 }
 
-// RemoveMirrorConf removes the configuration file that we use to configure mirroring.
+// RemoveMirrorConf removes the configuration file that we use to configure mirroring. It does
+// nothing if the file doesn't exist.
 func (l *CRIOTool) RemoveMirrorConf() error {
 	file := l.absolutePath(crioMirrorConf)
-	err := os.Remove(file)
+	err := l.saveConf(file)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -208,6 +254,111 @@ func (l *CRIOTool) RemoveMirrorConf() error {
 	return nil
 }
 
+// ConfFiles returns the absolute paths of the configuration files created by this tool that
+// currently exist.
+func (t *CRIOTool) ConfFiles() (result []string, err error) {
+	for _, file := range []string{crioMirrorConf, crioPinConf} {
+		file = t.absolutePath(file)
+		_, err = os.Stat(file)
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		result = append(result, file)
+	}
+	return
+}
+
+// RemoveStaleMirrorConf removes the configuration file that we use to configure mirroring if it
+// was left behind by a previous execution that didn't finish, for example because it was killed.
+// Returns true if the file existed. Note that the removal isn't saved, so the file will not be
+// restored by RestoreConf.
+func (t *CRIOTool) RemoveStaleMirrorConf() (removed bool, err error) {
+	file := t.absolutePath(crioMirrorConf)
+	err = os.Remove(file)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	removed = true
+	t.logger.Info(
+		"Removed stale mirroring configuration",
+		"file", file,
+	)
+	return
+}
+
+// RestoreConf restores the configuration files written or removed by this tool to the content
+// they had before, and reloads CRI-O so that the restored configuration is used. It does nothing
+// if no configuration file has been changed.
+func (t *CRIOTool) RestoreConf(ctx context.Context) error {
+	if len(t.saved) == 0 {
+		return nil
+	}
+	files := maps.Keys(t.saved)
+	slices.Sort(files)
+	for _, file := range files {
+		saved := t.saved[file]
+		var err error
+		if saved.exists {
+			err = os.WriteFile(file, saved.data, 0644)
+		} else {
+			err = os.Remove(file)
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		delete(t.saved, file)
+		t.logger.Info(
+			"Restored configuration",
+			"file", file,
+			"existed", saved.exists,
+		)
+	}
+	return t.ReloadService(ctx)
+}
+
+// writeConf writes a configuration file, saving first the original content.
+func (t *CRIOTool) writeConf(file string, data []byte) error {
+	err := t.saveConf(file)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+// saveConf saves the content of the given configuration file so that it can later be restored.
+// Only the first call for each file saves the content, as that is the original one.
+func (t *CRIOTool) saveConf(file string) error {
+	if _, ok := t.saved[file]; ok {
+		return nil
+	}
+	saved := &crioSavedConf{}
+	data, err := os.ReadFile(file)
+	switch {
+	case err == nil:
+		saved.exists = true
+		saved.data = data
+	case errors.Is(err, os.ErrNotExist):
+	default:
+		return err
+	}
+	if t.saved == nil {
+		t.saved = map[string]*crioSavedConf{}
+	}
+	t.saved[file] = saved
+	return nil
+}
+
 // ReloadService reloads the CRI-O configuration with the equivalent of 'systemctl reload
 // crio.service'.
 func (t *CRIOTool) ReloadService(ctx context.Context) error {
@@ -258,13 +409,15 @@ func (t *CRIOTool) ReloadService(ctx context.Context) error {
 	return nil
 }
 
-// Pull image asks CRI-O to pull the given image references.
-func (t *CRIOTool) PullImage(ctx context.Context, ref string) error {
+// Pull image asks CRI-O to pull the given image references. The optional authentication
+// configuration is used for all the registries that CRI-O contacts, including mirrors.
+func (t *CRIOTool) PullImage(ctx context.Context, ref string, auth *criv1.AuthConfig) error {
 	start := time.Now()
 	request := &criv1.PullImageRequest{
 		Image: &criv1.ImageSpec{
 			Image: ref,
 		},
+		Auth: auth,
 	}
 	response, err := t.imageClient.PullImage(ctx, request)
 	if err != nil {
@@ -279,6 +432,212 @@ func (t *CRIOTool) PullImage(ctx context.Context, ref string) error {
 	return nil
 }
 
+// CheckHealth checks that CRI-O is healthy: that it responds to requests and that it reports that
+// the runtime is ready.
+func (t *CRIOTool) CheckHealth(ctx context.Context) error {
+	version, err := t.runtimeClient.Version(ctx, &criv1.VersionRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to get CRI-O version: %w", err)
+	}
+	status, err := t.runtimeClient.Status(ctx, &criv1.StatusRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to get CRI-O status: %w", err)
+	}
+	if status.Status == nil {
+		return errors.New("CRI-O didn't return the status")
+	}
+	for _, condition := range status.Status.Conditions {
+		if condition.Type != criv1.RuntimeReady {
+			continue
+		}
+		if !condition.Status {
+			return fmt.Errorf(
+				"CRI-O runtime isn't ready, reason is '%s' and message is '%s'",
+				condition.Reason, condition.Message,
+			)
+		}
+		t.logger.V(1).Info(
+			"CRI-O is healthy",
+			"runtime", version.RuntimeName,
+			"version", version.RuntimeVersion,
+		)
+		return nil
+	}
+	return errors.New("CRI-O didn't report the runtime ready condition")
+}
+
+// CheckPinConf checks that the configuration that CRI-O is currently using pins the given images.
+// This is used to verify that the configuration files have been loaded after reloading the
+// service. The configuration is obtained from the HTTP server that CRI-O runs in the same socket
+// than the gRPC server, like the 'crio status config' command does.
+func (t *CRIOTool) CheckPinConf(ctx context.Context, refs []string) error {
+	socket := t.absolutePath(crioSocket)
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				dialer := &net.Dialer{}
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, crioConfigURL, nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to get CRI-O configuration: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf(
+			"failed to get CRI-O configuration, status code is %d",
+			response.StatusCode,
+		)
+	}
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	config := string(data)
+	for _, ref := range refs {
+		if !strings.Contains(config, fmt.Sprintf("%q", ref)) {
+			return fmt.Errorf(
+				"CRI-O configuration doesn't pin image '%s', the pinning "+
+					"configuration didn't take effect",
+				ref,
+			)
+		}
+	}
+	t.logger.V(1).Info(
+		"Checked CRI-O pinning configuration",
+		"images", len(refs),
+	)
+	return nil
+}
+
+// ImageDigests returns the digests of the manifests of the given image, as stored by CRI-O. Returns
+// an empty list if the image isn't in the store.
+func (t *CRIOTool) ImageDigests(ctx context.Context, ref string) (result []string, err error) {
+	request := &criv1.ImageStatusRequest{
+		Image: &criv1.ImageSpec{
+			Image: ref,
+		},
+	}
+	response, err := t.imageClient.ImageStatus(ctx, request)
+	if err != nil {
+		return
+	}
+	if response.Image == nil {
+		return
+	}
+	for _, repoDigest := range response.Image.RepoDigests {
+		index := strings.LastIndex(repoDigest, "@")
+		if index >= 0 {
+			result = append(result, repoDigest[index+1:])
+		}
+	}
+	return
+}
+
+// PinnedImages returns the image references of the pinning configuration file. Returns an empty
+// list if the file doesn't exist.
+func (t *CRIOTool) PinnedImages() (result []string, err error) {
+	file := t.absolutePath(crioPinConf)
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	for _, match := range crioQuotedRE.FindAllStringSubmatch(string(data), -1) {
+		result = append(result, match[1])
+	}
+	return
+}
+
+// ListImages returns the images that are in the CRI-O storage.
+func (t *CRIOTool) ListImages(ctx context.Context) (result []*criv1.Image, err error) {
+	response, err := t.imageClient.ListImages(ctx, &criv1.ListImagesRequest{})
+	if err != nil {
+		return
+	}
+	result = response.Images
+	return
+}
+
+// UsedImages returns the set of images used by containers, running or not. The set contains both
+// the image references and the image identifiers used by the containers.
+func (t *CRIOTool) UsedImages(ctx context.Context) (result map[string]bool, err error) {
+	response, err := t.runtimeClient.ListContainers(ctx, &criv1.ListContainersRequest{})
+	if err != nil {
+		return
+	}
+	result = map[string]bool{}
+	for _, container := range response.Containers {
+		if container.ImageRef != "" {
+			result[container.ImageRef] = true
+		}
+		if container.Image != nil && container.Image.Image != "" {
+			result[container.Image.Image] = true
+		}
+	}
+	return
+}
+
+// RemoveImage removes the image with the given identifier from the CRI-O storage.
+func (t *CRIOTool) RemoveImage(ctx context.Context, id string) error {
+	request := &criv1.RemoveImageRequest{
+		Image: &criv1.ImageSpec{
+			Image: id,
+		},
+	}
+	_, err := t.imageClient.RemoveImage(ctx, request)
+	if err != nil {
+		return err
+	}
+	t.logger.Info(
+		"Removed image",
+		"id", id,
+	)
+	return nil
+}
+
+// ImageStore returns the description of the storage that CRI-O uses for images.
+func (t *CRIOTool) ImageStore(ctx context.Context) (result *CRIOImageStore, err error) {
+	fsResponse, err := t.imageClient.ImageFsInfo(ctx, &criv1.ImageFsInfoRequest{})
+	if err != nil {
+		return
+	}
+	listResponse, err := t.imageClient.ListImages(ctx, &criv1.ListImagesRequest{})
+	if err != nil {
+		return
+	}
+	result = &CRIOImageStore{
+		Images: map[string]uint64{},
+	}
+	for _, fs := range fsResponse.ImageFilesystems {
+		if fs.FsId != nil && result.Path == "" {
+			result.Path = fs.FsId.Mountpoint
+		}
+		if fs.UsedBytes != nil {
+			result.UsedBytes += fs.UsedBytes.Value
+		}
+	}
+	for _, image := range listResponse.Images {
+		result.Images[image.Id] = image.Size_
+	}
+	t.logger.V(1).Info(
+		"Read image store",
+		"path", result.Path,
+		"used", result.UsedBytes,
+		"images", len(result.Images),
+	)
+	return
+}
+
 func (t *CRIOTool) absolutePath(relPath string) string {
 	absPath := relPath
 	if t.rootDir != "" {
@@ -293,6 +652,14 @@ const (
 	crioMirrorConf = "/etc/containers/registries.conf.d/999-upgrade-mirror.conf"
 	crioPinConf    = "/etc/crio/crio.conf.d/99-upgrade-pin"
 
+	// crioConfigURL is the URL of the endpoint that returns the configuration. Note that the
+	// host is ignored because the connection is always to the CRI-O socket.
+	crioConfigURL = "http://localhost/config"
+
 	dbusSystemSocket = "/var/run/dbus/system_bus_socket"
 	dbusSystemEnv    = "DBUS_SYSTEM_BUS_ADDRESS"
 )
+
+// crioQuotedRE is the regular expression used to extract the quoted image references from the
+// pinning configuration file.
+var crioQuotedRE = regexp.MustCompile(`"([^"]*)"`)
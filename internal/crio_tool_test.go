@@ -0,0 +1,245 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	criv1 "k8s.io/cri-api/pkg/apis/runtime/v1"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("CRI-O tool", func() {
+	var (
+		ctx    context.Context
+		tmp    string
+		tool   *CRIOTool
+		pin    string
+		mirror string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err := logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create a temporary directory with the directories for the configuration files:
+		tmp, err = os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		pin = filepath.Join(tmp, crioPinConf)
+		mirror = filepath.Join(tmp, crioMirrorConf)
+		for _, file := range []string{pin, mirror} {
+			err = os.MkdirAll(filepath.Dir(file), 0755)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		// Create the tool. Note that there is no D-Bus server, so reloading the service
+		// will fail, but the configuration files will still be restored.
+		tool = &CRIOTool{
+			logger:  logger,
+			rootDir: tmp,
+		}
+	})
+
+	It("Restores the original configuration", func() {
+		// Create a pinning configuration that existed before:
+		err := os.WriteFile(pin, []byte("original"), 0644)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Replace the configuration:
+		refs := []string{"quay.io/openshift/image:1"}
+		err = tool.CreatePinConf(refs)
+		Expect(err).ToNot(HaveOccurred())
+		err = tool.CreateMirrorConf("localhost:5000", refs)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mirror).To(BeARegularFile())
+
+		// Restore it:
+		_ = tool.RestoreConf(ctx)
+		data, err := os.ReadFile(pin)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("original"))
+		Expect(mirror).ToNot(BeAnExistingFile())
+	})
+
+	It("Restores the content from before the first change", func() {
+		err := tool.CreatePinConf([]string{"quay.io/openshift/image:1"})
+		Expect(err).ToNot(HaveOccurred())
+		err = tool.CreatePinConf([]string{"quay.io/openshift/image:2"})
+		Expect(err).ToNot(HaveOccurred())
+		_ = tool.RestoreConf(ctx)
+		Expect(pin).ToNot(BeAnExistingFile())
+	})
+
+	It("Does nothing if nothing was changed", func() {
+		err := tool.RestoreConf(ctx)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Removes stale mirroring configuration without saving it", func() {
+		err := os.WriteFile(mirror, []byte("stale"), 0644)
+		Expect(err).ToNot(HaveOccurred())
+		removed, err := tool.RemoveStaleMirrorConf()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(removed).To(BeTrue())
+		Expect(mirror).ToNot(BeAnExistingFile())
+		err = tool.CreateMirrorConf("localhost:5000", []string{"quay.io/openshift/image:1"})
+		Expect(err).ToNot(HaveOccurred())
+		_ = tool.RestoreConf(ctx)
+		Expect(mirror).ToNot(BeAnExistingFile())
+	})
+
+	It("Doesn't fail if there is no stale mirroring configuration", func() {
+		removed, err := tool.RemoveStaleMirrorConf()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(removed).To(BeFalse())
+	})
+
+	Describe("Health check", func() {
+		It("Succeeds if the runtime is ready", func() {
+			tool.runtimeClient = &fakeRuntimeClient{
+				ready: true,
+			}
+			err := tool.CheckHealth(ctx)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Fails if the runtime isn't ready", func() {
+			tool.runtimeClient = &fakeRuntimeClient{
+				ready: false,
+			}
+			err := tool.CheckHealth(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("isn't ready"))
+		})
+
+		It("Fails if CRI-O doesn't respond", func() {
+			tool.runtimeClient = &fakeRuntimeClient{
+				err: errors.New("connection refused"),
+			}
+			err := tool.CheckHealth(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("connection refused"))
+		})
+	})
+
+	Describe("Pinning configuration check", func() {
+		var config string
+
+		BeforeEach(func() {
+			// Start an HTTP server in the CRI-O socket that returns the configuration:
+			socket := filepath.Join(tmp, crioSocket)
+			err := os.MkdirAll(filepath.Dir(socket), 0755)
+			Expect(err).ToNot(HaveOccurred())
+			listener, err := net.Listen("unix", socket)
+			Expect(err).ToNot(HaveOccurred())
+			server := &http.Server{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprint(w, config)
+				}),
+			}
+			go func() {
+				defer GinkgoRecover()
+				_ = server.Serve(listener)
+			}()
+			DeferCleanup(server.Close)
+		})
+
+		It("Succeeds if all the images are pinned", func() {
+			config = `pinned_images = ["quay.io/openshift/image:1", "quay.io/openshift/image:2"]`
+			err := tool.CheckPinConf(ctx, []string{
+				"quay.io/openshift/image:1",
+				"quay.io/openshift/image:2",
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Fails if some image isn't pinned", func() {
+			config = `pinned_images = ["quay.io/openshift/image:1"]`
+			err := tool.CheckPinConf(ctx, []string{
+				"quay.io/openshift/image:1",
+				"quay.io/openshift/image:2",
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("quay.io/openshift/image:2"))
+		})
+	})
+})
+
+// fakeRuntimeClient is an implementation of the CRI runtime service client that returns the
+// version and the status used by the health check, and the given list of containers.
+type fakeRuntimeClient struct {
+	criv1.RuntimeServiceClient
+	ready      bool
+	err        error
+	containers []*criv1.Container
+}
+
+func (c *fakeRuntimeClient) ListContainers(ctx context.Context, in *criv1.ListContainersRequest,
+	opts ...grpc.CallOption) (out *criv1.ListContainersResponse, err error) {
+	out = &criv1.ListContainersResponse{
+		Containers: c.containers,
+	}
+	return
+}
+
+func (c *fakeRuntimeClient) Version(ctx context.Context, in *criv1.VersionRequest,
+	opts ...grpc.CallOption) (out *criv1.VersionResponse, err error) {
+	if c.err != nil {
+		err = c.err
+		return
+	}
+	out = &criv1.VersionResponse{
+		RuntimeName:    "cri-o",
+		RuntimeVersion: "1.27.0",
+	}
+	return
+}
+
+func (c *fakeRuntimeClient) Status(ctx context.Context, in *criv1.StatusRequest,
+	opts ...grpc.CallOption) (out *criv1.StatusResponse, err error) {
+	if c.err != nil {
+		err = c.err
+		return
+	}
+	out = &criv1.StatusResponse{
+		Status: &criv1.RuntimeStatus{
+			Conditions: []*criv1.RuntimeCondition{{
+				Type:   criv1.RuntimeReady,
+				Status: c.ready,
+			}},
+		},
+	}
+	return
+}
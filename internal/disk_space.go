@@ -0,0 +1,46 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// availableSpace returns the number of bytes available to unprivileged users in the filesystem
+// that contains the given directory. If the directory doesn't exist yet it uses the nearest parent
+// that exists, as that is where the directory will be created.
+func availableSpace(dir string) (result uint64, err error) {
+	for {
+		_, err = os.Stat(dir)
+		if err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, os.ErrNotExist) || parent == dir {
+			return
+		}
+		dir = parent
+	}
+	var stat syscall.Statfs_t
+	err = syscall.Statfs(dir, &stat)
+	if err != nil {
+		return
+	}
+	result = uint64(stat.Bavail) * uint64(stat.Bsize)
+	return
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+// Names of the supported distributions:
+const (
+	// DistributionOCP is OpenShift Container Platform. Releases are published with tags that
+	// contain the version and the architecture, for example '4.13.4-x86_64', and are signed.
+	DistributionOCP = "ocp"
+
+	// DistributionOKD is the community distribution of OpenShift. Releases are published with
+	// tags that contain only the version, for example '4.14.0-0.okd-scos-2023-10-21-013046',
+	// and aren't signed.
+	DistributionOKD = "okd"
+)
+
+// Distributions returns the names of the supported distributions.
+func Distributions() []string {
+	return []string{
+		DistributionOCP,
+		DistributionOKD,
+	}
+}
+
+// distributionReleaseRepos contains the default release repository for each distribution.
+var distributionReleaseRepos = map[string]string{
+	DistributionOCP: "quay.io/openshift-release-dev/ocp-release",
+	DistributionOKD: "quay.io/okd/scos-release",
+}
+
+// distributionGraphURLs contains the default URL of the update graph for each distribution.
+var distributionGraphURLs = map[string]string{
+	DistributionOCP: "https://api.openshift.com/api/upgrades_info/v1/graph",
+}
+
+// distributionOSArchs maps the architecture names used in the version tags of OpenShift
+// releases to the names used in the platform of multi-architecture images.
+var distributionOSArchs = map[string]string{
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+}
+
+// distributionOSArch returns the name of the architecture used in the platforms of images,
+// accepting also the names used in the release tags. It returns an empty string if the
+// architecture isn't supported.
+func distributionOSArch(arch string) string {
+	for tagArch, osArch := range distributionOSArchs {
+		if arch == tagArch || arch == osArch {
+			return osArch
+		}
+	}
+	return ""
+}
+
+// distributionTagArch returns the name of the architecture used in the release tags, accepting
+// also the names used in the platforms of images. It returns an empty string if the architecture
+// isn't supported.
+func distributionTagArch(arch string) string {
+	for tagArch, osArch := range distributionOSArchs {
+		if arch == tagArch || arch == osArch {
+			return tagArch
+		}
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Names of the node roles used in the image sets of the bundle metadata:
+const (
+	RoleControlPlane = "control-plane"
+	RoleWorker       = "worker"
+)
+
+// ControlPlaneImages is the list of names of payload images that are only used in control plane
+// nodes, and that therefore don't need to be loaded in worker nodes.
+var ControlPlaneImages = []string{
+	"cluster-authentication-operator",
+	"cluster-etcd-operator",
+	"cluster-kube-apiserver-operator",
+	"cluster-kube-controller-manager-operator",
+	"cluster-kube-scheduler-operator",
+	"cluster-openshift-apiserver-operator",
+	"cluster-openshift-controller-manager-operator",
+	"etcd",
+	"oauth-apiserver",
+	"oauth-server",
+	"openshift-apiserver",
+}
+
+// RoleImages calculates the names of the payload images needed by each node role, given the names
+// of all the payload images. Control plane nodes need all the images, and worker nodes need all
+// except the ones in the ControlPlaneImages list.
+func RoleImages(tags map[string]string) map[string][]string {
+	all := maps.Keys(tags)
+	slices.Sort(all)
+	workers := make([]string, 0, len(all))
+	for _, name := range all {
+		if !slices.Contains(ControlPlaneImages, name) {
+			workers = append(workers, name)
+		}
+	}
+	return map[string][]string{
+		RoleControlPlane: all,
+		RoleWorker:       workers,
+	}
+}
+
+// NodeRoles returns the roles of the given node, extracted from the 'node-role.kubernetes.io/...'
+// labels. The legacy 'master' role is returned as 'control-plane'.
+func NodeRoles(node *corev1.Node) []string {
+	var result []string
+	for label := range node.Labels {
+		role, ok := strings.CutPrefix(label, nodeRoleLabelPrefix)
+		if !ok || role == "" {
+			continue
+		}
+		if role == nodeRoleMaster {
+			role = RoleControlPlane
+		}
+		if !slices.Contains(result, role) {
+			result = append(result, role)
+		}
+	}
+	slices.Sort(result)
+	return result
+}
+
+// SelectRoleImages returns the image references from the metadata that are needed by nodes with
+// the given roles. All the images are returned if the metadata doesn't contain the image sets, if
+// the node has no roles, or if any of the roles of the node isn't in the metadata, as in those
+// cases we can't know what images are needed. Images that don't have a name are always returned.
+func SelectRoleImages(metadata *Metadata, roles []string) []string {
+	if len(metadata.Roles) == 0 || len(roles) == 0 {
+		return slices.Clone(metadata.Images)
+	}
+	needed := map[string]bool{}
+	for _, role := range roles {
+		names, ok := metadata.Roles[role]
+		if !ok {
+			return slices.Clone(metadata.Images)
+		}
+		for _, name := range names {
+			needed[name] = true
+		}
+	}
+	named := map[string]bool{}
+	wanted := map[string]bool{}
+	for name, ref := range metadata.Tags {
+		named[ref] = true
+		if needed[name] {
+			wanted[ref] = true
+		}
+	}
+	result := make([]string, 0, len(metadata.Images))
+	for _, ref := range metadata.Images {
+		if wanted[ref] || !named[ref] {
+			result = append(result, ref)
+		}
+	}
+	return result
+}
+
+const (
+	nodeRoleLabelPrefix = "node-role.kubernetes.io/"
+	nodeRoleMaster      = "master"
+)
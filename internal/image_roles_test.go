@@ -0,0 +1,123 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Image roles", func() {
+	tags := map[string]string{
+		"etcd":                    "quay.io/openshift/etcd@sha256:1",
+		"hyperkube":               "quay.io/openshift/hyperkube@sha256:2",
+		"machine-config-operator": "quay.io/openshift/mco@sha256:3",
+		"openshift-apiserver":     "quay.io/openshift/apiserver@sha256:4",
+	}
+	images := []string{
+		"quay.io/openshift/etcd@sha256:1",
+		"quay.io/openshift/hyperkube@sha256:2",
+		"quay.io/openshift/mco@sha256:3",
+		"quay.io/openshift/apiserver@sha256:4",
+		"quay.io/openshift/unnamed@sha256:5",
+	}
+
+	It("Calculates the images of each role", func() {
+		roles := RoleImages(tags)
+		Expect(roles).To(HaveLen(2))
+		Expect(roles[RoleControlPlane]).To(Equal([]string{
+			"etcd",
+			"hyperkube",
+			"machine-config-operator",
+			"openshift-apiserver",
+		}))
+		Expect(roles[RoleWorker]).To(Equal([]string{
+			"hyperkube",
+			"machine-config-operator",
+		}))
+	})
+
+	It("Extracts the roles of the node", func() {
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{
+					"kubernetes.io/hostname":                "my-node",
+					"node-role.kubernetes.io/master":        "",
+					"node-role.kubernetes.io/control-plane": "",
+					"node-role.kubernetes.io/worker":        "",
+				},
+			},
+		}
+		Expect(NodeRoles(node)).To(Equal([]string{
+			RoleControlPlane,
+			RoleWorker,
+		}))
+	})
+
+	It("Selects the images of worker nodes", func() {
+		metadata := &Metadata{
+			Images: images,
+			Tags:   tags,
+			Roles:  RoleImages(tags),
+		}
+		result := SelectRoleImages(metadata, []string{RoleWorker})
+		Expect(result).To(Equal([]string{
+			"quay.io/openshift/hyperkube@sha256:2",
+			"quay.io/openshift/mco@sha256:3",
+			"quay.io/openshift/unnamed@sha256:5",
+		}))
+	})
+
+	It("Selects all the images for nodes that are control plane and worker", func() {
+		metadata := &Metadata{
+			Images: images,
+			Tags:   tags,
+			Roles:  RoleImages(tags),
+		}
+		result := SelectRoleImages(metadata, []string{RoleControlPlane, RoleWorker})
+		Expect(result).To(Equal(images))
+	})
+
+	It("Selects all the images if the metadata doesn't have roles", func() {
+		metadata := &Metadata{
+			Images: images,
+			Tags:   tags,
+		}
+		result := SelectRoleImages(metadata, []string{RoleWorker})
+		Expect(result).To(Equal(images))
+	})
+
+	It("Selects all the images if the role isn't known", func() {
+		metadata := &Metadata{
+			Images: images,
+			Tags:   tags,
+			Roles:  RoleImages(tags),
+		}
+		result := SelectRoleImages(metadata, []string{"infra"})
+		Expect(result).To(Equal(images))
+	})
+
+	It("Selects all the images if the node has no roles", func() {
+		metadata := &Metadata{
+			Images: images,
+			Tags:   tags,
+			Roles:  RoleImages(tags),
+		}
+		result := SelectRoleImages(metadata, nil)
+		Expect(result).To(Equal(images))
+	})
+})
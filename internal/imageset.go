@@ -0,0 +1,71 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+// imageSetMetadata contains the fields of the '.metadata.json' file of the imageset archives
+// created by the 'oc-mirror' tool that are needed to find and describe the release images.
+type imageSetMetadata struct {
+	Kind       string             `json:"kind,omitempty"`
+	APIVersion string             `json:"apiVersion,omitempty"`
+	UID        string             `json:"uid,omitempty"`
+	SingleUse  bool               `json:"singleUse"`
+	PastMirror imageSetPastMirror `json:"pastMirror"`
+}
+
+type imageSetPastMirror struct {
+	Timestamp    int64                 `json:"timestamp,omitempty"`
+	Sequence     int                   `json:"sequence,omitempty"`
+	Associations []imageSetAssociation `json:"associations"`
+}
+
+// imageSetAssociation describes an image contained in the imageset archive. The name is the
+// original reference of the image, the identifier is the digest of the manifest and the tag
+// symlink is the tag used in the archive, for example '4.13.4-x86_64' for the release image or
+// '4.13.4-x86_64-etcd' for a payload image.
+type imageSetAssociation struct {
+	Name            string   `json:"name"`
+	Path            string   `json:"path"`
+	TagSymlink      string   `json:"tagSymlink"`
+	ID              string   `json:"id"`
+	Type            string   `json:"type"`
+	ManifestDigests []string `json:"manifestDigests,omitempty"`
+	LayerDigests    []string `json:"layerDigests,omitempty"`
+}
+
+// imageSetReleaseTag returns the tag used in imageset archives for the release image of the given
+// version, architecture and distribution.
+func imageSetReleaseTag(version, arch, distribution string) string {
+	if distribution == DistributionOKD {
+		return version
+	}
+	return version + "-" + arch
+}
+
+// imageSetMetadataFile is the name of the file inside the imageset archive that contains the
+// metadata.
+const imageSetMetadataFile = "publish/.metadata.json"
+
+// Types of the imageset associations for release images and for payload images.
+const (
+	imageSetReleaseType        = "ocpRelease"
+	imageSetReleaseContentType = "ocpReleaseContent"
+)
+
+// Names of the repositories used inside imageset archives for release images and for payload
+// images.
+const (
+	imageSetReleaseRepo        = "openshift/release-images"
+	imageSetReleaseContentRepo = "openshift/release"
+)
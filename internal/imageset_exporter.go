@@ -0,0 +1,458 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	dreference "github.com/distribution/distribution/v3/reference"
+	"github.com/go-logr/logr"
+	godigest "github.com/opencontainers/go-digest"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+// ImageSetExporterBuilder contains the data and logic needed to create an imageset exporter. Don't
+// create instances of this type directly, use the NewImageSetExporter function instead.
+type ImageSetExporterBuilder struct {
+	logger logr.Logger
+	bundle string
+	file   string
+}
+
+// ImageSetExporter knows how to convert an upgrade bundle into an imageset archive with the layout
+// used by the 'oc-mirror' tool, so that it can be published to a mirror registry with the
+// 'oc-mirror --from' command. Don't create instances of this type directly, use the
+// NewImageSetExporter function instead.
+type ImageSetExporter struct {
+	logger logr.Logger
+	bundle string
+	file   string
+}
+
+// imageSetExportTask contains the data used during the export of one bundle.
+type imageSetExportTask struct {
+	logger    logr.Logger
+	bundle    string
+	file      string
+	metadata  *Metadata
+	revisions map[godigest.Digest]bool
+	manifests map[godigest.Digest][]byte
+	writer    *tar.Writer
+}
+
+// NewImageSetExporter creates a builder that can then be used to configure and create imageset
+// exporters.
+func NewImageSetExporter() *ImageSetExporterBuilder {
+	return &ImageSetExporterBuilder{}
+}
+
+// SetLogger sets the logger that the exporter will use to write log messages. This is mandatory.
+func (b *ImageSetExporterBuilder) SetLogger(value logr.Logger) *ImageSetExporterBuilder {
+	b.logger = value
+	return b
+}
+
+// SetBundle sets the name of the bundle file that will be converted. This is mandatory.
+func (b *ImageSetExporterBuilder) SetBundle(value string) *ImageSetExporterBuilder {
+	b.bundle = value
+	return b
+}
+
+// SetFile sets the name of the imageset archive file that will be created. This is mandatory.
+func (b *ImageSetExporterBuilder) SetFile(value string) *ImageSetExporterBuilder {
+	b.file = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new imageset exporter.
+func (b *ImageSetExporterBuilder) Build() (result *ImageSetExporter, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+	if b.bundle == "" {
+		err = errors.New("bundle is mandatory")
+		return
+	}
+	if b.file == "" {
+		err = errors.New("file is mandatory")
+		return
+	}
+
+	// Create and populate the object:
+	result = &ImageSetExporter{
+		logger: b.logger,
+		bundle: b.bundle,
+		file:   b.file,
+	}
+	return
+}
+
+// Run converts the bundle into the imageset archive. The bundle is read twice: first to find the
+// metadata and the manifests of each repository, and then to copy the blobs.
+func (e *ImageSetExporter) Run(ctx context.Context) (err error) {
+	task := &imageSetExportTask{
+		logger:    e.logger,
+		bundle:    e.bundle,
+		file:      e.file,
+		revisions: map[godigest.Digest]bool{},
+		manifests: map[godigest.Digest][]byte{},
+	}
+	return task.execute(ctx)
+}
+
+func (t *imageSetExportTask) execute(ctx context.Context) (err error) {
+	// Find the metadata and the manifests:
+	err = t.scanBundle(ctx)
+	if err != nil {
+		return
+	}
+	if t.metadata == nil {
+		err = fmt.Errorf("bundle '%s' doesn't contain metadata", t.bundle)
+		return
+	}
+
+	// Create the output file, and remove it if something fails:
+	file, err := os.Create(t.file)
+	if err != nil {
+		return
+	}
+	defer func() {
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(t.file)
+		}
+	}()
+	t.writer = tar.NewWriter(file)
+
+	// Copy the blobs, and then write the manifests and the metadata:
+	err = t.copyBlobs(ctx)
+	if err != nil {
+		return
+	}
+	associations, err := t.writeManifests()
+	if err != nil {
+		return
+	}
+	err = t.writeMetadata(associations)
+	if err != nil {
+		return
+	}
+	err = t.writer.Close()
+	if err != nil {
+		return
+	}
+	t.logger.Info(
+		"Exported imageset",
+		"bundle", t.bundle,
+		"file", t.file,
+		"images", len(associations),
+	)
+	return
+}
+
+// scanBundle reads the bundle metadata and the revision links, in order to know which blobs are
+// manifests.
+func (t *imageSetExportTask) scanBundle(ctx context.Context) error {
+	return t.walkBundle(ctx, func(name string, reader io.Reader) error {
+		if name == "metadata.json" {
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				return err
+			}
+			t.metadata = &Metadata{}
+			return json.Unmarshal(data, t.metadata)
+		}
+		if !strings.HasPrefix(name, imageSetExportRepositoriesDir) {
+			return nil
+		}
+		_, rest, ok := strings.Cut(name, "/_manifests/revisions/")
+		if !ok {
+			return nil
+		}
+		digest, ok := t.linkDigest(rest)
+		if !ok {
+			return nil
+		}
+		t.revisions[digest] = true
+		return nil
+	})
+}
+
+// copyBlobs copies the blobs that aren't manifests to the 'blobs' directory of the archive, and
+// saves the manifests in memory so that they can later be written to the directories of their
+// repositories.
+func (t *imageSetExportTask) copyBlobs(ctx context.Context) error {
+	return t.walkBundle(ctx, func(name string, reader io.Reader) error {
+		rest, ok := strings.CutPrefix(name, imageSetExportBlobsDir)
+		if !ok || path.Base(rest) != "data" {
+			return nil
+		}
+		digest, ok := t.linkDigest(path.Dir(rest))
+		if !ok {
+			return nil
+		}
+		if t.revisions[digest] {
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				return err
+			}
+			t.manifests[digest] = data
+			return nil
+		}
+		return t.writeFile("blobs/"+digest.String(), reader, -1)
+	})
+}
+
+// writeManifests writes the manifests to the repositories of the archive, together with the tags
+// that point to them, and returns the associations that describe them.
+func (t *imageSetExportTask) writeManifests() (result []imageSetAssociation, err error) {
+	// Calculate the tags of the release image and of the payload images:
+	releaseTag := imageSetReleaseTag(
+		t.metadata.Version, t.metadata.Arch, t.metadata.Distribution,
+	)
+	tags := t.metadata.Tags
+	if len(tags) == 0 {
+		// Older bundles don't contain the names of the payload images, so we use the
+		// digests instead:
+		tags = map[string]string{}
+		for _, ref := range t.metadata.Images {
+			named, err := dreference.ParseNamed(ref)
+			if err != nil {
+				continue
+			}
+			digested, ok := named.(dreference.Digested)
+			if ok {
+				tags[digested.Digest().Encoded()] = ref
+			}
+		}
+	}
+
+	// Add the release image:
+	assoc, err := t.writeImage(
+		t.metadata.Release, imageSetReleaseRepo, releaseTag, imageSetReleaseType,
+	)
+	if err != nil {
+		return
+	}
+	result = append(result, assoc)
+
+	// Add the payload images:
+	names := maps.Keys(tags)
+	slices.Sort(names)
+	for _, name := range names {
+		assoc, err = t.writeImage(
+			tags[name], imageSetReleaseContentRepo, releaseTag+"-"+name,
+			imageSetReleaseContentType,
+		)
+		if err != nil {
+			return
+		}
+		result = append(result, assoc)
+	}
+	return
+}
+
+// writeImage writes the manifest of the given image, and the manifests of the list if it is a
+// list, to the given repository of the archive, and creates the tag symlink.
+func (t *imageSetExportTask) writeImage(ref, repo, tag, kind string) (result imageSetAssociation,
+	err error) {
+	named, err := dreference.ParseNamed(ref)
+	if err != nil {
+		return
+	}
+	digested, ok := named.(dreference.Digested)
+	if !ok {
+		err = fmt.Errorf("image reference '%s' doesn't contain a digest", ref)
+		return
+	}
+	digest := digested.Digest()
+	result = imageSetAssociation{
+		Name:       ref,
+		Path:       fmt.Sprintf("%s:%s", repo, tag),
+		TagSymlink: tag,
+		ID:         digest.String(),
+		Type:       kind,
+	}
+	pending := []godigest.Digest{digest}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		data, ok := t.manifests[current]
+		if !ok {
+			err = fmt.Errorf(
+				"manifest '%s' of image '%s' isn't in the bundle",
+				current, ref,
+			)
+			return
+		}
+		var manifest registryManifest
+		err = json.Unmarshal(data, &manifest)
+		if err != nil {
+			return
+		}
+		for _, child := range manifest.Manifests {
+			pending = append(pending, child.Digest)
+			result.ManifestDigests = append(result.ManifestDigests, child.Digest.String())
+		}
+		if manifest.Config != nil {
+			result.LayerDigests = append(result.LayerDigests, manifest.Config.Digest.String())
+		}
+		for _, layer := range manifest.Layers {
+			result.LayerDigests = append(result.LayerDigests, layer.Digest.String())
+		}
+		name := path.Join("v2", repo, "manifests", current.String())
+		err = t.writeFile(name, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return
+		}
+	}
+	err = t.writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     path.Join("v2", repo, "manifests", tag),
+		Linkname: digest.String(),
+		Mode:     0777,
+		ModTime:  time.Now(),
+	})
+	return
+}
+
+// writeMetadata writes the metadata file that 'oc-mirror' uses to find the images in the archive.
+func (t *imageSetExportTask) writeMetadata(associations []imageSetAssociation) error {
+	metadata := &imageSetMetadata{
+		Kind:       "Metadata",
+		APIVersion: "mirror.openshift.io/v1alpha2",
+		UID:        string(uuid.NewUUID()),
+		SingleUse:  true,
+		PastMirror: imageSetPastMirror{
+			Timestamp:    time.Now().Unix(),
+			Sequence:     1,
+			Associations: associations,
+		},
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return t.writeFile(imageSetMetadataFile, bytes.NewReader(data), int64(len(data)))
+}
+
+// writeFile writes a regular file to the archive. If the size is negative it is taken from the
+// header of the bundle entry that is being copied.
+func (t *imageSetExportTask) writeFile(name string, reader io.Reader, size int64) error {
+	if size < 0 {
+		sized, ok := reader.(*imageSetSizedReader)
+		if !ok {
+			return fmt.Errorf("size of file '%s' is unknown", name)
+		}
+		size = sized.size
+	}
+	err := t.writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(t.writer, reader)
+	return err
+}
+
+// walkBundle calls the given function for each regular file of the bundle archive. The name passed
+// to the function is cleaned, so that it doesn't start with './'.
+func (t *imageSetExportTask) walkBundle(ctx context.Context,
+	fn func(name string, reader io.Reader) error) error {
+	file, err := os.Open(t.bundle)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	archive := tar.NewReader(file)
+	for {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		reader := &imageSetSizedReader{
+			Reader: archive,
+			size:   header.Size,
+		}
+		err = fn(path.Clean(header.Name), reader)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// linkDigest extracts the digest from a path of the registry storage like 'sha256/<hex>' or
+// 'sha256/<prefix>/<hex>', ignoring the trailing 'link' if present.
+func (t *imageSetExportTask) linkDigest(rest string) (result godigest.Digest, ok bool) {
+	parts := strings.Split(strings.TrimSuffix(rest, "/link"), "/")
+	if len(parts) < 2 {
+		return
+	}
+	digest := godigest.NewDigestFromEncoded(
+		godigest.Algorithm(parts[0]),
+		parts[len(parts)-1],
+	)
+	if digest.Validate() != nil {
+		return
+	}
+	result = digest
+	ok = true
+	return
+}
+
+// imageSetSizedReader is a reader that also knows the size of the data, so that it can be copied
+// to another archive without reading it to memory first.
+type imageSetSizedReader struct {
+	io.Reader
+	size int64
+}
+
+// Locations of the blobs and the repositories inside the bundle archive.
+const (
+	imageSetExportBlobsDir        = "docker/registry/v2/blobs/"
+	imageSetExportRepositoriesDir = "docker/registry/v2/repositories/"
+)
@@ -0,0 +1,206 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	godigest "github.com/opencontainers/go-digest"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Imageset exporter", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		tmp    string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create a temporary directory:
+		tmp, err = os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+	})
+
+	// addImage adds an image with a single layer to the given registry storage, the same way
+	// that the bundle creator does, and returns the reference.
+	addImage := func(storage *registryStorage, repo, content string) string {
+		write := func(data []byte) godigest.Digest {
+			digest := godigest.FromBytes(data)
+			err := storage.writeBlob(digest, bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+			return digest
+		}
+		layer := []byte(content)
+		layerDigest := write(layer)
+		config := []byte(`{"architecture":"amd64"}`)
+		configDigest := write(config)
+		manifest, err := json.Marshal(map[string]any{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+			"config": map[string]any{
+				"digest": configDigest,
+				"size":   len(config),
+			},
+			"layers": []any{
+				map[string]any{
+					"digest": layerDigest,
+					"size":   len(layer),
+				},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		manifestDigest := write(manifest)
+		for _, digest := range []godigest.Digest{layerDigest, configDigest} {
+			err = storage.linkLayer(repo, digest)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		err = storage.linkManifest(repo, manifestDigest)
+		Expect(err).ToNot(HaveOccurred())
+		err = storage.tagManifest(repo, manifestDigest.Encoded(), manifestDigest)
+		Expect(err).ToNot(HaveOccurred())
+		return "quay.io/" + repo + "@" + manifestDigest.String()
+	}
+
+	// writeBundle writes the content of the given directory to a bundle archive.
+	writeBundle := func(dir string) string {
+		name := filepath.Join(tmp, "upgrade-4.13.4-x86_64.tar")
+		file, err := os.Create(name)
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+		writer := tar.NewWriter(file)
+		err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			err = writer.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.ToSlash(rel),
+				Mode:     0644,
+				Size:     int64(len(data)),
+			})
+			if err != nil {
+				return err
+			}
+			_, err = writer.Write(data)
+			return err
+		})
+		Expect(err).ToNot(HaveOccurred())
+		err = writer.Close()
+		Expect(err).ToNot(HaveOccurred())
+		return name
+	}
+
+	It("Exports a bundle that can be imported again", func() {
+		// Create the bundle:
+		dir := filepath.Join(tmp, "bundle")
+		storage := &registryStorage{
+			root: dir,
+		}
+		release := addImage(storage, "openshift-release-dev/ocp-release", "release")
+		etcd := addImage(storage, "openshift-release-dev/ocp-v4.0-art-dev", "etcd")
+		metadata, err := json.Marshal(&Metadata{
+			Version: "4.13.4",
+			Arch:    "x86_64",
+			Release: release,
+			Images:  []string{etcd},
+			Tags: map[string]string{
+				"etcd": etcd,
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		err = os.WriteFile(filepath.Join(dir, "metadata.json"), metadata, 0644)
+		Expect(err).ToNot(HaveOccurred())
+		bundle := writeBundle(dir)
+
+		// Export it:
+		imageSet := filepath.Join(tmp, "mirror_seq1_000000.tar")
+		exporter, err := NewImageSetExporter().
+			SetLogger(logger).
+			SetBundle(bundle).
+			SetFile(imageSet).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		err = exporter.Run(ctx)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Import it again and check that we get the same images:
+		importer, err := NewImageSetImporter().
+			SetLogger(logger).
+			SetFile(imageSet).
+			SetDir(filepath.Join(tmp, "imported")).
+			SetVersion("4.13.4").
+			SetArch("x86_64").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		importedRelease, importedImages, err := importer.Run(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(importedRelease).To(Equal(release))
+		Expect(importedImages).To(Equal(map[string]string{
+			"etcd": etcd,
+		}))
+	})
+
+	It("Fails if the bundle doesn't contain metadata", func() {
+		dir := filepath.Join(tmp, "bundle")
+		storage := &registryStorage{
+			root: dir,
+		}
+		addImage(storage, "openshift-release-dev/ocp-release", "release")
+		bundle := writeBundle(dir)
+		imageSet := filepath.Join(tmp, "mirror_seq1_000000.tar")
+		exporter, err := NewImageSetExporter().
+			SetLogger(logger).
+			SetBundle(bundle).
+			SetFile(imageSet).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		err = exporter.Run(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("metadata"))
+		Expect(imageSet).ToNot(BeAnExistingFile())
+	})
+})
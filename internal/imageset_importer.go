@@ -0,0 +1,433 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	dreference "github.com/distribution/distribution/v3/reference"
+	"github.com/go-logr/logr"
+	godigest "github.com/opencontainers/go-digest"
+	"golang.org/x/exp/slices"
+)
+
+// ImageSetImporterBuilder contains the data and logic needed to create an imageset importer. Don't
+// create instances of this type directly, use the NewImageSetImporter function instead.
+type ImageSetImporterBuilder struct {
+	logger       logr.Logger
+	file         string
+	dir          string
+	version      string
+	arch         string
+	distribution string
+}
+
+// ImageSetImporter knows how to copy the release images contained in an imageset archive created
+// by the 'oc-mirror' tool into the registry storage of a bundle, so that the bundle can be created
+// without downloading the images again. Don't create instances of this type directly, use the
+// NewImageSetImporter function instead.
+type ImageSetImporter struct {
+	logger       logr.Logger
+	file         string
+	storage      *registryStorage
+	version      string
+	arch         string
+	distribution string
+}
+
+// NewImageSetImporter creates a builder that can then be used to configure and create imageset
+// importers.
+func NewImageSetImporter() *ImageSetImporterBuilder {
+	return &ImageSetImporterBuilder{
+		distribution: DistributionOCP,
+	}
+}
+
+// SetLogger sets the logger that the importer will use to write log messages. This is mandatory.
+func (b *ImageSetImporterBuilder) SetLogger(value logr.Logger) *ImageSetImporterBuilder {
+	b.logger = value
+	return b
+}
+
+// SetFile sets the name of the imageset archive file. This is mandatory.
+func (b *ImageSetImporterBuilder) SetFile(value string) *ImageSetImporterBuilder {
+	b.file = value
+	return b
+}
+
+// SetDir sets the directory where the images will be written, using the layout of the file
+// system storage driver of the image registry. This is mandatory.
+func (b *ImageSetImporterBuilder) SetDir(value string) *ImageSetImporterBuilder {
+	b.dir = value
+	return b
+}
+
+// SetVersion sets the version of the release that will be imported. This is mandatory.
+func (b *ImageSetImporterBuilder) SetVersion(value string) *ImageSetImporterBuilder {
+	b.version = value
+	return b
+}
+
+// SetArch sets the architecture of the release that will be imported. This is mandatory.
+func (b *ImageSetImporterBuilder) SetArch(value string) *ImageSetImporterBuilder {
+	b.arch = value
+	return b
+}
+
+// SetDistribution sets the distribution of the release, either 'ocp' or 'okd'. This is used to
+// calculate the tag of the release image. This is optional and the default is 'ocp'.
+func (b *ImageSetImporterBuilder) SetDistribution(value string) *ImageSetImporterBuilder {
+	b.distribution = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new imageset importer.
+func (b *ImageSetImporterBuilder) Build() (result *ImageSetImporter, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+	if b.file == "" {
+		err = errors.New("file is mandatory")
+		return
+	}
+	if b.dir == "" {
+		err = errors.New("directory is mandatory")
+		return
+	}
+	if b.version == "" {
+		err = errors.New("version is mandatory")
+		return
+	}
+	if b.arch == "" {
+		err = errors.New("architecture is mandatory")
+		return
+	}
+	if !slices.Contains(Distributions(), b.distribution) {
+		err = fmt.Errorf(
+			"distribution '%s' isn't valid, it should be one of %v",
+			b.distribution, Distributions(),
+		)
+		return
+	}
+
+	// Create and populate the object:
+	result = &ImageSetImporter{
+		logger: b.logger,
+		file:   b.file,
+		storage: &registryStorage{
+			root: b.dir,
+		},
+		version:      b.version,
+		arch:         b.arch,
+		distribution: b.distribution,
+	}
+	return
+}
+
+// Run copies the blobs from the imageset archive to the registry storage and then creates the
+// repositories and tags for the release image and the payload images. It returns the reference of
+// the release image and a map containing the names of the payload images and their references,
+// like the 'oc adm release info' command.
+func (i *ImageSetImporter) Run(ctx context.Context) (release string, images map[string]string,
+	err error) {
+	// Copy the blobs and read the metadata:
+	metadata, err := i.readArchive(ctx)
+	if err != nil {
+		return
+	}
+	if metadata == nil {
+		err = fmt.Errorf(
+			"imageset '%s' doesn't contain the '%s' file",
+			i.file, imageSetMetadataFile,
+		)
+		return
+	}
+
+	// Find the release image and the payload images:
+	releaseAssoc, contentAssocs, err := i.findAssociations(metadata)
+	if err != nil {
+		return
+	}
+
+	// Add the release image:
+	release, err = i.importImage(releaseAssoc)
+	if err != nil {
+		return
+	}
+
+	// Add the payload images:
+	prefix := releaseAssoc.TagSymlink + "-"
+	images = map[string]string{}
+	for _, assoc := range contentAssocs {
+		var ref string
+		ref, err = i.importImage(assoc)
+		if err != nil {
+			return
+		}
+		tag := strings.TrimPrefix(assoc.TagSymlink, prefix)
+		if tag == "" {
+			tag = assoc.ID
+		}
+		images[tag] = ref
+	}
+	i.logger.Info(
+		"Imported imageset",
+		"file", i.file,
+		"release", release,
+		"images", len(images),
+	)
+	return
+}
+
+// readArchive copies all the blobs and manifests contained in the imageset archive to the registry
+// storage, and returns the content of the metadata file. Note that the archive contains the blobs
+// as files named after their digests, for example 'blobs/sha256:...' or
+// 'v2/openshift/release/manifests/sha256:...', so we don't need to know the repository they
+// belong to in order to copy them.
+func (i *ImageSetImporter) readArchive(ctx context.Context) (result *imageSetMetadata,
+	err error) {
+	file, err := os.Open(i.file)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	archive := tar.NewReader(file)
+	blobs := 0
+	for {
+		err = ctx.Err()
+		if err != nil {
+			return
+		}
+		var header *tar.Header
+		header, err = archive.Next()
+		if errors.Is(err, io.EOF) {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(header.Name)
+		if name == imageSetMetadataFile {
+			var data []byte
+			data, err = io.ReadAll(archive)
+			if err != nil {
+				return
+			}
+			result = &imageSetMetadata{}
+			err = json.Unmarshal(data, result)
+			if err != nil {
+				err = fmt.Errorf("failed to parse imageset metadata: %w", err)
+				return
+			}
+			continue
+		}
+		digest, ok := i.blobDigest(name)
+		if !ok {
+			i.logger.V(2).Info(
+				"Ignoring imageset file",
+				"name", name,
+			)
+			continue
+		}
+		err = i.storage.writeBlob(digest, archive)
+		if err != nil {
+			err = fmt.Errorf("failed to copy imageset file '%s': %w", name, err)
+			return
+		}
+		blobs++
+	}
+	i.logger.Info(
+		"Copied imageset blobs",
+		"file", i.file,
+		"blobs", blobs,
+	)
+	return
+}
+
+// blobDigest checks if the given archive file name corresponds to a blob or manifest and returns
+// its digest.
+func (i *ImageSetImporter) blobDigest(name string) (result godigest.Digest, ok bool) {
+	dir := path.Base(path.Dir(name))
+	if dir != "blobs" && dir != "manifests" {
+		return
+	}
+	digest, err := godigest.Parse(path.Base(name))
+	if err != nil {
+		return
+	}
+	result = digest
+	ok = true
+	return
+}
+
+// findAssociations finds the association of the release image that matches the version and
+// architecture, and the associations of the payload images of that release.
+func (i *ImageSetImporter) findAssociations(metadata *imageSetMetadata) (
+	release imageSetAssociation, content []imageSetAssociation, err error) {
+	tag := imageSetReleaseTag(i.version, i.arch, i.distribution)
+	var releases []imageSetAssociation
+	for _, assoc := range metadata.PastMirror.Associations {
+		if assoc.Type == imageSetReleaseType {
+			releases = append(releases, assoc)
+		}
+	}
+	found := false
+	for _, assoc := range releases {
+		if assoc.TagSymlink == tag {
+			release = assoc
+			found = true
+			break
+		}
+	}
+	if !found {
+		available := make([]string, len(releases))
+		for j, assoc := range releases {
+			available[j] = assoc.TagSymlink
+		}
+		slices.Sort(available)
+		err = fmt.Errorf(
+			"imageset '%s' doesn't contain release '%s', available releases are %v",
+			i.file, tag, available,
+		)
+		return
+	}
+	prefix := release.TagSymlink + "-"
+	for _, assoc := range metadata.PastMirror.Associations {
+		if assoc.Type != imageSetReleaseContentType {
+			continue
+		}
+		if len(releases) > 1 && !strings.HasPrefix(assoc.TagSymlink, prefix) {
+			continue
+		}
+		content = append(content, assoc)
+	}
+	if len(content) == 0 {
+		err = fmt.Errorf(
+			"imageset '%s' doesn't contain payload images for release '%s'",
+			i.file, tag,
+		)
+		return
+	}
+	return
+}
+
+// importImage creates the repository for the given image, linking the manifests and the blobs
+// that were previously copied from the archive. Returns the original reference of the image,
+// using the digest instead of the tag.
+func (i *ImageSetImporter) importImage(assoc imageSetAssociation) (result string, err error) {
+	named, err := dreference.ParseNormalizedNamed(assoc.Name)
+	if err != nil {
+		err = fmt.Errorf("name '%s' of image isn't valid: %w", assoc.Name, err)
+		return
+	}
+	digest, err := godigest.Parse(assoc.ID)
+	if err != nil {
+		err = fmt.Errorf("identifier '%s' of image '%s' isn't valid: %w", assoc.ID, assoc.Name, err)
+		return
+	}
+	repo := dreference.Path(named)
+	err = i.linkManifest(repo, digest)
+	if err != nil {
+		err = fmt.Errorf("failed to import image '%s': %w", assoc.Name, err)
+		return
+	}
+
+	// The bundle creator uses the hex part of the digest as the tag, do the same here so that
+	// the loader can find the images in the same way:
+	err = i.storage.tagManifest(repo, digest.Encoded(), digest)
+	if err != nil {
+		return
+	}
+	result = fmt.Sprintf("%s@%s", named.Name(), digest)
+	return
+}
+
+// linkManifest links the given manifest and all the blobs it references to the given repository.
+// If the manifest is a list the manifests of the list are also linked.
+func (i *ImageSetImporter) linkManifest(repo string, digest godigest.Digest) error {
+	exists, err := i.storage.hasBlob(digest)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf(
+			"manifest '%s' isn't in the imageset, note that differential imagesets "+
+				"aren't supported",
+			digest,
+		)
+	}
+	manifest, err := i.storage.readManifest(digest)
+	if err != nil {
+		return err
+	}
+	for _, child := range manifest.Manifests {
+		// The digests come from the archive, so we need to check them before using them to
+		// build paths inside the storage:
+		err = child.Digest.Validate()
+		if err != nil {
+			return fmt.Errorf(
+				"digest '%s' of manifest list '%s' isn't valid: %w",
+				child.Digest, digest, err,
+			)
+		}
+		err = i.linkManifest(repo, child.Digest)
+		if err != nil {
+			return err
+		}
+	}
+	blobs := slices.Clone(manifest.Layers)
+	if manifest.Config != nil {
+		blobs = append(blobs, *manifest.Config)
+	}
+	for _, blob := range blobs {
+		err = blob.Digest.Validate()
+		if err != nil {
+			return fmt.Errorf(
+				"digest '%s' of blob of manifest '%s' isn't valid: %w",
+				blob.Digest, digest, err,
+			)
+		}
+		exists, err = i.storage.hasBlob(blob.Digest)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf(
+				"blob '%s' of manifest '%s' isn't in the imageset, note that "+
+					"differential imagesets aren't supported",
+				blob.Digest, digest,
+			)
+		}
+		err = i.storage.linkLayer(repo, blob.Digest)
+		if err != nil {
+			return err
+		}
+	}
+	return i.storage.linkManifest(repo, digest)
+}
@@ -0,0 +1,329 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/ginkgo/v2/dsl/table"
+	. "github.com/onsi/gomega"
+	godigest "github.com/opencontainers/go-digest"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Imageset importer", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		tmp    string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create a temporary directory:
+		tmp, err = os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+	})
+
+	// image contains the files of an image written to the test archive.
+	type image struct {
+		manifest godigest.Digest
+		layer    godigest.Digest
+		files    map[string][]byte
+	}
+
+	// makeImage generates an image with a single layer, with the blobs stored in the archive
+	// locations used by the 'oc-mirror' tool.
+	makeImage := func(repo, content string) image {
+		layer := []byte(content)
+		layerDigest := godigest.FromBytes(layer)
+		config := []byte(`{"architecture":"amd64"}`)
+		configDigest := godigest.FromBytes(config)
+		manifest, err := json.Marshal(map[string]any{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+			"config": map[string]any{
+				"digest": configDigest,
+				"size":   len(config),
+			},
+			"layers": []any{
+				map[string]any{
+					"digest": layerDigest,
+					"size":   len(layer),
+				},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		manifestDigest := godigest.FromBytes(manifest)
+		return image{
+			manifest: manifestDigest,
+			layer:    layerDigest,
+			files: map[string][]byte{
+				"blobs/" + layerDigest.String():                        layer,
+				"blobs/" + configDigest.String():                       config,
+				"v2/" + repo + "/manifests/" + manifestDigest.String(): manifest,
+			},
+		}
+	}
+
+	// writeArchive writes the given images and metadata to an imageset archive.
+	writeArchive := func(metadata any, images ...image) string {
+		name := filepath.Join(tmp, "mirror_seq1_000000.tar")
+		file, err := os.Create(name)
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+		writer := tar.NewWriter(file)
+		write := func(name string, data []byte) {
+			err := writer.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     name,
+				Mode:     0644,
+				Size:     int64(len(data)),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = writer.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		for _, image := range images {
+			for name, data := range image.files {
+				write(name, data)
+			}
+		}
+		data, err := json.Marshal(metadata)
+		Expect(err).ToNot(HaveOccurred())
+		write("publish/.metadata.json", data)
+		err = writer.Close()
+		Expect(err).ToNot(HaveOccurred())
+		return name
+	}
+
+	makeMetadata := func(associations ...imageSetAssociation) any {
+		return map[string]any{
+			"kind":       "Metadata",
+			"apiVersion": "mirror.openshift.io/v1alpha2",
+			"pastMirror": map[string]any{
+				"associations": associations,
+			},
+		}
+	}
+
+	It("Imports the release and the payload images", func() {
+		// Prepare the archive:
+		release := makeImage("openshift/release-images", "release")
+		etcd := makeImage("openshift/release", "etcd")
+		file := writeArchive(
+			makeMetadata(
+				imageSetAssociation{
+					Name:       "quay.io/openshift-release-dev/ocp-release:4.13.4-x86_64",
+					TagSymlink: "4.13.4-x86_64",
+					ID:         release.manifest.String(),
+					Type:       imageSetReleaseType,
+				},
+				imageSetAssociation{
+					Name: "quay.io/openshift-release-dev/ocp-v4.0-art-dev@" +
+						etcd.manifest.String(),
+					TagSymlink: "4.13.4-x86_64-etcd",
+					ID:         etcd.manifest.String(),
+					Type:       imageSetReleaseContentType,
+				},
+			),
+			release, etcd,
+		)
+
+		// Run the importer:
+		dir := filepath.Join(tmp, "bundle")
+		importer, err := NewImageSetImporter().
+			SetLogger(logger).
+			SetFile(file).
+			SetDir(dir).
+			SetVersion("4.13.4").
+			SetArch("x86_64").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		releaseRef, images, err := importer.Run(ctx)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Check the results:
+		Expect(releaseRef).To(Equal(
+			"quay.io/openshift-release-dev/ocp-release@" + release.manifest.String(),
+		))
+		Expect(images).To(HaveLen(1))
+		Expect(images).To(HaveKeyWithValue(
+			"etcd",
+			"quay.io/openshift-release-dev/ocp-v4.0-art-dev@"+etcd.manifest.String(),
+		))
+
+		// Check the registry storage:
+		storage := &registryStorage{
+			root: dir,
+		}
+		repo := "openshift-release-dev/ocp-v4.0-art-dev"
+		digest, err := storage.readTag(repo, etcd.manifest.Encoded())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(digest).To(Equal(etcd.manifest))
+		manifest, err := storage.readManifest(digest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.Layers).To(HaveLen(1))
+		Expect(manifest.Layers[0].Digest).To(Equal(etcd.layer))
+		Expect(filepath.Join(
+			storage.repoDir(repo), "_layers", "sha256", etcd.layer.Encoded(), "link",
+		)).To(BeARegularFile())
+	})
+
+	It("Fails if the release isn't in the archive", func() {
+		release := makeImage("openshift/release-images", "release")
+		file := writeArchive(
+			makeMetadata(
+				imageSetAssociation{
+					Name:       "quay.io/openshift-release-dev/ocp-release:4.13.3-x86_64",
+					TagSymlink: "4.13.3-x86_64",
+					ID:         release.manifest.String(),
+					Type:       imageSetReleaseType,
+				},
+			),
+			release,
+		)
+		importer, err := NewImageSetImporter().
+			SetLogger(logger).
+			SetFile(file).
+			SetDir(filepath.Join(tmp, "bundle")).
+			SetVersion("4.13.4").
+			SetArch("x86_64").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		_, _, err = importer.Run(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("4.13.3-x86_64"))
+	})
+
+	It("Fails if a blob is missing", func() {
+		release := makeImage("openshift/release-images", "release")
+		etcd := makeImage("openshift/release", "etcd")
+		for name := range release.files {
+			if strings.Contains(name, release.layer.String()) {
+				delete(release.files, name)
+			}
+		}
+		file := writeArchive(
+			makeMetadata(
+				imageSetAssociation{
+					Name:       "quay.io/openshift-release-dev/ocp-release:4.13.4-x86_64",
+					TagSymlink: "4.13.4-x86_64",
+					ID:         release.manifest.String(),
+					Type:       imageSetReleaseType,
+				},
+				imageSetAssociation{
+					Name: "quay.io/openshift-release-dev/ocp-v4.0-art-dev@" +
+						etcd.manifest.String(),
+					TagSymlink: "4.13.4-x86_64-etcd",
+					ID:         etcd.manifest.String(),
+					Type:       imageSetReleaseContentType,
+				},
+			),
+			release, etcd,
+		)
+		importer, err := NewImageSetImporter().
+			SetLogger(logger).
+			SetFile(file).
+			SetDir(filepath.Join(tmp, "bundle")).
+			SetVersion("4.13.4").
+			SetArch("x86_64").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		_, _, err = importer.Run(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("differential"))
+	})
+
+	DescribeTable(
+		"Rejects invalid digests inside manifests",
+		func(field string, value string) {
+			// Prepare a manifest that contains the invalid digest:
+			manifest, err := json.Marshal(map[string]any{
+				"schemaVersion": 2,
+				field: []any{
+					map[string]any{
+						"digest": value,
+						"size":   1,
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			digest := godigest.FromBytes(manifest)
+			release := image{
+				manifest: digest,
+				files: map[string][]byte{
+					"v2/openshift/release-images/manifests/" + digest.String(): manifest,
+				},
+			}
+			etcd := makeImage("openshift/release", "etcd")
+			file := writeArchive(
+				makeMetadata(
+					imageSetAssociation{
+						Name:       "quay.io/openshift-release-dev/ocp-release:4.13.4-x86_64",
+						TagSymlink: "4.13.4-x86_64",
+						ID:         digest.String(),
+						Type:       imageSetReleaseType,
+					},
+					imageSetAssociation{
+						Name: "quay.io/openshift-release-dev/ocp-v4.0-art-dev@" +
+							etcd.manifest.String(),
+						TagSymlink: "4.13.4-x86_64-etcd",
+						ID:         etcd.manifest.String(),
+						Type:       imageSetReleaseContentType,
+					},
+				),
+				release, etcd,
+			)
+
+			// Run the importer:
+			importer, err := NewImageSetImporter().
+				SetLogger(logger).
+				SetFile(file).
+				SetDir(filepath.Join(tmp, "bundle")).
+				SetVersion("4.13.4").
+				SetArch("x86_64").
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			_, _, err = importer.Run(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("isn't valid"))
+		},
+		Entry("Empty layer digest", "layers", ""),
+		Entry("Layer digest with relative path", "layers", "sha256:../../x"),
+		Entry("Empty manifest list digest", "manifests", ""),
+		Entry("Manifest list digest with relative path", "manifests", "sha256:../../x"),
+	)
+})
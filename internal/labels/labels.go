@@ -14,6 +14,10 @@ License.
 
 package labels
 
+import (
+	"strings"
+)
+
 // This file contains constants for frequently used labels.
 
 // BundleExtracted is indicates that a node has the bundle files extracted into the a directory.
@@ -31,5 +35,14 @@ const Job = prefix + "/job"
 // App contains the name of the application.
 const App = prefix + "/app"
 
+// ManagedClusterUpgrade contains the identifier of the ManagedClusterUpgrade object that generated
+// the object that has this label.
+const ManagedClusterUpgrade = prefix + "/managed-cluster-upgrade"
+
+// Owned checks if the given label is one of the labels of the tool.
+func Owned(name string) bool {
+	return strings.HasPrefix(name, prefix+"/")
+}
+
 // prefix is the prefix for all the annotations.
 const prefix = "upgrade-tool"
@@ -0,0 +1,37 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+// Names of the supported modes to load the images of the bundle into CRI-O:
+const (
+	// LoadModePull starts a registry server that serves the bundle and asks CRI-O to pull the
+	// images from it.
+	LoadModePull = "pull"
+
+	// LoadModeCopy copies the images directly from the bundle directory into the container
+	// storage used by CRI-O, without starting a registry server.
+	LoadModeCopy = "copy"
+
+	// LoadModeDefault is the mode used when no mode is explicitly given.
+	LoadModeDefault = LoadModePull
+)
+
+// LoadModes returns the names of the supported load modes.
+func LoadModes() []string {
+	return []string{
+		LoadModePull,
+		LoadModeCopy,
+	}
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+// LogLevelWatcherBuilder contains the data and logic needed to create a log level watcher. Don't
+// create instances of this type directly, use the NewLogLevelWatcher function instead.
+type LogLevelWatcherBuilder struct {
+	logger   logr.Logger
+	client   clnt.Client
+	node     string
+	interval time.Duration
+}
+
+// LogLevelWatcher periodically checks the log level annotation of a node and applies it to the
+// logger, so that the verbosity of a running program can be changed without restarting it. Don't
+// create instances of this type directly, use the NewLogLevelWatcher function instead.
+type LogLevelWatcher struct {
+	logger   logr.Logger
+	client   clnt.Client
+	node     string
+	interval time.Duration
+	initial  int
+	current  string
+	cancel   context.CancelFunc
+}
+
+// NewLogLevelWatcher creates a builder that can then be used to configure and create log level
+// watchers.
+func NewLogLevelWatcher() *LogLevelWatcherBuilder {
+	return &LogLevelWatcherBuilder{
+		interval: 30 * time.Second,
+	}
+}
+
+// SetLogger sets the logger whose level will be changed. Note that this logger must have been
+// created with the logging package. This is mandatory.
+func (b *LogLevelWatcherBuilder) SetLogger(value logr.Logger) *LogLevelWatcherBuilder {
+	b.logger = value
+	return b
+}
+
+// SetClient sets the Kubernetes API client that the watcher will use to read the node annotations.
+// This is mandatory.
+func (b *LogLevelWatcherBuilder) SetClient(value clnt.Client) *LogLevelWatcherBuilder {
+	b.client = value
+	return b
+}
+
+// SetNode sets the name of the node that contains the log level annotation. This is mandatory.
+func (b *LogLevelWatcherBuilder) SetNode(value string) *LogLevelWatcherBuilder {
+	b.node = value
+	return b
+}
+
+// SetInterval sets the interval between checks of the node annotation. This is optional and the
+// default is 30 seconds.
+func (b *LogLevelWatcherBuilder) SetInterval(value time.Duration) *LogLevelWatcherBuilder {
+	b.interval = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new log level watcher.
+func (b *LogLevelWatcherBuilder) Build() (result *LogLevelWatcher, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+	if b.client == nil {
+		err = errors.New("client is mandatory")
+		return
+	}
+	if b.node == "" {
+		err = errors.New("node name is mandatory")
+		return
+	}
+	if b.interval <= 0 {
+		err = fmt.Errorf(
+			"interval %s isn't valid, it must be greater than zero",
+			b.interval,
+		)
+		return
+	}
+
+	// Remember the initial level, so that it can be restored when the annotation is removed:
+	initial, err := logging.GetLevel(b.logger)
+	if err != nil {
+		return
+	}
+
+	// Create and populate the object:
+	result = &LogLevelWatcher{
+		logger:   b.logger,
+		client:   b.client,
+		node:     b.node,
+		interval: b.interval,
+		initial:  initial,
+	}
+	return
+}
+
+// Start starts watching the node annotation and returns inmediately.
+func (w *LogLevelWatcher) Start(ctx context.Context) error {
+	ctx, w.cancel = context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			w.check(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops watching the node annotation. Note that the logger will preserve the last level
+// applied.
+func (w *LogLevelWatcher) Stop(ctx context.Context) error {
+	if w.cancel != nil {
+		w.cancel()
+	}
+	return nil
+}
+
+func (w *LogLevelWatcher) check(ctx context.Context) {
+	// Fetch the node:
+	nodeObject := &corev1.Node{}
+	nodeKey := clnt.ObjectKey{
+		Name: w.node,
+	}
+	err := w.client.Get(ctx, nodeKey, nodeObject)
+	if err != nil {
+		if ctx.Err() == nil {
+			w.logger.Error(
+				err,
+				"Failed to fetch node to check log level",
+				"node", w.node,
+			)
+		}
+		return
+	}
+
+	// Do nothing if the value hasn't changed:
+	value := nodeObject.Annotations[annotations.LogLevel]
+	if value == w.current {
+		return
+	}
+	w.current = value
+
+	// If the annotation has been removed then go back to the initial level, otherwise apply the
+	// new level:
+	level := w.initial
+	if value != "" {
+		level, err = ParseLogLevel(value)
+		if err != nil {
+			w.logger.Error(
+				err,
+				"Invalid log level annotation, will ignore it",
+				"node", w.node,
+				"value", value,
+			)
+			return
+		}
+	}
+	err = logging.SetLevel(w.logger, level)
+	if err != nil {
+		w.logger.Error(
+			err,
+			"Failed to change log level",
+			"node", w.node,
+			"level", level,
+		)
+		return
+	}
+	w.logger.Info(
+		"Changed log level",
+		"node", w.node,
+		"level", level,
+	)
+}
+
+// ParseLogLevel converts the given text into a log level. The text can be a non negative integer
+// or one of the names 'info', 'debug' or 'trace', which correspond to levels zero, one and two.
+func ParseLogLevel(text string) (result int, err error) {
+	text = strings.TrimSpace(strings.ToLower(text))
+	switch text {
+	case "info":
+		result = 0
+	case "debug":
+		result = 1
+	case "trace":
+		result = 2
+	default:
+		result, err = strconv.Atoi(text)
+		if err != nil {
+			err = fmt.Errorf("log level '%s' isn't valid", text)
+			return
+		}
+		if result < 0 {
+			err = fmt.Errorf(
+				"log level %d isn't valid, it must be greater than or equal to zero",
+				result,
+			)
+		}
+	}
+	return
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/ginkgo/v2/dsl/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Log level parsing", func() {
+	DescribeTable(
+		"Parses valid levels",
+		func(text string, expected int) {
+			actual, err := ParseLogLevel(text)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual).To(Equal(expected))
+		},
+		Entry("Info", "info", 0),
+		Entry("Debug", "debug", 1),
+		Entry("Trace", "trace", 2),
+		Entry("Upper case", "DEBUG", 1),
+		Entry("Spaces", " debug ", 1),
+		Entry("Zero", "0", 0),
+		Entry("Number", "3", 3),
+	)
+
+	DescribeTable(
+		"Rejects invalid levels",
+		func(text string) {
+			_, err := ParseLogLevel(text)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("Empty", ""),
+		Entry("Junk", "junk"),
+		Entry("Negative", "-1"),
+	)
+})
+
+var _ = Describe("Log level watcher", func() {
+	It("Applies the level of the annotation and restores the initial one when removed", func() {
+		ctx := context.Background()
+
+		// Create a logger with a level that we can recognize later:
+		logger, err := logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(3).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create a client containing the node with the annotation:
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "node0",
+				Annotations: map[string]string{
+					annotations.LogLevel: "debug",
+				},
+			},
+		}
+		client := fake.NewClientBuilder().
+			WithScheme(snapshotScheme()).
+			WithObjects(node).
+			Build()
+
+		// Create the watcher:
+		watcher, err := NewLogLevelWatcher().
+			SetLogger(logger).
+			SetClient(client).
+			SetNode("node0").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Check that the level of the annotation is applied:
+		watcher.check(ctx)
+		level, err := logging.GetLevel(logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(level).To(Equal(1))
+
+		// Remove the annotation and check that the initial level is restored:
+		err = client.Get(ctx, clnt.ObjectKeyFromObject(node), node)
+		Expect(err).ToNot(HaveOccurred())
+		delete(node.Annotations, annotations.LogLevel)
+		err = client.Update(ctx, node)
+		Expect(err).ToNot(HaveOccurred())
+		watcher.check(ctx)
+		level, err = logging.GetLevel(logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(level).To(Equal(3))
+	})
+
+	It("Doesn't change the level if there is no annotation", func() {
+		ctx := context.Background()
+		logger, err := logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(3).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		client := fake.NewClientBuilder().
+			WithScheme(snapshotScheme()).
+			WithObjects(&corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "node0",
+				},
+			}).
+			Build()
+		watcher, err := NewLogLevelWatcher().
+			SetLogger(logger).
+			SetClient(client).
+			SetNode("node0").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		watcher.check(ctx)
+		level, err := logging.GetLevel(logger)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(level).To(Equal(3))
+	})
+})
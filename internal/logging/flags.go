@@ -33,6 +33,20 @@ func AddFlags(set *pflag.FlagSet) {
 			"log will be written to the standard output or error stream of the "+
 			"process.",
 	)
+	_ = set.Int(
+		maxSizeFlagName,
+		0,
+		"Maximum size of the log file in mebibytes. When the file reaches this size it is "+
+			"renamed adding a '.1' suffix and a new file is started. The default is "+
+			"zero, which means that the file is never rotated. Has no effect when the "+
+			"log is written to the standard output or error streams.",
+	)
+	_ = set.Int(
+		maxBackupsFlagName,
+		defaultMaxBackups,
+		"Number of rotated log files that are kept, older ones are removed. Has no effect "+
+			"unless '--log-max-size' is also used.",
+	)
 	_ = set.StringArray(
 		fieldFlagName,
 		[]string{},
@@ -71,11 +85,13 @@ func AddFlags(set *pflag.FlagSet) {
 
 // Names of the flags:
 const (
-	levelFlagName   = "log-level"
-	fileFlagName    = "log-file"
-	fieldFlagName   = "log-field"
-	fieldsFlagName  = "log-fields"
-	headersFlagName = "log-headers"
-	bodiesFlagName  = "log-bodies"
-	redactFlagName  = "log-redact"
+	levelFlagName      = "log-level"
+	fileFlagName       = "log-file"
+	maxSizeFlagName    = "log-max-size"
+	maxBackupsFlagName = "log-max-backups"
+	fieldFlagName      = "log-field"
+	fieldsFlagName     = "log-fields"
+	headersFlagName    = "log-headers"
+	bodiesFlagName     = "log-bodies"
+	redactFlagName     = "log-redact"
 )
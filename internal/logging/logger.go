@@ -35,19 +35,22 @@ import (
 // LoggerBuilder contains the data and logic needed to create a logger. Don't create instances of
 // this directly, use the NewLogger function instead.
 type LoggerBuilder struct {
-	writer io.Writer
-	out    io.Writer
-	err    io.Writer
-	level  int
-	file   string
-	fields map[string]any
-	redact bool
+	writer     io.Writer
+	out        io.Writer
+	err        io.Writer
+	level      int
+	file       string
+	maxSize    int64
+	maxBackups int
+	fields     map[string]any
+	redact     bool
 }
 
 // NewLogger creates a builder that can then be used to configure and create a logger.
 func NewLogger() *LoggerBuilder {
 	return &LoggerBuilder{
-		redact: true,
+		redact:     true,
+		maxBackups: defaultMaxBackups,
 	}
 }
 
@@ -124,6 +127,22 @@ func (b *LoggerBuilder) SetFile(value string) *LoggerBuilder {
 	return b
 }
 
+// SetMaxSize sets the maximum size in bytes of the log file. When the file reaches this size it is
+// renamed adding a '.1' suffix, the suffixes of the previous backups are shifted, and a new file
+// is started. This is optional, the default is zero, which means that the file is never rotated.
+// It has no effect when the log is written to a writer or to the standard output or error streams.
+func (b *LoggerBuilder) SetMaxSize(value int64) *LoggerBuilder {
+	b.maxSize = value
+	return b
+}
+
+// SetMaxBackups sets the number of rotated log files that are kept. Older ones are removed. This
+// is optional and the default is three. It has no effect unless the maximum size is set.
+func (b *LoggerBuilder) SetMaxBackups(value int) *LoggerBuilder {
+	b.maxBackups = value
+	return b
+}
+
 // Set redact sets the flag that indicates if security sensitive data should be removed from the
 // log. These fields are indicated by adding an exlamation mark in front of the field name. For
 // example, to write a message with a `public` field that isn't sensitive and another `private`
@@ -166,6 +185,18 @@ func (b *LoggerBuilder) SetFlags(flags *pflag.FlagSet) *LoggerBuilder {
 				b.SetFile(value)
 			}
 		}
+		if flags.Changed(maxSizeFlagName) {
+			value, err := flags.GetInt(maxSizeFlagName)
+			if err == nil {
+				b.SetMaxSize(int64(value) * 1024 * 1024)
+			}
+		}
+		if flags.Changed(maxBackupsFlagName) {
+			value, err := flags.GetInt(maxBackupsFlagName)
+			if err == nil {
+				b.SetMaxBackups(value)
+			}
+		}
 		if flags.Changed(fieldFlagName) {
 			values, err := flags.GetStringArray(fieldFlagName)
 			if err == nil {
@@ -228,6 +259,20 @@ func (b *LoggerBuilder) Build() (result logr.Logger, err error) {
 		)
 		return
 	}
+	if b.maxSize < 0 {
+		err = fmt.Errorf(
+			"maximum size %d isn't valid, it must be greater than or equal to zero",
+			b.maxSize,
+		)
+		return
+	}
+	if b.maxBackups < 0 {
+		err = fmt.Errorf(
+			"maximum backups %d isn't valid, it must be greater than or equal to zero",
+			b.maxBackups,
+		)
+		return
+	}
 
 	// If no writer has been explicitly provided then open the log file:
 	writer := b.writer
@@ -238,14 +283,8 @@ func (b *LoggerBuilder) Build() (result logr.Logger, err error) {
 		}
 	}
 
-	// Map the level to a zap level, taking into account that in zap there is a maximum of 128
-	// custom level and they are negative.
-	var level zapcore.Level
-	if b.level <= 128 {
-		level = zapcore.Level(-b.level)
-	} else {
-		level = zapcore.Level(-128)
-	}
+	// Use an atomic level, so that it can be changed later with the SetLevel function:
+	level := zap.NewAtomicLevelAt(zapLevel(b.level))
 
 	// Create the zap logger:
 	syncer := zapcore.AddSync(writer)
@@ -267,6 +306,7 @@ func (b *LoggerBuilder) Build() (result logr.Logger, err error) {
 	result = result.WithSink(&sink{
 		settings: &sinkSettings{
 			redact: b.redact,
+			level:  level,
 		},
 		delegate: result.GetSink(),
 	})
@@ -318,6 +358,15 @@ func (b *LoggerBuilder) openDefaultFile() (result io.Writer, err error) {
 }
 
 func (b *LoggerBuilder) openFile(file string) (result io.Writer, err error) {
+	if b.maxSize > 0 {
+		var rotating *rotatingFile
+		rotating, err = openRotatingFile(file, b.maxSize, b.maxBackups)
+		if err != nil {
+			return
+		}
+		result = rotating
+		return
+	}
 	result, err = os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
 	return
 }
@@ -348,6 +397,46 @@ func (b *LoggerBuilder) customField(name string, value any) (result any, err err
 	return
 }
 
+// SetLevel changes the maximum log level of a logger that has been previously created with the
+// NewLogger function. The change affects the given logger and all the loggers derived from it, and
+// it takes effect inmediately. Returns an error if the logger wasn't created with the NewLogger
+// function or if the level isn't valid.
+func SetLevel(logger logr.Logger, value int) error {
+	if value < 0 {
+		return fmt.Errorf(
+			"level %d isn't valid, it must be greater than or equal to zero",
+			value,
+		)
+	}
+	sink, ok := logger.GetSink().(*sink)
+	if !ok {
+		return errors.New("logger wasn't created with the logging package")
+	}
+	sink.settings.level.SetLevel(zapLevel(value))
+	return nil
+}
+
+// GetLevel returns the current maximum log level of a logger that has been previously created with
+// the NewLogger function. Returns an error if the logger wasn't created with the NewLogger function.
+func GetLevel(logger logr.Logger) (result int, err error) {
+	sink, ok := logger.GetSink().(*sink)
+	if !ok {
+		err = errors.New("logger wasn't created with the logging package")
+		return
+	}
+	result = -int(sink.settings.level.Level())
+	return
+}
+
+// zapLevel maps the level to a zap level, taking into account that in zap there is a maximum of
+// 128 custom level and they are negative.
+func zapLevel(value int) zapcore.Level {
+	if value <= 128 {
+		return zapcore.Level(-value)
+	}
+	return zapcore.Level(-128)
+}
+
 // loggerTimeEncoder converts the time to UTC and uses the RFC3339 format.
 func loggerTimeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
 	zapcore.RFC3339TimeEncoder(t.UTC(), enc)
@@ -378,3 +467,6 @@ const (
 	pidLogFieldName  = "pid"
 	pidLogFieldValue = "%p"
 )
+
+// defaultMaxBackups is the default number of rotated log files that are kept.
+const defaultMaxBackups = 3
@@ -321,6 +321,38 @@ var _ = Describe("Logger", func() {
 		Expect(buffer.Len()).To(BeZero())
 	})
 
+	It("Changes the level of an existing logger", func() {
+		// Create a logger that writes to a memory buffer:
+		buffer := &bytes.Buffer{}
+		logger, err := NewLogger().
+			SetWriter(buffer).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Verify that debug messages aren't written initially:
+		logger.V(1).Info("")
+		Expect(buffer.Len()).To(BeZero())
+
+		// Change the level and verify that debug messages are written now, also for derived
+		// loggers:
+		err = SetLevel(logger, 1)
+		Expect(err).ToNot(HaveOccurred())
+		logger.V(1).Info("")
+		Expect(buffer.Len()).ToNot(BeZero())
+		buffer.Reset()
+		logger.WithName("child").V(1).Info("")
+		Expect(buffer.Len()).ToNot(BeZero())
+	})
+
+	It("Rejects negative level change", func() {
+		logger, err := NewLogger().
+			SetWriter(io.Discard).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		err = SetLevel(logger, -1)
+		Expect(err).To(HaveOccurred())
+	})
+
 	DescribeTable(
 		"Writes debug messages with level less than or equal to the maximum",
 		func(v int) {
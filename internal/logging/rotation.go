@@ -0,0 +1,126 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a writer that appends to a file and that, when the file reaches a maximum size,
+// renames it adding a '.1' suffix, shifting the suffixes of the previous backups, and starts a new
+// one. Only the given number of backups are kept, older ones are removed.
+type rotatingFile struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+// openRotatingFile opens the given file for appending, creating it if it doesn't exist.
+func openRotatingFile(path string, maxSize int64, backups int) (result *rotatingFile, err error) {
+	result = &rotatingFile{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+	err = result.open()
+	if err != nil {
+		result = nil
+	}
+	return
+}
+
+// Write writes the given data to the file, rotating it first if it would exceed the maximum size.
+// Note that messages are never split, so the file may exceed the maximum size when a single
+// message is larger than that.
+func (f *rotatingFile) Write(p []byte) (n int, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		err = f.rotate()
+		if err != nil {
+			return
+		}
+	}
+	n, err = f.file.Write(p)
+	f.size += int64(n)
+	return
+}
+
+// Sync flushes the file to disk. This is called by the logging library after writing error
+// messages.
+func (f *rotatingFile) Sync() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file.Sync()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file and opens a new one. The current file is closed only when the
+// new one has been opened, so that if something fails the writer can still be used and the
+// rotation will be tried again with the next message.
+func (f *rotatingFile) rotate() error {
+	// Shift the backups, discarding the oldest one. When no backups are kept the current file
+	// is just removed.
+	var err error
+	if f.backups == 0 {
+		err = os.Remove(f.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	} else {
+		for i := f.backups - 1; i > 0; i-- {
+			err = os.Rename(f.backup(i), f.backup(i+1))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		err = os.Rename(f.path, f.backup(1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	// Open the new file, and only then close the old one:
+	old := f.file
+	err = f.open()
+	if err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+func (f *rotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/pflag"
+)
+
+var _ = Describe("Log rotation", func() {
+	var (
+		tmp  string
+		file string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		file = filepath.Join(tmp, "my.log")
+	})
+
+	// read returns the content of the given file, or an empty string if it doesn't exist.
+	read := func(path string) string {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			return ""
+		}
+		Expect(err).ToNot(HaveOccurred())
+		return string(data)
+	}
+
+	It("Rotates the file when it reaches the maximum size", func() {
+		writer, err := openRotatingFile(file, 10, 2)
+		Expect(err).ToNot(HaveOccurred())
+		for _, line := range []string{"aaaaaaa\n", "bbbbbbb\n", "ccccccc\n", "ddddddd\n"} {
+			_, err = writer.Write([]byte(line))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(read(file)).To(Equal("ddddddd\n"))
+		Expect(read(file + ".1")).To(Equal("ccccccc\n"))
+		Expect(read(file + ".2")).To(Equal("bbbbbbb\n"))
+		Expect(read(file + ".3")).To(BeEmpty())
+	})
+
+	It("Takes into account the size of the existing file", func() {
+		err := os.WriteFile(file, []byte("aaaaaaa\n"), 0600)
+		Expect(err).ToNot(HaveOccurred())
+		writer, err := openRotatingFile(file, 10, 1)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = writer.Write([]byte("bbbbbbb\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read(file)).To(Equal("bbbbbbb\n"))
+		Expect(read(file + ".1")).To(Equal("aaaaaaa\n"))
+	})
+
+	It("Doesn't keep backups when the number is zero", func() {
+		writer, err := openRotatingFile(file, 10, 0)
+		Expect(err).ToNot(HaveOccurred())
+		for _, line := range []string{"aaaaaaa\n", "bbbbbbb\n"} {
+			_, err = writer.Write([]byte(line))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(read(file)).To(Equal("bbbbbbb\n"))
+		Expect(read(file + ".1")).To(BeEmpty())
+	})
+
+	It("Can still be used when rotation fails", func() {
+		writer, err := openRotatingFile(file, 10, 1)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = writer.Write([]byte("aaaaaaa\n"))
+		Expect(err).ToNot(HaveOccurred())
+
+		// Make the rename fail putting a directory that isn't empty where the backup should
+		// be:
+		err = os.MkdirAll(filepath.Join(file+".1", "junk"), 0700)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = writer.Write([]byte("bbbbbbb\n"))
+		Expect(err).To(HaveOccurred())
+
+		// Remove the directory and check that the next write rotates the file:
+		err = os.RemoveAll(file + ".1")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = writer.Write([]byte("ccccccc\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read(file)).To(Equal("ccccccc\n"))
+		Expect(read(file + ".1")).To(Equal("aaaaaaa\n"))
+	})
+
+	It("Honors the rotation flags", func() {
+		// Prepare the flags:
+		flags := pflag.NewFlagSet("", pflag.ContinueOnError)
+		AddFlags(flags)
+		err := flags.Parse([]string{
+			"--log-file", file,
+			"--log-max-size", "1",
+			"--log-max-backups", "1",
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create the logger and write enough messages to rotate the file more than once:
+		logger, err := NewLogger().
+			SetFlags(flags).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		padding := strings.Repeat("x", 1024)
+		for i := 0; i < 3*1024; i++ {
+			logger.Info("my message", "padding", padding)
+		}
+
+		// Check that there is only one backup, and that the sizes are within the limit:
+		matches, err := filepath.Glob(file + "*")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(matches).To(ConsistOf(file, file+".1"))
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Size()).To(BeNumerically("<=", 1024*1024))
+		}
+	})
+})
@@ -19,6 +19,7 @@ import (
 	"strings"
 
 	"github.com/go-logr/logr"
+	"go.uber.org/zap"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -33,6 +34,7 @@ type sink struct {
 // sinkSettings stores settings shared by multiple sinks.
 type sinkSettings struct {
 	redact bool
+	level  zap.AtomicLevel
 }
 
 // Make sure we implement the logr.LogSink interface.
@@ -0,0 +1,338 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// The container image of the controller doesn't have the time zone database, so it needs
+	// to be embedded in the binary:
+	_ "time/tzdata"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+)
+
+// maintenanceSchedule contains the maintenance windows of an upgrade, parsed and ready to check
+// if the upgrade is inside of one of them.
+type maintenanceSchedule struct {
+	windows []*maintenanceWindow
+}
+
+// maintenanceWindow is a window of time when the upgrade can progress. It is either a recurring
+// window that starts when the cron expression matches and lasts the given duration, or a single
+// window with a start and end time.
+type maintenanceWindow struct {
+	cron     *cronExpression
+	duration time.Duration
+	start    time.Time
+	end      time.Time
+}
+
+// parseMaintenanceSchedule parses the schedule of an upgrade. The result is nil if the schedule
+// is nil or doesn't contain windows, which means that the upgrade can progress at any time.
+func parseMaintenanceSchedule(
+	schedule *v1alpha1.ClusterUpgradeSchedule) (result *maintenanceSchedule, err error) {
+	if schedule == nil || len(schedule.Windows) == 0 {
+		return
+	}
+	location, err := parseTimeZone(schedule.TimeZone)
+	if err != nil {
+		return
+	}
+	windows := make([]*maintenanceWindow, len(schedule.Windows))
+	for i, window := range schedule.Windows {
+		windows[i], err = parseMaintenanceWindow(window, location)
+		if err != nil {
+			err = fmt.Errorf("window %d isn't valid: %w", i, err)
+			return
+		}
+	}
+	result = &maintenanceSchedule{
+		windows: windows,
+	}
+	return
+}
+
+// parseTimeZone returns the location for the given IANA time zone name, for example
+// 'Europe/Madrid'. The empty string means UTC.
+func parseTimeZone(name string) (result *time.Location, err error) {
+	if name == "" {
+		result = time.UTC
+		return
+	}
+	result, err = time.LoadLocation(name)
+	if err != nil {
+		err = fmt.Errorf("time zone '%s' isn't valid: %w", name, err)
+	}
+	return
+}
+
+// parseMaintenanceWindow parses one of the windows of the schedule. Cron expressions are
+// evaluated in the given location.
+func parseMaintenanceWindow(window v1alpha1.ClusterUpgradeWindow,
+	location *time.Location) (result *maintenanceWindow, err error) {
+	recurring := window.Cron != ""
+	single := window.Start != nil || window.End != nil
+	switch {
+	case recurring && single:
+		err = fmt.Errorf("cron and start or end are mutually exclusive")
+	case recurring:
+		var cron *cronExpression
+		cron, err = parseCron(window.Cron, location)
+		if err != nil {
+			return
+		}
+		if window.Duration == nil || window.Duration.Duration <= 0 {
+			err = fmt.Errorf("duration is mandatory and must be positive when cron is used")
+			return
+		}
+		result = &maintenanceWindow{
+			cron:     cron,
+			duration: window.Duration.Duration,
+		}
+	case single:
+		if window.Start == nil || window.End == nil {
+			err = fmt.Errorf("start and end are both mandatory when cron isn't used")
+			return
+		}
+		if !window.End.After(window.Start.Time) {
+			err = fmt.Errorf("end must be after start")
+			return
+		}
+		if window.Duration != nil {
+			err = fmt.Errorf("duration can only be used with cron")
+			return
+		}
+		result = &maintenanceWindow{
+			start: window.Start.Time,
+			end:   window.End.Time,
+		}
+	default:
+		err = fmt.Errorf("either cron or start and end are mandatory")
+	}
+	return
+}
+
+// check checks if the given time is inside of one of the windows of the schedule. When it isn't
+// it also returns the time when the next window opens, which is zero if there are no more
+// windows.
+func (s *maintenanceSchedule) check(now time.Time) (open bool, next time.Time) {
+	for _, window := range s.windows {
+		var start time.Time
+		open, start = window.check(now)
+		if open {
+			next = time.Time{}
+			return
+		}
+		if !start.IsZero() && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+	}
+	return
+}
+
+// check checks if the given time is inside of the window, and if it isn't returns the time when
+// it opens next, which is zero if it will not open again.
+func (w *maintenanceWindow) check(now time.Time) (open bool, next time.Time) {
+	if w.cron == nil {
+		open = !now.Before(w.start) && now.Before(w.end)
+		if now.Before(w.start) {
+			next = w.start
+		}
+		return
+	}
+
+	// The window is open if it started less than the duration ago:
+	start := w.cron.next(now.Add(-w.duration))
+	if !start.IsZero() && !start.After(now) {
+		open = true
+		return
+	}
+	next = w.cron.next(now)
+	return
+}
+
+// cronExpression is a cron expression with the usual five fields: minute, hour, day of month,
+// month and day of week. Each field can be an asterisk, a number, a range like '1-5', a step like
+// '*/15' or '0-30/10', or a comma separated list of those. Names of months and days aren't
+// supported.
+type cronExpression struct {
+	location *time.Location
+	minutes  cronField
+	hours    cronField
+	days     cronField
+	months   cronField
+	weekdays cronField
+
+	// anyDay and anyWeekday indicate that the day of month or day of week fields are asterisks.
+	// When both fields are restricted a day matches if it matches any of them.
+	anyDay     bool
+	anyWeekday bool
+}
+
+// cronField is the set of values that a field of a cron expression matches.
+type cronField uint64
+
+// has checks if the field matches the given value.
+func (f cronField) has(value int) bool {
+	return f&(1<<uint(value)) != 0
+}
+
+// parseCron parses a cron expression that will be evaluated in the given location.
+func parseCron(text string, location *time.Location) (result *cronExpression, err error) {
+	fields := strings.Fields(text)
+	if len(fields) != 5 {
+		err = fmt.Errorf(
+			"cron expression '%s' isn't valid, it should have five fields but it has %d",
+			text, len(fields),
+		)
+		return
+	}
+	cron := &cronExpression{
+		location:   location,
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	cron.minutes, err = parseCronField(fields[0], 0, 59)
+	if err == nil {
+		cron.hours, err = parseCronField(fields[1], 0, 23)
+	}
+	if err == nil {
+		cron.days, err = parseCronField(fields[2], 1, 31)
+	}
+	if err == nil {
+		cron.months, err = parseCronField(fields[3], 1, 12)
+	}
+	if err == nil {
+		cron.weekdays, err = parseCronField(fields[4], 0, 7)
+	}
+	if err != nil {
+		err = fmt.Errorf("cron expression '%s' isn't valid: %w", text, err)
+		return
+	}
+
+	// Seven is an alternative name for Sunday:
+	if cron.weekdays.has(7) {
+		cron.weekdays |= 1
+	}
+
+	result = cron
+	return
+}
+
+// parseCronField parses one field of a cron expression whose values are between the given
+// lowest and highest.
+func parseCronField(text string, lowest, highest int) (result cronField, err error) {
+	for _, item := range strings.Split(text, ",") {
+		// Extract the step:
+		step := 1
+		rng, stepText, hasStep := strings.Cut(item, "/")
+		if hasStep {
+			step, err = strconv.Atoi(stepText)
+			if err != nil || step < 1 {
+				err = fmt.Errorf("step '%s' isn't valid", stepText)
+				return
+			}
+		}
+
+		// Extract the range:
+		first, last := lowest, highest
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			firstText, lastText, _ := strings.Cut(rng, "-")
+			first, err = strconv.Atoi(firstText)
+			if err == nil {
+				last, err = strconv.Atoi(lastText)
+			}
+			if err != nil || first > last {
+				err = fmt.Errorf("range '%s' isn't valid", rng)
+				return
+			}
+		default:
+			first, err = strconv.Atoi(rng)
+			if err != nil {
+				err = fmt.Errorf("value '%s' isn't valid", rng)
+				return
+			}
+			if !hasStep {
+				last = first
+			}
+		}
+		if first < lowest || last > highest {
+			err = fmt.Errorf(
+				"'%s' is out of range, values must be between %d and %d",
+				item, lowest, highest,
+			)
+			return
+		}
+		for value := first; value <= last; value += step {
+			result |= 1 << uint(value)
+		}
+	}
+	return
+}
+
+// next returns the first time after the given one that matches the expression, with a resolution
+// of one minute. It returns zero if there is no such time in the next five years, which happens
+// for expressions like '0 0 31 2 *'.
+func (c *cronExpression) next(after time.Time) time.Time {
+	t := after.In(c.location)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, c.location)
+	t = t.Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		var next time.Time
+		switch {
+		case !c.months.has(int(t.Month())):
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.location)
+		case !c.dayMatches(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.location)
+		case !c.hours.has(t.Hour()):
+			next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		case !c.minutes.has(t.Minute()):
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+
+		// Changes of daylight saving time could move the calculated time backwards, make
+		// sure that it always moves forward:
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+// dayMatches checks if the day of the given time matches the day of month and day of week fields.
+func (c *cronExpression) dayMatches(t time.Time) bool {
+	day := c.days.has(t.Day())
+	weekday := c.weekdays.has(int(t.Weekday()))
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+)
+
+var _ = Describe("Maintenance schedule", func() {
+	// date returns the given UTC date and time.
+	date := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	Describe("Cron expressions", func() {
+		It("Calculates the next time for a weekly expression", func() {
+			cron, err := parseCron("0 22 * * 6", time.UTC)
+			Expect(err).ToNot(HaveOccurred())
+
+			// 2023-07-05 is a Wednesday, so the next Saturday is 2023-07-08:
+			next := cron.next(date(2023, time.July, 5, 10, 30))
+			Expect(next).To(Equal(date(2023, time.July, 8, 22, 0)))
+		})
+
+		It("Doesn't return the given time even if it matches", func() {
+			cron, err := parseCron("0 22 * * *", time.UTC)
+			Expect(err).ToNot(HaveOccurred())
+			next := cron.next(date(2023, time.July, 5, 22, 0))
+			Expect(next).To(Equal(date(2023, time.July, 6, 22, 0)))
+		})
+
+		It("Supports lists, ranges and steps", func() {
+			cron, err := parseCron("*/20 1-3 * * 1,3", time.UTC)
+			Expect(err).ToNot(HaveOccurred())
+			next := cron.next(date(2023, time.July, 4, 3, 50))
+			Expect(next).To(Equal(date(2023, time.July, 5, 1, 0)))
+			next = cron.next(next)
+			Expect(next).To(Equal(date(2023, time.July, 5, 1, 20)))
+		})
+
+		It("Matches any of the days when both day fields are restricted", func() {
+			// The first day of the month or Sundays:
+			cron, err := parseCron("0 0 1 * 0", time.UTC)
+			Expect(err).ToNot(HaveOccurred())
+			next := cron.next(date(2023, time.July, 25, 0, 0))
+			Expect(next).To(Equal(date(2023, time.July, 30, 0, 0)))
+			next = cron.next(next)
+			Expect(next).To(Equal(date(2023, time.August, 1, 0, 0)))
+		})
+
+		It("Evaluates the expression in the given time zone", func() {
+			location, err := time.LoadLocation("Europe/Madrid")
+			Expect(err).ToNot(HaveOccurred())
+			cron, err := parseCron("0 22 * * *", location)
+			Expect(err).ToNot(HaveOccurred())
+
+			// In summer Madrid is two hours ahead of UTC:
+			next := cron.next(date(2023, time.July, 5, 10, 0))
+			Expect(next.UTC()).To(Equal(date(2023, time.July, 5, 20, 0)))
+		})
+
+		It("Returns zero for expressions that never match", func() {
+			cron, err := parseCron("0 0 31 2 *", time.UTC)
+			Expect(err).ToNot(HaveOccurred())
+			next := cron.next(date(2023, time.July, 5, 10, 0))
+			Expect(next.IsZero()).To(BeTrue())
+		})
+
+		It("Rejects invalid expressions", func() {
+			for _, text := range []string{
+				"",
+				"0 22 * *",
+				"60 * * * *",
+				"* 24 * * *",
+				"* * 0 * *",
+				"* * * 13 *",
+				"* * * * 8",
+				"5-1 * * * *",
+				"*/0 * * * *",
+				"junk * * * *",
+			} {
+				_, err := parseCron(text, time.UTC)
+				Expect(err).To(HaveOccurred(), "expression '%s'", text)
+			}
+		})
+	})
+
+	Describe("Windows", func() {
+		It("Is open during the duration of a recurring window", func() {
+			schedule, err := parseMaintenanceSchedule(&v1alpha1.ClusterUpgradeSchedule{
+				Windows: []v1alpha1.ClusterUpgradeWindow{{
+					Cron: "0 22 * * 6",
+					Duration: &metav1.Duration{
+						Duration: 6 * time.Hour,
+					},
+				}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			// Inside of the window that started on Saturday:
+			open, _ := schedule.check(date(2023, time.July, 9, 3, 59))
+			Expect(open).To(BeTrue())
+
+			// After the end of the window:
+			open, next := schedule.check(date(2023, time.July, 9, 4, 0))
+			Expect(open).To(BeFalse())
+			Expect(next).To(Equal(date(2023, time.July, 15, 22, 0)))
+		})
+
+		It("Is open between the start and end of a single window", func() {
+			start := metav1.NewTime(date(2023, time.July, 8, 22, 0))
+			end := metav1.NewTime(date(2023, time.July, 9, 4, 0))
+			schedule, err := parseMaintenanceSchedule(&v1alpha1.ClusterUpgradeSchedule{
+				Windows: []v1alpha1.ClusterUpgradeWindow{{
+					Start: &start,
+					End:   &end,
+				}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			open, next := schedule.check(date(2023, time.July, 8, 10, 0))
+			Expect(open).To(BeFalse())
+			Expect(next).To(Equal(start.Time))
+			open, _ = schedule.check(date(2023, time.July, 8, 23, 0))
+			Expect(open).To(BeTrue())
+			open, next = schedule.check(date(2023, time.July, 9, 5, 0))
+			Expect(open).To(BeFalse())
+			Expect(next.IsZero()).To(BeTrue())
+		})
+
+		It("Returns the earliest of the next windows", func() {
+			start := metav1.NewTime(date(2023, time.July, 6, 22, 0))
+			end := metav1.NewTime(date(2023, time.July, 7, 4, 0))
+			schedule, err := parseMaintenanceSchedule(&v1alpha1.ClusterUpgradeSchedule{
+				Windows: []v1alpha1.ClusterUpgradeWindow{
+					{
+						Cron: "0 22 * * 6",
+						Duration: &metav1.Duration{
+							Duration: time.Hour,
+						},
+					},
+					{
+						Start: &start,
+						End:   &end,
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			open, next := schedule.check(date(2023, time.July, 5, 10, 0))
+			Expect(open).To(BeFalse())
+			Expect(next).To(Equal(start.Time))
+		})
+
+		It("Returns nil when there are no windows", func() {
+			schedule, err := parseMaintenanceSchedule(&v1alpha1.ClusterUpgradeSchedule{
+				TimeZone: "Europe/Madrid",
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(schedule).To(BeNil())
+		})
+
+		It("Rejects invalid windows", func() {
+			start := metav1.NewTime(date(2023, time.July, 8, 22, 0))
+			for _, window := range []v1alpha1.ClusterUpgradeWindow{
+				{},
+				{
+					Cron: "0 22 * * 6",
+				},
+				{
+					Cron:  "0 22 * * 6",
+					Start: &start,
+					End:   &start,
+				},
+				{
+					Start: &start,
+				},
+				{
+					Start: &start,
+					End:   &start,
+				},
+			} {
+				_, err := parseMaintenanceSchedule(&v1alpha1.ClusterUpgradeSchedule{
+					Windows: []v1alpha1.ClusterUpgradeWindow{window},
+				})
+				Expect(err).To(HaveOccurred())
+			}
+		})
+
+		It("Rejects an invalid time zone", func() {
+			_, err := parseMaintenanceSchedule(&v1alpha1.ClusterUpgradeSchedule{
+				TimeZone: "Junk/Junk",
+				Windows: []v1alpha1.ClusterUpgradeWindow{{
+					Cron: "0 22 * * 6",
+					Duration: &metav1.Duration{
+						Duration: time.Hour,
+					},
+				}},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Junk/Junk"))
+		})
+	})
+})
@@ -0,0 +1,465 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+	"github.com/jhernand/upgrade-tool/internal/labels"
+)
+
+// managedClusterUpgradeReconciler reconciles ManagedClusterUpgrade objects in an Advanced Cluster
+// Management hub. For each selected managed cluster it creates a ManifestWork that contains the
+// ClusterUpgrade object, and aggregates in the status the feedback that the managed clusters
+// report back about those objects.
+type managedClusterUpgradeReconciler struct {
+	logger logr.Logger
+	client clnt.Client
+}
+
+func (r *managedClusterUpgradeReconciler) Reconcile(ctx context.Context,
+	request ctrl.Request) (result ctrl.Result, err error) {
+	// Fetch the object:
+	object := &v1alpha1.ManagedClusterUpgrade{}
+	err = r.client.Get(ctx, request.NamespacedName, object)
+	if apierrors.IsNotFound(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	// The manifest works are in the namespaces of the clusters, so they can't be owned by the
+	// object, and we need a finalizer to delete them:
+	if object.DeletionTimestamp != nil {
+		err = r.deleteWorks(ctx, object, nil)
+		if err != nil {
+			return
+		}
+		err = r.removeFinalizer(ctx, object)
+		return
+	}
+	err = r.addFinalizer(ctx, object)
+	if err != nil {
+		return
+	}
+
+	// Create or update the manifest works of the selected clusters, and delete the ones of the
+	// clusters that are no longer selected:
+	clusters, err := r.selectClusters(ctx, object)
+	if err != nil {
+		return
+	}
+	works := map[string]*unstructured.Unstructured{}
+	for _, cluster := range clusters {
+		works[cluster], err = r.ensureWork(ctx, object, cluster)
+		if err != nil {
+			return
+		}
+	}
+	err = r.deleteWorks(ctx, object, works)
+	if err != nil {
+		return
+	}
+
+	// Update the status with the feedback of the clusters:
+	update := object.DeepCopy()
+	r.updateStatus(update, clusters, works)
+	if !equality.Semantic.DeepEqual(update.Status, object.Status) {
+		err = r.client.Status().Update(ctx, update)
+		if err != nil {
+			return
+		}
+		r.logger.Info(
+			"Updated managed cluster upgrade status",
+			"namespace", update.Namespace,
+			"name", update.Name,
+			"phase", update.Status.Phase,
+			"message", update.Status.Message,
+		)
+	}
+
+	// Changes in the feedback of the manifest works and in the labels of the managed clusters
+	// aren't watched, so we need to check them periodically:
+	result.RequeueAfter = controllerRequeueDelay
+	return
+}
+
+func (r *managedClusterUpgradeReconciler) addFinalizer(ctx context.Context,
+	object *v1alpha1.ManagedClusterUpgrade) error {
+	if controllerutil.ContainsFinalizer(object, managedClusterUpgradeFinalizer) {
+		return nil
+	}
+	update := object.DeepCopy()
+	controllerutil.AddFinalizer(update, managedClusterUpgradeFinalizer)
+	err := r.client.Patch(ctx, update, clnt.MergeFrom(object))
+	if err != nil {
+		return err
+	}
+	object.ObjectMeta = update.ObjectMeta
+	return nil
+}
+
+func (r *managedClusterUpgradeReconciler) removeFinalizer(ctx context.Context,
+	object *v1alpha1.ManagedClusterUpgrade) error {
+	if !controllerutil.ContainsFinalizer(object, managedClusterUpgradeFinalizer) {
+		return nil
+	}
+	update := object.DeepCopy()
+	controllerutil.RemoveFinalizer(update, managedClusterUpgradeFinalizer)
+	return r.client.Patch(ctx, update, clnt.MergeFrom(object))
+}
+
+// selectClusters returns the sorted names of the managed clusters selected by the given object.
+func (r *managedClusterUpgradeReconciler) selectClusters(ctx context.Context,
+	object *v1alpha1.ManagedClusterUpgrade) (results []string, err error) {
+	selector, err := metav1.LabelSelectorAsSelector(&object.Spec.ClusterSelector)
+	if err != nil {
+		return
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(managedClusterListGVK)
+	err = r.client.List(ctx, list, clnt.MatchingLabelsSelector{Selector: selector})
+	if err != nil {
+		return
+	}
+	results = make([]string, len(list.Items))
+	for i, item := range list.Items {
+		results[i] = item.GetName()
+	}
+	sort.Strings(results)
+	return
+}
+
+// ensureWork creates or updates the manifest work that contains the cluster upgrade for the given
+// cluster, and returns it. Existing manifest works are only updated when the generation of the
+// object changes.
+func (r *managedClusterUpgradeReconciler) ensureWork(ctx context.Context,
+	object *v1alpha1.ManagedClusterUpgrade, cluster string) (result *unstructured.Unstructured,
+	err error) {
+	work, err := r.makeWork(object, cluster)
+	if err != nil {
+		return
+	}
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(manifestWorkGVK)
+	err = r.client.Get(ctx, clnt.ObjectKeyFromObject(work), existing)
+	switch {
+	case apierrors.IsNotFound(err):
+		err = r.client.Create(ctx, work)
+		if err != nil {
+			r.logger.Error(
+				err,
+				"Failed to create manifest work",
+				"cluster", cluster,
+				"name", work.GetName(),
+			)
+			return
+		}
+		r.logger.Info(
+			"Created manifest work",
+			"cluster", cluster,
+			"name", work.GetName(),
+		)
+		result = work
+	case err != nil:
+		return
+	case existing.GetAnnotations()[annotations.Generation] != strconv.FormatInt(
+		object.Generation, 10,
+	):
+		update := existing.DeepCopy()
+		update.SetLabels(work.GetLabels())
+		update.SetAnnotations(work.GetAnnotations())
+		update.Object["spec"] = work.Object["spec"]
+		err = r.client.Update(ctx, update)
+		if err != nil {
+			r.logger.Error(
+				err,
+				"Failed to update manifest work",
+				"cluster", cluster,
+				"name", work.GetName(),
+			)
+			return
+		}
+		r.logger.Info(
+			"Updated manifest work",
+			"cluster", cluster,
+			"name", work.GetName(),
+		)
+		result = update
+	default:
+		result = existing
+	}
+	return
+}
+
+// makeWork creates the manifest work that contains the cluster upgrade for the given cluster, and
+// that asks the work agent to report back the status of the cluster upgrade.
+func (r *managedClusterUpgradeReconciler) makeWork(object *v1alpha1.ManagedClusterUpgrade,
+	cluster string) (result *unstructured.Unstructured, err error) {
+	namespace := object.Spec.Namespace
+	if namespace == "" {
+		namespace = managedClusterUpgradeDefaultNamespace
+	}
+	upgrade := &v1alpha1.ClusterUpgrade{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       "ClusterUpgrade",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      object.Name,
+		},
+		Spec: object.Spec.Upgrade,
+	}
+	manifest, err := manifestData(upgrade)
+	if err != nil {
+		return
+	}
+	var paths []any
+	for _, feedback := range managedClusterUpgradeFeedback {
+		paths = append(paths, map[string]any{
+			"name": feedback[0],
+			"path": feedback[1],
+		})
+	}
+	result = &unstructured.Unstructured{}
+	result.SetGroupVersionKind(manifestWorkGVK)
+	result.SetNamespace(cluster)
+	result.SetName(fmt.Sprintf("%s-%s", managedClusterUpgradeWorkPrefix, object.Name))
+	result.SetLabels(map[string]string{
+		labels.ManagedClusterUpgrade: string(object.UID),
+	})
+	result.SetAnnotations(map[string]string{
+		annotations.Generation: strconv.FormatInt(object.Generation, 10),
+	})
+	result.Object["spec"] = map[string]any{
+		"workload": map[string]any{
+			"manifests": []any{
+				manifest,
+			},
+		},
+		"manifestConfigs": []any{
+			map[string]any{
+				"resourceIdentifier": map[string]any{
+					"group":     v1alpha1.GroupVersion.Group,
+					"resource":  "clusterupgrades",
+					"namespace": namespace,
+					"name":      object.Name,
+				},
+				"feedbackRules": []any{
+					map[string]any{
+						"type":      "JSONPaths",
+						"jsonPaths": paths,
+					},
+				},
+			},
+		},
+	}
+	return
+}
+
+// deleteWorks deletes the manifest works generated for the given object, except the ones of the
+// clusters that are in the given map. Passing a nil map deletes all of them.
+func (r *managedClusterUpgradeReconciler) deleteWorks(ctx context.Context,
+	object *v1alpha1.ManagedClusterUpgrade, keep map[string]*unstructured.Unstructured) error {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(manifestWorkListGVK)
+	err := r.client.List(ctx, list, clnt.MatchingLabels{
+		labels.ManagedClusterUpgrade: string(object.UID),
+	})
+	if err != nil {
+		return err
+	}
+	for i := range list.Items {
+		work := &list.Items[i]
+		_, ok := keep[work.GetNamespace()]
+		if ok || work.GetDeletionTimestamp() != nil {
+			continue
+		}
+		err = r.client.Delete(ctx, work)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			r.logger.Error(
+				err,
+				"Failed to delete manifest work",
+				"cluster", work.GetNamespace(),
+				"name", work.GetName(),
+			)
+			return err
+		}
+		r.logger.Info(
+			"Deleted manifest work",
+			"cluster", work.GetNamespace(),
+			"name", work.GetName(),
+		)
+	}
+	return nil
+}
+
+// updateStatus updates the status of the given object with the feedback reported by the manifest
+// works of the given clusters.
+func (r *managedClusterUpgradeReconciler) updateStatus(object *v1alpha1.ManagedClusterUpgrade,
+	clusters []string, works map[string]*unstructured.Unstructured) {
+	status := &object.Status
+	status.ObservedGeneration = object.Generation
+	status.Clusters = len(clusters)
+	status.CompletedClusters = 0
+	status.DegradedClusters = 0
+	status.ClusterStatuses = nil
+	started := 0
+	for _, cluster := range clusters {
+		clusterStatus := r.clusterStatus(cluster, works[cluster])
+		switch clusterStatus.Phase {
+		case "", v1alpha1.ClusterUpgradePending:
+		case v1alpha1.ClusterUpgradeCompleted:
+			status.CompletedClusters++
+			started++
+		default:
+			started++
+		}
+		if clusterStatus.Degraded {
+			status.DegradedClusters++
+		}
+		status.ClusterStatuses = append(status.ClusterStatuses, clusterStatus)
+	}
+	switch {
+	case len(clusters) == 0:
+		status.Phase = v1alpha1.ManagedClusterUpgradePending
+		status.Message = "No managed cluster matches the selector"
+	case status.CompletedClusters == len(clusters):
+		status.Phase = v1alpha1.ManagedClusterUpgradeCompleted
+		status.Message = fmt.Sprintf(
+			"Upgrade has completed in all the %d clusters",
+			len(clusters),
+		)
+	case started == 0:
+		status.Phase = v1alpha1.ManagedClusterUpgradePending
+		status.Message = "Waiting for the clusters to start the upgrade"
+	default:
+		status.Phase = v1alpha1.ManagedClusterUpgradeProgressing
+		status.Message = fmt.Sprintf(
+			"Upgrade has completed in %d of %d clusters",
+			status.CompletedClusters, len(clusters),
+		)
+	}
+	if status.DegradedClusters > 0 {
+		status.Message = fmt.Sprintf(
+			"%s, %d degraded",
+			status.Message, status.DegradedClusters,
+		)
+	}
+}
+
+// clusterStatus extracts the status of the cluster upgrade from the feedback of the given manifest
+// work.
+func (r *managedClusterUpgradeReconciler) clusterStatus(cluster string,
+	work *unstructured.Unstructured) (result v1alpha1.ManagedClusterUpgradeClusterStatus) {
+	result.Cluster = cluster
+	if work == nil {
+		return
+	}
+	manifests, _, _ := unstructured.NestedSlice(
+		work.Object, "status", "resourceStatus", "manifests",
+	)
+	for _, manifest := range manifests {
+		data, ok := manifest.(map[string]any)
+		if !ok {
+			continue
+		}
+		resource, _, _ := unstructured.NestedString(data, "resourceMeta", "resource")
+		if resource != "clusterupgrades" {
+			continue
+		}
+		values, _, _ := unstructured.NestedSlice(data, "statusFeedback", "values")
+		for _, value := range values {
+			item, ok := value.(map[string]any)
+			if !ok {
+				continue
+			}
+			name, _, _ := unstructured.NestedString(item, "name")
+			text, _, _ := unstructured.NestedString(item, "fieldValue", "string")
+			number, _, _ := unstructured.NestedInt64(item, "fieldValue", "integer")
+			switch name {
+			case "phase":
+				result.Phase = v1alpha1.ClusterUpgradePhase(text)
+			case "message":
+				result.Message = text
+			case "degraded":
+				result.Degraded = text == string(metav1.ConditionTrue)
+			case "nodes":
+				result.Nodes = int(number)
+			case "extractedNodes":
+				result.ExtractedNodes = int(number)
+			case "loadedNodes":
+				result.LoadedNodes = int(number)
+			}
+		}
+	}
+	return
+}
+
+// managedClusterUpgradeFeedback contains the names and JSON paths of the fields of the status of
+// the cluster upgrades that the work agents report back to the hub.
+var managedClusterUpgradeFeedback = [][2]string{
+	{"phase", ".status.phase"},
+	{"message", ".status.message"},
+	{"degraded", `.status.conditions[?(@.type=="Degraded")].status`},
+	{"nodes", ".status.nodes"},
+	{"extractedNodes", ".status.extractedNodes"},
+	{"loadedNodes", ".status.loadedNodes"},
+}
+
+var (
+	managedClusterListGVK = schema.GroupVersionKind{
+		Group:   "cluster.open-cluster-management.io",
+		Version: "v1",
+		Kind:    "ManagedClusterList",
+	}
+	manifestWorkGVK = schema.GroupVersionKind{
+		Group:   "work.open-cluster-management.io",
+		Version: "v1",
+		Kind:    "ManifestWork",
+	}
+	manifestWorkListGVK = schema.GroupVersionKind{
+		Group:   "work.open-cluster-management.io",
+		Version: "v1",
+		Kind:    "ManifestWorkList",
+	}
+)
+
+const (
+	managedClusterUpgradeDefaultNamespace = "upgrade-tool"
+	managedClusterUpgradeFinalizer        = "upgrade-tool.io/managed-cluster-upgrade"
+	managedClusterUpgradeWorkPrefix       = "upgrade-tool"
+)
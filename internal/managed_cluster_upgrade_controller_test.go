@@ -0,0 +1,306 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+	"github.com/jhernand/upgrade-tool/internal/labels"
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Managed cluster upgrade controller", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		ctx = context.Background()
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	// makeCluster creates a managed cluster with the given name and labels.
+	makeCluster := func(name string, values map[string]string) *unstructured.Unstructured {
+		object := &unstructured.Unstructured{}
+		object.SetAPIVersion("cluster.open-cluster-management.io/v1")
+		object.SetKind("ManagedCluster")
+		object.SetName(name)
+		object.SetLabels(values)
+		return object
+	}
+
+	// makeUpgrade creates a managed cluster upgrade that selects the production clusters.
+	makeUpgrade := func() *v1alpha1.ManagedClusterUpgrade {
+		return &v1alpha1.ManagedClusterUpgrade{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:  "upgrade-tool",
+				Name:       "my-upgrade",
+				UID:        types.UID("1234"),
+				Generation: 1,
+			},
+			Spec: v1alpha1.ManagedClusterUpgradeSpec{
+				ClusterSelector: metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						"env": "production",
+					},
+				},
+				Upgrade: v1alpha1.ClusterUpgradeSpec{
+					Version: "4.13.4",
+					Bundle: v1alpha1.ClusterUpgradeBundle{
+						URL: "s3://bundles/4.13.4.tar",
+					},
+				},
+			},
+		}
+	}
+
+	// makeClient creates a fake client containing the given upgrade and objects.
+	makeClient := func(upgrade *v1alpha1.ManagedClusterUpgrade,
+		objects ...clnt.Object) clnt.Client {
+		return fake.NewClientBuilder().
+			WithScheme(snapshotScheme()).
+			WithObjects(upgrade).
+			WithObjects(objects...).
+			WithStatusSubresource(upgrade).
+			Build()
+	}
+
+	// makeWork creates a manifest work for the given cluster that reports the given feedback
+	// values for the cluster upgrade.
+	makeWork := func(cluster string, values ...any) *unstructured.Unstructured {
+		object := &unstructured.Unstructured{}
+		object.SetGroupVersionKind(manifestWorkGVK)
+		object.SetNamespace(cluster)
+		object.SetName("upgrade-tool-my-upgrade")
+		object.SetLabels(map[string]string{
+			labels.ManagedClusterUpgrade: "1234",
+		})
+		object.Object["status"] = map[string]any{
+			"resourceStatus": map[string]any{
+				"manifests": []any{
+					map[string]any{
+						"resourceMeta": map[string]any{
+							"group":     "upgrade-tool.io",
+							"resource":  "clusterupgrades",
+							"namespace": "upgrade-tool",
+							"name":      "my-upgrade",
+						},
+						"statusFeedback": map[string]any{
+							"values": values,
+						},
+					},
+				},
+			},
+		}
+		return object
+	}
+
+	// stringValue creates a feedback value containing a string.
+	stringValue := func(name, value string) any {
+		return map[string]any{
+			"name": name,
+			"fieldValue": map[string]any{
+				"type":   "String",
+				"string": value,
+			},
+		}
+	}
+
+	// reconcile runs one reconciliation cycle and returns the resulting upgrade.
+	reconcile := func(client clnt.Client) *v1alpha1.ManagedClusterUpgrade {
+		reconciler := &managedClusterUpgradeReconciler{
+			logger: logger,
+			client: client,
+		}
+		key := clnt.ObjectKey{
+			Namespace: "upgrade-tool",
+			Name:      "my-upgrade",
+		}
+		result, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.RequeueAfter).To(Equal(controllerRequeueDelay))
+		upgrade := &v1alpha1.ManagedClusterUpgrade{}
+		err = client.Get(ctx, key, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+		return upgrade
+	}
+
+	// listWorks returns the manifest works that exist.
+	listWorks := func(client clnt.Client) []unstructured.Unstructured {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(manifestWorkListGVK)
+		err := client.List(ctx, list)
+		Expect(err).ToNot(HaveOccurred())
+		return list.Items
+	}
+
+	It("Creates the manifest works for the selected clusters", func() {
+		client := makeClient(
+			makeUpgrade(),
+			makeCluster("prod0", map[string]string{"env": "production"}),
+			makeCluster("prod1", map[string]string{"env": "production"}),
+			makeCluster("test0", map[string]string{"env": "test"}),
+		)
+		upgrade := reconcile(client)
+		Expect(upgrade.Finalizers).To(ContainElement(managedClusterUpgradeFinalizer))
+
+		// Check the manifest works:
+		works := listWorks(client)
+		Expect(works).To(HaveLen(2))
+		var namespaces []string
+		for _, work := range works {
+			namespaces = append(namespaces, work.GetNamespace())
+		}
+		Expect(namespaces).To(ConsistOf("prod0", "prod1"))
+
+		// Check the cluster upgrade inside the manifest work:
+		manifests, _, err := unstructured.NestedSlice(
+			works[0].Object, "spec", "workload", "manifests",
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifests).To(HaveLen(1))
+		manifest := manifests[0].(map[string]any)
+		Expect(manifest["kind"]).To(Equal("ClusterUpgrade"))
+		Expect(manifest).ToNot(HaveKey("status"))
+		namespace, _, _ := unstructured.NestedString(manifest, "metadata", "namespace")
+		Expect(namespace).To(Equal("upgrade-tool"))
+		url, _, _ := unstructured.NestedString(manifest, "spec", "bundle", "url")
+		Expect(url).To(Equal("s3://bundles/4.13.4.tar"))
+
+		// Check the status:
+		Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ManagedClusterUpgradePending))
+		Expect(upgrade.Status.Clusters).To(Equal(2))
+		Expect(upgrade.Status.ClusterStatuses).To(HaveLen(2))
+		Expect(upgrade.Status.ClusterStatuses[0].Cluster).To(Equal("prod0"))
+	})
+
+	It("Deletes the manifest works of the clusters that are no longer selected", func() {
+		client := makeClient(
+			makeUpgrade(),
+			makeCluster("prod0", map[string]string{"env": "production"}),
+			makeCluster("test0", map[string]string{"env": "test"}),
+			makeWork("test0"),
+		)
+		reconcile(client)
+		works := listWorks(client)
+		Expect(works).To(HaveLen(1))
+		Expect(works[0].GetNamespace()).To(Equal("prod0"))
+	})
+
+	It("Aggregates the status reported by the clusters", func() {
+		client := makeClient(
+			makeUpgrade(),
+			makeCluster("prod0", map[string]string{"env": "production"}),
+			makeCluster("prod1", map[string]string{"env": "production"}),
+			makeCluster("prod2", map[string]string{"env": "production"}),
+			makeWork(
+				"prod0",
+				stringValue("phase", "Completed"),
+				stringValue("message", "Upgrade to version '4.13.4' has completed"),
+			),
+			makeWork(
+				"prod1",
+				stringValue("phase", "Loading"),
+				stringValue("degraded", "True"),
+				map[string]any{
+					"name": "nodes",
+					"fieldValue": map[string]any{
+						"type":    "Integer",
+						"integer": int64(3),
+					},
+				},
+			),
+			makeWork("prod2"),
+		)
+		upgrade := reconcile(client)
+		Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ManagedClusterUpgradeProgressing))
+		Expect(upgrade.Status.Message).To(Equal(
+			"Upgrade has completed in 1 of 3 clusters, 1 degraded",
+		))
+		Expect(upgrade.Status.CompletedClusters).To(Equal(1))
+		Expect(upgrade.Status.DegradedClusters).To(Equal(1))
+		type clusterStatus = v1alpha1.ManagedClusterUpgradeClusterStatus
+		Expect(upgrade.Status.ClusterStatuses).To(Equal([]clusterStatus{
+			{
+				Cluster: "prod0",
+				Phase:   v1alpha1.ClusterUpgradeCompleted,
+				Message: "Upgrade to version '4.13.4' has completed",
+			},
+			{
+				Cluster:  "prod1",
+				Phase:    v1alpha1.ClusterUpgradeLoading,
+				Degraded: true,
+				Nodes:    3,
+			},
+			{
+				Cluster: "prod2",
+			},
+		}))
+	})
+
+	It("Reports completion when all the clusters have completed", func() {
+		client := makeClient(
+			makeUpgrade(),
+			makeCluster("prod0", map[string]string{"env": "production"}),
+			makeWork("prod0", stringValue("phase", "Completed")),
+		)
+		upgrade := reconcile(client)
+		Expect(upgrade.Status.Phase).To(Equal(v1alpha1.ManagedClusterUpgradeCompleted))
+		Expect(upgrade.Status.Message).To(Equal("Upgrade has completed in all the 1 clusters"))
+	})
+
+	It("Deletes the manifest works when the upgrade is deleted", func() {
+		upgrade := makeUpgrade()
+		upgrade.Finalizers = []string{managedClusterUpgradeFinalizer}
+		client := makeClient(
+			upgrade,
+			makeCluster("prod0", map[string]string{"env": "production"}),
+			makeWork("prod0"),
+		)
+		err := client.Delete(ctx, upgrade)
+		Expect(err).ToNot(HaveOccurred())
+		reconciler := &managedClusterUpgradeReconciler{
+			logger: logger,
+			client: client,
+		}
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{
+			NamespacedName: clnt.ObjectKeyFromObject(upgrade),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(listWorks(client)).To(BeEmpty())
+
+		// Check that the finalizer has been removed, so the object is gone:
+		err = client.Get(ctx, clnt.ObjectKeyFromObject(upgrade), upgrade)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,109 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+// ParseManifests parses the given text, that may contain multiple YAML or JSON documents, and
+// returns the list of objects. Empty documents are ignored. Documents that don't have an API
+// version or kind are considered errors. Documents are numbered starting with one, including the
+// empty ones, so that the numbers in error messages match the position in the text.
+func ParseManifests(data []byte) (results []*unstructured.Unstructured, err error) {
+	decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	count := 0
+	for {
+		var object map[string]any
+		err = decoder.Decode(&object)
+		if errors.Is(err, io.EOF) {
+			err = nil
+			return
+		}
+		count++
+		if err != nil {
+			err = fmt.Errorf("failed to parse document %d: %w", count, err)
+			return
+		}
+		if len(object) == 0 {
+			continue
+		}
+		result := &unstructured.Unstructured{
+			Object: object,
+		}
+		if result.GetAPIVersion() == "" {
+			err = fmt.Errorf("document %d doesn't have an API version", count)
+			return
+		}
+		if result.GetKind() == "" {
+			err = fmt.Errorf("document %d doesn't have a kind", count)
+			return
+		}
+		results = append(results, result)
+	}
+}
+
+// WriteManifests writes the given objects as YAML documents separated by '---'. The objects need
+// to have the API version and kind set. Fields that the server fills, like the creation timestamp
+// and the status, are omitted.
+func WriteManifests(writer io.Writer, objects []clnt.Object) error {
+	for i, object := range objects {
+		data, err := manifestData(object)
+		if err != nil {
+			return err
+		}
+		text, err := sigsyaml.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			_, err = io.WriteString(writer, "\n---\n\n")
+			if err != nil {
+				return err
+			}
+		}
+		_, err = writer.Write(text)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manifestData converts the given object into the data of a manifest, omitting the fields that
+// the server fills, like the creation timestamp and the status. The object needs to have the API
+// version and kind set.
+func manifestData(object clnt.Object) (result map[string]any, err error) {
+	result, err = runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	if err != nil {
+		return
+	}
+	unstructured.RemoveNestedField(result, "metadata", "creationTimestamp")
+	unstructured.RemoveNestedField(result, "status")
+	spec, ok := result["spec"].(map[string]any)
+	if ok && len(spec) == 0 {
+		delete(result, "spec")
+	}
+	return
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Manifests", func() {
+	It("Parses multiple YAML documents", func() {
+		objects, err := ParseManifests([]byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  namespace: my-ns
+  name: my-config
+data:
+  my-key: my-value
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: my-ns
+`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(objects).To(HaveLen(2))
+		Expect(objects[0].GetKind()).To(Equal("ConfigMap"))
+		Expect(objects[0].GetNamespace()).To(Equal("my-ns"))
+		Expect(objects[0].GetName()).To(Equal("my-config"))
+		Expect(objects[0].Object["data"]).To(HaveKeyWithValue("my-key", "my-value"))
+		Expect(objects[1].GetKind()).To(Equal("Namespace"))
+		Expect(objects[1].GetName()).To(Equal("my-ns"))
+	})
+
+	It("Parses a JSON document", func() {
+		objects, err := ParseManifests([]byte(`{
+			"apiVersion": "v1",
+			"kind": "Namespace",
+			"metadata": {
+				"name": "my-ns"
+			}
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(objects).To(HaveLen(1))
+		Expect(objects[0].GetName()).To(Equal("my-ns"))
+	})
+
+	It("Ignores empty documents", func() {
+		objects, err := ParseManifests([]byte(`
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: my-ns
+---
+---
+`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(objects).To(HaveLen(1))
+	})
+
+	It("Returns nothing for empty text", func() {
+		objects, err := ParseManifests([]byte{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(objects).To(BeEmpty())
+	})
+
+	It("Fails if a document doesn't have an API version", func() {
+		_, err := ParseManifests([]byte(`
+kind: Namespace
+metadata:
+  name: my-ns
+`))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("document 1 doesn't have an API version"))
+	})
+
+	It("Fails if a document doesn't have a kind", func() {
+		_, err := ParseManifests([]byte(`
+apiVersion: v1
+metadata:
+  name: my-ns
+`))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("document 1 doesn't have a kind"))
+	})
+
+	It("Counts empty documents when reporting the position of errors", func() {
+		_, err := ParseManifests([]byte(`
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: my-ns
+---
+# This document is empty.
+---
+apiVersion: v1
+metadata:
+  name: your-ns
+`))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("document 3 doesn't have a kind"))
+	})
+
+	It("Fails if a document isn't valid", func() {
+		_, err := ParseManifests([]byte(`
+apiVersion: v1
+kind: Namespace
+---
+apiVersion: [
+`))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("document 2"))
+	})
+})
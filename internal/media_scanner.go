@@ -0,0 +1,200 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// mediaScanner knows how to find bundle files in the directories where removable media, like USB
+// disks, are mounted. It looks for files with names like 'upgrade-4.12.3.tar' and only accepts
+// them if their digest matches the expected one, so that incomplete or corrupted copies are
+// ignored.
+type mediaScanner struct {
+	logger logr.Logger
+
+	// dirs are the directories where removable media are mounted, for example '/run/media'.
+	dirs []string
+
+	// version is the version that the bundle should have. If empty any version is accepted.
+	version string
+
+	// digest is the expected digest of the bundle, as hex string. If empty the digest is read
+	// from the '.sha256' file next to each bundle file, and files without it are ignored.
+	digest string
+}
+
+// scan searches the directories and returns the first bundle file that has the expected version
+// and digest. Returns an empty string if there is no such file.
+func (s *mediaScanner) scan(ctx context.Context) (result string, err error) {
+	for _, dir := range s.dirs {
+		var candidates []string
+		candidates, err = s.findCandidates(dir)
+		if err != nil {
+			return
+		}
+		for _, candidate := range candidates {
+			err = ctx.Err()
+			if err != nil {
+				return
+			}
+			var ok bool
+			ok, err = s.checkCandidate(candidate)
+			if err != nil {
+				s.logger.Error(
+					err,
+					"Failed to check bundle file in removable media",
+					"file", candidate,
+				)
+				err = nil
+				continue
+			}
+			if ok {
+				s.logger.Info(
+					"Found bundle file in removable media",
+					"file", candidate,
+				)
+				result = candidate
+				return
+			}
+		}
+	}
+	return
+}
+
+// findCandidates returns the files inside the given directory, or its subdirectories, whose names
+// match the pattern of bundle files. Directories that don't exist or that can't be read are
+// silently ignored, as media may be mounted or removed at any time.
+func (s *mediaScanner) findCandidates(dir string) (result []string, err error) {
+	err = filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+				if entry != nil && entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			if file == dir {
+				return nil
+			}
+			if strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			rel, err := filepath.Rel(dir, file)
+			if err != nil {
+				return err
+			}
+			if strings.Count(rel, string(filepath.Separator)) >= mediaScannerMaxDepth-1 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		matches, err := filepath.Match(mediaScannerPattern, entry.Name())
+		if err != nil {
+			return err
+		}
+		if matches {
+			result = append(result, file)
+		}
+		return nil
+	})
+	return
+}
+
+// checkCandidate checks that the given file has the expected version and digest.
+func (s *mediaScanner) checkCandidate(file string) (ok bool, err error) {
+	// Get the expected digest:
+	expected := s.digest
+	if expected == "" {
+		expected, err = readBundleDigest(file)
+		if err != nil {
+			return
+		}
+	}
+	if expected == "" {
+		s.logger.Info(
+			"Ignoring bundle file in removable media because the digest isn't known",
+			"file", file,
+			"digest_file", bundleDigestFile(file),
+		)
+		return
+	}
+
+	// Check the version first, as that is much cheaper than calculating the digest:
+	if s.version != "" {
+		var reader *os.File
+		reader, err = os.Open(file)
+		if err != nil {
+			return
+		}
+		var metadata *Metadata
+		metadata, err = readBundleMetadata(reader)
+		reader.Close()
+		if err != nil {
+			return
+		}
+		if metadata == nil || metadata.Version != s.version {
+			s.logger.Info(
+				"Ignoring bundle file in removable media because the version doesn't match",
+				"file", file,
+				"expected", s.version,
+			)
+			return
+		}
+	}
+
+	// Check the digest:
+	s.logger.Info(
+		"Checking digest of bundle file in removable media",
+		"file", file,
+	)
+	actual, err := calculateFileDigest(file)
+	if err != nil {
+		return
+	}
+	if !strings.EqualFold(actual, expected) {
+		s.logger.Info(
+			"Ignoring bundle file in removable media because the digest doesn't match",
+			"file", file,
+			"expected", expected,
+			"actual", actual,
+		)
+		return
+	}
+	ok = true
+	return
+}
+
+const (
+	// mediaScannerPattern is the pattern that the names of bundle files should match.
+	mediaScannerPattern = "upgrade-*.tar"
+
+	// mediaScannerMaxDepth is the maximum depth of the subdirectories that are searched. This
+	// is enough for the layout used by most systems, like '/run/media/{user}/{label}/{file}'.
+	mediaScannerMaxDepth = 3
+)
@@ -0,0 +1,168 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Media scanner", func() {
+	var (
+		ctx     context.Context
+		logger  logr.Logger
+		tmp     string
+		media   string
+		scanner *mediaScanner
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create a temporary directory and the directory where media are mounted inside it:
+		tmp, err = os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		media = filepath.Join(tmp, "run", "media")
+		err = os.MkdirAll(media, 0755)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create the scanner:
+		scanner = &mediaScanner{
+			logger: logger,
+			dirs: []string{
+				filepath.Join(tmp, "missing"),
+				media,
+			},
+		}
+	})
+
+	// writeMediaBundle writes a bundle to the given file, relative to the media directory, and
+	// returns its absolute path and its digest.
+	writeMediaBundle := func(name, version string) (file, digest string) {
+		file = filepath.Join(media, name)
+		err := os.MkdirAll(filepath.Dir(file), 0755)
+		Expect(err).ToNot(HaveOccurred())
+		writeTestBundle(file, version)
+		digest, err = calculateFileDigest(file)
+		Expect(err).ToNot(HaveOccurred())
+		return
+	}
+
+	writeMediaDigest := func(file, digest string) {
+		err := os.WriteFile(bundleDigestFile(file), []byte(digest+"  bundle.tar\n"), 0600)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	It("Finds the bundle with a valid digest file", func() {
+		file, digest := writeMediaBundle("user/usb/upgrade-4.13.5.tar", "4.13.5")
+		writeMediaDigest(file, digest)
+		result, err := scanner.scan(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(file))
+	})
+
+	It("Uses the configured digest", func() {
+		file, digest := writeMediaBundle("usb/upgrade-4.13.5.tar", "4.13.5")
+		scanner.digest = digest
+		result, err := scanner.scan(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(file))
+	})
+
+	It("Ignores files without digest", func() {
+		writeMediaBundle("usb/upgrade-4.13.5.tar", "4.13.5")
+		result, err := scanner.scan(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(BeEmpty())
+	})
+
+	It("Ignores files whose digest doesn't match", func() {
+		bad, _ := writeMediaBundle("a/upgrade-4.13.5.tar", "4.13.5")
+		writeMediaDigest(bad, strings.Repeat("0", 64))
+		good, digest := writeMediaBundle("b/upgrade-4.13.5.tar", "4.13.5")
+		writeMediaDigest(good, digest)
+		result, err := scanner.scan(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(good))
+	})
+
+	It("Ignores files with a different version", func() {
+		old, digest := writeMediaBundle("a/upgrade-4.13.4.tar", "4.13.4")
+		writeMediaDigest(old, digest)
+		current, digest := writeMediaBundle("b/upgrade-4.13.5.tar", "4.13.5")
+		writeMediaDigest(current, digest)
+		scanner.version = "4.13.5"
+		result, err := scanner.scan(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(current))
+	})
+
+	It("Ignores files with other names", func() {
+		file, digest := writeMediaBundle("usb/bundle.tar", "4.13.5")
+		writeMediaDigest(file, digest)
+		result, err := scanner.scan(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(BeEmpty())
+	})
+
+	It("Doesn't search too deep", func() {
+		file, digest := writeMediaBundle("a/b/c/upgrade-4.13.5.tar", "4.13.5")
+		writeMediaDigest(file, digest)
+		result, err := scanner.scan(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(BeEmpty())
+	})
+
+	It("Is used by the extractor when the bundle file doesn't exist", func() {
+		file, digest := writeMediaBundle("usb/upgrade-4.13.5.tar", "4.13.5")
+		writeMediaDigest(file, digest)
+		extractor, err := NewBundleExtractor().
+			SetLogger(logger).
+			SetClient(fake.NewClientBuilder().Build()).
+			SetNode("my-node").
+			SetRootDir(tmp).
+			SetBundleFile("missing.tar").
+			SetBundleDir("extracted").
+			AddMediaDir("/run/media").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		reader, info, err := extractor.openBundleAttempt(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reader).ToNot(BeNil())
+		defer reader.Close()
+		Expect(info.Name).To(Equal("upgrade-4.13.5.tar"))
+		Expect(extractor.expectedDigest(info)).To(Equal(digest))
+	})
+})
@@ -14,11 +14,74 @@ License.
 
 package internal
 
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
 // Metadata describes an upgrade package. This will be serialized to JSON and added to the tar
 // archive as the first item, named `metadata.json`.
 type Metadata struct {
-	Version string   `json:"version,omitempty"`
-	Arch    string   `json:"arch,omitempty"`
+	Version string `json:"version,omitempty"`
+	Arch    string `json:"arch,omitempty"`
+
+	// Distribution is the distribution of the release, either 'ocp' or 'okd'. An empty value means
+	// 'ocp', as that was the only distribution supported by older versions of the tool.
+	Distribution string `json:"distribution,omitempty"`
+
 	Release string   `json:"release,omitempty"`
 	Images  []string `json:"images,omitempty"`
+
+	// Tags contains the names of the payload images, for example 'etcd', and the corresponding
+	// image references.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Roles contains for each node role, for example 'worker', the names of the payload images
+	// that nodes with that role need. Loaders use it to load only those images. Bundles created
+	// by older versions of the tool don't have it, and then all the images are needed.
+	Roles map[string][]string `json:"roles,omitempty"`
+
+	// Manifests contains the text of additional Kubernetes manifests that the controller will
+	// apply to the cluster before requesting the upgrade.
+	Manifests []string `json:"manifests,omitempty"`
+
+	// Graph contains the part of the update graph that describes the supported updates to this
+	// version, so that the controller can check and configure the update in disconnected
+	// clusters.
+	Graph *UpdateGraph `json:"graph,omitempty"`
+
+	// Size is the total size in bytes of the files of the bundle once extracted. The extractor
+	// uses it to check that there is enough disk space before extracting the bundle. Zero means
+	// that the size isn't known, as in bundles created by older versions of the tool.
+	Size int64 `json:"size,omitempty"`
+}
+
+// readBundleMetadata reads the metadata from the given bundle tar archive. Returns nil if the
+// archive doesn't contain the metadata. Note that the metadata is usually the first entry of the
+// archive, and that the rest of the entries are skipped efficiently if the reader is seekable.
+func readBundleMetadata(reader io.Reader) (result *Metadata, err error) {
+	archive := tar.NewReader(reader)
+	for {
+		var header *tar.Header
+		header, err = archive.Next()
+		if errors.Is(err, io.EOF) {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		if header.Name != "metadata.json" {
+			continue
+		}
+		var data []byte
+		data, err = io.ReadAll(archive)
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(data, &result)
+		return
+	}
 }
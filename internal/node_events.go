@@ -0,0 +1,151 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// nodeEventWriter knows how to create the Kubernetes events that describe the phase transitions and
+// failures of the programs that run in a node, so that they are visible with 'oc get events' and
+// to alerting tools. The involved object of the events is the node. Like the status, writing events
+// is best effort: failures are written to the log but not returned. All the methods do nothing if
+// the writer is nil.
+type nodeEventWriter struct {
+	logger    logr.Logger
+	client    clnt.Client
+	node      string
+	component string
+}
+
+// newNodeEventWriter creates an event writer for the given node. The component is the name of the
+// program that will be reported as the source of the events.
+func newNodeEventWriter(logger logr.Logger, client clnt.Client,
+	node, component string) *nodeEventWriter {
+	return &nodeEventWriter{
+		logger:    logger,
+		client:    client,
+		node:      node,
+		component: component,
+	}
+}
+
+// normal creates an event of the normal type.
+func (w *nodeEventWriter) normal(ctx context.Context, reason, message string) {
+	w.write(ctx, corev1.EventTypeNormal, reason, message)
+}
+
+// warning creates an event of the warning type.
+func (w *nodeEventWriter) warning(ctx context.Context, reason, message string) {
+	w.write(ctx, corev1.EventTypeWarning, reason, message)
+}
+
+func (w *nodeEventWriter) write(ctx context.Context, kind, reason, message string) {
+	if w == nil {
+		return
+	}
+
+	// Try to get the node in order to put the identifier in the involved object. If that fails
+	// the event is still created, just without the identifier.
+	node := &corev1.Node{}
+	err := w.client.Get(ctx, clnt.ObjectKey{Name: w.node}, node)
+	if err != nil {
+		w.logger.V(1).Info(
+			"Failed to get node for event",
+			"node", w.node,
+			"error", err.Error(),
+		)
+	}
+
+	// Events for nodes go to the default namespace because nodes aren't namespaced, same than
+	// what the kubelet does:
+	now := time.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: metav1.NamespaceDefault,
+			Name:      fmt.Sprintf("%s.%x", w.node, now.UnixNano()),
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Node",
+			Name:       w.node,
+			UID:        node.UID,
+		},
+		Reason:  reason,
+		Message: message,
+		Type:    kind,
+		Source: corev1.EventSource{
+			Component: w.component,
+			Host:      w.node,
+		},
+		FirstTimestamp: metav1.NewTime(now),
+		LastTimestamp:  metav1.NewTime(now),
+		Count:          1,
+	}
+	err = w.client.Create(ctx, event)
+	if err != nil {
+		w.logger.Error(
+			err,
+			"Failed to create event",
+			"node", w.node,
+			"reason", reason,
+		)
+		return
+	}
+	w.logger.V(2).Info(
+		"Created event",
+		"node", w.node,
+		"type", kind,
+		"reason", reason,
+		"message", message,
+	)
+}
+
+// Reasons of the events:
+const (
+	nodeEventExtracting       = "BundleExtracting"
+	nodeEventExtracted        = "BundleExtracted"
+	nodeEventExtractionFailed = "BundleExtractionFailed"
+	nodeEventLoading          = "BundleLoading"
+	nodeEventLoaded           = "BundleLoaded"
+	nodeEventLoadingFailed    = "BundleLoadingFailed"
+	nodeEventCleaning         = "BundleCleaning"
+	nodeEventCleaned          = "BundleCleaned"
+	nodeEventCleaningFailed   = "BundleCleaningFailed"
+)
+
+// Components used as the source of the events:
+const (
+	nodeEventExtractorComponent = "upgrade-tool-extractor"
+	nodeEventLoaderComponent    = "upgrade-tool-loader"
+	nodeEventCleanerComponent   = "upgrade-tool-cleaner"
+)
+
+// nodeEventRules are the permissions needed to write the events of the nodes. Events go to the
+// default namespace, so this needs to be granted in the cluster. Note that the writer also gets
+// the node, but all the programs that use it already have permission for that.
+var nodeEventRules = []rbacv1.PolicyRule{{
+	APIGroups: []string{""},
+	Resources: []string{"events"},
+	Verbs:     []string{"create"},
+}}
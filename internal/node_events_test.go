@@ -0,0 +1,114 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	core "k8s.io/client-go/kubernetes/scheme"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Node event writer", func() {
+	var (
+		ctx    context.Context
+		client clnt.Client
+		writer *nodeEventWriter
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err := logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create the API client with the node:
+		scheme := runtime.NewScheme()
+		core.AddToScheme(scheme)
+		client = fake.NewClientBuilder().
+			WithScheme(scheme).
+			WithObjects(&corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "my-node",
+					UID:  types.UID("my-uid"),
+				},
+			}).
+			Build()
+
+		// Create the writer:
+		writer = newNodeEventWriter(logger, client, "my-node", "my-component")
+	})
+
+	// list returns the events of the default namespace.
+	list := func() []corev1.Event {
+		events := &corev1.EventList{}
+		err := client.List(ctx, events, clnt.InNamespace(metav1.NamespaceDefault))
+		Expect(err).ToNot(HaveOccurred())
+		return events.Items
+	}
+
+	It("Creates a normal event for the node", func() {
+		writer.normal(ctx, nodeEventLoading, "Started loading bundle")
+		events := list()
+		Expect(events).To(HaveLen(1))
+		event := events[0]
+		Expect(event.Type).To(Equal(corev1.EventTypeNormal))
+		Expect(event.Reason).To(Equal(nodeEventLoading))
+		Expect(event.Message).To(Equal("Started loading bundle"))
+		Expect(event.InvolvedObject.Kind).To(Equal("Node"))
+		Expect(event.InvolvedObject.Name).To(Equal("my-node"))
+		Expect(event.InvolvedObject.UID).To(Equal(types.UID("my-uid")))
+		Expect(event.Source.Component).To(Equal("my-component"))
+		Expect(event.Source.Host).To(Equal("my-node"))
+	})
+
+	It("Creates a warning event for a failure", func() {
+		writer.warning(ctx, nodeEventLoadingFailed, "Image was corrupted")
+		events := list()
+		Expect(events).To(HaveLen(1))
+		event := events[0]
+		Expect(event.Type).To(Equal(corev1.EventTypeWarning))
+		Expect(event.Reason).To(Equal(nodeEventLoadingFailed))
+		Expect(event.Message).To(Equal("Image was corrupted"))
+	})
+
+	It("Creates one event per transition", func() {
+		writer.normal(ctx, nodeEventLoading, "Started loading bundle")
+		writer.normal(ctx, nodeEventLoaded, "Finished loading bundle")
+		Expect(list()).To(HaveLen(2))
+	})
+
+	It("Does nothing if nil", func() {
+		var writer *nodeEventWriter
+		writer.normal(ctx, nodeEventLoading, "Started loading bundle")
+		Expect(list()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,179 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+)
+
+// nodeStatusWriter knows how to update the NodeUpgradeStatus object of a node. The object has the
+// same name than the node and is created if it doesn't exist. Writing the status is best effort:
+// failures are written to the log but not returned, so that the programs that run in the nodes
+// don't fail because the custom resource definition isn't installed. All the methods do nothing
+// if the writer is nil, which is what is used when no namespace has been configured.
+type nodeStatusWriter struct {
+	logger    logr.Logger
+	client    clnt.Client
+	namespace string
+	node      string
+}
+
+// newNodeStatusWriter creates a writer for the given node, or returns nil if the namespace is
+// empty.
+func newNodeStatusWriter(logger logr.Logger, client clnt.Client,
+	namespace, node string) *nodeStatusWriter {
+	if namespace == "" {
+		return nil
+	}
+	return &nodeStatusWriter{
+		logger:    logger,
+		client:    client,
+		namespace: namespace,
+		node:      node,
+	}
+}
+
+// start indicates that the given phase has started.
+func (w *nodeStatusWriter) start(ctx context.Context, phase v1alpha1.NodeUpgradePhase) {
+	w.update(ctx, func(status *v1alpha1.NodeUpgradeStatusStatus, now *metav1.Time) {
+		*status = v1alpha1.NodeUpgradeStatusStatus{
+			Phase:      phase,
+			StartTime:  now,
+			UpdateTime: now,
+		}
+	})
+}
+
+// progress updates the description of the progress of the current phase.
+func (w *nodeStatusWriter) progress(ctx context.Context, text string, percent int) {
+	w.update(ctx, func(status *v1alpha1.NodeUpgradeStatusStatus, now *metav1.Time) {
+		status.Progress = text
+		status.Percent = percent
+		status.UpdateTime = now
+	})
+}
+
+// succeed indicates that the current phase finished successfully, moving to the given phase.
+func (w *nodeStatusWriter) succeed(ctx context.Context, phase v1alpha1.NodeUpgradePhase) {
+	w.update(ctx, func(status *v1alpha1.NodeUpgradeStatusStatus, now *metav1.Time) {
+		status.Phase = phase
+		status.Percent = 100
+		status.UpdateTime = now
+		status.CompletionTime = now
+	})
+}
+
+// fail indicates that the current phase failed with the given error.
+func (w *nodeStatusWriter) fail(ctx context.Context, text string) {
+	w.update(ctx, func(status *v1alpha1.NodeUpgradeStatusStatus, now *metav1.Time) {
+		if status.Phase != v1alpha1.NodeUpgradeFailed {
+			status.FailedPhase = status.Phase
+		}
+		status.Phase = v1alpha1.NodeUpgradeFailed
+		status.Error = text
+		status.UpdateTime = now
+		status.CompletionTime = now
+	})
+}
+
+func (w *nodeStatusWriter) update(ctx context.Context,
+	mutate func(status *v1alpha1.NodeUpgradeStatusStatus, now *metav1.Time)) {
+	if w == nil {
+		return
+	}
+	object, err := w.fetch(ctx)
+	if err != nil {
+		w.logger.Error(
+			err,
+			"Failed to fetch node upgrade status",
+			"namespace", w.namespace,
+			"node", w.node,
+		)
+		return
+	}
+	update := object.DeepCopy()
+	now := metav1.Now()
+	mutate(&update.Status, &now)
+	err = w.client.Status().Patch(ctx, update, clnt.MergeFrom(object))
+	if err != nil {
+		w.logger.Error(
+			err,
+			"Failed to update node upgrade status",
+			"namespace", w.namespace,
+			"node", w.node,
+		)
+		return
+	}
+	w.logger.V(2).Info(
+		"Updated node upgrade status",
+		"namespace", w.namespace,
+		"node", w.node,
+		"phase", update.Status.Phase,
+		"progress", update.Status.Progress,
+	)
+}
+
+// fetch returns the status object of the node, creating it if it doesn't exist yet.
+func (w *nodeStatusWriter) fetch(ctx context.Context) (result *v1alpha1.NodeUpgradeStatus,
+	err error) {
+	object := &v1alpha1.NodeUpgradeStatus{}
+	key := clnt.ObjectKey{
+		Namespace: w.namespace,
+		Name:      w.node,
+	}
+	err = w.client.Get(ctx, key, object)
+	if apierrors.IsNotFound(err) {
+		object = &v1alpha1.NodeUpgradeStatus{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: w.namespace,
+				Name:      w.node,
+			},
+			Spec: v1alpha1.NodeUpgradeStatusSpec{
+				Node: w.node,
+			},
+		}
+		err = w.client.Create(ctx, object)
+		if apierrors.IsAlreadyExists(err) {
+			err = w.client.Get(ctx, key, object)
+		}
+	}
+	if err != nil {
+		return
+	}
+	result = object
+	return
+}
+
+// nodeStatusRules are the permissions needed to write the NodeUpgradeStatus objects.
+var nodeStatusRules = []rbacv1.PolicyRule{
+	{
+		APIGroups: []string{v1alpha1.GroupVersion.Group},
+		Resources: []string{"nodeupgradestatuses"},
+		Verbs:     []string{"get", "create"},
+	},
+	{
+		APIGroups: []string{v1alpha1.GroupVersion.Group},
+		Resources: []string{"nodeupgradestatuses/status"},
+		Verbs:     []string{"patch"},
+	},
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime"
+	core "k8s.io/client-go/kubernetes/scheme"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Node status writer", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+		client clnt.Client
+		writer *nodeStatusWriter
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create the API client:
+		scheme := runtime.NewScheme()
+		core.AddToScheme(scheme)
+		v1alpha1.AddToScheme(scheme)
+		client = fake.NewClientBuilder().
+			WithScheme(scheme).
+			WithStatusSubresource(&v1alpha1.NodeUpgradeStatus{}).
+			Build()
+
+		// Create the writer:
+		writer = newNodeStatusWriter(logger, client, "my-ns", "my-node")
+	})
+
+	// get returns the status object of the node.
+	get := func() *v1alpha1.NodeUpgradeStatus {
+		object := &v1alpha1.NodeUpgradeStatus{}
+		key := clnt.ObjectKey{
+			Namespace: "my-ns",
+			Name:      "my-node",
+		}
+		err := client.Get(ctx, key, object)
+		Expect(err).ToNot(HaveOccurred())
+		return object
+	}
+
+	It("Isn't created without namespace", func() {
+		Expect(newNodeStatusWriter(logger, client, "", "my-node")).To(BeNil())
+	})
+
+	It("Does nothing if nil", func() {
+		var writer *nodeStatusWriter
+		writer.start(ctx, v1alpha1.NodeUpgradeExtracting)
+		writer.progress(ctx, "Extracting", 10)
+		writer.succeed(ctx, v1alpha1.NodeUpgradeExtracted)
+		writer.fail(ctx, "Failed")
+	})
+
+	It("Creates the object when the phase starts", func() {
+		writer.start(ctx, v1alpha1.NodeUpgradeExtracting)
+		object := get()
+		Expect(object.Spec.Node).To(Equal("my-node"))
+		Expect(object.Status.Phase).To(Equal(v1alpha1.NodeUpgradeExtracting))
+		Expect(object.Status.StartTime).ToNot(BeNil())
+		Expect(object.Status.UpdateTime).ToNot(BeNil())
+		Expect(object.Status.CompletionTime).To(BeNil())
+	})
+
+	It("Updates the progress", func() {
+		writer.start(ctx, v1alpha1.NodeUpgradeExtracting)
+		writer.progress(ctx, "Extracting bundle, 1 GiB of 2 GiB (50%)", 50)
+		object := get()
+		Expect(object.Status.Phase).To(Equal(v1alpha1.NodeUpgradeExtracting))
+		Expect(object.Status.Progress).To(Equal("Extracting bundle, 1 GiB of 2 GiB (50%)"))
+		Expect(object.Status.Percent).To(Equal(50))
+	})
+
+	It("Writes the completion", func() {
+		writer.start(ctx, v1alpha1.NodeUpgradeLoading)
+		writer.succeed(ctx, v1alpha1.NodeUpgradeLoaded)
+		object := get()
+		Expect(object.Status.Phase).To(Equal(v1alpha1.NodeUpgradeLoaded))
+		Expect(object.Status.Percent).To(Equal(100))
+		Expect(object.Status.CompletionTime).ToNot(BeNil())
+	})
+
+	It("Writes the error and the phase that failed", func() {
+		writer.start(ctx, v1alpha1.NodeUpgradeLoading)
+		writer.fail(ctx, "Image was corrupted")
+		object := get()
+		Expect(object.Status.Phase).To(Equal(v1alpha1.NodeUpgradeFailed))
+		Expect(object.Status.FailedPhase).To(Equal(v1alpha1.NodeUpgradeLoading))
+		Expect(object.Status.Error).To(Equal("Image was corrupted"))
+		Expect(object.Status.CompletionTime).ToNot(BeNil())
+	})
+
+	It("Clears the error when a new phase starts", func() {
+		writer.start(ctx, v1alpha1.NodeUpgradeExtracting)
+		writer.fail(ctx, "Wrong bundle")
+		writer.start(ctx, v1alpha1.NodeUpgradeExtracting)
+		object := get()
+		Expect(object.Status.Phase).To(Equal(v1alpha1.NodeUpgradeExtracting))
+		Expect(object.Status.Error).To(BeEmpty())
+		Expect(object.Status.FailedPhase).To(BeEmpty())
+	})
+
+	It("Doesn't fail if the custom resource isn't available", func() {
+		client = fake.NewClientBuilder().Build()
+		writer = newNodeStatusWriter(logger, client, "my-ns", "my-node")
+		writer.start(ctx, v1alpha1.NodeUpgradeExtracting)
+	})
+})
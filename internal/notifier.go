@@ -0,0 +1,321 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Notification is the content of the notifications that the controller sends to the webhooks when
+// the upgrade makes progress. When a webhook doesn't have a template this is sent as is, encoded
+// as JSON, otherwise it is the data passed to the template.
+type Notification struct {
+	// Event is the kind of event, one of 'UpgradeStarted', 'BatchCompleted', 'NodeFailed' or
+	// 'UpgradeCompleted'.
+	Event string `json:"event"`
+
+	// Time is the time when the event happened.
+	Time time.Time `json:"time"`
+
+	// Namespace and Name identify the ClusterUpgrade object.
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+
+	// Version is the version that the cluster is being upgraded to.
+	Version string `json:"version,omitempty"`
+
+	// Phase is the phase of the upgrade after the event.
+	Phase string `json:"phase"`
+
+	// Message is a human readable description of the event.
+	Message string `json:"message"`
+
+	// Batch is the number of the batch that completed, and Batches is the total number of
+	// batches. Both are only set for 'BatchCompleted' events.
+	Batch   int `json:"batch,omitempty"`
+	Batches int `json:"batches,omitempty"`
+
+	// Node is the name of the node that failed. It is only set for 'NodeFailed' events.
+	Node string `json:"node,omitempty"`
+}
+
+// Kinds of notification events.
+const (
+	NotificationUpgradeStarted   = "UpgradeStarted"
+	NotificationBatchCompleted   = "BatchCompleted"
+	NotificationNodeFailed       = "NodeFailed"
+	NotificationUpgradeCompleted = "UpgradeCompleted"
+)
+
+// NotifierBuilder contains the data and logic needed to create a notifier. Don't create instances
+// of this type directly, use the NewNotifier function instead.
+type NotifierBuilder struct {
+	logger   logr.Logger
+	webhooks []string
+	client   *http.Client
+}
+
+// Notifier sends notifications to webhooks using HTTP POST requests. The methods can be called
+// with a nil receiver, and then they do nothing, so that the reconciliation logic doesn't need to
+// check if notifications are enabled. Don't create instances of this type directly, use the
+// NewNotifier function instead.
+type Notifier struct {
+	logger   logr.Logger
+	webhooks []*notifierWebhook
+	client   *http.Client
+}
+
+// notifierWebhook is an URL where notifications are sent, and the optional template used to
+// render them.
+type notifierWebhook struct {
+	url      string
+	template *template.Template
+}
+
+// NewNotifier creates a builder that can then be used to configure and create notifiers.
+func NewNotifier() *NotifierBuilder {
+	return &NotifierBuilder{}
+}
+
+// SetLogger sets the logger that the notifier will use to write log messages. This is mandatory.
+func (b *NotifierBuilder) SetLogger(value logr.Logger) *NotifierBuilder {
+	b.logger = value
+	return b
+}
+
+// AddWebhook adds an URL where notifications will be sent. By default the body of the request is
+// the notification encoded as JSON. To send a different payload the URL can be prefixed with the
+// name of a template and an equals sign: 'slack' and 'teams' are built in templates for the
+// incoming webhooks of Slack and Microsoft Teams, and any other name is the path of a file
+// containing a Go template that receives the notification and generates the JSON body. For
+// example 'slack=https://hooks.slack.com/services/...' or '/etc/my.tmpl=https://example.com'.
+func (b *NotifierBuilder) AddWebhook(value string) *NotifierBuilder {
+	b.webhooks = append(b.webhooks, value)
+	return b
+}
+
+// AddWebhooks adds a list of webhooks. See the AddWebhook method for details.
+func (b *NotifierBuilder) AddWebhooks(values ...string) *NotifierBuilder {
+	b.webhooks = append(b.webhooks, values...)
+	return b
+}
+
+// SetClient sets the HTTP client that will be used to send the notifications. This is optional,
+// and the default is a client with a short timeout, so that webhooks that don't respond don't
+// delay the upgrade.
+func (b *NotifierBuilder) SetClient(value *http.Client) *NotifierBuilder {
+	b.client = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new notifier.
+func (b *NotifierBuilder) Build() (result *Notifier, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+
+	// Parse the webhooks:
+	webhooks := make([]*notifierWebhook, len(b.webhooks))
+	for i, value := range b.webhooks {
+		webhooks[i], err = b.parseWebhook(value)
+		if err != nil {
+			return
+		}
+	}
+
+	// Create the default client:
+	client := b.client
+	if client == nil {
+		client = &http.Client{
+			Timeout: notifierTimeout,
+		}
+	}
+
+	// Create and populate the object:
+	result = &Notifier{
+		logger:   b.logger,
+		webhooks: webhooks,
+		client:   client,
+	}
+	return
+}
+
+func (b *NotifierBuilder) parseWebhook(value string) (result *notifierWebhook, err error) {
+	// The template is separated from the URL by an equals sign, but the URL may also contain
+	// equals signs in the query, so we only look for it before the scheme:
+	address := value
+	name := ""
+	scheme := strings.Index(value, "://")
+	if scheme != -1 {
+		index := strings.Index(value[:scheme], "=")
+		if index != -1 {
+			name = value[:index]
+			address = value[index+1:]
+		}
+	}
+	parsed, err := url.Parse(address)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		err = fmt.Errorf(
+			"notification webhook '%s' isn't valid: %w",
+			notifierRedact(address), err,
+		)
+		return
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		err = fmt.Errorf(
+			"notification webhook '%s' isn't valid, the scheme must be 'http' or 'https'",
+			notifierRedact(address),
+		)
+		return
+	}
+
+	// Load the template:
+	result = &notifierWebhook{
+		url: address,
+	}
+	if name == "" {
+		return
+	}
+	var source []byte
+	switch name {
+	case "slack", "teams":
+		source, err = TemplatesFS.ReadFile(fmt.Sprintf("templates/notifications/%s.json", name))
+	default:
+		source, err = os.ReadFile(name)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to load notification template '%s': %w", name, err)
+		return
+	}
+	result.template, err = template.New(name).
+		Option("missingkey=error").
+		Funcs(notifierTemplateFuncs).
+		Parse(string(source))
+	if err != nil {
+		err = fmt.Errorf("failed to parse notification template '%s': %w", name, err)
+		return
+	}
+	return
+}
+
+// Notify sends the given notification to all the webhooks. Failures are written to the log but
+// not returned, as notifications should never stop the upgrade.
+func (n *Notifier) Notify(ctx context.Context, notification *Notification) {
+	if n == nil {
+		return
+	}
+	for _, webhook := range n.webhooks {
+		err := n.send(ctx, webhook, notification)
+		if err != nil {
+			// The errors returned by the HTTP client contain the complete URL, including
+			// the credentials, so we need to remove it:
+			var uerr *url.Error
+			if errors.As(err, &uerr) {
+				err = uerr.Err
+			}
+			n.logger.Error(
+				err,
+				"Failed to send notification",
+				"url", notifierRedact(webhook.url),
+				"event", notification.Event,
+			)
+			continue
+		}
+		n.logger.V(1).Info(
+			"Sent notification",
+			"url", notifierRedact(webhook.url),
+			"event", notification.Event,
+		)
+	}
+}
+
+func (n *Notifier) send(ctx context.Context, webhook *notifierWebhook,
+	notification *Notification) error {
+	// Render the body:
+	var body []byte
+	var err error
+	if webhook.template != nil {
+		buffer := &bytes.Buffer{}
+		err = webhook.template.Execute(buffer, notification)
+		body = buffer.Bytes()
+	} else {
+		body, err = json.Marshal(notification)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Send the request:
+	request, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, webhook.url, bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := n.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status code %d", response.StatusCode)
+	}
+	return nil
+}
+
+// notifierRedact removes the path and the query from the given URL before writing it to the log
+// or to error messages, as incoming webhooks like the ones of Slack contain the credentials in
+// the path.
+func notifierRedact(address string) string {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return "***"
+	}
+	return fmt.Sprintf("%s://%s/***", parsed.Scheme, parsed.Host)
+}
+
+// notifierTemplateFuncs are the functions available to the templates of the notifications. The
+// 'json' function encodes a value as JSON, which is needed to safely put strings inside the JSON
+// documents generated by the templates.
+var notifierTemplateFuncs = template.FuncMap{
+	"json": func(value any) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+// notifierTimeout is the maximum time to wait for a webhook to respond.
+const notifierTimeout = 10 * time.Second
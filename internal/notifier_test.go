@@ -0,0 +1,229 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Notifier", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		ctx = context.Background()
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	// startServer starts a server that saves the bodies of the requests that it receives and
+	// responds with the given status code.
+	startServer := func(code int) (server *httptest.Server, bodies func() [][]byte) {
+		var lock sync.Mutex
+		var received [][]byte
+		server = httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Expect(r.Method).To(Equal(http.MethodPost))
+				Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+				body, err := io.ReadAll(r.Body)
+				Expect(err).ToNot(HaveOccurred())
+				lock.Lock()
+				received = append(received, body)
+				lock.Unlock()
+				w.WriteHeader(code)
+			},
+		))
+		DeferCleanup(server.Close)
+		bodies = func() [][]byte {
+			lock.Lock()
+			defer lock.Unlock()
+			return received
+		}
+		return
+	}
+
+	makeNotification := func() *Notification {
+		return &Notification{
+			Event:     NotificationNodeFailed,
+			Time:      time.Date(2023, 7, 1, 10, 0, 0, 0, time.UTC),
+			Namespace: "upgrade-tool",
+			Name:      "my-upgrade",
+			Version:   "4.13.4",
+			Phase:     "Extracting",
+			Message:   `Node 'node0' reported an error: Disk "full"`,
+			Node:      "node0",
+		}
+	}
+
+	It("Can't be created with an URL that isn't HTTP", func() {
+		notifier, err := NewNotifier().
+			SetLogger(logger).
+			AddWebhook("ftp://example.com").
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("'http' or 'https'"))
+		Expect(notifier).To(BeNil())
+	})
+
+	It("Doesn't include the secret part of the URL in the error message", func() {
+		notifier, err := NewNotifier().
+			SetLogger(logger).
+			AddWebhook("ftp://example.com/my-secret").
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).ToNot(ContainSubstring("my-secret"))
+		Expect(err.Error()).To(ContainSubstring("ftp://example.com/***"))
+		Expect(notifier).To(BeNil())
+	})
+
+	It("Can't be created with a template that doesn't exist", func() {
+		notifier, err := NewNotifier().
+			SetLogger(logger).
+			AddWebhook("/does/not/exist.tmpl=https://example.com").
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("/does/not/exist.tmpl"))
+		Expect(notifier).To(BeNil())
+	})
+
+	It("Does nothing when it is nil", func() {
+		var notifier *Notifier
+		notifier.Notify(ctx, makeNotification())
+	})
+
+	It("Sends the notification as JSON by default", func() {
+		server, bodies := startServer(http.StatusOK)
+		notifier, err := NewNotifier().
+			SetLogger(logger).
+			AddWebhook(server.URL + "/hook?token=a=b").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		notifier.Notify(ctx, makeNotification())
+		Expect(bodies()).To(HaveLen(1))
+		var received Notification
+		err = json.Unmarshal(bodies()[0], &received)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(*makeNotification()))
+	})
+
+	It("Renders the built in Slack and Teams templates", func() {
+		server, bodies := startServer(http.StatusOK)
+		notifier, err := NewNotifier().
+			SetLogger(logger).
+			AddWebhooks("slack="+server.URL, "teams="+server.URL).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		notifier.Notify(ctx, makeNotification())
+		Expect(bodies()).To(HaveLen(2))
+
+		// Check the Slack payload:
+		var slack struct {
+			Text string `json:"text"`
+		}
+		err = json.Unmarshal(bodies()[0], &slack)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(slack.Text).To(Equal(`my-upgrade: Node 'node0' reported an error: Disk "full"`))
+
+		// Check the Teams payload:
+		var teams struct {
+			Type  string `json:"@type"`
+			Title string `json:"title"`
+			Text  string `json:"text"`
+		}
+		err = json.Unmarshal(bodies()[1], &teams)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(teams.Type).To(Equal("MessageCard"))
+		Expect(teams.Title).To(Equal("NodeFailed upgrade-tool/my-upgrade"))
+		Expect(teams.Text).To(Equal(`Node 'node0' reported an error: Disk "full"`))
+	})
+
+	It("Renders a custom template", func() {
+		tmp, err := os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		file := filepath.Join(tmp, "my.tmpl")
+		err = os.WriteFile(file, []byte(`{"node":{{ .Node | json }}}`), 0600)
+		Expect(err).ToNot(HaveOccurred())
+		server, bodies := startServer(http.StatusOK)
+		notifier, err := NewNotifier().
+			SetLogger(logger).
+			AddWebhook(file + "=" + server.URL).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		notifier.Notify(ctx, makeNotification())
+		Expect(bodies()).To(HaveLen(1))
+		Expect(string(bodies()[0])).To(Equal(`{"node":"node0"}`))
+	})
+
+	It("Continues with the rest of the webhooks when one fails", func() {
+		failing, _ := startServer(http.StatusInternalServerError)
+		working, bodies := startServer(http.StatusOK)
+		notifier, err := NewNotifier().
+			SetLogger(logger).
+			AddWebhooks(failing.URL, working.URL).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		notifier.Notify(ctx, makeNotification())
+		Expect(bodies()).To(HaveLen(1))
+	})
+
+	It("Doesn't write the secret part of the URL to the log when the request fails", func() {
+		// Start and immediately stop a server, so that we have an address that refuses
+		// connections:
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+
+		// Send the notification with a logger that writes to a buffer:
+		buffer := &bytes.Buffer{}
+		logger, err := logging.NewLogger().
+			SetWriter(io.MultiWriter(buffer, GinkgoWriter)).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		notifier, err := NewNotifier().
+			SetLogger(logger).
+			AddWebhook(server.URL + "/my-secret?token=my-token").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		notifier.Notify(ctx, makeNotification())
+
+		// Check the log:
+		Expect(buffer.String()).To(ContainSubstring("Failed to send notification"))
+		Expect(buffer.String()).ToNot(ContainSubstring("my-secret"))
+		Expect(buffer.String()).ToNot(ContainSubstring("my-token"))
+	})
+})
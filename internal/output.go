@@ -0,0 +1,69 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// OutputText is the human readable output, written to the console. It isn't intended to be
+	// parsed and may change between versions.
+	OutputText = "text"
+
+	// OutputJSON is the JSON encoding of the result, indented for readability.
+	OutputJSON = "json"
+
+	// OutputYAML is the YAML encoding of the result. Field names are the same than in the JSON
+	// output.
+	OutputYAML = "yaml"
+)
+
+// OutputFormats returns the names of the supported output formats.
+func OutputFormats() []string {
+	return []string{
+		OutputText,
+		OutputJSON,
+		OutputYAML,
+	}
+}
+
+// WriteOutput writes the given value to the given writer using the given machine readable format,
+// either 'json' or 'yaml'. The text format isn't supported because each command writes it in its
+// own way. Both formats use the JSON tags of the value, so that the schema is the same for both.
+func WriteOutput(writer io.Writer, format string, value any) error {
+	switch format {
+	case OutputJSON:
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case OutputYAML:
+		data, err := yaml.Marshal(value)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(data)
+		return err
+	default:
+		return fmt.Errorf(
+			"output format '%s' isn't valid, it must be '%s' or '%s'",
+			format, OutputJSON, OutputYAML,
+		)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Output", func() {
+	report := &ReadinessReport{
+		Verdict: ReadinessNoGo,
+		Checks: []ReadinessCheck{{
+			Name:    "cluster-version",
+			Status:  ReadinessFail,
+			Message: "Cluster version doesn't exist",
+		}},
+	}
+
+	It("Writes JSON", func() {
+		buffer := &bytes.Buffer{}
+		err := WriteOutput(buffer, OutputJSON, report)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buffer.String()).To(MatchJSON(`{
+			"verdict": "no-go",
+			"checks": [{
+				"name": "cluster-version",
+				"status": "fail",
+				"message": "Cluster version doesn't exist"
+			}]
+		}`))
+	})
+
+	It("Writes YAML with the same field names than JSON", func() {
+		buffer := &bytes.Buffer{}
+		err := WriteOutput(buffer, OutputYAML, report)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buffer.String()).To(MatchYAML(`
+verdict: no-go
+checks:
+- name: cluster-version
+  status: fail
+  message: Cluster version doesn't exist
+`))
+	})
+
+	It("Rejects the text format", func() {
+		err := WriteOutput(&bytes.Buffer{}, OutputText, report)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("'text' isn't valid"))
+	})
+})
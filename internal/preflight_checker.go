@@ -0,0 +1,458 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	configv1 "github.com/openshift/api/config/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/rest"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PreflightCheckerBuilder contains the data and logic needed to create a preflight checker. Don't
+// create instances of this type directly, use the NewPreflightChecker function instead.
+type PreflightCheckerBuilder struct {
+	logger    logr.Logger
+	client    clnt.Reader
+	config    *rest.Config
+	diskSpace resource.Quantity
+}
+
+// PreflightChecker checks if the cluster is healthy enough to start an upgrade, before anything is
+// distributed to the nodes: the cluster operators are available, all the etcd members are ready,
+// the nodes are ready and have enough disk space, and the certificate of the API server isn't
+// about to expire. Don't create instances of this type directly, use the NewPreflightChecker
+// function instead.
+type PreflightChecker struct {
+	logger    logr.Logger
+	client    clnt.Reader
+	config    *rest.Config
+	diskSpace resource.Quantity
+}
+
+type preflightCheckTask struct {
+	logger    logr.Logger
+	client    clnt.Reader
+	config    *rest.Config
+	diskSpace resource.Quantity
+	nodes     []corev1.Node
+	report    *ReadinessReport
+}
+
+// NewPreflightChecker creates a builder that can then be used to configure and create preflight
+// checkers.
+func NewPreflightChecker() *PreflightCheckerBuilder {
+	return &PreflightCheckerBuilder{}
+}
+
+// SetLogger sets the logger that the checker will use to write log messages. This is mandatory.
+func (b *PreflightCheckerBuilder) SetLogger(value logr.Logger) *PreflightCheckerBuilder {
+	b.logger = value
+	return b
+}
+
+// SetClient sets the Kubernetes API client that the checker will use to read the cluster objects.
+// Note that it needs to read objects from namespaces other than the namespace of the tool, so it
+// should be a client that doesn't use a cache restricted to that namespace. This is mandatory.
+func (b *PreflightCheckerBuilder) SetClient(value clnt.Reader) *PreflightCheckerBuilder {
+	b.client = value
+	return b
+}
+
+// SetConfig sets the configuration used to connect to the API server, which is used to check the
+// expiration of its certificate. This is optional, and when it isn't set that check only produces
+// a warning.
+func (b *PreflightCheckerBuilder) SetConfig(value *rest.Config) *PreflightCheckerBuilder {
+	b.config = value
+	return b
+}
+
+// SetDiskSpace sets the minimum allocatable ephemeral storage that the nodes need. This is
+// optional, and the default is zero, which means that only the disk pressure condition of the
+// nodes is checked.
+func (b *PreflightCheckerBuilder) SetDiskSpace(value resource.Quantity) *PreflightCheckerBuilder {
+	b.diskSpace = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new preflight checker.
+func (b *PreflightCheckerBuilder) Build() (result *PreflightChecker, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+	if b.client == nil {
+		err = errors.New("client is mandatory")
+		return
+	}
+	if b.diskSpace.Sign() < 0 {
+		err = fmt.Errorf(
+			"disk space '%s' isn't valid, it must be greater than or equal to zero",
+			b.diskSpace.String(),
+		)
+		return
+	}
+
+	// Create and populate the object:
+	result = &PreflightChecker{
+		logger:    b.logger,
+		client:    b.client,
+		config:    b.config,
+		diskSpace: b.diskSpace,
+	}
+	return
+}
+
+// Run executes all the checks and returns the report. Note that failed checks aren't reported as
+// errors, they are reported in the report. Errors are returned only when the checks can't be
+// executed at all, for example when the API server isn't reachable.
+func (c *PreflightChecker) Run(ctx context.Context) (result *ReadinessReport, err error) {
+	task := &preflightCheckTask{
+		logger:    c.logger,
+		client:    c.client,
+		config:    c.config,
+		diskSpace: c.diskSpace,
+		report:    &ReadinessReport{},
+	}
+	err = task.execute(ctx)
+	if err != nil {
+		return
+	}
+	result = task.report
+	return
+}
+
+func (t *preflightCheckTask) execute(ctx context.Context) error {
+	// Fetch the nodes:
+	nodeList := &corev1.NodeList{}
+	err := t.client.List(ctx, nodeList)
+	if err != nil {
+		return err
+	}
+	t.nodes = nodeList.Items
+
+	// Run the checks:
+	err = t.checkClusterOperators(ctx)
+	if err != nil {
+		return err
+	}
+	err = t.checkEtcdQuorum(ctx)
+	if err != nil {
+		return err
+	}
+	t.checkNodesReady()
+	t.checkNodesDisk()
+	t.checkAPICertificate(ctx)
+
+	// Calculate the verdict:
+	t.report.Verdict = ReadinessGo
+	for _, check := range t.report.Checks {
+		if check.Status == ReadinessFail {
+			t.report.Verdict = ReadinessNoGo
+			break
+		}
+	}
+	t.logger.Info(
+		"Executed preflight checks",
+		"verdict", t.report.Verdict,
+		"checks", len(t.report.Checks),
+	)
+	return nil
+}
+
+func (t *preflightCheckTask) checkClusterOperators(ctx context.Context) error {
+	const name = "cluster-operators"
+	list := &configv1.ClusterOperatorList{}
+	err := t.client.List(ctx, list)
+	if meta.IsNoMatchError(err) || apierrors.IsNotFound(err) {
+		t.add(name, ReadinessWarn, "Cluster operators aren't supported by the cluster")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for _, operator := range list.Items {
+		available := false
+		degraded := false
+		for _, condition := range operator.Status.Conditions {
+			switch condition.Type {
+			case configv1.OperatorAvailable:
+				available = condition.Status == configv1.ConditionTrue
+			case configv1.OperatorDegraded:
+				degraded = condition.Status == configv1.ConditionTrue
+			}
+		}
+		if !available {
+			problems = append(problems, fmt.Sprintf("'%s' isn't available", operator.Name))
+		}
+		if degraded {
+			problems = append(problems, fmt.Sprintf("'%s' is degraded", operator.Name))
+		}
+	}
+	if len(problems) > 0 {
+		t.add(
+			name, ReadinessFail,
+			"Cluster operators aren't healthy: %s",
+			strings.Join(problems, ", "),
+		)
+		return nil
+	}
+	t.add(
+		name, ReadinessPass,
+		"All the %d cluster operators are available and not degraded",
+		len(list.Items),
+	)
+	return nil
+}
+
+// checkEtcdQuorum checks that all the etcd members are ready. Losing one member doesn't lose the
+// quorum, but the upgrade reboots the control plane nodes one after the other, so if a member
+// is already missing the reboot of another one would.
+func (t *preflightCheckTask) checkEtcdQuorum(ctx context.Context) error {
+	const name = "etcd-quorum"
+	list := &corev1.PodList{}
+	err := t.client.List(
+		ctx, list,
+		clnt.InNamespace(preflightEtcdNamespace),
+		clnt.MatchingLabels{
+			preflightEtcdLabel: preflightEtcdValue,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if len(list.Items) == 0 {
+		t.add(
+			name, ReadinessWarn,
+			"There are no etcd pods in namespace '%s', quorum can't be checked",
+			preflightEtcdNamespace,
+		)
+		return nil
+	}
+	var notReady []string
+	for _, pod := range list.Items {
+		ready := false
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodReady {
+				ready = condition.Status == corev1.ConditionTrue
+				break
+			}
+		}
+		if !ready {
+			notReady = append(notReady, pod.Name)
+		}
+	}
+	if len(notReady) > 0 {
+		t.add(
+			name, ReadinessFail,
+			"Etcd members %s of %d aren't ready, rebooting control plane nodes could "+
+				"lose the quorum",
+			strings.Join(notReady, ", "), len(list.Items),
+		)
+		return nil
+	}
+	t.add(name, ReadinessPass, "All the %d etcd members are ready", len(list.Items))
+	return nil
+}
+
+func (t *preflightCheckTask) checkNodesReady() {
+	const name = "nodes-ready"
+	if len(t.nodes) == 0 {
+		t.add(name, ReadinessFail, "There are no nodes")
+		return
+	}
+	var notReady []string
+	for _, node := range t.nodes {
+		if !t.nodeCondition(&node, corev1.NodeReady) {
+			notReady = append(notReady, node.Name)
+		}
+	}
+	if len(notReady) > 0 {
+		t.add(name, ReadinessFail, "Nodes %s aren't ready", strings.Join(notReady, ", "))
+		return
+	}
+	t.add(name, ReadinessPass, "All the %d nodes are ready", len(t.nodes))
+}
+
+func (t *preflightCheckTask) checkNodesDisk() {
+	const name = "nodes-disk"
+	var problems []string
+	for _, node := range t.nodes {
+		if t.nodeCondition(&node, corev1.NodeDiskPressure) {
+			problems = append(problems, fmt.Sprintf("'%s' has disk pressure", node.Name))
+			continue
+		}
+		if t.diskSpace.IsZero() {
+			continue
+		}
+		storage, ok := node.Status.Allocatable[corev1.ResourceEphemeralStorage]
+		if ok && storage.Cmp(t.diskSpace) < 0 {
+			problems = append(problems, fmt.Sprintf(
+				"'%s' has only %s of ephemeral storage",
+				node.Name, storage.String(),
+			))
+		}
+	}
+	if len(problems) > 0 {
+		t.add(
+			name, ReadinessFail,
+			"Nodes don't have enough disk space: %s",
+			strings.Join(problems, ", "),
+		)
+		return
+	}
+	t.add(name, ReadinessPass, "All the %d nodes have enough disk space", len(t.nodes))
+}
+
+// checkAPICertificate connects to the API server and checks that its certificate isn't expired
+// and that it will not expire during the upgrade. A certificate that is about to expire usually
+// means that the automatic rotation isn't working.
+func (t *preflightCheckTask) checkAPICertificate(ctx context.Context) {
+	const name = "api-certificate"
+	if t.config == nil {
+		t.add(name, ReadinessWarn, "API server configuration isn't available")
+		return
+	}
+	address, err := t.apiAddress()
+	if err != nil {
+		t.add(name, ReadinessWarn, "API server address isn't valid: %v", err)
+		return
+	}
+	if address == "" {
+		t.add(name, ReadinessWarn, "API server doesn't use TLS")
+		return
+	}
+
+	// Note that verification is disabled because the only purpose of this connection is to
+	// retrieve the certificate, and if it has already expired verification would fail. Nothing
+	// is sent using this connection.
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{
+			Timeout: preflightDialTimeout,
+		},
+		Config: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		t.add(name, ReadinessWarn, "Failed to connect to API server '%s': %v", address, err)
+		return
+	}
+	defer conn.Close()
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		t.add(name, ReadinessWarn, "API server '%s' didn't send a certificate", address)
+		return
+	}
+	expiry := certs[0].NotAfter
+	remaining := time.Until(expiry)
+	switch {
+	case remaining <= 0:
+		t.add(
+			name, ReadinessFail,
+			"Certificate of API server '%s' expired at %s",
+			address, expiry.UTC().Format(time.RFC3339),
+		)
+	case remaining < preflightCertificateMargin:
+		t.add(
+			name, ReadinessFail,
+			"Certificate of API server '%s' expires at %s, in less than %s",
+			address, expiry.UTC().Format(time.RFC3339), preflightCertificateMargin,
+		)
+	default:
+		t.add(
+			name, ReadinessPass,
+			"Certificate of API server '%s' expires at %s",
+			address, expiry.UTC().Format(time.RFC3339),
+		)
+	}
+}
+
+// apiAddress returns the host and port of the API server, or an empty string if it doesn't use
+// TLS.
+func (t *preflightCheckTask) apiAddress() (result string, err error) {
+	host := t.config.Host
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	parsed, err := url.Parse(host)
+	if err != nil {
+		return
+	}
+	if parsed.Scheme != "https" {
+		return
+	}
+	result = parsed.Host
+	if parsed.Port() == "" {
+		result = net.JoinHostPort(parsed.Hostname(), "443")
+	}
+	return
+}
+
+func (t *preflightCheckTask) nodeCondition(node *corev1.Node,
+	kind corev1.NodeConditionType) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == kind {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func (t *preflightCheckTask) add(name, status, format string, args ...any) {
+	check := ReadinessCheck{
+		Name:    name,
+		Status:  status,
+		Message: fmt.Sprintf(format, args...),
+	}
+	t.report.Checks = append(t.report.Checks, check)
+	t.logger.V(1).Info(
+		"Executed preflight check",
+		"name", check.Name,
+		"status", check.Status,
+		"message", check.Message,
+	)
+}
+
+// preflightEtcdNamespace is the namespace where the etcd pods run, and preflightEtcdLabel and
+// preflightEtcdValue are the label and value that identify them.
+const (
+	preflightEtcdNamespace = "openshift-etcd"
+	preflightEtcdLabel     = "app"
+	preflightEtcdValue     = "etcd"
+)
+
+// preflightCertificateMargin is the minimum time that the certificate of the API server needs to
+// be valid to start the upgrade.
+const preflightCertificateMargin = 24 * time.Hour
+
+// preflightDialTimeout is the maximum time to wait for the connection to the API server.
+const preflightDialTimeout = 10 * time.Second
@@ -0,0 +1,306 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Preflight checker", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	makeOperator := func(name string, available, degraded bool) *configv1.ClusterOperator {
+		status := func(value bool) configv1.ConditionStatus {
+			if value {
+				return configv1.ConditionTrue
+			}
+			return configv1.ConditionFalse
+		}
+		return &configv1.ClusterOperator{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+			},
+			Status: configv1.ClusterOperatorStatus{
+				Conditions: []configv1.ClusterOperatorStatusCondition{
+					{
+						Type:   configv1.OperatorAvailable,
+						Status: status(available),
+					},
+					{
+						Type:   configv1.OperatorDegraded,
+						Status: status(degraded),
+					},
+				},
+			},
+		}
+	}
+
+	makeEtcd := func(name string, ready bool) *corev1.Pod {
+		status := corev1.ConditionFalse
+		if ready {
+			status = corev1.ConditionTrue
+		}
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: preflightEtcdNamespace,
+				Name:      name,
+				Labels: map[string]string{
+					preflightEtcdLabel: preflightEtcdValue,
+				},
+			},
+			Status: corev1.PodStatus{
+				Conditions: []corev1.PodCondition{{
+					Type:   corev1.PodReady,
+					Status: status,
+				}},
+			},
+		}
+	}
+
+	makeNode := func(name string, conditions ...corev1.NodeCondition) *corev1.Node {
+		if len(conditions) == 0 {
+			conditions = []corev1.NodeCondition{{
+				Type:   corev1.NodeReady,
+				Status: corev1.ConditionTrue,
+			}}
+		}
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+			},
+			Status: corev1.NodeStatus{
+				Conditions: conditions,
+				Allocatable: corev1.ResourceList{
+					corev1.ResourceEphemeralStorage: resource.MustParse("100Gi"),
+				},
+			},
+		}
+	}
+
+	// makeHealthy returns the objects of a healthy cluster.
+	makeHealthy := func() []clnt.Object {
+		return []clnt.Object{
+			makeOperator("etcd", true, false),
+			makeOperator("kube-apiserver", true, false),
+			makeEtcd("etcd-master0", true),
+			makeEtcd("etcd-master1", true),
+			makeEtcd("etcd-master2", true),
+			makeNode("node0"),
+			makeNode("node1"),
+		}
+	}
+
+	runWith := func(config *rest.Config, diskSpace string, objects ...clnt.Object) *ReadinessReport {
+		client := fake.NewClientBuilder().
+			WithScheme(snapshotScheme()).
+			WithObjects(objects...).
+			Build()
+		checker, err := NewPreflightChecker().
+			SetLogger(logger).
+			SetClient(client).
+			SetConfig(config).
+			SetDiskSpace(resource.MustParse(diskSpace)).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		report, err := checker.Run(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		return report
+	}
+
+	run := func(objects ...clnt.Object) *ReadinessReport {
+		return runWith(nil, "0", objects...)
+	}
+
+	findCheck := func(report *ReadinessReport, name string) ReadinessCheck {
+		for _, check := range report.Checks {
+			if check.Name == name {
+				return check
+			}
+		}
+		Fail("check '" + name + "' not found")
+		return ReadinessCheck{}
+	}
+
+	// startServer starts a TLS server that uses a certificate that is valid for the given time.
+	startServer := func(validity time.Duration) *httptest.Server {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		now := time.Now()
+		spec := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject: pkix.Name{
+				CommonName: "localhost",
+			},
+			NotBefore: now.Add(-time.Hour),
+			NotAfter:  now.Add(validity),
+		}
+		cert, err := x509.CreateCertificate(rand.Reader, spec, spec, key.Public(), key)
+		Expect(err).ToNot(HaveOccurred())
+		server := httptest.NewUnstartedServer(http.NotFoundHandler())
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{cert},
+				PrivateKey:  key,
+			}},
+		}
+		server.StartTLS()
+		DeferCleanup(server.Close)
+		return server
+	}
+
+	It("Can't be created without a client", func() {
+		checker, err := NewPreflightChecker().
+			SetLogger(logger).
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("client"))
+		Expect(checker).To(BeNil())
+	})
+
+	It("Says go when the cluster is healthy", func() {
+		report := run(makeHealthy()...)
+		Expect(report.Verdict).To(Equal(ReadinessGo))
+		Expect(findCheck(report, "cluster-operators").Status).To(Equal(ReadinessPass))
+		Expect(findCheck(report, "etcd-quorum").Status).To(Equal(ReadinessPass))
+		Expect(findCheck(report, "nodes-ready").Status).To(Equal(ReadinessPass))
+		Expect(findCheck(report, "nodes-disk").Status).To(Equal(ReadinessPass))
+		Expect(findCheck(report, "api-certificate").Status).To(Equal(ReadinessWarn))
+	})
+
+	It("Says no-go when a cluster operator is degraded", func() {
+		objects := append(makeHealthy(), makeOperator("network", true, true))
+		report := run(objects...)
+		Expect(report.Verdict).To(Equal(ReadinessNoGo))
+		check := findCheck(report, "cluster-operators")
+		Expect(check.Status).To(Equal(ReadinessFail))
+		Expect(check.Message).To(ContainSubstring("'network' is degraded"))
+	})
+
+	It("Says no-go when an etcd member isn't ready", func() {
+		objects := append(makeHealthy(), makeEtcd("etcd-master3", false))
+		report := run(objects...)
+		Expect(report.Verdict).To(Equal(ReadinessNoGo))
+		check := findCheck(report, "etcd-quorum")
+		Expect(check.Status).To(Equal(ReadinessFail))
+		Expect(check.Message).To(ContainSubstring("etcd-master3"))
+	})
+
+	It("Warns when there are no etcd pods", func() {
+		report := run(makeNode("node0"))
+		Expect(report.Verdict).To(Equal(ReadinessGo))
+		Expect(findCheck(report, "etcd-quorum").Status).To(Equal(ReadinessWarn))
+	})
+
+	It("Says no-go when a node isn't ready", func() {
+		objects := append(makeHealthy(), makeNode("node2", corev1.NodeCondition{
+			Type:   corev1.NodeReady,
+			Status: corev1.ConditionFalse,
+		}))
+		report := run(objects...)
+		Expect(report.Verdict).To(Equal(ReadinessNoGo))
+		check := findCheck(report, "nodes-ready")
+		Expect(check.Status).To(Equal(ReadinessFail))
+		Expect(check.Message).To(Equal("Nodes node2 aren't ready"))
+	})
+
+	It("Says no-go when a node has disk pressure", func() {
+		objects := append(makeHealthy(), makeNode(
+			"node2",
+			corev1.NodeCondition{
+				Type:   corev1.NodeReady,
+				Status: corev1.ConditionTrue,
+			},
+			corev1.NodeCondition{
+				Type:   corev1.NodeDiskPressure,
+				Status: corev1.ConditionTrue,
+			},
+		))
+		report := run(objects...)
+		Expect(report.Verdict).To(Equal(ReadinessNoGo))
+		check := findCheck(report, "nodes-disk")
+		Expect(check.Status).To(Equal(ReadinessFail))
+		Expect(check.Message).To(ContainSubstring("'node2' has disk pressure"))
+	})
+
+	It("Says no-go when nodes don't have the minimum disk space", func() {
+		report := runWith(nil, "200Gi", makeHealthy()...)
+		Expect(report.Verdict).To(Equal(ReadinessNoGo))
+		check := findCheck(report, "nodes-disk")
+		Expect(check.Status).To(Equal(ReadinessFail))
+		Expect(check.Message).To(ContainSubstring("'node0' has only 100Gi"))
+	})
+
+	It("Accepts an API server certificate that doesn't expire soon", func() {
+		server := startServer(30 * 24 * time.Hour)
+		config := &rest.Config{
+			Host: server.URL,
+		}
+		report := runWith(config, "0", makeHealthy()...)
+		Expect(report.Verdict).To(Equal(ReadinessGo))
+		Expect(findCheck(report, "api-certificate").Status).To(Equal(ReadinessPass))
+	})
+
+	It("Says no-go when the API server certificate is about to expire", func() {
+		server := startServer(time.Hour)
+		config := &rest.Config{
+			Host: server.URL,
+		}
+		report := runWith(config, "0", makeHealthy()...)
+		Expect(report.Verdict).To(Equal(ReadinessNoGo))
+		check := findCheck(report, "api-certificate")
+		Expect(check.Status).To(Equal(ReadinessFail))
+		Expect(check.Message).To(ContainSubstring("in less than 24h0m0s"))
+	})
+})
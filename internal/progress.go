@@ -0,0 +1,40 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+// ProgressDetails is the machine readable description of the progress of the programs that run in
+// the nodes. It is serialized to JSON and stored in the progress details annotation of the node.
+type ProgressDetails struct {
+	// Phase is the current phase, for example 'downloading' or 'extracting'.
+	Phase string `json:"phase"`
+
+	// Bytes is the number of bytes processed so far.
+	Bytes int64 `json:"bytes"`
+
+	// Total is the total number of bytes that will be processed. Zero means that it isn't known.
+	Total int64 `json:"total,omitempty"`
+
+	// Percent is the percentage of the total already processed. It is only meaningful when the
+	// total is known.
+	Percent int `json:"percent,omitempty"`
+}
+
+// Phases of the progress:
+const (
+	ProgressPhaseDownloading = "downloading"
+	ProgressPhaseExtracting  = "extracting"
+	ProgressPhaseFinished    = "finished"
+	ProgressPhaseFailed      = "failed"
+)
@@ -0,0 +1,478 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// ProvenanceStatement is an in-toto statement containing a SLSA provenance predicate. It describes
+// how a bundle was created: the tool that created it, the release it was created from and the
+// digests of the images and metadata that it contains.
+type ProvenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []ProvenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     ProvenancePredicate `json:"predicate"`
+}
+
+// ProvenanceSubject is one of the artifacts described by the provenance statement.
+type ProvenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// ProvenancePredicate is the SLSA provenance predicate.
+type ProvenancePredicate struct {
+	BuildDefinition ProvenanceBuildDefinition `json:"buildDefinition"`
+	RunDetails      ProvenanceRunDetails      `json:"runDetails"`
+}
+
+// ProvenanceBuildDefinition describes the inputs that were used to create the bundle.
+type ProvenanceBuildDefinition struct {
+	BuildType            string                         `json:"buildType"`
+	ExternalParameters   map[string]any                 `json:"externalParameters"`
+	ResolvedDependencies []ProvenanceResourceDescriptor `json:"resolvedDependencies,omitempty"`
+}
+
+// ProvenanceResourceDescriptor describes an artifact that was used to create the bundle.
+type ProvenanceResourceDescriptor struct {
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// ProvenanceRunDetails describes the tool that created the bundle and when it did it.
+type ProvenanceRunDetails struct {
+	Builder  ProvenanceBuilder     `json:"builder"`
+	Metadata ProvenanceRunMetadata `json:"metadata"`
+}
+
+// ProvenanceBuilder identifies the entity that created the bundle.
+type ProvenanceBuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+// ProvenanceRunMetadata contains the start and finish times of the creation of the bundle.
+type ProvenanceRunMetadata struct {
+	StartedOn  *time.Time `json:"startedOn,omitempty"`
+	FinishedOn *time.Time `json:"finishedOn,omitempty"`
+}
+
+// FindSubject returns the subject with the given name, or nil if there is no such subject.
+func (s *ProvenanceStatement) FindSubject(name string) *ProvenanceSubject {
+	for i := range s.Subject {
+		if s.Subject[i].Name == name {
+			return &s.Subject[i]
+		}
+	}
+	return nil
+}
+
+// provenanceEnvelope is the DSSE envelope used to sign the provenance statement. Note that the
+// payload and the signatures are byte slices, so the JSON encoder will automatically encode them
+// using base64 as required by the DSSE specification.
+type provenanceEnvelope struct {
+	PayloadType string                `json:"payloadType"`
+	Payload     []byte                `json:"payload"`
+	Signatures  []provenanceSignature `json:"signatures"`
+}
+
+type provenanceSignature struct {
+	KeyID string `json:"keyid,omitempty"`
+	Sig   []byte `json:"sig"`
+}
+
+// ProvenanceSignerBuilder contains the data and logic needed to create a provenance signer. Don't
+// create instances of this type directly, use the NewProvenanceSigner function instead.
+type ProvenanceSignerBuilder struct {
+	logger logr.Logger
+	key    string
+}
+
+// ProvenanceSigner knows how to sign a provenance statement and wrap it in a DSSE envelope. Don't
+// create instances of this type directly, use the NewProvenanceSigner function instead.
+type ProvenanceSigner struct {
+	logger logr.Logger
+	key    crypto.Signer
+	keyID  string
+}
+
+// NewProvenanceSigner creates a builder that can then be used to configure and create provenance
+// signers.
+func NewProvenanceSigner() *ProvenanceSignerBuilder {
+	return &ProvenanceSignerBuilder{}
+}
+
+// SetLogger sets the logger that the signer will use to write log messages. This is mandatory.
+func (b *ProvenanceSignerBuilder) SetLogger(value logr.Logger) *ProvenanceSignerBuilder {
+	b.logger = value
+	return b
+}
+
+// SetKey sets the name of the PEM file containing the private key that will be used to sign the
+// statements. ECDSA, Ed25519 and RSA keys are supported. This is mandatory.
+func (b *ProvenanceSignerBuilder) SetKey(value string) *ProvenanceSignerBuilder {
+	b.key = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new provenance signer.
+func (b *ProvenanceSignerBuilder) Build() (result *ProvenanceSigner, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+	if b.key == "" {
+		err = errors.New("key is mandatory")
+		return
+	}
+
+	// Load the key:
+	key, err := b.loadKey()
+	if err != nil {
+		err = fmt.Errorf("failed to load signing key from file '%s': %w", b.key, err)
+		return
+	}
+	keyID, err := provenanceKeyID(key.Public())
+	if err != nil {
+		return
+	}
+
+	// Create and populate the object:
+	result = &ProvenanceSigner{
+		logger: b.logger,
+		key:    key,
+		keyID:  keyID,
+	}
+	return
+}
+
+func (b *ProvenanceSignerBuilder) loadKey() (result crypto.Signer, err error) {
+	data, err := os.ReadFile(b.key)
+	if err != nil {
+		return
+	}
+	result, err = parsePrivateKey(data)
+	return
+}
+
+// parsePrivateKey parses a private key in PEM format, supporting PKCS#8, EC and PKCS#1 blocks.
+func parsePrivateKey(data []byte) (result crypto.Signer, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		err = errors.New("file doesn't contain a PEM block")
+		return
+	}
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("PEM block type '%s' isn't supported", block.Type)
+	}
+	if err != nil {
+		return
+	}
+	result, ok := key.(crypto.Signer)
+	if !ok {
+		err = fmt.Errorf("key of type %T can't be used to sign", key)
+	}
+	return
+}
+
+// KeyID returns the identifier of the key, calculated as the SHA-256 digest of the DER encoding of
+// the public key.
+func (s *ProvenanceSigner) KeyID() string {
+	return s.keyID
+}
+
+// Sign serializes the given statement, signs it and returns the JSON representation of the DSSE
+// envelope.
+func (s *ProvenanceSigner) Sign(statement *ProvenanceStatement) (result []byte, err error) {
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return
+	}
+	message := provenancePAE(provenancePayloadType, payload)
+	var sig []byte
+	switch s.key.(type) {
+	case ed25519.PrivateKey:
+		sig, err = s.key.Sign(rand.Reader, message, crypto.Hash(0))
+	default:
+		digest := sha256.Sum256(message)
+		sig, err = s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return
+	}
+	envelope := &provenanceEnvelope{
+		PayloadType: provenancePayloadType,
+		Payload:     payload,
+		Signatures: []provenanceSignature{{
+			KeyID: s.keyID,
+			Sig:   sig,
+		}},
+	}
+	result, err = json.MarshalIndent(envelope, "", "  ")
+	if err != nil {
+		return
+	}
+	s.logger.V(1).Info(
+		"Signed provenance statement",
+		"key", s.keyID,
+		"subjects", len(statement.Subject),
+	)
+	return
+}
+
+// ProvenanceVerifierBuilder contains the data and logic needed to create a provenance verifier.
+// Don't create instances of this type directly, use the NewProvenanceVerifier function instead.
+type ProvenanceVerifierBuilder struct {
+	logger logr.Logger
+	key    string
+}
+
+// ProvenanceVerifier knows how to check the signature of a DSSE envelope containing a provenance
+// statement. Don't create instances of this type directly, use the NewProvenanceVerifier function
+// instead.
+type ProvenanceVerifier struct {
+	logger logr.Logger
+	key    crypto.PublicKey
+	keyID  string
+}
+
+// NewProvenanceVerifier creates a builder that can then be used to configure and create provenance
+// verifiers.
+func NewProvenanceVerifier() *ProvenanceVerifierBuilder {
+	return &ProvenanceVerifierBuilder{}
+}
+
+// SetLogger sets the logger that the verifier will use to write log messages. This is mandatory.
+func (b *ProvenanceVerifierBuilder) SetLogger(value logr.Logger) *ProvenanceVerifierBuilder {
+	b.logger = value
+	return b
+}
+
+// SetKey sets the name of the PEM file containing the public key that will be used to check the
+// signatures. This is mandatory.
+func (b *ProvenanceVerifierBuilder) SetKey(value string) *ProvenanceVerifierBuilder {
+	b.key = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new provenance verifier.
+func (b *ProvenanceVerifierBuilder) Build() (result *ProvenanceVerifier, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+	if b.key == "" {
+		err = errors.New("key is mandatory")
+		return
+	}
+
+	// Load the key:
+	key, err := b.loadKey()
+	if err != nil {
+		err = fmt.Errorf("failed to load verification key from file '%s': %w", b.key, err)
+		return
+	}
+	keyID, err := provenanceKeyID(key)
+	if err != nil {
+		return
+	}
+
+	// Create and populate the object:
+	result = &ProvenanceVerifier{
+		logger: b.logger,
+		key:    key,
+		keyID:  keyID,
+	}
+	return
+}
+
+func (b *ProvenanceVerifierBuilder) loadKey() (result crypto.PublicKey, err error) {
+	data, err := os.ReadFile(b.key)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		err = errors.New("file doesn't contain a PEM block")
+		return
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		result, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			result = cert.PublicKey
+		}
+	default:
+		err = fmt.Errorf("PEM block type '%s' isn't supported", block.Type)
+	}
+	return
+}
+
+// Verify checks that the given DSSE envelope has been signed with the key of the verifier and
+// returns the provenance statement that it contains.
+func (v *ProvenanceVerifier) Verify(data []byte) (result *ProvenanceStatement, err error) {
+	// Parse the envelope:
+	var envelope provenanceEnvelope
+	err = json.Unmarshal(data, &envelope)
+	if err != nil {
+		err = fmt.Errorf("failed to parse envelope: %w", err)
+		return
+	}
+	if envelope.PayloadType != provenancePayloadType {
+		err = fmt.Errorf(
+			"payload type '%s' isn't supported, it should be '%s'",
+			envelope.PayloadType, provenancePayloadType,
+		)
+		return
+	}
+
+	// Check that at least one of the signatures is valid:
+	message := provenancePAE(envelope.PayloadType, envelope.Payload)
+	verified := false
+	for _, signature := range envelope.Signatures {
+		if v.verifySignature(message, signature.Sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		err = fmt.Errorf(
+			"envelope doesn't contain a valid signature for key '%s'",
+			v.keyID,
+		)
+		return
+	}
+
+	// Parse the statement:
+	err = json.Unmarshal(envelope.Payload, &result)
+	if err != nil {
+		err = fmt.Errorf("failed to parse statement: %w", err)
+		return
+	}
+	if result.Type != provenanceStatementType {
+		err = fmt.Errorf(
+			"statement type '%s' isn't supported, it should be '%s'",
+			result.Type, provenanceStatementType,
+		)
+		return
+	}
+	if result.PredicateType != provenancePredicateType {
+		err = fmt.Errorf(
+			"predicate type '%s' isn't supported, it should be '%s'",
+			result.PredicateType, provenancePredicateType,
+		)
+		return
+	}
+	v.logger.V(1).Info(
+		"Verified provenance statement",
+		"key", v.keyID,
+		"subjects", len(result.Subject),
+	)
+	return
+}
+
+func (v *ProvenanceVerifier) verifySignature(message, sig []byte) bool {
+	digest := sha256.Sum256(message)
+	switch key := v.key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	default:
+		return false
+	}
+}
+
+// provenancePAE calculates the pre-authentication encoding of the payload, as described in the
+// DSSE specification. This is what is actually signed.
+func provenancePAE(payloadType string, payload []byte) []byte {
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))
+	buffer.Write(payload)
+	return buffer.Bytes()
+}
+
+func provenanceKeyID(key crypto.PublicKey) (result string, err error) {
+	data, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(data)
+	result = hex.EncodeToString(sum[:])
+	return
+}
+
+// provenanceToolVersion returns the version of the tool, calculated from the build information.
+func provenanceToolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && setting.Value != "" {
+			return setting.Value
+		}
+	}
+	if info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// Types used in the provenance statements and envelopes:
+const (
+	provenancePayloadType   = "application/vnd.in-toto+json"
+	provenanceStatementType = "https://in-toto.io/Statement/v1"
+	provenancePredicateType = "https://slsa.dev/provenance/v1"
+	provenanceBuildType     = "https://github.com/jhernand/upgrade-tool/bundle/v1"
+)
+
+// provenanceFile is the name of the file inside the bundle that contains the signed provenance
+// statement.
+const provenanceFile = "provenance.json"
@@ -0,0 +1,205 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/ginkgo/v2/dsl/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Provenance", func() {
+	var (
+		logger    logr.Logger
+		dir       string
+		statement *ProvenanceStatement
+	)
+
+	// writeKeys writes the private and public parts of the given key to PEM files and returns
+	// their names.
+	writeKeys := func(key crypto.Signer) (private, public string) {
+		privateDER, err := x509.MarshalPKCS8PrivateKey(key)
+		Expect(err).ToNot(HaveOccurred())
+		publicDER, err := x509.MarshalPKIXPublicKey(key.Public())
+		Expect(err).ToNot(HaveOccurred())
+		private = filepath.Join(dir, "private.pem")
+		public = filepath.Join(dir, "public.pem")
+		err = os.WriteFile(private, pem.EncodeToMemory(&pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: privateDER,
+		}), 0600)
+		Expect(err).ToNot(HaveOccurred())
+		err = os.WriteFile(public, pem.EncodeToMemory(&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: publicDER,
+		}), 0644)
+		Expect(err).ToNot(HaveOccurred())
+		return
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create the keys directory and the statement:
+		dir = GinkgoT().TempDir()
+		statement = &ProvenanceStatement{
+			Type: provenanceStatementType,
+			Subject: []ProvenanceSubject{{
+				Name: "metadata.json",
+				Digest: map[string]string{
+					"sha256": "0123456789abcdef",
+				},
+			}},
+			PredicateType: provenancePredicateType,
+			Predicate: ProvenancePredicate{
+				BuildDefinition: ProvenanceBuildDefinition{
+					BuildType: provenanceBuildType,
+				},
+				RunDetails: ProvenanceRunDetails{
+					Builder: ProvenanceBuilder{
+						ID: "my-builder",
+					},
+				},
+			},
+		}
+	})
+
+	DescribeTable(
+		"Verifies what it signs",
+		func(generate func() crypto.Signer) {
+			private, public := writeKeys(generate())
+			signer, err := NewProvenanceSigner().
+				SetLogger(logger).
+				SetKey(private).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			verifier, err := NewProvenanceVerifier().
+				SetLogger(logger).
+				SetKey(public).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			envelope, err := signer.Sign(statement)
+			Expect(err).ToNot(HaveOccurred())
+			result, err := verifier.Verify(envelope)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(statement))
+			Expect(result.FindSubject("metadata.json")).ToNot(BeNil())
+			Expect(result.FindSubject("junk")).To(BeNil())
+		},
+		Entry(
+			"ECDSA",
+			func() crypto.Signer {
+				key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				Expect(err).ToNot(HaveOccurred())
+				return key
+			},
+		),
+		Entry(
+			"Ed25519",
+			func() crypto.Signer {
+				_, key, err := ed25519.GenerateKey(rand.Reader)
+				Expect(err).ToNot(HaveOccurred())
+				return key
+			},
+		),
+		Entry(
+			"RSA",
+			func() crypto.Signer {
+				key, err := rsa.GenerateKey(rand.Reader, 2048)
+				Expect(err).ToNot(HaveOccurred())
+				return key
+			},
+		),
+	)
+
+	It("Rejects modified payload", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		private, public := writeKeys(key)
+		signer, err := NewProvenanceSigner().
+			SetLogger(logger).
+			SetKey(private).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		verifier, err := NewProvenanceVerifier().
+			SetLogger(logger).
+			SetKey(public).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		data, err := signer.Sign(statement)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Replace the digest of the subject and put the modified statement back into the
+		// envelope:
+		var envelope provenanceEnvelope
+		err = json.Unmarshal(data, &envelope)
+		Expect(err).ToNot(HaveOccurred())
+		statement.Subject[0].Digest["sha256"] = "fedcba9876543210"
+		envelope.Payload, err = json.Marshal(statement)
+		Expect(err).ToNot(HaveOccurred())
+		data, err = json.Marshal(envelope)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = verifier.Verify(data)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("valid signature"))
+	})
+
+	It("Rejects signature from other key", func() {
+		signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		private, _ := writeKeys(signingKey)
+		signer, err := NewProvenanceSigner().
+			SetLogger(logger).
+			SetKey(private).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		data, err := signer.Sign(statement)
+		Expect(err).ToNot(HaveOccurred())
+
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		_, public := writeKeys(otherKey)
+		verifier, err := NewProvenanceVerifier().
+			SetLogger(logger).
+			SetKey(public).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = verifier.Verify(data)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,100 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/exp/slices"
+)
+
+// Names of the supported strategies to decide the order of image pulls:
+const (
+	// PullOrderDefault pulls the images in the order they appear in the bundle metadata.
+	PullOrderDefault = "default"
+
+	// PullOrderSize pulls the largest images first.
+	PullOrderSize = "size"
+
+	// PullOrderPriority pulls first the images whose names appear in the priority list, in the
+	// order of that list.
+	PullOrderPriority = "priority"
+)
+
+// PullOrders returns the names of the supported pull order strategies.
+func PullOrders() []string {
+	return []string{
+		PullOrderDefault,
+		PullOrderSize,
+		PullOrderPriority,
+	}
+}
+
+// DefaultPullPriority is the list of image names used by the priority strategy when no explicit
+// list is given. These are the images that are needed first when the nodes are updated.
+var DefaultPullPriority = []string{
+	"rhel-coreos",
+	"rhel-coreos-8",
+	"machine-os-content",
+	"machine-config-operator",
+	"etcd",
+	"hyperkube",
+}
+
+// SortPulls returns a copy of the given image references sorted according to the given strategy.
+// The sizes are indexed by image reference and are only used by the size strategy. The tags map
+// image names to image references and together with the priority list of image names are only used
+// by the priority strategy. Images that have the same size or priority keep their original order.
+func SortPulls(order string, refs []string, sizes map[string]int64, tags map[string]string,
+	priority []string) (result []string, err error) {
+	result = slices.Clone(refs)
+	switch order {
+	case "", PullOrderDefault:
+	case PullOrderSize:
+		sort.SliceStable(result, func(i, j int) bool {
+			return sizes[result[i]] > sizes[result[j]]
+		})
+	case PullOrderPriority:
+		ranks := map[string]int{}
+		for name, ref := range tags {
+			rank := slices.Index(priority, name)
+			if rank == -1 {
+				continue
+			}
+			current, ok := ranks[ref]
+			if !ok || rank < current {
+				ranks[ref] = rank
+			}
+		}
+		rankOf := func(ref string) int {
+			rank, ok := ranks[ref]
+			if !ok {
+				return len(priority)
+			}
+			return rank
+		}
+		sort.SliceStable(result, func(i, j int) bool {
+			return rankOf(result[i]) < rankOf(result[j])
+		})
+	default:
+		result = nil
+		err = fmt.Errorf(
+			"pull order '%s' isn't valid, it should be one of %v",
+			order, PullOrders(),
+		)
+	}
+	return
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pull order", func() {
+	refs := []string{"a", "b", "c", "d"}
+
+	It("Preserves the order with the default strategy", func() {
+		result, err := SortPulls(PullOrderDefault, refs, nil, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(refs))
+	})
+
+	It("Sorts largest images first with the size strategy", func() {
+		sizes := map[string]int64{
+			"a": 10,
+			"b": 30,
+			"c": 20,
+			"d": 30,
+		}
+		result, err := SortPulls(PullOrderSize, refs, sizes, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal([]string{"b", "d", "c", "a"}))
+	})
+
+	It("Sorts images in the priority list first with the priority strategy", func() {
+		tags := map[string]string{
+			"etcd":       "c",
+			"hyperkube":  "d",
+			"console":    "a",
+			"other-etcd": "b",
+		}
+		priority := []string{"hyperkube", "etcd"}
+		result, err := SortPulls(PullOrderPriority, refs, nil, tags, priority)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal([]string{"d", "c", "a", "b"}))
+	})
+
+	It("Doesn't modify the input", func() {
+		input := []string{"a", "b"}
+		sizes := map[string]int64{
+			"b": 1,
+		}
+		_, err := SortPulls(PullOrderSize, input, sizes, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(input).To(Equal([]string{"a", "b"}))
+	})
+
+	It("Rejects unknown strategy", func() {
+		result, err := SortPulls("junk", refs, nil, nil, nil)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("junk"))
+		Expect(result).To(BeNil())
+	})
+})
@@ -0,0 +1,276 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/exp/slices"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// rbacPermissions describes the permissions that a component of the tool needs. Each component
+// declares them next to its code, and they are used to generate the manifests that contain the
+// service accounts, roles and role bindings, so that there is no need to grant the cluster-admin
+// role to the tool.
+type rbacPermissions struct {
+	// cluster contains the rules that are granted in all the namespaces and for the objects
+	// that aren't namespaced.
+	cluster []rbacv1.PolicyRule
+
+	// namespace contains the rules that are granted only in the namespace of the tool.
+	namespace []rbacv1.PolicyRule
+
+	// privileged indicates if the pods of the component need the privileged security context
+	// constraint, because they use the file system or the network of the host.
+	privileged bool
+
+	// binder indicates if the component creates the role bindings of the other components, so
+	// it needs permission to bind their roles.
+	binder bool
+}
+
+// rbacComponents contains the permissions of the components of the tool, indexed by the name of
+// the service account.
+var rbacComponents = map[string]*rbacPermissions{
+	controllerServiceAccount: &controllerPermissions,
+	bundleAgent:              &bundleAgentPermissions,
+	bundleCleaner:            &bundleCleanerPermissions,
+	bundleExtractor:          &bundleExtractorPermissions,
+	bundleLoader:             &bundleLoaderPermissions,
+	bundleServer:             &bundleServerPermissions,
+}
+
+// rbacObjects contains the objects that give a component the permissions that it needs. Objects
+// that aren't needed, like the roles of components without rules, are nil.
+type rbacObjects struct {
+	serviceAccount     *corev1.ServiceAccount
+	clusterRole        *rbacv1.ClusterRole
+	clusterRoleBinding *rbacv1.ClusterRoleBinding
+	role               *rbacv1.Role
+	roleBinding        *rbacv1.RoleBinding
+	privilegedBinding  *rbacv1.RoleBinding
+}
+
+// RBACManifests returns the namespace, and the service accounts, roles and role bindings of all
+// the components of the tool.
+func RBACManifests(namespace string) []clnt.Object {
+	results := []clnt.Object{
+		&corev1.Namespace{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: "v1",
+				Kind:       "Namespace",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name: namespace,
+			},
+		},
+	}
+	names := make([]string, 0, len(rbacComponents))
+	for name := range rbacComponents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		objects := rbacComponents[name].objects(namespace, name)
+		results = append(results, objects.list()...)
+	}
+	return results
+}
+
+// rbacRoleName returns the name of the cluster role and of the role that contain the permissions
+// of the given component.
+func rbacRoleName(component string) string {
+	return fmt.Sprintf("upgrade-tool:%s", component)
+}
+
+// rbacBindableRoles returns the names of the roles that the controller needs to bind to the
+// service accounts of the other components.
+func rbacBindableRoles(namespaced bool) []string {
+	var results []string
+	for name, permissions := range rbacComponents {
+		if name == controllerServiceAccount {
+			continue
+		}
+		rules := permissions.cluster
+		if namespaced {
+			rules = permissions.namespace
+		}
+		if len(rules) > 0 {
+			results = append(results, rbacRoleName(name))
+		}
+	}
+	if !namespaced {
+		results = append(results, rbacPrivilegedRole)
+	}
+	sort.Strings(results)
+	return results
+}
+
+// objects returns the objects that give the permissions to the service account with the given
+// name.
+func (p *rbacPermissions) objects(namespace, name string) *rbacObjects {
+	result := &rbacObjects{}
+	clusterRules := p.cluster
+	namespaceRules := p.namespace
+	if p.binder {
+		clusterRules = append(slices.Clip(clusterRules), rbacv1.PolicyRule{
+			APIGroups:     []string{rbacv1.GroupName},
+			Resources:     []string{"clusterroles"},
+			Verbs:         []string{"bind"},
+			ResourceNames: rbacBindableRoles(false),
+		})
+		namespaceRules = append(slices.Clip(namespaceRules), rbacv1.PolicyRule{
+			APIGroups:     []string{rbacv1.GroupName},
+			Resources:     []string{"roles"},
+			Verbs:         []string{"bind"},
+			ResourceNames: rbacBindableRoles(true),
+		})
+	}
+	subjects := []rbacv1.Subject{{
+		Kind:      rbacv1.ServiceAccountKind,
+		Namespace: namespace,
+		Name:      name,
+	}}
+	result.serviceAccount = &corev1.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ServiceAccount",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+	}
+	if len(clusterRules) > 0 {
+		result.clusterRole = &rbacv1.ClusterRole{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: rbacv1.SchemeGroupVersion.String(),
+				Kind:       "ClusterRole",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name: rbacRoleName(name),
+			},
+			Rules: clusterRules,
+		}
+		result.clusterRoleBinding = &rbacv1.ClusterRoleBinding{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: rbacv1.SchemeGroupVersion.String(),
+				Kind:       "ClusterRoleBinding",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name: fmt.Sprintf("%s-%s", namespace, name),
+			},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "ClusterRole",
+				Name:     rbacRoleName(name),
+			},
+			Subjects: subjects,
+		}
+	}
+	if len(namespaceRules) > 0 {
+		result.role = &rbacv1.Role{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: rbacv1.SchemeGroupVersion.String(),
+				Kind:       "Role",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      rbacRoleName(name),
+			},
+			Rules: namespaceRules,
+		}
+		result.roleBinding = &rbacv1.RoleBinding{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: rbacv1.SchemeGroupVersion.String(),
+				Kind:       "RoleBinding",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+			},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "Role",
+				Name:     rbacRoleName(name),
+			},
+			Subjects: subjects,
+		}
+	}
+	if p.privileged {
+		result.privilegedBinding = &rbacv1.RoleBinding{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: rbacv1.SchemeGroupVersion.String(),
+				Kind:       "RoleBinding",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      fmt.Sprintf("%s-privileged", name),
+			},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "ClusterRole",
+				Name:     rbacPrivilegedRole,
+			},
+			Subjects: subjects,
+		}
+	}
+	return result
+}
+
+// list returns the objects that aren't nil, in the order that they should be created.
+func (o *rbacObjects) list() []clnt.Object {
+	results := []clnt.Object{
+		o.serviceAccount,
+	}
+	if o.clusterRole != nil {
+		results = append(results, o.clusterRole, o.clusterRoleBinding)
+	}
+	if o.role != nil {
+		results = append(results, o.role, o.roleBinding)
+	}
+	if o.privilegedBinding != nil {
+		results = append(results, o.privilegedBinding)
+	}
+	return results
+}
+
+// bindings returns the service account and the role bindings, but not the roles. This is what
+// the controller creates for the components that it starts, as creating roles would require
+// permissions that the controller doesn't have.
+func (o *rbacObjects) bindings() []clnt.Object {
+	results := []clnt.Object{
+		o.serviceAccount,
+	}
+	if o.clusterRoleBinding != nil {
+		results = append(results, o.clusterRoleBinding)
+	}
+	if o.roleBinding != nil {
+		results = append(results, o.roleBinding)
+	}
+	if o.privilegedBinding != nil {
+		results = append(results, o.privilegedBinding)
+	}
+	return results
+}
+
+// rbacPrivilegedRole is the cluster role that gives permission to use the privileged security
+// context constraint.
+const rbacPrivilegedRole = "system:openshift:scc:privileged"
@@ -0,0 +1,158 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("RBAC", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+		ctx = context.Background()
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Generates manifests that can be parsed", func() {
+		buffer := &bytes.Buffer{}
+		err := WriteManifests(buffer, RBACManifests("my-ns"))
+		Expect(err).ToNot(HaveOccurred())
+		objects, err := ParseManifests(buffer.Bytes())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(objects[0].GetKind()).To(Equal("Namespace"))
+		Expect(objects[0].GetName()).To(Equal("my-ns"))
+		Expect(buffer.String()).ToNot(ContainSubstring("creationTimestamp"))
+		Expect(buffer.String()).ToNot(ContainSubstring("cluster-admin"))
+		var names []string
+		for _, object := range objects {
+			if object.GetKind() == "ServiceAccount" {
+				Expect(object.GetNamespace()).To(Equal("my-ns"))
+				names = append(names, object.GetName())
+			}
+		}
+		Expect(names).To(ConsistOf(
+			"controller",
+			"bundle-agent",
+			"bundle-cleaner",
+			"bundle-extractor",
+			"bundle-loader",
+			"bundle-server",
+		))
+	})
+
+	It("Lets the controller bind the roles of the other components", func() {
+		objects := controllerPermissions.objects("my-ns", controllerServiceAccount)
+		Expect(objects.clusterRole.Rules).To(ContainElement(rbacv1.PolicyRule{
+			APIGroups: []string{rbacv1.GroupName},
+			Resources: []string{"clusterroles"},
+			Verbs:     []string{"bind"},
+			ResourceNames: []string{
+				rbacPrivilegedRole,
+				"upgrade-tool:bundle-agent",
+				"upgrade-tool:bundle-cleaner",
+				"upgrade-tool:bundle-extractor",
+				"upgrade-tool:bundle-loader",
+			},
+		}))
+		Expect(objects.role.Rules).To(ContainElement(rbacv1.PolicyRule{
+			APIGroups: []string{rbacv1.GroupName},
+			Resources: []string{"roles"},
+			Verbs:     []string{"bind"},
+			ResourceNames: []string{
+				"upgrade-tool:bundle-agent",
+				"upgrade-tool:bundle-cleaner",
+				"upgrade-tool:bundle-extractor",
+				"upgrade-tool:bundle-loader",
+			},
+		}))
+		Expect(objects.privilegedBinding).To(BeNil())
+	})
+
+	It("Creates and deletes the bindings of a component", func() {
+		legacy := &rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "my-ns-bundle-extractor-cluster-admin",
+			},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacv1.GroupName,
+				Kind:     "ClusterRole",
+				Name:     "cluster-admin",
+			},
+		}
+		client := fake.NewClientBuilder().
+			WithScheme(snapshotScheme()).
+			WithObjects(legacy).
+			Build()
+		task := &controllerReconcileTask{
+			logger:    logger,
+			client:    client,
+			namespace: "my-ns",
+		}
+
+		// Create the bindings, and check that they reference the roles of the component:
+		err := task.createPrivilegedServiceAccount(ctx, bundleExtractor)
+		Expect(err).ToNot(HaveOccurred())
+		clusterBinding := &rbacv1.ClusterRoleBinding{}
+		key := clnt.ObjectKey{
+			Name: "my-ns-bundle-extractor",
+		}
+		err = client.Get(ctx, key, clusterBinding)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(clusterBinding.RoleRef.Name).To(Equal("upgrade-tool:bundle-extractor"))
+		binding := &rbacv1.RoleBinding{}
+		key = clnt.ObjectKey{
+			Namespace: "my-ns",
+			Name:      "bundle-extractor",
+		}
+		err = client.Get(ctx, key, binding)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(binding.RoleRef.Kind).To(Equal("Role"))
+		Expect(binding.RoleRef.Name).To(Equal("upgrade-tool:bundle-extractor"))
+
+		// Creating them again shouldn't fail:
+		err = task.createPrivilegedServiceAccount(ctx, bundleExtractor)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Delete them, and check that the binding created by older versions is also
+		// deleted:
+		err = task.deletePrivilegedServiceAccount(ctx, bundleExtractor)
+		Expect(err).ToNot(HaveOccurred())
+		err = client.Get(ctx, clnt.ObjectKeyFromObject(clusterBinding), clusterBinding)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		err = client.Get(ctx, clnt.ObjectKeyFromObject(legacy), legacy)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,608 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	dreference "github.com/distribution/distribution/v3/reference"
+	"github.com/go-logr/logr"
+	configv1 "github.com/openshift/api/config/v1"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/labels"
+)
+
+// Possible results of a readiness check:
+const (
+	ReadinessPass = "pass"
+	ReadinessWarn = "warn"
+	ReadinessFail = "fail"
+)
+
+// Possible verdicts of a readiness report:
+const (
+	ReadinessGo   = "go"
+	ReadinessNoGo = "no-go"
+)
+
+// ReadinessReport is the result of checking if the cluster is ready for the upgrade.
+type ReadinessReport struct {
+	// Verdict is 'go' if none of the checks failed and 'no-go' otherwise. Checks that produce
+	// warnings don't change the verdict.
+	Verdict string `json:"verdict"`
+
+	// Checks contains the results of the individual checks.
+	Checks []ReadinessCheck `json:"checks"`
+}
+
+// ReadinessCheck is the result of an individual readiness check.
+type ReadinessCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// ReadinessCheckerBuilder contains the data and logic needed to create a readiness checker. Don't
+// create instances of this type directly, use the NewReadinessChecker function instead.
+type ReadinessCheckerBuilder struct {
+	logger        logr.Logger
+	client        clnt.Client
+	config        *rest.Config
+	allowUnsigned bool
+	preflightDisk resource.Quantity
+}
+
+// ReadinessChecker checks if the cluster is ready to be upgraded: the cluster version and the
+// machine config pools are healthy, all the nodes have the bundle content loaded and the release
+// signature is available. The report also includes the results of the preflight checks that the
+// controller runs before starting an upgrade. Don't create instances of this type directly, use
+// the NewReadinessChecker function instead.
+type ReadinessChecker struct {
+	logger        logr.Logger
+	client        clnt.Client
+	config        *rest.Config
+	allowUnsigned bool
+	preflightDisk resource.Quantity
+}
+
+type readinessCheckTask struct {
+	logger        logr.Logger
+	client        clnt.Client
+	config        *rest.Config
+	allowUnsigned bool
+	preflightDisk resource.Quantity
+	version       *configv1.ClusterVersion
+	nodes         []corev1.Node
+	release       string
+	distribution  string
+	report        *ReadinessReport
+}
+
+// NewReadinessChecker creates a builder that can then be used to configure and create readiness
+// checkers.
+func NewReadinessChecker() *ReadinessCheckerBuilder {
+	return &ReadinessCheckerBuilder{}
+}
+
+// SetLogger sets the logger that the checker will use to write log messages. This is mandatory.
+func (b *ReadinessCheckerBuilder) SetLogger(value logr.Logger) *ReadinessCheckerBuilder {
+	b.logger = value
+	return b
+}
+
+// SetClient sets the Kubernetes API client that the checker will use to read the cluster objects.
+// This is optional, and the default is to create a client using the current Kubernetes
+// configuration.
+func (b *ReadinessCheckerBuilder) SetClient(value clnt.Client) *ReadinessCheckerBuilder {
+	b.client = value
+	return b
+}
+
+// SetConfig sets the configuration used to connect to the API server, which the preflight checks
+// use to check the expiration of its certificate. This is optional. When neither this nor the
+// client are set the current Kubernetes configuration is used, and when only the client is set the
+// certificate check only produces a warning.
+func (b *ReadinessCheckerBuilder) SetConfig(value *rest.Config) *ReadinessCheckerBuilder {
+	b.config = value
+	return b
+}
+
+// SetAllowUnsigned sets the flag that indicates if a release without a signature is acceptable.
+// When it is the missing signature is only a warning, as the upgrade can still be forced. This is
+// optional and the default is false, so that a missing signature makes the verdict 'no-go'.
+func (b *ReadinessCheckerBuilder) SetAllowUnsigned(value bool) *ReadinessCheckerBuilder {
+	b.allowUnsigned = value
+	return b
+}
+
+// SetPreflightDiskSpace sets the minimum allocatable ephemeral storage that the preflight checks
+// require in the nodes. This is optional, and the default is zero, which means that only the disk
+// pressure condition of the nodes is checked.
+func (b *ReadinessCheckerBuilder) SetPreflightDiskSpace(
+	value resource.Quantity) *ReadinessCheckerBuilder {
+	b.preflightDisk = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new readiness checker.
+func (b *ReadinessCheckerBuilder) Build() (result *ReadinessChecker, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+
+	if b.preflightDisk.Sign() < 0 {
+		err = fmt.Errorf(
+			"disk space '%s' isn't valid, it must be greater than or equal to zero",
+			b.preflightDisk.String(),
+		)
+		return
+	}
+
+	// Create the API client if needed:
+	client := b.client
+	config := b.config
+	if client == nil {
+		if config == nil {
+			config, err = ctrl.GetConfig()
+			if err != nil {
+				return
+			}
+		}
+		client, err = clnt.New(config, clnt.Options{
+			Scheme: snapshotScheme(),
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	// Create and populate the object:
+	result = &ReadinessChecker{
+		logger:        b.logger,
+		client:        client,
+		config:        config,
+		allowUnsigned: b.allowUnsigned,
+		preflightDisk: b.preflightDisk,
+	}
+	return
+}
+
+// Run executes all the checks and returns the report. Note that failed checks aren't reported as
+// errors, they are reported in the report. Errors are returned only when the checks can't be
+// executed at all, for example when the API server isn't reachable.
+func (c *ReadinessChecker) Run(ctx context.Context) (result *ReadinessReport, err error) {
+	task := &readinessCheckTask{
+		logger:        c.logger,
+		client:        c.client,
+		config:        c.config,
+		allowUnsigned: c.allowUnsigned,
+		preflightDisk: c.preflightDisk,
+		report:        &ReadinessReport{},
+	}
+	err = task.execute(ctx)
+	if err != nil {
+		return
+	}
+	result = task.report
+	return
+}
+
+func (t *readinessCheckTask) execute(ctx context.Context) error {
+	// Fetch the cluster version:
+	t.version = &configv1.ClusterVersion{}
+	err := t.client.Get(ctx, clnt.ObjectKey{Name: "version"}, t.version)
+	if apierrors.IsNotFound(err) {
+		t.version = nil
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Fetch the nodes:
+	nodeList := &corev1.NodeList{}
+	err = t.client.List(ctx, nodeList)
+	if err != nil {
+		return err
+	}
+	t.nodes = nodeList.Items
+
+	// Run the checks:
+	t.checkClusterVersion()
+	t.checkBundleFile()
+	t.checkStagedContent()
+	t.checkBundleConsistency()
+	err = t.checkMachineConfigPools(ctx)
+	if err != nil {
+		return err
+	}
+	err = t.checkReleaseSignature(ctx)
+	if err != nil {
+		return err
+	}
+	err = t.checkPreflight(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Calculate the verdict:
+	t.report.Verdict = ReadinessGo
+	for _, check := range t.report.Checks {
+		if check.Status == ReadinessFail {
+			t.report.Verdict = ReadinessNoGo
+			break
+		}
+	}
+	t.logger.Info(
+		"Checked readiness",
+		"verdict", t.report.Verdict,
+		"checks", len(t.report.Checks),
+	)
+	return nil
+}
+
+func (t *readinessCheckTask) checkClusterVersion() {
+	const name = "cluster-version"
+	if t.version == nil {
+		t.add(name, ReadinessFail, "Cluster version doesn't exist")
+		return
+	}
+	desired := t.version.Spec.DesiredUpdate
+	if desired != nil && (desired.Version != "" || desired.Image != "") {
+		t.add(
+			name, ReadinessFail,
+			"Upgrade has already been requested to version '%s' and image '%s'",
+			desired.Version, desired.Image,
+		)
+		return
+	}
+	var problems []string
+	if !t.versionCondition(configv1.OperatorAvailable, configv1.ConditionTrue) {
+		problems = append(problems, "isn't available")
+	}
+	if t.versionCondition(configv1.OperatorProgressing, configv1.ConditionTrue) {
+		problems = append(problems, "is progressing")
+	}
+	if t.versionCondition(readinessFailingCondition, configv1.ConditionTrue) {
+		problems = append(problems, "is failing")
+	}
+	if len(problems) > 0 {
+		t.add(name, ReadinessFail, "Cluster version %s", strings.Join(problems, ", "))
+		return
+	}
+	t.add(
+		name, ReadinessPass,
+		"Cluster version '%s' is available and not progressing",
+		t.version.Status.Desired.Version,
+	)
+}
+
+func (t *readinessCheckTask) versionCondition(kind configv1.ClusterStatusConditionType,
+	status configv1.ConditionStatus) bool {
+	for _, condition := range t.version.Status.Conditions {
+		if condition.Type == kind {
+			return condition.Status == status
+		}
+	}
+	return false
+}
+
+func (t *readinessCheckTask) checkBundleFile() {
+	const name = "bundle-file"
+	if t.version == nil {
+		t.add(name, ReadinessFail, "Cluster version doesn't exist")
+		return
+	}
+	value := t.version.Annotations[annotations.BundleFile]
+	if value == "" {
+		t.add(
+			name, ReadinessFail,
+			"Cluster version doesn't have the '%s' annotation",
+			annotations.BundleFile,
+		)
+		return
+	}
+	t.add(name, ReadinessPass, "Bundle file is '%s'", value)
+}
+
+func (t *readinessCheckTask) checkStagedContent() {
+	const name = "staged-content"
+	if len(t.nodes) == 0 {
+		t.add(name, ReadinessFail, "There are no nodes")
+		return
+	}
+	var notExtracted, notLoaded []string
+	for _, node := range t.nodes {
+		if !t.boolLabel(&node, labels.BundleExtracted) {
+			notExtracted = append(notExtracted, node.Name)
+			continue
+		}
+		if !t.boolLabel(&node, labels.BundleLoaded) {
+			notLoaded = append(notLoaded, node.Name)
+		}
+	}
+	if len(notExtracted) > 0 || len(notLoaded) > 0 {
+		var parts []string
+		if len(notExtracted) > 0 {
+			parts = append(parts, fmt.Sprintf(
+				"bundle isn't extracted in %s",
+				strings.Join(notExtracted, ", "),
+			))
+		}
+		if len(notLoaded) > 0 {
+			parts = append(parts, fmt.Sprintf(
+				"bundle isn't loaded in %s",
+				strings.Join(notLoaded, ", "),
+			))
+		}
+		t.add(name, ReadinessFail, "Content isn't staged: %s", strings.Join(parts, "; "))
+		return
+	}
+	t.add(name, ReadinessPass, "Bundle is loaded in all the %d nodes", len(t.nodes))
+}
+
+func (t *readinessCheckTask) checkBundleConsistency() {
+	const name = "bundle-consistency"
+	releases := map[string][]string{}
+	for _, node := range t.nodes {
+		value := node.Annotations[annotations.BundleMetadata]
+		if value == "" {
+			continue
+		}
+		var metadata Metadata
+		err := json.Unmarshal([]byte(value), &metadata)
+		if err != nil {
+			t.add(
+				name, ReadinessFail,
+				"Metadata of node '%s' isn't valid: %v",
+				node.Name, err,
+			)
+			return
+		}
+		releases[metadata.Release] = append(releases[metadata.Release], node.Name)
+		if metadata.Distribution != "" {
+			t.distribution = metadata.Distribution
+		}
+	}
+	switch len(releases) {
+	case 0:
+		t.add(name, ReadinessFail, "No node has bundle metadata")
+		return
+	case 1:
+	default:
+		keys := maps.Keys(releases)
+		slices.Sort(keys)
+		t.add(
+			name, ReadinessFail,
+			"Nodes have bundles for different releases: %s",
+			strings.Join(keys, ", "),
+		)
+		return
+	}
+	t.release = maps.Keys(releases)[0]
+	named, err := dreference.ParseNamed(t.release)
+	if err == nil {
+		_, ok := named.(dreference.Digested)
+		if !ok {
+			err = errors.New("it doesn't contain a digest")
+		}
+	}
+	if err != nil {
+		t.add(
+			name, ReadinessFail,
+			"Release image '%s' isn't valid: %v",
+			t.release, err,
+		)
+		t.release = ""
+		return
+	}
+	t.add(name, ReadinessPass, "All nodes have the bundle for release '%s'", t.release)
+}
+
+func (t *readinessCheckTask) checkMachineConfigPools(ctx context.Context) error {
+	const name = "machine-config-pools"
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(readinessPoolListGVK)
+	err := t.client.List(ctx, list)
+	if meta.IsNoMatchError(err) || apierrors.IsNotFound(err) {
+		t.add(name, ReadinessWarn, "Machine config pools aren't supported by the cluster")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for _, pool := range list.Items {
+		paused, _, _ := unstructured.NestedBool(pool.Object, "spec", "paused")
+		if paused {
+			problems = append(problems, fmt.Sprintf("'%s' is paused", pool.GetName()))
+		}
+		conditions, _, _ := unstructured.NestedSlice(pool.Object, "status", "conditions")
+		for _, item := range conditions {
+			condition, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch {
+			case condition["type"] == "Degraded" && condition["status"] == "True":
+				problems = append(
+					problems,
+					fmt.Sprintf("'%s' is degraded", pool.GetName()),
+				)
+			case condition["type"] == "Updated" && condition["status"] != "True":
+				problems = append(
+					problems,
+					fmt.Sprintf("'%s' isn't updated", pool.GetName()),
+				)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		t.add(
+			name, ReadinessFail,
+			"Machine config pools aren't healthy: %s",
+			strings.Join(problems, ", "),
+		)
+		return nil
+	}
+	t.add(name, ReadinessPass, "All the %d machine config pools are healthy", len(list.Items))
+	return nil
+}
+
+func (t *readinessCheckTask) checkReleaseSignature(ctx context.Context) error {
+	const name = "release-signature"
+	if t.release == "" {
+		t.add(name, ReadinessWarn, "Release image is unknown, signature can't be checked")
+		return nil
+	}
+	if t.distribution == DistributionOKD {
+		t.add(name, ReadinessPass, "Release '%s' is an unsigned OKD release", t.release)
+		return nil
+	}
+	named, err := dreference.ParseNamed(t.release)
+	if err != nil {
+		return err
+	}
+	digested, ok := named.(dreference.Digested)
+	if !ok {
+		t.add(
+			name, ReadinessFail,
+			"Release image '%s' doesn't contain a digest, signature can't be checked",
+			t.release,
+		)
+		return nil
+	}
+	digest := digested.Digest()
+	prefix := fmt.Sprintf("%s-%s-", digest.Algorithm(), digest.Encoded())
+	list := &corev1.ConfigMapList{}
+	err = t.client.List(
+		ctx, list,
+		clnt.InNamespace(readinessSignaturesNamespace),
+		clnt.HasLabels{readinessSignaturesLabel},
+	)
+	if err != nil {
+		return err
+	}
+	for _, item := range list.Items {
+		for key := range item.BinaryData {
+			if strings.HasPrefix(key, prefix) {
+				t.add(
+					name, ReadinessPass,
+					"Signature for release '%s' is in config map '%s'",
+					t.release, item.Name,
+				)
+				return nil
+			}
+		}
+	}
+	if t.allowUnsigned {
+		t.add(
+			name, ReadinessWarn,
+			"Signature for release '%s' isn't available, the upgrade will be forced",
+			t.release,
+		)
+		return nil
+	}
+	t.add(
+		name, ReadinessFail,
+		"Signature for release '%s' isn't available",
+		t.release,
+	)
+	return nil
+}
+
+// checkPreflight runs the same preflight checks that the controller runs before starting an
+// upgrade, and adds their results to the report.
+func (t *readinessCheckTask) checkPreflight(ctx context.Context) error {
+	checker, err := NewPreflightChecker().
+		SetLogger(t.logger).
+		SetClient(t.client).
+		SetConfig(t.config).
+		SetDiskSpace(t.preflightDisk).
+		Build()
+	if err != nil {
+		return err
+	}
+	report, err := checker.Run(ctx)
+	if err != nil {
+		return err
+	}
+	t.report.Checks = append(t.report.Checks, report.Checks...)
+	return nil
+}
+
+func (t *readinessCheckTask) add(name, status, format string, args ...any) {
+	check := ReadinessCheck{
+		Name:    name,
+		Status:  status,
+		Message: fmt.Sprintf(format, args...),
+	}
+	t.report.Checks = append(t.report.Checks, check)
+	t.logger.V(1).Info(
+		"Executed readiness check",
+		"name", check.Name,
+		"status", check.Status,
+		"message", check.Message,
+	)
+}
+
+func (t *readinessCheckTask) boolLabel(object clnt.Object, label string) bool {
+	value, ok := object.GetLabels()[label]
+	if !ok {
+		return false
+	}
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		return false
+	}
+	return result
+}
+
+// readinessFailingCondition is the condition that the cluster version operator uses to indicate
+// that it failed to apply the desired version.
+const readinessFailingCondition configv1.ClusterStatusConditionType = "Failing"
+
+// readinessSignaturesNamespace is the namespace where the cluster version operator looks for
+// config maps containing release signatures, and readinessSignaturesLabel is the label that those
+// config maps must have.
+const (
+	readinessSignaturesNamespace = "openshift-config-managed"
+	readinessSignaturesLabel     = "release.openshift.io/verification-signatures"
+)
+
+var readinessPoolListGVK = schema.GroupVersionKind{
+	Group:   "machineconfiguration.openshift.io",
+	Version: "v1",
+	Kind:    "MachineConfigPoolList",
+}
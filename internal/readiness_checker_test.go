@@ -0,0 +1,269 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/annotations"
+	"github.com/jhernand/upgrade-tool/internal/labels"
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Readiness checker", func() {
+	const release = "quay.io/openshift-release-dev/ocp-release@sha256:" +
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	var (
+		ctx    context.Context
+		logger logr.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	makeVersion := func() *configv1.ClusterVersion {
+		return &configv1.ClusterVersion{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "version",
+				Annotations: map[string]string{
+					annotations.BundleFile: "/var/lib/upgrade.tar",
+				},
+			},
+			Status: configv1.ClusterVersionStatus{
+				Desired: configv1.Release{
+					Version: "4.12.0",
+				},
+				Conditions: []configv1.ClusterOperatorStatusCondition{
+					{
+						Type:   configv1.OperatorAvailable,
+						Status: configv1.ConditionTrue,
+					},
+					{
+						Type:   configv1.OperatorProgressing,
+						Status: configv1.ConditionFalse,
+					},
+				},
+			},
+		}
+	}
+
+	makeNode := func(name string, loaded bool) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					labels.BundleExtracted: "true",
+					labels.BundleLoaded:    strconv.FormatBool(loaded),
+				},
+				Annotations: map[string]string{
+					annotations.BundleMetadata: `{"release":"` + release + `"}`,
+				},
+			},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{{
+					Type:   corev1.NodeReady,
+					Status: corev1.ConditionTrue,
+				}},
+			},
+		}
+	}
+
+	makeSignatures := func() *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: readinessSignaturesNamespace,
+				Name:      "release-signatures",
+				Labels: map[string]string{
+					readinessSignaturesLabel: "",
+				},
+			},
+			BinaryData: map[string][]byte{
+				"sha256-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef-1": {
+					1,
+				},
+			},
+		}
+	}
+
+	runWith := func(allowUnsigned bool, objects ...clnt.Object) *ReadinessReport {
+		client := fake.NewClientBuilder().
+			WithScheme(snapshotScheme()).
+			WithObjects(objects...).
+			Build()
+		checker, err := NewReadinessChecker().
+			SetLogger(logger).
+			SetClient(client).
+			SetAllowUnsigned(allowUnsigned).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		report, err := checker.Run(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		return report
+	}
+
+	run := func(objects ...clnt.Object) *ReadinessReport {
+		return runWith(false, objects...)
+	}
+
+	findCheck := func(report *ReadinessReport, name string) ReadinessCheck {
+		for _, check := range report.Checks {
+			if check.Name == name {
+				return check
+			}
+		}
+		Fail("check '" + name + "' not found")
+		return ReadinessCheck{}
+	}
+
+	It("Can't be created without a logger", func() {
+		checker, err := NewReadinessChecker().
+			SetClient(fake.NewClientBuilder().Build()).
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("logger"))
+		Expect(checker).To(BeNil())
+	})
+
+	It("Says go when everything is ready", func() {
+		report := run(
+			makeVersion(),
+			makeNode("node0", true),
+			makeNode("node1", true),
+			makeSignatures(),
+		)
+		Expect(report.Verdict).To(Equal(ReadinessGo))
+		Expect(findCheck(report, "cluster-version").Status).To(Equal(ReadinessPass))
+		Expect(findCheck(report, "staged-content").Status).To(Equal(ReadinessPass))
+		Expect(findCheck(report, "bundle-consistency").Status).To(Equal(ReadinessPass))
+		Expect(findCheck(report, "release-signature").Status).To(Equal(ReadinessPass))
+	})
+
+	It("Says no-go when the bundle isn't loaded in some node", func() {
+		report := run(
+			makeVersion(),
+			makeNode("node0", true),
+			makeNode("node1", false),
+			makeSignatures(),
+		)
+		Expect(report.Verdict).To(Equal(ReadinessNoGo))
+		check := findCheck(report, "staged-content")
+		Expect(check.Status).To(Equal(ReadinessFail))
+		Expect(check.Message).To(ContainSubstring("node1"))
+	})
+
+	It("Says no-go when the cluster version is progressing", func() {
+		version := makeVersion()
+		version.Status.Conditions[1].Status = configv1.ConditionTrue
+		report := run(version, makeNode("node0", true), makeSignatures())
+		Expect(report.Verdict).To(Equal(ReadinessNoGo))
+		check := findCheck(report, "cluster-version")
+		Expect(check.Status).To(Equal(ReadinessFail))
+		Expect(check.Message).To(ContainSubstring("progressing"))
+	})
+
+	It("Says no-go when the upgrade has already been requested", func() {
+		version := makeVersion()
+		version.Spec.DesiredUpdate = &configv1.Update{
+			Image: release,
+		}
+		report := run(version, makeNode("node0", true), makeSignatures())
+		Expect(report.Verdict).To(Equal(ReadinessNoGo))
+		Expect(findCheck(report, "cluster-version").Status).To(Equal(ReadinessFail))
+	})
+
+	It("Says no-go when the release signature is missing", func() {
+		report := run(makeVersion(), makeNode("node0", true))
+		Expect(report.Verdict).To(Equal(ReadinessNoGo))
+		Expect(findCheck(report, "release-signature").Status).To(Equal(ReadinessFail))
+	})
+
+	It("Only warns when the release signature is missing and unsigned releases are allowed", func() {
+		report := runWith(true, makeVersion(), makeNode("node0", true))
+		Expect(report.Verdict).To(Equal(ReadinessGo))
+		Expect(findCheck(report, "release-signature").Status).To(Equal(ReadinessWarn))
+	})
+
+	It("Says no-go when the release doesn't contain a digest", func() {
+		node := makeNode("node0", true)
+		node.Annotations[annotations.BundleMetadata] = `{
+			"release": "quay.io/openshift-release-dev/ocp-release:4.13.4-x86_64"
+		}`
+		report := run(makeVersion(), node, makeSignatures())
+		Expect(report.Verdict).To(Equal(ReadinessNoGo))
+		Expect(findCheck(report, "bundle-consistency").Status).To(Equal(ReadinessFail))
+	})
+
+	It("Includes the preflight checks", func() {
+		report := run(
+			makeVersion(),
+			makeNode("node0", true),
+			makeSignatures(),
+			&configv1.ClusterOperator{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "etcd",
+				},
+			},
+		)
+		Expect(findCheck(report, "nodes-ready").Status).To(Equal(ReadinessPass))
+		Expect(findCheck(report, "etcd-quorum").Status).To(Equal(ReadinessWarn))
+		check := findCheck(report, "cluster-operators")
+		Expect(check.Status).To(Equal(ReadinessFail))
+		Expect(check.Message).To(ContainSubstring("'etcd' isn't available"))
+		Expect(report.Verdict).To(Equal(ReadinessNoGo))
+	})
+
+	It("Says no-go when a node isn't ready", func() {
+		node := makeNode("node1", true)
+		node.Status.Conditions[0].Status = corev1.ConditionFalse
+		report := run(makeVersion(), makeNode("node0", true), node, makeSignatures())
+		Expect(report.Verdict).To(Equal(ReadinessNoGo))
+		check := findCheck(report, "nodes-ready")
+		Expect(check.Status).To(Equal(ReadinessFail))
+		Expect(check.Message).To(ContainSubstring("node1"))
+	})
+
+	It("Doesn't require signatures for OKD releases", func() {
+		node := makeNode("node0", true)
+		node.Annotations[annotations.BundleMetadata] = `{
+			"distribution": "okd",
+			"release": "` + release + `"
+		}`
+		report := run(makeVersion(), node)
+		Expect(report.Verdict).To(Equal(ReadinessGo))
+		Expect(findCheck(report, "release-signature").Status).To(Equal(ReadinessPass))
+	})
+})
@@ -16,56 +16,110 @@ package internal
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"math/big"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	dconfiguration "github.com/distribution/distribution/v3/configuration"
 	dhandlers "github.com/distribution/distribution/v3/registry/handlers"
+	dstorage "github.com/distribution/distribution/v3/registry/storage"
+	dfilesystem "github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
 	"github.com/go-logr/logr"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/exp/slices"
+	"golang.org/x/time/rate"
 
-	_ "github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	_ "github.com/distribution/distribution/v3/registry/auth/htpasswd"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/s3-aws"
 )
 
 // RegistryBuilder contains the data and logic needed to build a simple image registry server. Don't
 // create instances of this type directly, use the NewRegistry function instead.
 type RegistryBuilder struct {
-	logger  logr.Logger
-	address string
-	root    string
-	cert    []byte
-	key     []byte
+	logger       logr.Logger
+	address      string
+	root         string
+	cert         []byte
+	key          []byte
+	maxBandwidth int64
+	username     string
+	password     string
+	htpasswd     string
+	tokenFile    string
+	certFile     string
+	keyFile      string
+	readOnly     bool
+	metricsAddr  string
+	catalogMax   int
+	s3Storage    string
+	s3Endpoint   string
+	s3Region     string
+	s3Creds      string
+	keyAlgorithm string
+	certValidity time.Duration
+	certNames    []string
+	caCert       []byte
+	caKey        []byte
 }
 
 // Registry implements a simple registry server. Don't create instances of this type directly, use
 // the NewRegistry function instead.
 type Registry struct {
-	logger   logr.Logger
-	address  string
-	root     string
-	tmp      string
-	cert     []byte
-	key      []byte
-	listener net.Listener
-	server   *http.Server
+	logger          logr.Logger
+	address         string
+	root            string
+	tmp             string
+	cert            []byte
+	key             []byte
+	username        string
+	password        string
+	htpasswd        string
+	token           string
+	reloader        *registryCertReloader
+	readOnly        bool
+	catalogMax      int
+	storage         dconfiguration.Storage
+	limiter         *rate.Limiter
+	listener        net.Listener
+	server          *http.Server
+	metrics         *registryMetrics
+	metricsAddr     string
+	metricsListener net.Listener
+	metricsServer   *http.Server
+	requests        atomic.Int64
 }
 
 // NewRegistry creates a builder that can then be used to configure and create a new registry
 // server.
 func NewRegistry() *RegistryBuilder {
-	return &RegistryBuilder{}
+	return &RegistryBuilder{
+		catalogMax:   registryDefaultCatalogMax,
+		keyAlgorithm: registryKeyAlgorithmECDSA,
+		certValidity: registryDefaultCertValidity,
+	}
 }
 
 // SetLogger sets the logger that the registry will use to write log messages. This is mandatory.
@@ -80,8 +134,9 @@ func (b *RegistryBuilder) SetAddress(value string) *RegistryBuilder {
 	return b
 }
 
-// SetRoot sets the root of the directory tree where the registry will store the images. This is
-// mandatory.
+// SetRoot sets the root of the directory tree where the registry will store the images. The
+// generated certificate and key are also saved in this directory, so that they can be reused in
+// later runs. This is mandatory unless the S3 storage is used.
 func (b *RegistryBuilder) SetRoot(value string) *RegistryBuilder {
 	b.root = value
 	return b
@@ -95,6 +150,138 @@ func (b *RegistryBuilder) SetCertificate(cert, key []byte) *RegistryBuilder {
 	return b
 }
 
+// SetCertificateFiles sets the files that contain the TLS certificate and key (in PEM format) that
+// will be used by the server. The files are loaded again when they change, so that certificates
+// mounted from Kubernetes secrets can be rotated without restarting the registry. This is optional
+// and can't be combined with SetCertificate.
+func (b *RegistryBuilder) SetCertificateFiles(certFile, keyFile string) *RegistryBuilder {
+	b.certFile = certFile
+	b.keyFile = keyFile
+	return b
+}
+
+// SetMaxBandwidth sets the maximum number of bytes per second that the registry will accept, adding
+// all the requests. This is optional, and the default is to not limit the bandwidth. Note that this
+// limits the speed of pushes to the registry, not pulls from it.
+func (b *RegistryBuilder) SetMaxBandwidth(value int64) *RegistryBuilder {
+	b.maxBandwidth = value
+	return b
+}
+
+// SetCredentials sets the user name and password that clients must send, using basic
+// authentication. This is optional, and when not set clients aren't authenticated.
+func (b *RegistryBuilder) SetCredentials(username, password string) *RegistryBuilder {
+	b.username = username
+	b.password = password
+	return b
+}
+
+// SetHtpasswdFile sets the path of an htpasswd file containing the bcrypt hashed passwords of the
+// users that are allowed to use the registry, using basic authentication. This is optional, and
+// can't be combined with the other authentication options.
+func (b *RegistryBuilder) SetHtpasswdFile(value string) *RegistryBuilder {
+	b.htpasswd = value
+	return b
+}
+
+// SetTokenFile sets the file that contains the token that clients must send in the 'Authorization'
+// header, using the 'Bearer' scheme. This is optional, and can't be combined with the other
+// authentication options.
+func (b *RegistryBuilder) SetTokenFile(value string) *RegistryBuilder {
+	b.tokenFile = value
+	return b
+}
+
+// SetReadOnly sets a flag that indicates if the registry should reject pushes, using the read only
+// maintenance mode of the registry server. This is intended for registries that serve storage that
+// has already been populated. This is optional and the default is to accept pushes.
+func (b *RegistryBuilder) SetReadOnly(value bool) *RegistryBuilder {
+	b.readOnly = value
+	return b
+}
+
+// SetS3Storage sets the URL of the S3 bucket where the registry will store the images instead of
+// the root directory, for example 's3://my-bucket/my-prefix'. The prefix is optional. This is
+// optional, and when set the root directory isn't needed.
+func (b *RegistryBuilder) SetS3Storage(value string) *RegistryBuilder {
+	b.s3Storage = value
+	return b
+}
+
+// SetS3Endpoint sets the URL of the S3 compatible object store used for the S3 storage. This is
+// optional, and if not specified the endpoint will be read from the credentials directory, or else
+// the AWS endpoint of the region will be used.
+func (b *RegistryBuilder) SetS3Endpoint(value string) *RegistryBuilder {
+	b.s3Endpoint = value
+	return b
+}
+
+// SetS3Region sets the region of the S3 compatible object store used for the S3 storage. This is
+// optional, and if not specified the region will be read from the credentials directory, or else
+// 'us-east-1' will be used.
+func (b *RegistryBuilder) SetS3Region(value string) *RegistryBuilder {
+	b.s3Region = value
+	return b
+}
+
+// SetS3CredentialsDir sets the directory containing the credentials for the S3 storage, with the
+// same files used by the bundle extractor: 'access-key-id', 'secret-access-key' and optionally
+// 'endpoint' and 'region'. Note that session tokens aren't supported by the storage driver. This
+// is optional, and if not specified the credentials of the environment will be used.
+func (b *RegistryBuilder) SetS3CredentialsDir(value string) *RegistryBuilder {
+	b.s3Creds = value
+	return b
+}
+
+// SetCatalogMaxEntries sets the maximum number of repositories that the registry returns in each
+// page of the catalog. This is optional and the default is 1000, enough to list all the
+// repositories of a release in one page.
+func (b *RegistryBuilder) SetCatalogMaxEntries(value int) *RegistryBuilder {
+	b.catalogMax = value
+	return b
+}
+
+// SetKeyAlgorithm sets the algorithm of the key generated for the self signed certificate, when
+// the certificate isn't explicitly set. Valid values are 'ecdsa', to generate a P-256 key, and
+// 'rsa', to generate a 4096 bits key for old clients that don't support ECDSA. This is optional
+// and the default is 'ecdsa', as generating it is much faster.
+func (b *RegistryBuilder) SetKeyAlgorithm(value string) *RegistryBuilder {
+	b.keyAlgorithm = value
+	return b
+}
+
+// SetCertificateValidity sets the validity of the generated certificate, when the certificate
+// isn't explicitly set. This is optional and the default is one year.
+func (b *RegistryBuilder) SetCertificateValidity(value time.Duration) *RegistryBuilder {
+	b.certValidity = value
+	return b
+}
+
+// AddCertificateNames adds host names or IP addresses that will be added as subject alternative
+// names to the generated certificate, in addition to the host of the listen address. Values that
+// are IP addresses are added as IP addresses, and the rest as DNS names. This is optional.
+func (b *RegistryBuilder) AddCertificateNames(values ...string) *RegistryBuilder {
+	b.certNames = append(b.certNames, values...)
+	return b
+}
+
+// SetCA sets the certificate and key of the certificate authority, in PEM format, that will be
+// used to sign the generated certificate, so that clients only need to trust that certificate
+// authority. This is optional, and if not specified the generated certificate will be self signed.
+func (b *RegistryBuilder) SetCA(cert, key []byte) *RegistryBuilder {
+	b.caCert = cert
+	b.caKey = key
+	return b
+}
+
+// SetMetricsAddress sets the address where the registry will serve the Prometheus metrics, using
+// plain HTTP and without authentication, for example 'localhost:9100'. Use port zero to select a
+// random port. This is optional and the default is to not serve the metrics.
+func (b *RegistryBuilder) SetMetricsAddress(value string) *RegistryBuilder {
+	b.metricsAddr = value
+	return b
+}
+
 // Build uses the data stored in the builder to create a new registry.
 func (b *RegistryBuilder) Build() (result *Registry, err error) {
 	// Check parameters:
@@ -106,8 +293,12 @@ func (b *RegistryBuilder) Build() (result *Registry, err error) {
 		err = errors.New("address is mandatory")
 		return
 	}
-	if b.root == "" {
-		err = errors.New("root is mandatory")
+	if b.root == "" && b.s3Storage == "" {
+		err = errors.New("root or S3 storage is mandatory")
+		return
+	}
+	if b.root != "" && b.s3Storage != "" {
+		err = errors.New("root and S3 storage are mutually exclusive")
 		return
 	}
 	if b.cert != nil && b.key == nil {
@@ -118,17 +309,118 @@ func (b *RegistryBuilder) Build() (result *Registry, err error) {
 		err = errors.New("certificate is mandatory when key is set")
 		return
 	}
+	if b.certFile != "" && b.keyFile == "" {
+		err = errors.New("key file is mandatory when certificate file is set")
+		return
+	}
+	if b.keyFile != "" && b.certFile == "" {
+		err = errors.New("certificate file is mandatory when key file is set")
+		return
+	}
+	if b.certFile != "" && b.cert != nil {
+		err = errors.New("certificate and certificate files are mutually exclusive")
+		return
+	}
+	if b.maxBandwidth < 0 {
+		err = fmt.Errorf(
+			"maximum bandwidth %d isn't valid, it must be greater than or equal to zero",
+			b.maxBandwidth,
+		)
+		return
+	}
+	if b.catalogMax <= 0 {
+		err = fmt.Errorf(
+			"catalog maximum entries %d isn't valid, it must be greater than zero",
+			b.catalogMax,
+		)
+		return
+	}
+	if b.caCert != nil && b.caKey == nil {
+		err = errors.New("CA key is mandatory when CA certificate is set")
+		return
+	}
+	if b.caKey != nil && b.caCert == nil {
+		err = errors.New("CA certificate is mandatory when CA key is set")
+		return
+	}
+	if b.caCert != nil && (b.cert != nil || b.certFile != "") {
+		err = errors.New("CA and certificate are mutually exclusive")
+		return
+	}
+	if b.certValidity <= 0 {
+		err = fmt.Errorf(
+			"certificate validity %s isn't valid, it must be greater than zero",
+			b.certValidity,
+		)
+		return
+	}
+	if b.keyAlgorithm != registryKeyAlgorithmECDSA && b.keyAlgorithm != registryKeyAlgorithmRSA {
+		err = fmt.Errorf(
+			"key algorithm '%s' isn't valid, it must be '%s' or '%s'",
+			b.keyAlgorithm, registryKeyAlgorithmECDSA, registryKeyAlgorithmRSA,
+		)
+		return
+	}
+	if b.username != "" && b.password == "" {
+		err = errors.New("password is mandatory when user name is set")
+		return
+	}
+	if b.password != "" && b.username == "" {
+		err = errors.New("user name is mandatory when password is set")
+		return
+	}
+	auths := 0
+	for _, value := range []string{b.username, b.htpasswd, b.tokenFile} {
+		if value != "" {
+			auths++
+		}
+	}
+	if auths > 1 {
+		err = errors.New(
+			"credentials, htpasswd file and token file are mutually exclusive",
+		)
+		return
+	}
+	if b.htpasswd != "" {
+		// Note that this check is needed because the registry creates the file with a
+		// random password if it doesn't exist.
+		_, err = os.Stat(b.htpasswd)
+		if err != nil {
+			err = fmt.Errorf("failed to check htpasswd file '%s': %w", b.htpasswd, err)
+			return
+		}
+	}
 
-	// Create the temporary directory:
-	tmp, err := os.MkdirTemp("", "*.registry")
+	// Prepare the storage configuration:
+	storage, err := b.makeStorage()
 	if err != nil {
 		return
 	}
 
-	// Generate the TLS certificate and key if needed:
+	// Read the token:
+	var token string
+	if b.tokenFile != "" {
+		token, err = readTokenFile(b.tokenFile)
+		if err != nil {
+			return
+		}
+	}
+
+	// Load the TLS certificate and key from the files, or generate them if needed:
+	var reloader *registryCertReloader
 	cert, key := b.cert, b.key
-	if b.cert == nil && b.key == nil {
-		cert, key, err = b.makeSelfSignedCert()
+	if b.certFile != "" {
+		reloader = &registryCertReloader{
+			logger:   b.logger,
+			certFile: b.certFile,
+			keyFile:  b.keyFile,
+		}
+		err = reloader.load()
+		if err != nil {
+			return
+		}
+	} else if b.cert == nil && b.key == nil {
+		cert, key, err = b.loadOrMakeCert()
 		if err != nil {
 			return
 		}
@@ -136,21 +428,209 @@ func (b *RegistryBuilder) Build() (result *Registry, err error) {
 
 	// Create and populate the object:
 	result = &Registry{
-		logger:  b.logger,
-		address: b.address,
-		root:    b.root,
-		tmp:     tmp,
-		cert:    cert,
-		key:     key,
+		logger:      b.logger,
+		address:     b.address,
+		root:        b.root,
+		cert:        cert,
+		key:         key,
+		username:    b.username,
+		password:    b.password,
+		htpasswd:    b.htpasswd,
+		token:       token,
+		reloader:    reloader,
+		readOnly:    b.readOnly,
+		catalogMax:  b.catalogMax,
+		storage:     storage,
+		limiter:     NewBandwidthLimiter(b.maxBandwidth),
+		metrics:     newRegistryMetrics(),
+		metricsAddr: b.metricsAddr,
 	}
 	return
 }
 
-func (b *RegistryBuilder) makeSelfSignedCert() (certPEM, keyPEM []byte, err error) {
+// makeStorage creates the storage configuration of the registry server, either for the file system
+// driver or for the S3 driver.
+func (b *RegistryBuilder) makeStorage() (result dconfiguration.Storage, err error) {
+	if b.s3Storage == "" {
+		result = dconfiguration.Storage{
+			"filesystem": dconfiguration.Parameters{
+				"rootdirectory": b.root,
+			},
+		}
+		return
+	}
+	parsed, err := url.Parse(b.s3Storage)
+	if err != nil {
+		return
+	}
+	if parsed.Scheme != "s3" || parsed.Host == "" {
+		err = fmt.Errorf(
+			"S3 storage '%s' should have the form 's3://bucket/prefix'",
+			b.s3Storage,
+		)
+		return
+	}
+	endpoint := b.s3Endpoint
+	region := b.s3Region
+	parameters := dconfiguration.Parameters{
+		"bucket":         parsed.Host,
+		"forcepathstyle": true,
+	}
+	prefix := strings.Trim(parsed.Path, "/")
+	if prefix != "" {
+		parameters["rootdirectory"] = "/" + prefix
+	}
+	if b.s3Creds != "" {
+		var values map[string]string
+		values, err = readS3Files(b.s3Creds)
+		if err != nil {
+			return
+		}
+		if values[s3AccessKeyIDFile] == "" || values[s3SecretAccessKeyFile] == "" {
+			err = fmt.Errorf(
+				"credentials directory '%s' must contain the '%s' and '%s' files",
+				b.s3Creds, s3AccessKeyIDFile, s3SecretAccessKeyFile,
+			)
+			return
+		}
+		parameters["accesskey"] = values[s3AccessKeyIDFile]
+		parameters["secretkey"] = values[s3SecretAccessKeyFile]
+		if endpoint == "" {
+			endpoint = values[s3EndpointFile]
+		}
+		if region == "" {
+			region = values[s3RegionFile]
+		}
+	}
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	parameters["region"] = region
+	if endpoint != "" {
+		parameters["regionendpoint"] = endpoint
+	}
+	result = dconfiguration.Storage{
+		"s3": parameters,
+	}
+	return
+}
+
+// loadOrMakeCert reuses the certificate and key generated by a previous run and saved in the root
+// directory, if they are still valid for the current configuration. Otherwise it generates new
+// ones and saves them in the root directory, so that clients don't need to trust a different
+// certificate each time that the registry starts.
+func (b *RegistryBuilder) loadOrMakeCert() (certPEM, keyPEM []byte, err error) {
+	if b.root == "" {
+		certPEM, keyPEM, err = b.makeSelfSignedCert()
+		return
+	}
+	certFile := filepath.Join(b.root, registryCertFile)
+	keyFile := filepath.Join(b.root, registryKeyFile)
+	certPEM, certErr := os.ReadFile(certFile)
+	keyPEM, keyErr := os.ReadFile(keyFile)
+	if certErr == nil && keyErr == nil {
+		reason := b.checkSavedCert(certPEM, keyPEM)
+		if reason == "" {
+			b.logger.V(1).Info(
+				"Reusing saved certificate",
+				"file", certFile,
+			)
+			return
+		}
+		b.logger.V(1).Info(
+			"Saved certificate can't be reused",
+			"file", certFile,
+			"reason", reason,
+		)
+	}
+	certPEM, keyPEM, err = b.makeSelfSignedCert()
+	if err != nil {
+		return
+	}
+
+	// Failing to save the certificate isn't fatal, as it only means that it will not be reused
+	// in the next run:
+	err = os.WriteFile(keyFile, keyPEM, 0600)
+	if err == nil {
+		err = os.WriteFile(certFile, certPEM, 0600)
+	}
+	if err != nil {
+		b.logger.Error(
+			err,
+			"Failed to save certificate",
+			"file", certFile,
+		)
+		err = nil
+	}
+	return
+}
+
+// checkSavedCert checks if the given saved certificate and key can be reused with the current
+// configuration. Returns an empty string if it can be reused, or else the reason why not.
+func (b *RegistryBuilder) checkSavedCert(certPEM, keyPEM []byte) string {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err.Error()
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err.Error()
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.Add(registryCertRenewMargin).After(cert.NotAfter) {
+		return "certificate is expired or about to expire"
+	}
+	var algorithm x509.PublicKeyAlgorithm
+	switch b.keyAlgorithm {
+	case registryKeyAlgorithmRSA:
+		algorithm = x509.RSA
+	default:
+		algorithm = x509.ECDSA
+	}
+	if cert.PublicKeyAlgorithm != algorithm {
+		return "key algorithm has changed"
+	}
+	names := append([]string{b.certHost()}, b.certNames...)
+	for _, name := range names {
+		err = cert.VerifyHostname(name)
+		if err != nil {
+			return err.Error()
+		}
+	}
+	if b.caCert != nil {
+		var ca *x509.Certificate
+		ca, _, err = b.loadCA()
+		if err != nil {
+			return err.Error()
+		}
+		err = cert.CheckSignatureFrom(ca)
+		if err != nil {
+			return err.Error()
+		}
+	} else {
+		err = cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+		if err != nil {
+			return "certificate isn't self signed"
+		}
+	}
+	return ""
+}
+
+// certHost returns the host name of the generated certificate, extracted from the listen address.
+func (b *RegistryBuilder) certHost() string {
 	host, _, err := net.SplitHostPort(b.address)
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	return host
+}
+
+func (b *RegistryBuilder) makeSelfSignedCert() (certPEM, keyPEM []byte, err error) {
+	_, _, err = net.SplitHostPort(b.address)
 	if err != nil {
 		return
 	}
+	host := b.certHost()
 	addrs, err := net.LookupHost(host)
 	if err != nil {
 		return
@@ -159,28 +639,55 @@ func (b *RegistryBuilder) makeSelfSignedCert() (certPEM, keyPEM []byte, err erro
 	for i, addr := range addrs {
 		ips[i] = net.ParseIP(addr)
 	}
-	key, err := rsa.GenerateKey(rand.Reader, 4096)
+	names := []string{
+		host,
+	}
+	for _, name := range b.certNames {
+		ip := net.ParseIP(name)
+		if ip != nil {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, name)
+		}
+	}
+	key, keyBlock, keyUsage, err := b.makeKey()
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
 		return
 	}
 	now := time.Now()
 	spec := x509.Certificate{
-		SerialNumber: big.NewInt(0),
+		SerialNumber: serial,
 		Subject: pkix.Name{
 			CommonName: host,
 		},
-		DNSNames: []string{
-			host,
-		},
+		DNSNames:    names,
 		IPAddresses: ips,
 		NotBefore:   now,
-		NotAfter:    now.Add(365 * 24 * time.Hour),
-		KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		NotAfter:    now.Add(b.certValidity),
+		KeyUsage:    keyUsage,
 		ExtKeyUsage: []x509.ExtKeyUsage{
 			x509.ExtKeyUsageServerAuth,
 		},
 	}
-	cert, err := x509.CreateCertificate(rand.Reader, &spec, &spec, &key.PublicKey, key)
+
+	// Sign the certificate with the CA if it has been provided, otherwise sign it with its own
+	// key:
+	parent := &spec
+	var signer crypto.Signer = key
+	if b.caCert != nil {
+		parent, signer, err = b.loadCA()
+		if err != nil {
+			return
+		}
+		if spec.NotAfter.After(parent.NotAfter) {
+			spec.NotAfter = parent.NotAfter
+		}
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, &spec, parent, key.Public(), signer)
 	if err != nil {
 		return
 	}
@@ -188,10 +695,69 @@ func (b *RegistryBuilder) makeSelfSignedCert() (certPEM, keyPEM []byte, err erro
 		Type:  "CERTIFICATE",
 		Bytes: cert,
 	})
-	keyPEM = pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	})
+	keyPEM = pem.EncodeToMemory(keyBlock)
+	return
+}
+
+// loadCA parses the certificate and key of the certificate authority.
+func (b *RegistryBuilder) loadCA() (cert *x509.Certificate, key crypto.Signer, err error) {
+	block, _ := pem.Decode(b.caCert)
+	if block == nil || block.Type != "CERTIFICATE" {
+		err = errors.New("CA certificate doesn't contain a PEM certificate")
+		return
+	}
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		err = fmt.Errorf("failed to parse CA certificate: %w", err)
+		return
+	}
+	if !cert.IsCA {
+		err = errors.New("CA certificate isn't a certificate authority")
+		return
+	}
+	key, err = parsePrivateKey(b.caKey)
+	if err != nil {
+		err = fmt.Errorf("failed to parse CA key: %w", err)
+		return
+	}
+	return
+}
+
+// makeKey generates the key for the self signed certificate, using the configured algorithm. It
+// returns the key, the PEM block containing it and the key usage for the certificate.
+func (b *RegistryBuilder) makeKey() (key crypto.Signer, block *pem.Block,
+	usage x509.KeyUsage, err error) {
+	switch b.keyAlgorithm {
+	case registryKeyAlgorithmRSA:
+		var rsaKey *rsa.PrivateKey
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			return
+		}
+		key = rsaKey
+		block = &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+		}
+		usage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	default:
+		var ecKey *ecdsa.PrivateKey
+		ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return
+		}
+		var data []byte
+		data, err = x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			return
+		}
+		key = ecKey
+		block = &pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: data,
+		}
+		usage = x509.KeyUsageDigitalSignature
+	}
 	return
 }
 
@@ -200,6 +766,15 @@ func (r *Registry) Address() string {
 	return r.listener.Addr().String()
 }
 
+// MetricsAddress returns the address where the registry serves the metrics. Returns an empty
+// string if the registry hasn't been configured to serve the metrics.
+func (r *Registry) MetricsAddress() string {
+	if r.metricsListener == nil {
+		return ""
+	}
+	return r.metricsListener.Addr().String()
+}
+
 // Root returns the root directory of the registry.
 func (r *Registry) Root() string {
 	return r.root
@@ -207,11 +782,22 @@ func (r *Registry) Root() string {
 
 // Certificate returns the TLS certificate and key used by the registry, in PEM format.
 func (r *Registry) Certificate() (cert, key []byte) {
+	if r.reloader != nil {
+		return r.reloader.current()
+	}
 	cert = slices.Clone(r.cert)
 	key = slices.Clone(r.key)
 	return
 }
 
+// Credentials returns the user name and password that clients must send, using basic
+// authentication. Both will be empty if the registry wasn't configured with credentials.
+func (r *Registry) Credentials() (username, password string) {
+	username = r.username
+	password = r.password
+	return
+}
+
 // Start starts the registry.
 func (r *Registry) Start(ctx context.Context) error {
 	var err error
@@ -224,37 +810,78 @@ func (r *Registry) Start(ctx context.Context) error {
 		logger: r.logger,
 	})
 
-	// Start the registry server:
-	certFile := filepath.Join(r.tmp, "tls.crt")
-	err = os.WriteFile(certFile, r.cert, 0400)
-	if err != nil {
-		return err
-	}
-	keyFile := filepath.Join(r.tmp, "tls.key")
-	err = os.WriteFile(keyFile, r.key, 0400)
-	if err != nil {
-		return err
+	// Write the TLS files to a temporary directory, unless they have been loaded from files:
+	var certFile, keyFile string
+	if r.reloader != nil {
+		certFile, keyFile = r.reloader.certFile, r.reloader.keyFile
+	} else {
+		certFile, keyFile, err = r.writeCertFiles()
+		if err != nil {
+			return err
+		}
 	}
+
+	// Start the registry server:
 	r.listener, err = net.Listen("tcp", r.address)
 	if err != nil {
 		return err
 	}
 	configObj := &dconfiguration.Configuration{}
-	configObj.Storage = dconfiguration.Storage{
-		"filesystem": dconfiguration.Parameters{
-			"rootdirectory": r.root,
-		},
+	configObj.Storage = dconfiguration.Storage{}
+	for name, parameters := range r.storage {
+		configObj.Storage[name] = parameters
+	}
+	if r.readOnly {
+		configObj.Storage["maintenance"] = dconfiguration.Parameters{
+			"readonly": map[any]any{
+				"enabled": true,
+			},
+		}
 	}
 	configObj.HTTP.Secret = "42"
 	configObj.HTTP.Addr = r.listener.Addr().String()
 	configObj.HTTP.TLS.Certificate = certFile
 	configObj.HTTP.TLS.Key = keyFile
-	configObj.Catalog.MaxEntries = 100
+	configObj.Catalog.MaxEntries = r.catalogMax
+	if r.htpasswd != "" {
+		configObj.Auth = dconfiguration.Auth{
+			"htpasswd": dconfiguration.Parameters{
+				"realm": registryAuthRealm,
+				"path":  r.htpasswd,
+			},
+		}
+	}
+	var handler http.Handler = dhandlers.NewApp(ctx, configObj)
+	if r.limiter != nil {
+		handler = &registryThrottleHandler{
+			handler: handler,
+			limiter: r.limiter,
+		}
+	}
+	if r.username != "" || r.token != "" {
+		handler = &registryAuthHandler{
+			handler:  handler,
+			username: r.username,
+			password: r.password,
+			token:    r.token,
+		}
+	}
+	handler = &registryCountingHandler{
+		handler:  handler,
+		requests: &r.requests,
+	}
+	handler = &registryMetricsHandler{
+		handler: handler,
+		metrics: r.metrics,
+	}
 	r.server = &http.Server{
-		Handler: dhandlers.NewApp(ctx, configObj),
+		Handler: handler,
 	}
-	if err != nil {
-		return err
+	if r.reloader != nil {
+		r.server.TLSConfig = &tls.Config{
+			GetCertificate: r.reloader.getCertificate,
+		}
+		certFile, keyFile = "", ""
 	}
 	go func() {
 		err = r.server.ServeTLS(r.listener, certFile, keyFile)
@@ -263,26 +890,352 @@ func (r *Registry) Start(ctx context.Context) error {
 		}
 	}()
 
+	// Start the metrics server:
+	if r.metricsAddr != "" {
+		err = r.startMetrics()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// startMetrics starts the server that serves the metrics of the registry.
+func (r *Registry) startMetrics() error {
+	var err error
+	r.metricsListener, err = net.Listen("tcp", r.metricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(registryMetricsPath, r.metrics.handler)
+	r.metricsServer = &http.Server{
+		Handler: mux,
+	}
+	go func() {
+		err := r.metricsServer.Serve(r.metricsListener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			r.logger.Error(err, "Failed to serve metrics")
+		}
+	}()
+	r.logger.Info(
+		"Serving metrics",
+		"address", r.metricsListener.Addr().String(),
+		"path", registryMetricsPath,
+	)
+	return nil
+}
+
+// writeCertFiles writes the TLS certificate and key to a temporary directory, as that is what the
+// registry server needs.
+func (r *Registry) writeCertFiles() (certFile, keyFile string, err error) {
+	r.tmp, err = os.MkdirTemp("", "*.registry")
+	if err != nil {
+		return
+	}
+	certFile = filepath.Join(r.tmp, registryCertFile)
+	err = os.WriteFile(certFile, r.cert, 0400)
+	if err != nil {
+		return
+	}
+	keyFile = filepath.Join(r.tmp, registryKeyFile)
+	err = os.WriteFile(keyFile, r.key, 0400)
+	return
+}
+
+// Requests returns the number of requests received by the registry since it was started. This is
+// used to check that clients are actually using the registry.
+func (r *Registry) Requests() int64 {
+	return r.requests.Load()
+}
+
 // Stop stops the registry.
 func (r *Registry) Stop(ctx context.Context) error {
-	// Shutdown the server:
+	// Shutdown the servers:
 	err := r.server.Shutdown(ctx)
 	if err != nil {
 		return err
 	}
+	if r.metricsServer != nil {
+		err = r.metricsServer.Shutdown(ctx)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Remore the temporary directory:
-	err = os.RemoveAll(r.tmp)
+	if r.tmp != "" {
+		err = os.RemoveAll(r.tmp)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GarbageCollect removes from the storage of the registry the blobs that aren't referenced by any
+// manifest and, optionally, the manifests that aren't referenced by any tag. Returns the number of
+// bytes reclaimed. The registry doesn't need to be started, but if it is then it must not be
+// receiving pushes, as the blobs of the images that are being pushed would be removed.
+func (r *Registry) GarbageCollect(ctx context.Context,
+	removeUntagged bool) (reclaimed int64, err error) {
+	if r.root == "" {
+		err = errors.New("garbage collection is only supported for the file system storage")
+		return
+	}
+
+	// The garbage collector fails if there are no repositories, but then there is nothing to
+	// collect anyhow:
+	storage := &registryStorage{
+		root: r.root,
+	}
+	_, err = os.Stat(filepath.Join(storage.v2Dir(), "repositories"))
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	}
 	if err != nil {
-		return err
+		return
+	}
+
+	before, err := r.storageSize()
+	if err != nil {
+		return
+	}
+	driver, err := dfilesystem.FromParameters(map[string]any{
+		"rootdirectory": r.root,
+	})
+	if err != nil {
+		return
+	}
+	namespace, err := dstorage.NewRegistry(ctx, driver)
+	if err != nil {
+		return
 	}
+	err = dstorage.MarkAndSweep(ctx, driver, namespace, dstorage.GCOpts{
+		RemoveUntagged: removeUntagged,
+	})
+	if err != nil {
+		return
+	}
+	after, err := r.storageSize()
+	if err != nil {
+		return
+	}
+	reclaimed = before - after
+	r.logger.Info(
+		"Collected garbage",
+		"root", r.root,
+		"before", before,
+		"after", after,
+		"reclaimed", reclaimed,
+	)
+	return
+}
 
+// storageSize calculates the total size of the files in the storage of the registry.
+func (r *Registry) storageSize() (result int64, err error) {
+	err = filepath.WalkDir(r.root, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		result += info.Size()
+		return nil
+	})
+	return
+}
+
+// registryCertReloader loads the TLS certificate and key from files, and loads them again when the
+// files change. This is intended for certificates mounted from Kubernetes secrets, where rotation
+// replaces the files without restarting the process.
+type registryCertReloader struct {
+	logger   logr.Logger
+	certFile string
+	keyFile  string
+	lock     sync.Mutex
+	modTime  time.Time
+	certPEM  []byte
+	keyPEM   []byte
+	pair     *tls.Certificate
+}
+
+// getCertificate returns the current certificate, loading it again if the files have changed.
+// Failures to load the new files are written to the log and the previous certificate is used.
+func (l *registryCertReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	modTime, err := l.modTimeLocked()
+	if err == nil && !modTime.Equal(l.modTime) {
+		err = l.loadLocked()
+		if err == nil {
+			l.logger.Info(
+				"Reloaded TLS certificate",
+				"cert", l.certFile,
+				"key", l.keyFile,
+			)
+		}
+	}
+	if err != nil {
+		l.logger.Error(
+			err,
+			"Failed to reload TLS certificate, will use the previous one",
+			"cert", l.certFile,
+			"key", l.keyFile,
+		)
+	}
+	return l.pair, nil
+}
+
+// current returns the PEM encoded certificate and key that are currently loaded.
+func (l *registryCertReloader) current() (cert, key []byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	cert = slices.Clone(l.certPEM)
+	key = slices.Clone(l.keyPEM)
+	return
+}
+
+// load loads the certificate and key from the files.
+func (l *registryCertReloader) load() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.loadLocked()
+}
+
+func (l *registryCertReloader) loadLocked() error {
+	modTime, err := l.modTimeLocked()
+	if err != nil {
+		return err
+	}
+	certPEM, err := os.ReadFile(l.certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := os.ReadFile(l.keyFile)
+	if err != nil {
+		return err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to load certificate '%s' and key '%s': %w",
+			l.certFile, l.keyFile, err,
+		)
+	}
+	l.modTime = modTime
+	l.certPEM = certPEM
+	l.keyPEM = keyPEM
+	l.pair = &pair
 	return nil
 }
 
+// modTimeLocked returns the most recent modification time of the certificate and key files. Note
+// that this follows symbolic links, so it detects the updates that Kubernetes does to mounted
+// secrets replacing the target of the links.
+func (l *registryCertReloader) modTimeLocked() (result time.Time, err error) {
+	for _, file := range []string{l.certFile, l.keyFile} {
+		var info fs.FileInfo
+		info, err = os.Stat(file)
+		if err != nil {
+			return
+		}
+		if info.ModTime().After(result) {
+			result = info.ModTime()
+		}
+	}
+	return
+}
+
+// registryThrottleHandler is an HTTP handler that limits the bandwidth used by the bodies of the
+// requests.
+type registryThrottleHandler struct {
+	handler http.Handler
+	limiter *rate.Limiter
+}
+
+func (h *registryThrottleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		r.Body = &registryThrottledBody{
+			Reader: ThrottleReader(r.Context(), r.Body, h.limiter),
+			Closer: r.Body,
+		}
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// registryCountingHandler is an HTTP handler that counts the requests.
+type registryCountingHandler struct {
+	handler  http.Handler
+	requests *atomic.Int64
+}
+
+func (h *registryCountingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.requests.Add(1)
+	h.handler.ServeHTTP(w, r)
+}
+
+// registryAuthHandler is an HTTP handler that rejects requests that don't contain the expected
+// basic authentication credentials or bearer token.
+type registryAuthHandler struct {
+	handler  http.Handler
+	username string
+	password string
+	token    string
+}
+
+func (h *registryAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.token != "" {
+		if !h.checkToken(r) {
+			h.sendChallenge(w, "Bearer")
+			return
+		}
+	} else {
+		username, password, ok := r.BasicAuth()
+		if !ok || !h.checkCredentials(username, password) {
+			h.sendChallenge(w, "Basic")
+			return
+		}
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+func (h *registryAuthHandler) sendChallenge(w http.ResponseWriter, scheme string) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("%s realm=%q", scheme, registryAuthRealm))
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func (h *registryAuthHandler) checkToken(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *registryAuthHandler) checkCredentials(username, password string) bool {
+	usernameOk := subtle.ConstantTimeCompare([]byte(username), []byte(h.username)) == 1
+	passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(h.password)) == 1
+	return usernameOk && passwordOk
+}
+
+type registryThrottledBody struct {
+	io.Reader
+	io.Closer
+}
+
 // registryLogrHook is a logrus hook that sends the log messages to a logr logger.
 type registryLogrHook struct {
 	logger logr.Logger
@@ -311,3 +1264,45 @@ func (h *registryLogrHook) Fire(entry *logrus.Entry) error {
 func (h *registryLogrHook) Levels() []logrus.Level {
 	return logrus.AllLevels
 }
+
+// registryDefaultCatalogMax is the default maximum number of repositories returned in each page of
+// the catalog. Releases contain close to 200 repositories, so this is enough to list all of them.
+const registryDefaultCatalogMax = 1000
+
+// registryDefaultCertValidity is the default validity of the generated certificate.
+const registryDefaultCertValidity = 365 * 24 * time.Hour
+
+// registryCertRenewMargin is the minimum remaining validity that a saved certificate needs to have
+// to be reused.
+const registryCertRenewMargin = 24 * time.Hour
+
+// Names of the files, inside the root directory, where the generated certificate and key are saved.
+const (
+	registryCertFile = "tls.crt"
+	registryKeyFile  = "tls.key"
+)
+
+// Algorithms of the key generated for the self signed certificate of the registry.
+const (
+	registryKeyAlgorithmECDSA = "ecdsa"
+	registryKeyAlgorithmRSA   = "rsa"
+)
+
+// registryAuthRealm is the realm sent to clients in authentication challenges.
+const registryAuthRealm = "upgrade-tool"
+
+// registryUsername is the user name used by the registries that the tool starts internally, with
+// randomly generated passwords.
+const registryUsername = "upgrade-tool"
+
+// makeRegistryPassword generates a random password for the registries that the tool starts
+// internally, so that other processes running in the same host can't use them.
+func makeRegistryPassword() (result string, err error) {
+	data := make([]byte, 32)
+	_, err = rand.Read(data)
+	if err != nil {
+		return
+	}
+	result = hex.EncodeToString(data)
+	return
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registryMetrics contains the Prometheus metrics of the registry. They are registered in a
+// registry owned by the image registry instead of the global one, so that multiple registries can
+// be created in the same process, for example in tests.
+type registryMetrics struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+	requests *prometheus.CounterVec
+	sent     *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+}
+
+func newRegistryMetrics() *registryMetrics {
+	registry := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: registryMetricsNamespace,
+			Subsystem: registryMetricsSubsystem,
+			Name:      "requests_total",
+			Help:      "Number of requests, per HTTP method and status code.",
+		},
+		[]string{"method", "code"},
+	)
+	sent := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: registryMetricsNamespace,
+			Subsystem: registryMetricsSubsystem,
+			Name:      "sent_bytes_total",
+			Help:      "Number of bytes sent to clients, per kind of object.",
+		},
+		[]string{"kind"},
+	)
+	failures := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: registryMetricsNamespace,
+			Subsystem: registryMetricsSubsystem,
+			Name:      "errors_total",
+			Help:      "Number of failed requests, per HTTP status code.",
+		},
+		[]string{"code"},
+	)
+	registry.MustRegister(
+		requests,
+		sent,
+		failures,
+	)
+	return &registryMetrics{
+		registry: registry,
+		handler:  promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		requests: requests,
+		sent:     sent,
+		errors:   failures,
+	}
+}
+
+// registryMetricsHandler is an HTTP handler that updates the metrics of the registry.
+type registryMetricsHandler struct {
+	handler http.Handler
+	metrics *registryMetrics
+}
+
+func (h *registryMetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writer := &registryResponseWriter{
+		ResponseWriter: w,
+		sent:           h.metrics.sent.WithLabelValues(registryObjectKind(r.URL.Path)),
+	}
+	h.handler.ServeHTTP(writer, r)
+	code := writer.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	text := strconv.Itoa(code)
+	h.metrics.requests.WithLabelValues(r.Method, text).Inc()
+	if code >= http.StatusBadRequest {
+		h.metrics.errors.WithLabelValues(text).Inc()
+	}
+}
+
+// registryResponseWriter wraps the response writer to save the status code and to count the bytes
+// sent.
+type registryResponseWriter struct {
+	http.ResponseWriter
+	sent prometheus.Counter
+	code int
+}
+
+func (w *registryResponseWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *registryResponseWriter) Write(data []byte) (n int, err error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err = w.ResponseWriter.Write(data)
+	w.sent.Add(float64(n))
+	return
+}
+
+// registryObjectKind returns the kind of object requested by the given path, 'blob', 'manifest' or
+// 'other'.
+func registryObjectKind(path string) string {
+	switch {
+	case strings.Contains(path, "/blobs/"):
+		return registryBlobKind
+	case strings.Contains(path, "/manifests/"):
+		return registryManifestKind
+	default:
+		return registryOtherKind
+	}
+}
+
+const (
+	registryMetricsPath      = "/metrics"
+	registryMetricsNamespace = "upgrade_tool"
+	registryMetricsSubsystem = "registry"
+
+	registryBlobKind     = "blob"
+	registryManifestKind = "manifest"
+	registryOtherKind    = "other"
+)
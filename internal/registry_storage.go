@@ -0,0 +1,204 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// registryStorage knows how to read and write the files used by the file system storage driver of
+// the image registry, so that images can be added to a bundle without running the registry. The
+// root is the directory passed as 'rootdirectory' to the registry.
+type registryStorage struct {
+	root string
+}
+
+// registryManifest contains the fields of image manifests and manifest lists that are needed to
+// find the blobs that they reference.
+type registryManifest struct {
+	MediaType string               `json:"mediaType,omitempty"`
+	Config    *registryDescriptor  `json:"config,omitempty"`
+	Layers    []registryDescriptor `json:"layers,omitempty"`
+	Manifests []registryDescriptor `json:"manifests,omitempty"`
+}
+
+type registryDescriptor struct {
+	MediaType string            `json:"mediaType,omitempty"`
+	Digest    godigest.Digest   `json:"digest"`
+	Size      int64             `json:"size"`
+	Platform  *registryPlatform `json:"platform,omitempty"`
+}
+
+type registryPlatform struct {
+	Architecture string `json:"architecture,omitempty"`
+	OS           string `json:"os,omitempty"`
+}
+
+func (s *registryStorage) v2Dir() string {
+	return filepath.Join(s.root, "docker", "registry", "v2")
+}
+
+func (s *registryStorage) blobFile(digest godigest.Digest) string {
+	return filepath.Join(
+		s.v2Dir(), "blobs", digest.Algorithm().String(), digest.Encoded()[0:2],
+		digest.Encoded(), "data",
+	)
+}
+
+func (s *registryStorage) repoDir(repo string) string {
+	return filepath.Join(s.v2Dir(), "repositories", filepath.FromSlash(repo))
+}
+
+// hasBlob checks if the storage contains the blob with the given digest.
+func (s *registryStorage) hasBlob(digest godigest.Digest) (result bool, err error) {
+	_, err = os.Stat(s.blobFile(digest))
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	result = true
+	return
+}
+
+// readBlob returns the complete content of the blob with the given digest.
+func (s *registryStorage) readBlob(digest godigest.Digest) ([]byte, error) {
+	return os.ReadFile(s.blobFile(digest))
+}
+
+// writeBlob copies the data from the given reader to the blob with the given digest, checking
+// that the digest of the data matches. The blob is first written to a temporary file, so that
+// partially written blobs are never visible.
+func (s *registryStorage) writeBlob(digest godigest.Digest, reader io.Reader) (err error) {
+	err = digest.Validate()
+	if err != nil {
+		return
+	}
+	file := s.blobFile(digest)
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), "*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	verifier := digest.Verifier()
+	_, err = io.Copy(io.MultiWriter(tmp, verifier), reader)
+	if err != nil {
+		return
+	}
+	if !verifier.Verified() {
+		err = fmt.Errorf("content of blob '%s' doesn't match its digest", digest)
+		return
+	}
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), file)
+	return
+}
+
+// readManifest reads and parses the manifest or manifest list with the given digest.
+func (s *registryStorage) readManifest(digest godigest.Digest) (result *registryManifest,
+	err error) {
+	data, err := s.readBlob(digest)
+	if err != nil {
+		return
+	}
+	var manifest registryManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		err = fmt.Errorf("failed to parse manifest '%s': %w", digest, err)
+		return
+	}
+	result = &manifest
+	return
+}
+
+// linkLayer makes the blob with the given digest accessible from the given repository.
+func (s *registryStorage) linkLayer(repo string, digest godigest.Digest) error {
+	return s.writeLink(
+		filepath.Join(
+			s.repoDir(repo), "_layers", digest.Algorithm().String(),
+			digest.Encoded(), "link",
+		),
+		digest,
+	)
+}
+
+// linkManifest makes the manifest with the given digest accessible from the given repository.
+func (s *registryStorage) linkManifest(repo string, digest godigest.Digest) error {
+	return s.writeLink(
+		filepath.Join(
+			s.repoDir(repo), "_manifests", "revisions", digest.Algorithm().String(),
+			digest.Encoded(), "link",
+		),
+		digest,
+	)
+}
+
+// tagManifest makes the given tag of the given repository point to the manifest with the given
+// digest.
+func (s *registryStorage) tagManifest(repo, tag string, digest godigest.Digest) error {
+	dir := filepath.Join(s.repoDir(repo), "_manifests", "tags", tag)
+	err := s.writeLink(filepath.Join(dir, "current", "link"), digest)
+	if err != nil {
+		return err
+	}
+	return s.writeLink(
+		filepath.Join(
+			dir, "index", digest.Algorithm().String(), digest.Encoded(), "link",
+		),
+		digest,
+	)
+}
+
+// readTag returns the digest of the manifest that the given tag of the given repository points to.
+func (s *registryStorage) readTag(repo, tag string) (result godigest.Digest, err error) {
+	data, err := os.ReadFile(filepath.Join(
+		s.repoDir(repo), "_manifests", "tags", tag, "current", "link",
+	))
+	if err != nil {
+		return
+	}
+	result, err = godigest.Parse(strings.TrimSpace(string(data)))
+	return
+}
+
+func (s *registryStorage) writeLink(file string, digest godigest.Digest) error {
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, []byte(digest.String()), 0600)
+}
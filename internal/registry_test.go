@@ -0,0 +1,716 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	godigest "github.com/opencontainers/go-digest"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Registry", func() {
+	var logger logr.Logger
+
+	BeforeEach(func() {
+		var err error
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Requires password when user name is set", func() {
+		_, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("localhost:0").
+			SetRoot("/var/lib/upgrade").
+			SetCertificate([]byte("cert"), []byte("key")).
+			SetCredentials("my-user", "").
+			Build()
+		Expect(err).To(MatchError("password is mandatory when user name is set"))
+	})
+
+	It("Rejects multiple authentication options", func() {
+		_, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("localhost:0").
+			SetRoot("/var/lib/upgrade").
+			SetCertificate([]byte("cert"), []byte("key")).
+			SetCredentials("my-user", "my-password").
+			SetTokenFile("/etc/token").
+			Build()
+		Expect(err).To(MatchError(
+			"credentials, htpasswd file and token file are mutually exclusive",
+		))
+	})
+
+	It("Rejects htpasswd file that doesn't exist", func() {
+		_, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("localhost:0").
+			SetRoot("/var/lib/upgrade").
+			SetCertificate([]byte("cert"), []byte("key")).
+			SetHtpasswdFile("/does/not/exist").
+			Build()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Authenticates with htpasswd file", func() {
+		// Create the htpasswd file:
+		tmp, err := os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		htpasswd := filepath.Join(tmp, "htpasswd")
+		err = os.WriteFile(
+			htpasswd,
+			[]byte("my-user:$2a$04$NaXL.QbVcXATHe2JCIVqMOdzNyKmGO54INQHn.gT67KeHLSao50ni\n"),
+			0600,
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Start the registry:
+		ctx := context.Background()
+		registry, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("127.0.0.1:0").
+			SetRoot(filepath.Join(tmp, "root")).
+			SetHtpasswdFile(htpasswd).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		err = registry.Start(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(registry.Stop, ctx)
+
+		// Send requests with and without credentials:
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+			},
+		}
+		url := "https://" + registry.Address() + "/v2/"
+		response, err := client.Get(url)
+		Expect(err).ToNot(HaveOccurred())
+		response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+		request, err := http.NewRequest(http.MethodGet, url, nil)
+		Expect(err).ToNot(HaveOccurred())
+		request.SetBasicAuth("my-user", "my-password")
+		response, err = client.Do(request)
+		Expect(err).ToNot(HaveOccurred())
+		response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("Removes unreferenced blobs when collecting garbage", func() {
+		// Create a storage with one image and one orphaned blob:
+		ctx := context.Background()
+		tmp, err := os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		storage := &registryStorage{
+			root: tmp,
+		}
+		write := func(data []byte) godigest.Digest {
+			digest := godigest.FromBytes(data)
+			err := storage.writeBlob(digest, bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+			return digest
+		}
+		layer := []byte("layer")
+		layerDigest := write(layer)
+		config := []byte(`{"architecture":"amd64"}`)
+		configDigest := write(config)
+		manifest, err := json.Marshal(map[string]any{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+			"config": map[string]any{
+				"mediaType": "application/vnd.docker.container.image.v1+json",
+				"digest":    configDigest,
+				"size":      len(config),
+			},
+			"layers": []any{
+				map[string]any{
+					"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+					"digest":    layerDigest,
+					"size":      len(layer),
+				},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		manifestDigest := write(manifest)
+		for _, digest := range []godigest.Digest{layerDigest, configDigest} {
+			err = storage.linkLayer("my-repo", digest)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		err = storage.linkManifest("my-repo", manifestDigest)
+		Expect(err).ToNot(HaveOccurred())
+		err = storage.tagManifest("my-repo", "latest", manifestDigest)
+		Expect(err).ToNot(HaveOccurred())
+		orphan := []byte("orphan")
+		orphanDigest := write(orphan)
+
+		// Collect the garbage:
+		registry, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("127.0.0.1:0").
+			SetRoot(tmp).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		reclaimed, err := registry.GarbageCollect(ctx, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reclaimed).To(BeNumerically(">=", len(orphan)))
+
+		// Check that only the orphaned blob has been removed:
+		for _, digest := range []godigest.Digest{layerDigest, configDigest, manifestDigest} {
+			exists, err := storage.hasBlob(digest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeTrue())
+		}
+		exists, err := storage.hasBlob(orphanDigest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(exists).To(BeFalse())
+	})
+
+	It("Rejects pushes in read only mode", func() {
+		ctx := context.Background()
+		tmp, err := os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		registry, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("127.0.0.1:0").
+			SetRoot(tmp).
+			SetReadOnly(true).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		err = registry.Start(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(registry.Stop, ctx)
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+			},
+		}
+		base := "https://" + registry.Address() + "/v2/"
+		response, err := client.Get(base)
+		Expect(err).ToNot(HaveOccurred())
+		response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		response, err = client.Post(base+"my-repo/blobs/uploads/", "", nil)
+		Expect(err).ToNot(HaveOccurred())
+		response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	It("Serves metrics", func() {
+		ctx := context.Background()
+		tmp, err := os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		registry, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("127.0.0.1:0").
+			SetRoot(tmp).
+			SetMetricsAddress("127.0.0.1:0").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		err = registry.Start(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(registry.Stop, ctx)
+
+		// Send a request that succeeds and another that fails:
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+			},
+		}
+		base := "https://" + registry.Address() + "/v2/"
+		for _, path := range []string{"", "my-repo/manifests/latest"} {
+			response, err := client.Get(base + path)
+			Expect(err).ToNot(HaveOccurred())
+			response.Body.Close()
+		}
+
+		// Check the metrics:
+		response, err := http.Get("http://" + registry.MetricsAddress() + "/metrics")
+		Expect(err).ToNot(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		data, err := io.ReadAll(response.Body)
+		Expect(err).ToNot(HaveOccurred())
+		text := string(data)
+		Expect(text).To(ContainSubstring(
+			`upgrade_tool_registry_requests_total{code="200",method="GET"} 1`,
+		))
+		Expect(text).To(ContainSubstring(
+			`upgrade_tool_registry_errors_total{code="404"} 1`,
+		))
+		Expect(text).To(ContainSubstring(
+			`upgrade_tool_registry_sent_bytes_total{kind="manifest"}`,
+		))
+	})
+
+	It("Returns more than 100 repositories in the catalog", func() {
+		// Create a storage with 150 repositories:
+		ctx := context.Background()
+		tmp, err := os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		storage := &registryStorage{
+			root: tmp,
+		}
+		digest := godigest.FromString("manifest")
+		for i := 0; i < 150; i++ {
+			err = storage.linkManifest(fmt.Sprintf("my-repo-%03d", i), digest)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		// Start the registry:
+		registry, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("127.0.0.1:0").
+			SetRoot(tmp).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		err = registry.Start(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(registry.Stop, ctx)
+
+		// Get the catalog:
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+			},
+		}
+		response, err := client.Get("https://" + registry.Address() + "/v2/_catalog?n=200")
+		Expect(err).ToNot(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		var catalog struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&catalog)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(catalog.Repositories).To(HaveLen(150))
+	})
+
+	It("Rejects catalog maximum entries that isn't positive", func() {
+		_, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("localhost:0").
+			SetRoot("/var/lib/upgrade").
+			SetCertificate([]byte("cert"), []byte("key")).
+			SetCatalogMaxEntries(0).
+			Build()
+		Expect(err).To(MatchError(
+			"catalog maximum entries 0 isn't valid, it must be greater than zero",
+		))
+	})
+
+	It("Rejects root and S3 storage together", func() {
+		_, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("localhost:0").
+			SetRoot("/var/lib/upgrade").
+			SetS3Storage("s3://my-bucket/my-prefix").
+			SetCertificate([]byte("cert"), []byte("key")).
+			Build()
+		Expect(err).To(MatchError("root and S3 storage are mutually exclusive"))
+	})
+
+	It("Rejects S3 storage that isn't an S3 URL", func() {
+		_, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("localhost:0").
+			SetS3Storage("https://my-bucket/my-prefix").
+			SetCertificate([]byte("cert"), []byte("key")).
+			Build()
+		Expect(err).To(MatchError(
+			"S3 storage 'https://my-bucket/my-prefix' should have the form " +
+				"'s3://bucket/prefix'",
+		))
+	})
+
+	It("Configures the S3 storage driver", func() {
+		// Write the credentials:
+		tmp, err := os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		files := map[string]string{
+			s3AccessKeyIDFile:     "my-key\n",
+			s3SecretAccessKeyFile: "my-secret\n",
+			s3EndpointFile:        "https://minio.example.com\n",
+		}
+		for name, value := range files {
+			err = os.WriteFile(filepath.Join(tmp, name), []byte(value), 0600)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		// Create the registry:
+		registry, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("localhost:0").
+			SetS3Storage("s3://my-bucket/my-prefix").
+			SetS3CredentialsDir(tmp).
+			SetCertificate([]byte("cert"), []byte("key")).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(registry.storage).To(HaveKey("s3"))
+		parameters := registry.storage.Parameters()
+		Expect(parameters).To(HaveKeyWithValue("bucket", "my-bucket"))
+		Expect(parameters).To(HaveKeyWithValue("rootdirectory", "/my-prefix"))
+		Expect(parameters).To(HaveKeyWithValue("accesskey", "my-key"))
+		Expect(parameters).To(HaveKeyWithValue("secretkey", "my-secret"))
+		Expect(parameters).To(HaveKeyWithValue("regionendpoint", "https://minio.example.com"))
+		Expect(parameters).To(HaveKeyWithValue("region", "us-east-1"))
+	})
+
+	It("Generates ECDSA key by default", func() {
+		builder := &RegistryBuilder{
+			address:      "127.0.0.1:0",
+			keyAlgorithm: registryKeyAlgorithmECDSA,
+		}
+		cert, key, err := builder.makeSelfSignedCert()
+		Expect(err).ToNot(HaveOccurred())
+		pair, err := tls.X509KeyPair(cert, key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pair.PrivateKey).To(BeAssignableToTypeOf(&ecdsa.PrivateKey{}))
+	})
+
+	It("Generates RSA key when requested", func() {
+		builder := &RegistryBuilder{
+			address:      "127.0.0.1:0",
+			keyAlgorithm: registryKeyAlgorithmRSA,
+		}
+		cert, key, err := builder.makeSelfSignedCert()
+		Expect(err).ToNot(HaveOccurred())
+		pair, err := tls.X509KeyPair(cert, key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pair.PrivateKey).To(BeAssignableToTypeOf(&rsa.PrivateKey{}))
+	})
+
+	It("Adds names and validity to the generated certificate", func() {
+		builder := &RegistryBuilder{
+			address:      "127.0.0.1:0",
+			keyAlgorithm: registryKeyAlgorithmECDSA,
+			certValidity: time.Hour,
+			certNames: []string{
+				"registry.example.com",
+				"192.168.1.1",
+			},
+		}
+		data, _, err := builder.makeSelfSignedCert()
+		Expect(err).ToNot(HaveOccurred())
+		block, _ := pem.Decode(data)
+		Expect(block).ToNot(BeNil())
+		cert, err := x509.ParseCertificate(block.Bytes)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cert.DNSNames).To(ContainElement("registry.example.com"))
+		Expect(cert.IPAddresses).To(ContainElement(net.ParseIP("192.168.1.1").To4()))
+		Expect(cert.NotAfter.Sub(cert.NotBefore)).To(Equal(time.Hour))
+	})
+
+	It("Signs the generated certificate with the CA", func() {
+		// Generate the CA:
+		caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		now := time.Now()
+		caSpec := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject: pkix.Name{
+				CommonName: "my-ca",
+			},
+			NotBefore:             now,
+			NotAfter:              now.Add(24 * time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		caData, err := x509.CreateCertificate(rand.Reader, caSpec, caSpec, &caKey.PublicKey, caKey)
+		Expect(err).ToNot(HaveOccurred())
+		caKeyData, err := x509.MarshalECPrivateKey(caKey)
+		Expect(err).ToNot(HaveOccurred())
+		caCertPEM := pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: caData,
+		})
+		caKeyPEM := pem.EncodeToMemory(&pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: caKeyData,
+		})
+
+		// Generate the certificate:
+		builder := &RegistryBuilder{
+			address:      "127.0.0.1:0",
+			keyAlgorithm: registryKeyAlgorithmECDSA,
+			certValidity: registryDefaultCertValidity,
+			caCert:       caCertPEM,
+			caKey:        caKeyPEM,
+		}
+		data, _, err := builder.makeSelfSignedCert()
+		Expect(err).ToNot(HaveOccurred())
+		block, _ := pem.Decode(data)
+		Expect(block).ToNot(BeNil())
+		cert, err := x509.ParseCertificate(block.Bytes)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Verify that it is signed by the CA, and that it doesn't outlive it:
+		pool := x509.NewCertPool()
+		Expect(pool.AppendCertsFromPEM(caCertPEM)).To(BeTrue())
+		_, err = cert.Verify(x509.VerifyOptions{
+			Roots: pool,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cert.NotAfter).To(BeTemporally("<=", now.Add(24*time.Hour), time.Second))
+	})
+
+	It("Reuses the saved certificate", func() {
+		tmp, err := os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		build := func(names ...string) *Registry {
+			registry, err := NewRegistry().
+				SetLogger(logger).
+				SetAddress("127.0.0.1:0").
+				SetRoot(tmp).
+				AddCertificateNames(names...).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			return registry
+		}
+
+		// The first registry generates and saves the certificate:
+		first := build()
+		firstCert, firstKey := first.Certificate()
+		Expect(filepath.Join(tmp, registryCertFile)).To(BeARegularFile())
+		Expect(filepath.Join(tmp, registryKeyFile)).To(BeARegularFile())
+
+		// The second registry reuses it:
+		second := build()
+		secondCert, secondKey := second.Certificate()
+		Expect(secondCert).To(Equal(firstCert))
+		Expect(secondKey).To(Equal(firstKey))
+
+		// The third registry needs an additional name, so it generates a new one:
+		third := build("registry.example.com")
+		thirdCert, _ := third.Certificate()
+		Expect(thirdCert).ToNot(Equal(firstCert))
+	})
+
+	It("Regenerates the saved certificate when it is about to expire", func() {
+		tmp, err := os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		build := func(validity time.Duration) *Registry {
+			registry, err := NewRegistry().
+				SetLogger(logger).
+				SetAddress("127.0.0.1:0").
+				SetRoot(tmp).
+				SetCertificateValidity(validity).
+				Build()
+			Expect(err).ToNot(HaveOccurred())
+			return registry
+		}
+		first := build(time.Hour)
+		firstCert, _ := first.Certificate()
+		second := build(time.Hour)
+		secondCert, _ := second.Certificate()
+		Expect(secondCert).ToNot(Equal(firstCert))
+	})
+
+	It("Rejects CA together with certificate", func() {
+		_, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("localhost:0").
+			SetRoot("/var/lib/upgrade").
+			SetCertificate([]byte("cert"), []byte("key")).
+			SetCA([]byte("ca-cert"), []byte("ca-key")).
+			Build()
+		Expect(err).To(MatchError("CA and certificate are mutually exclusive"))
+	})
+
+	It("Rejects key algorithm that isn't supported", func() {
+		_, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("localhost:0").
+			SetRoot("/var/lib/upgrade").
+			SetKeyAlgorithm("dsa").
+			Build()
+		Expect(err).To(MatchError(
+			"key algorithm 'dsa' isn't valid, it must be 'ecdsa' or 'rsa'",
+		))
+	})
+
+	It("Reloads the certificate when the files change", func() {
+		// Write the initial certificate:
+		tmp, err := os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		certFile := filepath.Join(tmp, "tls.crt")
+		keyFile := filepath.Join(tmp, "tls.key")
+		writeCert := func(modTime time.Time) []byte {
+			builder := &RegistryBuilder{
+				address: "127.0.0.1:0",
+			}
+			cert, key, err := builder.makeSelfSignedCert()
+			Expect(err).ToNot(HaveOccurred())
+			for file, data := range map[string][]byte{certFile: cert, keyFile: key} {
+				err = os.WriteFile(file, data, 0600)
+				Expect(err).ToNot(HaveOccurred())
+				err = os.Chtimes(file, modTime, modTime)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			return cert
+		}
+		first := writeCert(time.Now().Add(-time.Hour))
+		registry, err := NewRegistry().
+			SetLogger(logger).
+			SetAddress("127.0.0.1:0").
+			SetRoot(tmp).
+			SetCertificateFiles(certFile, keyFile).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		cert, _ := registry.Certificate()
+		Expect(cert).To(Equal(first))
+
+		// Replace the certificate and check that it is loaded again:
+		second := writeCert(time.Now())
+		pair, err := registry.reloader.getCertificate(nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pair).ToNot(BeNil())
+		cert, _ = registry.Certificate()
+		Expect(cert).To(Equal(second))
+
+		// Write garbage and check that the previous certificate is kept:
+		err = os.WriteFile(certFile, []byte("junk"), 0600)
+		Expect(err).ToNot(HaveOccurred())
+		pair, err = registry.reloader.getCertificate(nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pair).ToNot(BeNil())
+		cert, _ = registry.Certificate()
+		Expect(cert).To(Equal(second))
+	})
+
+	Describe("Authentication", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewServer(&registryAuthHandler{
+				handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				}),
+				username: "my-user",
+				password: "my-password",
+			})
+			DeferCleanup(server.Close)
+		})
+
+		It("Accepts request with the right credentials", func() {
+			request, err := http.NewRequest(http.MethodGet, server.URL+"/v2/", nil)
+			Expect(err).ToNot(HaveOccurred())
+			request.SetBasicAuth("my-user", "my-password")
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).ToNot(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("Rejects request without credentials", func() {
+			response, err := http.Get(server.URL + "/v2/")
+			Expect(err).ToNot(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(response.Header.Get("WWW-Authenticate")).To(HavePrefix("Basic "))
+		})
+
+		It("Rejects request with wrong password", func() {
+			request, err := http.NewRequest(http.MethodGet, server.URL+"/v2/", nil)
+			Expect(err).ToNot(HaveOccurred())
+			request.SetBasicAuth("my-user", "wrong")
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).ToNot(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Describe("Token authentication", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewServer(&registryAuthHandler{
+				handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				}),
+				token: "my-token",
+			})
+			DeferCleanup(server.Close)
+		})
+
+		It("Accepts request with the right token", func() {
+			request, err := http.NewRequest(http.MethodGet, server.URL+"/v2/", nil)
+			Expect(err).ToNot(HaveOccurred())
+			request.Header.Set("Authorization", "Bearer my-token")
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).ToNot(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("Rejects request with wrong token", func() {
+			request, err := http.NewRequest(http.MethodGet, server.URL+"/v2/", nil)
+			Expect(err).ToNot(HaveOccurred())
+			request.Header.Set("Authorization", "Bearer wrong")
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).ToNot(HaveOccurred())
+			defer response.Body.Close()
+			Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(response.Header.Get("WWW-Authenticate")).To(HavePrefix("Bearer "))
+		})
+	})
+})
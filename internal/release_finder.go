@@ -0,0 +1,120 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+
+	"github.com/go-logr/logr"
+
+	jqtool "github.com/jhernand/upgrade-tool/internal/jq"
+)
+
+// releaseFinder knows how to find the reference of a release image and the references of its
+// payload images using the 'oc adm release info' command.
+type releaseFinder struct {
+	logger       logr.Logger
+	jq           *jqtool.Tool
+	retrier      *Retrier
+	releaseRepo  string
+	version      string
+	arch         string
+	distribution string
+
+	// oc is the path of the 'oc' binary. If empty it will be searched in the path.
+	oc string
+}
+
+// find returns the reference of the release image, using the digest instead of the tag, and a
+// map containing the names of the payload images and their references.
+func (f *releaseFinder) find(ctx context.Context) (release string, images map[string]string,
+	err error) {
+	args := []string{
+		"adm", "release", "info",
+		"--output=json",
+	}
+	switch f.distribution {
+	case DistributionOKD:
+		// OKD release tags don't contain the architecture, so we need to tell the 'oc'
+		// command what architecture to select in case the release is a manifest list:
+		release = fmt.Sprintf("%s:%s", f.releaseRepo, f.version)
+		osArch, ok := distributionOSArchs[f.arch]
+		if ok {
+			args = append(args, fmt.Sprintf("--filter-by-os=linux/%s", osArch))
+		}
+	default:
+		release = fmt.Sprintf("%s:%s-%s", f.releaseRepo, f.version, f.arch)
+	}
+	args = append(args, release)
+	path := f.oc
+	if path == "" {
+		path, err = exec.LookPath("oc")
+		if err != nil {
+			return
+		}
+	}
+	stdout := &bytes.Buffer{}
+	err = f.retrier.Do(ctx, "release inspection", func(ctx context.Context) error {
+		stdout.Reset()
+		stderr := &bytes.Buffer{}
+		cmd := exec.CommandContext(ctx, path, args...)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		err := cmd.Run()
+		f.logger.Info(
+			"Executed 'oc' command",
+			"args", cmd.Args,
+			"stdout", cmd.String(),
+			"stderr", cmd.String(),
+			"code", cmd.ProcessState.ExitCode(),
+		)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	var digest string
+	err = f.jq.QueryBytes(
+		`.digest`,
+		stdout.Bytes(), &digest,
+	)
+	if err != nil {
+		return
+	}
+	release = fmt.Sprintf("%s@%s", f.releaseRepo, digest)
+	type Tag struct {
+		Tag string `json:"tag"`
+		Ref string `json:"ref"`
+	}
+	var tags []Tag
+	err = f.jq.QueryBytes(
+		`[.references.spec.tags[] | {
+			"tag": .name,
+			"ref": .from.name
+		}]`,
+		stdout.Bytes(), &tags,
+	)
+	if err != nil {
+		return
+	}
+	images = map[string]string{}
+	for _, tag := range tags {
+		images[tag.Tag] = tag.Ref
+	}
+	return
+}
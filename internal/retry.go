@@ -0,0 +1,188 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// RetrierBuilder contains the data and logic needed to create a retrier. Don't create instances of
+// this type directly, use the NewRetrier function instead.
+type RetrierBuilder struct {
+	logger   logr.Logger
+	attempts int
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+// Retrier knows how to execute a task repeatedly, waiting an exponentially increasing time between
+// attempts, till it succeeds or the number of attempts is exhausted. Don't create instances of
+// this type directly, use the NewRetrier function instead.
+type Retrier struct {
+	logger   logr.Logger
+	attempts int
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+// NewRetrier creates a builder that can then be used to configure and create retriers.
+func NewRetrier() *RetrierBuilder {
+	return &RetrierBuilder{
+		attempts: 5,
+		delay:    10 * time.Second,
+		maxDelay: 5 * time.Minute,
+	}
+}
+
+// SetLogger sets the logger that the retrier will use to write log messages. This is mandatory.
+func (b *RetrierBuilder) SetLogger(value logr.Logger) *RetrierBuilder {
+	b.logger = value
+	return b
+}
+
+// SetAttempts sets the maximum number of times that the task will be executed, including the first
+// one. This is optional and the default is five. A value of one disables retries.
+func (b *RetrierBuilder) SetAttempts(value int) *RetrierBuilder {
+	b.attempts = value
+	return b
+}
+
+// SetDelay sets the time to wait after the first failure. The time will be doubled after each
+// subsequent failure. This is optional and the default is ten seconds.
+func (b *RetrierBuilder) SetDelay(value time.Duration) *RetrierBuilder {
+	b.delay = value
+	return b
+}
+
+// SetMaxDelay sets the maximum time to wait between attempts. This is optional and the default is
+// five minutes.
+func (b *RetrierBuilder) SetMaxDelay(value time.Duration) *RetrierBuilder {
+	b.maxDelay = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new retrier.
+func (b *RetrierBuilder) Build() (result *Retrier, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+	if b.attempts < 1 {
+		err = fmt.Errorf(
+			"number of attempts %d isn't valid, it must be greater than zero",
+			b.attempts,
+		)
+		return
+	}
+	if b.delay < 0 {
+		err = fmt.Errorf(
+			"delay %s isn't valid, it must be greater than or equal to zero",
+			b.delay,
+		)
+		return
+	}
+	if b.maxDelay < b.delay {
+		err = fmt.Errorf(
+			"maximum delay %s isn't valid, it must be greater than or equal to the "+
+				"delay %s",
+			b.maxDelay, b.delay,
+		)
+		return
+	}
+
+	// Create and populate the object:
+	result = &Retrier{
+		logger:   b.logger,
+		attempts: b.attempts,
+		delay:    b.delay,
+		maxDelay: b.maxDelay,
+	}
+	return
+}
+
+// Do executes the given task till it succeeds, till it returns an error created with the
+// StopRetrying function, till the number of attempts is exhausted or till the context is
+// cancelled. The name is used only in the log messages. Returns the error of the last attempt.
+func (r *Retrier) Do(ctx context.Context, name string, task func(ctx context.Context) error) error {
+	delay := r.delay
+	for attempt := 1; ; attempt++ {
+		err := task(ctx)
+		if err == nil {
+			if attempt > 1 {
+				r.logger.Info(
+					"Task succeeded after retrying",
+					"task", name,
+					"attempt", attempt,
+				)
+			}
+			return nil
+		}
+		var stop *retrierStopError
+		if errors.As(err, &stop) {
+			return stop.err
+		}
+		if attempt >= r.attempts {
+			return fmt.Errorf("%s failed after %d attempts: %w", name, attempt, err)
+		}
+		r.logger.Error(
+			err,
+			"Task failed, will try again",
+			"task", name,
+			"attempt", attempt,
+			"attempts", r.attempts,
+			"delay", delay.String(),
+		)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		delay *= 2
+		if delay > r.maxDelay {
+			delay = r.maxDelay
+		}
+	}
+}
+
+// StopRetrying wraps the given error so that when it is returned by a task executed by a retrier
+// the retrier will not try again, and will return the original error.
+func StopRetrying(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retrierStopError{
+		err: err,
+	}
+}
+
+type retrierStopError struct {
+	err error
+}
+
+func (e *retrierStopError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retrierStopError) Unwrap() error {
+	return e.err
+}
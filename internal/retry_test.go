@@ -0,0 +1,142 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Retrier", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Can't be created with zero attempts", func() {
+		retrier, err := NewRetrier().
+			SetLogger(logger).
+			SetAttempts(0).
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(retrier).To(BeNil())
+	})
+
+	It("Doesn't retry if the task succeeds", func() {
+		retrier, err := NewRetrier().
+			SetLogger(logger).
+			SetDelay(time.Millisecond).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		calls := 0
+		err = retrier.Do(ctx, "test", func(ctx context.Context) error {
+			calls++
+			return nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(calls).To(Equal(1))
+	})
+
+	It("Retries till the task succeeds", func() {
+		retrier, err := NewRetrier().
+			SetLogger(logger).
+			SetAttempts(5).
+			SetDelay(time.Millisecond).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		calls := 0
+		err = retrier.Do(ctx, "test", func(ctx context.Context) error {
+			calls++
+			if calls < 3 {
+				return errors.New("myerror")
+			}
+			return nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(calls).To(Equal(3))
+	})
+
+	It("Returns the last error when attempts are exhausted", func() {
+		retrier, err := NewRetrier().
+			SetLogger(logger).
+			SetAttempts(3).
+			SetDelay(time.Millisecond).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		calls := 0
+		myerr := errors.New("myerror")
+		err = retrier.Do(ctx, "test", func(ctx context.Context) error {
+			calls++
+			return myerr
+		})
+		Expect(err).To(MatchError(myerr))
+		Expect(calls).To(Equal(3))
+	})
+
+	It("Doesn't retry permanent errors", func() {
+		retrier, err := NewRetrier().
+			SetLogger(logger).
+			SetDelay(time.Millisecond).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		calls := 0
+		myerr := errors.New("myerror")
+		err = retrier.Do(ctx, "test", func(ctx context.Context) error {
+			calls++
+			return StopRetrying(myerr)
+		})
+		Expect(err).To(BeIdenticalTo(myerr))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("Stops when the context is cancelled", func() {
+		retrier, err := NewRetrier().
+			SetLogger(logger).
+			SetDelay(time.Hour).
+			SetMaxDelay(time.Hour).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		ctx, cancel := context.WithCancel(ctx)
+		calls := 0
+		err = retrier.Do(ctx, "test", func(ctx context.Context) error {
+			calls++
+			cancel()
+			return errors.New("myerror")
+		})
+		Expect(err).To(MatchError(context.Canceled))
+		Expect(calls).To(Equal(1))
+	})
+})
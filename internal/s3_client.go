@@ -0,0 +1,256 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3Client knows how to calculate the URLs of objects stored in an S3 compatible object store, how
+// to sign the requests that download them using the AWS signature version 4, and how to upload
+// files using the AWS SDK.
+type s3Client struct {
+	endpoint        *url.URL
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// newS3Client creates a client for the given endpoint and region. The credentials are read from
+// the given directory, which usually is a secret mounted as a volume. The directory should contain
+// the files 'access-key-id' and 'secret-access-key', and optionally 'session-token'. It can also
+// contain the 'endpoint' and 'region' files, which are used when the endpoint or region passed as
+// parameters are empty. If the directory is empty requests will not be signed, which is only
+// useful for public buckets.
+func newS3Client(endpoint, region, credentialsDir string) (result *s3Client, err error) {
+	result = &s3Client{}
+	if credentialsDir != "" {
+		var values map[string]string
+		values, err = readS3Files(credentialsDir)
+		if err != nil {
+			return
+		}
+		result.accessKeyID = values[s3AccessKeyIDFile]
+		result.secretAccessKey = values[s3SecretAccessKeyFile]
+		result.sessionToken = values[s3SessionTokenFile]
+		if result.accessKeyID == "" || result.secretAccessKey == "" {
+			err = fmt.Errorf(
+				"credentials directory '%s' must contain the '%s' and '%s' files",
+				credentialsDir, s3AccessKeyIDFile, s3SecretAccessKeyFile,
+			)
+			return
+		}
+		if endpoint == "" {
+			endpoint = values[s3EndpointFile]
+		}
+		if region == "" {
+			region = values[s3RegionFile]
+		}
+	}
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	result.endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return
+	}
+	if result.endpoint.Scheme != "http" && result.endpoint.Scheme != "https" {
+		err = fmt.Errorf(
+			"endpoint '%s' isn't valid, scheme should be 'http' or 'https'",
+			endpoint,
+		)
+		return
+	}
+	result.region = region
+	return
+}
+
+func readS3Files(dir string) (result map[string]string, err error) {
+	result = map[string]string{}
+	names := []string{
+		s3AccessKeyIDFile,
+		s3SecretAccessKeyFile,
+		s3SessionTokenFile,
+		s3EndpointFile,
+		s3RegionFile,
+	}
+	for _, name := range names {
+		var data []byte
+		data, err = os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		result[name] = strings.TrimSpace(string(data))
+	}
+	return
+}
+
+// objectURL converts an URL like 's3://bucket/key' into the HTTP URL of the object, using path
+// style addressing, as that is what most S3 compatible object stores support.
+func (c *s3Client) objectURL(value string) (result string, err error) {
+	bucket, key, err := s3SplitURL(value)
+	if err != nil {
+		return
+	}
+	object := *c.endpoint
+	object.Path = strings.TrimSuffix(object.Path, "/") + "/" + bucket + "/" + key
+	object.RawPath = ""
+	result = object.String()
+	return
+}
+
+// upload uploads the given file to the object with the given URL, which should have the form
+// 's3://bucket/key'. Large files are uploaded in multiple parts.
+func (c *s3Client) upload(ctx context.Context, file, value string) error {
+	bucket, key, err := s3SplitURL(value)
+	if err != nil {
+		return err
+	}
+	reader, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	config := &aws.Config{
+		Endpoint:         aws.String(c.endpoint.String()),
+		Region:           aws.String(c.region),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.AnonymousCredentials,
+	}
+	if c.accessKeyID != "" {
+		config.Credentials = credentials.NewStaticCredentials(
+			c.accessKeyID,
+			c.secretAccessKey,
+			c.sessionToken,
+		)
+	}
+	session, err := session.NewSession(config)
+	if err != nil {
+		return err
+	}
+	uploader := s3manager.NewUploader(session)
+	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   reader,
+	})
+	return err
+}
+
+// matches checks if the given URL is in the object store.
+func (c *s3Client) matches(value *url.URL) bool {
+	return value.Scheme == c.endpoint.Scheme && value.Host == c.endpoint.Host
+}
+
+// sign adds to the request the headers needed to authenticate it, using the AWS signature version
+// 4. The request must not have a body. Requests aren't signed if there are no credentials.
+func (c *s3Client) sign(request *http.Request, now time.Time) error {
+	if c.accessKeyID == "" {
+		return nil
+	}
+
+	// Use exactly the same escaped path that we use in the signature, otherwise the Go HTTP
+	// client may escape it differently. Note that S3 doesn't escape the path twice like other
+	// services, so the signer needs to use it as is.
+	request.URL.RawPath = s3EscapePath(request.URL.Path)
+	signer := v4.NewSigner(
+		credentials.NewStaticCredentials(
+			c.accessKeyID,
+			c.secretAccessKey,
+			c.sessionToken,
+		),
+		func(signer *v4.Signer) {
+			signer.DisableURIPathEscaping = true
+		},
+	)
+	_, err := signer.Sign(request, nil, "s3", c.region, now)
+	return err
+}
+
+// s3EscapePath escapes the path as required by the signature: all the bytes except the unreserved
+// characters are percent encoded, and the slashes are preserved.
+func s3EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3SplitURL extracts the bucket and the key from an URL like 's3://bucket/key'.
+func s3SplitURL(value string) (bucket, key string, err error) {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return
+	}
+	bucket = parsed.Host
+	key = strings.TrimPrefix(parsed.Path, "/")
+	if parsed.Scheme != "s3" || bucket == "" || key == "" {
+		err = fmt.Errorf("URL '%s' should have the form 's3://bucket/key'", value)
+	}
+	return
+}
+
+func s3Escape(value string) string {
+	buffer := &strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+			buffer.WriteByte(c)
+		case c == '-', c == '.', c == '_', c == '~':
+			buffer.WriteByte(c)
+		default:
+			fmt.Fprintf(buffer, "%%%02X", c)
+		}
+	}
+	return buffer.String()
+}
+
+// Names of the files of the credentials directory:
+const (
+	s3AccessKeyIDFile     = "access-key-id"
+	s3SecretAccessKeyFile = "secret-access-key"
+	s3SessionTokenFile    = "session-token"
+	s3EndpointFile        = "endpoint"
+	s3RegionFile          = "region"
+)
+
+const s3DefaultRegion = "us-east-1"
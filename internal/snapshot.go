@@ -0,0 +1,250 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-logr/logr"
+	config "github.com/openshift/api/config"
+	configv1 "github.com/openshift/api/config/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	core "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+)
+
+// SnapshotCollectorBuilder contains the data and logic needed to create a snapshot collector. Don't
+// create instances of this type directly, use the NewSnapshotCollector function instead.
+type SnapshotCollectorBuilder struct {
+	logger    logr.Logger
+	namespace string
+}
+
+// SnapshotCollector collects the objects that the controller uses to make decisions (cluster
+// version, nodes, cluster upgrades and jobs) and writes them in YAML format, so that they can
+// later be used to simulate the behaviour of the controller without a live cluster. Don't create
+// instances of this type directly, use the NewSnapshotCollector function instead.
+type SnapshotCollector struct {
+	logger    logr.Logger
+	namespace string
+	scheme    *runtime.Scheme
+	client    clnt.Client
+}
+
+// NewSnapshotCollector creates a builder that can then be used to configure and create snapshot
+// collectors.
+func NewSnapshotCollector() *SnapshotCollectorBuilder {
+	return &SnapshotCollectorBuilder{}
+}
+
+// SetLogger sets the logger that the collector will use to write log messages. This is mandatory.
+func (b *SnapshotCollectorBuilder) SetLogger(value logr.Logger) *SnapshotCollectorBuilder {
+	b.logger = value
+	return b
+}
+
+// SetNamespace sets the namespace where the controller creates its objects. This is mandatory.
+func (b *SnapshotCollectorBuilder) SetNamespace(value string) *SnapshotCollectorBuilder {
+	b.namespace = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new snapshot collector.
+func (b *SnapshotCollectorBuilder) Build() (result *SnapshotCollector, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+	if b.namespace == "" {
+		err = errors.New("namespace is mandatory")
+		return
+	}
+
+	// Create the API client:
+	scheme := snapshotScheme()
+	cfg, err := ctrl.GetConfig()
+	if err != nil {
+		return
+	}
+	client, err := clnt.New(cfg, clnt.Options{
+		Scheme: scheme,
+	})
+	if err != nil {
+		return
+	}
+
+	// Create and populate the object:
+	result = &SnapshotCollector{
+		logger:    b.logger,
+		namespace: b.namespace,
+		scheme:    scheme,
+		client:    client,
+	}
+	return
+}
+
+// Run collects the objects and writes them to the given writer.
+func (c *SnapshotCollector) Run(ctx context.Context, writer io.Writer) error {
+	var objects []clnt.Object
+
+	// Collect the cluster version:
+	version := &configv1.ClusterVersion{}
+	err := c.client.Get(ctx, clnt.ObjectKey{Name: "version"}, version)
+	switch {
+	case err == nil:
+		objects = append(objects, version)
+	case apierrors.IsNotFound(err):
+		c.logger.Info("Cluster version doesn't exist")
+	default:
+		return err
+	}
+
+	// Collect the nodes:
+	nodes := &corev1.NodeList{}
+	err = c.client.List(ctx, nodes)
+	if err != nil {
+		return err
+	}
+	for i := range nodes.Items {
+		objects = append(objects, &nodes.Items[i])
+	}
+
+	// Collect the cluster upgrades, if the custom resource definition is installed:
+	upgrades := &v1alpha1.ClusterUpgradeList{}
+	err = c.client.List(ctx, upgrades, clnt.InNamespace(c.namespace))
+	switch {
+	case err == nil:
+		for i := range upgrades.Items {
+			objects = append(objects, &upgrades.Items[i])
+		}
+	case meta.IsNoMatchError(err):
+		c.logger.Info("Cluster upgrade custom resource definition isn't installed")
+	default:
+		return err
+	}
+
+	// Collect the jobs:
+	jobs := &batchv1.JobList{}
+	err = c.client.List(ctx, jobs, clnt.InNamespace(c.namespace))
+	if err != nil {
+		return err
+	}
+	for i := range jobs.Items {
+		objects = append(objects, &jobs.Items[i])
+	}
+	c.logger.Info(
+		"Collected objects",
+		"nodes", len(nodes.Items),
+		"upgrades", len(upgrades.Items),
+		"jobs", len(jobs.Items),
+	)
+
+	// Write the list:
+	items := make([]any, len(objects))
+	for i, object := range objects {
+		gvk, err := apiutil.GVKForObject(object, c.scheme)
+		if err != nil {
+			return err
+		}
+		object.GetObjectKind().SetGroupVersionKind(gvk)
+		object.SetManagedFields(nil)
+		items[i] = object
+	}
+	data, err := yaml.Marshal(map[string]any{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"items":      items,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+// LoadSnapshot parses a snapshot previously generated by the snapshot collector and returns the
+// typed objects that it contains.
+func LoadSnapshot(data []byte) (results []clnt.Object, err error) {
+	scheme := snapshotScheme()
+	documents, err := ParseManifests(data)
+	if err != nil {
+		return
+	}
+	for _, document := range documents {
+		items := []any{document.Object}
+		if document.IsList() {
+			items, _ = document.Object["items"].([]any)
+		}
+		for _, item := range items {
+			fields, ok := item.(map[string]any)
+			if !ok {
+				err = fmt.Errorf("snapshot item is of type %T, but expected a map", item)
+				return
+			}
+			var object clnt.Object
+			object, err = snapshotObject(scheme, fields)
+			if err != nil {
+				return
+			}
+			results = append(results, object)
+		}
+	}
+	return
+}
+
+func snapshotObject(scheme *runtime.Scheme, fields map[string]any) (result clnt.Object,
+	err error) {
+	apiVersion, _ := fields["apiVersion"].(string)
+	kind, _ := fields["kind"].(string)
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return
+	}
+	typed, err := scheme.New(gv.WithKind(kind))
+	if err != nil {
+		return
+	}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(fields, typed)
+	if err != nil {
+		return
+	}
+	result, ok := typed.(clnt.Object)
+	if !ok {
+		err = fmt.Errorf("snapshot object of kind '%s' isn't supported", kind)
+	}
+	return
+}
+
+func snapshotScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	core.AddToScheme(scheme)
+	config.Install(scheme)
+	v1alpha1.AddToScheme(scheme)
+	return scheme
+}
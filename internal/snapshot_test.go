@@ -0,0 +1,124 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+)
+
+var _ = Describe("Snapshot", func() {
+	It("Loads the objects of a list", func() {
+		objects, err := LoadSnapshot([]byte(`
+apiVersion: v1
+kind: List
+items:
+- apiVersion: config.openshift.io/v1
+  kind: ClusterVersion
+  metadata:
+    name: version
+  status:
+    desired:
+      version: 4.12.9
+- apiVersion: v1
+  kind: Node
+  metadata:
+    name: node0
+    labels:
+      node-role.kubernetes.io/master: ""
+- apiVersion: upgrade-tool.io/v1alpha1
+  kind: ClusterUpgrade
+  metadata:
+    namespace: upgrade-tool
+    name: my-upgrade
+  spec:
+    version: 4.13.4
+    bundle:
+      url: s3://bundles/4.13.4.tar
+- apiVersion: batch/v1
+  kind: Job
+  metadata:
+    namespace: upgrade-tool
+    name: bundle-extractor-node0
+`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(objects).To(HaveLen(4))
+
+		version, ok := objects[0].(*configv1.ClusterVersion)
+		Expect(ok).To(BeTrue())
+		Expect(version.Name).To(Equal("version"))
+		Expect(version.Status.Desired.Version).To(Equal("4.12.9"))
+
+		node, ok := objects[1].(*corev1.Node)
+		Expect(ok).To(BeTrue())
+		Expect(node.Name).To(Equal("node0"))
+		Expect(node.Labels).To(HaveKey("node-role.kubernetes.io/master"))
+
+		upgrade, ok := objects[2].(*v1alpha1.ClusterUpgrade)
+		Expect(ok).To(BeTrue())
+		Expect(upgrade.Namespace).To(Equal("upgrade-tool"))
+		Expect(upgrade.Spec.Version).To(Equal("4.13.4"))
+		Expect(upgrade.Spec.Bundle.URL).To(Equal("s3://bundles/4.13.4.tar"))
+
+		job, ok := objects[3].(*batchv1.Job)
+		Expect(ok).To(BeTrue())
+		Expect(job.Name).To(Equal("bundle-extractor-node0"))
+	})
+
+	It("Loads objects from multiple documents", func() {
+		objects, err := LoadSnapshot([]byte(`
+apiVersion: v1
+kind: Node
+metadata:
+  name: node0
+---
+apiVersion: v1
+kind: Node
+metadata:
+  name: node1
+`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(objects).To(HaveLen(2))
+		Expect(objects[0].GetName()).To(Equal("node0"))
+		Expect(objects[1].GetName()).To(Equal("node1"))
+	})
+
+	It("Fails if the kind isn't known", func() {
+		_, err := LoadSnapshot([]byte(`
+apiVersion: example.com/v1
+kind: Junk
+metadata:
+  name: junk
+`))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Junk"))
+	})
+
+	It("Fails if an item of the list isn't an object", func() {
+		_, err := LoadSnapshot([]byte(`
+apiVersion: v1
+kind: List
+items:
+- junk
+`))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("string"))
+	})
+})
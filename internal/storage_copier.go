@@ -0,0 +1,273 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	dreference "github.com/distribution/distribution/v3/reference"
+	"github.com/go-logr/logr"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// storageCopier knows how to copy images directly from the file system layout of the image
+// registry used by bundles into the container storage used by CRI-O. To do so it creates for each
+// image a temporary OCI layout whose blobs are symbolic links to the blobs of the bundle, and then
+// uses the 'skopeo' command to copy from that layout to the 'containers-storage' transport.
+type storageCopier struct {
+	logger logr.Logger
+
+	// bundleDir is the absolute path of the directory of the bundle, used as root of the
+	// registry storage.
+	bundleDir string
+
+	// layoutsDir is the absolute path of the directory where the temporary OCI layouts will be
+	// created.
+	layoutsDir string
+
+	// graphRoot and runRoot are the absolute paths of the directories of the container storage.
+	graphRoot string
+	runRoot   string
+
+	// skopeo is the path of the 'skopeo' binary. If empty it will be searched in the path.
+	skopeo string
+}
+
+// copy copies the image with the given reference into the container storage. The reference must
+// contain a digest, as that is how images are stored in the bundle.
+func (c *storageCopier) copy(ctx context.Context, ref string) error {
+	// Create the OCI layout:
+	layout, err := c.createLayout(ref)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := os.RemoveAll(layout)
+		if err != nil {
+			c.logger.Error(
+				err,
+				"Failed to remove OCI layout",
+				"ref", ref,
+				"layout", layout,
+			)
+		}
+	}()
+
+	// Copy the image:
+	path := c.skopeo
+	if path == "" {
+		path, err = exec.LookPath("skopeo")
+		if err != nil {
+			return err
+		}
+	}
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(
+		ctx,
+		path,
+		"copy",
+		fmt.Sprintf("oci:%s", layout),
+		fmt.Sprintf(
+			"containers-storage:[%s@%s+%s]%s",
+			storageCopierDriver, c.graphRoot, c.runRoot, ref,
+		),
+	)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	c.logger.V(1).Info(
+		"Executed 'skopeo' command",
+		"args", cmd.Args,
+		"stdout", stdout.String(),
+		"stderr", stderr.String(),
+		"code", cmd.ProcessState.ExitCode(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to copy image '%s': %w", ref, err)
+	}
+	c.logger.Info(
+		"Copied image",
+		"ref", ref,
+	)
+	return nil
+}
+
+// createLayout creates the temporary OCI layout that contains the given image and returns its
+// directory.
+func (c *storageCopier) createLayout(ref string) (result string, err error) {
+	// Find the digest of the manifest that is stored in the bundle:
+	named, err := dreference.ParseNamed(ref)
+	if err != nil {
+		return
+	}
+	digested, ok := named.(dreference.Digested)
+	if !ok {
+		err = fmt.Errorf(
+			"image reference '%s' can't be copied because it doesn't contain a digest",
+			ref,
+		)
+		return
+	}
+	storage := &registryStorage{
+		root: c.bundleDir,
+	}
+	digest, err := storage.readTag(dreference.Path(named), digested.Digest().Encoded())
+	if err != nil {
+		return
+	}
+	manifest, err := storage.readManifest(digest)
+	if err != nil {
+		return
+	}
+
+	// Create the directory:
+	err = os.MkdirAll(c.layoutsDir, 0700)
+	if err != nil {
+		return
+	}
+	dir, err := os.MkdirTemp(c.layoutsDir, "*.oci")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	// Link the blobs:
+	err = c.linkBlobs(storage, dir, digest)
+	if err != nil {
+		return
+	}
+
+	// Write the layout and index files:
+	info, err := os.Stat(storage.blobFile(digest))
+	if err != nil {
+		return
+	}
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType = storageCopierManifestMediaType
+	}
+	err = c.writeJSON(filepath.Join(dir, "oci-layout"), map[string]any{
+		"imageLayoutVersion": "1.0.0",
+	})
+	if err != nil {
+		return
+	}
+	err = c.writeJSON(filepath.Join(dir, "index.json"), map[string]any{
+		"schemaVersion": 2,
+		"manifests": []any{
+			map[string]any{
+				"mediaType": mediaType,
+				"digest":    digest,
+				"size":      info.Size(),
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	c.logger.V(2).Info(
+		"Created OCI layout",
+		"ref", ref,
+		"layout", dir,
+		"digest", digest,
+	)
+	result = dir
+	return
+}
+
+// linkBlobs creates in the OCI layout the links for the given manifest and for all the blobs
+// that it references, recursively for manifest lists. Blobs that aren't in the bundle are
+// ignored, as bundles only contain the images for the architecture of the cluster.
+func (c *storageCopier) linkBlobs(storage *registryStorage, dir string,
+	digest godigest.Digest) error {
+	err := c.linkBlob(storage, dir, digest)
+	if err != nil {
+		return err
+	}
+	manifest, err := storage.readManifest(digest)
+	if err != nil {
+		return err
+	}
+	for _, child := range manifest.Manifests {
+		exists, err := storage.hasBlob(child.Digest)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		err = c.linkBlobs(storage, dir, child.Digest)
+		if err != nil {
+			return err
+		}
+	}
+	blobs := make([]godigest.Digest, 0, len(manifest.Layers)+1)
+	if manifest.Config != nil {
+		blobs = append(blobs, manifest.Config.Digest)
+	}
+	for _, layer := range manifest.Layers {
+		blobs = append(blobs, layer.Digest)
+	}
+	for _, blob := range blobs {
+		err = c.linkBlob(storage, dir, blob)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *storageCopier) linkBlob(storage *registryStorage, dir string,
+	digest godigest.Digest) error {
+	link := filepath.Join(dir, "blobs", digest.Algorithm().String(), digest.Encoded())
+	err := os.MkdirAll(filepath.Dir(link), 0700)
+	if err != nil {
+		return err
+	}
+	err = os.Symlink(storage.blobFile(digest), link)
+	if errors.Is(err, os.ErrExist) {
+		err = nil
+	}
+	return err
+}
+
+func (c *storageCopier) writeJSON(file string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0600)
+}
+
+const (
+	// storageCopierDriver is the storage driver used by CRI-O.
+	storageCopierDriver = "overlay"
+
+	// storageCopierManifestMediaType is the media type used for manifests that don't specify
+	// it explicitly.
+	storageCopierManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+)
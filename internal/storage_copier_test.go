@@ -0,0 +1,181 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	godigest "github.com/opencontainers/go-digest"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Storage copier", func() {
+	var (
+		ctx      context.Context
+		logger   logr.Logger
+		tmp      string
+		storage  *registryStorage
+		copier   *storageCopier
+		ref      string
+		manifest godigest.Digest
+		config   godigest.Digest
+		layer    godigest.Digest
+	)
+
+	// writeBlob writes the given data to the bundle and returns its digest.
+	writeBlob := func(data []byte) godigest.Digest {
+		digest := godigest.FromBytes(data)
+		err := storage.writeBlob(digest, bytes.NewReader(data))
+		Expect(err).ToNot(HaveOccurred())
+		return digest
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create a temporary directory for the bundle and the storage:
+		tmp, err = os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+
+		// Write an image to the bundle, tagged with the hex part of the original digest, like
+		// the bundle creator does:
+		storage = &registryStorage{
+			root: filepath.Join(tmp, "bundle"),
+		}
+		config = writeBlob([]byte(`{"architecture":"amd64","os":"linux"}`))
+		layer = writeBlob([]byte("my-layer"))
+		data, err := json.Marshal(map[string]any{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+			"config": map[string]any{
+				"mediaType": "application/vnd.docker.container.image.v1+json",
+				"digest":    config,
+				"size":      37,
+			},
+			"layers": []any{
+				map[string]any{
+					"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+					"digest":    layer,
+					"size":      8,
+				},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		manifest = writeBlob(data)
+		ref = "quay.io/openshift/image@" + manifest.String()
+		err = storage.tagManifest("openshift/image", manifest.Encoded(), manifest)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create the copier:
+		copier = &storageCopier{
+			logger:     logger,
+			bundleDir:  storage.root,
+			layoutsDir: filepath.Join(storage.root, "layouts"),
+			graphRoot:  filepath.Join(tmp, "graph"),
+			runRoot:    filepath.Join(tmp, "run"),
+		}
+	})
+
+	It("Creates the OCI layout", func() {
+		layout, err := copier.createLayout(ref)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Check the index:
+		data, err := os.ReadFile(filepath.Join(layout, "index.json"))
+		Expect(err).ToNot(HaveOccurred())
+		var index struct {
+			Manifests []registryDescriptor `json:"manifests"`
+		}
+		err = json.Unmarshal(data, &index)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(index.Manifests).To(HaveLen(1))
+		Expect(index.Manifests[0].Digest).To(Equal(manifest))
+		Expect(index.Manifests[0].MediaType).To(Equal(
+			"application/vnd.docker.distribution.manifest.v2+json",
+		))
+		Expect(filepath.Join(layout, "oci-layout")).To(BeARegularFile())
+
+		// Check that all the blobs are linked to the bundle:
+		for _, digest := range []godigest.Digest{manifest, config, layer} {
+			link := filepath.Join(layout, "blobs", "sha256", digest.Encoded())
+			target, err := os.Readlink(link)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(target).To(Equal(storage.blobFile(digest)))
+		}
+	})
+
+	It("Rejects references without digest", func() {
+		_, err := copier.createLayout("quay.io/openshift/image:latest")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("digest"))
+	})
+
+	It("Fails if the image isn't in the bundle", func() {
+		_, err := copier.createLayout("quay.io/openshift/other@" + manifest.String())
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Runs skopeo to copy the image to the container storage", func() {
+		// Create a fake skopeo that saves the arguments:
+		args := filepath.Join(tmp, "args")
+		copier.skopeo = filepath.Join(tmp, "skopeo")
+		script := "#!/bin/sh\necho \"$@\" > " + args + "\n"
+		err := os.WriteFile(copier.skopeo, []byte(script), 0700)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Copy the image and check the arguments:
+		err = copier.copy(ctx, ref)
+		Expect(err).ToNot(HaveOccurred())
+		data, err := os.ReadFile(args)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(MatchRegexp(
+			`^copy oci:%s/[^ ]+\.oci containers-storage:\[overlay@%s\+%s\]%s\n$`,
+			copier.layoutsDir, copier.graphRoot, copier.runRoot, ref,
+		))
+
+		// Check that the layout has been removed:
+		entries, err := os.ReadDir(copier.layoutsDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("Fails if skopeo fails", func() {
+		copier.skopeo = filepath.Join(tmp, "skopeo")
+		err := os.WriteFile(copier.skopeo, []byte("#!/bin/sh\nexit 1\n"), 0700)
+		Expect(err).ToNot(HaveOccurred())
+		err = copier.copy(ctx, ref)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(ref))
+	})
+})
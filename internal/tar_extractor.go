@@ -0,0 +1,373 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// tarExtractor knows how to extract a tar archive to a directory without using the external 'tar'
+// command. It rejects entries that would be written outside of the directory, preserves the
+// permissions, ownership and modification times of the entries, and flushes files and directories
+// to disk before returning.
+type tarExtractor struct {
+	logger logr.Logger
+	dir    string
+
+	// check is an optional function that is called after extracting each regular file, with
+	// the path of the file relative to the directory and the absolute path. If it returns an
+	// error the extraction stops.
+	check func(name, file string) error
+
+	// root is the directory with all the symbolic links resolved, used to check that entries
+	// aren't written outside of it.
+	root string
+
+	// dirs contains the directories that have been modified and need to be flushed to disk,
+	// and the headers of the directories whose permissions and times need to be set once all
+	// the files have been written.
+	dirs    map[string]bool
+	headers map[string]*tar.Header
+}
+
+// extract reads the archive from the given reader and writes its contents to the directory, which
+// must already exist.
+func (x *tarExtractor) extract(ctx context.Context, reader io.Reader) (err error) {
+	x.root, err = filepath.EvalSymlinks(x.dir)
+	if err != nil {
+		return
+	}
+	x.dirs = map[string]bool{
+		x.dir: true,
+	}
+	x.headers = map[string]*tar.Header{}
+	archive := tar.NewReader(reader)
+	count := 0
+	for {
+		err = ctx.Err()
+		if err != nil {
+			return
+		}
+		var header *tar.Header
+		header, err = archive.Next()
+		if errors.Is(err, io.EOF) {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		err = x.extractEntry(header, archive)
+		if err != nil {
+			err = fmt.Errorf("failed to extract '%s': %w", header.Name, err)
+			return
+		}
+		count++
+	}
+
+	// Now that all the files have been written we can set the permissions and times of the
+	// directories, and flush them to disk:
+	for file, header := range x.headers {
+		err = x.setAttributes(file, header)
+		if err != nil {
+			return
+		}
+	}
+	for dir := range x.dirs {
+		err = syncDir(dir)
+		if err != nil {
+			return
+		}
+	}
+	x.logger.V(1).Info(
+		"Extracted archive",
+		"dir", x.dir,
+		"entries", count,
+	)
+	return
+}
+
+func (x *tarExtractor) extractEntry(header *tar.Header, reader io.Reader) error {
+	// Calculate the target path and check that it is inside the directory:
+	target, err := x.targetPath(header.Name)
+	if err != nil {
+		return err
+	}
+	if target == x.dir {
+		return nil
+	}
+	parent := filepath.Dir(target)
+	err = x.makeParent(parent)
+	if err != nil {
+		return err
+	}
+	x.dirs[parent] = true
+
+	// Create the entry:
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return x.extractDir(target, header)
+	case tar.TypeReg, tar.TypeRegA:
+		return x.extractFile(target, header, reader)
+	case tar.TypeSymlink:
+		return x.extractSymlink(target, header)
+	case tar.TypeLink:
+		return x.extractLink(target, header)
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		x.logger.Info(
+			"Ignoring unsupported archive entry",
+			"name", header.Name,
+			"type", string(header.Typeflag),
+		)
+		return nil
+	}
+}
+
+func (x *tarExtractor) extractDir(target string, header *tar.Header) error {
+	info, err := os.Lstat(target)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		err = os.Mkdir(target, 0755)
+		if err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case !info.IsDir():
+		return fmt.Errorf("'%s' already exists and isn't a directory", target)
+	}
+	x.dirs[target] = true
+	x.headers[target] = header
+	return nil
+}
+
+func (x *tarExtractor) extractFile(target string, header *tar.Header, reader io.Reader) error {
+	// Remove the existing file, if any, so that we don't write through a symbolic link:
+	err := x.removeExisting(target)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	err = x.setAttributes(target, header)
+	if err != nil {
+		return err
+	}
+	if x.check != nil {
+		name, err := filepath.Rel(x.dir, target)
+		if err != nil {
+			return err
+		}
+		return x.check(filepath.ToSlash(name), target)
+	}
+	return nil
+}
+
+func (x *tarExtractor) extractSymlink(target string, header *tar.Header) error {
+	// The link itself is harmless, as we never write through links, but we reject links that
+	// point outside of the directory anyhow, as nothing in the bundle should need them:
+	if filepath.IsAbs(header.Linkname) {
+		return fmt.Errorf("symbolic link target '%s' is absolute", header.Linkname)
+	}
+	linked := filepath.Join(filepath.Dir(target), filepath.FromSlash(header.Linkname))
+	if !x.isInside(x.dir, linked) {
+		return fmt.Errorf(
+			"symbolic link target '%s' is outside of the directory",
+			header.Linkname,
+		)
+	}
+	err := x.removeExisting(target)
+	if err != nil {
+		return err
+	}
+	err = os.Symlink(header.Linkname, target)
+	if err != nil {
+		return err
+	}
+	return x.setOwner(target, header)
+}
+
+func (x *tarExtractor) extractLink(target string, header *tar.Header) error {
+	linked, err := x.targetPath(header.Linkname)
+	if err != nil {
+		return err
+	}
+	err = x.checkInside(filepath.Dir(linked))
+	if err != nil {
+		return err
+	}
+	err = x.removeExisting(target)
+	if err != nil {
+		return err
+	}
+	return os.Link(linked, target)
+}
+
+// targetPath calculates the path where an entry of the archive will be written, and checks that it
+// is inside the directory.
+func (x *tarExtractor) targetPath(name string) (result string, err error) {
+	// Like the 'tar' command we remove the leading slashes, but we reject names that contain
+	// '..' components that would go outside of the directory:
+	clean := path.Clean(strings.TrimLeft(name, "/"))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		err = fmt.Errorf("name '%s' is outside of the directory", name)
+		return
+	}
+	result = filepath.Join(x.dir, filepath.FromSlash(clean))
+	if !x.isInside(x.dir, result) {
+		err = fmt.Errorf("name '%s' is outside of the directory", name)
+	}
+	return
+}
+
+// makeParent creates the parent directory of an entry. Before creating it checks that the nearest
+// existing ancestor is inside the directory, so that directories aren't created following symbolic
+// links that point outside.
+func (x *tarExtractor) makeParent(parent string) error {
+	existing := parent
+	for {
+		_, err := os.Lstat(existing)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		existing = filepath.Dir(existing)
+	}
+	err := x.checkInside(existing)
+	if err != nil {
+		return err
+	}
+	if existing == parent {
+		return nil
+	}
+	return os.MkdirAll(parent, 0755)
+}
+
+// checkInside checks that the given existing directory, after resolving all the symbolic links, is
+// inside the directory. This prevents writing outside of the directory using links created by
+// previous entries of the archive.
+func (x *tarExtractor) checkInside(dir string) error {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if !x.isInside(x.root, resolved) {
+		return fmt.Errorf("'%s' is outside of the directory", dir)
+	}
+	return nil
+}
+
+func (x *tarExtractor) isInside(dir, file string) bool {
+	rel, err := filepath.Rel(dir, file)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (x *tarExtractor) removeExisting(target string) error {
+	info, err := os.Lstat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("'%s' already exists and is a directory", target)
+	}
+	return os.Remove(target)
+}
+
+// setAttributes sets the permissions, ownership and modification time of the given file or
+// directory.
+func (x *tarExtractor) setAttributes(target string, header *tar.Header) error {
+	err := x.setOwner(target, header)
+	if err != nil {
+		return err
+	}
+	mode := header.FileInfo().Mode() & tarExtractorModeMask
+	err = os.Chmod(target, mode)
+	if err != nil {
+		return err
+	}
+	if !header.ModTime.IsZero() {
+		accessTime := header.AccessTime
+		if accessTime.IsZero() {
+			accessTime = time.Now()
+		}
+		err = os.Chtimes(target, accessTime, header.ModTime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setOwner preserves the owner of the file when running as root, like the 'tar' command does.
+func (x *tarExtractor) setOwner(target string, header *tar.Header) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Lchown(target, header.Uid, header.Gid)
+}
+
+// syncDir flushes the given directory to disk, so that the entries created inside it aren't lost
+// if the node crashes.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// tarExtractorModeMask contains the bits of the mode of the entries of the archive that are
+// preserved.
+const tarExtractorModeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
@@ -0,0 +1,226 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Tar extractor", func() {
+	var (
+		ctx       context.Context
+		logger    logr.Logger
+		tmp       string
+		dir       string
+		extractor *tarExtractor
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create a temporary directory, and the directory where the archives will be
+		// extracted inside it, so that we can check that nothing is written outside:
+		tmp, err = os.MkdirTemp("", "*.test")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, tmp)
+		dir = filepath.Join(tmp, "dir")
+		err = os.Mkdir(dir, 0755)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Create the extractor:
+		extractor = &tarExtractor{
+			logger: logger,
+			dir:    dir,
+		}
+	})
+
+	It("Extracts directories, files and links", func() {
+		mtime := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+		archive := makeTestArchive(
+			&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     "docker/",
+				Mode:     0700,
+				ModTime:  mtime,
+			},
+			&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     "docker/data",
+				Mode:     0640,
+				ModTime:  mtime,
+			},
+			&tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     "docker/symlink",
+				Linkname: "data",
+			},
+			&tar.Header{
+				Typeflag: tar.TypeLink,
+				Name:     "docker/hardlink",
+				Linkname: "docker/data",
+			},
+		)
+		err := extractor.extract(ctx, archive)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Check the directory:
+		info, err := os.Stat(filepath.Join(dir, "docker"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.IsDir()).To(BeTrue())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0700)))
+		Expect(info.ModTime().Equal(mtime)).To(BeTrue())
+
+		// Check the file:
+		data, err := os.ReadFile(filepath.Join(dir, "docker", "data"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("docker/data"))
+		info, err = os.Stat(filepath.Join(dir, "docker", "data"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0640)))
+		Expect(info.ModTime().Equal(mtime)).To(BeTrue())
+
+		// Check the links:
+		target, err := os.Readlink(filepath.Join(dir, "docker", "symlink"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target).To(Equal("data"))
+		data, err = os.ReadFile(filepath.Join(dir, "docker", "hardlink"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("docker/data"))
+	})
+
+	It("Removes leading slashes", func() {
+		archive := makeTestArchive(
+			&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     "/metadata.json",
+				Mode:     0644,
+			},
+		)
+		err := extractor.extract(ctx, archive)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(filepath.Join(dir, "metadata.json")).To(BeARegularFile())
+	})
+
+	It("Rejects names outside of the directory", func() {
+		archive := makeTestArchive(
+			&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     "docker/../../evil",
+				Mode:     0644,
+			},
+		)
+		err := extractor.extract(ctx, archive)
+		Expect(err).To(HaveOccurred())
+		Expect(filepath.Join(tmp, "evil")).ToNot(BeAnExistingFile())
+	})
+
+	It("Rejects absolute symbolic links", func() {
+		archive := makeTestArchive(
+			&tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     "link",
+				Linkname: "/etc",
+			},
+		)
+		err := extractor.extract(ctx, archive)
+		Expect(err).To(HaveOccurred())
+		Expect(filepath.Join(dir, "link")).ToNot(BeAnExistingFile())
+	})
+
+	It("Rejects symbolic links outside of the directory", func() {
+		archive := makeTestArchive(
+			&tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     "link",
+				Linkname: "../outside",
+			},
+		)
+		err := extractor.extract(ctx, archive)
+		Expect(err).To(HaveOccurred())
+		Expect(filepath.Join(dir, "link")).ToNot(BeAnExistingFile())
+	})
+
+	It("Doesn't write through chains of symbolic links", func() {
+		// Each of these links looks like it points inside the directory, but combined they
+		// point to the parent of the directory:
+		archive := makeTestArchive(
+			&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     "b/",
+				Mode:     0755,
+			},
+			&tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     "b/a",
+				Linkname: "..",
+			},
+			&tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     "b/c",
+				Linkname: "a/..",
+			},
+			&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     "b/c/evil",
+				Mode:     0644,
+			},
+		)
+		err := extractor.extract(ctx, archive)
+		Expect(err).To(HaveOccurred())
+		Expect(filepath.Join(tmp, "evil")).ToNot(BeAnExistingFile())
+	})
+})
+
+// makeTestArchive creates a tar archive containing the given entries. The content of regular files
+// is their name.
+func makeTestArchive(headers ...*tar.Header) *bytes.Buffer {
+	buffer := &bytes.Buffer{}
+	writer := tar.NewWriter(buffer)
+	for _, header := range headers {
+		var data []byte
+		if header.Typeflag == tar.TypeReg {
+			data = []byte(header.Name)
+			header.Size = int64(len(data))
+		}
+		err := writer.WriteHeader(header)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = writer.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+	}
+	err := writer.Close()
+	Expect(err).ToNot(HaveOccurred())
+	return buffer
+}
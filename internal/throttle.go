@@ -0,0 +1,140 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// NewBandwidthLimiter creates a rate limiter that allows the given number of bytes per second. The
+// same limiter can be shared by multiple readers and writers in order to limit the aggregated
+// bandwidth. Returns nil if the value is zero or negative, which means no limit.
+func NewBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := bytesPerSecond
+	if burst > throttleMaxBurst {
+		burst = throttleMaxBurst
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(burst))
+}
+
+// ThrottleReader wraps the given reader so that reading from it waits for the given limiters. Nil
+// limiters are ignored.
+func ThrottleReader(ctx context.Context, reader io.Reader, limiters ...*rate.Limiter) io.Reader {
+	limiters = throttleLimiters(limiters)
+	if len(limiters) == 0 {
+		return reader
+	}
+	return &throttledReader{
+		ctx:      ctx,
+		reader:   reader,
+		limiters: limiters,
+	}
+}
+
+// ThrottleWriter wraps the given writer so that writing to it waits for the given limiters. Nil
+// limiters are ignored.
+func ThrottleWriter(ctx context.Context, writer io.Writer, limiters ...*rate.Limiter) io.Writer {
+	limiters = throttleLimiters(limiters)
+	if len(limiters) == 0 {
+		return writer
+	}
+	return &throttledWriter{
+		ctx:      ctx,
+		writer:   writer,
+		limiters: limiters,
+	}
+}
+
+func throttleLimiters(limiters []*rate.Limiter) []*rate.Limiter {
+	var result []*rate.Limiter
+	for _, limiter := range limiters {
+		if limiter != nil {
+			result = append(result, limiter)
+		}
+	}
+	return result
+}
+
+func throttleChunk(limiters []*rate.Limiter, size int) int {
+	for _, limiter := range limiters {
+		burst := limiter.Burst()
+		if size > burst {
+			size = burst
+		}
+	}
+	return size
+}
+
+func throttleWait(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for _, limiter := range limiters {
+		err := limiter.WaitN(ctx, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type throttledReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	limiters []*rate.Limiter
+}
+
+func (r *throttledReader) Read(p []byte) (n int, err error) {
+	p = p[:throttleChunk(r.limiters, len(p))]
+	n, err = r.reader.Read(p)
+	if n > 0 {
+		waitErr := throttleWait(r.ctx, r.limiters, n)
+		if err == nil {
+			err = waitErr
+		}
+	}
+	return
+}
+
+type throttledWriter struct {
+	ctx      context.Context
+	writer   io.Writer
+	limiters []*rate.Limiter
+}
+
+func (w *throttledWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		size := throttleChunk(w.limiters, len(p))
+		err = throttleWait(w.ctx, w.limiters, size)
+		if err != nil {
+			return
+		}
+		var written int
+		written, err = w.writer.Write(p[:size])
+		n += written
+		if err != nil {
+			return
+		}
+		p = p[size:]
+	}
+	return
+}
+
+// throttleMaxBurst is the maximum number of bytes that will be read or written at once by
+// throttled readers and writers.
+const throttleMaxBurst = 256 * 1024
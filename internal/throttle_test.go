@@ -0,0 +1,73 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Throttling", func() {
+	var ctx context.Context
+
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	It("Doesn't create limiter for zero bandwidth", func() {
+		Expect(NewBandwidthLimiter(0)).To(BeNil())
+	})
+
+	It("Returns the original reader if there are no limiters", func() {
+		reader := &bytes.Buffer{}
+		Expect(ThrottleReader(ctx, reader, nil)).To(BeIdenticalTo(reader))
+	})
+
+	It("Reads all the data", func() {
+		data := bytes.Repeat([]byte("x"), 1000)
+		limiter := NewBandwidthLimiter(100000)
+		reader := ThrottleReader(ctx, bytes.NewReader(data), limiter)
+		result, err := io.ReadAll(reader)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(data))
+	})
+
+	It("Writes all the data", func() {
+		data := bytes.Repeat([]byte("x"), 1000)
+		limiter := NewBandwidthLimiter(100000)
+		buffer := &bytes.Buffer{}
+		writer := ThrottleWriter(ctx, buffer, limiter)
+		n, err := writer.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(len(data)))
+		Expect(buffer.Bytes()).To(Equal(data))
+	})
+
+	It("Limits the bandwidth", func() {
+		// With a limit of 1000 bytes per second the first 1000 bytes are the initial burst,
+		// and the next 500 should take at least half a second.
+		data := bytes.Repeat([]byte("x"), 1500)
+		limiter := NewBandwidthLimiter(1000)
+		start := time.Now()
+		_, err := io.Copy(io.Discard, ThrottleReader(ctx, bytes.NewReader(data), limiter))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically(">=", 400*time.Millisecond))
+	})
+})
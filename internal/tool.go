@@ -190,6 +190,20 @@ func (t *Tool) Run(ctx context.Context) error {
 func (t *Tool) run(cmd *cobra.Command, args []string) error {
 	var err error
 
+	// Take the values of the flags that weren't given in the command line from the environment
+	// and from the configuration file:
+	loader, err := NewConfigLoader().
+		SetLogger(t.logger).
+		SetFlags(cmd.Flags()).
+		Build()
+	if err != nil {
+		return err
+	}
+	err = loader.Load()
+	if err != nil {
+		return err
+	}
+
 	// Replace the default logger with one configured according to the command line options:
 	if t.loggerOwned {
 		t.logger, err = t.createConfiguredLogger()
@@ -203,6 +217,7 @@ func (t *Tool) run(cmd *cobra.Command, args []string) error {
 	t.console, err = NewConsole().
 		SetLogger(t.logger).
 		SetFlags(cmd.Flags()).
+		SetIn(t.in).
 		SetOut(t.out).
 		SetErr(t.err).
 		Build()
@@ -237,6 +252,7 @@ func (t *Tool) createCommand() error {
 	flags := t.cmd.PersistentFlags()
 	logging.AddFlags(flags)
 	AddConsoleFlags(flags)
+	AddConfigFlags(flags)
 
 	// Add sub-commands:
 	for _, sub := range t.sub {
@@ -0,0 +1,80 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"golang.org/x/exp/slices"
+)
+
+// UpdateGraph is a snapshot of the update graph returned by the update service (Cincinnati), in the
+// same format used by the service, so that it can be used in disconnected environments.
+type UpdateGraph struct {
+	// Channel is the channel that was used to fetch the graph, for example 'stable-4.13'.
+	Channel string `json:"channel,omitempty"`
+
+	// Nodes contains the releases.
+	Nodes []UpdateGraphNode `json:"nodes"`
+
+	// Edges contains the supported updates. Each edge is a pair of indexes of the nodes slice,
+	// the first one is the source and the second one is the target.
+	Edges [][2]int `json:"edges"`
+}
+
+// UpdateGraphNode is a release in the update graph.
+type UpdateGraphNode struct {
+	Version  string            `json:"version"`
+	Payload  string            `json:"payload"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Filter returns a new graph that contains only the given version and the versions that can be
+// updated directly to it. Returns nil if the graph doesn't contain the version.
+func (g *UpdateGraph) Filter(version string) *UpdateGraph {
+	target := g.index(version)
+	if target == -1 {
+		return nil
+	}
+	result := &UpdateGraph{
+		Channel: g.Channel,
+		Nodes: []UpdateGraphNode{
+			g.Nodes[target],
+		},
+		Edges: [][2]int{},
+	}
+	for _, edge := range g.Edges {
+		if edge[1] != target || edge[0] < 0 || edge[0] >= len(g.Nodes) {
+			continue
+		}
+		result.Nodes = append(result.Nodes, g.Nodes[edge[0]])
+		result.Edges = append(result.Edges, [2]int{len(result.Nodes) - 1, 0})
+	}
+	return result
+}
+
+// HasEdge checks if the graph contains a direct update from one version to another.
+func (g *UpdateGraph) HasEdge(from, to string) bool {
+	source := g.index(from)
+	target := g.index(to)
+	if source == -1 || target == -1 {
+		return false
+	}
+	return slices.Contains(g.Edges, [2]int{source, target})
+}
+
+func (g *UpdateGraph) index(version string) int {
+	return slices.IndexFunc(g.Nodes, func(node UpdateGraphNode) bool {
+		return node.Version == version
+	})
+}
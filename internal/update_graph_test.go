@@ -0,0 +1,59 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Update graph", func() {
+	graph := &UpdateGraph{
+		Channel: "stable-4.13",
+		Nodes: []UpdateGraphNode{
+			{Version: "4.13.1", Payload: "quay.io/ocp-release@sha256:1"},
+			{Version: "4.13.2", Payload: "quay.io/ocp-release@sha256:2"},
+			{Version: "4.13.3", Payload: "quay.io/ocp-release@sha256:3"},
+			{Version: "4.13.4", Payload: "quay.io/ocp-release@sha256:4"},
+		},
+		Edges: [][2]int{
+			{0, 1},
+			{0, 3},
+			{1, 2},
+			{2, 3},
+		},
+	}
+
+	It("Keeps only the edges to the target version", func() {
+		result := graph.Filter("4.13.4")
+		Expect(result).ToNot(BeNil())
+		Expect(result.Channel).To(Equal("stable-4.13"))
+		Expect(result.Nodes).To(HaveLen(3))
+		Expect(result.Nodes[0].Version).To(Equal("4.13.4"))
+		Expect(result.HasEdge("4.13.1", "4.13.4")).To(BeTrue())
+		Expect(result.HasEdge("4.13.3", "4.13.4")).To(BeTrue())
+		Expect(result.HasEdge("4.13.2", "4.13.4")).To(BeFalse())
+	})
+
+	It("Returns nil if the target version isn't in the graph", func() {
+		Expect(graph.Filter("4.14.0")).To(BeNil())
+	})
+
+	It("Checks edges", func() {
+		Expect(graph.HasEdge("4.13.1", "4.13.2")).To(BeTrue())
+		Expect(graph.HasEdge("4.13.2", "4.13.1")).To(BeFalse())
+		Expect(graph.HasEdge("4.12.0", "4.13.1")).To(BeFalse())
+	})
+})
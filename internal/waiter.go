@@ -0,0 +1,350 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	configv1 "github.com/openshift/api/config/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+	"github.com/jhernand/upgrade-tool/internal/labels"
+)
+
+// Conditions that the waiter can wait for:
+const (
+	// WaitBundleLoaded waits till the bundle has been loaded in all the nodes.
+	WaitBundleLoaded = "bundle-loaded"
+
+	// WaitAllNodesExtracted waits till the bundle has been extracted in all the nodes.
+	WaitAllNodesExtracted = "all-nodes-extracted"
+
+	// WaitUpgradeComplete waits till the upgrade has completed.
+	WaitUpgradeComplete = "upgrade-complete"
+)
+
+// WaitConditions is the list of conditions that the waiter supports.
+var WaitConditions = []string{
+	WaitBundleLoaded,
+	WaitAllNodesExtracted,
+	WaitUpgradeComplete,
+}
+
+// ErrWaitTimeout is the error returned by the waiter when the condition isn't met before the
+// context is done.
+var ErrWaitTimeout = errors.New("timed out waiting for condition")
+
+// WaiterBuilder contains the data and logic needed to create a waiter. Don't create instances of
+// this type directly, use the NewWaiter function instead.
+type WaiterBuilder struct {
+	logger    logr.Logger
+	client    clnt.Client
+	condition string
+	namespace string
+	name      string
+	interval  time.Duration
+}
+
+// Waiter checks periodically the state of the cluster till a condition is met. Don't create
+// instances of this type directly, use the NewWaiter function instead.
+type Waiter struct {
+	logger    logr.Logger
+	client    clnt.Client
+	condition string
+	namespace string
+	name      string
+	interval  time.Duration
+}
+
+// NewWaiter creates a builder that can then be used to configure and create waiters.
+func NewWaiter() *WaiterBuilder {
+	return &WaiterBuilder{
+		interval: waiterDefaultInterval,
+	}
+}
+
+// SetLogger sets the logger that the waiter will use to write log messages. This is mandatory.
+func (b *WaiterBuilder) SetLogger(value logr.Logger) *WaiterBuilder {
+	b.logger = value
+	return b
+}
+
+// SetClient sets the Kubernetes API client that the waiter will use to read the cluster objects.
+// This is optional, and the default is to create a client using the current Kubernetes
+// configuration.
+func (b *WaiterBuilder) SetClient(value clnt.Client) *WaiterBuilder {
+	b.client = value
+	return b
+}
+
+// SetCondition sets the condition to wait for. This is mandatory and must be one of
+// 'bundle-loaded', 'all-nodes-extracted' or 'upgrade-complete'.
+func (b *WaiterBuilder) SetCondition(value string) *WaiterBuilder {
+	b.condition = value
+	return b
+}
+
+// SetUpgrade sets the namespace and name of the ClusterUpgrade object that will be checked for the
+// 'upgrade-complete' condition. This is optional, and when not set the waiter checks the cluster
+// version instead.
+func (b *WaiterBuilder) SetUpgrade(namespace, name string) *WaiterBuilder {
+	b.namespace = namespace
+	b.name = name
+	return b
+}
+
+// SetInterval sets the time to wait between checks. This is optional and the default is ten
+// seconds.
+func (b *WaiterBuilder) SetInterval(value time.Duration) *WaiterBuilder {
+	b.interval = value
+	return b
+}
+
+// Build uses the data stored in the builder to create and configure a new waiter.
+func (b *WaiterBuilder) Build() (result *Waiter, err error) {
+	// Check parameters:
+	if b.logger.GetSink() == nil {
+		err = errors.New("logger is mandatory")
+		return
+	}
+	switch b.condition {
+	case WaitBundleLoaded, WaitAllNodesExtracted, WaitUpgradeComplete:
+	case "":
+		err = errors.New("condition is mandatory")
+		return
+	default:
+		err = fmt.Errorf(
+			"condition '%s' isn't valid, it must be one of '%s'",
+			b.condition, strings.Join(WaitConditions, "', '"),
+		)
+		return
+	}
+	if (b.namespace == "") != (b.name == "") {
+		err = errors.New("namespace and name of the upgrade must be both set or both empty")
+		return
+	}
+	if b.name != "" && b.condition != WaitUpgradeComplete {
+		err = fmt.Errorf(
+			"upgrade can only be used with the '%s' condition",
+			WaitUpgradeComplete,
+		)
+		return
+	}
+	if b.interval <= 0 {
+		err = fmt.Errorf(
+			"interval %s isn't valid, it must be positive",
+			b.interval,
+		)
+		return
+	}
+
+	// Create the API client if needed:
+	client := b.client
+	if client == nil {
+		var cfg *rest.Config
+		cfg, err = ctrl.GetConfig()
+		if err != nil {
+			return
+		}
+		client, err = clnt.New(cfg, clnt.Options{
+			Scheme: snapshotScheme(),
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	// Create and populate the object:
+	result = &Waiter{
+		logger:    b.logger,
+		client:    client,
+		condition: b.condition,
+		namespace: b.namespace,
+		name:      b.name,
+		interval:  b.interval,
+	}
+	return
+}
+
+// Wait blocks till the condition is met or the context is done. When the context is done it
+// returns an error that wraps ErrWaitTimeout and contains the last observed state. Errors reading
+// the cluster objects are written to the log and the check is retried, so that transient problems
+// with the API server don't abort the wait.
+func (w *Waiter) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	message := "condition hasn't been checked yet"
+	for {
+		met, current, err := w.Check(ctx)
+		switch {
+		case err != nil:
+			w.logger.Error(
+				err,
+				"Failed to check condition, will retry",
+				"condition", w.condition,
+			)
+		case met:
+			w.logger.Info(
+				"Condition is met",
+				"condition", w.condition,
+				"message", current,
+			)
+			return nil
+		default:
+			if current != message {
+				w.logger.Info(
+					"Condition isn't met yet",
+					"condition", w.condition,
+					"message", current,
+				)
+			}
+			message = current
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%w '%s': %s", ErrWaitTimeout, w.condition, message)
+		}
+	}
+}
+
+// Check checks once if the condition is met, and returns a human readable message describing the
+// current state.
+func (w *Waiter) Check(ctx context.Context) (met bool, message string, err error) {
+	switch w.condition {
+	case WaitBundleLoaded:
+		met, message, err = w.checkNodes(ctx, labels.BundleLoaded, "loaded")
+	case WaitAllNodesExtracted:
+		met, message, err = w.checkNodes(ctx, labels.BundleExtracted, "extracted")
+	case WaitUpgradeComplete:
+		if w.name != "" {
+			met, message, err = w.checkUpgrade(ctx)
+		} else {
+			met, message, err = w.checkVersion(ctx)
+		}
+	}
+	return
+}
+
+func (w *Waiter) checkNodes(ctx context.Context, label, verb string) (met bool, message string,
+	err error) {
+	list := &corev1.NodeList{}
+	err = w.client.List(ctx, list)
+	if err != nil {
+		return
+	}
+	if len(list.Items) == 0 {
+		message = "there are no nodes"
+		return
+	}
+	var pending []string
+	for _, node := range list.Items {
+		value, _ := strconv.ParseBool(node.Labels[label])
+		if !value {
+			pending = append(pending, node.Name)
+		}
+	}
+	done := len(list.Items) - len(pending)
+	message = fmt.Sprintf(
+		"bundle is %s in %d of %d nodes", verb, done, len(list.Items),
+	)
+	if len(pending) > 0 {
+		message = fmt.Sprintf(
+			"%s, pending %s", message, strings.Join(pending, ", "),
+		)
+		return
+	}
+	met = true
+	return
+}
+
+func (w *Waiter) checkUpgrade(ctx context.Context) (met bool, message string, err error) {
+	upgrade := &v1alpha1.ClusterUpgrade{}
+	key := clnt.ObjectKey{
+		Namespace: w.namespace,
+		Name:      w.name,
+	}
+	err = w.client.Get(ctx, key, upgrade)
+	if apierrors.IsNotFound(err) {
+		err = nil
+		message = fmt.Sprintf("upgrade '%s/%s' doesn't exist", w.namespace, w.name)
+		return
+	}
+	if err != nil {
+		return
+	}
+	phase := upgrade.Status.Phase
+	if phase == "" {
+		phase = v1alpha1.ClusterUpgradePending
+	}
+	message = fmt.Sprintf("upgrade is in phase '%s'", phase)
+	if upgrade.Status.Message != "" {
+		message = fmt.Sprintf("%s: %s", message, upgrade.Status.Message)
+	}
+	met = upgrade.Status.Phase == v1alpha1.ClusterUpgradeCompleted
+	return
+}
+
+// checkVersion checks if the cluster version operator has completed the requested update. This
+// uses the same criteria than the controller: the most recent entry of the history must be
+// completed and must match the desired update.
+func (w *Waiter) checkVersion(ctx context.Context) (met bool, message string, err error) {
+	version := &configv1.ClusterVersion{}
+	err = w.client.Get(ctx, clnt.ObjectKey{Name: "version"}, version)
+	if apierrors.IsNotFound(err) {
+		err = nil
+		message = "cluster version doesn't exist"
+		return
+	}
+	if err != nil {
+		return
+	}
+	desired := version.Spec.DesiredUpdate
+	if desired == nil || (desired.Version == "" && desired.Image == "") {
+		message = "upgrade hasn't been requested yet"
+		return
+	}
+	history := version.Status.History
+	if len(history) == 0 {
+		message = "cluster version doesn't have history"
+		return
+	}
+	latest := history[0]
+	if desired.Image != "" {
+		met = latest.Image == desired.Image
+	} else {
+		met = latest.Version == desired.Version
+	}
+	met = met && latest.State == configv1.CompletedUpdate
+	message = fmt.Sprintf(
+		"update to version '%s' is in state '%s'",
+		latest.Version, latest.State,
+	)
+	return
+}
+
+// waiterDefaultInterval is the default time to wait between checks.
+const waiterDefaultInterval = 10 * time.Second
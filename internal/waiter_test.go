@@ -0,0 +1,233 @@
+/*
+Copyright 2023 Red Hat Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except in
+compliance with the License. You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under the License is
+distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions and limitations under the
+License.
+*/
+
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2/dsl/core"
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clnt "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/jhernand/upgrade-tool/internal/api/v1alpha1"
+	"github.com/jhernand/upgrade-tool/internal/labels"
+	"github.com/jhernand/upgrade-tool/internal/logging"
+)
+
+var _ = Describe("Waiter", func() {
+	var (
+		ctx    context.Context
+		logger logr.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		// Create a context:
+		ctx = context.Background()
+
+		// Create a logger:
+		logger, err = logging.NewLogger().
+			SetWriter(GinkgoWriter).
+			SetLevel(2).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	makeNode := func(name string, extracted, loaded bool) *corev1.Node {
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{},
+			},
+		}
+		if extracted {
+			node.Labels[labels.BundleExtracted] = "true"
+		}
+		if loaded {
+			node.Labels[labels.BundleLoaded] = "true"
+		}
+		return node
+	}
+
+	makeClient := func(objects ...clnt.Object) clnt.Client {
+		return fake.NewClientBuilder().
+			WithScheme(snapshotScheme()).
+			WithObjects(objects...).
+			Build()
+	}
+
+	It("Can't be created without a condition", func() {
+		waiter, err := NewWaiter().
+			SetLogger(logger).
+			SetClient(makeClient()).
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("condition is mandatory"))
+		Expect(waiter).To(BeNil())
+	})
+
+	It("Can't be created with an unknown condition", func() {
+		waiter, err := NewWaiter().
+			SetLogger(logger).
+			SetClient(makeClient()).
+			SetCondition("junk").
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("'junk' isn't valid"))
+		Expect(waiter).To(BeNil())
+	})
+
+	It("Can't be created with an upgrade for a node condition", func() {
+		waiter, err := NewWaiter().
+			SetLogger(logger).
+			SetClient(makeClient()).
+			SetCondition(WaitBundleLoaded).
+			SetUpgrade("upgrade-tool", "my-upgrade").
+			Build()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(WaitUpgradeComplete))
+		Expect(waiter).To(BeNil())
+	})
+
+	It("Checks that the bundle is extracted in all the nodes", func() {
+		client := makeClient(
+			makeNode("node0", true, false),
+			makeNode("node1", false, false),
+		)
+		waiter, err := NewWaiter().
+			SetLogger(logger).
+			SetClient(client).
+			SetCondition(WaitAllNodesExtracted).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		met, message, err := waiter.Check(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(met).To(BeFalse())
+		Expect(message).To(Equal("bundle is extracted in 1 of 2 nodes, pending node1"))
+
+		// Extract the bundle in the pending node and check again:
+		err = client.Update(ctx, makeNode("node1", true, false))
+		Expect(err).ToNot(HaveOccurred())
+		met, message, err = waiter.Check(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(met).To(BeTrue())
+		Expect(message).To(Equal("bundle is extracted in 2 of 2 nodes"))
+	})
+
+	It("Checks that the bundle is loaded in all the nodes", func() {
+		client := makeClient(
+			makeNode("node0", true, true),
+			makeNode("node1", true, false),
+		)
+		waiter, err := NewWaiter().
+			SetLogger(logger).
+			SetClient(client).
+			SetCondition(WaitBundleLoaded).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		met, message, err := waiter.Check(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(met).To(BeFalse())
+		Expect(message).To(ContainSubstring("pending node1"))
+	})
+
+	It("Checks that the cluster version has completed the update", func() {
+		version := &configv1.ClusterVersion{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "version",
+			},
+			Spec: configv1.ClusterVersionSpec{
+				DesiredUpdate: &configv1.Update{
+					Version: "4.13.4",
+				},
+			},
+			Status: configv1.ClusterVersionStatus{
+				History: []configv1.UpdateHistory{
+					{
+						State:   configv1.PartialUpdate,
+						Version: "4.13.4",
+					},
+					{
+						State:   configv1.CompletedUpdate,
+						Version: "4.12.0",
+					},
+				},
+			},
+		}
+		client := makeClient(version)
+		waiter, err := NewWaiter().
+			SetLogger(logger).
+			SetClient(client).
+			SetCondition(WaitUpgradeComplete).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		met, message, err := waiter.Check(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(met).To(BeFalse())
+		Expect(message).To(Equal("update to version '4.13.4' is in state 'Partial'"))
+
+		// Complete the update and check again:
+		version.Status.History[0].State = configv1.CompletedUpdate
+		err = client.Update(ctx, version)
+		Expect(err).ToNot(HaveOccurred())
+		met, _, err = waiter.Check(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(met).To(BeTrue())
+	})
+
+	It("Checks that the cluster upgrade has completed", func() {
+		upgrade := &v1alpha1.ClusterUpgrade{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "upgrade-tool",
+				Name:      "my-upgrade",
+			},
+			Status: v1alpha1.ClusterUpgradeStatus{
+				Phase:   v1alpha1.ClusterUpgradeCompleted,
+				Message: "Upgrade to version '4.13.4' has completed",
+			},
+		}
+		waiter, err := NewWaiter().
+			SetLogger(logger).
+			SetClient(makeClient(upgrade)).
+			SetCondition(WaitUpgradeComplete).
+			SetUpgrade("upgrade-tool", "my-upgrade").
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		err = waiter.Wait(ctx)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Times out if the condition isn't met", func() {
+		waiter, err := NewWaiter().
+			SetLogger(logger).
+			SetClient(makeClient(makeNode("node0", false, false))).
+			SetCondition(WaitAllNodesExtracted).
+			SetInterval(10 * time.Millisecond).
+			Build()
+		Expect(err).ToNot(HaveOccurred())
+		timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		err = waiter.Wait(timeout)
+		Expect(err).To(MatchError(ErrWaitTimeout))
+		Expect(err.Error()).To(ContainSubstring("pending node0"))
+	})
+})
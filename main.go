@@ -34,9 +34,17 @@ func main() {
 		SetIn(os.Stdin).
 		SetOut(os.Stdout).
 		SetErr(os.Stderr).
+		AddCommand(cmd.Collect).
+		AddCommand(cmd.Convert).
 		AddCommand(cmd.Create).
+		AddCommand(cmd.Docs).
+		AddCommand(cmd.Estimate).
+		AddCommand(cmd.GC).
+		AddCommand(cmd.Generate).
 		AddCommand(cmd.Start).
+		AddCommand(cmd.Verify).
 		AddCommand(cmd.Version).
+		AddCommand(cmd.Wait).
 		Build()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())